@@ -16,10 +16,13 @@
 package client
 
 import (
+	"bytes"
 	"code.google.com/p/goprotobuf/proto"
+	"compress/flate"
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	"hash"
@@ -45,14 +48,38 @@ func (p *ProtobufEncoder) EncodeMessage(msg *message.Message) ([]byte, error) {
 func (p *ProtobufEncoder) EncodeMessageStream(msg *message.Message, outBytes *[]byte) (err error) {
 	msgBytes, err := p.EncodeMessage(msg) // TODO if we compute the size of the header first this can be marshaled directly to outBytes
 	if err == nil {
-		err = createStream(msgBytes, outBytes, p.signer)
+		err = createStream(msgBytes, msgBytes, outBytes, p.signer)
 	}
 	return
 }
 
-func createStream(msgBytes []byte, outBytes *[]byte, msc *message.MessageSigningConfig) error {
+// Like EncodeMessageStream, but the message is compressed with deflate
+// before being framed, for peers that negotiated compression. The HMAC still
+// covers the uncompressed message.
+func (p *ProtobufEncoder) EncodeCompressedMessageStream(msg *message.Message,
+	outBytes *[]byte) (err error) {
+
+	msgBytes, err := p.EncodeMessage(msg)
+	if err != nil {
+		return
+	}
+	var compressed bytes.Buffer
+	w, _ := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if _, err = w.Write(msgBytes); err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = createStream(msgBytes, compressed.Bytes(), outBytes, p.signer)
+	}
+	return
+}
+
+// Frames the body, signing msgBytes (the body itself unless it's compressed).
+func createStream(msgBytes, body []byte, outBytes *[]byte,
+	msc *message.MessageSigningConfig) error {
+
 	h := &message.Header{}
-	h.SetMessageLength(uint32(len(msgBytes)))
+	h.SetMessageLength(uint32(len(body)))
 	if msc != nil {
 		h.SetHmacSigner(msc.Name)
 		h.SetHmacKeyVersion(msc.Version)
@@ -61,6 +88,9 @@ func createStream(msgBytes []byte, outBytes *[]byte, msc *message.MessageSigning
 		case "sha1":
 			hm = hmac.New(sha1.New, []byte(msc.Key))
 			h.SetHmacHashFunction(message.Header_SHA1)
+		case "sha256":
+			hm = hmac.New(sha256.New, []byte(msc.Key))
+			h.SetHmacHashFunction(message.Header_SHA256)
 		default:
 			hm = hmac.New(md5.New, []byte(msc.Key))
 		}
@@ -69,7 +99,7 @@ func createStream(msgBytes []byte, outBytes *[]byte, msc *message.MessageSigning
 		h.SetHmac(hm.Sum(nil))
 	}
 	headerSize := proto.Size(h)
-	requiredSize := message.HEADER_FRAMING_SIZE + headerSize + len(msgBytes)
+	requiredSize := message.HEADER_FRAMING_SIZE + headerSize + len(body)
 	if requiredSize > message.MAX_RECORD_SIZE {
 		return fmt.Errorf("Message too big, requires %d (MAX_RECORD_SIZE = %d)",
 			message.MAX_RECORD_SIZE, requiredSize)
@@ -89,6 +119,6 @@ func createStream(msgBytes []byte, outBytes *[]byte, msc *message.MessageSigning
 		return err
 	}
 	(*outBytes)[headerSize+message.HEADER_DELIMITER_SIZE] = message.UNIT_SEPARATOR
-	copy((*outBytes)[message.HEADER_FRAMING_SIZE+headerSize:], msgBytes)
+	copy((*outBytes)[message.HEADER_FRAMING_SIZE+headerSize:], body)
 	return nil
 }
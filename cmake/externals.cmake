@@ -135,6 +135,8 @@ add_dependencies(slices raw)
 git_clone(https://github.com/feyeleanor/sets 6c54cb57ea406ff6354256a4847e37298194478f)
 add_dependencies(sets slices)
 git_clone(https://github.com/crowdmob/goamz e9a919b6da95151fc77b1b7bb3e78a8a68379aa1)
+git_clone(https://github.com/eapache/go-resiliency v1.0.0)
+git_clone(https://github.com/Shopify/sarama v1.0.0)
 git_clone(https://github.com/rafrombrc/gospec 2e46585948f47047b0c217d00fa24bbc4e370e6b)
 git_clone(https://github.com/crankycoder/g2s 2594f7a035ed881bb10618bc5dc4440ef35c6a29)
 git_clone(https://github.com/crankycoder/xmlpath 670b185b686fd11aa115291fb2f6dc3ed7ebb488)
@@ -154,9 +156,11 @@ if (INCLUDE_DOCUMENTATION)
 endif()
 
 hg_clone(https://code.google.com/p/go-uuid default)
+hg_clone(https://code.google.com/p/go.text default)
 hg_clone(https://code.google.com/p/goprotobuf default)
 add_custom_command(TARGET goprotobuf POST_BUILD
 COMMAND ${GO_EXECUTABLE} install code.google.com/p/goprotobuf/protoc-gen-go)
+hg_clone(https://code.google.com/p/snappy-go default)
 
 include(plugin_loader OPTIONAL)
 
@@ -0,0 +1,267 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+/*
+
+Heka Tail client.
+
+Connects to the Server-Sent Events endpoint of a TailOutput and prints the
+messages matching a message matcher as they go through the pipeline, with
+colorized headers and fields and long payloads folded, a `tail -f` over the
+whole Heka instance.
+
+*/
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ANSI escape sequences used when colors are on.
+const (
+	colorReset  = "\x1b[0m"
+	colorBold   = "\x1b[1m"
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorBlue   = "\x1b[34m"
+	colorCyan   = "\x1b[36m"
+	colorGray   = "\x1b[90m"
+)
+
+var severityNames = []string{"EMERG", "ALERT", "CRIT", "ERR", "WARNING",
+	"NOTICE", "INFO", "DEBUG"}
+
+type Printer struct {
+	color bool
+	// Width payload lines are folded at, 0 disables folding.
+	foldWidth int
+	// Maximum number of payload lines printed, 0 prints them all.
+	maxLines  int
+	noPayload bool
+	out       io.Writer
+}
+
+// Wraps s in the color if colors are on.
+func (p *Printer) paint(color, s string) string {
+	if !p.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+func (p *Printer) severityColor(severity int32) string {
+	switch {
+	case severity <= 3:
+		return colorRed
+	case severity == 4:
+		return colorYellow
+	case severity == 5:
+		return colorBlue
+	}
+	return colorGray
+}
+
+func severityName(severity int32) string {
+	if severity >= 0 && int(severity) < len(severityNames) {
+		return severityNames[severity]
+	}
+	return fmt.Sprint(severity)
+}
+
+// Returns the field's values, comma separated.
+func fieldValues(field *message.Field) string {
+	var values []string
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		for _, v := range field.GetValueString() {
+			values = append(values, fmt.Sprintf("%q", v))
+		}
+	case message.Field_BYTES:
+		for _, v := range field.GetValueBytes() {
+			values = append(values, fmt.Sprintf("%x", v))
+		}
+	case message.Field_INTEGER:
+		for _, v := range field.GetValueInteger() {
+			values = append(values, fmt.Sprint(v))
+		}
+	case message.Field_DOUBLE:
+		for _, v := range field.GetValueDouble() {
+			values = append(values, fmt.Sprint(v))
+		}
+	case message.Field_BOOL:
+		for _, v := range field.GetValueBool() {
+			values = append(values, fmt.Sprint(v))
+		}
+	}
+	return strings.Join(values, ", ")
+}
+
+// Splits the line into chunks of at most width runes.
+func fold(line string, width int) (chunks []string) {
+	if width <= 0 || utf8.RuneCountInString(line) <= width {
+		return []string{line}
+	}
+	for utf8.RuneCountInString(line) > width {
+		i, n := 0, 0
+		for n < width {
+			_, size := utf8.DecodeRuneInString(line[i:])
+			i += size
+			n++
+		}
+		chunks = append(chunks, line[:i])
+		line = line[i:]
+	}
+	return append(chunks, line)
+}
+
+// Prints the message: a header line, a line per field and the folded
+// payload, cut at maxLines.
+func (p *Printer) Print(msg *message.Message) {
+	severity := msg.GetSeverity()
+	ts := time.Unix(0, msg.GetTimestamp()).Format("2006-01-02 15:04:05.000")
+	fmt.Fprintf(p.out, "%s %s %s %s@%s[%d]\n", p.paint(colorGray, ts),
+		p.paint(p.severityColor(severity), fmt.Sprintf("%-7s", severityName(severity))),
+		p.paint(colorBold, msg.GetType()), msg.GetLogger(), msg.GetHostname(),
+		msg.GetPid())
+
+	for _, field := range msg.Fields {
+		repr := ""
+		if field.GetRepresentation() != "" {
+			repr = p.paint(colorGray, " ("+field.GetRepresentation()+")")
+		}
+		fmt.Fprintf(p.out, "    %s = %s%s\n", p.paint(colorCyan, field.GetName()),
+			fieldValues(field), repr)
+	}
+
+	payload := strings.TrimRight(msg.GetPayload(), "\n")
+	if p.noPayload || payload == "" {
+		return
+	}
+	var lines []string
+	for _, line := range strings.Split(payload, "\n") {
+		lines = append(lines, fold(line, p.foldWidth)...)
+	}
+	if p.maxLines > 0 && len(lines) > p.maxLines {
+		more := len(lines) - p.maxLines
+		lines = append(lines[:p.maxLines], p.paint(colorGray,
+			fmt.Sprintf("... (%d more lines)", more)))
+	}
+	for _, line := range lines {
+		fmt.Fprintf(p.out, "  %s %s\n", p.paint(colorGray, "|"), line)
+	}
+}
+
+// Reads the events from the stream, printing the message each one carries
+// until the stream ends.
+func (p *Printer) readEvents(r io.Reader) (err error) {
+	reader := bufio.NewReader(r)
+	var data []string
+	for {
+		var line string
+		if line, err = reader.ReadString('\n'); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "data:") {
+			data = append(data, strings.TrimPrefix(line[5:], " "))
+			continue
+		}
+		if line != "" || len(data) == 0 {
+			continue
+		}
+		msg := new(message.Message)
+		if e := json.Unmarshal([]byte(strings.Join(data, "\n")), msg); e != nil {
+			log.Printf("Tail: [error] decode message: %s\n", e)
+		} else {
+			p.Print(msg)
+		}
+		data = data[:0]
+	}
+}
+
+// Connects to the TailOutput, streaming the messages to the printer until
+// the connection is closed.
+func tail(tailUrl, match string, p *Printer) (err error) {
+	u, err := url.Parse(tailUrl)
+	if err != nil {
+		return fmt.Errorf("invalid url: %s", err)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/events"
+	}
+	query := u.Query()
+	query.Set("match", match)
+	u.RawQuery = query.Encode()
+
+	resp, err := http.Get(u.String())
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(body))
+	}
+	return p.readEvents(resp.Body)
+}
+
+func main() {
+	flagUrl := flag.String("url", "http://127.0.0.1:4353", "TailOutput to connect to")
+	flagMatch := flag.String("match", "TRUE", "Message matcher selecting the messages to print")
+	flagNoColor := flag.Bool("no-color", false, "Disable colors")
+	flagFold := flag.Int("fold", 120, "Width payload lines are folded at, 0 to disable")
+	flagMaxLines := flag.Int("max-lines", 10, "Payload lines printed per message, 0 for all")
+	flagNoPayload := flag.Bool("no-payload", false, "Don't print the payloads")
+	flagReconnect := flag.Duration("reconnect", 0,
+		"Delay before reconnecting when the connection is lost, 0 to exit instead")
+
+	flag.Parse()
+
+	p := &Printer{
+		color:     !*flagNoColor,
+		foldWidth: *flagFold,
+		maxLines:  *flagMaxLines,
+		noPayload: *flagNoPayload,
+		out:       os.Stdout,
+	}
+
+	for {
+		err := tail(*flagUrl, *flagMatch, p)
+		if err != nil {
+			log.Printf("Tail: [error] %s\n", err)
+		}
+		if *flagReconnect <= 0 {
+			if err != nil {
+				os.Exit(1)
+			}
+			return
+		}
+		time.Sleep(*flagReconnect)
+	}
+}
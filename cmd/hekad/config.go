@@ -20,15 +20,18 @@ package main
 import (
 	"fmt"
 	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/pipeline"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 )
 
 type HekadConfig struct {
 	Maxprocs              int           `toml:"maxprocs"`
 	PoolSize              int           `toml:"poolsize"`
+	MaxPoolSize           int           `toml:"max_pool_size"`
 	DecoderPoolSize       int           `toml:"decoder_poolsize"`
 	ChanSize              int           `toml:"plugin_chansize"`
 	CpuProfName           string        `toml:"cpuprof"`
@@ -39,6 +42,37 @@ type HekadConfig struct {
 	MaxMsgTimerInject     uint          `toml:"max_timer_inject"`
 	MaxPackIdle           time.Duration `toml:"max_pack_idle"`
 	BaseDir               string        `toml:"base_dir"`
+	AdminAddr             string        `toml:"admin_addr"`
+	AdminSocket           string        `toml:"admin_socket"`
+	AdminSocketMode       string        `toml:"admin_socket_mode"`
+	MetricsAddr           string        `toml:"metrics_addr"`
+	RouterWorkers         int           `toml:"router_workers"`
+	RouterShardField      string        `toml:"router_shard_field"`
+	DiskBudgetTotal       uint64        `toml:"disk_budget_total"`
+	DiskFullAction        string        `toml:"disk_full_action"`
+	DiskCheckInterval     uint          `toml:"disk_check_interval"`
+	SpoolKeyProvider      string        `toml:"spool_key_provider"`
+	SpoolKeyId            string        `toml:"spool_key_id"`
+	ConfigKeyProvider     string        `toml:"config_key_provider"`
+	ConfigKeyId           string        `toml:"config_key_id"`
+	KVStoreMaxSize        uint64        `toml:"kv_store_max_size"`
+	KVStoreFlushInterval  uint          `toml:"kv_store_flush_interval"`
+	LookupCheckInterval   uint          `toml:"lookup_check_interval"`
+	DeadLetterOutput      string        `toml:"dead_letter_output"`
+	DeadLetterFile        string        `toml:"dead_letter_file"`
+	DependencyTimeout     uint          `toml:"dependency_timeout"`
+	ReportHistoryHours    uint          `toml:"report_history_hours"`
+	ReportHistoryInterval uint          `toml:"report_history_interval"`
+	VolumeInterval        uint          `toml:"volume_interval"`
+	VolumeMaxSources      uint          `toml:"volume_max_sources"`
+	EmitVolumeMessages    bool          `toml:"emit_volume_messages"`
+	IdentityProvider      string        `toml:"identity_provider"`
+	IdentitySource        string        `toml:"identity_source"`
+	IdentityField         string        `toml:"identity_field"`
+	ReplayMaxMessages     uint          `toml:"replay_max_messages"`
+	SnapshotDir           string        `toml:"snapshot_dir"`
+	Cgroup                string        `toml:"cgroup"`
+	CgroupMemoryMax       uint64        `toml:"cgroup_memory_max"`
 }
 
 func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
@@ -56,6 +90,21 @@ func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
 		MaxMsgTimerInject:     10,
 		MaxPackIdle:           idle,
 		BaseDir:               filepath.FromSlash("/var/cache/hekad"),
+		RouterWorkers:         1,
+		RouterShardField:      "Logger",
+		DiskFullAction:        pipeline.DISK_FULL_BLOCK,
+		DiskCheckInterval:     10,
+		KVStoreMaxSize:        1 << 20,
+		KVStoreFlushInterval:  10,
+		LookupCheckInterval:   5,
+		DependencyTimeout:     30,
+		ReportHistoryInterval: 60,
+		VolumeInterval:        60,
+		VolumeMaxSources:      1000,
+		EmitVolumeMessages:    true,
+		IdentityProvider:      "os",
+		ReplayMaxMessages:     10000,
+		AdminSocketMode:       "0600",
 	}
 
 	var configFile map[string]toml.Primitive
@@ -90,6 +139,19 @@ func LoadHekadConfig(configPath string) (config *HekadConfig, err error) {
 			err = fmt.Errorf("Can't unmarshal config: %s", err)
 		}
 	}
+	if err == nil {
+		switch config.DiskFullAction {
+		case pipeline.DISK_FULL_BLOCK, pipeline.DISK_FULL_DROP_OLDEST,
+			pipeline.DISK_FULL_ALERT:
+		default:
+			err = fmt.Errorf("Invalid disk_full_action: %s", config.DiskFullAction)
+		}
+	}
+	if err == nil {
+		if _, e := strconv.ParseUint(config.AdminSocketMode, 8, 32); e != nil {
+			err = fmt.Errorf("Invalid admin_socket_mode: %s", config.AdminSocketMode)
+		}
+	}
 
 	return
 }
@@ -33,11 +33,16 @@ import (
 	_ "github.com/mozilla-services/heka/plugins/file"
 	_ "github.com/mozilla-services/heka/plugins/graphite"
 	_ "github.com/mozilla-services/heka/plugins/http"
+	_ "github.com/mozilla-services/heka/plugins/kafka"
 	_ "github.com/mozilla-services/heka/plugins/nagios"
 	_ "github.com/mozilla-services/heka/plugins/payload"
+	_ "github.com/mozilla-services/heka/plugins/probe"
 	_ "github.com/mozilla-services/heka/plugins/process"
+	_ "github.com/mozilla-services/heka/plugins/report"
+	_ "github.com/mozilla-services/heka/plugins/s3"
 	_ "github.com/mozilla-services/heka/plugins/smtp"
 	_ "github.com/mozilla-services/heka/plugins/statsd"
+	_ "github.com/mozilla-services/heka/plugins/syslog"
 	_ "github.com/mozilla-services/heka/plugins/tcp"
 	_ "github.com/mozilla-services/heka/plugins/udp"
 	"io/ioutil"
@@ -46,6 +51,9 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -68,6 +76,7 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 
 	globals := pipeline.DefaultGlobals()
 	globals.PoolSize = poolSize
+	globals.MaxPoolSize = config.MaxPoolSize
 	globals.DecoderPoolSize = decoderPoolSize
 	globals.PluginChanSize = chanSize
 	globals.MaxMsgLoops = maxMsgLoops
@@ -78,15 +87,62 @@ func setGlobalConfigs(config *HekadConfig) (*pipeline.GlobalConfigStruct, string
 	globals.MaxMsgProcessDuration = maxMsgProcessDuration
 	globals.MaxMsgTimerInject = maxMsgTimerInject
 	globals.BaseDir = config.BaseDir
+	globals.AdminAddr = config.AdminAddr
+	globals.AdminSocket = config.AdminSocket
+	adminSocketMode, _ := strconv.ParseUint(config.AdminSocketMode, 8, 32)
+	globals.AdminSocketMode = os.FileMode(adminSocketMode)
+	globals.MetricsAddr = config.MetricsAddr
+	globals.RouterWorkers = config.RouterWorkers
+	globals.RouterShardField = config.RouterShardField
+	globals.DiskBudgetTotal = config.DiskBudgetTotal
+	globals.DiskFullAction = config.DiskFullAction
+	globals.DiskCheckInterval = time.Duration(config.DiskCheckInterval) * time.Second
+	globals.KVStoreMaxSize = config.KVStoreMaxSize
+	globals.KVStoreFlushInterval = time.Duration(config.KVStoreFlushInterval) * time.Second
+	globals.LookupCheckInterval = time.Duration(config.LookupCheckInterval) * time.Second
+	globals.DeadLetterOutput = config.DeadLetterOutput
+	globals.DeadLetterFile = config.DeadLetterFile
+	globals.DependencyTimeout = time.Duration(config.DependencyTimeout) * time.Second
+	globals.ReportHistory = time.Duration(config.ReportHistoryHours) * time.Hour
+	globals.ReportHistoryInterval = time.Duration(config.ReportHistoryInterval) * time.Second
+	globals.VolumeInterval = time.Duration(config.VolumeInterval) * time.Second
+	globals.VolumeMaxSources = int(config.VolumeMaxSources)
+	globals.EmitVolumeMessages = config.EmitVolumeMessages
+	globals.IdentityField = config.IdentityField
+	globals.ReplayMaxMessages = int(config.ReplayMaxMessages)
+	globals.SnapshotDir = config.SnapshotDir
+	globals.Cgroup = config.Cgroup
+	globals.CgroupMemoryMax = config.CgroupMemoryMax
 
 	return globals, cpuProfName, memProfName
 }
 
+// Prints the encrypted form of the value read from stdin, ignoring its
+// trailing newline.
+func encryptValue(sc *pipeline.SpoolCipher) {
+	if sc == nil {
+		log.Fatal("config_key_provider must be set to encrypt values")
+	}
+	plain, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal("Error reading value: ", err)
+	}
+	value, err := pipeline.EncryptConfigValue(sc, strings.TrimRight(string(plain), "\r\n"))
+	if err != nil {
+		log.Fatal("Error encrypting value: ", err)
+	}
+	fmt.Println(value)
+}
+
 func main() {
 	configPath := flag.String("config", filepath.FromSlash("/etc/hekad.toml"),
 		"Config file or directory. If directory is specified then all files "+
 			"in the directory will be loaded.")
 	version := flag.Bool("version", false, "Output version and exit")
+	encrypt := flag.Bool("encrypt", false, "Read a value from stdin, output "+
+		"its encrypted form for the plugin config and exit")
+	restore := flag.String("restore", "", "Snapshot directory whose files are "+
+		"restored into the base_dir before the pipeline starts")
 	flag.Parse()
 
 	config := &HekadConfig{}
@@ -109,10 +165,38 @@ func main() {
 		log.Fatal("Error reading config: ", err)
 	}
 	globals, cpuProfName, memProfName := setGlobalConfigs(config)
+	if config.SpoolKeyProvider != "" {
+		if globals.SpoolCipher, err = pipeline.NewSpoolCipher(
+			config.SpoolKeyProvider, config.SpoolKeyId); err != nil {
+			log.Fatal("Error setting up spool encryption: ", err)
+		}
+	}
+	if config.ConfigKeyProvider != "" {
+		if globals.ConfigCipher, err = pipeline.NewSpoolCipher(
+			config.ConfigKeyProvider, config.ConfigKeyId); err != nil {
+			log.Fatal("Error setting up config decryption: ", err)
+		}
+	}
+	if globals.Hostname, err = pipeline.ResolveIdentity(config.IdentityProvider,
+		config.IdentitySource); err != nil {
+		log.Fatal("Error resolving identity: ", err)
+	}
+	if *encrypt {
+		encryptValue(globals.ConfigCipher)
+		os.Exit(0)
+	}
 
 	if err = os.MkdirAll(globals.BaseDir, 0755); err != nil {
 		log.Fatalf("Error creating base_dir %s: %s", config.BaseDir, err)
 	}
+	if *restore != "" {
+		manifest, err := pipeline.RestoreSnapshot(*restore, globals.BaseDir)
+		if err != nil {
+			log.Fatal("Error restoring snapshot: ", err)
+		}
+		log.Printf("Restored %d files of the snapshot taken on %s at %s",
+			len(manifest.Files), manifest.Hostname, manifest.Created)
+	}
 
 	if cpuProfName != "" {
 		profFile, err := os.Create(cpuProfName)
@@ -138,21 +222,12 @@ func main() {
 		}()
 	}
 
+	// Keep the secrets resolved from the plugin configs out of the logs.
+	log.SetOutput(pipeline.NewSecretRedactor(os.Stderr))
+
 	// Set up and load the pipeline configuration and start the daemon.
 	pipeconf := pipeline.NewPipelineConfig(globals)
-	p, err := os.Open(*configPath)
-	fi, err := p.Stat()
-
-	if fi.IsDir() {
-		files, _ := ioutil.ReadDir(*configPath)
-		for _, f := range files {
-			err = pipeconf.LoadFromConfigFile(filepath.Join(*configPath, f.Name()))
-		}
-	} else {
-		err = pipeconf.LoadFromConfigFile(*configPath)
-	}
-
-	if err != nil {
+	if err = pipeconf.LoadFromConfigPath(*configPath); err != nil {
 		log.Fatal("Error reading config: ", err)
 	}
 	pipeline.Run(pipeconf)
@@ -16,17 +16,20 @@ var _ = math.Inf
 type Header_HmacHashFunction int32
 
 const (
-	Header_MD5  Header_HmacHashFunction = 0
-	Header_SHA1 Header_HmacHashFunction = 1
+	Header_MD5    Header_HmacHashFunction = 0
+	Header_SHA1   Header_HmacHashFunction = 1
+	Header_SHA256 Header_HmacHashFunction = 2
 )
 
 var Header_HmacHashFunction_name = map[int32]string{
 	0: "MD5",
 	1: "SHA1",
+	2: "SHA256",
 }
 var Header_HmacHashFunction_value = map[string]int32{
-	"MD5":  0,
-	"SHA1": 1,
+	"MD5":    0,
+	"SHA1":   1,
+	"SHA256": 2,
 }
 
 func (x Header_HmacHashFunction) Enum() *Header_HmacHashFunction {
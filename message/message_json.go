@@ -0,0 +1,256 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Canonical JSON representation of a message, see MarshalMessageJSON.
+type jsonMessage struct {
+	Uuid       string      `json:"uuid"`
+	Timestamp  int64       `json:"timestamp"`
+	Type       *string     `json:"type,omitempty"`
+	Logger     *string     `json:"logger,omitempty"`
+	Severity   *int32      `json:"severity,omitempty"`
+	Payload    *string     `json:"payload,omitempty"`
+	EnvVersion *string     `json:"env_version,omitempty"`
+	Pid        *int32      `json:"pid,omitempty"`
+	Hostname   *string     `json:"hostname,omitempty"`
+	Fields     []jsonField `json:"fields,omitempty"`
+}
+
+type jsonField struct {
+	Name           string          `json:"name"`
+	Type           string          `json:"type"`
+	Representation string          `json:"representation,omitempty"`
+	Value          json.RawMessage `json:"value"`
+}
+
+// JSON strings standing for the doubles JSON numbers can't represent.
+const (
+	jsonNaN      = "NaN"
+	jsonInf      = "Infinity"
+	jsonMinusInf = "-Infinity"
+)
+
+// Returns the name of a field value type in the JSON representation.
+func jsonTypeName(t Field_ValueType) string {
+	return strings.ToLower(Field_ValueType_name[int32(t)])
+}
+
+// Serializes the message to its canonical JSON representation, a stable
+// format holding everything the protobuf encoding does:
+//
+//	{"uuid": "f8d3a2e6-...", "timestamp": <ns since the epoch>,
+//	 "type": ..., "logger": ..., "severity": ..., "payload": ...,
+//	 "env_version": ..., "pid": ..., "hostname": ...,
+//	 "fields": [{"name": ..., "type": "string", "representation": ...,
+//	             "value": [...]}, ...]}
+//
+// Headers that aren't set are left out. Field types are "string", "bytes"
+// (base64 encoded), "integer", "double" (with "NaN", "Infinity" and
+// "-Infinity" strings for the non-finite values) and "bool", and the value
+// is always an array. The keys are always in this order.
+func MarshalMessageJSON(msg *Message) (data []byte, err error) {
+	jm := jsonMessage{
+		Uuid:       msg.GetUuidString(),
+		Timestamp:  msg.GetTimestamp(),
+		Type:       msg.Type,
+		Logger:     msg.Logger,
+		Severity:   msg.Severity,
+		Payload:    msg.Payload,
+		EnvVersion: msg.EnvVersion,
+		Pid:        msg.Pid,
+		Hostname:   msg.Hostname,
+		Fields:     make([]jsonField, 0, len(msg.Fields)),
+	}
+	for _, field := range msg.Fields {
+		jf := jsonField{
+			Name:           field.GetName(),
+			Type:           jsonTypeName(field.GetValueType()),
+			Representation: field.GetRepresentation(),
+		}
+		var values interface{}
+		switch field.GetValueType() {
+		case Field_STRING:
+			values = field.ValueString
+		case Field_BYTES:
+			encoded := make([]string, len(field.ValueBytes))
+			for i, value := range field.ValueBytes {
+				encoded[i] = base64.StdEncoding.EncodeToString(value)
+			}
+			values = encoded
+		case Field_INTEGER:
+			values = field.ValueInteger
+		case Field_DOUBLE:
+			doubles := make([]interface{}, len(field.ValueDouble))
+			for i, value := range field.ValueDouble {
+				switch {
+				case math.IsNaN(value):
+					doubles[i] = jsonNaN
+				case math.IsInf(value, 1):
+					doubles[i] = jsonInf
+				case math.IsInf(value, -1):
+					doubles[i] = jsonMinusInf
+				default:
+					doubles[i] = value
+				}
+			}
+			values = doubles
+		case Field_BOOL:
+			values = field.ValueBool
+		default:
+			return nil, fmt.Errorf("field %s: unknown value type %d", jf.Name,
+				field.GetValueType())
+		}
+		if jf.Value, err = json.Marshal(values); err != nil {
+			return nil, fmt.Errorf("field %s: %s", jf.Name, err)
+		}
+		if bytes.Equal(jf.Value, []byte("null")) {
+			jf.Value = []byte("[]")
+		}
+		jm.Fields = append(jm.Fields, jf)
+	}
+	return json.Marshal(jm)
+}
+
+func parseJsonUuid(s string) (id []byte, err error) {
+	if id, err = hex.DecodeString(strings.Replace(s, "-", "", -1)); err != nil ||
+		len(id) != UUID_SIZE {
+		return nil, fmt.Errorf("invalid uuid: %q", s)
+	}
+	return
+}
+
+// Decodes a field value array of the named type into a field.
+func decodeJsonValues(field *Field, typeName string, raw json.RawMessage) (
+	err error) {
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var values []interface{}
+	if err = decoder.Decode(&values); err != nil {
+		return
+	}
+	for _, value := range values {
+		var ok bool
+		switch typeName {
+		case "string":
+			var s string
+			if s, ok = value.(string); ok {
+				field.ValueString = append(field.ValueString, s)
+			}
+		case "bytes":
+			var s string
+			if s, ok = value.(string); ok {
+				var b []byte
+				if b, err = base64.StdEncoding.DecodeString(s); err != nil {
+					return
+				}
+				field.ValueBytes = append(field.ValueBytes, b)
+			}
+		case "integer":
+			var n json.Number
+			if n, ok = value.(json.Number); ok {
+				var i int64
+				if i, err = strconv.ParseInt(string(n), 10, 64); err != nil {
+					return
+				}
+				field.ValueInteger = append(field.ValueInteger, i)
+			}
+		case "double":
+			var d float64
+			switch v := value.(type) {
+			case json.Number:
+				if d, err = strconv.ParseFloat(string(v), 64); err != nil {
+					return
+				}
+				ok = true
+			case string:
+				ok = true
+				switch v {
+				case jsonNaN:
+					d = math.NaN()
+				case jsonInf:
+					d = math.Inf(1)
+				case jsonMinusInf:
+					d = math.Inf(-1)
+				default:
+					ok = false
+				}
+			}
+			field.ValueDouble = append(field.ValueDouble, d)
+		case "bool":
+			var b bool
+			if b, ok = value.(bool); ok {
+				field.ValueBool = append(field.ValueBool, b)
+			}
+		}
+		if !ok {
+			return fmt.Errorf("invalid %s value: %v", typeName, value)
+		}
+	}
+	return
+}
+
+// Replaces the message with the one held by its canonical JSON
+// representation, as produced by MarshalMessageJSON. The message is left
+// alone if the data can't be decoded.
+func UnmarshalMessageJSON(data []byte, msg *Message) (err error) {
+	var jm jsonMessage
+	if err = json.Unmarshal(data, &jm); err != nil {
+		return
+	}
+	decoded := &Message{
+		Timestamp:  &jm.Timestamp,
+		Type:       jm.Type,
+		Logger:     jm.Logger,
+		Severity:   jm.Severity,
+		Payload:    jm.Payload,
+		EnvVersion: jm.EnvVersion,
+		Pid:        jm.Pid,
+		Hostname:   jm.Hostname,
+	}
+	if decoded.Uuid, err = parseJsonUuid(jm.Uuid); err != nil {
+		return
+	}
+	for _, jf := range jm.Fields {
+		if jf.Name == "" {
+			return errors.New("field without a name")
+		}
+		valueType, ok := Field_ValueType_value[strings.ToUpper(jf.Type)]
+		if !ok || jf.Type != strings.ToLower(jf.Type) {
+			return fmt.Errorf("field %s: unknown type %q", jf.Name, jf.Type)
+		}
+		field := NewFieldInit(jf.Name, Field_ValueType(valueType), jf.Representation)
+		if len(jf.Value) > 0 {
+			if err = decodeJsonValues(field, jf.Type, jf.Value); err != nil {
+				return fmt.Errorf("field %s: %s", jf.Name, err)
+			}
+		}
+		decoded.AddField(field)
+	}
+	*msg = *decoded
+	return
+}
@@ -0,0 +1,84 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package message
+
+import (
+	"github.com/rafrombrc/gospec/src/gospec"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"math"
+)
+
+func MessageJsonSpec(c gospec.Context) {
+	c.Specify("The canonical JSON representation", func() {
+		msg := getTestMessage()
+		f, _ := NewField("raw", []byte{0, 1, 0xff}, "")
+		msg.AddField(f)
+		f, _ = NewField("ratio", 0.25, "%")
+		f.AddValue(math.Inf(-1))
+		msg.AddField(f)
+		f, _ = NewField("ok", true, "")
+		msg.AddField(f)
+		f, _ = NewField("big", int64(math.MaxInt64), "")
+		msg.AddField(f)
+
+		c.Specify("round trips the message", func() {
+			data, err := MarshalMessageJSON(msg)
+			c.Assume(err, gs.IsNil)
+			decoded := new(Message)
+			err = UnmarshalMessageJSON(data, decoded)
+			c.Assume(err, gs.IsNil)
+			c.Expect(decoded.Equals(msg), gs.IsTrue)
+			c.Expect(decoded.FindFirstField("big").ValueInteger[0], gs.Equals,
+				int64(math.MaxInt64))
+			c.Expect(math.IsInf(decoded.FindFirstField("ratio").ValueDouble[1], -1),
+				gs.IsTrue)
+		})
+
+		c.Specify("is stable", func() {
+			msg := new(Message)
+			msg.SetUuid([]byte("0123456789abcdef"))
+			msg.SetTimestamp(1400000000000000000)
+			msg.SetType("test")
+			f, _ := NewField("count", 3, "B")
+			msg.AddField(f)
+			f, _ = NewField("raw", []byte("heka"), "")
+			msg.AddField(f)
+			data, err := MarshalMessageJSON(msg)
+			c.Assume(err, gs.IsNil)
+			c.Expect(string(data), gs.Equals, `{"uuid":"30313233-3435-3637-3839-616263646566",`+
+				`"timestamp":1400000000000000000,"type":"test","fields":[`+
+				`{"name":"count","type":"integer","representation":"B","value":[3]},`+
+				`{"name":"raw","type":"bytes","value":["aGVrYQ=="]}]}`)
+		})
+
+		c.Specify("rejects invalid messages", func() {
+			decoded := new(Message)
+			decoded.SetPayload("untouched")
+			bad := []string{
+				`{"uuid":"nope","timestamp":1}`,
+				`{"uuid":"30313233-3435-3637-3839-616263646566","timestamp":1,` +
+					`"fields":[{"name":"f","type":"decimal","value":[1]}]}`,
+				`{"uuid":"30313233-3435-3637-3839-616263646566","timestamp":1,` +
+					`"fields":[{"name":"f","type":"integer","value":["1"]}]}`,
+				`{"uuid":"30313233-3435-3637-3839-616263646566","timestamp":1,` +
+					`"fields":[{"name":"f","type":"integer","value":[1.5]}]}`,
+			}
+			for _, data := range bad {
+				c.Expect(UnmarshalMessageJSON([]byte(data), decoded), gs.Not(gs.IsNil))
+			}
+			c.Expect(decoded.GetPayload(), gs.Equals, "untouched")
+		})
+	})
+}
@@ -14,6 +14,13 @@
 
 package message
 
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
 // MatcherSpecification used by the message router to distribute messages
 type MatcherSpecification struct {
 	vm   *tree
@@ -43,6 +50,91 @@ func (m *MatcherSpecification) String() string {
 	return m.spec
 }
 
+// PredicateResult is the outcome of testing a single predicate of a matcher
+// spec against a message.
+type PredicateResult struct {
+	Predicate string
+	Match     bool
+}
+
+// Explain compares the message against the matcher spec like Match, also
+// returning the result of every predicate in the order they appear in the
+// spec. All of the predicates are tested, including the ones Match would
+// short circuit.
+func (m *MatcherSpecification) Explain(message *Message) (match bool,
+	predicates []PredicateResult) {
+
+	predicates = explainMatcherSpecification(m.vm, message, predicates)
+	return m.Match(message), predicates
+}
+
+func explainMatcherSpecification(t *tree, msg *Message,
+	predicates []PredicateResult) []PredicateResult {
+
+	if t == nil {
+		return predicates
+	}
+	if t.left == nil {
+		return append(predicates, PredicateResult{t.stmt.String(),
+			testExpr(msg, t.stmt)})
+	}
+	predicates = explainMatcherSpecification(t.left, msg, predicates)
+	return explainMatcherSpecification(t.right, msg, predicates)
+}
+
+func formatDouble(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// String outputs the statement in matcher spec syntax.
+func (s *Statement) String() string {
+	field := s.field.token
+	if s.field.tokenId == VAR_FIELDS {
+		field = fmt.Sprintf("Fields[%s][%d][%d]", field, s.field.fieldIndex,
+			s.field.arrayIndex)
+	}
+	var op, value string
+	switch s.op.tokenId {
+	case TRUE, FALSE:
+		return s.op.token
+	case OP_EXISTS:
+		return "EXISTS " + field
+	case OP_NEXISTS:
+		return "NOT EXISTS " + field
+	case OP_RE, OP_NRE:
+		op = s.op.token
+		value = "/" + s.value.regexp.String() + "/"
+	case OP_IN, OP_NIN:
+		op = "IN"
+		if s.op.tokenId == OP_NIN {
+			op = "NOT IN"
+		}
+		var items []string
+		if s.value.tokenId == STRING_VALUE {
+			for item := range s.value.stringSet {
+				items = append(items, strconv.Quote(item))
+			}
+		} else {
+			for item := range s.value.numericSet {
+				items = append(items, formatDouble(item))
+			}
+		}
+		sort.Strings(items)
+		value = "(" + strings.Join(items, ", ") + ")"
+	case OP_BETWEEN:
+		op = "BETWEEN"
+		value = formatDouble(s.value.double) + " AND " + formatDouble(s.value.upper)
+	default:
+		op = s.op.token
+		if s.value.tokenId == STRING_VALUE {
+			value = strconv.Quote(s.value.token)
+		} else {
+			value = s.value.token
+		}
+	}
+	return fmt.Sprintf("%s %s %s", field, op, value)
+}
+
 func evalMatcherSpecification(t *tree, msg *Message) (b bool) {
 	if t == nil {
 		return false
@@ -114,6 +206,10 @@ func stringTest(s string, stmt *Statement) bool {
 		return stmt.value.regexp.MatchString(s)
 	case OP_NRE:
 		return !stmt.value.regexp.MatchString(s)
+	case OP_IN:
+		return stmt.value.stringSet[s]
+	case OP_NIN:
+		return stmt.value.stringSet != nil && !stmt.value.stringSet[s]
 	}
 	return false
 }
@@ -132,16 +228,62 @@ func numericTest(f float64, stmt *Statement) bool {
 		return (f > stmt.value.double)
 	case OP_GTE:
 		return (f >= stmt.value.double)
+	case OP_IN:
+		return stmt.value.numericSet[f]
+	case OP_NIN:
+		return stmt.value.numericSet != nil && !stmt.value.numericSet[f]
+	case OP_BETWEEN:
+		return (f >= stmt.value.double && f <= stmt.value.upper)
 	}
 	return false
 }
 
+// Returns the message field the statement refers to, or nil if there is no
+// such field.
+func getField(msg *Message, stmt *Statement) (field *Field) {
+	fi := stmt.field.fieldIndex
+	if fi != 0 {
+		fields := msg.FindAllFields(stmt.field.token)
+		if fi >= len(fields) {
+			return nil
+		}
+		return fields[fi]
+	}
+	return msg.FindFirstField(stmt.field.token)
+}
+
+// Returns whether the field and array index the statement refers to exist.
+func fieldExists(msg *Message, stmt *Statement) bool {
+	field := getField(msg, stmt)
+	if field == nil {
+		return false
+	}
+	var count int
+	switch field.GetValueType() {
+	case Field_STRING:
+		count = len(field.ValueString)
+	case Field_BYTES:
+		count = len(field.ValueBytes)
+	case Field_INTEGER:
+		count = len(field.ValueInteger)
+	case Field_DOUBLE:
+		count = len(field.ValueDouble)
+	case Field_BOOL:
+		count = len(field.ValueBool)
+	}
+	return stmt.field.arrayIndex < count
+}
+
 func testExpr(msg *Message, stmt *Statement) bool {
 	switch stmt.op.tokenId {
 	case TRUE:
 		return true
 	case FALSE:
 		return false
+	case OP_EXISTS:
+		return fieldExists(msg, stmt)
+	case OP_NEXISTS:
+		return !fieldExists(msg, stmt)
 	default:
 		switch stmt.field.tokenId {
 		case VAR_UUID, VAR_TYPE, VAR_LOGGER, VAR_PAYLOAD,
@@ -150,20 +292,10 @@ func testExpr(msg *Message, stmt *Statement) bool {
 		case VAR_TIMESTAMP, VAR_SEVERITY, VAR_PID:
 			return numericTest(getNumericValue(msg, stmt), stmt)
 		case VAR_FIELDS:
-			fi := stmt.field.fieldIndex
 			ai := stmt.field.arrayIndex
-			var field *Field
-
-			if fi != 0 {
-				fields := msg.FindAllFields(stmt.field.token)
-				if fi >= len(fields) {
-					return false
-				}
-				field = fields[fi]
-			} else {
-				if field = msg.FindFirstField(stmt.field.token); field == nil {
-					return false
-				}
+			field := getField(msg, stmt)
+			if field == nil {
+				return false
 			}
 			switch field.GetValueType() {
 			case Field_STRING:
@@ -1,9 +1,12 @@
+// Code generated by goyacc -l=false -o=message_matcher_parser.go message_matcher_parser.y. DO NOT EDIT.
 
 //line message_matcher_parser.y:2
 package message
+
 import __yyfmt__ "fmt"
+
 //line message_matcher_parser.y:2
-		
+
 import (
 	"fmt"
 	"log"
@@ -25,7 +28,12 @@ var variables = map[string]int{
 	"Pid":        VAR_PID,
 	"Fields":     VAR_FIELDS,
 	"TRUE":       TRUE,
-	"FALSE":      FALSE}
+	"FALSE":      FALSE,
+	"IN":         IN,
+	"NOT":        NOT,
+	"EXISTS":     EXISTS,
+	"BETWEEN":    BETWEEN,
+	"AND":        AND}
 
 var parseLock sync.Mutex
 
@@ -65,16 +73,18 @@ func (s *stack) pop() (node *tree) {
 
 var nodes []*tree
 
-
-//line message_matcher_parser.y:67
+//line message_matcher_parser.y:72
 type yySymType struct {
-	yys int
-   tokenId     int
-   token       string
-   double      float64
-   fieldIndex  int
-   arrayIndex  int
-   regexp      *regexp.Regexp
+	yys        int
+	tokenId    int
+	token      string
+	double     float64
+	fieldIndex int
+	arrayIndex int
+	regexp     *regexp.Regexp
+	stringSet  map[string]bool
+	numericSet map[float64]bool
+	upper      float64
 }
 
 const OP_EQ = 57346
@@ -102,8 +112,21 @@ const NUMERIC_VALUE = 57367
 const REGEXP_VALUE = 57368
 const TRUE = 57369
 const FALSE = 57370
-
-var yyToknames = []string{
+const OP_IN = 57371
+const OP_NIN = 57372
+const OP_EXISTS = 57373
+const OP_NEXISTS = 57374
+const OP_BETWEEN = 57375
+const IN = 57376
+const NOT = 57377
+const EXISTS = 57378
+const BETWEEN = 57379
+const AND = 57380
+
+var yyToknames = [...]string{
+	"$end",
+	"error",
+	"$unk",
 	"OP_EQ",
 	"OP_NE",
 	"OP_GT",
@@ -129,22 +152,35 @@ var yyToknames = []string{
 	"REGEXP_VALUE",
 	"TRUE",
 	"FALSE",
+	"OP_IN",
+	"OP_NIN",
+	"OP_EXISTS",
+	"OP_NEXISTS",
+	"OP_BETWEEN",
+	"IN",
+	"NOT",
+	"EXISTS",
+	"BETWEEN",
+	"AND",
+	"','",
+	"'('",
+	"')'",
 }
-var yyStatenames = []string{}
+
+var yyStatenames = [...]string{}
 
 const yyEofCode = 1
 const yyErrCode = 2
-const yyMaxDepth = 200
-
-//line message_matcher_parser.y:177
+const yyInitialStackSize = 16
 
+//line message_matcher_parser.y:260
 
 type MatcherSpecificationParser struct {
 	spec     string
 	sym      string
 	peekrune rune
 	lexPos   int
-    reToken *regexp.Regexp
+	reToken  *regexp.Regexp
 }
 
 func parseMatcherSpecification(ms *MatcherSpecification) error {
@@ -403,12 +439,12 @@ regexpstring:
 		m.sym += string(c)
 	}
 	m.sym = m.reToken.ReplaceAllStringFunc(m.sym,
-		func(match string) string {            
-            replace, ok := HelperRegexSubs[match[1:len(match)-1]]
-            if !ok {
-                return match
-            } 
-            return replace
+		func(match string) string {
+			replace, ok := HelperRegexSubs[match[1:len(match)-1]]
+			if !ok {
+				return match
+			}
+			return replace
 		})
 	yylval.regexp, err = regexp.Compile(m.sym)
 	if err != nil {
@@ -460,110 +496,154 @@ func (m *MatcherSpecificationParser) getrune() rune {
 }
 
 //line yacctab:1
-var yyExca = []int{
+var yyExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
 }
 
-const yyNprod = 36
 const yyPrivate = 57344
 
-var yyTokenNames []string
-var yyStates []string
-
-const yyLast = 77
-
-var yyAct = []int{
-
-	13, 14, 15, 16, 17, 18, 19, 20, 21, 10,
-	7, 24, 23, 11, 12, 3, 11, 12, 2, 49,
-	22, 44, 25, 45, 47, 46, 43, 24, 23, 42,
-	38, 29, 30, 31, 32, 33, 34, 35, 23, 6,
-	5, 4, 40, 41, 9, 8, 1, 0, 0, 48,
-	28, 29, 30, 31, 32, 33, 34, 35, 28, 29,
-	30, 31, 32, 33, 26, 27, 0, 0, 0, 0,
-	0, 0, 0, 0, 36, 37, 39,
+const yyLast = 113
+
+var yyAct = [...]int8{
+	73, 71, 16, 17, 18, 19, 20, 21, 22, 23,
+	24, 11, 62, 8, 68, 14, 15, 32, 33, 34,
+	35, 36, 37, 13, 12, 61, 27, 26, 3, 47,
+	33, 34, 35, 36, 37, 38, 39, 32, 33, 34,
+	35, 36, 37, 38, 39, 58, 75, 40, 41, 80,
+	45, 84, 52, 59, 78, 55, 83, 14, 15, 40,
+	41, 66, 45, 69, 72, 74, 86, 40, 41, 77,
+	76, 80, 67, 81, 78, 2, 79, 25, 57, 28,
+	65, 64, 82, 74, 63, 60, 85, 72, 56, 70,
+	51, 27, 26, 26, 31, 7, 29, 44, 30, 6,
+	5, 4, 53, 54, 10, 43, 49, 42, 46, 50,
+	48, 9, 1,
 }
-var yyPact = []int{
 
-	-14, -14, 15, -14, -1000, -1000, -1000, -1000, 46, 54,
-	26, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
-	-1000, -1000, 15, -14, -14, -1, 2, -5, -1000, -1000,
-	-1000, -1000, -1000, -1000, -1000, -1000, -2, 0, -11, -7,
-	-1000, 25, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+var yyPact = [...]int16{
+	-12, -12, 79, -12, -1000, -1000, -1000, -1000, -1000, 33,
+	13, 25, 67, 16, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, -1000, -1000, -1000, -1000, 79, -12, -12, 14, 64,
+	52, 5, -1000, -1000, -1000, -1000, -1000, -1000, -1000, -1000,
+	-1000, 19, 60, -15, 59, -1000, 56, 30, 46, -26,
+	59, -1000, 66, -1000, 80, -1000, -1000, -1000, 63, -1000,
+	-1000, 58, -1000, 8, -1000, -1000, -1000, -1000, 40, -1000,
+	-1000, 35, -1000, 32, -1000, 57, 15, 10, 62, -1000,
+	41, -1000, -1000, -1000, -1000, -1000, -1000,
 }
-var yyPgo = []int{
 
-	0, 46, 18, 64, 65, 45, 44, 41, 40, 39,
-	10,
+var yyPgo = [...]int8{
+	0, 112, 75, 96, 98, 111, 104, 94, 1, 0,
+	97, 12, 101, 100, 99, 13, 95,
 }
-var yyR1 = []int{
 
+var yyR1 = [...]int8{
 	0, 1, 1, 3, 3, 3, 3, 3, 3, 4,
 	4, 5, 5, 5, 5, 5, 5, 6, 6, 6,
-	7, 7, 8, 9, 9, 9, 9, 10, 10, 2,
-	2, 2, 2, 2, 2, 2,
+	7, 7, 8, 8, 9, 9, 10, 11, 12, 12,
+	12, 13, 13, 13, 14, 14, 14, 14, 14, 14,
+	14, 16, 16, 15, 15, 2, 2, 2, 2, 2,
+	2, 2, 2,
 }
-var yyR2 = []int{
 
+var yyR2 = [...]int8{
 	0, 1, 2, 1, 1, 1, 1, 1, 1, 1,
 	1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
-	3, 3, 3, 3, 3, 3, 3, 1, 1, 3,
-	3, 3, 1, 1, 1, 1,
+	1, 2, 1, 3, 1, 3, 1, 3, 3, 3,
+	5, 3, 5, 3, 3, 3, 3, 3, 5, 5,
+	3, 2, 3, 1, 1, 3, 3, 3, 1, 1,
+	1, 1, 1,
 }
-var yyChk = []int{
 
-	-1000, -1, -2, 29, -7, -8, -9, -10, -5, -6,
-	23, 27, 28, 14, 15, 16, 17, 18, 19, 20,
-	21, 22, -2, 13, 12, -2, -3, -4, 4, 5,
-	6, 7, 8, 9, 10, 11, -3, -3, 4, -4,
-	-2, -2, 30, 24, 26, 25, 25, 24, -10, 26,
+var yyChk = [...]int16{
+	-1000, -1, -2, 40, -12, -13, -14, -16, -15, -5,
+	-6, 23, 36, 35, 27, 28, 14, 15, 16, 17,
+	18, 19, 20, 21, 22, -2, 13, 12, -2, -3,
+	-4, -7, 4, 5, 6, 7, 8, 9, 10, 11,
+	34, 35, -3, -7, -10, 37, -3, 4, -4, -7,
+	-10, 23, 36, -2, -2, 41, 24, 26, 40, 34,
+	25, 40, -11, 25, 25, 24, -15, 26, 40, -11,
+	23, -8, 24, -9, 25, 38, -8, -9, 39, 41,
+	39, 41, 25, 41, 41, 24, 25,
 }
-var yyDef = []int{
 
-	0, -2, 1, 0, 32, 33, 34, 35, 0, 0,
-	0, 27, 28, 11, 12, 13, 14, 15, 16, 17,
-	18, 19, 2, 0, 0, 0, 0, 0, 3, 4,
-	5, 6, 7, 8, 9, 10, 0, 0, 3, 0,
-	30, 31, 29, 20, 21, 22, 23, 24, 25, 26,
+var yyDef = [...]int8{
+	0, -2, 1, 0, 48, 49, 50, 51, 52, 0,
+	0, 0, 0, 0, 43, 44, 11, 12, 13, 14,
+	15, 16, 17, 18, 19, 2, 0, 0, 0, 0,
+	0, 0, 3, 4, 5, 6, 7, 8, 9, 10,
+	20, 0, 0, 0, 0, 26, 0, 3, 0, 0,
+	0, 41, 0, 46, 47, 45, 28, 29, 0, 21,
+	31, 0, 33, 0, 34, 35, 36, 37, 0, 40,
+	42, 0, 22, 0, 24, 0, 0, 0, 0, 30,
+	0, 32, 27, 38, 39, 23, 25,
 }
-var yyTok1 = []int{
 
+var yyTok1 = [...]int8{
 	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	29, 30,
+	40, 41, 3, 3, 39,
 }
-var yyTok2 = []int{
 
+var yyTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
-	22, 23, 24, 25, 26, 27, 28,
+	22, 23, 24, 25, 26, 27, 28, 29, 30, 31,
+	32, 33, 34, 35, 36, 37, 38,
 }
-var yyTok3 = []int{
+
+var yyTok3 = [...]int8{
 	0,
 }
 
+var yyErrorMessages = [...]struct {
+	state int
+	token int
+	msg   string
+}{}
+
 //line yaccpar:1
 
 /*	parser for yacc output	*/
 
-var yyDebug = 0
+var (
+	yyDebug        = 0
+	yyErrorVerbose = false
+)
 
 type yyLexer interface {
 	Lex(lval *yySymType) int
 	Error(s string)
 }
 
+type yyParser interface {
+	Parse(yyLexer) int
+	Lookahead() int
+}
+
+type yyParserImpl struct {
+	lval  yySymType
+	stack [yyInitialStackSize]yySymType
+	char  int
+}
+
+func (p *yyParserImpl) Lookahead() int {
+	return p.char
+}
+
+func yyNewParser() yyParser {
+	return &yyParserImpl{}
+}
+
 const yyFlag = -1000
 
 func yyTokname(c int) string {
-	// 4 is TOKSTART above
-	if c >= 4 && c-4 < len(yyToknames) {
-		if yyToknames[c-4] != "" {
-			return yyToknames[c-4]
+	if c >= 1 && c-1 < len(yyToknames) {
+		if yyToknames[c-1] != "" {
+			return yyToknames[c-1]
 		}
 	}
 	return __yyfmt__.Sprintf("tok-%v", c)
@@ -578,51 +658,127 @@ func yyStatname(s int) string {
 	return __yyfmt__.Sprintf("state-%v", s)
 }
 
-func yylex1(lex yyLexer, lval *yySymType) int {
-	c := 0
-	char := lex.Lex(lval)
+func yyErrorMessage(state, lookAhead int) string {
+	const TOKSTART = 4
+
+	if !yyErrorVerbose {
+		return "syntax error"
+	}
+
+	for _, e := range yyErrorMessages {
+		if e.state == state && e.token == lookAhead {
+			return "syntax error: " + e.msg
+		}
+	}
+
+	res := "syntax error: unexpected " + yyTokname(lookAhead)
+
+	// To match Bison, suggest at most four expected tokens.
+	expected := make([]int, 0, 4)
+
+	// Look for shiftable tokens.
+	base := int(yyPact[state])
+	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+	}
+
+	if yyDef[state] == -2 {
+		i := 0
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
+			i += 2
+		}
+
+		// Look for tokens that we accept or reduce.
+		for i += 2; yyExca[i] >= 0; i += 2 {
+			tok := int(yyExca[i])
+			if tok < TOKSTART || yyExca[i+1] == 0 {
+				continue
+			}
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+
+		// If the default action is to accept or reduce, give up.
+		if yyExca[i+1] != 0 {
+			return res
+		}
+	}
+
+	for i, tok := range expected {
+		if i == 0 {
+			res += ", expecting "
+		} else {
+			res += " or "
+		}
+		res += yyTokname(tok)
+	}
+	return res
+}
+
+func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
+	token = 0
+	char = lex.Lex(lval)
 	if char <= 0 {
-		c = yyTok1[0]
+		token = int(yyTok1[0])
 		goto out
 	}
 	if char < len(yyTok1) {
-		c = yyTok1[char]
+		token = int(yyTok1[char])
 		goto out
 	}
 	if char >= yyPrivate {
 		if char < yyPrivate+len(yyTok2) {
-			c = yyTok2[char-yyPrivate]
+			token = int(yyTok2[char-yyPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(yyTok3); i += 2 {
-		c = yyTok3[i+0]
-		if c == char {
-			c = yyTok3[i+1]
+		token = int(yyTok3[i+0])
+		if token == char {
+			token = int(yyTok3[i+1])
 			goto out
 		}
 	}
 
 out:
-	if c == 0 {
-		c = yyTok2[1] /* unknown char */
+	if token == 0 {
+		token = int(yyTok2[1]) /* unknown char */
 	}
 	if yyDebug >= 3 {
-		__yyfmt__.Printf("lex %U %s\n", uint(char), yyTokname(c))
+		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
 	}
-	return c
+	return char, token
 }
 
 func yyParse(yylex yyLexer) int {
+	return yyNewParser().Parse(yylex)
+}
+
+func (yyrcvr *yyParserImpl) Parse(yylex yyLexer) int {
 	var yyn int
-	var yylval yySymType
 	var yyVAL yySymType
-	yyS := make([]yySymType, yyMaxDepth)
+	var yyDollar []yySymType
+	_ = yyDollar // silence set and not used
+	yyS := yyrcvr.stack[:]
 
 	Nerrs := 0   /* number of errors */
 	Errflag := 0 /* error recovery flag */
 	yystate := 0
-	yychar := -1
+	yyrcvr.char = -1
+	yytoken := -1 // yyrcvr.char translated into internal numbering
+	defer func() {
+		// Make sure we report no lookahead when not parsing.
+		yystate = -1
+		yyrcvr.char = -1
+		yytoken = -1
+	}()
 	yyp := -1
 	goto yystack
 
@@ -635,7 +791,7 @@ ret1:
 yystack:
 	/* put a state and value onto the stack */
 	if yyDebug >= 4 {
-		__yyfmt__.Printf("char %v in %v\n", yyTokname(yychar), yyStatname(yystate))
+		__yyfmt__.Printf("char %v in %v\n", yyTokname(yytoken), yyStatname(yystate))
 	}
 
 	yyp++
@@ -648,21 +804,22 @@ yystack:
 	yyS[yyp].yys = yystate
 
 yynewstate:
-	yyn = yyPact[yystate]
+	yyn = int(yyPact[yystate])
 	if yyn <= yyFlag {
 		goto yydefault /* simple state */
 	}
-	if yychar < 0 {
-		yychar = yylex1(yylex, &yylval)
+	if yyrcvr.char < 0 {
+		yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 	}
-	yyn += yychar
+	yyn += yytoken
 	if yyn < 0 || yyn >= yyLast {
 		goto yydefault
 	}
-	yyn = yyAct[yyn]
-	if yyChk[yyn] == yychar { /* valid shift */
-		yychar = -1
-		yyVAL = yylval
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
+		yyrcvr.char = -1
+		yytoken = -1
+		yyVAL = yyrcvr.lval
 		yystate = yyn
 		if Errflag > 0 {
 			Errflag--
@@ -672,27 +829,27 @@ yynewstate:
 
 yydefault:
 	/* default state action */
-	yyn = yyDef[yystate]
+	yyn = int(yyDef[yystate])
 	if yyn == -2 {
-		if yychar < 0 {
-			yychar = yylex1(yylex, &yylval)
+		if yyrcvr.char < 0 {
+			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 		}
 
 		/* look through exception table */
 		xi := 0
 		for {
-			if yyExca[xi+0] == -1 && yyExca[xi+1] == yystate {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			yyn = yyExca[xi+0]
-			if yyn < 0 || yyn == yychar {
+			yyn = int(yyExca[xi+0])
+			if yyn < 0 || yyn == yytoken {
 				break
 			}
 		}
-		yyn = yyExca[xi+1]
+		yyn = int(yyExca[xi+1])
 		if yyn < 0 {
 			goto ret0
 		}
@@ -701,11 +858,11 @@ yydefault:
 		/* error ... attempt to resume parsing */
 		switch Errflag {
 		case 0: /* brand new error */
-			yylex.Error("syntax error")
+			yylex.Error(yyErrorMessage(yystate, yytoken))
 			Nerrs++
 			if yyDebug >= 1 {
 				__yyfmt__.Printf("%s", yyStatname(yystate))
-				__yyfmt__.Printf("saw %s\n", yyTokname(yychar))
+				__yyfmt__.Printf(" saw %s\n", yyTokname(yytoken))
 			}
 			fallthrough
 
@@ -714,10 +871,10 @@ yydefault:
 
 			/* find a state where "error" is a legal shift action */
 			for yyp >= 0 {
-				yyn = yyPact[yyS[yyp].yys] + yyErrCode
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
 				if yyn >= 0 && yyn < yyLast {
-					yystate = yyAct[yyn] /* simulate a shift of "error" */
-					if yyChk[yystate] == yyErrCode {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
 						goto yystack
 					}
 				}
@@ -733,12 +890,13 @@ yydefault:
 
 		case 3: /* no shift yet; clobber input char */
 			if yyDebug >= 2 {
-				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yychar))
+				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yytoken))
 			}
-			if yychar == yyEofCode {
+			if yytoken == yyEofCode {
 				goto ret1
 			}
-			yychar = -1
+			yyrcvr.char = -1
+			yytoken = -1
 			goto yynewstate /* try again in the same state */
 		}
 	}
@@ -752,90 +910,206 @@ yydefault:
 	yypt := yyp
 	_ = yypt // guard against "declared and not used"
 
-	yyp -= yyR2[yyn]
+	yyp -= int(yyR2[yyn])
+	// yyp is now the index of $0. Perform the default action. Iff the
+	// reduced production is ε, $1 is possibly out of range.
+	if yyp+1 >= len(yyS) {
+		nyys := make([]yySymType, len(yyS)*2)
+		copy(nyys, yyS)
+		yyS = nyys
+	}
 	yyVAL = yyS[yyp+1]
 
 	/* consult goto table to find next state */
-	yyn = yyR1[yyn]
-	yyg := yyPgo[yyn]
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
 	yyj := yyg + yyS[yyp].yys + 1
 
 	if yyj >= yyLast {
-		yystate = yyAct[yyg]
+		yystate = int(yyAct[yyg])
 	} else {
-		yystate = yyAct[yyj]
-		if yyChk[yystate] != -yyn {
-			yystate = yyAct[yyg]
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch yynt {
 
 	case 20:
-		//line message_matcher_parser.y:115
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:125
 		{
-	       //fmt.Println("string_test", $1, $2, $3)
-       nodes = append(nodes, &tree{stmt:&Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
-	       }
+			yyVAL = yyDollar[1]
+			yyVAL.tokenId = OP_IN
+		}
 	case 21:
-		//line message_matcher_parser.y:120
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line message_matcher_parser.y:130
 		{
-	       //fmt.Println("string_test regexp", $1, $2, $3)
-       nodes = append(nodes, &tree{stmt:&Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
-	       }
+			yyVAL = yyDollar[2]
+			yyVAL.tokenId = OP_NIN
+		}
 	case 22:
-		//line message_matcher_parser.y:126
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:136
 		{
-	   //fmt.Println("numeric_test", $1, $2, $3)
-   nodes = append(nodes, &tree{stmt:&Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
-	   }
+			yyVAL = yyDollar[1]
+			yyVAL.stringSet = map[string]bool{yyDollar[1].token: true}
+		}
 	case 23:
-		//line message_matcher_parser.y:132
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:141
 		{
-	      //fmt.Println("field_test numeric", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
-	      }
+			yyVAL = yyDollar[1]
+			yyVAL.stringSet[yyDollar[3].token] = true
+		}
 	case 24:
-		//line message_matcher_parser.y:137
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:147
 		{
-	      //fmt.Println("field_test string", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
-	      }
+			yyVAL = yyDollar[1]
+			yyVAL.numericSet = map[float64]bool{yyDollar[1].double: true}
+		}
 	case 25:
-		//line message_matcher_parser.y:142
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:152
 		{
-	      //fmt.Println("field_test boolean", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
-	      }
+			yyVAL = yyDollar[1]
+			yyVAL.numericSet[yyDollar[3].double] = true
+		}
 	case 26:
-		//line message_matcher_parser.y:147
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:158
 		{
-	      //fmt.Println("field_test regexp", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{yyS[yypt-2], yyS[yypt-1], yyS[yypt-0]}})
-	      }
+			yyVAL = yyDollar[1]
+			yyVAL.tokenId = OP_BETWEEN
+		}
+	case 27:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:164
+		{
+			yyVAL = yyDollar[1]
+			yyVAL.upper = yyDollar[3].double
+		}
+	case 28:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:170
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
 	case 29:
-		//line message_matcher_parser.y:154
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:174
 		{
-	      yyVAL = yyS[yypt-1]
-	      }
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
 	case 30:
-		//line message_matcher_parser.y:158
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:178
 		{
-	      //fmt.Println("and", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{op:yyS[yypt-1]}})
-	      }
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[4]}})
+		}
 	case 31:
-		//line message_matcher_parser.y:163
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:183
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 32:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:187
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[4]}})
+		}
+	case 33:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:191
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 34:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:196
 		{
-	      //fmt.Println("or", $1, $2, $3)
-      nodes = append(nodes, &tree{stmt:&Statement{op:yyS[yypt-1]}})
-	      }
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
 	case 35:
-		//line message_matcher_parser.y:171
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:200
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 36:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:204
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 37:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:208
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 38:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:212
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[4]}})
+		}
+	case 39:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line message_matcher_parser.y:216
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[4]}})
+		}
+	case 40:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:220
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{yyDollar[1], yyDollar[2], yyDollar[3]}})
+		}
+	case 41:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line message_matcher_parser.y:225
+		{
+			op := yyDollar[1]
+			op.tokenId = OP_EXISTS
+			nodes = append(nodes, &tree{stmt: &Statement{field: yyDollar[2], op: op}})
+		}
+	case 42:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:231
+		{
+			op := yyDollar[2]
+			op.tokenId = OP_NEXISTS
+			nodes = append(nodes, &tree{stmt: &Statement{field: yyDollar[3], op: op}})
+		}
+	case 45:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:239
+		{
+			yyVAL = yyDollar[2]
+		}
+	case 46:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:243
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[2]}})
+		}
+	case 47:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line message_matcher_parser.y:247
 		{
-	         //fmt.Println("boolean", $1)
-         nodes = append(nodes, &tree{stmt:&Statement{op:yyS[yypt-0]}})
-	      }
+			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[2]}})
+		}
+	case 52:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line message_matcher_parser.y:255
+		{
+			nodes = append(nodes, &tree{stmt: &Statement{op: yyDollar[1]}})
+		}
 	}
 	goto yystack /* stack new state and value */
 }
@@ -22,7 +22,12 @@ var variables = map[string]int{
 	"Pid":        VAR_PID,
 	"Fields":     VAR_FIELDS,
 	"TRUE":       TRUE,
-	"FALSE":      FALSE}
+	"FALSE":      FALSE,
+	"IN":         IN,
+	"NOT":        NOT,
+	"EXISTS":     EXISTS,
+	"BETWEEN":    BETWEEN,
+	"AND":        AND}
 
 var parseLock sync.Mutex
 
@@ -71,6 +76,9 @@ var nodes []*tree
    fieldIndex  int
    arrayIndex  int
    regexp      *regexp.Regexp
+   stringSet   map[string]bool
+   numericSet  map[float64]bool
+   upper       float64
 }
 
 %token OP_EQ OP_NE OP_GT OP_GTE OP_LT OP_LTE OP_RE OP_NRE
@@ -80,6 +88,8 @@ var nodes []*tree
 %token VAR_FIELDS
 %token STRING_VALUE NUMERIC_VALUE REGEXP_VALUE
 %token TRUE FALSE
+%token OP_IN OP_NIN OP_EXISTS OP_NEXISTS OP_BETWEEN
+%token IN NOT EXISTS BETWEEN AND
 
 %start spec
 %left OP_OR
@@ -111,43 +121,118 @@ numeric_vars : VAR_TIMESTAMP
    | VAR_SEVERITY
    | VAR_PID
 ;
+set_op : IN
+      {
+      $$ = $1
+      $$.tokenId = OP_IN
+      }
+   | NOT IN
+      {
+      $$ = $2
+      $$.tokenId = OP_NIN
+      }
+;
+string_list : STRING_VALUE
+      {
+      $$ = $1
+      $$.stringSet = map[string]bool{$1.token: true}
+      }
+   | string_list ',' STRING_VALUE
+      {
+      $$ = $1
+      $$.stringSet[$3.token] = true
+      }
+;
+numeric_list : NUMERIC_VALUE
+      {
+      $$ = $1
+      $$.numericSet = map[float64]bool{$1.double: true}
+      }
+   | numeric_list ',' NUMERIC_VALUE
+      {
+      $$ = $1
+      $$.numericSet[$3.double] = true
+      }
+;
+between : BETWEEN
+      {
+      $$ = $1
+      $$.tokenId = OP_BETWEEN
+      }
+;
+range : NUMERIC_VALUE AND NUMERIC_VALUE
+      {
+      $$ = $1
+      $$.upper = $3.double
+      }
+;
 string_test : string_vars relational STRING_VALUE
        {
-       //fmt.Println("string_test", $1, $2, $3)
        nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
        }
    |   string_vars regexp REGEXP_VALUE
        {
-       //fmt.Println("string_test regexp", $1, $2, $3)
        nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
        }
+   |   string_vars set_op '(' string_list ')'
+       {
+       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $4}})
+       }
 ;
 numeric_test : numeric_vars relational NUMERIC_VALUE
    {
-   //fmt.Println("numeric_test", $1, $2, $3)
+   nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+   }
+   | numeric_vars set_op '(' numeric_list ')'
+   {
+   nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $4}})
+   }
+   | numeric_vars between range
+   {
    nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
    }
 ;
 field_test : VAR_FIELDS relational NUMERIC_VALUE
       {
-      //fmt.Println("field_test numeric", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
       }
    | VAR_FIELDS relational STRING_VALUE
       {
-      //fmt.Println("field_test string", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
       }
    | VAR_FIELDS OP_EQ boolean
       {
-      //fmt.Println("field_test boolean", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
       }
    | VAR_FIELDS regexp REGEXP_VALUE
       {
-      //fmt.Println("field_test regexp", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
       }
+   | VAR_FIELDS set_op '(' string_list ')'
+      {
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $4}})
+      }
+   | VAR_FIELDS set_op '(' numeric_list ')'
+      {
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $4}})
+      }
+   | VAR_FIELDS between range
+      {
+      nodes = append(nodes, &tree{stmt:&Statement{$1, $2, $3}})
+      }
+;
+exists_test : EXISTS VAR_FIELDS
+      {
+      op := $1
+      op.tokenId = OP_EXISTS
+      nodes = append(nodes, &tree{stmt:&Statement{field:$2, op:op}})
+      }
+   | NOT EXISTS VAR_FIELDS
+      {
+      op := $2
+      op.tokenId = OP_NEXISTS
+      nodes = append(nodes, &tree{stmt:&Statement{field:$3, op:op}})
+      }
 ;
 boolean : TRUE | FALSE
 expr : '(' expr ')'
@@ -156,20 +241,18 @@ expr : '(' expr ')'
       }
    | expr OP_AND expr
       {
-      //fmt.Println("and", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{op:$2}})
       }
    | expr OP_OR expr
       {
-      //fmt.Println("or", $1, $2, $3)
       nodes = append(nodes, &tree{stmt:&Statement{op:$2}})
       }
    | string_test
    | numeric_test
    | field_test
+   | exists_test
    | boolean
       {
-         //fmt.Println("boolean", $1)
          nodes = append(nodes, &tree{stmt:&Statement{op:$1}})
       }
 ;
@@ -72,6 +72,13 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type =~ /\\ytest/",                                           // invalid escape character
 			"Type != 'test\"",                                             // mis matched quote types
 			"Pid =~ 6",                                                    // number instead of regexp
+			"Type IN ()",                                                  // empty set
+			"Type IN ('a', 1)",                                            // mixed set types
+			"Pid IN ('a')",                                                // Pid is not a string
+			"Type BETWEEN 'a' AND 'b'",                                    // range not allowed on strings
+			"Severity BETWEEN 1",                                          // missing upper bound
+			"EXISTS Type",                                                 // only fields can be missing
+			"Type NOT == 'test'",                                          // NOT only before IN
 		}
 
 		negative := []string{
@@ -99,6 +106,20 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Type == \"te'st\"",
 			"Type == 'te\"st'",
 			"Fields[int] =~ /999/",
+			"Type IN ('foo', 'bar')",
+			"Type NOT IN ('foo', 'TEST')",
+			"Severity IN (1, 2, 3)",
+			"Severity NOT IN (6, 7)",
+			"Fields[foo] IN ('baz')",
+			"Fields[int] IN (1, 2)",
+			"Fields[missing] IN ('bar')",
+			"Fields[missing] NOT IN ('bar')",
+			"Severity BETWEEN 7 AND 9",
+			"Fields[double] BETWEEN 100 AND 200",
+			"EXISTS Fields[missing]",
+			"EXISTS Fields[foo][2]",
+			"EXISTS Fields[int][0][2]",
+			"NOT EXISTS Fields[foo]",
 		}
 
 		positive := []string{
@@ -144,6 +165,23 @@ func MatcherSpecificationSpec(c gospec.Context) {
 			"Fields[foo][1] =~ /alt/",
 			"Fields[Payload] =~ /name=\\w+/",
 			"Type =~ /(ST)/",
+			"Type IN ('foo', 'TEST', 'bar')",
+			"Type NOT IN ('foo', 'bar')",
+			"Severity IN (6, 7)",
+			"Severity NOT IN (1,2)",
+			"Fields[foo] IN ('bar', 'baz')",
+			"Fields[foo][1] IN ('alternate')",
+			"Fields[int] IN (999, 1024)",
+			"Fields[int][0][1] NOT IN (999)",
+			"Severity BETWEEN 6 AND 7",
+			"Fields[double] BETWEEN 99 AND 100",
+			"Fields[int][0][1] BETWEEN 1000 AND 2000",
+			"EXISTS Fields[foo]",
+			"EXISTS Fields[foo][1]",
+			"EXISTS Fields[int][0][1]",
+			"NOT EXISTS Fields[missing]",
+			"EXISTS Fields[bool] && NOT EXISTS Fields[foo][2]",
+			"(Type IN ('TEST') || FALSE) && Fields[int] BETWEEN 0 AND 1000",
 		}
 
 		c.Specify("malformed matcher tests", func() {
@@ -170,6 +208,27 @@ func MatcherSpecificationSpec(c gospec.Context) {
 				c.Expect(match, gs.IsTrue)
 			}
 		})
+
+		c.Specify("explains the match", func() {
+			ms, err := CreateMatcherSpecification("Type == 'TEST' && " +
+				"(Severity BETWEEN 7 AND 8 || Fields[int][0][1] IN (1024, 1)) && " +
+				"Payload !~ /^Test/ && NOT EXISTS Fields[missing] || FALSE")
+			c.Assume(err, gs.IsNil)
+			match, predicates := ms.Explain(msg)
+			c.Expect(match, gs.IsFalse)
+			expected := []PredicateResult{
+				{`Type == "TEST"`, true},
+				{"Severity BETWEEN 7 AND 8", false},
+				{"Fields[int][0][1] IN (1, 1024)", true},
+				{"Payload !~ /^Test/", false},
+				{"NOT EXISTS Fields[missing][0][0]", true},
+				{"FALSE", false},
+			}
+			c.Expect(len(predicates), gs.Equals, len(expected))
+			for i, predicate := range predicates {
+				c.Expect(predicate, gs.Equals, expected[i])
+			}
+		})
 	})
 }
 
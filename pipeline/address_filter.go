@@ -0,0 +1,171 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Allow and deny lists of CIDR ranges (or single IPs) shared by the network
+// inputs, checked against the remote address before anything it sent is
+// read. Deny entries take precedence; if the allow list isn't empty only the
+// addresses it covers are accepted.
+type AddressFilter struct {
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	rejected int64
+}
+
+// Parses the `allow` and `deny` config settings. Returns a nil filter if both
+// are empty.
+func NewAddressFilter(allow, deny []string) (f *AddressFilter, err error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f = new(AddressFilter)
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, fmt.Errorf("allow: %s", err)
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, fmt.Errorf("deny: %s", err)
+	}
+	return
+}
+
+func parseCIDRs(entries []string) (nets []*net.IPNet, err error) {
+	nets = make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address: %s", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, e := net.ParseCIDR(entry)
+		if e != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether the remote address is accepted, counting it as rejected if
+// not. Addresses that aren't IP based (e.g. unix sockets) are rejected if an
+// allow list is set.
+func (f *AddressFilter) Allowed(addr net.Addr) (ok bool) {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case *net.IPAddr:
+		ip = a.IP
+	default:
+		if addr != nil {
+			host, _, err := net.SplitHostPort(addr.String())
+			if err != nil {
+				host = addr.String()
+			}
+			ip = net.ParseIP(host)
+		}
+	}
+	if ip == nil {
+		ok = len(f.allow) == 0
+	} else {
+		ok = !containsIP(f.deny, ip) && (len(f.allow) == 0 || containsIP(f.allow, ip))
+	}
+	if !ok {
+		atomic.AddInt64(&f.rejected, 1)
+	}
+	return
+}
+
+// Number of connections or packets rejected so far.
+func (f *AddressFilter) Rejected() int64 {
+	return atomic.LoadInt64(&f.rejected)
+}
+
+// Returns a listener that closes connections from rejected addresses as soon
+// as they're accepted. Wrap the raw TCP listener so rejected clients don't
+// get as far as a TLS handshake.
+func (f *AddressFilter) Listener(l net.Listener) net.Listener {
+	return &filteredListener{l, f}
+}
+
+type filteredListener struct {
+	net.Listener
+	filter *AddressFilter
+}
+
+func (l *filteredListener) Accept() (conn net.Conn, err error) {
+	for {
+		if conn, err = l.Listener.Accept(); err != nil {
+			return
+		}
+		if l.filter.Allowed(conn.RemoteAddr()) {
+			return
+		}
+		conn.Close()
+	}
+}
+
+// Returns a connection whose reads silently drop datagrams from rejected
+// addresses. The connection must be packet based, e.g. a *net.UDPConn.
+func (f *AddressFilter) PacketConn(conn net.Conn) (net.Conn, error) {
+	pc, ok := conn.(net.PacketConn)
+	if !ok {
+		return nil, fmt.Errorf("%T isn't a packet connection", conn)
+	}
+	return &filteredPacketConn{conn, pc, f}, nil
+}
+
+type filteredPacketConn struct {
+	net.Conn
+	pc     net.PacketConn
+	filter *AddressFilter
+}
+
+func (c *filteredPacketConn) Read(b []byte) (n int, err error) {
+	var addr net.Addr
+	for {
+		if n, addr, err = c.pc.ReadFrom(b); err != nil {
+			return
+		}
+		if c.filter.Allowed(addr) {
+			return
+		}
+	}
+}
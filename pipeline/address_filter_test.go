@@ -0,0 +1,119 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"time"
+)
+
+func AddressFilterSpec(c gs.Context) {
+	tcpAddr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 5565}
+	}
+
+	c.Specify("An AddressFilter", func() {
+		c.Specify("is nil without allow or deny lists", func() {
+			f, err := NewAddressFilter(nil, []string{})
+			c.Expect(err, gs.IsNil)
+			c.Expect(f, gs.IsNil)
+		})
+
+		c.Specify("rejects invalid entries", func() {
+			_, err := NewAddressFilter([]string{"10.0.0.0/33"}, nil)
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = NewAddressFilter(nil, []string{"bogus"})
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("applies deny before allow", func() {
+			f, err := NewAddressFilter([]string{"10.0.0.0/8", "::1"},
+				[]string{"10.1.0.0/16", "10.2.3.4"})
+			c.Assume(err, gs.IsNil)
+			c.Expect(f.Allowed(tcpAddr("10.0.0.1")), gs.IsTrue)
+			c.Expect(f.Allowed(tcpAddr("::1")), gs.IsTrue)
+			c.Expect(f.Allowed(tcpAddr("10.1.2.3")), gs.IsFalse)
+			c.Expect(f.Allowed(tcpAddr("10.2.3.4")), gs.IsFalse)
+			c.Expect(f.Allowed(tcpAddr("10.2.3.5")), gs.IsTrue)
+			c.Expect(f.Allowed(&net.UDPAddr{IP: net.ParseIP("192.168.0.1")}),
+				gs.IsFalse)
+			c.Expect(f.Allowed(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}),
+				gs.IsFalse)
+			c.Expect(f.Rejected(), gs.Equals, int64(4))
+		})
+
+		c.Specify("with only a deny list allows everything else", func() {
+			f, err := NewAddressFilter(nil, []string{"127.0.0.2"})
+			c.Assume(err, gs.IsNil)
+			c.Expect(f.Allowed(tcpAddr("127.0.0.1")), gs.IsTrue)
+			c.Expect(f.Allowed(tcpAddr("127.0.0.2")), gs.IsFalse)
+			c.Expect(f.Allowed(&net.UnixAddr{Name: "/tmp/sock", Net: "unix"}),
+				gs.IsTrue)
+		})
+
+		c.Specify("closes rejected TCP connections", func() {
+			f, err := NewAddressFilter(nil, []string{"127.0.0.1"})
+			c.Assume(err, gs.IsNil)
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			l = f.Listener(l)
+			defer l.Close()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			go l.Accept()
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			c.Expect(err, gs.Not(gs.IsNil))
+			if neterr, ok := err.(net.Error); ok {
+				c.Expect(neterr.Timeout(), gs.IsFalse)
+			}
+			c.Expect(f.Rejected(), gs.Equals, int64(1))
+		})
+
+		c.Specify("drops rejected UDP packets", func() {
+			f, err := NewAddressFilter([]string{"127.0.0.1"}, nil)
+			c.Assume(err, gs.IsNil)
+			udpAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			udpConn, err := net.ListenUDP("udp", udpAddr)
+			c.Assume(err, gs.IsNil)
+			conn, err := f.PacketConn(udpConn)
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+
+			send := func(from, payload string) {
+				laddr, err := net.ResolveUDPAddr("udp", from+":0")
+				c.Assume(err, gs.IsNil)
+				sender, err := net.DialUDP("udp", laddr,
+					udpConn.LocalAddr().(*net.UDPAddr))
+				c.Assume(err, gs.IsNil)
+				defer sender.Close()
+				sender.Write([]byte(payload))
+			}
+			send("127.0.0.2", "rejected")
+			send("127.0.0.1", "accepted")
+
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			buf := make([]byte, 64)
+			n, err := conn.Read(buf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(f.Rejected(), gs.Equals, int64(1))
+			c.Expect(string(buf[:n]), gs.Equals, "accepted")
+		})
+	})
+}
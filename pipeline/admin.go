@@ -0,0 +1,390 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Description of a running plugin returned by the admin API.
+type adminPluginInfo struct {
+	Name      string
+	Type      string
+	Globals   *PluginGlobals
+	LeakCount int
+	// Startup state, see PipelineConfig.PluginState. Not set for decoders.
+	State string `json:",omitempty"`
+}
+
+func newAdminPluginInfo(runner PluginRunner) (info adminPluginInfo) {
+	info.Name = runner.Name()
+	info.Globals = runner.PluginGlobals()
+	info.LeakCount = runner.LeakCount()
+	if info.Globals != nil && info.Globals.Typ != "" {
+		info.Type = info.Globals.Typ
+	} else {
+		info.Type = info.Name
+	}
+	return
+}
+
+// Explanation of whether a filter's or output's message matcher accepts a
+// message, returned by the admin API.
+type adminMatcherExplanation struct {
+	Name       string
+	Matcher    string
+	Match      bool
+	Predicates []message.PredicateResult
+}
+
+// Serves the JSON admin API for inspecting and managing the running
+// pipeline:
+//
+//	GET  /plugins               running plugins and the Heka globals
+//	GET  /reports               the same data as the heka.all-report message
+//	GET  /ready                 200 once every plugin is ready, 503 before
+//	GET  /history               retained report data, see adminHandler.history
+//	GET  /volume                messages and bytes per source, see adminHandler.volume
+//	POST /explain               which matchers accept the posted message
+//	POST /plugins/<name>/stop    stops an input, filter, or output
+//	POST /plugins/<name>/restart restarts an input, filter, or output
+//	POST /reload                reloads the config, like SIGHUP
+//	POST /snapshot              quiesces the pipeline and snapshots its state
+//	POST /shutdown              shuts Heka down cleanly
+type adminHandler struct {
+	pc *PipelineConfig
+}
+
+func (a *adminHandler) writeJson(w http.ResponseWriter, status int,
+	data interface{}) {
+
+	body, err := json.Marshal(data)
+	if err != nil {
+		log.Println("Admin API can't encode response: ", err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":"can't encode response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err = w.Write([]byte(RedactSecrets(string(body)) + "\n")); err != nil {
+		log.Println("Admin API can't write response: ", err)
+	}
+}
+
+func (a *adminHandler) writeError(w http.ResponseWriter, status int, err error) {
+	a.writeJson(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *adminHandler) writeOk(w http.ResponseWriter) {
+	a.writeJson(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (a *adminHandler) plugins() map[string]interface{} {
+	pc := a.pc
+	data := map[string]interface{}{"globals": Globals()}
+
+	inputs := make([]adminPluginInfo, 0)
+	pc.inputsLock.Lock()
+	for _, runner := range pc.InputRunners {
+		info := newAdminPluginInfo(runner)
+		info.State = pc.runnerState(runner)
+		inputs = append(inputs, info)
+	}
+	pc.inputsLock.Unlock()
+	data["inputs"] = inputs
+
+	decoders := make([]adminPluginInfo, 0)
+	pc.allDecodersLock.Lock()
+	for _, runner := range pc.allDecoders {
+		decoders = append(decoders, newAdminPluginInfo(runner))
+	}
+	pc.allDecodersLock.Unlock()
+	data["decoders"] = decoders
+
+	filters := make([]adminPluginInfo, 0)
+	pc.filtersLock.Lock()
+	for _, runner := range pc.FilterRunners {
+		info := newAdminPluginInfo(runner)
+		info.State = pc.runnerState(runner)
+		filters = append(filters, info)
+	}
+	pc.filtersLock.Unlock()
+	data["filters"] = filters
+
+	outputs := make([]adminPluginInfo, 0)
+	pc.outputsLock.Lock()
+	for _, runner := range pc.OutputRunners {
+		info := newAdminPluginInfo(runner)
+		info.State = pc.runnerState(runner)
+		outputs = append(outputs, info)
+	}
+	pc.outputsLock.Unlock()
+	data["outputs"] = outputs
+	return data
+}
+
+// Tests the message against the matchers of the running filters and outputs.
+func (a *adminHandler) explain(msg *message.Message) map[string]interface{} {
+	pc := a.pc
+	matchRunners := make(map[string]*MatchRunner)
+	pc.filtersLock.Lock()
+	for name, runner := range pc.FilterRunners {
+		matchRunners[name] = runner.MatchRunner()
+	}
+	pc.filtersLock.Unlock()
+	pc.outputsLock.Lock()
+	for name, runner := range pc.OutputRunners {
+		matchRunners[name] = runner.MatchRunner()
+	}
+	pc.outputsLock.Unlock()
+
+	names := make([]string, 0, len(matchRunners))
+	for name, mr := range matchRunners {
+		if mr != nil && mr.MatcherSpecification() != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	matches := make([]string, 0)
+	matchers := make([]adminMatcherExplanation, 0, len(names))
+	for _, name := range names {
+		spec := matchRunners[name].MatcherSpecification()
+		explanation := adminMatcherExplanation{Name: name, Matcher: spec.String()}
+		explanation.Match, explanation.Predicates = spec.Explain(msg)
+		if explanation.Match {
+			matches = append(matches, name)
+		}
+		matchers = append(matchers, explanation)
+	}
+	return map[string]interface{}{"matches": matches, "matchers": matchers}
+}
+
+// Serves the report history, optionally narrowed down by the `plugin`,
+// `field` and `since` (a duration such as "30m") query parameters. With
+// `rate=true` counters are returned as per second rates.
+func (a *adminHandler) history(w http.ResponseWriter, req *http.Request) {
+	h := a.pc.reportHistory
+	if h == nil {
+		a.writeError(w, http.StatusNotFound,
+			errors.New("report history is disabled, see report_history_hours"))
+		return
+	}
+	query := req.URL.Query()
+	since := time.Time{}
+	if value := query.Get("since"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			a.writeError(w, http.StatusBadRequest, fmt.Errorf("invalid since: %s", err))
+			return
+		}
+		since = time.Now().Add(-duration)
+	}
+	a.writeJson(w, http.StatusOK, map[string]interface{}{
+		"interval": h.interval.Seconds(),
+		"series": h.query(query.Get("plugin"), query.Get("field"), since,
+			query.Get("rate") == "true"),
+	})
+}
+
+// Serves the message volume per Logger, Hostname and Type of the interval in
+// progress and of the last one that ended, largest first. The `logger`,
+// `hostname` and `type` query parameters narrow the sources down.
+func (a *adminHandler) volume(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	filter := func(interval *volumeInterval) *volumeInterval {
+		if interval == nil {
+			return nil
+		}
+		filtered := *interval
+		filtered.Sources = make([]volumeEntry, 0, len(interval.Sources))
+		for _, entry := range interval.Sources {
+			if (query.Get("logger") == "" || entry.Logger == query.Get("logger")) &&
+				(query.Get("hostname") == "" || entry.Hostname == query.Get("hostname")) &&
+				(query.Get("type") == "" || entry.Type == query.Get("type")) {
+
+				filtered.Sources = append(filtered.Sources, entry)
+			}
+		}
+		return &filtered
+	}
+	volume := a.pc.router.volume
+	current, previous := volume.intervals()
+	a.writeJson(w, http.StatusOK, map[string]interface{}{
+		"interval": volume.interval.Seconds(),
+		"current":  filter(current),
+		"previous": filter(previous),
+	})
+}
+
+func (a *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(path, "/")
+
+	if req.Method == "GET" {
+		switch path {
+		case "plugins":
+			a.writeJson(w, http.StatusOK, a.plugins())
+		case "reports":
+			_, payload := a.pc.allReportsData()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(payload))
+		case "history":
+			a.history(w, req)
+		case "volume":
+			a.volume(w, req)
+		case "ready":
+			if notReady := a.pc.notReady(); len(notReady) > 0 {
+				a.writeJson(w, http.StatusServiceUnavailable,
+					map[string]interface{}{"status": "not ready", "plugins": notReady})
+			} else {
+				a.writeJson(w, http.StatusOK, map[string]string{"status": "ready"})
+			}
+		default:
+			http.NotFound(w, req)
+		}
+		return
+	}
+	if req.Method != "POST" {
+		a.writeError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method not allowed: %s", req.Method))
+		return
+	}
+
+	if path == "explain" {
+		msg := new(message.Message)
+		if err := json.NewDecoder(req.Body).Decode(msg); err != nil {
+			a.writeError(w, http.StatusBadRequest,
+				fmt.Errorf("invalid message: %s", err))
+			return
+		}
+		a.writeJson(w, http.StatusOK, a.explain(msg))
+		return
+	}
+	if path == "snapshot" {
+		dir, manifest, err := a.pc.Snapshot()
+		if err != nil {
+			a.writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		a.writeJson(w, http.StatusOK, map[string]interface{}{
+			"status": "ok", "path": dir, "manifest": manifest})
+		return
+	}
+
+	var err error
+	switch {
+	case path == "reload":
+		err = a.pc.Reload()
+	case path == "shutdown":
+		log.Println("Shutdown requested through the admin API.")
+		Globals().ShutDown()
+	case len(parts) == 3 && parts[0] == "plugins" && parts[2] == "stop":
+		err = a.pc.StopPlugin(parts[1])
+	case len(parts) == 3 && parts[0] == "plugins" && parts[2] == "restart":
+		err = a.pc.RestartPlugin(parts[1])
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	a.writeOk(w)
+}
+
+// Starts serving the admin API on the given address, returning the listener
+// so it can be closed at shutdown.
+func (self *PipelineConfig) startAdminServer(addr string) (listener net.Listener,
+	err error) {
+
+	if listener, err = net.Listen("tcp", addr); err != nil {
+		return
+	}
+	self.serveAdmin(listener)
+	return
+}
+
+// Listener of the admin socket, which is moved to its final path after it's
+// created, so the socket is removed from there when it's closed.
+type adminSocketListener struct {
+	net.Listener
+	path string
+}
+
+func (l *adminSocketListener) Close() error {
+	os.Remove(l.path)
+	return l.Listener.Close()
+}
+
+// Starts serving the admin API on a unix domain socket that only users
+// allowed by `mode` can connect to. A stale socket left behind by a previous
+// run is replaced, one still in use is not. The socket is created in a
+// private directory and only moved into place once its permissions are
+// set, so nobody can connect to it in between.
+func (self *PipelineConfig) startAdminSocket(path string, mode os.FileMode) (
+	listener net.Listener, err error) {
+
+	if info, e := os.Lstat(path); e == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if conn, e := net.Dial("unix", path); e == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+	tmpDir, err := ioutil.TempDir(filepath.Dir(path), ".heka-admin-")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPath := filepath.Join(tmpDir, "admin.sock")
+	if listener, err = net.Listen("unix", tmpPath); err != nil {
+		return
+	}
+	if err = os.Chmod(tmpPath, mode); err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	listener = &adminSocketListener{listener, path}
+	self.serveAdmin(listener)
+	return
+}
+
+func (self *PipelineConfig) serveAdmin(listener net.Listener) {
+	server := &http.Server{Handler: &adminHandler{self}}
+	go func() {
+		if err := server.Serve(listener); err != nil && !Globals().Stopping {
+			log.Println("Admin API server stopped: ", err)
+		}
+	}()
+}
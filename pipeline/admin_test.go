@@ -0,0 +1,195 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+func AdminSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	c.Specify("The admin API", func() {
+		atomic.StoreInt32(&reloadOutputRuns, 0)
+		atomic.StoreInt32(&reloadOutputStops, 0)
+		config := NewPipelineConfig(nil)
+		err := ioutil.WriteFile(filepath.Join(tmpDir, "hekad.toml"), []byte(`
+[out1]
+type = "ReloadTestOutput"
+message_matcher = "Type == 'foo'"
+`), 0644)
+		c.Assume(err, gs.IsNil)
+		err = config.LoadFromConfigPath(tmpDir)
+		c.Assume(err, gs.IsNil)
+		config.router.Start()
+		defer close(config.router.InChan())
+		for _, output := range config.OutputRunners {
+			config.outputsWg.Add(1)
+			output.Start(config, &config.outputsWg)
+		}
+		c.Assume(waitForCount(&reloadOutputRuns, 1), gs.IsTrue)
+		orig := config.OutputRunners["out1"]
+		handler := &adminHandler{config}
+
+		requestBody := func(method, path string, body io.Reader) *httptest.ResponseRecorder {
+			req, err := http.NewRequest(method, "http://localhost"+path, body)
+			c.Assume(err, gs.IsNil)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			return w
+		}
+
+		request := func(method, path string) *httptest.ResponseRecorder {
+			return requestBody(method, path, nil)
+		}
+
+		c.Specify("lists the running plugins", func() {
+			w := request("GET", "/plugins")
+			c.Expect(w.Code, gs.Equals, http.StatusOK)
+			var data struct {
+				Outputs []adminPluginInfo `json:"outputs"`
+				Globals map[string]interface{}
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &data)
+			c.Expect(err, gs.IsNil)
+			c.Assume(len(data.Outputs), gs.Equals, 1)
+			c.Expect(data.Outputs[0].Name, gs.Equals, "out1")
+			c.Expect(data.Outputs[0].Type, gs.Equals, "ReloadTestOutput")
+			c.Expect(data.Outputs[0].Globals.Matcher, gs.Equals, "Type == 'foo'")
+			c.Expect(data.Globals["PoolSize"], gs.Equals, float64(100))
+		})
+
+		c.Specify("reports when the plugins are ready", func() {
+			w := request("GET", "/ready")
+			c.Expect(w.Code, gs.Equals, http.StatusServiceUnavailable)
+			config.setPluginState("out1", PLUGIN_STARTING)
+			w = request("GET", "/ready")
+			c.Expect(w.Code, gs.Equals, http.StatusOK)
+		})
+
+		c.Specify("explains which matchers accept a message", func() {
+			w := requestBody("POST", "/explain",
+				strings.NewReader(`{"type": "foo", "severity": 3}`))
+			c.Expect(w.Code, gs.Equals, http.StatusOK)
+			var data struct {
+				Matches  []string                  `json:"matches"`
+				Matchers []adminMatcherExplanation `json:"matchers"`
+			}
+			err := json.Unmarshal(w.Body.Bytes(), &data)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(data.Matches), gs.Equals, 1)
+			c.Assume(len(data.Matchers), gs.Equals, 1)
+			c.Expect(data.Matchers[0].Name, gs.Equals, "out1")
+			c.Expect(data.Matchers[0].Match, gs.IsTrue)
+			c.Assume(len(data.Matchers[0].Predicates), gs.Equals, 1)
+			c.Expect(data.Matchers[0].Predicates[0].Predicate, gs.Equals,
+				`Type == "foo"`)
+
+			w = requestBody("POST", "/explain", strings.NewReader(`{"type": `))
+			c.Expect(w.Code, gs.Equals, http.StatusBadRequest)
+		})
+
+		c.Specify("restarts a plugin", func() {
+			w := request("POST", "/plugins/out1/restart")
+			c.Expect(w.Code, gs.Equals, http.StatusOK)
+			c.Expect(waitForCount(&reloadOutputStops, 1), gs.IsTrue)
+			c.Expect(waitForCount(&reloadOutputRuns, 2), gs.IsTrue)
+			c.Expect(config.OutputRunners["out1"], gs.Not(gs.Equals), orig)
+		})
+
+		c.Specify("stops a plugin", func() {
+			w := request("POST", "/plugins/out1/stop")
+			c.Expect(w.Code, gs.Equals, http.StatusOK)
+			c.Expect(waitForCount(&reloadOutputStops, 1), gs.IsTrue)
+			_, ok := config.OutputRunners["out1"]
+			c.Expect(ok, gs.IsFalse)
+
+			c.Specify("which a reload starts again", func() {
+				w = request("POST", "/reload")
+				c.Expect(w.Code, gs.Equals, http.StatusOK)
+				c.Expect(waitForCount(&reloadOutputRuns, 2), gs.IsTrue)
+				_, ok = config.OutputRunners["out1"]
+				c.Expect(ok, gs.IsTrue)
+			})
+		})
+
+		c.Specify("rejects bad requests", func() {
+			w := request("POST", "/plugins/nope/stop")
+			c.Expect(w.Code, gs.Equals, http.StatusBadRequest)
+			w = request("POST", "/plugins/ProtobufDecoder/restart")
+			c.Expect(w.Code, gs.Equals, http.StatusBadRequest)
+			w = request("GET", "/nope")
+			c.Expect(w.Code, gs.Equals, http.StatusNotFound)
+			w = request("DELETE", "/plugins")
+			c.Expect(w.Code, gs.Equals, http.StatusMethodNotAllowed)
+		})
+
+		c.Specify("serves the API on a unix socket", func() {
+			path := filepath.Join(tmpDir, "admin.sock")
+			err := ioutil.WriteFile(path, []byte("not a socket"), 0644)
+			c.Assume(err, gs.IsNil)
+			_, err = config.startAdminSocket(path, 0600)
+			c.Expect(err, gs.Not(gs.IsNil))
+			os.Remove(path)
+
+			listener, err := config.startAdminSocket(path, 0600)
+			c.Assume(err, gs.IsNil)
+			defer listener.Close()
+			info, err := os.Stat(path)
+			c.Assume(err, gs.IsNil)
+			c.Expect(info.Mode().Perm(), gs.Equals, os.FileMode(0600))
+
+			client := &http.Client{Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", path)
+				}}}
+			resp, err := client.Get("http://heka/plugins")
+			c.Assume(err, gs.IsNil)
+			resp.Body.Close()
+			c.Expect(resp.StatusCode, gs.Equals, http.StatusOK)
+
+			_, err = config.startAdminSocket(path, 0600)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			// Only the socket is left in the directory, and it's removed
+			// once closed.
+			names, err := filepath.Glob(filepath.Join(tmpDir, ".heka-admin-*"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(names), gs.Equals, 0)
+			listener.Close()
+			_, err = os.Stat(path)
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+		})
+
+		Globals().Stopping = true
+		for _, output := range config.OutputRunners {
+			config.router.RemoveOutputMatcher() <- output.MatchRunner()
+		}
+		config.outputsWg.Wait()
+		Globals().Stopping = false
+	})
+}
@@ -36,12 +36,49 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(AddressFilterSpec)
+	r.AddSpec(AdminSpec)
+	r.AddSpec(CgroupSpec)
+	r.AddSpec(CharsetSpec)
+	r.AddSpec(ConfigCryptoSpec)
+	r.AddSpec(ConfigMigrationSpec)
+	r.AddSpec(ConfigSecretsSpec)
+	r.AddSpec(DeadLetterSpec)
+	r.AddSpec(DecoderPoolSpec)
+	r.AddSpec(DeliveryPolicySpec)
+	r.AddSpec(DiskWatchdogSpec)
+	r.AddSpec(FieldCryptoSpec)
+	r.AddSpec(HekaJsonSpec)
+	r.AddSpec(HotWindowSpec)
+	r.AddSpec(IdempotencySpec)
+	r.AddSpec(IdentitySpec)
+	r.AddSpec(InputJournalSpec)
 	r.AddSpec(InputRunnerSpec)
+	r.AddSpec(KVStoreSpec)
+	r.AddSpec(LeaderElectionSpec)
+	r.AddSpec(LookupTableSpec)
+	r.AddSpec(MessageExpirySpec)
+	r.AddSpec(MessageGuardSpec)
+	r.AddSpec(MetricsSpec)
 	r.AddSpec(OutputRunnerSpec)
+	r.AddSpec(PackPoolSpec)
+	r.AddSpec(PluginDependenciesSpec)
 	r.AddSpec(ProtobufDecoderSpec)
+	r.AddSpec(QueueBufferSpec)
+	r.AddSpec(RecycleBatchSpec)
+	r.AddSpec(ReloadSpec)
+	r.AddSpec(ReplayRingSpec)
+	r.AddSpec(ReportHistorySpec)
 	r.AddSpec(ReportSpec)
+	r.AddSpec(RouterSpec)
+	r.AddSpec(SeverityShedderSpec)
+	r.AddSpec(SnapshotSpec)
+	r.AddSpec(SplitterSpec)
 	r.AddSpec(StatAccumInputSpec)
 	r.AddSpec(StreamParserSpec)
+	r.AddSpec(TenantsSpec)
+	r.AddSpec(TlsConfigSpec)
+	r.AddSpec(VolumeAccountingSpec)
 
 	gospec.MainGoTest(r, t)
 }
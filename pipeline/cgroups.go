@@ -0,0 +1,205 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/bbangert/toml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// Name of the config section declaring the cgroups plugins can be confined
+// to, one subsection per group.
+const CGROUPS_SECTION = "cgroups"
+
+// cpu.max period, in microseconds.
+const cgroupCpuPeriod = 100000
+
+// Config for a single cgroup.
+type CgroupConfig struct {
+	// CPU time the group's plugins may use together, as a percentage of one
+	// CPU (e.g. 150 is one and a half CPUs), zero is unlimited.
+	CpuPercent uint `toml:"cpu_percent"`
+	// Share of the CPU time the group gets when CPUs are contended, from 1
+	// to 10000, zero leaves the kernel default of 100.
+	CpuWeight uint `toml:"cpu_weight"`
+}
+
+// Writes a value to a cgroup interface file.
+func writeCgroupFile(dir, file, value string) error {
+	path := filepath.Join(dir, file)
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("can't write '%s' to %s: %s", value, path, err)
+	}
+	return nil
+}
+
+// Moves hekad into the cgroup set with the `cgroup` hekad setting, which
+// must be delegated to the user hekad runs as, and applies the
+// `cgroup_memory_max` limit. Only done once.
+func (self *PipelineConfig) joinRootCgroup() (err error) {
+	if self.cgroupRootJoined {
+		return
+	}
+	globals := Globals()
+	if globals.Cgroup == "" {
+		return fmt.Errorf("the %s section needs the cgroup hekad setting",
+			CGROUPS_SECTION)
+	}
+	if err = os.MkdirAll(globals.Cgroup, 0755); err != nil {
+		return
+	}
+	if globals.CgroupMemoryMax > 0 {
+		if err = writeCgroupFile(globals.Cgroup, "memory.max",
+			strconv.FormatUint(globals.CgroupMemoryMax, 10)); err != nil {
+			return
+		}
+	}
+	if err = writeCgroupFile(globals.Cgroup, "cgroup.procs",
+		strconv.Itoa(os.Getpid())); err != nil {
+		return
+	}
+	self.cgroupRootJoined = true
+	return
+}
+
+// Creates (or updates) a threaded child of hekad's cgroup with the given
+// limits.
+func (self *PipelineConfig) createCgroup(name string, conf *CgroupConfig) (
+	path string, err error) {
+
+	path = filepath.Join(Globals().Cgroup, name)
+	if err = os.MkdirAll(path, 0755); err != nil {
+		return
+	}
+	if err = writeCgroupFile(path, "cgroup.type", "threaded"); err != nil {
+		return
+	}
+	// The cpu controller can only be enabled for the children once they're
+	// threaded, hekad's cgroup has processes of its own.
+	if err = writeCgroupFile(Globals().Cgroup, "cgroup.subtree_control",
+		"+cpu"); err != nil {
+		return
+	}
+	cpuMax := "max"
+	if conf.CpuPercent > 0 {
+		cpuMax = strconv.Itoa(int(conf.CpuPercent) * cgroupCpuPeriod / 100)
+	}
+	if err = writeCgroupFile(path, "cpu.max", fmt.Sprintf("%s %d", cpuMax,
+		cgroupCpuPeriod)); err != nil {
+		return
+	}
+	weight := conf.CpuWeight
+	if weight == 0 {
+		weight = 100
+	}
+	err = writeCgroupFile(path, "cpu.weight", strconv.Itoa(int(weight)))
+	return
+}
+
+// Creates the cgroups declared in the cgroups config section.
+func (self *PipelineConfig) declareCgroups(section toml.Primitive) (errcnt uint) {
+	var sections map[string]toml.Primitive
+	if err := toml.PrimitiveDecode(section, &sections); err != nil {
+		self.log(fmt.Sprintf("Unable to decode config for %s: %s",
+			CGROUPS_SECTION, err))
+		return 1
+	}
+	if !cgroupsSupported {
+		self.log("cgroups are only supported on Linux")
+		return 1
+	}
+	if err := self.joinRootCgroup(); err != nil {
+		self.log(fmt.Sprintf("Can't set up hekad's cgroup: %s", err))
+		return 1
+	}
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		conf := new(CgroupConfig)
+		if err := toml.PrimitiveDecode(sections[name], conf); err != nil {
+			self.log(fmt.Sprintf("Unable to decode config for cgroup '%s': %s",
+				name, err))
+			errcnt++
+			continue
+		}
+		if conf.CpuWeight > 10000 {
+			self.log(fmt.Sprintf("Invalid cpu_weight for cgroup '%s': %d",
+				name, conf.CpuWeight))
+			errcnt++
+			continue
+		}
+		path, err := self.createCgroup(name, conf)
+		if err != nil {
+			self.log(fmt.Sprintf("Can't create cgroup '%s': %s", name, err))
+			errcnt++
+			continue
+		}
+		self.cgroupsLock.Lock()
+		self.cgroups[name] = path
+		self.cgroupsLock.Unlock()
+	}
+	return
+}
+
+// Moves the calling goroutine's thread into the named cgroup. The goroutine
+// is locked to the thread for the rest of its life, so when it exits the
+// runtime discards the thread rather than reusing it outside the group.
+func (self *PipelineConfig) joinCgroup(name string) error {
+	self.cgroupsLock.RLock()
+	path, ok := self.cgroups[name]
+	self.cgroupsLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no such cgroup: '%s'", name)
+	}
+	tid, err := lockThread()
+	if err != nil {
+		return err
+	}
+	return writeCgroupFile(path, "cgroup.threads", strconv.Itoa(tid))
+}
+
+// Checks that the plugins' `cgroup` settings name declared cgroups.
+func (self *PipelineConfig) checkCgroups() error {
+	check := func(name string, globals *PluginGlobals) error {
+		if globals == nil || globals.Cgroup == "" {
+			return nil
+		}
+		if _, ok := self.cgroups[globals.Cgroup]; !ok {
+			return fmt.Errorf("'%s' uses undeclared cgroup '%s'", name,
+				globals.Cgroup)
+		}
+		return nil
+	}
+	for name, runner := range self.FilterRunners {
+		if err := check(name, runner.PluginGlobals()); err != nil {
+			return err
+		}
+	}
+	for name, runner := range self.OutputRunners {
+		if err := check(name, runner.PluginGlobals()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"runtime"
+	"syscall"
+)
+
+const cgroupsSupported = true
+
+// Locks the calling goroutine to its thread, returning the thread id.
+func lockThread() (tid int, err error) {
+	runtime.LockOSThread()
+	return syscall.Gettid(), nil
+}
@@ -0,0 +1,109 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/bbangert/toml"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+func CgroupSpec(c gs.Context) {
+	if !cgroupsSupported {
+		return
+	}
+	// A plain directory stands in for the delegated cgroup, the interface
+	// files are created as they're written.
+	tmpDir, err := ioutil.TempDir("", "heka-cgroups")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	readFile := func(path ...string) string {
+		data, err := ioutil.ReadFile(filepath.Join(append([]string{tmpDir}, path...)...))
+		c.Assume(err, gs.IsNil)
+		return string(data)
+	}
+
+	c.Specify("The cgroups section", func() {
+		globals := DefaultGlobals()
+		globals.Cgroup = tmpDir
+		globals.CgroupMemoryMax = 1 << 30
+		pc := NewPipelineConfig(globals)
+		declare := func(tomlStr string) uint {
+			var configFile ConfigFile
+			_, err := toml.Decode(tomlStr, &configFile)
+			c.Assume(err, gs.IsNil)
+			return pc.declareCgroups(configFile[CGROUPS_SECTION])
+		}
+
+		c.Specify("moves hekad into its cgroup", func() {
+			c.Expect(declare("[cgroups.analysis]\n"), gs.Equals, uint(0))
+			c.Expect(readFile("cgroup.procs"), gs.Equals, strconv.Itoa(os.Getpid()))
+			c.Expect(readFile("memory.max"), gs.Equals, "1073741824")
+			c.Expect(readFile("cgroup.subtree_control"), gs.Equals, "+cpu")
+		})
+
+		c.Specify("creates threaded cgroups with cpu limits", func() {
+			errcnt := declare(`
+[cgroups.analysis]
+cpu_percent = 50
+cpu_weight = 20
+
+[cgroups.unlimited]
+`)
+			c.Expect(errcnt, gs.Equals, uint(0))
+			c.Expect(readFile("analysis", "cgroup.type"), gs.Equals, "threaded")
+			c.Expect(readFile("analysis", "cpu.max"), gs.Equals, "50000 100000")
+			c.Expect(readFile("analysis", "cpu.weight"), gs.Equals, "20")
+			c.Expect(readFile("unlimited", "cpu.max"), gs.Equals, "max 100000")
+			c.Expect(readFile("unlimited", "cpu.weight"), gs.Equals, "100")
+		})
+
+		c.Specify("rejects invalid settings", func() {
+			c.Expect(declare("[cgroups.analysis]\ncpu_weight = 10001\n"),
+				gs.Equals, uint(1))
+			globals.Cgroup = ""
+			pc = NewPipelineConfig(globals)
+			c.Expect(declare("[cgroups.analysis]\n"), gs.Equals, uint(1))
+		})
+
+		c.Specify("confines plugin threads", func() {
+			c.Assume(declare("[cgroups.analysis]\n"), gs.Equals, uint(0))
+			errChan := make(chan error)
+			go func() {
+				// The thread is discarded when the goroutine exits.
+				errChan <- pc.joinCgroup("analysis")
+			}()
+			c.Expect(<-errChan, gs.IsNil)
+			tid, err := strconv.Atoi(readFile("analysis", "cgroup.threads"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(tid > 0, gs.IsTrue)
+			c.Expect(pc.joinCgroup("missing").Error(), gs.Equals,
+				"no such cgroup: 'missing'")
+		})
+
+		c.Specify("must be declared for the plugins using them", func() {
+			c.Assume(declare("[cgroups.analysis]\n"), gs.Equals, uint(0))
+			pluginGlobals := &PluginGlobals{Cgroup: "analysis"}
+			pc.FilterRunners["filter"] = NewFORunner("filter", nil, pluginGlobals)
+			c.Expect(pc.checkCgroups(), gs.IsNil)
+			pluginGlobals.Cgroup = "missing"
+			c.Expect(pc.checkCgroups().Error(), gs.Equals,
+				"'filter' uses undeclared cgroup 'missing'")
+		})
+	})
+}
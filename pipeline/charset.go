@@ -0,0 +1,206 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"code.google.com/p/go.text/encoding/japanese"
+	"code.google.com/p/go.text/transform"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Charsets a decoder's `charset` setting takes.
+const (
+	// Detects the charset of each invalid UTF-8 string.
+	CHARSET_AUTO        = "auto"
+	CHARSET_LATIN1      = "latin1"
+	CHARSET_WINDOWS1252 = "windows-1252"
+	CHARSET_SHIFT_JIS   = "shift_jis"
+)
+
+var charsetAliases = map[string]string{
+	"iso-8859-1": CHARSET_LATIN1,
+	"latin-1":    CHARSET_LATIN1,
+	"cp1252":     CHARSET_WINDOWS1252,
+	"sjis":       CHARSET_SHIFT_JIS,
+	"shift-jis":  CHARSET_SHIFT_JIS,
+}
+
+// Code points of the Windows-1252 bytes 0x80 to 0x9f, the five undefined
+// ones mapping to the matching C1 controls like Latin-1.
+var windows1252High = [32]rune{
+	0x20ac, 0x0081, 0x201a, 0x0192, 0x201e, 0x2026, 0x2020, 0x2021,
+	0x02c6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008d, 0x017d, 0x008f,
+	0x0090, 0x2018, 0x2019, 0x201c, 0x201d, 0x2022, 0x2013, 0x2014,
+	0x02dc, 0x2122, 0x0161, 0x203a, 0x0153, 0x009d, 0x017e, 0x0178,
+}
+
+// Transcodes the payloads and string field values a decoder gets and
+// produces to UTF-8 when they aren't valid UTF-8, so invalid bytes don't
+// corrupt the JSON encoders and ElasticSearch outputs downstream. Invalid
+// sequences of the source charset are replaced with U+FFFD.
+type charsetNormalizer struct {
+	charset string
+	// Number of messages transcoded and of invalid sequences replaced.
+	transcoded   int64
+	replacements int64
+}
+
+// Returns the normalizer for a decoder's settings, nil if it has no charset.
+func newCharsetNormalizer(globals *PluginGlobals) (*charsetNormalizer, error) {
+	if globals == nil || globals.Charset == "" {
+		return nil, nil
+	}
+	charset := strings.ToLower(globals.Charset)
+	if alias, ok := charsetAliases[charset]; ok {
+		charset = alias
+	}
+	switch charset {
+	case CHARSET_AUTO, CHARSET_LATIN1, CHARSET_WINDOWS1252, CHARSET_SHIFT_JIS:
+	default:
+		return nil, fmt.Errorf("unsupported charset: %s", globals.Charset)
+	}
+	return &charsetNormalizer{charset: charset}, nil
+}
+
+// Returns true if s is well formed Shift-JIS text with at least two adjacent
+// double-byte characters, which Latin-1 text seldom happens to be.
+func looksLikeShiftJIS(s string) bool {
+	var run, longest int
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c < 0x80 || (c >= 0xa1 && c <= 0xdf):
+			run = 0
+		case (c >= 0x81 && c <= 0x9f) || (c >= 0xe0 && c <= 0xfc):
+			if i+1 == len(s) {
+				return false
+			}
+			t := s[i+1]
+			if t < 0x40 || t == 0x7f || t > 0xfc {
+				return false
+			}
+			i++
+			if run++; run > longest {
+				longest = run
+			}
+		default:
+			return false
+		}
+	}
+	return longest >= 2
+}
+
+// Returns the charset an invalid UTF-8 string is most likely in.
+func detectCharset(s string) string {
+	if looksLikeShiftJIS(s) {
+		return CHARSET_SHIFT_JIS
+	}
+	return CHARSET_WINDOWS1252
+}
+
+// Returns s transcoded from the charset and the number of invalid sequences
+// replaced.
+func transcode(s, charset string) (string, int, error) {
+	switch charset {
+	case CHARSET_SHIFT_JIS:
+		reader := transform.NewReader(strings.NewReader(s),
+			japanese.ShiftJIS.NewDecoder())
+		decoded, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return "", 0, err
+		}
+		return string(decoded), bytes.Count(decoded, []byte("\uFFFD")), nil
+	}
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+		if charset == CHARSET_WINDOWS1252 && s[i] >= 0x80 && s[i] <= 0x9f {
+			runes[i] = windows1252High[s[i]-0x80]
+		}
+	}
+	return string(runes), 0, nil
+}
+
+// Returns s in UTF-8, whether it had to be transcoded, and the number of
+// invalid sequences replaced.
+func (n *charsetNormalizer) normalize(s string) (string, bool, int) {
+	if utf8.ValidString(s) {
+		return s, false, 0
+	}
+	charset := n.charset
+	if charset == CHARSET_AUTO {
+		charset = detectCharset(s)
+	}
+	normalized, replaced, err := transcode(s, charset)
+	if err != nil {
+		normalized, replaced = replaceInvalid(s)
+	}
+	return normalized, true, replaced
+}
+
+// Returns s with its invalid UTF-8 bytes replaced with U+FFFD, and the number
+// of bytes replaced.
+func replaceInvalid(s string) (string, int) {
+	var replaced int
+	runes := make([]rune, 0, len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			replaced++
+		}
+		runes = append(runes, r)
+		i += size
+	}
+	return string(runes), replaced
+}
+
+// Transcodes the message's payload and string field values.
+func (n *charsetNormalizer) apply(msg *message.Message) {
+	var transcoded bool
+	var replacements int
+	normalize := func(s string) string {
+		normalized, changed, replaced := n.normalize(s)
+		transcoded = transcoded || changed
+		replacements += replaced
+		return normalized
+	}
+	if msg.Payload != nil {
+		if payload := normalize(msg.GetPayload()); transcoded {
+			msg.SetPayload(payload)
+		}
+	}
+	for _, field := range msg.Fields {
+		for i, value := range field.ValueString {
+			field.ValueString[i] = normalize(value)
+		}
+	}
+	if transcoded {
+		atomic.AddInt64(&n.transcoded, 1)
+		atomic.AddInt64(&n.replacements, int64(replacements))
+	}
+}
+
+func (n *charsetNormalizer) ReportMsg(msg *message.Message) {
+	message.NewInt64Field(msg, "CharsetTranscodedCount",
+		atomic.LoadInt64(&n.transcoded), "count")
+	message.NewInt64Field(msg, "CharsetReplacementCount",
+		atomic.LoadInt64(&n.replacements), "count")
+}
@@ -0,0 +1,105 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CharsetSpec(c gs.Context) {
+	newNormalizer := func(charset string) *charsetNormalizer {
+		n, err := newCharsetNormalizer(&PluginGlobals{Charset: charset})
+		c.Assume(err, gs.IsNil)
+		return n
+	}
+	normalize := func(n *charsetNormalizer, s string) string {
+		normalized, _, _ := n.normalize(s)
+		return normalized
+	}
+
+	c.Specify("A charset normalizer", func() {
+		c.Specify("takes the usual charset names", func() {
+			c.Expect(newNormalizer("ISO-8859-1").charset, gs.Equals, CHARSET_LATIN1)
+			c.Expect(newNormalizer("SJIS").charset, gs.Equals, CHARSET_SHIFT_JIS)
+			n, err := newCharsetNormalizer(&PluginGlobals{Charset: "ebcdic"})
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(n, gs.IsNil)
+			n, err = newCharsetNormalizer(new(PluginGlobals))
+			c.Expect(err, gs.IsNil)
+			c.Expect(n, gs.IsNil)
+		})
+
+		c.Specify("leaves valid UTF-8 alone", func() {
+			n := newNormalizer(CHARSET_AUTO)
+			s, transcoded, _ := n.normalize("日本語 café")
+			c.Expect(s, gs.Equals, "日本語 café")
+			c.Expect(transcoded, gs.IsFalse)
+		})
+
+		c.Specify("detects Latin-1", func() {
+			n := newNormalizer(CHARSET_AUTO)
+			c.Expect(normalize(n, "caf\xe9"), gs.Equals, "café")
+			c.Expect(normalize(n, "f\xfcr"), gs.Equals, "für")
+			c.Expect(normalize(n, "\x93Hi\x94"), gs.Equals, "“Hi”")
+		})
+
+		c.Specify("detects Shift-JIS", func() {
+			n := newNormalizer(CHARSET_AUTO)
+			c.Expect(normalize(n, "\x93\xfa\x96\x7b\x8c\xea log"), gs.Equals,
+				"日本語 log")
+		})
+
+		c.Specify("transcodes from the configured charset", func() {
+			c.Expect(normalize(newNormalizer(CHARSET_LATIN1), "\x93\xe9"), gs.Equals,
+				"\u0093é")
+			s, _, replaced := newNormalizer(CHARSET_SHIFT_JIS).normalize("\x93\xfa\x96")
+			c.Expect(s, gs.Equals, "日�")
+			c.Expect(replaced, gs.Equals, 1)
+		})
+
+		c.Specify("normalizes the payload and string fields", func() {
+			n := newNormalizer(CHARSET_SHIFT_JIS)
+			msg := new(message.Message)
+			msg.SetPayload("\x93\xfa\x96\x7b")
+			message.NewStringField(msg, "valid", "ok")
+			message.NewStringField(msg, "truncated", "\x8c")
+			n.apply(msg)
+			c.Expect(msg.GetPayload(), gs.Equals, "日本")
+			valid, _ := msg.GetFieldValue("valid")
+			c.Expect(valid, gs.Equals, "ok")
+			truncated, _ := msg.GetFieldValue("truncated")
+			c.Expect(truncated, gs.Equals, "�")
+
+			report := new(message.Message)
+			n.ReportMsg(report)
+			count, _ := report.GetFieldValue("CharsetTranscodedCount")
+			c.Expect(count, gs.Equals, int64(1))
+			count, _ = report.GetFieldValue("CharsetReplacementCount")
+			c.Expect(count, gs.Equals, int64(1))
+		})
+	})
+
+	c.Specify("The config rejects an unsupported charset", func() {
+		pc := NewPipelineConfig(nil)
+		var sections map[string]toml.Primitive
+		_, err := toml.Decode(`[section]
+		type = "ProtobufDecoder"
+		charset = "ebcdic"`, &sections)
+		c.Assume(err, gs.IsNil)
+		c.Expect(pc.loadSection("section", sections["section"]), gs.Equals, uint(1))
+	})
+}
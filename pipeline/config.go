@@ -28,12 +28,13 @@ import (
 	"time"
 )
 
-// Set a sample rate for match and message processing timing i.e. 1 in a million
+// Default sample rate for match and message processing timing, i.e. 1 in a
+// thousand, plugins can set their own with `sample_denominator`.
 const DURATION_SAMPLE_DENOMINATOR = 1e3
 
 var (
 	AvailablePlugins = make(map[string]func() interface{})
-	PluginTypeRegex  = regexp.MustCompile("^.*(Decoder|Filter|Input|Output)$")
+	PluginTypeRegex  = regexp.MustCompile("^.*(Decoder|Encoder|Filter|Input|Output|Splitter)$")
 )
 
 // Adds a plugin to the set of usable Heka plugins that can be referenced from
@@ -65,6 +66,14 @@ type PluginHelper interface {
 	// created Decoder of the specified name.
 	DecoderRunner(name string) (dRunner DecoderRunner, ok bool)
 
+	// Instantiates and returns an Encoder of the specified name, or ok ==
+	// false if no encoder by that name is registered.
+	Encoder(name string) (encoder Encoder, ok bool)
+
+	// Instantiates and returns a Splitter of the specified name, or ok ==
+	// false if no splitter by that name is registered.
+	Splitter(name string) (splitter Splitter, ok bool)
+
 	// Expects a loop count value from an existing message (or zero if there's
 	// no relevant existing message), returns an initialized `PipelinePack`
 	// pointer that can be populated w/ message data and inserted into the
@@ -76,6 +85,14 @@ type PluginHelper interface {
 	// StatAccumulator interface, or an error value if such a plugin
 	// can't be found.
 	StatAccumulator(name string) (statAccum StatAccumulator, err error)
+
+	// Returns the persistent key/value store of the named plugin, creating
+	// it if needed. Plugins should only use the store of their own name.
+	KVStore(name string) (store *KVStore, err error)
+
+	// Returns the lookup table of the given name, as declared in the
+	// `lookup_tables` config section.
+	LookupTable(name string) (table *LookupTable, ok bool)
 }
 
 // Indicates a plug-in has a specific-to-itself config struct that should be
@@ -92,6 +109,14 @@ type WantsName interface {
 	SetName(name string)
 }
 
+// Indicates a plug-in samples its message processing durations, e.g. for
+// its reports.
+type WantsSampleDenominator interface {
+	// Passes the plugin's `sample_denominator`, i.e. one in how many messages
+	// to time, into the plugin before it's started.
+	SetSampleDenominator(denominator int)
+}
+
 // Indicates a plug-in can handle being restart should it exit before
 // heka is shut-down.
 type Restarting interface {
@@ -116,6 +141,10 @@ type PipelineConfig struct {
 	inputWrappers map[string]*PluginWrapper
 	// PluginWrappers that can create Decoder plugin objects.
 	DecoderWrappers map[string]*PluginWrapper
+	// PluginWrappers that can create Encoder plugin objects.
+	encoderWrappers map[string]*PluginWrapper
+	// PluginWrappers that can create Splitter plugin objects.
+	splitterWrappers map[string]*PluginWrapper
 	// All running FilterRunners, by name.
 	FilterRunners map[string]FilterRunner
 	// PluginWrappers that can create Filter plugin objects.
@@ -126,11 +155,17 @@ type PipelineConfig struct {
 	outputWrappers map[string]*PluginWrapper
 	// Heka message router instance.
 	router *messageRouter
+	// Enforces the disk budgets of the queue and output directories.
+	diskWatchdog *DiskWatchdog
 	// PipelinePack supply for Input plugins.
 	inputRecycleChan chan *PipelinePack
 	// PipelinePack supply for Filter plugins (separate pool prevents
 	// deadlocks).
 	injectRecycleChan chan *PipelinePack
+	// Packs of the input and inject recycle channels, set once the pipeline
+	// runs.
+	inputPool  *packPool
+	injectPool *packPool
 	// Stores log messages generated by plugin config errors.
 	LogMsgs []string
 	// Lock protecting access to the set of running filters so dynamic filters
@@ -153,8 +188,58 @@ type PipelineConfig struct {
 	inputsLock sync.Mutex
 	// Is freed when all Input runners have stopped.
 	inputsWg sync.WaitGroup
+	// Lock protecting access to the set of running outputs so they can be
+	// safely added and removed by a config reload.
+	outputsLock sync.Mutex
+	// Is freed when all Output runners have stopped.
+	outputsWg sync.WaitGroup
+	// Lock protecting the decoder and encoder wrappers, which a config
+	// reload may replace.
+	wrappersLock sync.RWMutex
 	// Internal reporting channel
 	reportRecycleChan chan *PipelinePack
+	// Config files and directories loaded, re-read by a config reload.
+	configPaths []string
+	// Generic (i.e. map) form of each loaded config section, used to work
+	// out which sections a reload changes.
+	sectionConfigs map[string]interface{}
+	// Undecoded form of each loaded config section, used to recreate a
+	// plugin when it's restarted.
+	sectionPrimitives map[string]toml.Primitive
+	// Plugin category ("Input", "Decoder", etc.) of each loaded section.
+	sectionCategories map[string]string
+	// Deprecated options found in the loaded sections.
+	deprecations     []Deprecation
+	deprecationsLock sync.Mutex
+	// Only one config reload runs at a time.
+	reloadLock sync.Mutex
+	// Open plugin key/value stores, by plugin name.
+	kvStores     map[string]*KVStore
+	kvStoresLock sync.Mutex
+	// Declared lookup tables, by name.
+	lookupTables     map[string]*LookupTable
+	lookupTablesLock sync.RWMutex
+	// Keeps the messages that would otherwise be destroyed.
+	deadLetters *deadLetterQueue
+	// Each plugin's `depends_on` setting, if set.
+	pluginDeps map[string][]string
+	// Startup state of the inputs, filters and outputs that were started.
+	pluginStates map[string]string
+	// Protects pluginDeps and pluginStates, which config reloads change.
+	pluginStatesLock sync.Mutex
+	// Paths of the declared cgroups, by name.
+	cgroups     map[string]string
+	cgroupsLock sync.RWMutex
+	// Replay rings of the filters' matcher classes, by class.
+	replayRings     map[string]*replayRing
+	replayRingsLock sync.Mutex
+	// Set once hekad has moved itself into its cgroup.
+	cgroupRootJoined bool
+	// Recent report data served by the admin API, nil if disabled.
+	reportHistory *reportHistory
+	// Declared tenants, nil if there's no tenants section.
+	tenants     *tenantRegistry
+	tenantsLock sync.RWMutex
 }
 
 // Creates and initializes a PipelineConfig object. `nil` value for `globals`
@@ -171,18 +256,39 @@ func NewPipelineConfig(globals *GlobalConfigStruct) (config *PipelineConfig) {
 	config.InputRunners = make(map[string]InputRunner)
 	config.inputWrappers = make(map[string]*PluginWrapper)
 	config.DecoderWrappers = make(map[string]*PluginWrapper)
+	config.encoderWrappers = make(map[string]*PluginWrapper)
+	config.splitterWrappers = make(map[string]*PluginWrapper)
 	config.FilterRunners = make(map[string]FilterRunner)
 	config.filterWrappers = make(map[string]*PluginWrapper)
 	config.OutputRunners = make(map[string]OutputRunner)
+	config.sectionConfigs = make(map[string]interface{})
+	config.sectionPrimitives = make(map[string]toml.Primitive)
+	config.sectionCategories = make(map[string]string)
 	config.outputWrappers = make(map[string]*PluginWrapper)
 	config.router = NewMessageRouter()
-	config.inputRecycleChan = make(chan *PipelinePack, globals.PoolSize)
-	config.injectRecycleChan = make(chan *PipelinePack, globals.PoolSize)
+	config.diskWatchdog = NewDiskWatchdog(config, globals)
+	config.kvStores = make(map[string]*KVStore)
+	config.lookupTables = make(map[string]*LookupTable)
+	if globals.ReportHistory > 0 {
+		config.reportHistory = newReportHistory(globals.ReportHistory,
+			globals.ReportHistoryInterval)
+	}
+	poolCap := globals.PoolSize
+	if globals.MaxPoolSize > poolCap {
+		poolCap = globals.MaxPoolSize
+	}
+	config.inputRecycleChan = make(chan *PipelinePack, poolCap)
+	config.injectRecycleChan = make(chan *PipelinePack, poolCap)
 	config.LogMsgs = make([]string, 0, 4)
 	config.allDecoders = make([]DecoderRunner, 0, 10)
-	config.hostname, _ = os.Hostname()
+	config.hostname = globals.Hostname
 	config.pid = int32(os.Getpid())
 	config.reportRecycleChan = make(chan *PipelinePack, 1)
+	config.deadLetters = newDeadLetterQueue(config, globals)
+	config.pluginDeps = make(map[string][]string)
+	config.pluginStates = make(map[string]string)
+	config.cgroups = make(map[string]string)
+	config.replayRings = make(map[string]*replayRing)
 
 	return config
 }
@@ -197,7 +303,7 @@ func (self *PipelineConfig) PipelinePack(msgLoopCount uint) *PipelinePack {
 	pack := <-self.injectRecycleChan
 	pack.Message.SetTimestamp(time.Now().UnixNano())
 	pack.Message.SetUuid(uuid.NewRandom())
-	pack.Message.SetHostname(self.hostname)
+	StampIdentity(pack.Message, self.hostname)
 	pack.Message.SetPid(self.pid)
 	pack.RefCount = 1
 	pack.MsgLoopCount = msgLoopCount
@@ -209,6 +315,11 @@ func (self *PipelineConfig) Router() MessageRouter {
 	return self.router
 }
 
+// Returns the watchdog enforcing the disk budgets.
+func (self *PipelineConfig) DiskWatchdog() *DiskWatchdog {
+	return self.diskWatchdog
+}
+
 // Returns the inputRecycleChannel.
 func (self *PipelineConfig) InputRecycleChan() chan *PipelinePack {
 	return self.inputRecycleChan
@@ -227,6 +338,8 @@ func (self *PipelineConfig) Hostname() string {
 // Returns OutputRunner registered under the specified name, or nil (and ok ==
 // false) if no such name is registered.
 func (self *PipelineConfig) Output(name string) (oRunner OutputRunner, ok bool) {
+	self.outputsLock.Lock()
+	defer self.outputsLock.Unlock()
 	oRunner, ok = self.OutputRunners[name]
 	return
 }
@@ -242,7 +355,10 @@ func (self *PipelineConfig) PipelineConfig() *PipelineConfig {
 // WantsDecoderRunnerShutdown interfaces.
 func (self *PipelineConfig) Decoder(name string) (decoder Decoder, ok bool) {
 	var wrapper *PluginWrapper
-	if wrapper, ok = self.DecoderWrappers[name]; ok {
+	self.wrappersLock.RLock()
+	wrapper, ok = self.DecoderWrappers[name]
+	self.wrappersLock.RUnlock()
+	if ok {
 		decoder = wrapper.Create().(Decoder)
 	}
 	return
@@ -251,15 +367,52 @@ func (self *PipelineConfig) Decoder(name string) (decoder Decoder, ok bool) {
 // Instantiates, starts, and returns a DecoderRunner wrapped around a newly
 // created Decoder of the specified name.
 func (self *PipelineConfig) DecoderRunner(name string) (dRunner DecoderRunner, ok bool) {
-	var decoder Decoder
-	if decoder, ok = self.Decoder(name); ok {
-		pluginGlobals := new(PluginGlobals)
-		dRunner = NewDecoderRunner(name, decoder, pluginGlobals)
-		self.allDecodersLock.Lock()
-		self.allDecoders = append(self.allDecoders, dRunner)
-		self.allDecodersLock.Unlock()
-		self.decodersWg.Add(1)
-		dRunner.Start(self, &self.decodersWg)
+	var wrapper *PluginWrapper
+	self.wrappersLock.RLock()
+	wrapper, ok = self.DecoderWrappers[name]
+	self.wrappersLock.RUnlock()
+	if !ok {
+		return
+	}
+	pluginGlobals := wrapper.pluginGlobals
+	if pluginGlobals == nil {
+		pluginGlobals = new(PluginGlobals)
+	}
+	if pluginGlobals.PoolSize > 1 {
+		dRunner = newDecoderPool(name, wrapper, pluginGlobals)
+	} else {
+		dRunner = NewDecoderRunner(name, wrapper.Create().(Decoder), pluginGlobals)
+	}
+	self.allDecodersLock.Lock()
+	self.allDecoders = append(self.allDecoders, dRunner)
+	self.allDecodersLock.Unlock()
+	self.decodersWg.Add(1)
+	dRunner.Start(self, &self.decodersWg)
+	return
+}
+
+// Instantiates and returns an Encoder of the specified name. Each caller gets
+// its own instance, encoders don't need to be safe for concurrent use.
+func (self *PipelineConfig) Encoder(name string) (encoder Encoder, ok bool) {
+	var wrapper *PluginWrapper
+	self.wrappersLock.RLock()
+	wrapper, ok = self.encoderWrappers[name]
+	self.wrappersLock.RUnlock()
+	if ok {
+		encoder = wrapper.Create().(Encoder)
+	}
+	return
+}
+
+// Instantiates and returns a Splitter of the specified name. Each caller gets
+// its own instance, since a splitter holds the state of a single stream.
+func (self *PipelineConfig) Splitter(name string) (splitter Splitter, ok bool) {
+	var wrapper *PluginWrapper
+	self.wrappersLock.RLock()
+	wrapper, ok = self.splitterWrappers[name]
+	self.wrappersLock.RUnlock()
+	if ok {
+		splitter = wrapper.Create().(Splitter)
 	}
 	return
 }
@@ -376,6 +529,95 @@ type PluginGlobals struct {
 	Matcher string `toml:"message_matcher"`
 	Signer  string `toml:"message_signer"`
 	Retries RetryOptions
+	// Spool matched messages to disk before handing them to a filter or
+	// output.
+	UseBuffering bool `toml:"use_buffering"`
+	// Maximum number of bytes the disk buffer may hold, zero is unlimited.
+	MaxBufferSize uint64 `toml:"max_buffer_size"`
+	// What to do when the disk buffer is full: "drop", "block" or
+	// "shutdown".
+	FullAction string `toml:"full_action"`
+	// Maximum number of bytes the plugin's queue or output directory may
+	// use, zero is unlimited.
+	DiskBudget uint64 `toml:"disk_budget"`
+	// Number of instances of a decoder decoding in parallel for each input
+	// that uses it. Decoders only.
+	PoolSize uint `toml:"pool_size"`
+	// Age in seconds after which messages are skipped instead of delivered.
+	// Outputs only.
+	MessageTTL uint `toml:"message_ttl"`
+	// Queue fill percentage above which messages less severe than
+	// ShedMaxSeverity are dropped, zero disables shedding. Outputs only.
+	ShedQueuePercent uint `toml:"shed_queue_percent"`
+	// Highest severity still delivered while shedding.
+	ShedMaxSeverity int32 `toml:"shed_max_severity"`
+	// Longest the router waits to deliver to a filter or output before
+	// isolating it, e.g. "5s". Isolation is disabled if not set.
+	IsolateAfter string `toml:"isolate_after"`
+	// Output receiving an isolated plugin's messages, they're dropped if not
+	// set.
+	IsolateFailover string `toml:"isolate_failover"`
+	// What to do with a message when the filter or output's input channel
+	// is full: "block", "drop_oldest", "drop_newest" or "sample(N)".
+	DeliveryPolicy string `toml:"delivery_policy"`
+	// Plugins that must be running and ready before this one is started.
+	// Inputs, filters and outputs only.
+	DependsOn []string `toml:"depends_on"`
+	// Declared cgroup the plugin runs in. Filters and outputs only.
+	Cgroup string `toml:"cgroup"`
+	// Declared tenant every message the input receives belongs to. Inputs
+	// only.
+	Tenant string `toml:"tenant"`
+	// Declared tenants whose messages the filter or output may receive, all
+	// messages if empty.
+	Tenants []string `toml:"tenants"`
+	// Age, e.g. "15m", beyond which the messages the filter or output
+	// matches are diverted to ColdOutput instead, so backfill doesn't reach
+	// realtime plugins. Disabled if not set.
+	HotWindow string `toml:"hot_window"`
+	// Output receiving the messages older than HotWindow, they're dropped if
+	// not set.
+	ColdOutput string `toml:"cold_output"`
+	// Lock shared by the instances of a cluster running the filter, e.g.
+	// "file:/mnt/shared/deadman.lease", only the one holding it runs the
+	// filter actively. Filters only.
+	LeaderLock string `toml:"leader_lock"`
+	// Seconds the leader lock is held without being renewed,
+	// DEFAULT_LEADER_LEASE if zero.
+	LeaderLease uint `toml:"leader_lease"`
+	// How far back, e.g. "5m", the filter is fed the messages matching its
+	// message_matcher when it's started, so stateful aggregations warm up.
+	// Filters only.
+	Replay string `toml:"replay"`
+	// Journal the received records to disk until they reach the router, so
+	// they're replayed after a crash. Inputs only.
+	Journal bool `toml:"journal"`
+	// Limits on the messages a decoder produces, zero is unlimited. Decoders
+	// only.
+	MaxFields           uint `toml:"max_fields"`
+	MaxFieldNameLength  uint `toml:"max_field_name_length"`
+	MaxFieldValueLength uint `toml:"max_field_value_length"`
+	MaxPayloadSize      uint `toml:"max_payload_size"`
+	// What to do with a message exceeding one of the limits: "truncate" or
+	// "drop". Decoders only.
+	GuardAction string `toml:"guard_action"`
+	// Charset the payloads and string field values that aren't valid UTF-8
+	// are transcoded from: "auto", "latin1", "windows-1252" or "shift_jis".
+	// Decoders only.
+	Charset string `toml:"charset"`
+	// One in how many messages the matching and processing durations are
+	// sampled, DURATION_SAMPLE_DENOMINATOR if zero.
+	SampleDenominator uint `toml:"sample_denominator"`
+}
+
+// Returns the runner's `sample_denominator`, or the default if it's not set.
+func SampleDenominator(pr PluginRunner) int {
+	if pr != nil {
+		if globals := pr.PluginGlobals(); globals != nil && globals.SampleDenominator > 0 {
+			return int(globals.SampleDenominator)
+		}
+	}
+	return DURATION_SAMPLE_DENOMINATOR
 }
 
 // Default Decoders configuration.
@@ -388,6 +630,9 @@ type PluginWrapper struct {
 	Name          string
 	ConfigCreator func() interface{}
 	PluginCreator func() interface{}
+	// Heka's own settings from the plugin's config section, kept for
+	// decoders since their runners are created later.
+	pluginGlobals *PluginGlobals
 }
 
 // Create a new instance of the plugin and return it. Errors are ignored. Call
@@ -423,6 +668,8 @@ func LoadConfigStruct(config toml.Primitive, configable interface{}) (
 		configStruct = PluginConfig{}
 		if err = toml.PrimitiveDecode(config, configStruct); err != nil {
 			configStruct = nil
+		} else if err = resolveConfigValues(configStruct); err != nil {
+			configStruct = nil
 		}
 		return
 	}
@@ -453,10 +700,21 @@ func LoadConfigStruct(config toml.Primitive, configable interface{}) (
 			// We've got an unrecognized config option.
 			err = fmt.Errorf("Unknown config setting: %s", matches[1])
 		}
+	} else if err = resolveConfigValues(configStruct); err != nil {
+		configStruct = nil
 	}
 	return
 }
 
+// Expands the environment variable and file references in a decoded plugin
+// config, then decrypts its encrypted values.
+func resolveConfigValues(config interface{}) (err error) {
+	if err = InterpolateConfigValues(config); err != nil {
+		return
+	}
+	return DecryptConfigValues(config, Globals().ConfigCipher)
+}
+
 // Uses reflection to extract an attribute value from an arbitrary struct type
 // that may or may not actually have the attribute, returning a provided
 // default if the provided object is not a struct or if the attribute doesn't
@@ -478,10 +736,22 @@ func getAttr(ob interface{}, attr string, default_ interface{}) (ret interface{}
 
 // Used internally to log and record plugin config loading errors.
 func (self *PipelineConfig) log(msg string) {
+	msg = RedactSecrets(msg)
 	self.LogMsgs = append(self.LogMsgs, msg)
 	log.Println(msg)
 }
 
+// A plugin created from a config section that hasn't been registered with
+// the pipeline yet. Only one of iRunner / foRunner is set, depending on the
+// category, decoders and encoders only have a wrapper.
+type loadedSection struct {
+	category  string
+	wrapper   *PluginWrapper
+	iRunner   InputRunner
+	foRunner  *foRunner
+	dependsOn []string
+}
+
 // loadSection must be passed a plugin name and the config for that plugin. It
 // will create a PluginWrapper (i.e. a factory). For decoders we store the
 // PluginWrappers and create pools of DecoderRunners for each type, stored in
@@ -489,6 +759,48 @@ func (self *PipelineConfig) log(msg string) {
 // configure it, then create the appropriate plugin runner.
 func (self *PipelineConfig) loadSection(sectionName string,
 	configSection toml.Primitive) (errcnt uint) {
+	var section *loadedSection
+	if section, errcnt = self.createSection(sectionName, configSection); errcnt == 0 {
+		self.registerSection(section)
+	}
+	return
+}
+
+// Registers a loaded section's wrapper and runner with the pipeline. Only
+// used before the router is started, matchers are added to it directly.
+func (self *PipelineConfig) registerSection(section *loadedSection) {
+	name := section.wrapper.Name
+	self.sectionCategories[name] = section.category
+	self.setDependencies(name, section.dependsOn)
+	switch section.category {
+	case "Decoder":
+		self.DecoderWrappers[name] = section.wrapper
+	case "Encoder":
+		self.encoderWrappers[name] = section.wrapper
+	case "Splitter":
+		self.splitterWrappers[name] = section.wrapper
+	case "Input":
+		self.InputRunners[name] = section.iRunner
+		self.inputWrappers[name] = section.wrapper
+	case "Filter":
+		runner := section.foRunner
+		self.router.fMatchers = append(self.router.fMatchers, runner.matcher)
+		self.FilterRunners[name] = runner
+		if _, ok := runner.plugin.(Stoppable); !ok {
+			self.filterWrappers[name] = section.wrapper
+		}
+	case "Output":
+		runner := section.foRunner
+		self.router.oMatchers = append(self.router.oMatchers, runner.matcher)
+		self.OutputRunners[name] = runner
+		self.outputWrappers[name] = section.wrapper
+	}
+}
+
+// Creates the PluginWrapper and (for inputs, filters, and outputs) the
+// initialized plugin and its runner for a config section.
+func (self *PipelineConfig) createSection(sectionName string,
+	configSection toml.Primitive) (section *loadedSection, errcnt uint) {
 	var ok bool
 	var err error
 	var pluginGlobals PluginGlobals
@@ -503,6 +815,17 @@ func (self *PipelineConfig) loadSection(sectionName string,
 		Delay:      "250ms",
 		MaxRetries: -1,
 	}
+	pluginGlobals.FullAction = BUFFER_FULL_SHUTDOWN
+	pluginGlobals.ShedMaxSeverity = 4
+
+	deprecations, err := migrateSection(sectionName, configSection)
+	if err != nil {
+		self.log(fmt.Sprintf("Can't load config for plugin: %s, error: %s",
+			wrapper.Name, err))
+		errcnt++
+		return
+	}
+	self.recordDeprecations(deprecations)
 
 	if err = toml.PrimitiveDecode(configSection, &pluginGlobals); err != nil {
 		self.log(fmt.Sprintf("Unable to decode config for plugin: %s, error: %s",
@@ -510,6 +833,12 @@ func (self *PipelineConfig) loadSection(sectionName string,
 		errcnt++
 		return
 	}
+	if err = resolveConfigValues(&pluginGlobals); err != nil {
+		self.log(fmt.Sprintf("Can't load config for plugin: %s, error: %s",
+			wrapper.Name, err))
+		errcnt++
+		return
+	}
 	if pluginGlobals.Typ == "" {
 		pluginType = sectionName
 	} else {
@@ -552,12 +881,37 @@ func (self *PipelineConfig) loadSection(sectionName string,
 		return
 	}
 	pluginCategory := pluginCats[1]
+	section = &loadedSection{category: pluginCategory, wrapper: wrapper}
+	if len(pluginGlobals.DependsOn) > 0 {
+		switch pluginCategory {
+		case "Input", "Filter", "Output":
+			section.dependsOn = pluginGlobals.DependsOn
+		default:
+			self.log(fmt.Sprintf("'%s' can't use depends_on, only inputs, filters "+
+				"and outputs can", wrapper.Name))
+			errcnt++
+			return nil, errcnt
+		}
+	}
 
 	// Decoders are registered but aren't instantiated until needed by a
 	// specific input plugin. We ignore the one that's already been created
 	// and just store the wrapper so we can create them when we need them.
-	if pluginCategory == "Decoder" {
-		self.DecoderWrappers[wrapper.Name] = wrapper
+	// Encoders and splitters work the same way, each output or input stream
+	// that uses one gets a new instance.
+	if pluginCategory == "Decoder" || pluginCategory == "Encoder" ||
+		pluginCategory == "Splitter" {
+		if pluginCategory == "Decoder" {
+			if _, err = newMessageGuard(&pluginGlobals); err == nil {
+				_, err = newCharsetNormalizer(&pluginGlobals)
+			}
+			if err != nil {
+				self.log(fmt.Sprintf("Invalid config for '%s': %s", wrapper.Name, err))
+				errcnt++
+				return nil, errcnt
+			}
+		}
+		wrapper.pluginGlobals = &pluginGlobals
 		return
 	}
 
@@ -568,20 +922,28 @@ func (self *PipelineConfig) loadSection(sectionName string,
 		pluginGlobals.Ticker = tickerVal.(uint)
 	}
 
-	// For inputs we just store the InputRunner and we're done.
+	// For inputs we just create the InputRunner and we're done.
 	if pluginCategory == "Input" {
-		self.InputRunners[wrapper.Name] = NewInputRunner(wrapper.Name,
-			plugin.(Input), &pluginGlobals)
-		self.inputWrappers[wrapper.Name] = wrapper
-
+		section.iRunner = NewInputRunner(wrapper.Name, plugin.(Input),
+			&pluginGlobals)
 		if pluginGlobals.Ticker != 0 {
 			tickLength := time.Duration(pluginGlobals.Ticker) * time.Second
-			self.InputRunners[wrapper.Name].SetTickLength(tickLength)
+			section.iRunner.SetTickLength(tickLength)
 		}
-
 		return
 	}
 
+	if pluginGlobals.UseBuffering {
+		switch pluginGlobals.FullAction {
+		case BUFFER_FULL_DROP, BUFFER_FULL_BLOCK, BUFFER_FULL_SHUTDOWN:
+		default:
+			self.log(fmt.Sprintf("Invalid full_action for '%s': %s", wrapper.Name,
+				pluginGlobals.FullAction))
+			errcnt++
+			return nil, errcnt
+		}
+	}
+
 	// Filters and outputs have a few more config settings.
 	runner := NewFORunner(wrapper.Name, plugin.(Plugin), &pluginGlobals)
 	runner.name = wrapper.Name
@@ -597,42 +959,114 @@ func (self *PipelineConfig) loadSection(sectionName string,
 		pluginGlobals.Matcher = matcherVal.(string)
 	}
 
-	var matcher *MatchRunner
 	if pluginGlobals.Matcher == "" {
 		// Filters and outputs must specify a message matcher
 		self.log(fmt.Sprintf("'%s' missing message matcher", wrapper.Name))
 		errcnt++
-		return
+		return nil, errcnt
+	}
+	if runner.matcher, err = NewMatchRunner(pluginGlobals.Matcher,
+		pluginGlobals.Signer, runner); err != nil {
+		self.log(fmt.Sprintf("Can't create message matcher for '%s': %s",
+			wrapper.Name, err))
+		errcnt++
+		return nil, errcnt
+	}
+	runner.matcher.SetTenants(pluginGlobals.Tenants)
+	if runner.matcher.policy, err = newDeliveryPolicy(
+		pluginGlobals.DeliveryPolicy); err != nil {
+
+		self.log(fmt.Sprintf("Invalid delivery_policy for '%s': %s",
+			wrapper.Name, pluginGlobals.DeliveryPolicy))
+		errcnt++
+		return nil, errcnt
 	}
-	if pluginGlobals.Matcher != "" {
-		if matcher, err = NewMatchRunner(pluginGlobals.Matcher,
-			pluginGlobals.Signer, runner); err != nil {
-			self.log(fmt.Sprintf("Can't create message matcher for '%s': %s",
-				wrapper.Name, err))
+	if pluginGlobals.IsolateAfter != "" {
+		var after time.Duration
+		if after, err = time.ParseDuration(pluginGlobals.IsolateAfter); err != nil ||
+			after <= 0 {
+			self.log(fmt.Sprintf("Invalid isolate_after for '%s': %s",
+				wrapper.Name, pluginGlobals.IsolateAfter))
 			errcnt++
-			return
+			return nil, errcnt
+		}
+		if pluginGlobals.IsolateFailover == wrapper.Name {
+			self.log(fmt.Sprintf("'%s' can't be its own isolate_failover",
+				wrapper.Name))
+			errcnt++
+			return nil, errcnt
+		}
+		runner.matcher.isolator = &consumerIsolator{
+			after:        after,
+			failoverName: pluginGlobals.IsolateFailover,
+			pc:           self,
 		}
-		runner.matcher = matcher
 	}
-
-	switch pluginCategory {
-	case "Filter":
-		if matcher != nil {
-			self.router.fMatchers = append(self.router.fMatchers, matcher)
+	if pluginGlobals.HotWindow != "" {
+		var window time.Duration
+		if window, err = time.ParseDuration(pluginGlobals.HotWindow); err != nil ||
+			window <= 0 {
+			self.log(fmt.Sprintf("Invalid hot_window for '%s': %s",
+				wrapper.Name, pluginGlobals.HotWindow))
+			errcnt++
+			return nil, errcnt
 		}
-		self.FilterRunners[runner.name] = runner
-		if _, ok := runner.plugin.(Stoppable); !ok {
-			self.filterWrappers[runner.name] = wrapper
+		if pluginGlobals.ColdOutput == wrapper.Name {
+			self.log(fmt.Sprintf("'%s' can't be its own cold_output", wrapper.Name))
+			errcnt++
+			return nil, errcnt
 		}
-
-	case "Output":
-		if matcher != nil {
-			self.router.oMatchers = append(self.router.oMatchers, matcher)
+		runner.matcher.hot = newHotWindow(window, pluginGlobals.ColdOutput, self)
+	}
+	if pluginGlobals.LeaderLock != "" {
+		if pluginCategory != "Filter" {
+			self.log(fmt.Sprintf("'%s' can't have a leader_lock, only filters can",
+				wrapper.Name))
+			errcnt++
+			return nil, errcnt
 		}
-		self.OutputRunners[runner.name] = runner
-		self.outputWrappers[runner.name] = wrapper
+		var lock LeaderLock
+		if lock, err = NewLeaderLock(pluginGlobals.LeaderLock); err != nil {
+			self.log(fmt.Sprintf("Invalid leader_lock for '%s': %s", wrapper.Name,
+				err))
+			errcnt++
+			return nil, errcnt
+		}
+		runner.matcher.leader = newLeaderElector(lock, Globals().Hostname,
+			time.Duration(pluginGlobals.LeaderLease)*time.Second)
 	}
-
+	if pluginGlobals.Replay != "" {
+		var window time.Duration
+		if window, err = time.ParseDuration(pluginGlobals.Replay); err != nil ||
+			window <= 0 || pluginCategory != "Filter" {
+			self.log(fmt.Sprintf("Invalid replay for '%s': %s", wrapper.Name,
+				pluginGlobals.Replay))
+			errcnt++
+			return nil, errcnt
+		}
+		class := replayClass(pluginGlobals.Matcher, pluginGlobals.Signer,
+			pluginGlobals.Tenants)
+		runner.matcher.replay = newMatcherReplay(self.replayRing(class, window),
+			window)
+	}
+	if pluginCategory == "Output" {
+		runner.matcher.expiry = newMessageExpiry(
+			time.Duration(pluginGlobals.MessageTTL) * time.Second)
+		if pluginGlobals.ShedQueuePercent > 0 {
+			if pluginGlobals.ShedQueuePercent > 100 {
+				self.log(fmt.Sprintf("Invalid shed_queue_percent for '%s': %d",
+					wrapper.Name, pluginGlobals.ShedQueuePercent))
+				errcnt++
+				return nil, errcnt
+			}
+			runner.matcher.shedder = &severityShedder{
+				percent:     pluginGlobals.ShedQueuePercent,
+				maxSeverity: pluginGlobals.ShedMaxSeverity,
+				fill:        runner.queueFill,
+			}
+		}
+	}
+	section.foRunner = runner
 	return
 }
 
@@ -643,10 +1077,65 @@ func (self *PipelineConfig) loadSection(sectionName string,
 // The PipelineConfig should be already initialized before passed in via
 // its Init function.
 func (self *PipelineConfig) LoadFromConfigFile(filename string) (err error) {
+	self.configPaths = append(self.configPaths, filename)
+	if err = self.loadConfigFile(filename); err != nil {
+		return
+	}
+	return self.checkLoaded()
+}
+
+// Checks the settings that can refer to plugins or sections loaded from other
+// config files.
+func (self *PipelineConfig) checkLoaded() (err error) {
+	if err = self.checkDependencies(); err != nil {
+		return
+	}
+	if err = self.checkTenants(); err != nil {
+		return
+	}
+	if err = self.checkColdOutputs(); err != nil {
+		return
+	}
+	return self.checkCgroups()
+}
+
+// Checks that the filters' and outputs' `cold_output` settings name outputs.
+func (self *PipelineConfig) checkColdOutputs() error {
+	check := func(name string, globals *PluginGlobals) error {
+		if globals == nil || globals.ColdOutput == "" {
+			return nil
+		}
+		if _, ok := self.OutputRunners[globals.ColdOutput]; !ok {
+			return fmt.Errorf("'%s' has an unknown cold_output: '%s'", name,
+				globals.ColdOutput)
+		}
+		return nil
+	}
+	for name, runner := range self.FilterRunners {
+		if err := check(name, runner.PluginGlobals()); err != nil {
+			return err
+		}
+	}
+	for name, runner := range self.OutputRunners {
+		if err := check(name, runner.PluginGlobals()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Does the work for LoadFromConfigFile, without remembering the file name for
+// config reloads.
+func (self *PipelineConfig) loadConfigFile(filename string) (err error) {
 	var configFile ConfigFile
 	if _, err = toml.DecodeFile(filename, &configFile); err != nil {
 		return fmt.Errorf("Error decoding config file: %s", err)
 	}
+	// Keep a generic copy of each section so a reload can tell what changed.
+	var sections map[string]interface{}
+	if _, err = toml.DecodeFile(filename, &sections); err != nil {
+		return fmt.Errorf("Error decoding config file: %s", err)
+	}
 
 	// Load all the plugins
 	var errcnt uint
@@ -654,8 +1143,22 @@ func (self *PipelineConfig) LoadFromConfigFile(filename string) (err error) {
 		if name == "hekad" {
 			continue
 		}
+		if name == LOOKUP_TABLES_SECTION {
+			errcnt += self.declareLookupTables(conf)
+			continue
+		}
+		if name == CGROUPS_SECTION {
+			errcnt += self.declareCgroups(conf)
+			continue
+		}
+		if name == TENANTS_SECTION {
+			errcnt += self.declareTenants(conf)
+			continue
+		}
 		log.Printf("Loading: [%s]\n", name)
 		errcnt += self.loadSection(name, conf)
+		self.sectionConfigs[name] = sections[name]
+		self.sectionPrimitives[name] = conf
 	}
 
 	// Add JSON/PROTOCOL_BUFFER decoders if none were configured
@@ -0,0 +1,140 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Prefix of encrypted plugin config values, followed by the base64 encoded
+// output of the config cipher.
+const ENCRYPTED_VALUE_PREFIX = "enc:"
+
+// Returns the encrypted form of a config value, to be pasted into the TOML
+// in place of the plain text.
+func EncryptConfigValue(sc *SpoolCipher, plain string) (value string, err error) {
+	var sealed []byte
+	if sealed, err = sc.Seal([]byte(plain)); err != nil {
+		return
+	}
+	return ENCRYPTED_VALUE_PREFIX + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func decryptConfigValue(sc *SpoolCipher, value string) (plain string, err error) {
+	if sc == nil {
+		return "", errors.New("encrypted value found but no config_key_provider is set")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(value[len(ENCRYPTED_VALUE_PREFIX):])
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %s", err)
+	}
+	var decrypted []byte
+	if decrypted, err = sc.Open(sealed); err != nil {
+		return "", fmt.Errorf("can't decrypt value: %s", err)
+	}
+	return string(decrypted), nil
+}
+
+// Replaces every "enc:" prefixed string in a decoded config struct (or
+// PluginConfig map), including those in nested structs, slices and maps,
+// with its decrypted value. Decrypted values are redacted from the logs.
+func DecryptConfigValues(config interface{}, sc *SpoolCipher) error {
+	_, err := rewriteConfigStrings(reflect.ValueOf(config), func(s string) (
+		string, error) {
+
+		if !strings.HasPrefix(s, ENCRYPTED_VALUE_PREFIX) {
+			return s, nil
+		}
+		plain, err := decryptConfigValue(sc, s)
+		if err == nil {
+			RegisterSecret(plain)
+		}
+		return plain, err
+	})
+	return err
+}
+
+// Rewrites the strings within v with the replace function, in place where
+// possible. Values that can't be set in place (e.g. strings held in
+// interfaces) are returned as a replacement, nil if none is needed.
+func rewriteConfigStrings(v reflect.Value, replace func(string) (string, error)) (
+	replacement *reflect.Value, err error) {
+
+	switch v.Kind() {
+	case reflect.String:
+		s := v.String()
+		var rewritten string
+		if rewritten, err = replace(s); err != nil || rewritten == s {
+			return
+		}
+		if v.CanSet() {
+			v.SetString(rewritten)
+			return
+		}
+		r := reflect.ValueOf(rewritten).Convert(v.Type())
+		return &r, nil
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		var r *reflect.Value
+		if r, err = rewriteConfigStrings(v.Elem(), replace); err != nil || r == nil {
+			return
+		}
+		if v.Kind() == reflect.Interface && v.CanSet() {
+			v.Set(*r)
+			return nil, nil
+		}
+		return r, nil
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).CanSet() {
+				continue
+			}
+			if _, err = rewriteConfigStrings(v.Field(i), replace); err != nil {
+				return nil, fmt.Errorf("%s: %s", v.Type().Field(i).Name, err)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			var r *reflect.Value
+			if r, err = rewriteConfigStrings(v.Index(i), replace); err != nil {
+				return
+			}
+			if r != nil {
+				v.Index(i).Set(*r)
+			}
+		}
+	case reflect.Map:
+		// Map entries aren't addressable, rewrite a copy and store it back.
+		for _, key := range v.MapKeys() {
+			entry := reflect.New(v.Type().Elem()).Elem()
+			entry.Set(v.MapIndex(key))
+			var r *reflect.Value
+			if r, err = rewriteConfigStrings(entry, replace); err != nil {
+				return nil, fmt.Errorf("%v: %s", key.Interface(), err)
+			}
+			if r != nil {
+				entry = *r
+			}
+			v.SetMapIndex(key, entry)
+		}
+	}
+	return
+}
@@ -0,0 +1,152 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/bbangert/toml"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+type cryptoTestCreds struct {
+	Username string
+	Password string
+}
+
+type cryptoTestConfig struct {
+	Address  string
+	Password string
+	Brokers  []string
+	Headers  map[string]string
+	Creds    map[string]cryptoTestCreds
+	Auth     *cryptoTestCreds
+	Retries  int
+	internal string
+}
+
+func ConfigCryptoSpec(c gs.Context) {
+	key := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	cipher, err := NewSpoolCipher("hex", key)
+	c.Assume(err, gs.IsNil)
+
+	encrypt := func(plain string) string {
+		value, err := EncryptConfigValue(cipher, plain)
+		c.Assume(err, gs.IsNil)
+		return value
+	}
+
+	c.Specify("Encrypted config values", func() {
+		c.Specify("are prefixed and don't contain the plain text", func() {
+			value := encrypt("s3cr3t")
+			c.Expect(strings.HasPrefix(value, ENCRYPTED_VALUE_PREFIX), gs.IsTrue)
+			c.Expect(strings.Contains(value, "s3cr3t"), gs.IsFalse)
+			c.Expect(encrypt("s3cr3t") == value, gs.IsFalse)
+		})
+
+		c.Specify("are decrypted throughout a config struct", func() {
+			conf := &cryptoTestConfig{
+				Address:  "localhost:25",
+				Password: encrypt("smtp"),
+				Brokers:  []string{"kafka:9092", encrypt("secret:9092")},
+				Headers:  map[string]string{"Authorization": encrypt("Bearer t0k3n")},
+				Creds: map[string]cryptoTestCreds{
+					"es": {Username: "heka", Password: encrypt("elastic")},
+				},
+				Auth:     &cryptoTestCreds{Password: encrypt("auth")},
+				internal: encrypt("untouched"),
+			}
+			internal := conf.internal
+			err := DecryptConfigValues(conf, cipher)
+			c.Expect(err, gs.IsNil)
+			c.Expect(conf.Address, gs.Equals, "localhost:25")
+			c.Expect(conf.Password, gs.Equals, "smtp")
+			c.Expect(conf.Brokers[1], gs.Equals, "secret:9092")
+			c.Expect(conf.Headers["Authorization"], gs.Equals, "Bearer t0k3n")
+			c.Expect(conf.Creds["es"].Username, gs.Equals, "heka")
+			c.Expect(conf.Creds["es"].Password, gs.Equals, "elastic")
+			c.Expect(conf.Auth.Password, gs.Equals, "auth")
+			c.Expect(conf.internal, gs.Equals, internal)
+		})
+
+		c.Specify("are decrypted in a PluginConfig", func() {
+			conf := PluginConfig{
+				"password": encrypt("amqp"),
+				"nested": map[string]interface{}{
+					"list": []interface{}{"plain", encrypt("listed")},
+				},
+			}
+			err := DecryptConfigValues(conf, cipher)
+			c.Expect(err, gs.IsNil)
+			c.Expect(conf["password"], gs.Equals, "amqp")
+			list := conf["nested"].(map[string]interface{})["list"].([]interface{})
+			c.Expect(list[0], gs.Equals, "plain")
+			c.Expect(list[1], gs.Equals, "listed")
+		})
+
+		c.Specify("are decrypted when the plugin config is loaded", func() {
+			NewPipelineConfig(nil) // initializes Globals()
+			Globals().ConfigCipher = cipher
+			defer func() {
+				Globals().ConfigCipher = nil
+			}()
+			var section struct {
+				Plugin toml.Primitive
+			}
+			_, err := toml.Decode("[plugin]\naddress = \"localhost\"\npassword = \""+
+				encrypt("loaded")+"\"\n", &section)
+			c.Assume(err, gs.IsNil)
+			conf, err := LoadConfigStruct(section.Plugin, &cryptoTestPlugin{})
+			c.Expect(err, gs.IsNil)
+			c.Expect(conf.(*cryptoTestConfig).Password, gs.Equals, "loaded")
+		})
+
+		c.Specify("fail to decrypt", func() {
+			conf := &cryptoTestConfig{Password: encrypt("smtp")}
+
+			c.Specify("without a cipher", func() {
+				err := DecryptConfigValues(conf, nil)
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(strings.Contains(err.Error(), "config_key_provider"), gs.IsTrue)
+			})
+
+			c.Specify("with the wrong key", func() {
+				other, err := NewSpoolCipher("hex", strings.Repeat("ff", 32))
+				c.Assume(err, gs.IsNil)
+				err = DecryptConfigValues(conf, other)
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(strings.HasPrefix(err.Error(), "Password: "), gs.IsTrue)
+			})
+
+			c.Specify("when tampered with", func() {
+				conf.Password = conf.Password[:len(conf.Password)-4] + "AAA="
+				err := DecryptConfigValues(conf, cipher)
+				c.Expect(err, gs.Not(gs.IsNil))
+				conf.Password = ENCRYPTED_VALUE_PREFIX + "!!"
+				err = DecryptConfigValues(conf, cipher)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+	})
+}
+
+type cryptoTestPlugin struct{}
+
+func (p *cryptoTestPlugin) ConfigStruct() interface{} {
+	return new(cryptoTestConfig)
+}
+
+func (p *cryptoTestPlugin) Init(config interface{}) error {
+	return nil
+}
@@ -0,0 +1,215 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+	"strings"
+	"sync"
+)
+
+// Type of the messages injected at startup for each deprecated option found
+// in the config.
+const DEPRECATION_MESSAGE_TYPE = "heka.deprecation"
+
+// Describes a deprecated plugin option and how to rewrite it into its current
+// form, so config refactors don't break existing deployments.
+type ConfigMigration struct {
+	// Plugin type the option belongs to, e.g. "FileOutput".
+	PluginType string
+	// The deprecated option, matched regardless of case like TOML keys are.
+	Option string
+	// Only these values of the option are deprecated, all of them if empty.
+	Values []string
+	// Heka version the option was deprecated in.
+	Since string
+	// What to use instead, for the deprecation messages.
+	Advice string
+	// Moves the option's value to this option.
+	RenameTo string
+	// Rewrites the config section holding the option, if renaming isn't
+	// enough. Returns false if the option was left as is. The option is only
+	// reported if neither RenameTo nor Migrate are set.
+	Migrate func(section map[string]interface{}, key string) (bool, error)
+}
+
+// Whether the option's value is deprecated.
+func (m *ConfigMigration) applies(value interface{}) bool {
+	if len(m.Values) == 0 {
+		return true
+	}
+	for _, v := range m.Values {
+		if fmt.Sprint(value) == v {
+			return true
+		}
+	}
+	return false
+}
+
+// A deprecated option found in a config section.
+type Deprecation struct {
+	Section    string
+	PluginType string
+	Option     string
+	Since      string
+	Advice     string
+	// Whether the option was rewritten, as opposed to just reported.
+	Migrated bool
+}
+
+func (d Deprecation) String() string {
+	s := fmt.Sprintf("[%s] option '%s' of %s is deprecated since %s", d.Section,
+		d.Option, d.PluginType, d.Since)
+	if d.Migrated {
+		s += " and was migrated"
+	}
+	if d.Advice != "" {
+		s += ": " + d.Advice
+	}
+	return s
+}
+
+var (
+	configMigrations     = make(map[string][]ConfigMigration)
+	configMigrationsLock sync.RWMutex
+)
+
+// Registers a migration, plugins call it from their init function next to
+// RegisterPlugin.
+func RegisterConfigMigration(migration ConfigMigration) {
+	configMigrationsLock.Lock()
+	defer configMigrationsLock.Unlock()
+	configMigrations[migration.PluginType] = append(
+		configMigrations[migration.PluginType], migration)
+}
+
+// Returns the key of the section matching the option, ignoring case.
+func findOption(section map[string]interface{}, option string) (string, bool) {
+	if _, ok := section[option]; ok {
+		return option, true
+	}
+	for key := range section {
+		if strings.EqualFold(key, option) {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// Rewrites the deprecated options of the config section in place, returning
+// the deprecations found.
+func migrateSection(sectionName string, configSection toml.Primitive) (
+	deprecations []Deprecation, err error) {
+
+	section, ok := configSection.(map[string]interface{})
+	if !ok {
+		return
+	}
+	pluginType, _ := section["type"].(string)
+	if pluginType == "" {
+		pluginType = sectionName
+	}
+	configMigrationsLock.RLock()
+	migrations := configMigrations[pluginType]
+	configMigrationsLock.RUnlock()
+
+	for _, migration := range migrations {
+		key, ok := findOption(section, migration.Option)
+		if !ok || !migration.applies(section[key]) {
+			continue
+		}
+		migrated := false
+		switch {
+		case migration.Migrate != nil:
+			if migrated, err = migration.Migrate(section, key); err != nil {
+				return nil, fmt.Errorf("can't migrate deprecated option '%s': %s",
+					key, err)
+			}
+		case migration.RenameTo != "":
+			if _, ok := findOption(section, migration.RenameTo); ok {
+				return nil, fmt.Errorf("both '%s' and its replacement '%s' are set",
+					key, migration.RenameTo)
+			}
+			section[migration.RenameTo] = section[key]
+			delete(section, key)
+			migrated = true
+		}
+		deprecations = append(deprecations, Deprecation{
+			Section:    sectionName,
+			PluginType: pluginType,
+			Option:     key,
+			Since:      migration.Since,
+			Advice:     migration.Advice,
+			Migrated:   migrated,
+		})
+	}
+	return
+}
+
+// Records and logs the deprecations, skipping those already recorded (e.g.
+// when a plugin is recreated from the same section).
+func (self *PipelineConfig) recordDeprecations(deprecations []Deprecation) {
+	self.deprecationsLock.Lock()
+	defer self.deprecationsLock.Unlock()
+	for _, d := range deprecations {
+		known := false
+		for _, recorded := range self.deprecations {
+			if recorded == d {
+				known = true
+				break
+			}
+		}
+		if !known {
+			self.deprecations = append(self.deprecations, d)
+			self.log("Deprecated: " + d.String())
+		}
+	}
+}
+
+// Returns the deprecations found in the loaded config.
+func (self *PipelineConfig) Deprecations() []Deprecation {
+	self.deprecationsLock.Lock()
+	defer self.deprecationsLock.Unlock()
+	return append([]Deprecation(nil), self.deprecations...)
+}
+
+// Injects a message for each deprecation, so they show up wherever the
+// messages go rather than only in the startup log.
+func (self *PipelineConfig) injectDeprecationMessages() {
+	for _, d := range self.Deprecations() {
+		pack := self.PipelinePack(0)
+		if pack == nil {
+			return
+		}
+		msg := pack.Message
+		msg.SetType(DEPRECATION_MESSAGE_TYPE)
+		msg.SetSeverity(4)
+		msg.SetPayload(d.String())
+		for _, field := range [][2]string{
+			{"Section", d.Section},
+			{"PluginType", d.PluginType},
+			{"Option", d.Option},
+			{"Since", d.Since},
+			{"Advice", d.Advice},
+		} {
+			message.NewStringField(msg, field[0], field[1])
+		}
+		migrated, _ := message.NewField("Migrated", d.Migrated, "")
+		msg.AddField(migrated)
+		self.router.InChan() <- pack
+	}
+}
@@ -0,0 +1,112 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/bbangert/toml"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+func init() {
+	RegisterConfigMigration(ConfigMigration{
+		PluginType: "MigrationSpecOutput",
+		Option:     "mode",
+		Since:      "0.5.0",
+		Advice:     "use something else",
+		Values:     []string{"old"},
+	})
+}
+
+func ConfigMigrationSpec(c gs.Context) {
+	decodeSection := func(config string) toml.Primitive {
+		var sections map[string]toml.Primitive
+		_, err := toml.Decode(config, &sections)
+		c.Assume(err, gs.IsNil)
+		return sections["section"]
+	}
+
+	c.Specify("A config migration", func() {
+		c.Specify("renames deprecated options", func() {
+			section := decodeSection(`[section]
+			type = "StatAccumInput"
+			flushInterval = 5`)
+			deprecations, err := migrateSection("section", section)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(deprecations), gs.Equals, 1)
+			c.Expect(deprecations[0].Option, gs.Equals, "flushInterval")
+			c.Expect(deprecations[0].PluginType, gs.Equals, "StatAccumInput")
+			c.Expect(deprecations[0].Migrated, gs.IsTrue)
+
+			config := new(StatAccumInputConfig)
+			c.Expect(toml.PrimitiveDecode(section, config), gs.IsNil)
+			c.Expect(config.TickerInterval, gs.Equals, uint(5))
+		})
+
+		c.Specify("refuses to overwrite the replacement", func() {
+			section := decodeSection(`[section]
+			type = "StatAccumInput"
+			flushinterval = 5
+			ticker_interval = 10`)
+			_, err := migrateSection("section", section)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("only reports the deprecated values", func() {
+			section := decodeSection(`[section]
+			type = "MigrationSpecOutput"
+			mode = "old"`)
+			deprecations, err := migrateSection("section", section)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(deprecations), gs.Equals, 1)
+			c.Expect(deprecations[0].Migrated, gs.IsFalse)
+			mode := section.(map[string]interface{})["mode"]
+			c.Expect(mode, gs.Equals, "old")
+
+			section = decodeSection(`[section]
+			type = "MigrationSpecOutput"
+			mode = "new"`)
+			deprecations, err = migrateSection("section", section)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(deprecations), gs.Equals, 0)
+		})
+	})
+
+	c.Specify("A PipelineConfig", func() {
+		pConfig := NewPipelineConfig(nil)
+
+		c.Specify("loads sections with deprecated options", func() {
+			section := decodeSection(`[section]
+			type = "StatAccumInput"
+			flushinterval = 5`)
+			errcnt := pConfig.loadSection("section", section)
+			c.Expect(errcnt, gs.Equals, uint(0))
+			_, ok := pConfig.InputRunners["section"]
+			c.Expect(ok, gs.IsTrue)
+
+			deprecations := pConfig.Deprecations()
+			c.Expect(len(deprecations), gs.Equals, 1)
+			c.Expect(deprecations[0].Section, gs.Equals, "section")
+			c.Expect(len(pConfig.LogMsgs), gs.Equals, 1)
+			c.Expect(strings.HasPrefix(pConfig.LogMsgs[0], "Deprecated: [section]"),
+				gs.IsTrue)
+
+			c.Specify("and records each deprecation once", func() {
+				pConfig.recordDeprecations(deprecations)
+				c.Expect(len(pConfig.Deprecations()), gs.Equals, 1)
+			})
+		})
+	})
+}
@@ -0,0 +1,616 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bbangert/toml"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Order in which reloaded sections are started. Decoders, encoders and
+// splitters are swapped in before the plugins that use them, outputs and
+// filters are ready before the inputs feeding them.
+var reloadCategoryOrder = map[string]int{
+	"Decoder":  0,
+	"Encoder":  1,
+	"Splitter": 1,
+	"Output":   2,
+	"Filter":   3,
+	"Input":    4,
+}
+
+// Longest a reload or restart waits for an input to exit before creating its
+// replacement. Replaced in tests.
+var inputStopTimeout = 30 * time.Second
+
+// LoadFromConfigPath loads a TOML configuration file, or every file in a
+// directory (in name order), and remembers the path so the configuration can
+// be reloaded while Heka is running.
+func (self *PipelineConfig) LoadFromConfigPath(path string) (err error) {
+	var filenames []string
+	if filenames, err = configFilenames(path); err != nil {
+		return
+	}
+	self.configPaths = append(self.configPaths, path)
+	var errcnt int
+	for _, filename := range filenames {
+		if e := self.loadConfigFile(filename); e != nil {
+			log.Printf("Error loading '%s': %s", filename, e)
+			errcnt++
+		}
+	}
+	if errcnt != 0 {
+		return fmt.Errorf("%d config files failed to load", errcnt)
+	}
+	return self.checkLoaded()
+}
+
+// Returns the config files at the path, which is either a file or a directory
+// of files.
+func configFilenames(path string) (filenames []string, err error) {
+	var info os.FileInfo
+	if info, err = os.Stat(path); err != nil {
+		return
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+	var infos []os.FileInfo
+	if infos, err = ioutil.ReadDir(path); err != nil {
+		return
+	}
+	for _, info = range infos {
+		if !info.IsDir() {
+			filenames = append(filenames, filepath.Join(path, info.Name()))
+		}
+	}
+	return
+}
+
+// Reads every section from the config paths, returning them both ready for
+// plugin loading and in generic form for comparison.
+func readConfigPaths(paths []string) (configFile ConfigFile,
+	sections map[string]interface{}, err error) {
+
+	configFile = make(ConfigFile)
+	sections = make(map[string]interface{})
+	var filenames []string
+	for _, path := range paths {
+		if filenames, err = configFilenames(path); err != nil {
+			return
+		}
+		for _, filename := range filenames {
+			var fileConfig ConfigFile
+			var fileSections map[string]interface{}
+			if _, err = toml.DecodeFile(filename, &fileConfig); err == nil {
+				_, err = toml.DecodeFile(filename, &fileSections)
+			}
+			if err != nil {
+				err = fmt.Errorf("Error decoding config file '%s': %s", filename, err)
+				return
+			}
+			for name, conf := range fileConfig {
+				configFile[name] = conf
+				sections[name] = fileSections[name]
+			}
+		}
+	}
+	delete(configFile, "hekad")
+	delete(sections, "hekad")
+	return
+}
+
+// Returns true if the generic config value contains one of the names as a
+// string value, i.e. it refers to one of those plugins.
+func refersTo(conf interface{}, names map[string]bool) bool {
+	switch v := conf.(type) {
+	case string:
+		return names[v]
+	case map[string]interface{}:
+		for _, item := range v {
+			if refersTo(item, names) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if refersTo(item, names) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reload re-reads the config files, compares them to the running config, and
+// stops, starts, or restarts only the plugins whose sections were removed,
+// added, or changed. Inputs and outputs that refer to a changed decoder or
+// encoder are restarted as well. Every new plugin is created and initialized
+// before any running plugin is touched, so a config error leaves the running
+// pipeline as it is. Changed inputs are the exception, inputs may bind their
+// address in Init so the old input is stopped before its replacement is
+// created, and started again if the reload is aborted. Triggered by SIGHUP.
+func (self *PipelineConfig) Reload() (err error) {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	if len(self.configPaths) == 0 {
+		return errors.New("no config files were loaded")
+	}
+	if Globals().Stopping {
+		return errors.New("Heka is shutting down")
+	}
+
+	configFile, sections, err := readConfigPaths(self.configPaths)
+	if err != nil {
+		return
+	}
+	// Lookup tables aren't plugins, they're updated in place.
+	if conf, ok := configFile[LOOKUP_TABLES_SECTION]; ok {
+		if errcnt := self.declareLookupTables(conf); errcnt != 0 {
+			return fmt.Errorf("%d errors loading lookup tables, config not reloaded",
+				errcnt)
+		}
+		delete(configFile, LOOKUP_TABLES_SECTION)
+		delete(sections, LOOKUP_TABLES_SECTION)
+	}
+	// Neither are cgroups.
+	if conf, ok := configFile[CGROUPS_SECTION]; ok {
+		if errcnt := self.declareCgroups(conf); errcnt != 0 {
+			return fmt.Errorf("%d errors declaring cgroups, config not reloaded",
+				errcnt)
+		}
+		delete(configFile, CGROUPS_SECTION)
+		delete(sections, CGROUPS_SECTION)
+	}
+	// Nor are tenants.
+	if conf, ok := configFile[TENANTS_SECTION]; ok {
+		if errcnt := self.declareTenants(conf); errcnt != 0 {
+			return fmt.Errorf("%d errors declaring tenants, config not reloaded",
+				errcnt)
+		}
+		delete(configFile, TENANTS_SECTION)
+		delete(sections, TENANTS_SECTION)
+	}
+
+	var added, changed, removed []string
+	for name, conf := range sections {
+		if oldConf, ok := self.sectionConfigs[name]; !ok {
+			added = append(added, name)
+		} else if !reflect.DeepEqual(oldConf, conf) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range self.sectionConfigs {
+		if _, ok := sections[name]; !ok {
+			removed = append(removed, name)
+		}
+	}
+
+	// Inputs and outputs only create their decoders, encoders and splitters
+	// when they start, restart the ones using one that went away.
+	replaced := make(map[string]bool)
+	for _, name := range append(changed, removed...) {
+		switch self.sectionCategories[name] {
+		case "Decoder", "Encoder", "Splitter":
+			replaced[name] = true
+		}
+	}
+	if len(replaced) > 0 {
+		for name, conf := range sections {
+			cat := self.sectionCategories[name]
+			if cat != "Input" && cat != "Output" {
+				continue
+			}
+			if reflect.DeepEqual(self.sectionConfigs[name], conf) && refersTo(conf, replaced) {
+				changed = append(changed, name)
+			}
+		}
+	}
+
+	if len(added)+len(changed)+len(removed) == 0 {
+		log.Println("Config reload: no changes.")
+		return
+	}
+
+	// Create the new plugins up front, a failure aborts the whole reload.
+	loaded := make(map[string]*loadedSection)
+	var inputs []string
+	var errcnt uint
+	for _, name := range append(added, changed...) {
+		if self.sectionCategories[name] == "Input" {
+			inputs = append(inputs, name)
+			continue
+		}
+		log.Printf("Loading: [%s]\n", name)
+		section, cnt := self.createSection(name, configFile[name])
+		loaded[name] = section
+		errcnt += cnt
+	}
+	// Then the changed inputs, each once the input it replaces has exited.
+	stopped := make(map[string]<-chan struct{})
+	if errcnt == 0 {
+		for _, name := range inputs {
+			log.Printf("Loading: [%s]\n", name)
+			var section *loadedSection
+			var cnt uint
+			section, cnt, stopped[name] = self.replaceInput(name, configFile[name])
+			loaded[name] = section
+			if errcnt += cnt; errcnt != 0 {
+				break
+			}
+		}
+	}
+	if errcnt != 0 {
+		discardSections(loaded)
+		for name := range stopped {
+			self.restoreInput(name)
+		}
+		return fmt.Errorf("%d errors loading plugins, config not reloaded", errcnt)
+	}
+
+	for _, name := range removed {
+		self.stopSection(name)
+		delete(self.sectionConfigs, name)
+		delete(self.sectionPrimitives, name)
+		delete(self.sectionCategories, name)
+		self.forgetPlugin(name)
+		log.Printf("Config reload: removed '%s'", name)
+	}
+	// Old plugins drain the messages they already have while their
+	// replacements queue up new ones, the replacement starts once the old
+	// plugin has exited.
+	for _, name := range changed {
+		if _, ok := stopped[name]; !ok {
+			stopped[name] = self.stopSection(name)
+		}
+	}
+	starting := append(added, changed...)
+	sort.Sort(byReloadOrder{starting, loaded})
+	for _, name := range starting {
+		self.startSection(loaded[name], stopped[name])
+		self.sectionConfigs[name] = sections[name]
+		self.sectionPrimitives[name] = configFile[name]
+		if stopped[name] != nil {
+			log.Printf("Config reload: restarted '%s'", name)
+		} else {
+			log.Printf("Config reload: added '%s'", name)
+		}
+	}
+	return
+}
+
+// Stops the running input and creates its replacement from the config once it
+// has exited, since the replacement may bind the same address in Init.
+// Returns the channel closed when the old input exited, nil if it wasn't
+// running.
+func (self *PipelineConfig) replaceInput(name string, conf toml.Primitive) (
+	section *loadedSection, errcnt uint, stopped <-chan struct{}) {
+
+	stopped = self.stopSection(name)
+	if stopped != nil && !waitStopped([]<-chan struct{}{stopped}, inputStopTimeout) {
+		log.Printf("Input '%s' didn't stop within %s", name, inputStopTimeout)
+	}
+	section, errcnt = self.createSection(name, conf)
+	return
+}
+
+// Starts an input stopped by replaceInput again from its current config,
+// after its replacement couldn't be created.
+func (self *PipelineConfig) restoreInput(name string) {
+	section, errcnt := self.createSection(name, self.sectionPrimitives[name])
+	if errcnt != 0 {
+		log.Printf("Input '%s' can't be restored, it's stopped", name)
+		self.forgetSection(name)
+		return
+	}
+	self.startSection(section, nil)
+	log.Printf("Restored '%s'", name)
+}
+
+// Releases what the plugins of sections that were created but won't be
+// started hold, i.e. the sockets inputs bind in Init. Not every input expects
+// to be stopped before it runs, a panicking Stop is logged and ignored.
+func discardSections(loaded map[string]*loadedSection) {
+	for name, section := range loaded {
+		if section == nil || section.iRunner == nil {
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("Input '%s' can't be discarded: %v", name, r)
+				}
+			}()
+			section.iRunner.Input().Stop()
+		}()
+	}
+}
+
+// Sorts section names by the reload order of their loaded categories.
+type byReloadOrder struct {
+	names  []string
+	loaded map[string]*loadedSection
+}
+
+func (b byReloadOrder) Len() int      { return len(b.names) }
+func (b byReloadOrder) Swap(i, j int) { b.names[i], b.names[j] = b.names[j], b.names[i] }
+func (b byReloadOrder) Less(i, j int) bool {
+	return reloadCategoryOrder[b.loaded[b.names[i]].category] <
+		reloadCategoryOrder[b.loaded[b.names[j]].category]
+}
+
+// Removes a running section from the pipeline and tells its plugin to stop.
+// Returns a channel that is closed when the plugin has exited, or nil if the
+// section doesn't have a running plugin.
+func (self *PipelineConfig) stopSection(name string) (stopped <-chan struct{}) {
+	switch self.sectionCategories[name] {
+	case "Decoder":
+		self.wrappersLock.Lock()
+		delete(self.DecoderWrappers, name)
+		self.wrappersLock.Unlock()
+
+	case "Encoder":
+		self.wrappersLock.Lock()
+		delete(self.encoderWrappers, name)
+		self.wrappersLock.Unlock()
+
+	case "Splitter":
+		self.wrappersLock.Lock()
+		delete(self.splitterWrappers, name)
+		self.wrappersLock.Unlock()
+
+	case "Input":
+		self.inputsLock.Lock()
+		input := self.InputRunners[name]
+		delete(self.InputRunners, name)
+		delete(self.inputWrappers, name)
+		self.inputsLock.Unlock()
+		if ir, ok := input.(*iRunner); ok {
+			atomic.StoreInt32(&ir.removed, 1)
+			stopped = ir.stopped
+		}
+		if input != nil {
+			input.Input().Stop()
+		}
+
+	case "Filter":
+		self.filtersLock.Lock()
+		filter := self.FilterRunners[name]
+		delete(self.FilterRunners, name)
+		delete(self.filterWrappers, name)
+		self.filtersLock.Unlock()
+		if fr, ok := filter.(*foRunner); ok {
+			atomic.StoreInt32(&fr.removed, 1)
+			stopped = fr.stopped
+		}
+		if filter != nil {
+			// Closes the matcher and filter input channels once drained.
+			self.router.RemoveFilterMatcher() <- filter.MatchRunner()
+		}
+
+	case "Output":
+		self.outputsLock.Lock()
+		output := self.OutputRunners[name]
+		delete(self.OutputRunners, name)
+		delete(self.outputWrappers, name)
+		self.outputsLock.Unlock()
+		if or, ok := output.(*foRunner); ok {
+			atomic.StoreInt32(&or.removed, 1)
+			stopped = or.stopped
+		}
+		if output != nil {
+			self.router.RemoveOutputMatcher() <- output.MatchRunner()
+		}
+	}
+	return
+}
+
+// Adds a loaded section to the running pipeline. The plugin is started after
+// the `after` channel is closed (if not nil), filter and output matchers are
+// added to the router right away so no messages are missed in the meantime.
+func (self *PipelineConfig) startSection(section *loadedSection,
+	after <-chan struct{}) {
+
+	name := section.wrapper.Name
+	self.sectionCategories[name] = section.category
+	self.setDependencies(name, section.dependsOn)
+	switch section.category {
+	case "Decoder":
+		self.wrappersLock.Lock()
+		self.DecoderWrappers[name] = section.wrapper
+		self.wrappersLock.Unlock()
+
+	case "Encoder":
+		self.wrappersLock.Lock()
+		self.encoderWrappers[name] = section.wrapper
+		self.wrappersLock.Unlock()
+
+	case "Splitter":
+		self.wrappersLock.Lock()
+		self.splitterWrappers[name] = section.wrapper
+		self.wrappersLock.Unlock()
+
+	case "Input":
+		go func() {
+			if after != nil {
+				<-after
+			}
+			if Globals().Stopping {
+				return
+			}
+			if err := self.awaitDependencies(name); err != nil {
+				log.Printf("Input '%s' not started: %s", name, err)
+				self.setPluginState(name, PLUGIN_FAILED)
+				return
+			}
+			if err := self.AddInputRunner(section.iRunner, section.wrapper); err != nil {
+				log.Println(err)
+				self.setPluginState(name, PLUGIN_FAILED)
+				return
+			}
+			self.setPluginState(name, PLUGIN_STARTING)
+		}()
+
+	case "Filter":
+		runner := section.foRunner
+		self.filtersLock.Lock()
+		self.FilterRunners[name] = runner
+		if _, ok := runner.plugin.(Stoppable); !ok {
+			self.filterWrappers[name] = section.wrapper
+		}
+		self.filtersWg.Add(1)
+		self.filtersLock.Unlock()
+		self.router.AddFilterMatcher() <- runner.matcher
+		go func() {
+			if after != nil {
+				<-after
+			}
+			err := self.awaitDependencies(name)
+			if err == nil {
+				err = runner.Start(self, &self.filtersWg)
+			}
+			if err != nil {
+				log.Printf("Filter '%s' failed to start: %s", name, err)
+				self.setPluginState(name, PLUGIN_FAILED)
+				self.RemoveFilterRunner(name)
+				self.filtersWg.Done()
+				return
+			}
+			self.setPluginState(name, PLUGIN_STARTING)
+		}()
+
+	case "Output":
+		runner := section.foRunner
+		self.outputsLock.Lock()
+		self.OutputRunners[name] = runner
+		self.outputWrappers[name] = section.wrapper
+		self.outputsWg.Add(1)
+		self.outputsLock.Unlock()
+		self.router.AddOutputMatcher() <- runner.matcher
+		go func() {
+			if after != nil {
+				<-after
+			}
+			err := self.awaitDependencies(name)
+			if err == nil {
+				err = runner.Start(self, &self.outputsWg)
+			}
+			if err != nil {
+				log.Printf("Output '%s' failed to start: %s", name, err)
+				self.setPluginState(name, PLUGIN_FAILED)
+				self.outputsLock.Lock()
+				delete(self.OutputRunners, name)
+				self.outputsLock.Unlock()
+				self.router.RemoveOutputMatcher() <- runner.matcher
+				self.outputsWg.Done()
+				return
+			}
+			self.setPluginState(name, PLUGIN_STARTING)
+		}()
+	}
+}
+
+// Returns an error unless the named section is a running input, filter, or
+// output.
+func (self *PipelineConfig) runnerCategory(name string) (category string, err error) {
+	category = self.sectionCategories[name]
+	switch category {
+	case "Input", "Filter", "Output":
+	case "":
+		err = fmt.Errorf("no such plugin: '%s'", name)
+	default:
+		err = fmt.Errorf("'%s' is a %s, only inputs, filters, and outputs can be "+
+			"stopped or restarted", name, category)
+	}
+	return
+}
+
+// StopPlugin stops a single running input, filter, or output and removes it
+// from the pipeline. Filters and outputs finish processing the messages
+// already queued for them. The plugin stays stopped until Heka is restarted
+// or a config reload adds it back.
+func (self *PipelineConfig) StopPlugin(name string) (err error) {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	if Globals().Stopping {
+		return errors.New("Heka is shutting down")
+	}
+	if _, err = self.runnerCategory(name); err != nil {
+		// Filters started by a SandboxManager aren't config sections.
+		if self.RemoveFilterRunner(name) {
+			err = nil
+		}
+		return
+	}
+	self.stopSection(name)
+	self.forgetSection(name)
+	log.Printf("Stopped '%s'", name)
+	return
+}
+
+// Drops a stopped section's config, so a reload adds it back.
+func (self *PipelineConfig) forgetSection(name string) {
+	delete(self.sectionConfigs, name)
+	delete(self.sectionPrimitives, name)
+	delete(self.sectionCategories, name)
+	self.forgetPlugin(name)
+}
+
+// RestartPlugin replaces a single running input, filter, or output with a new
+// instance created from its current config. The new instance starts once the
+// old one has exited. Inputs are stopped before their new instance is
+// created, since it may bind the same address in Init, an input whose new
+// instance can't be created stays stopped.
+func (self *PipelineConfig) RestartPlugin(name string) (err error) {
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	if Globals().Stopping {
+		return errors.New("Heka is shutting down")
+	}
+	var category string
+	if category, err = self.runnerCategory(name); err != nil {
+		return
+	}
+	if category == "Input" {
+		section, errcnt, stopped := self.replaceInput(name, self.sectionPrimitives[name])
+		if errcnt != 0 {
+			self.forgetSection(name)
+			return fmt.Errorf("can't create '%s', it's stopped, see the log for "+
+				"details", name)
+		}
+		self.startSection(section, stopped)
+		log.Printf("Restarted '%s'", name)
+		return
+	}
+	section, errcnt := self.createSection(name, self.sectionPrimitives[name])
+	if errcnt != 0 {
+		return fmt.Errorf("can't create '%s', see the log for details", name)
+	}
+	self.startSection(section, self.stopSection(name))
+	log.Printf("Restarted '%s'", name)
+	return
+}
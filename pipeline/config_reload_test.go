@@ -0,0 +1,304 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	reloadOutputRuns  int32
+	reloadOutputStops int32
+	reloadInputRuns   int32
+)
+
+// Output that just counts how often it's started and stopped.
+type ReloadTestOutput struct{}
+
+func (o *ReloadTestOutput) Init(config interface{}) error {
+	return nil
+}
+
+func (o *ReloadTestOutput) Run(or OutputRunner, h PluginHelper) error {
+	atomic.AddInt32(&reloadOutputRuns, 1)
+	for pack := range or.InChan() {
+		pack.Recycle()
+	}
+	atomic.AddInt32(&reloadOutputStops, 1)
+	return nil
+}
+
+type ReloadTestInputConfig struct {
+	Address string
+	Tag     string
+}
+
+// Input that listens on its address from Init until it's stopped, like the
+// network inputs do.
+type ReloadTestInput struct {
+	listener net.Listener
+	stopChan chan bool
+}
+
+func (i *ReloadTestInput) ConfigStruct() interface{} {
+	return new(ReloadTestInputConfig)
+}
+
+func (i *ReloadTestInput) Init(config interface{}) (err error) {
+	i.listener, err = net.Listen("tcp", config.(*ReloadTestInputConfig).Address)
+	i.stopChan = make(chan bool)
+	return
+}
+
+func (i *ReloadTestInput) Run(ir InputRunner, h PluginHelper) error {
+	atomic.AddInt32(&reloadInputRuns, 1)
+	<-i.stopChan
+	return nil
+}
+
+func (i *ReloadTestInput) Stop() {
+	i.listener.Close()
+	close(i.stopChan)
+}
+
+func init() {
+	RegisterPlugin("ReloadTestOutput", func() interface{} {
+		return new(ReloadTestOutput)
+	})
+	RegisterPlugin("ReloadTestInput", func() interface{} {
+		return new(ReloadTestInput)
+	})
+}
+
+// Returns a local address nothing is listening on.
+func freeAddress() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+// Waits up to a second for the counter to reach the value.
+func waitForCount(counter *int32, value int32) bool {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt32(counter) == value {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func ReloadSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	writeConfig := func(toml string) {
+		err := ioutil.WriteFile(filepath.Join(tmpDir, "hekad.toml"), []byte(toml),
+			0644)
+		c.Assume(err, gs.IsNil)
+	}
+
+	c.Specify("A config reload", func() {
+		atomic.StoreInt32(&reloadOutputRuns, 0)
+		atomic.StoreInt32(&reloadOutputStops, 0)
+		config := NewPipelineConfig(nil)
+		writeConfig(`
+[out1]
+type = "ReloadTestOutput"
+message_matcher = "Type == 'foo'"
+`)
+		err := config.LoadFromConfigPath(tmpDir)
+		c.Assume(err, gs.IsNil)
+		config.router.Start()
+		defer close(config.router.InChan())
+		for _, output := range config.OutputRunners {
+			config.outputsWg.Add(1)
+			output.Start(config, &config.outputsWg)
+		}
+		c.Assume(waitForCount(&reloadOutputRuns, 1), gs.IsTrue)
+		orig := config.OutputRunners["out1"]
+
+		c.Specify("does nothing when the config hasn't changed", func() {
+			err := config.Reload()
+			c.Expect(err, gs.IsNil)
+			c.Expect(config.OutputRunners["out1"], gs.Equals, orig)
+			c.Expect(atomic.LoadInt32(&reloadOutputStops), gs.Equals, int32(0))
+		})
+
+		c.Specify("restarts a changed output", func() {
+			writeConfig(`
+[out1]
+type = "ReloadTestOutput"
+message_matcher = "Type == 'bar'"
+`)
+			err := config.Reload()
+			c.Expect(err, gs.IsNil)
+			c.Expect(waitForCount(&reloadOutputStops, 1), gs.IsTrue)
+			c.Expect(waitForCount(&reloadOutputRuns, 2), gs.IsTrue)
+			c.Expect(config.OutputRunners["out1"], gs.Not(gs.Equals), orig)
+			c.Expect(config.OutputRunners["out1"].MatchRunner().MatcherSpecification().String(),
+				gs.Equals, "Type == 'bar'")
+		})
+
+		c.Specify("adds and removes outputs", func() {
+			writeConfig(`
+[out2]
+type = "ReloadTestOutput"
+message_matcher = "Type == 'foo'"
+`)
+			err := config.Reload()
+			c.Expect(err, gs.IsNil)
+			c.Expect(waitForCount(&reloadOutputStops, 1), gs.IsTrue)
+			c.Expect(waitForCount(&reloadOutputRuns, 2), gs.IsTrue)
+			_, ok := config.OutputRunners["out1"]
+			c.Expect(ok, gs.IsFalse)
+			_, ok = config.OutputRunners["out2"]
+			c.Expect(ok, gs.IsTrue)
+		})
+
+		c.Specify("leaves the running plugins alone when the config is bad", func() {
+			writeConfig(`
+[out1]
+type = "ReloadTestOutput"
+message_matcher = "Type == 'bar'"
+
+[out2]
+type = "NoSuchOutput"
+message_matcher = "TRUE"
+`)
+			err := config.Reload()
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(config.OutputRunners["out1"], gs.Equals, orig)
+			c.Expect(atomic.LoadInt32(&reloadOutputStops), gs.Equals, int32(0))
+		})
+
+		// Shut down the remaining outputs.
+		Globals().Stopping = true
+		for _, output := range config.OutputRunners {
+			config.router.RemoveOutputMatcher() <- output.MatchRunner()
+		}
+		config.outputsWg.Wait()
+		Globals().Stopping = false
+	})
+
+	c.Specify("A config reload of a listening input", func() {
+		atomic.StoreInt32(&reloadInputRuns, 0)
+		origInputStopTimeout := inputStopTimeout
+		inputStopTimeout = time.Second
+		defer func() {
+			inputStopTimeout = origInputStopTimeout
+		}()
+		config := NewPipelineConfig(nil)
+		address := freeAddress()
+		writeConfig(`
+[in1]
+type = "ReloadTestInput"
+address = "` + address + `"
+`)
+		err := config.LoadFromConfigPath(tmpDir)
+		c.Assume(err, gs.IsNil)
+		config.router.Start()
+		defer close(config.router.InChan())
+		for _, input := range config.InputRunners {
+			config.inputsWg.Add(1)
+			input.Start(config, &config.inputsWg)
+		}
+		c.Assume(waitForCount(&reloadInputRuns, 1), gs.IsTrue)
+		orig := config.InputRunners["in1"]
+
+		c.Specify("stops it before creating its replacement", func() {
+			writeConfig(`
+[in1]
+type = "ReloadTestInput"
+address = "` + address + `"
+tag = "changed"
+`)
+			err := config.Reload()
+			c.Expect(err, gs.IsNil)
+			c.Expect(waitForCount(&reloadInputRuns, 2), gs.IsTrue)
+			config.inputsLock.Lock()
+			c.Expect(config.InputRunners["in1"], gs.Not(gs.Equals), orig)
+			config.inputsLock.Unlock()
+		})
+
+		c.Specify("is restarted by RestartPlugin", func() {
+			err := config.RestartPlugin("in1")
+			c.Expect(err, gs.IsNil)
+			c.Expect(waitForCount(&reloadInputRuns, 2), gs.IsTrue)
+			config.inputsLock.Lock()
+			c.Expect(config.InputRunners["in1"], gs.Not(gs.Equals), orig)
+			config.inputsLock.Unlock()
+		})
+
+		c.Specify("restores it and releases the new inputs when aborted", func() {
+			taken, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer taken.Close()
+			added := freeAddress()
+			writeConfig(`
+[in1]
+type = "ReloadTestInput"
+address = "` + taken.Addr().String() + `"
+
+[in2]
+type = "ReloadTestInput"
+address = "` + added + `"
+`)
+			err = config.Reload()
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(waitForCount(&reloadInputRuns, 2), gs.IsTrue)
+			config.inputsLock.Lock()
+			_, ok := config.InputRunners["in2"]
+			config.inputsLock.Unlock()
+			c.Expect(ok, gs.IsFalse)
+			listener, err := net.Listen("tcp", added)
+			c.Expect(err, gs.IsNil)
+			if err == nil {
+				listener.Close()
+			}
+		})
+
+		// Stop the remaining inputs.
+		waitForCount(&reloadInputRuns, 2)
+		Globals().Stopping = true
+		config.inputsLock.Lock()
+		for _, input := range config.InputRunners {
+			input.Input().Stop()
+		}
+		config.inputsLock.Unlock()
+		config.inputsWg.Wait()
+		Globals().Stopping = false
+	})
+
+	c.Specify("Restarts plugins that refer to a replaced plugin", func() {
+		names := map[string]bool{"MyDecoder": true}
+		conf := map[string]interface{}{
+			"decoders": []interface{}{"OtherDecoder", "MyDecoder"},
+		}
+		c.Expect(refersTo(conf, names), gs.IsTrue)
+		conf = map[string]interface{}{"decoder": "OtherDecoder"}
+		c.Expect(refersTo(conf, names), gs.IsFalse)
+	})
+}
@@ -0,0 +1,150 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Matches the `%ENV[VAR_NAME]` and `%FILE[/path]` references in plugin
+// config values.
+var secretRefRegex = regexp.MustCompile(`%(ENV|FILE)\[([^\]]*)\]`)
+
+// What resolved secrets are replaced with in logs and reports.
+const REDACTED = "[REDACTED]"
+
+// Resolved values shorter than this aren't redacted, they'd mangle any log
+// line containing the same characters.
+const minRedactedLength = 4
+
+// The values resolved from config references and encrypted values, longest
+// first so a secret containing another one is redacted as a whole.
+var secrets struct {
+	sync.RWMutex
+	values []string
+}
+
+type byLengthDesc []string
+
+func (s byLengthDesc) Len() int           { return len(s) }
+func (s byLengthDesc) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byLengthDesc) Less(i, j int) bool { return len(s[i]) > len(s[j]) }
+
+// Records a secret value to be redacted from the logs, reports and admin API
+// responses.
+func RegisterSecret(value string) {
+	if len(value) < minRedactedLength {
+		return
+	}
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, known := range secrets.values {
+		if known == value {
+			return
+		}
+	}
+	secrets.values = append(secrets.values, value)
+	sort.Stable(byLengthDesc(secrets.values))
+}
+
+// Returns s with every registered secret replaced by "[REDACTED]".
+func RedactSecrets(s string) string {
+	secrets.RLock()
+	defer secrets.RUnlock()
+	for _, value := range secrets.values {
+		if strings.Contains(s, value) {
+			s = strings.Replace(s, value, REDACTED, -1)
+		}
+	}
+	return s
+}
+
+// Writer redacting the registered secrets from everything written to the
+// wrapped writer, meant to be set as the log output.
+type secretRedactor struct {
+	w io.Writer
+}
+
+func NewSecretRedactor(w io.Writer) io.Writer {
+	return &secretRedactor{w}
+}
+
+func (r *secretRedactor) Write(p []byte) (n int, err error) {
+	if _, err = io.WriteString(r.w, RedactSecrets(string(p))); err != nil {
+		return
+	}
+	return len(p), nil
+}
+
+// Resolves a single `%ENV[...]` or `%FILE[...]` reference. File contents
+// lose their trailing newline.
+func resolveSecretRef(kind, name string) (value string, err error) {
+	if name == "" {
+		return "", fmt.Errorf("empty %%%s[] reference", kind)
+	}
+	if kind == "ENV" {
+		for _, entry := range os.Environ() {
+			if strings.HasPrefix(entry, name+"=") {
+				return entry[len(name)+1:], nil
+			}
+		}
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	var contents []byte
+	if contents, err = ioutil.ReadFile(name); err != nil {
+		return "", fmt.Errorf("can't read secret file: %s", err)
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
+
+// Expands the `%ENV[VAR_NAME]` and `%FILE[/path]` references in a string,
+// registering the resolved values as secrets.
+func InterpolateConfigValue(s string) (expanded string, err error) {
+	if !strings.Contains(s, "%ENV[") && !strings.Contains(s, "%FILE[") {
+		return s, nil
+	}
+	expanded = secretRefRegex.ReplaceAllStringFunc(s, func(ref string) string {
+		if err != nil {
+			return ref
+		}
+		match := secretRefRegex.FindStringSubmatch(ref)
+		var value string
+		if value, err = resolveSecretRef(match[1], match[2]); err != nil {
+			return ref
+		}
+		RegisterSecret(value)
+		return value
+	})
+	if err != nil {
+		expanded = ""
+	}
+	return
+}
+
+// Expands the `%ENV[VAR_NAME]` and `%FILE[/path]` references in every string
+// of a decoded config struct (or PluginConfig map), including those in
+// nested structs, slices and maps.
+func InterpolateConfigValues(config interface{}) error {
+	_, err := rewriteConfigStrings(reflect.ValueOf(config), InterpolateConfigValue)
+	return err
+}
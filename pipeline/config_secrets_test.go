@@ -0,0 +1,121 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	"github.com/bbangert/toml"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func ConfigSecretsSpec(c gs.Context) {
+	os.Setenv("HEKA_TEST_SMTP_PASSWORD", "sm7p-pa55")
+	os.Setenv("HEKA_TEST_BROKER", "kafka.internal")
+	defer os.Unsetenv("HEKA_TEST_SMTP_PASSWORD")
+	defer os.Unsetenv("HEKA_TEST_BROKER")
+
+	tmpDir, err := ioutil.TempDir("", "heka-secrets")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	keyPath := filepath.Join(tmpDir, "aws.key")
+	err = ioutil.WriteFile(keyPath, []byte("AKIA-s3cr3t-k3y\n"), 0600)
+	c.Assume(err, gs.IsNil)
+
+	c.Specify("Config references", func() {
+		c.Specify("are expanded throughout a config struct", func() {
+			conf := &cryptoTestConfig{
+				Address:  "localhost:25",
+				Password: "%ENV[HEKA_TEST_SMTP_PASSWORD]",
+				Brokers:  []string{"%ENV[HEKA_TEST_BROKER]:9092"},
+				Headers:  map[string]string{"Authorization": "AWS %FILE[" + keyPath + "]"},
+				Auth:     &cryptoTestCreds{Password: "%FILE[" + keyPath + "]"},
+			}
+			err := InterpolateConfigValues(conf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(conf.Address, gs.Equals, "localhost:25")
+			c.Expect(conf.Password, gs.Equals, "sm7p-pa55")
+			c.Expect(conf.Brokers[0], gs.Equals, "kafka.internal:9092")
+			c.Expect(conf.Headers["Authorization"], gs.Equals, "AWS AKIA-s3cr3t-k3y")
+			c.Expect(conf.Auth.Password, gs.Equals, "AKIA-s3cr3t-k3y")
+		})
+
+		c.Specify("are expanded in a PluginConfig", func() {
+			conf := PluginConfig{
+				"nested": map[string]interface{}{
+					"list": []interface{}{"plain", "%ENV[HEKA_TEST_BROKER]"},
+				},
+			}
+			err := InterpolateConfigValues(conf)
+			c.Expect(err, gs.IsNil)
+			list := conf["nested"].(map[string]interface{})["list"].([]interface{})
+			c.Expect(list[0], gs.Equals, "plain")
+			c.Expect(list[1], gs.Equals, "kafka.internal")
+		})
+
+		c.Specify("are expanded when the plugin config is loaded", func() {
+			NewPipelineConfig(nil) // initializes Globals()
+			var section struct {
+				Plugin toml.Primitive
+			}
+			_, err := toml.Decode("[plugin]\npassword = \"%ENV[HEKA_TEST_SMTP_PASSWORD]\"\n",
+				&section)
+			c.Assume(err, gs.IsNil)
+			conf, err := LoadConfigStruct(section.Plugin, &cryptoTestPlugin{})
+			c.Expect(err, gs.IsNil)
+			c.Expect(conf.(*cryptoTestConfig).Password, gs.Equals, "sm7p-pa55")
+		})
+
+		c.Specify("fail clearly when they can't be resolved", func() {
+			conf := &cryptoTestConfig{Password: "%ENV[HEKA_TEST_MISSING]"}
+			err := InterpolateConfigValues(conf)
+			c.Assume(err, gs.Not(gs.IsNil))
+			c.Expect(err.Error(), gs.Equals,
+				"Password: environment variable HEKA_TEST_MISSING is not set")
+
+			conf = &cryptoTestConfig{Password: "%FILE[" + keyPath + ".missing]"}
+			err = InterpolateConfigValues(conf)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("Resolved secrets", func() {
+		conf := &cryptoTestConfig{Password: "%ENV[HEKA_TEST_SMTP_PASSWORD]"}
+		err := InterpolateConfigValues(conf)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("are redacted", func() {
+			c.Expect(RedactSecrets("can't log in with sm7p-pa55"), gs.Equals,
+				"can't log in with [REDACTED]")
+		})
+
+		c.Specify("are redacted from the log", func() {
+			out := new(bytes.Buffer)
+			logger := log.New(NewSecretRedactor(out), "", 0)
+			logger.Printf("password: %s", conf.Password)
+			c.Expect(out.String(), gs.Equals, "password: [REDACTED]\n")
+		})
+
+		c.Specify("are redacted from the config loading errors", func() {
+			pc := NewPipelineConfig(nil)
+			pc.log("bad password sm7p-pa55")
+			c.Expect(strings.Contains(pc.LogMsgs[0], "sm7p-pa55"), gs.IsFalse)
+		})
+	})
+}
@@ -0,0 +1,112 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keeps a slow filter or output from holding up the router, and so every
+// other plugin. Once the router has waited longer than the `isolate_after`
+// timeout to deliver to the plugin it is isolated: its messages are diverted
+// to the `isolate_failover` output, or dropped if there's none or it can't
+// keep up either, until its match channel has drained to half its capacity.
+// Only the messages the plugin's message_matcher accepts are diverted.
+type consumerIsolator struct {
+	// Longest the router waits on the plugin before isolating it.
+	after time.Duration
+	// Name of the output taking the messages while isolated, if any.
+	failoverName string
+	pc           *PipelineConfig
+	// Set (atomically) to 1 while isolated.
+	isolated int32
+	// Number of messages diverted (or dropped) while isolated.
+	diverted int64
+	// Number of the diverted messages that were dropped.
+	dropped int64
+	// Protects the isolation state changes.
+	lock sync.Mutex
+}
+
+// Returns true if the consumer is isolated, ending the isolation if its
+// channel has drained enough.
+func (ci *consumerIsolator) check(mr *MatchRunner) bool {
+	if atomic.LoadInt32(&ci.isolated) == 0 {
+		return false
+	}
+	if len(mr.inChan) > cap(mr.inChan)/2 {
+		return true
+	}
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	if atomic.CompareAndSwapInt32(&ci.isolated, 1, 0) {
+		mr.pluginRunner.LogMessage(fmt.Sprintf(
+			"no longer isolated, %d messages were diverted",
+			atomic.LoadInt64(&ci.diverted)))
+	}
+	return false
+}
+
+// Isolates the consumer, after the router timed out delivering to it.
+func (ci *consumerIsolator) isolate(mr *MatchRunner) {
+	ci.lock.Lock()
+	defer ci.lock.Unlock()
+	if atomic.CompareAndSwapInt32(&ci.isolated, 0, 1) {
+		mr.pluginRunner.LogError(fmt.Errorf(
+			"isolated, router blocked for more than %s", ci.after))
+	}
+}
+
+// Hands the pack to the failover output, through its queue buffer if it's
+// buffered, if the consumer's matcher accepts it. The router never waits on
+// the failover, the pack is dropped if the failover's channel is full or
+// there's no failover running.
+func (ci *consumerIsolator) divert(mr *MatchRunner, pack *PipelinePack) {
+	if !mr.matches(pack) {
+		pack.Recycle()
+		return
+	}
+	atomic.AddInt64(&ci.diverted, 1)
+	// Looked up every time, the failover may be started after the isolated
+	// plugin, or be replaced by a reload or restart.
+	if ci.failoverName != "" {
+		if output, ok := ci.pc.Output(ci.failoverName); ok {
+			if failover, ok := output.(*foRunner); ok && failover.matcher != nil &&
+				failover.matcher.offer(pack) {
+				return
+			}
+		}
+	}
+	atomic.AddInt64(&ci.dropped, 1)
+	pack.Recycle()
+}
+
+// Returns the number of messages diverted so far.
+func (ci *consumerIsolator) DivertedCount() int64 {
+	return atomic.LoadInt64(&ci.diverted)
+}
+
+// Returns the number of diverted messages that were dropped so far.
+func (ci *consumerIsolator) DroppedCount() int64 {
+	return atomic.LoadInt64(&ci.dropped)
+}
+
+// Returns true while the consumer is isolated.
+func (ci *consumerIsolator) Isolated() bool {
+	return atomic.LoadInt32(&ci.isolated) != 0
+}
@@ -29,6 +29,10 @@ type CounterFilter struct {
 	count     uint
 	rate      float64
 	rates     []float64
+	// Idempotency keys seen since the last tally.
+	seenKeys            *idempotencySet
+	idempotencyKeyField string
+	duplicates          uint
 }
 
 // CounterFilter config struct, used only for specifying default ticker
@@ -39,19 +43,40 @@ type CounterFilterConfig struct {
 	MessageMatcher string `toml:"message_matcher"`
 	// Defaults to 5 second intervals.
 	TickerInterval uint `toml:"ticker_interval"`
+	// Name of a message field identifying the delivery, messages with the
+	// same value are only counted once per interval. Optional.
+	IdempotencyKeyField string `toml:"idempotency_key_field"`
+	// Most idempotency keys remembered per interval, the oldest ones are
+	// forgotten beyond it. Defaults to 100000.
+	MaxIdempotencyKeys uint `toml:"max_idempotency_keys"`
 }
 
 func (this *CounterFilter) ConfigStruct() interface{} {
 	return &CounterFilterConfig{
-		MessageMatcher: "Type != 'heka.counter-output'",
-		TickerInterval: uint(5),
+		MessageMatcher:     "Type != 'heka.counter-output'",
+		TickerInterval:     uint(5),
+		MaxIdempotencyKeys: DEFAULT_MAX_IDEMPOTENCY_KEYS,
 	}
 }
 
 func (this *CounterFilter) Init(config interface{}) error {
+	conf := config.(*CounterFilterConfig)
+	this.idempotencyKeyField = conf.IdempotencyKeyField
+	this.seenKeys = newIdempotencySet(int(conf.MaxIdempotencyKeys))
 	return nil
 }
 
+// Counts the message, unless a message with the same idempotency key was
+// already counted in this interval.
+func (this *CounterFilter) countMessage(pack *PipelinePack) {
+	key := IdempotencyKey(pack.Message, this.idempotencyKeyField)
+	if !this.seenKeys.add(key) {
+		this.duplicates++
+		return
+	}
+	this.count++
+}
+
 func (this *CounterFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 	inChan := fr.InChan()
 	ticker := fr.Ticker()
@@ -69,7 +94,7 @@ func (this *CounterFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 				break
 			}
 			msgLoopCount = pack.MsgLoopCount
-			this.count++
+			this.countMessage(pack)
 			pack.Recycle()
 		case <-ticker:
 			this.tally(fr, h, msgLoopCount)
@@ -81,6 +106,9 @@ func (this *CounterFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 func (this *CounterFilter) tally(fr FilterRunner, h PluginHelper,
 	msgLoopCount uint) {
 	msgsSent := this.count - this.lastCount
+	duplicates := this.duplicates
+	this.seenKeys.reset()
+	this.duplicates = 0
 	if msgsSent == 0 {
 		return
 	}
@@ -99,8 +127,12 @@ func (this *CounterFilter) tally(fr FilterRunner, h PluginHelper,
 		return
 	}
 	pack.Message.SetType("heka.counter-output")
-	pack.Message.SetPayload(fmt.Sprintf("Got %d messages. %0.2f msg/sec",
-		this.count, this.rate))
+	payload := fmt.Sprintf("Got %d messages. %0.2f msg/sec", this.count,
+		this.rate)
+	if duplicates > 0 {
+		payload += fmt.Sprintf(" (%d duplicates ignored)", duplicates)
+	}
+	pack.Message.SetPayload(payload)
 	fr.Inject(pack)
 
 	samples := len(this.rates)
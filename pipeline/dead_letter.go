@@ -0,0 +1,163 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Keeps the messages Heka would otherwise destroy, i.e. those a decoder
+// failed to decode or a sandbox filter rejected fatally. Each is annotated
+// with the error and the rejecting plugin and handed to the
+// `dead_letter_output` output, bypassing the router, or appended to the
+// `dead_letter_file` protobuf stream file. With neither configured they're
+// only counted.
+type deadLetterQueue struct {
+	pc         *PipelineConfig
+	outputName string
+	path       string
+	// Number of messages dead-lettered.
+	count int64
+	// Number of those that couldn't be kept.
+	dropped int64
+	// Protects the output lookup and the file writes.
+	lock     sync.Mutex
+	output   OutputRunner
+	file     *os.File
+	outBytes []byte
+}
+
+func newDeadLetterQueue(pc *PipelineConfig, globals *GlobalConfigStruct) *deadLetterQueue {
+	dlq := &deadLetterQueue{
+		pc:         pc,
+		outputName: globals.DeadLetterOutput,
+	}
+	if globals.DeadLetterFile != "" {
+		dlq.path = GetHekaConfigDir(globals.DeadLetterFile)
+	}
+	return dlq
+}
+
+// Hands a pack that would otherwise be discarded because of `err` to the
+// dead-letter queue, which takes over the caller's reference to it. `source`
+// is the name of the plugin rejecting the message.
+func (pc *PipelineConfig) DeadLetter(pack *PipelinePack, source string, err error) {
+	if pc.deadLetters == nil {
+		pack.Recycle()
+		return
+	}
+	pc.deadLetters.add(pack, source, err)
+}
+
+func (dlq *deadLetterQueue) add(pack *PipelinePack, source string, err error) {
+	atomic.AddInt64(&dlq.count, 1)
+	annotateDeadLetter(pack, source, err)
+	if output := dlq.getOutput(); output != nil {
+		output.InChan() <- pack
+		return
+	}
+	if dlq.path != "" {
+		if e := dlq.write(pack); e != nil {
+			atomic.AddInt64(&dlq.dropped, 1)
+			dlq.pc.log(fmt.Sprintf("Dead letter write failed: %s", e))
+		}
+	} else {
+		atomic.AddInt64(&dlq.dropped, 1)
+	}
+	pack.Recycle()
+}
+
+// Adds the error and source fields to the message. Raw input that was never
+// decoded, and so isn't in the message, goes in the DeadLetterData field.
+// Such a message has no Uuid or Timestamp yet, both are set so it can be
+// protobuf encoded.
+func annotateDeadLetter(pack *PipelinePack, source string, err error) {
+	msg := pack.Message
+	if msg.Uuid == nil {
+		msg.SetUuid(uuid.NewRandom())
+	}
+	if msg.Timestamp == nil {
+		msg.SetTimestamp(time.Now().UnixNano())
+	}
+	if err != nil {
+		message.NewStringField(msg, "DeadLetterError", err.Error())
+	}
+	message.NewStringField(msg, "DeadLetterSource", source)
+	// Inputs trim MsgBytes to the data they read, a full length slice is
+	// just the pack's unused buffer.
+	if !pack.Decoded && msg.GetPayload() == "" && len(pack.MsgBytes) > 0 &&
+		len(pack.MsgBytes) < cap(pack.MsgBytes) {
+
+		data := make([]byte, len(pack.MsgBytes))
+		copy(data, pack.MsgBytes)
+		if f, e := message.NewField("DeadLetterData", data, ""); e == nil {
+			msg.AddField(f)
+		}
+	}
+}
+
+// Looks up the dead-letter output, which may be started after the plugins
+// using it.
+func (dlq *deadLetterQueue) getOutput() OutputRunner {
+	if dlq.outputName == "" {
+		return nil
+	}
+	dlq.lock.Lock()
+	defer dlq.lock.Unlock()
+	if dlq.output == nil {
+		dlq.output, _ = dlq.pc.Output(dlq.outputName)
+	}
+	return dlq.output
+}
+
+// Appends the message to the dead-letter file, opening it the first time.
+func (dlq *deadLetterQueue) write(pack *PipelinePack) (err error) {
+	dlq.lock.Lock()
+	defer dlq.lock.Unlock()
+	if dlq.file == nil {
+		if dlq.file, err = os.OpenFile(dlq.path,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			dlq.file = nil
+			return
+		}
+	}
+	if err = ProtobufEncodeMessage(pack, &dlq.outBytes); err != nil {
+		return
+	}
+	_, err = dlq.file.Write(dlq.outBytes)
+	return
+}
+
+// Closes the dead-letter file, if it was opened.
+func (dlq *deadLetterQueue) close() {
+	dlq.lock.Lock()
+	defer dlq.lock.Unlock()
+	if dlq.file != nil {
+		dlq.file.Close()
+		dlq.file = nil
+	}
+}
+
+// Returns the number of messages dead-lettered so far, and how many of
+// those couldn't be kept.
+func (dlq *deadLetterQueue) Counts() (count, dropped int64) {
+	return atomic.LoadInt64(&dlq.count), atomic.LoadInt64(&dlq.dropped)
+}
@@ -0,0 +1,113 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func DeadLetterSpec(c gs.Context) {
+	globals := DefaultGlobals()
+	recycleChan := make(chan *PipelinePack, 1)
+	pack := NewPipelinePack(recycleChan)
+	pack.Message.SetType("bad")
+	decodeErr := errors.New("can't decode")
+
+	getField := func(msg *message.Message, name string) interface{} {
+		val, _ := msg.GetFieldValue(name)
+		return val
+	}
+
+	c.Specify("The dead-letter queue", func() {
+		c.Specify("counts the dropped messages if there's nowhere to keep them", func() {
+			pc := NewPipelineConfig(globals)
+			pc.DeadLetter(pack, "TestDecoder", decodeErr)
+			c.Expect(len(recycleChan), gs.Equals, 1)
+			count, dropped := pc.deadLetters.Counts()
+			c.Expect(count, gs.Equals, int64(1))
+			c.Expect(dropped, gs.Equals, int64(1))
+		})
+
+		c.Specify("hands annotated messages to the dead-letter output", func() {
+			globals.DeadLetterOutput = "dlq"
+			pc := NewPipelineConfig(globals)
+			output := NewFORunner("dlq", nil, new(PluginGlobals))
+			pc.OutputRunners["dlq"] = output
+			pack.MsgBytes = pack.MsgBytes[:3]
+			copy(pack.MsgBytes, "raw")
+
+			pc.DeadLetter(pack, "TestDecoder", decodeErr)
+			c.Expect(len(output.inChan), gs.Equals, 1)
+			c.Expect(<-output.inChan, gs.Equals, pack)
+			c.Expect(len(recycleChan), gs.Equals, 0)
+			c.Expect(getField(pack.Message, "DeadLetterError"), gs.Equals, "can't decode")
+			c.Expect(getField(pack.Message, "DeadLetterSource"), gs.Equals, "TestDecoder")
+			c.Expect(string(getField(pack.Message, "DeadLetterData").([]byte)),
+				gs.Equals, "raw")
+			count, dropped := pc.deadLetters.Counts()
+			c.Expect(count, gs.Equals, int64(1))
+			c.Expect(dropped, gs.Equals, int64(0))
+		})
+
+		c.Specify("keeps the Uuid and Timestamp of decoded messages", func() {
+			pack.Message.SetUuid([]byte("0123456789abcdef"))
+			pack.Message.SetTimestamp(42)
+			annotateDeadLetter(pack, "TestFilter", decodeErr)
+			c.Expect(string(pack.Message.GetUuid()), gs.Equals, "0123456789abcdef")
+			c.Expect(pack.Message.GetTimestamp(), gs.Equals, int64(42))
+		})
+
+		c.Specify("doesn't copy the pack's unused buffer", func() {
+			pc := NewPipelineConfig(globals)
+			annotateDeadLetter(pack, "TestDecoder", decodeErr)
+			c.Expect(getField(pack.Message, "DeadLetterData"), gs.IsNil)
+			pc.DeadLetter(pack, "TestDecoder", decodeErr)
+		})
+
+		c.Specify("appends messages to the dead-letter file", func() {
+			tmpDir, err := ioutil.TempDir("", "heka-dead-letter")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			globals.BaseDir = tmpDir
+			globals.DeadLetterFile = "dead_letters.log"
+			pc := NewPipelineConfig(globals)
+
+			pc.DeadLetter(pack, "TestFilter", decodeErr)
+			c.Expect(len(recycleChan), gs.Equals, 1)
+			pc.deadLetters.close()
+
+			data, err := ioutil.ReadFile(filepath.Join(tmpDir, "dead_letters.log"))
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(data) > message.HEADER_FRAMING_SIZE, gs.IsTrue)
+			c.Expect(data[0], gs.Equals, byte(message.RECORD_SEPARATOR))
+			headerEnd := int(data[1]) + message.HEADER_FRAMING_SIZE
+			msg := new(message.Message)
+			c.Expect(proto.Unmarshal(data[headerEnd:], msg), gs.IsNil)
+			c.Expect(len(msg.GetUuid()), gs.Equals, message.UUID_SIZE)
+			c.Expect(msg.GetTimestamp() > 0, gs.IsTrue)
+			c.Expect(msg.GetType(), gs.Equals, "bad")
+			c.Expect(getField(msg, "DeadLetterSource"), gs.Equals, "TestFilter")
+			count, dropped := pc.deadLetters.Counts()
+			c.Expect(count, gs.Equals, int64(1))
+			c.Expect(dropped, gs.Equals, int64(0))
+		})
+	})
+}
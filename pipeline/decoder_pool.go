@@ -0,0 +1,130 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"strings"
+	"sync"
+)
+
+// DecoderRunner for a decoder configured with a `pool_size` greater than one.
+// Runs that many instances of the decoder, each with its own Decoder object
+// (and so its own sandbox state) in its own goroutine, all reading from a
+// single input channel, so CPU heavy decoding can use more than one core.
+// Messages from one input are no longer guaranteed to be decoded in order.
+type decoderPool struct {
+	// The first instance, whose input channel is shared by all of them.
+	*dRunner
+	runners []*dRunner
+}
+
+func newDecoderPool(name string, wrapper *PluginWrapper,
+	pluginGlobals *PluginGlobals) *decoderPool {
+
+	pool := &decoderPool{runners: make([]*dRunner, pluginGlobals.PoolSize)}
+	for i := range pool.runners {
+		decoder := wrapper.Create().(Decoder)
+		runner := NewDecoderRunner(name, decoder, pluginGlobals).(*dRunner)
+		if i > 0 {
+			runner.inChan = pool.runners[0].inChan
+			runner.guard = pool.runners[0].guard
+			runner.charset = pool.runners[0].charset
+		}
+		pool.runners[i] = runner
+	}
+	pool.dRunner = pool.runners[0]
+	return pool
+}
+
+// Starts every instance, the wait group is decremented once all of them have
+// exited.
+func (p *decoderPool) Start(h PluginHelper, wg *sync.WaitGroup) {
+	var poolWg sync.WaitGroup
+	poolWg.Add(len(p.runners))
+	for _, runner := range p.runners {
+		runner.Start(h, &poolWg)
+	}
+	go func() {
+		poolWg.Wait()
+		wg.Done()
+	}()
+}
+
+// Combines the report fields of every instance so the pool reports as a
+// single decoder. Numeric fields are added up, except for averages, which
+// are averaged, and maximums, of which the largest is kept. Other fields are
+// taken from the first instance.
+func (p *decoderPool) ReportMsg(msg *message.Message) (err error) {
+	var fields []*message.Field
+	byName := make(map[string]*message.Field)
+	for i, runner := range p.runners {
+		reporter, ok := runner.plugin.(ReportingPlugin)
+		if !ok {
+			break
+		}
+		instanceMsg := new(message.Message)
+		if err = reporter.ReportMsg(instanceMsg); err != nil {
+			return
+		}
+		for _, f := range instanceMsg.Fields {
+			name := f.GetName()
+			total, ok := byName[name]
+			if !ok {
+				if i == 0 {
+					fields = append(fields, f)
+					byName[name] = f
+				}
+				continue
+			}
+			isMax := strings.HasPrefix(name, "Max")
+			switch f.GetValueType() {
+			case message.Field_INTEGER:
+				if len(f.ValueInteger) == 0 || len(total.ValueInteger) == 0 {
+					continue
+				}
+				if !isMax {
+					total.ValueInteger[0] += f.ValueInteger[0]
+				} else if f.ValueInteger[0] > total.ValueInteger[0] {
+					total.ValueInteger[0] = f.ValueInteger[0]
+				}
+			case message.Field_DOUBLE:
+				if len(f.ValueDouble) == 0 || len(total.ValueDouble) == 0 {
+					continue
+				}
+				if !isMax {
+					total.ValueDouble[0] += f.ValueDouble[0]
+				} else if f.ValueDouble[0] > total.ValueDouble[0] {
+					total.ValueDouble[0] = f.ValueDouble[0]
+				}
+			}
+		}
+	}
+
+	count := len(p.runners)
+	for _, f := range fields {
+		if strings.Contains(f.GetName(), "Avg") {
+			if len(f.ValueInteger) > 0 {
+				f.ValueInteger[0] /= int64(count)
+			}
+			if len(f.ValueDouble) > 0 {
+				f.ValueDouble[0] /= float64(count)
+			}
+		}
+		msg.AddField(f)
+	}
+	message.NewIntField(msg, "PoolSize", count, "count")
+	return
+}
@@ -0,0 +1,169 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Decoder that tags each message with the instance that decoded it.
+type PoolTestDecoder struct {
+	id          int64
+	count       int64
+	denominator int64
+}
+
+var poolTestDecoderIds int64
+
+func (d *PoolTestDecoder) Init(config interface{}) error {
+	d.id = atomic.AddInt64(&poolTestDecoderIds, 1)
+	return nil
+}
+
+func (d *PoolTestDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack,
+	err error) {
+
+	atomic.AddInt64(&d.count, 1)
+	message.NewInt64Field(pack.Message, "DecoderId", d.id, "")
+	return []*PipelinePack{pack}, nil
+}
+
+func (d *PoolTestDecoder) SetSampleDenominator(denominator int) {
+	atomic.StoreInt64(&d.denominator, int64(denominator))
+}
+
+func (d *PoolTestDecoder) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&d.count),
+		"count")
+	message.NewInt64Field(msg, "MaxId", d.id, "")
+	message.NewInt64Field(msg, "AvgId", d.id, "")
+	message.NewStringField(msg, "Note", "pooled")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("PoolTestDecoder", func() interface{} {
+		return new(PoolTestDecoder)
+	})
+}
+
+func DecoderPoolSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	c.Specify("A decoder with a pool_size", func() {
+		config := NewPipelineConfig(nil)
+		err := ioutil.WriteFile(filepath.Join(tmpDir, "hekad.toml"), []byte(`
+[pooled]
+type = "PoolTestDecoder"
+pool_size = 3
+sample_denominator = 10
+
+[single]
+type = "PoolTestDecoder"
+`), 0644)
+		c.Assume(err, gs.IsNil)
+		err = config.LoadFromConfigPath(tmpDir)
+		c.Assume(err, gs.IsNil)
+		atomic.StoreInt64(&poolTestDecoderIds, 0)
+
+		dr, ok := config.DecoderRunner("pooled")
+		c.Assume(ok, gs.IsTrue)
+		pool, ok := dr.(*decoderPool)
+		c.Assume(ok, gs.IsTrue)
+		c.Expect(len(pool.runners), gs.Equals, 3)
+		c.Expect(dr.Name(), gs.Equals, "pooled")
+
+		c.Specify("runs an instance per pool slot sharing one channel", func() {
+			ids := make(map[int64]bool)
+			for _, runner := range pool.runners {
+				c.Expect(runner.inChan, gs.Equals, dr.InChan())
+				ids[runner.Decoder().(*PoolTestDecoder).id] = true
+			}
+			c.Expect(len(ids), gs.Equals, 3)
+
+			supply := make(chan *PipelinePack, 30)
+			for i := 0; i < 30; i++ {
+				dr.InChan() <- NewPipelinePack(supply)
+			}
+			for i := 0; i < 30; i++ {
+				pack := <-config.router.InChan()
+				_, ok := pack.Message.GetFieldValue("DecoderId")
+				c.Expect(ok, gs.IsTrue)
+			}
+		})
+
+		c.Specify("passes its sample_denominator to every instance", func() {
+			supply := make(chan *PipelinePack, 1)
+			dr.InChan() <- NewPipelinePack(supply)
+			pack := <-config.router.InChan()
+			id, _ := pack.Message.GetFieldValue("DecoderId")
+			for _, runner := range pool.runners {
+				c.Expect(SampleDenominator(runner), gs.Equals, 10)
+				decoder := runner.Decoder().(*PoolTestDecoder)
+				if decoder.id == id.(int64) {
+					// The instance that decoded the pack has been started.
+					c.Expect(atomic.LoadInt64(&decoder.denominator), gs.Equals, int64(10))
+				}
+			}
+
+			single, ok := config.DecoderRunner("single")
+			c.Assume(ok, gs.IsTrue)
+			c.Expect(SampleDenominator(single), gs.Equals,
+				int(DURATION_SAMPLE_DENOMINATOR))
+			close(single.InChan())
+		})
+
+		c.Specify("reports the combined stats of its instances", func() {
+			supply := make(chan *PipelinePack, 6)
+			for i := 0; i < 6; i++ {
+				dr.InChan() <- NewPipelinePack(supply)
+			}
+			for i := 0; i < 6; i++ {
+				<-config.router.InChan()
+			}
+			msg := new(message.Message)
+			err := PopulateReportMsg(dr, msg)
+			c.Expect(err, gs.IsNil)
+			value, _ := msg.GetFieldValue("ProcessMessageCount")
+			c.Expect(value, gs.Equals, int64(6))
+			value, _ = msg.GetFieldValue("MaxId")
+			c.Expect(value, gs.Equals, int64(3))
+			value, _ = msg.GetFieldValue("AvgId")
+			c.Expect(value, gs.Equals, int64(2))
+			value, _ = msg.GetFieldValue("Note")
+			c.Expect(value, gs.Equals, "pooled")
+			value, _ = msg.GetFieldValue("PoolSize")
+			c.Expect(value, gs.Equals, int64(3))
+		})
+
+		c.Specify("leaves a decoder without one alone", func() {
+			single, ok := config.DecoderRunner("single")
+			c.Assume(ok, gs.IsTrue)
+			_, ok = single.(*decoderPool)
+			c.Expect(ok, gs.IsFalse)
+			close(single.InChan())
+		})
+
+		close(dr.InChan())
+		config.decodersWg.Wait()
+	})
+}
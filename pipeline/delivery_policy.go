@@ -0,0 +1,109 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// What a filter or output's matcher does with a matching message when the
+// plugin's input channel is full, set with `delivery_policy`.
+const (
+	// Waits for room, backing up the router and so every other plugin.
+	DELIVERY_BLOCK = "block"
+	// Drops the oldest message in the channel to make room.
+	DELIVERY_DROP_OLDEST = "drop_oldest"
+	// Drops the message.
+	DELIVERY_DROP_NEWEST = "drop_newest"
+	// "sample(N)" waits for room for one message in N and drops the others.
+	DELIVERY_SAMPLE = "sample"
+)
+
+// Keeps a full filter or output input channel from backing up the router,
+// by dropping messages instead of waiting.
+type deliveryPolicy struct {
+	action string
+	// Deliver one message in sampleRate while full, for DELIVERY_SAMPLE.
+	sampleRate int64
+	sampled    int64
+	dropped    int64
+}
+
+// Parses a `delivery_policy` setting, returning nil for DELIVERY_BLOCK.
+func newDeliveryPolicy(setting string) (dp *deliveryPolicy, err error) {
+	switch setting {
+	case "", DELIVERY_BLOCK:
+		return
+	case DELIVERY_DROP_OLDEST, DELIVERY_DROP_NEWEST:
+		return &deliveryPolicy{action: setting}, nil
+	}
+	if strings.HasPrefix(setting, DELIVERY_SAMPLE+"(") && strings.HasSuffix(setting, ")") {
+		rate, e := strconv.ParseInt(setting[len(DELIVERY_SAMPLE)+1:len(setting)-1], 10, 64)
+		if e == nil && rate > 0 {
+			return &deliveryPolicy{action: DELIVERY_SAMPLE, sampleRate: rate}, nil
+		}
+	}
+	return nil, fmt.Errorf("Invalid delivery_policy: %s", setting)
+}
+
+// Puts the pack on the channel, applying the policy if it's full.
+func (dp *deliveryPolicy) send(inChan chan *PipelinePack, pack *PipelinePack) {
+	select {
+	case inChan <- pack:
+		return
+	default:
+	}
+	switch dp.action {
+	case DELIVERY_DROP_NEWEST:
+		dp.drop(pack)
+	case DELIVERY_DROP_OLDEST:
+		if cap(inChan) == 0 {
+			// Nothing buffered to drop.
+			inChan <- pack
+			return
+		}
+		for {
+			select {
+			case oldest := <-inChan:
+				dp.drop(oldest)
+			default:
+			}
+			select {
+			case inChan <- pack:
+				return
+			default:
+			}
+		}
+	case DELIVERY_SAMPLE:
+		if atomic.AddInt64(&dp.sampled, 1)%dp.sampleRate == 0 {
+			inChan <- pack
+		} else {
+			dp.drop(pack)
+		}
+	}
+}
+
+func (dp *deliveryPolicy) drop(pack *PipelinePack) {
+	atomic.AddInt64(&dp.dropped, 1)
+	pack.Recycle()
+}
+
+// Returns the number of messages dropped so far.
+func (dp *deliveryPolicy) DroppedCount() int64 {
+	return atomic.LoadInt64(&dp.dropped)
+}
@@ -0,0 +1,98 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func DeliveryPolicySpec(c gs.Context) {
+	c.Specify("A delivery policy", func() {
+		recycleChan := make(chan *PipelinePack, 10)
+		inChan := make(chan *PipelinePack, 2)
+		newPack := func(typ string) *PipelinePack {
+			pack := NewPipelinePack(recycleChan)
+			pack.Message.SetType(typ)
+			return pack
+		}
+		inChan <- newPack("first")
+		inChan <- newPack("second")
+
+		c.Specify("isn't needed to block", func() {
+			dp, err := newDeliveryPolicy("")
+			c.Expect(err, gs.IsNil)
+			c.Expect(dp, gs.IsNil)
+			dp, err = newDeliveryPolicy(DELIVERY_BLOCK)
+			c.Expect(err, gs.IsNil)
+			c.Expect(dp, gs.IsNil)
+		})
+
+		c.Specify("rejects unknown policies", func() {
+			for _, setting := range []string{"drop", "sample(0)", "sample(x)", "sample"} {
+				_, err := newDeliveryPolicy(setting)
+				c.Expect(err, gs.Not(gs.IsNil))
+			}
+		})
+
+		c.Specify("delivers while there's room", func() {
+			dp, err := newDeliveryPolicy(DELIVERY_DROP_NEWEST)
+			c.Assume(err, gs.IsNil)
+			<-inChan
+			dp.send(inChan, newPack("third"))
+			c.Expect(len(inChan), gs.Equals, 2)
+			c.Expect(dp.DroppedCount(), gs.Equals, int64(0))
+		})
+
+		c.Specify("drops the newest message", func() {
+			dp, err := newDeliveryPolicy(DELIVERY_DROP_NEWEST)
+			c.Assume(err, gs.IsNil)
+			dp.send(inChan, newPack("third"))
+			c.Expect(len(recycleChan), gs.Equals, 1)
+			c.Expect((<-inChan).Message.GetType(), gs.Equals, "first")
+			c.Expect((<-inChan).Message.GetType(), gs.Equals, "second")
+			c.Expect(dp.DroppedCount(), gs.Equals, int64(1))
+		})
+
+		c.Specify("drops the oldest message", func() {
+			dp, err := newDeliveryPolicy(DELIVERY_DROP_OLDEST)
+			c.Assume(err, gs.IsNil)
+			dp.send(inChan, newPack("third"))
+			c.Expect(len(recycleChan), gs.Equals, 1)
+			c.Expect((<-inChan).Message.GetType(), gs.Equals, "second")
+			c.Expect((<-inChan).Message.GetType(), gs.Equals, "third")
+			c.Expect(dp.DroppedCount(), gs.Equals, int64(1))
+		})
+
+		c.Specify("samples one message in N", func() {
+			dp, err := newDeliveryPolicy("sample(3)")
+			c.Assume(err, gs.IsNil)
+			dp.send(inChan, newPack("third"))
+			dp.send(inChan, newPack("fourth"))
+			c.Expect(len(recycleChan), gs.Equals, 2)
+			c.Expect(dp.DroppedCount(), gs.Equals, int64(2))
+
+			done := make(chan bool)
+			go func() {
+				dp.send(inChan, newPack("fifth"))
+				done <- true
+			}()
+			c.Expect((<-inChan).Message.GetType(), gs.Equals, "first")
+			<-done
+			c.Expect((<-inChan).Message.GetType(), gs.Equals, "second")
+			c.Expect((<-inChan).Message.GetType(), gs.Equals, "fifth")
+			c.Expect(dp.DroppedCount(), gs.Equals, int64(2))
+		})
+	})
+}
@@ -0,0 +1,310 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Possible `disk_full_action` settings, applied when a watched directory or
+// the total of all of them goes over budget.
+const (
+	// Writers into the directory wait until enough space has been freed.
+	DISK_FULL_BLOCK = "block"
+	// The oldest data (replayed queue files, rotated output files) is
+	// removed, falling back to blocking if nothing more can be removed.
+	DISK_FULL_DROP_OLDEST = "drop_oldest"
+	// A heka.disk-alert message is sent but writes carry on.
+	DISK_FULL_ALERT = "alert"
+)
+
+// Keeps track of the disk space used by the directories Heka writes to (the
+// queue buffers and the FileOutput destinations) and enforces the per
+// directory `disk_budget` and global `disk_budget_total` limits. Usage is
+// checked periodically rather than on every write, so a directory can go
+// over its budget by however much is written in one check interval.
+type DiskWatchdog struct {
+	totalBudget int64
+	action      string
+	interval    time.Duration
+	pc          *PipelineConfig
+	lock        sync.Mutex
+	budgets     []*DiskBudget
+	// Whether the total budget was exceeded at the last check, only used by
+	// the check loop.
+	totalOver bool
+	// Called on every change to or from the over budget state, replaced in
+	// tests.
+	alert func(dir string, usage, budget int64, over bool)
+	// Closed when Heka shuts down.
+	stopChan chan struct{}
+}
+
+// Registration of a single plugin's directory with the watchdog.
+type DiskBudget struct {
+	name   string
+	dir    string
+	budget int64
+	// Removes at least `need` bytes of the oldest data in the directory if
+	// possible, returning the number of bytes actually freed.
+	dropOldest func(need int64) int64
+	// Set (atomically) while writes to the directory should be held back.
+	blocked int32
+	// Whether the directory was over budget at the last check, only used by
+	// the check loop.
+	over bool
+	wd   *DiskWatchdog
+}
+
+// Creates a watchdog enforcing the total budget and action from the globals.
+func NewDiskWatchdog(pc *PipelineConfig, globals *GlobalConfigStruct) *DiskWatchdog {
+	wd := &DiskWatchdog{
+		totalBudget: int64(globals.DiskBudgetTotal),
+		action:      globals.DiskFullAction,
+		interval:    globals.DiskCheckInterval,
+		pc:          pc,
+		stopChan:    make(chan struct{}),
+	}
+	if wd.action == "" {
+		wd.action = DISK_FULL_BLOCK
+	}
+	if wd.interval <= 0 {
+		wd.interval = 10 * time.Second
+	}
+	wd.alert = wd.sendAlert
+	return wd
+}
+
+// Adds a directory to be watched on behalf of the named plugin. A budget of
+// zero means the directory only counts towards the total budget.
+// `dropOldest` may be nil if the plugin has nothing it can safely remove.
+func (wd *DiskWatchdog) Register(name, dir string, budget int64,
+	dropOldest func(need int64) int64) (b *DiskBudget) {
+
+	b = &DiskBudget{
+		name:       name,
+		dir:        filepath.Clean(dir),
+		budget:     budget,
+		dropOldest: dropOldest,
+		wd:         wd,
+	}
+	wd.lock.Lock()
+	wd.budgets = append(wd.budgets, b)
+	wd.lock.Unlock()
+	return
+}
+
+// Stops watching the directory.
+func (b *DiskBudget) Close() {
+	wd := b.wd
+	wd.lock.Lock()
+	for i, other := range wd.budgets {
+		if other == b {
+			wd.budgets = append(wd.budgets[:i], wd.budgets[i+1:]...)
+			break
+		}
+	}
+	wd.lock.Unlock()
+	atomic.StoreInt32(&b.blocked, 0)
+}
+
+// Returns true when writes to the directory should be held back.
+func (b *DiskBudget) Blocked() bool {
+	return atomic.LoadInt32(&b.blocked) == 1
+}
+
+// Waits until writes to the directory are allowed again. Returns false if
+// the watchdog was stopped while waiting.
+func (b *DiskBudget) Wait() bool {
+	if !b.Blocked() {
+		return true
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for b.Blocked() {
+		select {
+		case <-ticker.C:
+		case <-b.wd.stopChan:
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the total size of the regular files in and below dir.
+func dirUsage(dir string) (usage int64) {
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			usage += info.Size()
+		}
+		return nil
+	})
+	return
+}
+
+type budgetsByUsage struct {
+	budgets []*DiskBudget
+	usage   map[string]int64
+}
+
+func (b budgetsByUsage) Len() int      { return len(b.budgets) }
+func (b budgetsByUsage) Swap(i, j int) { b.budgets[i], b.budgets[j] = b.budgets[j], b.budgets[i] }
+func (b budgetsByUsage) Less(i, j int) bool {
+	return b.usage[b.budgets[i].dir] > b.usage[b.budgets[j].dir]
+}
+
+// Measures every watched directory and applies the configured action to the
+// ones over budget.
+func (wd *DiskWatchdog) Check() {
+	wd.lock.Lock()
+	budgets := make([]*DiskBudget, len(wd.budgets))
+	copy(budgets, wd.budgets)
+	wd.lock.Unlock()
+
+	// Directories shared by several plugins are only measured once.
+	usage := make(map[string]int64)
+	var total int64
+	for _, b := range budgets {
+		if b.budget == 0 && wd.totalBudget == 0 {
+			continue
+		}
+		if _, ok := usage[b.dir]; !ok {
+			usage[b.dir] = dirUsage(b.dir)
+			total += usage[b.dir]
+		}
+	}
+
+	drop := func(b *DiskBudget, need int64) {
+		if b.dropOldest == nil || need <= 0 {
+			return
+		}
+		freed := b.dropOldest(need)
+		usage[b.dir] -= freed
+		total -= freed
+	}
+
+	dirOver := make(map[*DiskBudget]bool)
+	for _, b := range budgets {
+		if b.budget == 0 || usage[b.dir] <= b.budget {
+			continue
+		}
+		if wd.action == DISK_FULL_DROP_OLDEST {
+			drop(b, usage[b.dir]-b.budget)
+		}
+		dirOver[b] = usage[b.dir] > b.budget
+	}
+
+	totalOver := wd.totalBudget > 0 && total > wd.totalBudget
+	if totalOver && wd.action == DISK_FULL_DROP_OLDEST {
+		// Free space in the biggest directories first.
+		sort.Sort(budgetsByUsage{budgets, usage})
+		for _, b := range budgets {
+			if total <= wd.totalBudget {
+				break
+			}
+			drop(b, total-wd.totalBudget)
+		}
+		totalOver = total > wd.totalBudget
+	}
+	if totalOver != wd.totalOver {
+		wd.alert("", total, wd.totalBudget, totalOver)
+		wd.totalOver = totalOver
+	}
+
+	for _, b := range budgets {
+		over := dirOver[b]
+		if over != b.over {
+			wd.alert(b.dir, usage[b.dir], b.budget, over)
+			b.over = over
+		}
+		if (over || totalOver) && wd.action != DISK_FULL_ALERT {
+			atomic.StoreInt32(&b.blocked, 1)
+		} else {
+			atomic.StoreInt32(&b.blocked, 0)
+		}
+	}
+}
+
+// Checks the watched directories every check interval until the watchdog
+// is stopped.
+func (wd *DiskWatchdog) Run() {
+	ticker := time.NewTicker(wd.interval)
+	defer ticker.Stop()
+	for {
+		wd.Check()
+		select {
+		case <-ticker.C:
+		case <-wd.stopChan:
+			return
+		}
+	}
+}
+
+// Stops the check loop and releases the writers waiting for disk space, must
+// only be called once, when Heka shuts down.
+func (wd *DiskWatchdog) Stop() {
+	close(wd.stopChan)
+}
+
+// Logs the change and hands a heka.disk-alert message to the router. An
+// empty dir means the total budget.
+func (wd *DiskWatchdog) sendAlert(dir string, usage, budget int64, over bool) {
+	what := dir
+	if dir == "" {
+		what = "total disk usage"
+	}
+	var payload string
+	if over {
+		payload = fmt.Sprintf("%s over disk budget: %d of %d bytes used, action: %s",
+			what, usage, budget, wd.action)
+	} else {
+		payload = fmt.Sprintf("%s back under disk budget: %d of %d bytes used",
+			what, usage, budget)
+	}
+	log.Println(payload)
+	if wd.pc == nil {
+		return
+	}
+	// Don't hold up the checks if the pipeline is backed up.
+	go func() {
+		pack := wd.pc.PipelinePack(0)
+		if pack == nil {
+			return
+		}
+		pack.Message.SetType("heka.disk-alert")
+		pack.Message.SetLogger("hekad")
+		pack.Message.SetPayload(payload)
+		if over {
+			pack.Message.SetSeverity(2)
+		} else {
+			pack.Message.SetSeverity(5)
+		}
+		message.NewStringField(pack.Message, "Directory", dir)
+		message.NewInt64Field(pack.Message, "Usage", usage, "B")
+		message.NewInt64Field(pack.Message, "Budget", budget, "B")
+		message.NewStringField(pack.Message, "Action", wd.action)
+		field, _ := message.NewField("OverBudget", over, "")
+		pack.Message.AddField(field)
+		wd.pc.router.InChan() <- pack
+	}()
+}
@@ -0,0 +1,153 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func DiskWatchdogSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	globals := DefaultGlobals()
+	dirA := filepath.Join(tmpDir, "a")
+	dirB := filepath.Join(tmpDir, "b")
+	os.MkdirAll(dirA, 0700)
+	os.MkdirAll(dirB, 0700)
+
+	writeFile := func(dir, name string, size int) string {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, make([]byte, size), 0600)
+		c.Assume(err, gs.IsNil)
+		return path
+	}
+
+	type alert struct {
+		dir  string
+		over bool
+	}
+
+	c.Specify("A disk watchdog", func() {
+		writeFile(dirA, "1.log", 600)
+		writeFile(dirA, "2.log", 600)
+		writeFile(dirB, "1.log", 100)
+
+		var alerts []alert
+		newWatchdog := func() *DiskWatchdog {
+			wd := NewDiskWatchdog(nil, globals)
+			wd.alert = func(dir string, usage, budget int64, over bool) {
+				alerts = append(alerts, alert{dir, over})
+			}
+			return wd
+		}
+
+		c.Specify("blocks writers to a directory over budget", func() {
+			wd := newWatchdog()
+			a := wd.Register("a", dirA, 1000, nil)
+			b := wd.Register("b", dirB, 1000, nil)
+			wd.Check()
+			c.Expect(a.Blocked(), gs.IsTrue)
+			c.Expect(b.Blocked(), gs.IsFalse)
+			c.Assume(len(alerts), gs.Equals, 1)
+			c.Expect(alerts[0].dir, gs.Equals, dirA)
+			c.Expect(alerts[0].over, gs.IsTrue)
+
+			os.Remove(filepath.Join(dirA, "1.log"))
+			wd.Check()
+			c.Expect(a.Blocked(), gs.IsFalse)
+			c.Assume(len(alerts), gs.Equals, 2)
+			c.Expect(alerts[1].over, gs.IsFalse)
+			c.Expect(a.Wait(), gs.IsTrue)
+		})
+
+		c.Specify("enforces the total budget", func() {
+			globals.DiskBudgetTotal = 1200
+			wd := newWatchdog()
+			a := wd.Register("a", dirA, 0, nil)
+			b := wd.Register("b", dirB, 0, nil)
+			wd.Check()
+			c.Expect(a.Blocked(), gs.IsTrue)
+			c.Expect(b.Blocked(), gs.IsTrue)
+			c.Assume(len(alerts), gs.Equals, 1)
+			c.Expect(alerts[0].dir, gs.Equals, "")
+
+			b.Close()
+			os.RemoveAll(dirB)
+			wd.Check()
+			c.Expect(a.Blocked(), gs.IsFalse)
+			c.Expect(b.Blocked(), gs.IsFalse)
+			globals.DiskBudgetTotal = 0
+		})
+
+		c.Specify("drops the oldest data", func() {
+			globals.DiskFullAction = DISK_FULL_DROP_OLDEST
+			wd := newWatchdog()
+			var needed int64
+			a := wd.Register("a", dirA, 1000, func(need int64) int64 {
+				needed = need
+				if os.Remove(filepath.Join(dirA, "1.log")) != nil {
+					return 0
+				}
+				return 600
+			})
+			wd.Check()
+			c.Expect(needed, gs.Equals, int64(200))
+			c.Expect(a.Blocked(), gs.IsFalse)
+			c.Expect(len(alerts), gs.Equals, 0)
+
+			c.Specify("and blocks if that isn't enough", func() {
+				writeFile(dirA, "3.log", 600)
+				wd.Check()
+				c.Expect(a.Blocked(), gs.IsTrue)
+			})
+			globals.DiskFullAction = DISK_FULL_BLOCK
+		})
+
+		c.Specify("only alerts if so configured", func() {
+			globals.DiskFullAction = DISK_FULL_ALERT
+			wd := newWatchdog()
+			a := wd.Register("a", dirA, 1000, nil)
+			wd.Check()
+			c.Expect(a.Blocked(), gs.IsFalse)
+			c.Expect(len(alerts), gs.Equals, 1)
+			wd.Check()
+			c.Expect(len(alerts), gs.Equals, 1)
+			globals.DiskFullAction = DISK_FULL_BLOCK
+		})
+
+		c.Specify("stops waiting when Heka shuts down", func() {
+			wd := newWatchdog()
+			a := wd.Register("a", dirA, 1000, nil)
+			wd.Check()
+			result := make(chan bool)
+			go func() {
+				result <- a.Wait()
+			}()
+			wd.Stop()
+			select {
+			case ok := <-result:
+				c.Expect(ok, gs.IsFalse)
+			case <-time.After(time.Second):
+				c.Expect("timed out", gs.Equals, "")
+			}
+		})
+	})
+}
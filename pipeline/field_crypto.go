@@ -0,0 +1,229 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+)
+
+const (
+	// Random nonce AES-GCM, equal values encrypt differently.
+	FIELD_CRYPTO_ENCRYPT = "encrypt"
+	// Deterministic AES-GCM, equal values get equal tokens so they can still
+	// be counted and joined on.
+	FIELD_CRYPTO_TOKENIZE = "tokenize"
+	// Feistel cipher over the decimal digits, the value keeps its length,
+	// separators and trailing `preserve_last` digits, e.g. for card numbers.
+	FIELD_CRYPTO_FORMAT_PRESERVING = "format_preserving"
+)
+
+const fpeRounds = 10
+
+// Protects field values with a key, and reveals them again given the same
+// key.
+type FieldCrypter struct {
+	mode         string
+	aead         cipher.AEAD
+	block        cipher.Block
+	tokenKey     []byte
+	preserveLast int
+	// Identifies the key without giving it away.
+	KeyName string
+}
+
+// Derives a subkey for one use of the key, so e.g. the token nonces can't be
+// related to the ciphertexts.
+func deriveFieldKey(key []byte, label string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)[:len(key)]
+}
+
+// Returns the default name of a key: a prefix of its hash.
+func fieldKeyName(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+// Creates a crypter for the mode, using the AES key (16, 24, or 32 bytes).
+// The key name defaults to a fingerprint of the key.
+func NewFieldCrypter(mode string, key []byte, keyName string,
+	preserveLast int) (fc *FieldCrypter, err error) {
+
+	switch mode {
+	case FIELD_CRYPTO_ENCRYPT, FIELD_CRYPTO_TOKENIZE, FIELD_CRYPTO_FORMAT_PRESERVING:
+	default:
+		return nil, fmt.Errorf("unknown mode: %s", mode)
+	}
+	if preserveLast < 0 {
+		return nil, errors.New("preserve_last can't be negative")
+	}
+	if _, err = aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("invalid key: %s", err)
+	}
+	fc = &FieldCrypter{mode: mode, preserveLast: preserveLast, KeyName: keyName}
+	if fc.KeyName == "" {
+		fc.KeyName = fieldKeyName(key)
+	}
+	if mode == FIELD_CRYPTO_FORMAT_PRESERVING {
+		fc.block, err = aes.NewCipher(deriveFieldKey(key, "heka fpe"))
+		return
+	}
+	block, _ := aes.NewCipher(deriveFieldKey(key, "heka field cipher"))
+	if fc.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	fc.tokenKey = deriveFieldKey(key, "heka field token")
+	return
+}
+
+// Returns the protected form of the value.
+func (fc *FieldCrypter) Protect(value string) (string, error) {
+	if fc.mode == FIELD_CRYPTO_FORMAT_PRESERVING {
+		return fc.fpe(value, true)
+	}
+	nonce := make([]byte, fc.aead.NonceSize())
+	if fc.mode == FIELD_CRYPTO_TOKENIZE {
+		mac := hmac.New(sha256.New, fc.tokenKey)
+		mac.Write([]byte(value))
+		copy(nonce, mac.Sum(nil))
+	} else if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := fc.aead.Seal(nonce, nonce, []byte(value), nil)
+	return base64.URLEncoding.EncodeToString(sealed), nil
+}
+
+// Returns the original of a value returned by Protect, failing if it was
+// protected with a different key or mode.
+func (fc *FieldCrypter) Reveal(value string) (string, error) {
+	if fc.mode == FIELD_CRYPTO_FORMAT_PRESERVING {
+		return fc.fpe(value, false)
+	}
+	sealed, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		return "", fmt.Errorf("not a protected value: %s", err)
+	}
+	nonceSize := fc.aead.NonceSize()
+	if len(sealed) < nonceSize+fc.aead.Overhead() {
+		return "", errors.New("protected value too short")
+	}
+	plain, err := fc.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// Enciphers (or deciphers) the value's digits but the last `preserveLast`
+// ones, which tweak the cipher. Everything else is left in place.
+func (fc *FieldCrypter) fpe(value string, encipher bool) (string, error) {
+	out := []byte(value)
+	positions := make([]int, 0, len(out))
+	for i, c := range out {
+		if c >= '0' && c <= '9' {
+			positions = append(positions, i)
+		}
+	}
+	n := len(positions) - fc.preserveLast
+	if n < 2 {
+		return "", fmt.Errorf("value needs more than %d digits", fc.preserveLast+1)
+	}
+	digits := make([]byte, len(positions))
+	for i, pos := range positions {
+		digits[i] = out[pos]
+	}
+	result := fc.feistel(digits[:n], digits[n:], encipher)
+	for i, c := range result {
+		out[positions[i]] = c
+	}
+	return string(out), nil
+}
+
+var bigTen = big.NewInt(10)
+
+// Balanced Feistel network over decimal strings, along the lines of NIST's
+// FF1, with an AES based round function.
+func (fc *FieldCrypter) feistel(digits, tweak []byte, encipher bool) []byte {
+	n := len(digits)
+	u := n / 2
+	a := string(digits[:u])
+	b := string(digits[u:])
+	modulus := func(m int) *big.Int {
+		return new(big.Int).Exp(bigTen, big.NewInt(int64(m)), nil)
+	}
+	format := func(x *big.Int, m int) string {
+		s := x.String()
+		return strings.Repeat("0", m-len(s)) + s
+	}
+	parse := func(s string) *big.Int {
+		x, _ := new(big.Int).SetString(s, 10)
+		return x
+	}
+	if encipher {
+		for i := 0; i < fpeRounds; i++ {
+			m := n - u
+			if i%2 == 0 {
+				m = u
+			}
+			mod := modulus(m)
+			c := new(big.Int).Add(parse(a), fc.round(i, n, b, tweak))
+			c.Mod(c, mod)
+			a, b = b, format(c, m)
+		}
+	} else {
+		for i := fpeRounds - 1; i >= 0; i-- {
+			m := n - u
+			if i%2 == 0 {
+				m = u
+			}
+			mod := modulus(m)
+			c := new(big.Int).Sub(parse(b), fc.round(i, n, a, tweak))
+			c.Mod(c, mod)
+			a, b = format(c, m), a
+		}
+	}
+	return []byte(a + b)
+}
+
+// Round function: 256 bits of the AES encrypted hash of the round, the
+// length, the tweak and the half being mixed in.
+func (fc *FieldCrypter) round(i, n int, half string, tweak []byte) *big.Int {
+	h := sha256.New()
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(i))
+	binary.BigEndian.PutUint32(header[4:], uint32(n))
+	h.Write(header[:])
+	h.Write(tweak)
+	h.Write([]byte{0})
+	h.Write([]byte(half))
+	sum := h.Sum(nil)
+	out := make([]byte, len(sum))
+	fc.block.Encrypt(out[:16], sum[:16])
+	fc.block.Encrypt(out[16:], sum[16:])
+	return new(big.Int).SetBytes(out)
+}
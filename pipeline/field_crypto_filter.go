@@ -0,0 +1,217 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"strings"
+	"sync/atomic"
+)
+
+// Filter re-injecting the messages it matches with the values of the
+// selected fields encrypted or tokenized and their type prefixed, so outputs
+// can send them off the host without exposing the values. The name of the
+// key used is stored in a companion field next to each protected one, which
+// the filter checks when configured with `reveal = true` and the same key to
+// turn the messages back into the originals.
+type FieldCryptoFilter struct {
+	conf    *FieldCryptoFilterConfig
+	crypter *FieldCrypter
+	// Counters, accessed atomically.
+	processedCount int64
+	failedCount    int64
+}
+
+type FieldCryptoFilterConfig struct {
+	// Names of the fields to protect (or reveal).
+	Fields []string
+	// One of "encrypt" (default), "tokenize" or "format_preserving".
+	Mode string
+	// Reveals protected values instead of protecting them.
+	Reveal bool
+	// Where to get the key from, takes the same providers as the
+	// `spool_key_provider` hekad setting.
+	KeyProvider string `toml:"key_provider"`
+	KeyId       string `toml:"key_id"`
+	// Stored in the companion fields, defaults to a fingerprint of the key.
+	KeyName string `toml:"key_name"`
+	// Appended to a field's name to name its companion field.
+	KeyFieldSuffix string `toml:"key_field_suffix"`
+	// Digits left in clear at the end of the values in format_preserving
+	// mode.
+	PreserveLast uint `toml:"preserve_last"`
+	// Prepended to the type of the messages injected, or removed from it
+	// when revealing.
+	TypePrefix string `toml:"type_prefix"`
+}
+
+func (f *FieldCryptoFilter) ConfigStruct() interface{} {
+	return &FieldCryptoFilterConfig{
+		Mode:           FIELD_CRYPTO_ENCRYPT,
+		KeyProvider:    "hex",
+		KeyFieldSuffix: "_key",
+		TypePrefix:     "protected.",
+	}
+}
+
+func (f *FieldCryptoFilter) Init(config interface{}) (err error) {
+	f.conf = config.(*FieldCryptoFilterConfig)
+	if len(f.conf.Fields) == 0 {
+		return errors.New("no fields specified")
+	}
+	if f.conf.KeyFieldSuffix == "" {
+		return errors.New("key_field_suffix can't be empty")
+	}
+	var key []byte
+	if key, err = FetchSpoolKey(f.conf.KeyProvider, f.conf.KeyId); err != nil {
+		return fmt.Errorf("can't get key: %s", err)
+	}
+	f.crypter, err = NewFieldCrypter(f.conf.Mode, key, f.conf.KeyName,
+		int(f.conf.PreserveLast))
+	return
+}
+
+// Replaces the values of the named field by their protected (or revealed)
+// forms. Fields that aren't there or were already processed are left alone.
+func (f *FieldCryptoFilter) processField(msg *message.Message, name string) error {
+	keyFieldName := name + f.conf.KeyFieldSuffix
+	keyName, protected := msg.GetFieldValue(keyFieldName)
+	if protected == !f.conf.Reveal {
+		return nil
+	}
+	if f.conf.Reveal && keyName != f.crypter.KeyName {
+		return fmt.Errorf("field '%s' protected with unknown key '%v'", name,
+			keyName)
+	}
+	found := false
+	fields := msg.Fields[:0]
+	for _, field := range msg.Fields {
+		if field.GetName() == keyFieldName {
+			continue
+		}
+		if field.GetName() != name {
+			fields = append(fields, field)
+			continue
+		}
+		found = true
+		processed := message.NewFieldInit(name, message.Field_STRING,
+			field.GetRepresentation())
+		for _, value := range fieldStringValues(field) {
+			var (
+				result string
+				err    error
+			)
+			if f.conf.Reveal {
+				result, err = f.crypter.Reveal(value)
+			} else {
+				result, err = f.crypter.Protect(value)
+			}
+			if err != nil {
+				return fmt.Errorf("field '%s': %s", name, err)
+			}
+			processed.AddValue(result)
+		}
+		fields = append(fields, processed)
+	}
+	msg.Fields = fields
+	if found && !f.conf.Reveal {
+		message.NewStringField(msg, keyFieldName, f.crypter.KeyName)
+	}
+	return nil
+}
+
+// Returns the field's values as strings.
+func fieldStringValues(field *message.Field) (values []string) {
+	switch field.GetValueType() {
+	case message.Field_STRING:
+		return field.GetValueString()
+	case message.Field_BYTES:
+		for _, value := range field.GetValueBytes() {
+			values = append(values, string(value))
+		}
+	case message.Field_INTEGER:
+		for _, value := range field.GetValueInteger() {
+			values = append(values, fmt.Sprint(value))
+		}
+	case message.Field_DOUBLE:
+		for _, value := range field.GetValueDouble() {
+			values = append(values, fmt.Sprint(value))
+		}
+	case message.Field_BOOL:
+		for _, value := range field.GetValueBool() {
+			values = append(values, fmt.Sprint(value))
+		}
+	}
+	return
+}
+
+// Returns a copy of the message with the configured fields processed and its
+// type changed.
+func (f *FieldCryptoFilter) process(pack *PipelinePack, h PluginHelper) (
+	*PipelinePack, error) {
+
+	newPack := h.PipelinePack(pack.MsgLoopCount)
+	if newPack == nil {
+		return nil, fmt.Errorf("exceeded MaxMsgLoops = %d", Globals().MaxMsgLoops)
+	}
+	pack.Message.Copy(newPack.Message)
+	newPack.Tenant = pack.Tenant
+	msg := newPack.Message
+	for _, name := range f.conf.Fields {
+		if err := f.processField(msg, name); err != nil {
+			newPack.Recycle()
+			return nil, err
+		}
+	}
+	if f.conf.Reveal {
+		msg.SetType(strings.TrimPrefix(msg.GetType(), f.conf.TypePrefix))
+	} else {
+		msg.SetType(f.conf.TypePrefix + msg.GetType())
+	}
+	return newPack, nil
+}
+
+func (f *FieldCryptoFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	for pack := range fr.InChan() {
+		newPack, err := f.process(pack, h)
+		pack.Recycle()
+		if err != nil {
+			// Drop the message rather than let the values out in clear.
+			atomic.AddInt64(&f.failedCount, 1)
+			fr.LogError(err)
+			continue
+		}
+		atomic.AddInt64(&f.processedCount, 1)
+		fr.Inject(newPack)
+	}
+	return
+}
+
+func (f *FieldCryptoFilter) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessedCount",
+		atomic.LoadInt64(&f.processedCount), "count")
+	message.NewInt64Field(msg, "FailedCount",
+		atomic.LoadInt64(&f.failedCount), "count")
+	message.NewStringField(msg, "KeyName", f.crypter.KeyName)
+	return nil
+}
+
+func init() {
+	RegisterPlugin("FieldCryptoFilter", func() interface{} {
+		return new(FieldCryptoFilter)
+	})
+}
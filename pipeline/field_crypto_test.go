@@ -0,0 +1,159 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+func FieldCryptoSpec(c gs.Context) {
+	key := []byte("0123456789abcdef")
+	hexKey := "30313233343536373839616263646566"
+
+	c.Specify("A FieldCrypter", func() {
+		c.Specify("encrypts values differently every time", func() {
+			fc, err := NewFieldCrypter(FIELD_CRYPTO_ENCRYPT, key, "", 0)
+			c.Assume(err, gs.IsNil)
+			first, err := fc.Protect("secret")
+			c.Expect(err, gs.IsNil)
+			second, _ := fc.Protect("secret")
+			c.Expect(first, gs.Not(gs.Equals), second)
+			c.Expect(strings.Contains(first, "secret"), gs.IsFalse)
+			plain, err := fc.Reveal(first)
+			c.Expect(err, gs.IsNil)
+			c.Expect(plain, gs.Equals, "secret")
+		})
+
+		c.Specify("tokenizes values deterministically", func() {
+			fc, err := NewFieldCrypter(FIELD_CRYPTO_TOKENIZE, key, "", 0)
+			c.Assume(err, gs.IsNil)
+			first, _ := fc.Protect("user@example.com")
+			second, _ := fc.Protect("user@example.com")
+			other, _ := fc.Protect("other@example.com")
+			c.Expect(first, gs.Equals, second)
+			c.Expect(first, gs.Not(gs.Equals), other)
+			plain, err := fc.Reveal(first)
+			c.Expect(err, gs.IsNil)
+			c.Expect(plain, gs.Equals, "user@example.com")
+		})
+
+		c.Specify("preserves the format of card numbers", func() {
+			fc, err := NewFieldCrypter(FIELD_CRYPTO_FORMAT_PRESERVING, key, "", 4)
+			c.Assume(err, gs.IsNil)
+			card := "4111-1111-1111-1234"
+			protected, err := fc.Protect(card)
+			c.Expect(err, gs.IsNil)
+			c.Expect(protected, gs.Not(gs.Equals), card)
+			c.Expect(len(protected), gs.Equals, len(card))
+			c.Expect(strings.Count(protected, "-"), gs.Equals, 3)
+			c.Expect(strings.HasSuffix(protected, "-1234"), gs.IsTrue)
+			again, _ := fc.Protect(card)
+			c.Expect(again, gs.Equals, protected)
+			plain, err := fc.Reveal(protected)
+			c.Expect(err, gs.IsNil)
+			c.Expect(plain, gs.Equals, card)
+
+			_, err = fc.Protect("12345")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("fails to reveal with another key", func() {
+			fc, _ := NewFieldCrypter(FIELD_CRYPTO_ENCRYPT, key, "", 0)
+			other, _ := NewFieldCrypter(FIELD_CRYPTO_ENCRYPT,
+				[]byte("fedcba9876543210"), "", 0)
+			c.Expect(fc.KeyName, gs.Not(gs.Equals), other.KeyName)
+			protected, _ := fc.Protect("secret")
+			_, err := other.Reveal(protected)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects unknown modes", func() {
+			_, err := NewFieldCrypter("rot13", key, "", 0)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A FieldCryptoFilter", func() {
+		pConfig := NewPipelineConfig(nil)
+		for i := 0; i < 3; i++ {
+			pConfig.injectRecycleChan <- NewPipelinePack(pConfig.injectRecycleChan)
+		}
+		newFilter := func(reveal bool) *FieldCryptoFilter {
+			filter := new(FieldCryptoFilter)
+			config := filter.ConfigStruct().(*FieldCryptoFilterConfig)
+			config.Fields = []string{"card", "email"}
+			config.Mode = FIELD_CRYPTO_TOKENIZE
+			config.KeyId = hexKey
+			config.KeyName = "payments-1"
+			config.Reveal = reveal
+			c.Assume(filter.Init(config), gs.IsNil)
+			return filter
+		}
+
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+		pack.Message.SetType("payment")
+		message.NewStringField(pack.Message, "card", "4111111111111111")
+		message.NewStringField(pack.Message, "email", "user@example.com")
+		message.NewInt64Field(pack.Message, "amount", 42, "")
+
+		c.Specify("protects the fields and records the key name", func() {
+			protected, err := newFilter(false).process(pack, pConfig)
+			c.Assume(err, gs.IsNil)
+			msg := protected.Message
+			c.Expect(msg.GetType(), gs.Equals, "protected.payment")
+			protectedCard, _ := msg.GetFieldValue("card")
+			c.Expect(protectedCard, gs.Not(gs.Equals), "4111111111111111")
+			keyName, _ := msg.GetFieldValue("card_key")
+			c.Expect(keyName, gs.Equals, "payments-1")
+			keyName, _ = msg.GetFieldValue("email_key")
+			c.Expect(keyName, gs.Equals, "payments-1")
+			amount, _ := msg.GetFieldValue("amount")
+			c.Expect(amount, gs.Equals, int64(42))
+			// The original is left alone.
+			card, _ := pack.Message.GetFieldValue("card")
+			c.Expect(card, gs.Equals, "4111111111111111")
+
+			c.Specify("which are revealed by a filter with the same key", func() {
+				revealed, err := newFilter(true).process(protected, pConfig)
+				c.Assume(err, gs.IsNil)
+				msg := revealed.Message
+				c.Expect(msg.GetType(), gs.Equals, "payment")
+				card, _ := msg.GetFieldValue("card")
+				c.Expect(card, gs.Equals, "4111111111111111")
+				email, _ := msg.GetFieldValue("email")
+				c.Expect(email, gs.Equals, "user@example.com")
+				_, ok := msg.GetFieldValue("card_key")
+				c.Expect(ok, gs.IsFalse)
+			})
+
+			c.Specify("which aren't protected twice", func() {
+				again, err := newFilter(false).process(protected, pConfig)
+				c.Assume(err, gs.IsNil)
+				twice, _ := again.Message.GetFieldValue("card")
+				c.Expect(twice, gs.Equals, protectedCard)
+				c.Expect(len(again.Message.FindAllFields("card_key")), gs.Equals, 1)
+			})
+		})
+
+		c.Specify("won't reveal fields protected with another key", func() {
+			message.NewStringField(pack.Message, "card_key", "payments-0")
+			_, err := newFilter(true).process(pack, pConfig)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
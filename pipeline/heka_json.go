@@ -0,0 +1,77 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+)
+
+// Encoder serializing the whole message to its canonical JSON
+// representation (see message.MarshalMessageJSON), which HekaJsonDecoder
+// turns back into the same message.
+type HekaJsonEncoder struct {
+	conf *HekaJsonEncoderConfig
+}
+
+type HekaJsonEncoderConfig struct {
+	// Ends each message with a newline, for line delimited streams.
+	AppendNewlines bool `toml:"append_newlines"`
+}
+
+func (e *HekaJsonEncoder) ConfigStruct() interface{} {
+	return &HekaJsonEncoderConfig{AppendNewlines: true}
+}
+
+func (e *HekaJsonEncoder) Init(config interface{}) error {
+	e.conf = config.(*HekaJsonEncoderConfig)
+	return nil
+}
+
+func (e *HekaJsonEncoder) Encode(pack *PipelinePack) (output []byte, err error) {
+	if output, err = message.MarshalMessageJSON(pack.Message); err != nil {
+		return nil, err
+	}
+	if e.conf.AppendNewlines {
+		output = append(output, '\n')
+	}
+	return
+}
+
+// Decoder replacing the message with the one held by the canonical JSON in
+// its payload, as produced by HekaJsonEncoder.
+type HekaJsonDecoder struct{}
+
+func (d *HekaJsonDecoder) Init(config interface{}) error {
+	return nil
+}
+
+func (d *HekaJsonDecoder) Decode(pack *PipelinePack) (
+	packs []*PipelinePack, err error) {
+
+	if err = message.UnmarshalMessageJSON([]byte(pack.Message.GetPayload()),
+		pack.Message); err == nil {
+		packs = []*PipelinePack{pack}
+	}
+	return
+}
+
+func init() {
+	RegisterPlugin("HekaJsonEncoder", func() interface{} {
+		return new(HekaJsonEncoder)
+	})
+	RegisterPlugin("HekaJsonDecoder", func() interface{} {
+		return new(HekaJsonDecoder)
+	})
+}
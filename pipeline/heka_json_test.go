@@ -0,0 +1,59 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+func HekaJsonSpec(c gs.Context) {
+	supply := make(chan *PipelinePack, 2)
+	original := NewPipelinePack(supply)
+	original.Message.SetUuid(uuid.NewRandom())
+	original.Message.SetTimestamp(1400000000000000000)
+	original.Message.SetLogger("heka-json")
+	original.Message.SetPayload("line one\nline two")
+	message.NewStringField(original.Message, "user", "heka")
+	message.NewInt64Field(original.Message, "size", 42, "B")
+
+	encoder := new(HekaJsonEncoder)
+	err := encoder.Init(encoder.ConfigStruct())
+	c.Assume(err, gs.IsNil)
+
+	c.Specify("The HekaJsonEncoder output is decoded by the HekaJsonDecoder", func() {
+		output, err := encoder.Encode(original)
+		c.Assume(err, gs.IsNil)
+		c.Expect(strings.Count(string(output), "\n"), gs.Equals, 1)
+		c.Expect(output[len(output)-1], gs.Equals, byte('\n'))
+
+		pack := NewPipelinePack(supply)
+		pack.Message.SetPayload(string(output))
+		packs, err := new(HekaJsonDecoder).Decode(pack)
+		c.Expect(err, gs.IsNil)
+		c.Assume(len(packs), gs.Equals, 1)
+		c.Expect(packs[0].Message.Equals(original.Message), gs.IsTrue)
+	})
+
+	c.Specify("The HekaJsonDecoder fails on other payloads", func() {
+		pack := NewPipelinePack(supply)
+		pack.Message.SetPayload(`{"payload": "no uuid"}`)
+		packs, err := new(HekaJsonDecoder).Decode(pack)
+		c.Expect(err, gs.Not(gs.IsNil))
+		c.Expect(packs, gs.IsNil)
+	})
+}
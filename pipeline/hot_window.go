@@ -0,0 +1,82 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+	"time"
+)
+
+// Keeps backfilled messages away from a realtime filter or output (e.g.
+// dashboards or alerting): the matched messages whose timestamp is older than
+// the `hot_window` are diverted to the `cold_output` (e.g. an archive), or
+// dropped if there's none or it can't keep up.
+type hotWindow struct {
+	window time.Duration
+	// Name of the output taking the cold messages, if any.
+	coldName string
+	pc       *PipelineConfig
+	// Number of messages diverted (or dropped).
+	cold int64
+	// Number of the diverted messages that were dropped.
+	dropped int64
+	// Replaced in tests.
+	now func() time.Time
+}
+
+func newHotWindow(window time.Duration, coldName string,
+	pc *PipelineConfig) *hotWindow {
+
+	return &hotWindow{window: window, coldName: coldName, pc: pc, now: time.Now}
+}
+
+// Returns true if the message is older than the window.
+func (h *hotWindow) isCold(msg *message.Message) bool {
+	if msg.Timestamp == nil {
+		return false
+	}
+	return h.now().UnixNano()-msg.GetTimestamp() > h.window.Nanoseconds()
+}
+
+// Hands the pack to the cold output, through its queue buffer if it's
+// buffered. Never waits on the cold output, which would back up the router,
+// the pack is dropped if the cold output's channel is full or there's no cold
+// output running.
+func (h *hotWindow) divert(pack *PipelinePack) {
+	atomic.AddInt64(&h.cold, 1)
+	// Looked up every time, the cold output may be started after the hot
+	// plugin, or be replaced by a reload or restart.
+	if h.coldName != "" {
+		if output, ok := h.pc.Output(h.coldName); ok {
+			if cold, ok := output.(*foRunner); ok && cold.matcher != nil &&
+				cold.matcher.offer(pack) {
+				return
+			}
+		}
+	}
+	atomic.AddInt64(&h.dropped, 1)
+	pack.Recycle()
+}
+
+// Returns the number of messages diverted (or dropped) so far.
+func (h *hotWindow) ColdCount() int64 {
+	return atomic.LoadInt64(&h.cold)
+}
+
+// Returns the number of diverted messages that were dropped so far.
+func (h *hotWindow) DroppedCount() int64 {
+	return atomic.LoadInt64(&h.dropped)
+}
@@ -0,0 +1,122 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func HotWindowSpec(c gs.Context) {
+	pc := NewPipelineConfig(nil)
+	archive := NewFORunner("archive", nil, new(PluginGlobals))
+	var err error
+	archive.matcher, err = NewMatchRunner("TRUE", "", archive)
+	c.Assume(err, gs.IsNil)
+	archive.matcher.Start(archive.inChan)
+	defer close(archive.matcher.inChan)
+	pc.OutputRunners["archive"] = archive
+	now := time.Now()
+	recycleChan := make(chan *PipelinePack, 2)
+	newPack := func(age time.Duration) *PipelinePack {
+		pack := NewPipelinePack(recycleChan)
+		pack.Message.SetType("nginx.access")
+		pack.Message.SetTimestamp(now.Add(-age).UnixNano())
+		return pack
+	}
+
+	c.Specify("A hot window", func() {
+		hot := newHotWindow(15*time.Minute, "archive", pc)
+		hot.now = func() time.Time { return now }
+
+		c.Specify("tells cold messages apart", func() {
+			c.Expect(hot.isCold(newPack(time.Minute).Message), gs.IsFalse)
+			c.Expect(hot.isCold(newPack(-time.Hour).Message), gs.IsFalse)
+			c.Expect(hot.isCold(newPack(time.Hour).Message), gs.IsTrue)
+		})
+
+		c.Specify("diverts cold messages to the cold output", func() {
+			pack := newPack(time.Hour)
+			hot.divert(pack)
+			c.Expect(<-archive.inChan, gs.Equals, pack)
+			c.Expect(hot.ColdCount(), gs.Equals, int64(1))
+		})
+
+		c.Specify("drops them without a cold output", func() {
+			hot.coldName = ""
+			hot.divert(newPack(time.Hour))
+			c.Expect(len(recycleChan), gs.Equals, 1)
+			c.Expect(hot.ColdCount(), gs.Equals, int64(1))
+			c.Expect(hot.DroppedCount(), gs.Equals, int64(1))
+		})
+
+		c.Specify("drops them instead of waiting on a full cold output", func() {
+			for len(archive.inChan) < cap(archive.inChan) {
+				archive.inChan <- NewPipelinePack(nil)
+			}
+			hot.divert(newPack(time.Hour))
+			c.Expect(len(recycleChan), gs.Equals, 1)
+			c.Expect(hot.DroppedCount(), gs.Equals, int64(1))
+			for len(archive.inChan) > 0 {
+				<-archive.inChan
+			}
+		})
+
+		c.Specify("uses the cold output's replacement", func() {
+			replacement := NewFORunner("archive", nil, new(PluginGlobals))
+			replacement.matcher, err = NewMatchRunner("TRUE", "", replacement)
+			c.Assume(err, gs.IsNil)
+			replacement.matcher.Start(replacement.inChan)
+			defer close(replacement.matcher.inChan)
+			pc.OutputRunners["archive"] = replacement
+			defer func() {
+				pc.OutputRunners["archive"] = archive
+			}()
+			pack := newPack(time.Hour)
+			hot.divert(pack)
+			c.Expect(<-replacement.inChan, gs.Equals, pack)
+		})
+	})
+
+	c.Specify("A MatchRunner with a hot window", func() {
+		runner := NewFORunner("dashboard", nil, new(PluginGlobals))
+		matcher, err := NewMatchRunner("Type == 'nginx.access'", "", runner)
+		c.Assume(err, gs.IsNil)
+		matcher.hot = newHotWindow(15*time.Minute, "archive", pc)
+		matchChan := make(chan *PipelinePack, 2)
+		matcher.Start(matchChan)
+
+		old := newPack(time.Hour)
+		recent := newPack(time.Minute)
+		matcher.inChan <- old
+		matcher.inChan <- recent
+		close(matcher.inChan)
+		c.Expect(<-matchChan, gs.Equals, recent)
+		c.Expect(<-archive.inChan, gs.Equals, old)
+		_, ok := <-matchChan
+		c.Expect(ok, gs.IsFalse)
+	})
+
+	c.Specify("The config", func() {
+		c.Specify("rejects an unknown cold_output", func() {
+			runner := NewFORunner("dashboard", nil,
+				&PluginGlobals{ColdOutput: "missing"})
+			pc.OutputRunners["dashboard"] = runner
+			c.Expect(pc.checkColdOutputs(), gs.Not(gs.IsNil))
+			delete(pc.OutputRunners, "dashboard")
+			c.Expect(pc.checkColdOutputs(), gs.IsNil)
+		})
+	})
+}
@@ -0,0 +1,97 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Default bound of the idempotency keys an aggregation remembers per window.
+const DEFAULT_MAX_IDEMPOTENCY_KEYS = 100000
+
+// Returns the idempotency key of the message, the value of the named field,
+// or an empty string if the field is unset (or not there).
+func IdempotencyKey(msg *message.Message, field string) string {
+	if field == "" {
+		return ""
+	}
+	value, ok := msg.GetFieldValue(field)
+	if !ok || value == nil {
+		return ""
+	}
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return fmt.Sprint(value)
+}
+
+// Keys seen during the current aggregation window, so retried or duplicated
+// deliveries are only counted once. Holds `max` keys at most, forgetting the
+// oldest ones first. A nil set remembers nothing.
+type idempotencySet struct {
+	seen map[string]struct{}
+	// Ring buffer of the keys in the order they were added.
+	order []string
+	next  int
+	max   int
+}
+
+func newIdempotencySet(max int) *idempotencySet {
+	if max <= 0 {
+		max = DEFAULT_MAX_IDEMPOTENCY_KEYS
+	}
+	return &idempotencySet{seen: make(map[string]struct{}), max: max}
+}
+
+// Records the key, returning false if it was already seen in this window.
+// Empty keys are never considered duplicates.
+func (s *idempotencySet) add(key string) bool {
+	if s == nil || key == "" {
+		return true
+	}
+	if _, ok := s.seen[key]; ok {
+		return false
+	}
+	if len(s.order) < s.max {
+		s.order = append(s.order, key)
+	} else {
+		delete(s.seen, s.order[s.next])
+		s.order[s.next] = key
+		s.next = (s.next + 1) % s.max
+	}
+	s.seen[key] = struct{}{}
+	return true
+}
+
+// Starts a new window.
+func (s *idempotencySet) reset() {
+	if s == nil {
+		return
+	}
+	s.seen = make(map[string]struct{})
+	s.order = s.order[:0]
+	s.next = 0
+}
+
+func (s *idempotencySet) len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.seen)
+}
@@ -0,0 +1,123 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func IdempotencySpec(c gs.Context) {
+	NewPipelineConfig(nil)
+
+	c.Specify("An idempotencySet", func() {
+		set := newIdempotencySet(2)
+
+		c.Specify("tells duplicates apart", func() {
+			c.Expect(set.add("a"), gs.IsTrue)
+			c.Expect(set.add("a"), gs.IsFalse)
+			c.Expect(set.add(""), gs.IsTrue)
+			c.Expect(set.add(""), gs.IsTrue)
+			c.Expect(set.len(), gs.Equals, 1)
+		})
+
+		c.Specify("forgets the oldest keys beyond its bound", func() {
+			set.add("a")
+			set.add("b")
+			set.add("c")
+			c.Expect(set.len(), gs.Equals, 2)
+			c.Expect(set.add("b"), gs.IsFalse)
+			c.Expect(set.add("a"), gs.IsTrue)
+		})
+
+		c.Specify("forgets everything on reset", func() {
+			set.add("a")
+			set.reset()
+			c.Expect(set.len(), gs.Equals, 0)
+			c.Expect(set.add("a"), gs.IsTrue)
+		})
+	})
+
+	c.Specify("IdempotencyKey returns the field's value", func() {
+		msg := new(message.Message)
+		message.NewStringField(msg, "request_id", "abc")
+		message.NewInt64Field(msg, "seq", 42, "")
+		c.Expect(IdempotencyKey(msg, "request_id"), gs.Equals, "abc")
+		c.Expect(IdempotencyKey(msg, "seq"), gs.Equals, "42")
+		c.Expect(IdempotencyKey(msg, "missing"), gs.Equals, "")
+		c.Expect(IdempotencyKey(msg, ""), gs.Equals, "")
+	})
+
+	c.Specify("A StatAccumInput counts stats with the same key once", func() {
+		input := new(StatAccumInput)
+		config := input.ConfigStruct().(*StatAccumInputConfig)
+		config.EmitInFields = true
+		c.Assume(input.Init(config), gs.IsNil)
+
+		t := new(ts.SimpleT)
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		ith := new(InputTestHelper)
+		ith.MockHelper = NewMockPluginHelper(ctrl)
+		ith.MockInputRunner = NewMockInputRunner(ctrl)
+		ith.Pack = NewPipelinePack(make(chan *PipelinePack, 1))
+		tickChan := make(chan time.Time)
+		inChan := make(chan *PipelinePack, 1)
+		inChan <- ith.Pack
+		ith.MockHelper.EXPECT().PipelineConfig().Return(NewPipelineConfig(nil))
+		ith.MockInputRunner.EXPECT().Ticker().Return((<-chan time.Time)(tickChan))
+		ith.MockInputRunner.EXPECT().InChan().Return(inChan)
+		injected := make(chan *PipelinePack, 1)
+		ith.MockInputRunner.EXPECT().Inject(ith.Pack).Do(func(pack *PipelinePack) {
+			injected <- pack
+		})
+
+		go input.Run(ith.MockInputRunner, ith.MockHelper)
+		stat := Stat{Bucket: "hits", Value: "1", Modifier: "", Sampling: 1.0}
+		input.DropStatOnce(stat, "abc")
+		input.DropStatOnce(stat, "abc")
+		input.DropStatOnce(stat, "def")
+		input.DropStatOnce(stat, "")
+		other := stat
+		other.Bucket = "bytes"
+		input.DropStatOnce(other, "abc")
+		input.Stop()
+
+		msg := (<-injected).Message
+		hits, _ := msg.GetFieldValue("hits.count")
+		c.Expect(hits, gs.Equals, int64(3))
+		bytes, _ := msg.GetFieldValue("bytes.count")
+		c.Expect(bytes, gs.Equals, int64(1))
+		duplicates, _ := msg.GetFieldValue("statsd.numDuplicates")
+		c.Expect(duplicates, gs.Equals, int64(1))
+	})
+
+	c.Specify("A CounterFilter counts messages with the same key once", func() {
+		filter := new(CounterFilter)
+		config := filter.ConfigStruct().(*CounterFilterConfig)
+		config.IdempotencyKeyField = "request_id"
+		c.Assume(filter.Init(config), gs.IsNil)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+		message.NewStringField(pack.Message, "request_id", "abc")
+		filter.countMessage(pack)
+		filter.countMessage(pack)
+		c.Expect(filter.count, gs.Equals, uint(1))
+		c.Expect(filter.duplicates, gs.Equals, uint(1))
+	})
+}
@@ -0,0 +1,147 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Where the "instance_id" identity provider fetches the instance id from if
+// `identity_source` isn't set, the EC2 metadata service.
+const DEFAULT_INSTANCE_ID_URL = "http://169.254.169.254/latest/meta-data/instance-id"
+
+// Returns the identity stamped as the Hostname of the messages hekad
+// generates. The source is the `identity_source` hekad setting, what it means
+// is up to the provider.
+type IdentityProvider func(source string) (identity string, err error)
+
+var (
+	identityProviders     = make(map[string]IdentityProvider)
+	identityProvidersLock sync.Mutex
+)
+
+// Makes an identity provider available to the `identity_provider` hekad
+// setting. Must be called before the config is loaded, typically from an
+// `init` function.
+func RegisterIdentityProvider(name string, provider IdentityProvider) {
+	identityProvidersLock.Lock()
+	identityProviders[name] = provider
+	identityProvidersLock.Unlock()
+}
+
+// Returns the fully qualified domain name of the host, as resolved from its
+// hostname.
+func lookupFqdn(hostname string) (fqdn string, err error) {
+	if fqdn, err = net.LookupCNAME(hostname); err != nil {
+		return
+	}
+	return strings.TrimSuffix(fqdn, "."), nil
+}
+
+// Fetches the instance id from the cloud metadata service at url.
+func fetchInstanceId(url string) (id string, err error) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if id = strings.TrimSpace(string(body)); id == "" {
+		return "", fmt.Errorf("%s returned an empty instance id", url)
+	}
+	return
+}
+
+func init() {
+	// The operating system's hostname, the source is ignored.
+	RegisterIdentityProvider("os", func(source string) (string, error) {
+		return os.Hostname()
+	})
+	// The fully qualified domain name of the source, of the hostname if empty.
+	RegisterIdentityProvider("fqdn", func(source string) (string, error) {
+		if source == "" {
+			var err error
+			if source, err = os.Hostname(); err != nil {
+				return "", err
+			}
+		}
+		return lookupFqdn(source)
+	})
+	// The id of the cloud instance, fetched from the metadata service url in
+	// the source, DEFAULT_INSTANCE_ID_URL if empty.
+	RegisterIdentityProvider("instance_id", func(source string) (string, error) {
+		if source == "" {
+			source = DEFAULT_INSTANCE_ID_URL
+		}
+		return fetchInstanceId(source)
+	})
+	// The source itself.
+	RegisterIdentityProvider("static", func(source string) (string, error) {
+		if source == "" {
+			return "", fmt.Errorf("identity_source must be set")
+		}
+		return source, nil
+	})
+	// The value of the environment variable named by the source.
+	RegisterIdentityProvider("env", func(source string) (string, error) {
+		value := os.Getenv(source)
+		if value == "" {
+			return "", fmt.Errorf("environment variable %s is not set", source)
+		}
+		return value, nil
+	})
+}
+
+// Resolves the identity using the named provider.
+func ResolveIdentity(provider, source string) (identity string, err error) {
+	identityProvidersLock.Lock()
+	getIdentity, ok := identityProviders[provider]
+	identityProvidersLock.Unlock()
+	if !ok {
+		return "", fmt.Errorf("unknown identity provider: %s", provider)
+	}
+	if identity, err = getIdentity(source); err == nil && identity == "" {
+		err = fmt.Errorf("identity provider %s returned an empty identity", provider)
+	}
+	return
+}
+
+// Sets the Hostname of a message generated by hekad and, if the
+// `identity_field` hekad setting is set, adds the identity in that field.
+// Inputs letting their config override the hostname pass it in, the others
+// pass Globals().Hostname.
+func StampIdentity(msg *message.Message, hostname string) {
+	msg.SetHostname(hostname)
+	globals := Globals()
+	if globals.IdentityField == "" || msg.FindFirstField(globals.IdentityField) != nil {
+		return
+	}
+	message.NewStringField(msg, globals.IdentityField, globals.Hostname)
+}
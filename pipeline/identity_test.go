@@ -0,0 +1,90 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"os"
+)
+
+func IdentitySpec(c gs.Context) {
+	c.Specify("ResolveIdentity", func() {
+		c.Specify("defaults to the OS hostname", func() {
+			hostname, _ := os.Hostname()
+			identity, err := ResolveIdentity("os", "")
+			c.Expect(err, gs.IsNil)
+			c.Expect(identity, gs.Equals, hostname)
+			c.Expect(DefaultGlobals().Hostname, gs.Equals, hostname)
+		})
+
+		c.Specify("uses a static identity", func() {
+			identity, err := ResolveIdentity("static", "web-01")
+			c.Expect(err, gs.IsNil)
+			c.Expect(identity, gs.Equals, "web-01")
+
+			_, err = ResolveIdentity("static", "")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("fetches the instance id", func() {
+			status := http.StatusOK
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(status)
+					fmt.Fprint(w, "i-0123456789\n")
+				}))
+			defer server.Close()
+
+			identity, err := ResolveIdentity("instance_id", server.URL)
+			c.Expect(err, gs.IsNil)
+			c.Expect(identity, gs.Equals, "i-0123456789")
+
+			status = http.StatusNotFound
+			_, err = ResolveIdentity("instance_id", server.URL)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("fails for an unknown provider", func() {
+			_, err := ResolveIdentity("nonesuch", "")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A PipelineConfig stamps the identity", func() {
+		globals := DefaultGlobals()
+		globals.Hostname = "web-01"
+		globals.IdentityField = "Identity"
+		pConfig := NewPipelineConfig(globals)
+		pConfig.injectRecycleChan <- NewPipelinePack(pConfig.injectRecycleChan)
+
+		pack := pConfig.PipelinePack(0)
+		c.Expect(pack.Message.GetHostname(), gs.Equals, "web-01")
+		identity, ok := pack.Message.GetFieldValue("Identity")
+		c.Expect(ok, gs.IsTrue)
+		c.Expect(identity, gs.Equals, "web-01")
+
+		c.Specify("keeping the identity of overridden hostnames", func() {
+			msg := new(message.Message)
+			StampIdentity(msg, "other")
+			c.Expect(msg.GetHostname(), gs.Equals, "other")
+			identity, _ := msg.GetFieldValue("Identity")
+			c.Expect(identity, gs.Equals, "web-01")
+		})
+	})
+}
@@ -0,0 +1,359 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"code.google.com/p/goprotobuf/proto"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+)
+
+// Journal frame types. A record frame holds a received record, a commit
+// frame (without data) marks the record with the same sequence number as
+// delivered.
+const (
+	journalRecord byte = 'R'
+	journalCommit byte = 'C'
+)
+
+// Record flags, stored in the byte in front of the record data.
+const (
+	// The data is the encoded message the decoder expects in MsgBytes.
+	journalRaw byte = 1 << iota
+	// The message had no Timestamp yet, a zero one was journaled in its
+	// place so it could be encoded.
+	journalNoTimestamp
+)
+
+// Frame header: type, sequence number and data length.
+const journalHeaderSize = 1 + 8 + 4
+
+// Size above which the journal file is truncated as soon as no record is
+// pending.
+const journalTrimSize = 1 << 16
+
+// A record read back from the journal.
+type journalEntry struct {
+	// Name of the decoder the record was handed to, empty if it was
+	// injected.
+	decoder string
+	signer  string
+	// Whether data is the encoded message the decoder expects in MsgBytes,
+	// rather than the message itself.
+	raw bool
+	// Whether the journaled message's Timestamp is a placeholder.
+	noTimestamp bool
+	data        []byte
+}
+
+// Write-ahead journal of the records an input has accepted but that haven't
+// reached the router yet, so they aren't lost if hekad crashes. Records are
+// appended as the input receives them and committed when their pack reaches
+// the router or is recycled (e.g. dropped by the decoder).
+type inputJournal struct {
+	file    *os.File
+	lock    sync.Mutex
+	seq     uint64
+	pending map[uint64]bool
+	size    int64
+	// Number of records journaled, for the reports.
+	journaled int64
+}
+
+// Opens the journal at path, returning the records a previous run left
+// pending in the order they were received. The file is emptied, pending
+// records should be journaled again as they're replayed.
+func openInputJournal(path string) (j *inputJournal, entries []journalEntry,
+	err error) {
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	if entries, err = readInputJournal(path); err != nil {
+		return nil, nil, fmt.Errorf("can't read journal %s: %s", path, err)
+	}
+	j = &inputJournal{pending: make(map[uint64]bool)}
+	if j.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+// Reads the records of the journal that weren't committed. A partially
+// written frame at the end, left by a crash, is ignored.
+func readInputJournal(path string) (entries []journalEntry, err error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	records := make(map[uint64]journalEntry)
+	order := make([]uint64, 0)
+	header := make([]byte, journalHeaderSize)
+	for {
+		if _, err = io.ReadFull(reader, header); err != nil {
+			break
+		}
+		seq := binary.BigEndian.Uint64(header[1:])
+		data := make([]byte, binary.BigEndian.Uint32(header[9:]))
+		if _, err = io.ReadFull(reader, data); err != nil {
+			break
+		}
+		switch header[0] {
+		case journalRecord:
+			var entry journalEntry
+			if entry, err = decodeJournalEntry(data); err != nil {
+				return
+			}
+			records[seq] = entry
+			order = append(order, seq)
+		case journalCommit:
+			delete(records, seq)
+		default:
+			return nil, fmt.Errorf("unknown frame type %q", header[0])
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	for _, seq := range order {
+		if entry, ok := records[seq]; ok {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+func encodeJournalEntry(entry journalEntry) (data []byte, err error) {
+	data = make([]byte, 0, 5+len(entry.decoder)+len(entry.signer)+len(entry.data))
+	data = append(data, byte(len(entry.decoder)>>8), byte(len(entry.decoder)))
+	data = append(data, entry.decoder...)
+	data = append(data, byte(len(entry.signer)>>8), byte(len(entry.signer)))
+	data = append(data, entry.signer...)
+	var flags byte
+	if entry.raw {
+		flags |= journalRaw
+	}
+	if entry.noTimestamp {
+		flags |= journalNoTimestamp
+	}
+	data = append(data, flags)
+	data = append(data, entry.data...)
+	if cipher := Globals().SpoolCipher; cipher != nil {
+		data, err = cipher.Seal(data)
+	}
+	return
+}
+
+func decodeJournalEntry(data []byte) (entry journalEntry, err error) {
+	if cipher := Globals().SpoolCipher; cipher != nil {
+		if data, err = cipher.Open(data); err != nil {
+			return
+		}
+	}
+	errCorrupt := errors.New("corrupt journal record")
+	readString := func() (s string, ok bool) {
+		if len(data) < 2 {
+			return
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+n {
+			return
+		}
+		s, data = string(data[2:2+n]), data[2+n:]
+		return s, true
+	}
+	var ok bool
+	if entry.decoder, ok = readString(); !ok {
+		return entry, errCorrupt
+	}
+	if entry.signer, ok = readString(); !ok || len(data) < 1 {
+		return entry, errCorrupt
+	}
+	entry.raw = data[0]&journalRaw != 0
+	entry.noTimestamp = data[0]&journalNoTimestamp != 0
+	entry.data = data[1:]
+	return
+}
+
+func (j *inputJournal) writeFrame(frameType byte, seq uint64, data []byte) (
+	err error) {
+
+	frame := make([]byte, journalHeaderSize, journalHeaderSize+len(data))
+	frame[0] = frameType
+	binary.BigEndian.PutUint64(frame[1:], seq)
+	binary.BigEndian.PutUint32(frame[9:], uint32(len(data)))
+	frame = append(frame, data...)
+	_, err = j.file.Write(frame)
+	j.size += int64(len(frame))
+	return
+}
+
+// Journals the pack's record, handed to the named decoder. Protobuf inputs
+// leave the message empty (without a UUID) and hand the decoder the encoded
+// message in MsgBytes, which is what's journaled then; the message is
+// journaled otherwise. Inputs leaving the Timestamp to the decoder haven't
+// set it yet, a zero one stands in for it since it's a required field.
+func (j *inputJournal) append(pack *PipelinePack, decoder string) (err error) {
+	entry := journalEntry{decoder: decoder, signer: pack.Signer}
+	msg := pack.Message
+	if msg.Uuid == nil {
+		entry.raw = true
+		entry.data = pack.MsgBytes
+	} else {
+		if msg.Timestamp == nil {
+			entry.noTimestamp = true
+			msg.SetTimestamp(0)
+		}
+		entry.data, err = proto.Marshal(msg)
+		if entry.noTimestamp {
+			msg.Timestamp = nil
+		}
+		if err != nil {
+			return
+		}
+	}
+	var data []byte
+	if data, err = encodeJournalEntry(entry); err != nil {
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.seq++
+	if err = j.writeFrame(journalRecord, j.seq, data); err != nil {
+		return
+	}
+	j.pending[j.seq] = true
+	atomic.AddInt64(&j.journaled, 1)
+	pack.journal = j
+	pack.journalSeq = j.seq
+	return
+}
+
+// Marks the record as delivered, truncating the file if it has grown and
+// nothing is pending anymore.
+func (j *inputJournal) commit(seq uint64) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if !j.pending[seq] {
+		return
+	}
+	delete(j.pending, seq)
+	if len(j.pending) == 0 && j.size+journalHeaderSize >= journalTrimSize {
+		if err := j.file.Truncate(0); err == nil {
+			j.file.Seek(0, os.SEEK_SET)
+			j.size = 0
+			return
+		}
+	}
+	j.writeFrame(journalCommit, seq, nil)
+}
+
+// Number of records journaled but not delivered yet.
+func (j *inputJournal) Pending() int64 {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return int64(len(j.pending))
+}
+
+// Restores the journaled record into a fresh pack.
+func (entry journalEntry) restore(pack *PipelinePack) (err error) {
+	pack.Signer = entry.signer
+	if entry.raw {
+		pack.MsgBytes = append(pack.MsgBytes[:0], entry.data...)
+		return
+	}
+	if err = proto.Unmarshal(entry.data, pack.Message); err == nil &&
+		entry.noTimestamp {
+		pack.Message.Timestamp = nil
+	}
+	return
+}
+
+// Appends the record held by the pack to the input's journal if the input
+// has `journal` enabled, before it's handed to the decoder runner (or
+// injected if the decoder runner is nil). The record is dropped from the
+// journal once the pack reaches the router or is recycled, records left
+// behind by a crash are replayed when the input starts again.
+func JournalPack(ir InputRunner, pack *PipelinePack, dr DecoderRunner) {
+	runner, ok := ir.(*iRunner)
+	if !ok || runner.journal == nil {
+		return
+	}
+	decoder := ""
+	if dr != nil {
+		decoder = dr.Name()
+	}
+	if err := runner.journal.append(pack, decoder); err != nil {
+		runner.LogError(fmt.Errorf("can't journal record: %s", err))
+	}
+}
+
+// Marks the pack's journaled record, if any, as delivered.
+func (p *PipelinePack) commitJournal() {
+	if p.journal != nil {
+		p.journal.commit(p.journalSeq)
+		p.journal = nil
+	}
+}
+
+// Hands the records left pending by the previous run to their decoders, or
+// the router, journaling them again on the way.
+func (ir *iRunner) replayJournal(h PluginHelper, entries []journalEntry) {
+	decoders := make(map[string]DecoderRunner)
+	replayed := 0
+	for _, entry := range entries {
+		var dr DecoderRunner
+		if entry.decoder != "" {
+			if dr = decoders[entry.decoder]; dr == nil {
+				var ok bool
+				if dr, ok = h.DecoderRunner(entry.decoder); !ok {
+					ir.LogError(fmt.Errorf("can't replay journaled record, "+
+						"decoder not found: %s", entry.decoder))
+					continue
+				}
+				decoders[entry.decoder] = dr
+			}
+		}
+		pack := <-ir.inChan
+		if err := entry.restore(pack); err != nil {
+			ir.LogError(fmt.Errorf("can't replay journaled record: %s", err))
+			pack.Recycle()
+			continue
+		}
+		JournalPack(ir, pack, dr)
+		if dr == nil {
+			ir.Inject(pack)
+		} else {
+			dr.InChan() <- pack
+		}
+		replayed++
+	}
+	if replayed > 0 {
+		ir.LogMessage(fmt.Sprintf("replayed %d journaled records", replayed))
+	}
+}
@@ -0,0 +1,166 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func InputJournalSpec(c gs.Context) {
+	pc := NewPipelineConfig(nil)
+	tmpDir, err := ioutil.TempDir("", "heka-journal")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "journal", "input.log")
+
+	supply := make(chan *PipelinePack, 4)
+	for i := 0; i < cap(supply); i++ {
+		supply <- NewPipelinePack(supply)
+	}
+	payloadPack := func(payload string) *PipelinePack {
+		pack := <-supply
+		pack.Message.SetUuid(uuid.NewRandom())
+		pack.Message.SetPayload(payload)
+		return pack
+	}
+	rawPack := func(msgBytes string) *PipelinePack {
+		pack := <-supply
+		pack.MsgBytes = append(pack.MsgBytes[:0], msgBytes...)
+		pack.Signer = "ops"
+		return pack
+	}
+
+	c.Specify("An input journal", func() {
+		journal, entries, err := openInputJournal(path)
+		c.Assume(err, gs.IsNil)
+		c.Expect(len(entries), gs.Equals, 0)
+
+		c.Specify("returns the records that weren't delivered", func() {
+			first := payloadPack("first")
+			second := rawPack("encoded")
+			third := payloadPack("third")
+			third.Message.SetTimestamp(42)
+			c.Expect(journal.append(first, "Decoder"), gs.IsNil)
+			c.Expect(journal.append(second, "ProtobufDecoder"), gs.IsNil)
+			c.Expect(journal.append(third, ""), gs.IsNil)
+			c.Expect(journal.Pending(), gs.Equals, int64(3))
+
+			// Recycling the pack or handing it to the router commits it.
+			first.Recycle()
+			c.Expect(first.journal, gs.IsNil)
+			c.Expect(journal.Pending(), gs.Equals, int64(2))
+			journal.file.Close()
+
+			_, entries, err = openInputJournal(path)
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(entries), gs.Equals, 2)
+			c.Expect(entries[0].decoder, gs.Equals, "ProtobufDecoder")
+			c.Expect(entries[0].signer, gs.Equals, "ops")
+			c.Expect(entries[0].raw, gs.IsTrue)
+			c.Expect(string(entries[0].data), gs.Equals, "encoded")
+			c.Expect(entries[1].decoder, gs.Equals, "")
+			c.Expect(entries[1].raw, gs.IsFalse)
+
+			pack := <-supply
+			c.Expect(entries[1].restore(pack), gs.IsNil)
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "third")
+			c.Expect(pack.Message.GetTimestamp(), gs.Equals, int64(42))
+		})
+
+		c.Specify("leaves a missing Timestamp for the decoder", func() {
+			pack := payloadPack("no timestamp")
+			c.Expect(journal.append(pack, "Decoder"), gs.IsNil)
+			c.Expect(pack.Message.Timestamp, gs.IsNil)
+			journal.file.Close()
+
+			_, entries, err = openInputJournal(path)
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(entries), gs.Equals, 1)
+			c.Expect(entries[0].noTimestamp, gs.IsTrue)
+			restored := <-supply
+			c.Expect(entries[0].restore(restored), gs.IsNil)
+			c.Expect(restored.Message.GetPayload(), gs.Equals, "no timestamp")
+			c.Expect(restored.Message.Timestamp, gs.IsNil)
+		})
+
+		c.Specify("ignores a partially written record", func() {
+			c.Expect(journal.append(payloadPack("whole"), ""), gs.IsNil)
+			journal.file.Write([]byte{journalRecord, 0, 0})
+			journal.file.Close()
+
+			_, entries, err = openInputJournal(path)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(entries), gs.Equals, 1)
+		})
+
+		c.Specify("is truncated once it grows and nothing is pending", func() {
+			pack := payloadPack(strings.Repeat("x", journalTrimSize))
+			c.Expect(journal.append(pack, ""), gs.IsNil)
+			pack.Recycle()
+			info, err := os.Stat(path)
+			c.Assume(err, gs.IsNil)
+			c.Expect(info.Size(), gs.Equals, int64(0))
+		})
+
+		c.Specify("is encrypted with the spool key", func() {
+			key := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+			cipher, err := NewSpoolCipher("hex", key)
+			c.Assume(err, gs.IsNil)
+			Globals().SpoolCipher = cipher
+			defer func() {
+				Globals().SpoolCipher = nil
+			}()
+			c.Expect(journal.append(payloadPack("secret payload"), ""), gs.IsNil)
+			journal.file.Close()
+
+			contents, err := ioutil.ReadFile(path)
+			c.Assume(err, gs.IsNil)
+			c.Expect(strings.Contains(string(contents), "secret payload"), gs.IsFalse)
+			_, entries, err = openInputJournal(path)
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(entries), gs.Equals, 1)
+		})
+
+		c.Specify("is replayed by the input runner", func() {
+			c.Expect(journal.append(payloadPack("replay me"), ""), gs.IsNil)
+			journal.file.Close()
+
+			ir := NewInputRunner("input", new(StatAccumInput),
+				&PluginGlobals{Journal: true}).(*iRunner)
+			ir.h = pc
+			ir.inChan = supply
+			ir.journal, entries, err = openInputJournal(path)
+			c.Assume(err, gs.IsNil)
+			ir.replayJournal(pc, entries)
+
+			pack := <-pc.router.InChan()
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "replay me")
+			c.Expect(ir.journal.Pending(), gs.Equals, int64(1))
+			pack.commitJournal()
+			c.Expect(ir.journal.Pending(), gs.Equals, int64(0))
+
+			msg := pack.Message
+			msg.Fields = nil
+			c.Expect(PopulateReportMsg(ir, msg), gs.IsNil)
+			count, _ := msg.GetFieldValue("JournaledCount")
+			c.Expect(count, gs.Equals, int64(1))
+		})
+	})
+}
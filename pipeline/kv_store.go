@@ -0,0 +1,177 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Returned by KVStore.Set when the new value would take the store over its
+// size limit.
+var ErrKVStoreFull = errors.New("key/value store is full")
+
+// Small persistent key/value store, one per plugin, for lookup tables and
+// counters that need to survive restarts. The contents are kept in memory
+// and written to `{base_dir}/kvstore/{plugin name}.json` by Flush.
+type KVStore struct {
+	path    string
+	maxSize int
+	lock    sync.Mutex
+	data    map[string]string
+	// Total length of the keys and values.
+	size  int
+	dirty bool
+}
+
+// Opens the store persisted at path, or an empty one if the file doesn't
+// exist yet. A maxSize of zero means unlimited.
+func OpenKVStore(path string, maxSize uint64) (store *KVStore, err error) {
+	store = &KVStore{
+		path:    path,
+		maxSize: int(maxSize),
+		data:    make(map[string]string),
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = json.Unmarshal(contents, &store.data); err != nil {
+		return nil, fmt.Errorf("reading key/value store %s: %s", path, err)
+	}
+	for k, v := range store.data {
+		store.size += len(k) + len(v)
+	}
+	return
+}
+
+// Returns the value stored for key.
+func (s *KVStore) Get(key string) (value string, ok bool) {
+	s.lock.Lock()
+	value, ok = s.data[key]
+	s.lock.Unlock()
+	return
+}
+
+// Stores value under key, replacing any previous value.
+func (s *KVStore) Set(key, value string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	size := s.size + len(value)
+	if old, ok := s.data[key]; ok {
+		size -= len(old)
+	} else {
+		size += len(key)
+	}
+	if s.maxSize > 0 && size > s.maxSize {
+		return ErrKVStoreFull
+	}
+	s.data[key] = value
+	s.size = size
+	s.dirty = true
+	return nil
+}
+
+// Removes key from the store.
+func (s *KVStore) Delete(key string) {
+	s.lock.Lock()
+	if old, ok := s.data[key]; ok {
+		delete(s.data, key)
+		s.size -= len(key) + len(old)
+		s.dirty = true
+	}
+	s.lock.Unlock()
+}
+
+// Returns the total length of the stored keys and values.
+func (s *KVStore) Size() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.size
+}
+
+// Writes the store to disk if it changed since the last flush.
+func (s *KVStore) Flush() (err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.dirty {
+		return
+	}
+	contents, err := json.Marshal(s.data)
+	if err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return
+	}
+	// Write to a temporary file first so a crash can't leave a truncated
+	// store behind.
+	tmpPath := s.path + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, contents, 0600); err != nil {
+		return
+	}
+	if err = os.Rename(tmpPath, s.path); err == nil {
+		s.dirty = false
+	}
+	return
+}
+
+// Returns the key/value store of the named plugin, opening it on first use.
+func (self *PipelineConfig) KVStore(name string) (store *KVStore, err error) {
+	self.kvStoresLock.Lock()
+	defer self.kvStoresLock.Unlock()
+	if store = self.kvStores[name]; store != nil {
+		return
+	}
+	path := filepath.Join(Globals().BaseDir, "kvstore", name+".json")
+	if store, err = OpenKVStore(path, Globals().KVStoreMaxSize); err == nil {
+		self.kvStores[name] = store
+	}
+	return
+}
+
+// Writes all of the changed key/value stores to disk.
+func (self *PipelineConfig) flushKVStores() {
+	self.kvStoresLock.Lock()
+	defer self.kvStoresLock.Unlock()
+	for name, store := range self.kvStores {
+		if err := store.Flush(); err != nil {
+			log.Printf("Can't save key/value store of '%s': %s", name, err)
+		}
+	}
+}
+
+// Periodically flushes the key/value stores until Heka shuts down.
+func (self *PipelineConfig) runKVStoreFlusher(interval time.Duration) {
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for !Globals().Stopping {
+		<-ticker.C
+		self.flushKVStores()
+	}
+}
@@ -0,0 +1,79 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func KVStoreSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "kvstore", "filter.json")
+
+	c.Specify("A key/value store", func() {
+		store, err := OpenKVStore(path, 32)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("stores, replaces and deletes values", func() {
+			c.Expect(store.Set("host", "widget"), gs.IsNil)
+			v, ok := store.Get("host")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(v, gs.Equals, "widget")
+			c.Expect(store.Set("host", "gadget1"), gs.IsNil)
+			c.Expect(store.Size(), gs.Equals, 11)
+			store.Delete("host")
+			_, ok = store.Get("host")
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(store.Size(), gs.Equals, 0)
+		})
+
+		c.Specify("refuses values over its size limit", func() {
+			c.Expect(store.Set("a", "0123456789"), gs.IsNil)
+			c.Expect(store.Set("b", "012345678901234567890"), gs.Equals, ErrKVStoreFull)
+			_, ok := store.Get("b")
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(store.Size(), gs.Equals, 11)
+		})
+
+		c.Specify("survives being reopened", func() {
+			store.Set("count", "42")
+			c.Expect(store.Flush(), gs.IsNil)
+			reopened, err := OpenKVStore(path, 32)
+			c.Assume(err, gs.IsNil)
+			v, _ := reopened.Get("count")
+			c.Expect(v, gs.Equals, "42")
+			c.Expect(reopened.Size(), gs.Equals, 7)
+		})
+
+		c.Specify("is shared per plugin by the pipeline config", func() {
+			globals := DefaultGlobals()
+			globals.BaseDir = tmpDir
+			pc := NewPipelineConfig(globals)
+			a, err := pc.KVStore("filter")
+			c.Assume(err, gs.IsNil)
+			b, _ := pc.KVStore("filter")
+			c.Expect(a, gs.Equals, b)
+			a.Set("key", "value")
+			pc.flushKVStores()
+			_, err = os.Stat(path)
+			c.Expect(err, gs.IsNil)
+		})
+	})
+}
@@ -0,0 +1,365 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default length of a leader lease, renewed every third of it.
+const DEFAULT_LEADER_LEASE = 15 * time.Second
+
+// Lock shared by the hekad instances of a cluster running the same filter
+// with `leader_lock` set, only the instance holding it runs the filter
+// actively.
+type LeaderLock interface {
+	// Takes or renews the lock for the holder, returning false if another
+	// holder has it. A lease the holder doesn't renew expires, so the lock
+	// fails over when its instance dies.
+	TryAcquire(holder string, lease time.Duration) (bool, error)
+	// Gives the lock up if the holder has it.
+	Release(holder string) error
+}
+
+// Creates the lock for the target, the part of `leader_lock` after the
+// backend name.
+type LeaderLockBackend func(target string) (LeaderLock, error)
+
+var (
+	leaderLockBackends     = make(map[string]LeaderLockBackend)
+	leaderLockBackendsLock sync.Mutex
+)
+
+// Makes a lock backend available to the `leader_lock` setting, e.g. one
+// using Consul sessions. Must be called before the config is loaded,
+// typically from an `init` function.
+func RegisterLeaderLockBackend(name string, backend LeaderLockBackend) {
+	leaderLockBackendsLock.Lock()
+	leaderLockBackends[name] = backend
+	leaderLockBackendsLock.Unlock()
+}
+
+func init() {
+	// The target is the path of a lease file on storage shared by the
+	// cluster.
+	RegisterLeaderLockBackend("file", func(target string) (LeaderLock, error) {
+		return &fileLeaderLock{path: GetHekaConfigDir(target)}, nil
+	})
+	// The target is a TCP address only one instance can listen on at a time,
+	// typically a floating IP.
+	RegisterLeaderLockBackend("tcp", func(target string) (LeaderLock, error) {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, err
+		}
+		return &tcpLeaderLock{address: target}, nil
+	})
+}
+
+// Creates the lock for a `leader_lock` setting, i.e. "<backend>:<target>".
+func NewLeaderLock(spec string) (LeaderLock, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("leader_lock must be <backend>:<target>: %s", spec)
+	}
+	leaderLockBackendsLock.Lock()
+	backend, ok := leaderLockBackends[parts[0]]
+	leaderLockBackendsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown leader lock backend: %s", parts[0])
+	}
+	return backend(parts[1])
+}
+
+// Lease file holding the holder's name and the expiry time of its lease. The
+// file is only rewritten while holding an exclusively created ".lock" file
+// next to it, so two instances taking over an expired lease can't both win.
+type fileLeaderLock struct {
+	path string
+}
+
+// Returns the holder and expiry of the current lease.
+func (f *fileLeaderLock) read() (holder string, expiry time.Time, err error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if len(lines) != 2 {
+		return "", expiry, fmt.Errorf("invalid lease file %s", f.path)
+	}
+	var nanos int64
+	if nanos, err = strconv.ParseInt(lines[1], 10, 64); err != nil {
+		return "", expiry, fmt.Errorf("invalid lease file %s: %s", f.path, err)
+	}
+	return lines[0], time.Unix(0, nanos), nil
+}
+
+// Runs fn holding the ".lock" file, returning false without running it if
+// another instance holds it. A ".lock" file older than the lease is left
+// over by a dead instance and removed.
+func (f *fileLeaderLock) exclusive(lease time.Duration, fn func() error) (
+	ok bool, err error) {
+
+	lockPath := f.path + ".lock"
+	file, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		if info, e := os.Stat(lockPath); e == nil && time.Since(info.ModTime()) > lease {
+			removeStaleLock(lockPath, info)
+		}
+		return false, nil
+	}
+	if err != nil {
+		return
+	}
+	file.Close()
+	defer os.Remove(lockPath)
+	return true, fn()
+}
+
+func (f *fileLeaderLock) TryAcquire(holder string, lease time.Duration) (
+	acquired bool, err error) {
+
+	ok, err := f.exclusive(lease, func() (e error) {
+		current, expiry, e := f.read()
+		if e != nil && !os.IsNotExist(e) {
+			return
+		}
+		if e == nil && current != holder && time.Now().Before(expiry) {
+			return nil
+		}
+		tmpPath := f.path + ".tmp"
+		contents := fmt.Sprintf("%s\n%d\n", holder, time.Now().Add(lease).UnixNano())
+		if e = writeFileSync(tmpPath, []byte(contents)); e != nil {
+			return
+		}
+		if e = os.Rename(tmpPath, f.path); e == nil {
+			acquired = true
+		}
+		return
+	})
+	if err == nil && !ok {
+		// Another instance is checking the lease, which is still ours if it
+		// hasn't expired.
+		current, expiry, e := f.read()
+		acquired = e == nil && current == holder && time.Now().Before(expiry)
+	}
+	return
+}
+
+func (f *fileLeaderLock) Release(holder string) error {
+	_, err := f.exclusive(DEFAULT_LEADER_LEASE, func() error {
+		current, _, e := f.read()
+		if e != nil || current != holder {
+			return nil
+		}
+		return os.Remove(f.path)
+	})
+	return err
+}
+
+// Removes the stale ".lock" file described by info. Another instance may
+// have removed it and created a fresh one since it was checked, so it's moved
+// aside first and the fresh one is put back if that's what was moved.
+func removeStaleLock(lockPath string, info os.FileInfo) {
+	stalePath := fmt.Sprintf("%s.%d.%d", lockPath, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(lockPath, stalePath); err != nil {
+		return
+	}
+	// Inodes are reused, so a fresh lock can only be told apart by its
+	// modification time.
+	moved, err := os.Stat(stalePath)
+	if err == nil && (!os.SameFile(info, moved) || !moved.ModTime().Equal(info.ModTime())) {
+		// Fails if yet another instance has created the lock since, it's
+		// theirs then.
+		os.Link(stalePath, lockPath)
+	}
+	os.Remove(stalePath)
+}
+
+// Writes the file and syncs it, so the lease survives a crash of the host.
+func writeFileSync(path string, contents []byte) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	if _, err = file.Write(contents); err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	return
+}
+
+// Held by listening on the address. The lease is moot, the listener goes
+// away with the instance holding it.
+type tcpLeaderLock struct {
+	address  string
+	lock     sync.Mutex
+	listener net.Listener
+}
+
+func (t *tcpLeaderLock) TryAcquire(holder string, lease time.Duration) (bool, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.listener != nil {
+		return true, nil
+	}
+	listener, err := net.Listen("tcp", t.address)
+	if err != nil {
+		// In use, or the address isn't assigned to this host.
+		return false, nil
+	}
+	t.listener = listener
+	// Accept and close connections so peers can check there's a leader.
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return true, nil
+}
+
+func (t *tcpLeaderLock) Release(holder string) (err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.listener != nil {
+		err = t.listener.Close()
+		t.listener = nil
+	}
+	return
+}
+
+// Campaigns for a filter's leader lock, renewing it while the filter is the
+// active one. The filter's matcher drops its messages and its ticks are
+// swallowed while it's on standby.
+type leaderElector struct {
+	lock   LeaderLock
+	holder string
+	lease  time.Duration
+	leader int32
+	// Number of matched messages dropped while on standby.
+	standbyCount int64
+}
+
+func newLeaderElector(lock LeaderLock, holder string,
+	lease time.Duration) *leaderElector {
+
+	if lease <= 0 {
+		lease = DEFAULT_LEADER_LEASE
+	}
+	return &leaderElector{lock: lock, holder: holder, lease: lease}
+}
+
+// Returns true if the filter is the active one.
+func (e *leaderElector) IsLeader() bool {
+	return atomic.LoadInt32(&e.leader) == 1
+}
+
+// Returns the number of matched messages dropped while on standby.
+func (e *leaderElector) StandbyCount() int64 {
+	return atomic.LoadInt64(&e.standbyCount)
+}
+
+// Tries to take or renew the lock once, logging leadership changes. Errors
+// put the filter on standby, better no instance running it for a while than
+// two.
+func (e *leaderElector) campaign(pr PluginRunner) {
+	acquired, err := e.lock.TryAcquire(e.holder, e.lease)
+	if err != nil {
+		pr.LogError(fmt.Errorf("leader lock: %s", err))
+		acquired = false
+	}
+	var leader int32
+	if acquired {
+		leader = 1
+	}
+	if atomic.SwapInt32(&e.leader, leader) == leader {
+		return
+	}
+	if acquired {
+		pr.LogMessage("holds the leader lock, now active")
+	} else {
+		pr.LogMessage("lost the leader lock, now on standby")
+	}
+}
+
+// Campaigns every third of the lease until stopped, then releases the lock.
+func (e *leaderElector) run(pr PluginRunner, stopped <-chan struct{}) {
+	e.campaign(pr)
+	ticker := time.NewTicker(e.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.campaign(pr)
+		case <-stopped:
+			atomic.StoreInt32(&e.leader, 0)
+			if err := e.lock.Release(e.holder); err != nil {
+				pr.LogError(fmt.Errorf("releasing leader lock: %s", err))
+			}
+			return
+		}
+	}
+}
+
+// Returns a ticker channel only passing the ticks on while the filter is the
+// active one, so e.g. deadman alerts don't fire on standby instances. Stops
+// once the ticker is closed or the filter has stopped.
+func (e *leaderElector) gateTicker(ticker <-chan time.Time,
+	stopped <-chan struct{}) <-chan time.Time {
+
+	gated := make(chan time.Time, 1)
+	go func() {
+		for {
+			select {
+			case t, ok := <-ticker:
+				if !ok {
+					return
+				}
+				if !e.IsLeader() {
+					continue
+				}
+				select {
+				case gated <- t:
+				default:
+				}
+			case <-stopped:
+				return
+			}
+		}
+	}()
+	return gated
+}
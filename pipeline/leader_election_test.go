@@ -0,0 +1,220 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Lock whose state the specs set.
+type switchLeaderLock struct {
+	held bool
+}
+
+func (s *switchLeaderLock) TryAcquire(holder string, lease time.Duration) (bool, error) {
+	return s.held, nil
+}
+
+func (s *switchLeaderLock) Release(holder string) error {
+	s.held = false
+	return nil
+}
+
+func LeaderElectionSpec(c gs.Context) {
+	NewPipelineConfig(nil)
+
+	c.Specify("A file leader lock", func() {
+		tmpDir, err := ioutil.TempDir("", "leader")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		path := filepath.Join(tmpDir, "deadman.lease")
+		lock, err := NewLeaderLock("file:" + path)
+		c.Assume(err, gs.IsNil)
+		lease := time.Minute
+
+		ok, err := lock.TryAcquire("node1", lease)
+		c.Expect(err, gs.IsNil)
+		c.Expect(ok, gs.IsTrue)
+
+		c.Specify("is held by one instance at a time", func() {
+			ok, err = lock.TryAcquire("node2", lease)
+			c.Expect(err, gs.IsNil)
+			c.Expect(ok, gs.IsFalse)
+			ok, _ = lock.TryAcquire("node1", lease)
+			c.Expect(ok, gs.IsTrue)
+		})
+
+		c.Specify("fails over once the lease expires", func() {
+			lease = 20 * time.Millisecond
+			ok, _ = lock.TryAcquire("node1", lease)
+			c.Expect(ok, gs.IsTrue)
+			time.Sleep(2 * lease)
+			ok, _ = lock.TryAcquire("node2", lease)
+			c.Expect(ok, gs.IsTrue)
+			ok, _ = lock.TryAcquire("node1", lease)
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("fails over at once when released", func() {
+			c.Expect(lock.Release("node2"), gs.IsNil)
+			ok, _ = lock.TryAcquire("node2", lease)
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(lock.Release("node1"), gs.IsNil)
+			ok, _ = lock.TryAcquire("node2", lease)
+			c.Expect(ok, gs.IsTrue)
+		})
+
+		c.Specify("stays held while another instance checks it", func() {
+			err = ioutil.WriteFile(path+".lock", nil, 0644)
+			c.Assume(err, gs.IsNil)
+			ok, _ = lock.TryAcquire("node1", lease)
+			c.Expect(ok, gs.IsTrue)
+			ok, _ = lock.TryAcquire("node2", lease)
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("removes a .lock file left over by a dead instance", func() {
+			err = ioutil.WriteFile(path+".lock", nil, 0644)
+			c.Assume(err, gs.IsNil)
+			old := time.Now().Add(-2 * lease)
+			c.Assume(os.Chtimes(path+".lock", old, old), gs.IsNil)
+			ok, _ = lock.TryAcquire("node2", lease)
+			c.Expect(ok, gs.IsFalse)
+			names, err := filepath.Glob(path + ".lock*")
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(names), gs.Equals, 0)
+			ok, _ = lock.TryAcquire("node1", lease)
+			c.Expect(ok, gs.IsTrue)
+		})
+
+		c.Specify("keeps a fresh .lock file replacing the stale one", func() {
+			err = ioutil.WriteFile(path+".lock", nil, 0644)
+			c.Assume(err, gs.IsNil)
+			old := time.Now().Add(-2 * lease)
+			c.Assume(os.Chtimes(path+".lock", old, old), gs.IsNil)
+			stale, err := os.Stat(path + ".lock")
+			c.Assume(err, gs.IsNil)
+			c.Assume(os.Remove(path+".lock"), gs.IsNil)
+			err = ioutil.WriteFile(path+".lock", []byte("fresh"), 0644)
+			c.Assume(err, gs.IsNil)
+			removeStaleLock(path+".lock", stale)
+			contents, err := ioutil.ReadFile(path + ".lock")
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, "fresh")
+			names, err := filepath.Glob(path + ".lock*")
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(names), gs.Equals, 1)
+		})
+	})
+
+	c.Specify("A tcp leader lock is held by the instance listening", func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		address := ln.Addr().String()
+		ln.Close()
+
+		lock1, err := NewLeaderLock("tcp:" + address)
+		c.Assume(err, gs.IsNil)
+		lock2, _ := NewLeaderLock("tcp:" + address)
+		ok, _ := lock1.TryAcquire("node1", time.Second)
+		c.Expect(ok, gs.IsTrue)
+		ok, _ = lock2.TryAcquire("node2", time.Second)
+		c.Expect(ok, gs.IsFalse)
+		c.Expect(lock1.Release("node1"), gs.IsNil)
+		ok, _ = lock2.TryAcquire("node2", time.Second)
+		c.Expect(ok, gs.IsTrue)
+		lock2.Release("node2")
+	})
+
+	c.Specify("NewLeaderLock rejects invalid settings", func() {
+		_, err := NewLeaderLock("/mnt/shared/deadman.lease")
+		c.Expect(err, gs.Not(gs.IsNil))
+		_, err = NewLeaderLock("zookeeper:/deadman")
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+
+	c.Specify("A leader elected filter", func() {
+		lock := new(switchLeaderLock)
+		leader := newLeaderElector(lock, "node1", time.Second)
+		runner := NewFORunner("deadman", nil, new(PluginGlobals))
+		recycleChan := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(recycleChan)
+		pack.Message.SetType("heartbeat")
+
+		c.Specify("only receives messages while holding the lock", func() {
+			matcher, err := NewMatchRunner("Type == 'heartbeat'", "", runner)
+			c.Assume(err, gs.IsNil)
+			matcher.leader = leader
+			matchChan := make(chan *PipelinePack, 1)
+			matcher.Start(matchChan)
+
+			leader.campaign(runner)
+			matcher.inChan <- pack
+			c.Expect(<-recycleChan, gs.Equals, pack)
+			c.Expect(leader.StandbyCount(), gs.Equals, int64(1))
+
+			lock.held = true
+			leader.campaign(runner)
+			c.Expect(leader.IsLeader(), gs.IsTrue)
+			pack.Message.SetType("heartbeat")
+			matcher.inChan <- pack
+			c.Expect(<-matchChan, gs.Equals, pack)
+			close(matcher.inChan)
+		})
+
+		c.Specify("only ticks while holding the lock", func() {
+			ticker := make(chan time.Time)
+			stopped := make(chan struct{})
+			gated := leader.gateTicker(ticker, stopped)
+			ticker <- time.Now()
+			lock.held = true
+			leader.campaign(runner)
+			now := time.Now()
+			ticker <- now
+			c.Expect(<-gated, gs.Equals, now)
+			close(stopped)
+			// The gate has returned, the ticker isn't read any more.
+			read := false
+			select {
+			case ticker <- time.Now():
+				read = true
+			case <-time.After(50 * time.Millisecond):
+			}
+			c.Expect(read, gs.IsFalse)
+		})
+
+		c.Specify("releases the lock when stopped", func() {
+			lock.held = true
+			stopped := make(chan struct{})
+			done := make(chan bool)
+			go func() {
+				leader.run(runner, stopped)
+				done <- true
+			}()
+			for !leader.IsLeader() {
+				time.Sleep(time.Millisecond)
+			}
+			close(stopped)
+			<-done
+			c.Expect(leader.IsLeader(), gs.IsFalse)
+			c.Expect(lock.held, gs.IsFalse)
+		})
+	})
+}
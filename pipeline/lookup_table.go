@@ -0,0 +1,301 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/bbangert/toml"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Name of the config section declaring the lookup tables. Each table is a
+// sub-section, e.g. `[lookup_tables.service_team]`.
+const LOOKUP_TABLES_SECTION = "lookup_tables"
+
+// Config for a single lookup table.
+type LookupTableConfig struct {
+	// CSV or JSON file holding the mapping.
+	File string
+	// "csv" or "json", defaults to the file name extension.
+	Format string
+	// CSV column (counting from zero) holding the keys, default 0.
+	KeyColumn uint `toml:"key_column"`
+	// CSV column holding the values, default 1.
+	ValueColumn uint `toml:"value_column"`
+	// Whether the first CSV row holds column names and should be skipped.
+	HeaderRow bool `toml:"header_row"`
+}
+
+// Read only key to value mapping loaded from a CSV or JSON file, used by
+// filters to enrich messages (e.g. service to team, IP to datacenter). The
+// file is watched and the table reloaded whenever it changes; a file that
+// fails to load leaves the previous contents in place.
+type LookupTable struct {
+	name    string
+	lock    sync.RWMutex
+	conf    LookupTableConfig
+	data    map[string]string
+	modTime time.Time
+	size    int64
+}
+
+// Creates an empty lookup table, Load must be called to read its file.
+func NewLookupTable(name string, conf *LookupTableConfig) *LookupTable {
+	return &LookupTable{
+		name: name,
+		conf: *conf,
+		data: make(map[string]string),
+	}
+}
+
+func (t *LookupTable) Name() string {
+	return t.name
+}
+
+// Returns the value mapped to key.
+func (t *LookupTable) Lookup(key string) (value string, ok bool) {
+	t.lock.RLock()
+	value, ok = t.data[key]
+	t.lock.RUnlock()
+	return
+}
+
+// Returns the number of keys in the table.
+func (t *LookupTable) Len() int {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return len(t.data)
+}
+
+// (Re)reads the table's file, replacing the contents only if the whole file
+// could be read.
+func (t *LookupTable) Load() (err error) {
+	t.lock.RLock()
+	conf := t.conf
+	t.lock.RUnlock()
+	return t.load(&conf)
+}
+
+func (t *LookupTable) load(conf *LookupTableConfig) (err error) {
+	var (
+		fd   *os.File
+		info os.FileInfo
+		data map[string]string
+	)
+	if fd, err = os.Open(conf.File); err != nil {
+		return
+	}
+	defer fd.Close()
+	if info, err = fd.Stat(); err != nil {
+		return
+	}
+	switch lookupTableFormat(conf) {
+	case "csv":
+		data, err = readLookupCSV(fd, conf)
+	case "json":
+		data, err = readLookupJSON(fd)
+	default:
+		err = fmt.Errorf("unknown format: %s", conf.Format)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %s", conf.File, err)
+	}
+	t.lock.Lock()
+	t.conf = *conf
+	t.data = data
+	t.modTime = info.ModTime()
+	t.size = info.Size()
+	t.lock.Unlock()
+	return
+}
+
+// Reloads the table if its file's modification time or size changed since
+// the last load.
+func (t *LookupTable) ReloadIfChanged() (reloaded bool, err error) {
+	t.lock.RLock()
+	conf := t.conf
+	modTime, size := t.modTime, t.size
+	t.lock.RUnlock()
+
+	var info os.FileInfo
+	if info, err = os.Stat(conf.File); err != nil {
+		return
+	}
+	if info.ModTime().Equal(modTime) && info.Size() == size {
+		return
+	}
+	if err = t.load(&conf); err != nil {
+		// Don't retry a broken file until it changes again.
+		t.lock.Lock()
+		t.modTime, t.size = info.ModTime(), info.Size()
+		t.lock.Unlock()
+		return
+	}
+	return true, nil
+}
+
+func lookupTableFormat(conf *LookupTableConfig) string {
+	if conf.Format != "" {
+		return strings.ToLower(conf.Format)
+	}
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(conf.File)), ".")
+}
+
+func readLookupCSV(r io.Reader, conf *LookupTableConfig) (data map[string]string,
+	err error) {
+
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	data = make(map[string]string)
+	var record []string
+	for row := 1; ; row++ {
+		if record, err = reader.Read(); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			break
+		}
+		if row == 1 && conf.HeaderRow {
+			continue
+		}
+		if uint(len(record)) <= conf.KeyColumn || uint(len(record)) <= conf.ValueColumn {
+			return nil, fmt.Errorf("row %d has only %d columns", row, len(record))
+		}
+		data[record[conf.KeyColumn]] = record[conf.ValueColumn]
+	}
+	return
+}
+
+// Reads a JSON object, values that aren't strings are stored in their JSON
+// encoding.
+func readLookupJSON(r io.Reader) (data map[string]string, err error) {
+	var raw map[string]interface{}
+	if err = json.NewDecoder(r).Decode(&raw); err != nil {
+		return
+	}
+	data = make(map[string]string, len(raw))
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			data[k] = s
+			continue
+		}
+		var encoded []byte
+		if encoded, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+		data[k] = string(encoded)
+	}
+	return
+}
+
+// Returns the named lookup table.
+func (self *PipelineConfig) LookupTable(name string) (table *LookupTable, ok bool) {
+	self.lookupTablesLock.RLock()
+	table, ok = self.lookupTables[name]
+	self.lookupTablesLock.RUnlock()
+	return
+}
+
+// Creates or updates the lookup tables declared in the `lookup_tables`
+// config section. An existing table is only changed if its new config loads,
+// so the plugins holding it always see a complete mapping. Tables missing
+// from the section are kept until Heka is restarted.
+func (self *PipelineConfig) declareLookupTables(section toml.Primitive) (errcnt uint) {
+	var sections map[string]toml.Primitive
+	if err := toml.PrimitiveDecode(section, &sections); err != nil {
+		self.log(fmt.Sprintf("Unable to decode config for %s: %s",
+			LOOKUP_TABLES_SECTION, err))
+		return 1
+	}
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		conf := &LookupTableConfig{ValueColumn: 1}
+		if err := toml.PrimitiveDecode(sections[name], conf); err != nil {
+			self.log(fmt.Sprintf("Unable to decode config for lookup table '%s': %s",
+				name, err))
+			errcnt++
+			continue
+		}
+		if conf.File == "" {
+			self.log(fmt.Sprintf("Lookup table '%s' has no file", name))
+			errcnt++
+			continue
+		}
+		table, ok := self.LookupTable(name)
+		if !ok {
+			table = NewLookupTable(name, conf)
+		}
+		if err := table.load(conf); err != nil {
+			self.log(fmt.Sprintf("Can't load lookup table '%s': %s", name, err))
+			errcnt++
+			continue
+		}
+		if !ok {
+			self.lookupTablesLock.Lock()
+			self.lookupTables[name] = table
+			self.lookupTablesLock.Unlock()
+		}
+	}
+	return
+}
+
+// Reloads every lookup table whose file has changed.
+func (self *PipelineConfig) reloadLookupTables() {
+	self.lookupTablesLock.RLock()
+	tables := make([]*LookupTable, 0, len(self.lookupTables))
+	for _, table := range self.lookupTables {
+		tables = append(tables, table)
+	}
+	self.lookupTablesLock.RUnlock()
+
+	for _, table := range tables {
+		reloaded, err := table.ReloadIfChanged()
+		if err != nil {
+			log.Printf("Can't reload lookup table '%s': %s", table.Name(), err)
+		} else if reloaded {
+			log.Printf("Reloaded lookup table '%s' (%d keys)", table.Name(),
+				table.Len())
+		}
+	}
+}
+
+// Periodically checks the lookup table files for changes until Heka shuts
+// down.
+func (self *PipelineConfig) runLookupTableWatcher(interval time.Duration) {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for !Globals().Stopping {
+		<-ticker.C
+		self.reloadLookupTables()
+	}
+}
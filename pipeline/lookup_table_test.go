@@ -0,0 +1,145 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/bbangert/toml"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func LookupTableSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	csvPath := filepath.Join(tmpDir, "teams.csv")
+	jsonPath := filepath.Join(tmpDir, "datacenters.json")
+
+	// Writes a file and moves its mtime on, so a rewrite within the same
+	// second is still noticed.
+	age := 0
+	writeFile := func(path, contents string) {
+		c.Assume(ioutil.WriteFile(path, []byte(contents), 0600), gs.IsNil)
+		age++
+		mtime := time.Now().Add(time.Duration(age) * time.Minute)
+		c.Assume(os.Chtimes(path, mtime, mtime), gs.IsNil)
+	}
+
+	c.Specify("A lookup table", func() {
+		writeFile(csvPath, "service,owner,team\nweb,bob,ops\n\"db, primary\",alice,dba\n")
+		table := NewLookupTable("teams", &LookupTableConfig{
+			File:        csvPath,
+			ValueColumn: 2,
+			HeaderRow:   true,
+		})
+		c.Expect(table.Load(), gs.IsNil)
+
+		c.Specify("reads a CSV file", func() {
+			c.Expect(table.Len(), gs.Equals, 2)
+			v, ok := table.Lookup("db, primary")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(v, gs.Equals, "dba")
+			_, ok = table.Lookup("service")
+			c.Expect(ok, gs.IsFalse)
+		})
+
+		c.Specify("reads a JSON file", func() {
+			writeFile(jsonPath, `{"10.0.0.1": "us-east", "10.0.0.2": 2}`)
+			table := NewLookupTable("datacenters", &LookupTableConfig{File: jsonPath})
+			c.Expect(table.Load(), gs.IsNil)
+			v, _ := table.Lookup("10.0.0.1")
+			c.Expect(v, gs.Equals, "us-east")
+			v, _ = table.Lookup("10.0.0.2")
+			c.Expect(v, gs.Equals, "2")
+		})
+
+		c.Specify("reloads its file when it changes", func() {
+			reloaded, err := table.ReloadIfChanged()
+			c.Expect(err, gs.IsNil)
+			c.Expect(reloaded, gs.IsFalse)
+
+			writeFile(csvPath, "service,owner,team\nweb,bob,webops\n")
+			reloaded, err = table.ReloadIfChanged()
+			c.Expect(err, gs.IsNil)
+			c.Expect(reloaded, gs.IsTrue)
+			v, _ := table.Lookup("web")
+			c.Expect(v, gs.Equals, "webops")
+			c.Expect(table.Len(), gs.Equals, 1)
+		})
+
+		c.Specify("keeps its contents when the file is broken", func() {
+			writeFile(csvPath, "service,owner,team\nweb\n")
+			reloaded, err := table.ReloadIfChanged()
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(reloaded, gs.IsFalse)
+			v, _ := table.Lookup("web")
+			c.Expect(v, gs.Equals, "ops")
+
+			// The broken file isn't retried until it changes again.
+			reloaded, err = table.ReloadIfChanged()
+			c.Expect(err, gs.IsNil)
+			c.Expect(reloaded, gs.IsFalse)
+		})
+	})
+
+	c.Specify("The pipeline config", func() {
+		writeFile(csvPath, "web,ops\n")
+		pc := NewPipelineConfig(nil)
+		declare := func(tomlStr string) uint {
+			var configFile ConfigFile
+			_, err := toml.Decode(tomlStr, &configFile)
+			c.Assume(err, gs.IsNil)
+			return pc.declareLookupTables(configFile[LOOKUP_TABLES_SECTION])
+		}
+
+		c.Specify("declares lookup tables from the config", func() {
+			errcnt := declare(fmt.Sprintf("[lookup_tables.teams]\nfile = %q\n", csvPath))
+			c.Expect(errcnt, gs.Equals, uint(0))
+			table, ok := pc.LookupTable("teams")
+			c.Expect(ok, gs.IsTrue)
+			v, _ := table.Lookup("web")
+			c.Expect(v, gs.Equals, "ops")
+
+			c.Specify("and updates them in place", func() {
+				errcnt := declare(fmt.Sprintf(
+					"[lookup_tables.teams]\nfile = %q\nkey_column = 1\nvalue_column = 0\n",
+					csvPath))
+				c.Expect(errcnt, gs.Equals, uint(0))
+				v, ok := table.Lookup("ops")
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(v, gs.Equals, "web")
+			})
+
+			c.Specify("but not with a config that fails to load", func() {
+				errcnt := declare(fmt.Sprintf(
+					"[lookup_tables.teams]\nfile = %q\nformat = \"xml\"\n", csvPath))
+				c.Expect(errcnt, gs.Equals, uint(1))
+				v, _ := table.Lookup("web")
+				c.Expect(v, gs.Equals, "ops")
+			})
+		})
+
+		c.Specify("rejects a table without a file", func() {
+			errcnt := declare("[lookup_tables.teams]\nformat = \"csv\"\n")
+			c.Expect(errcnt, gs.Equals, uint(1))
+			_, ok := pc.LookupTable("teams")
+			c.Expect(ok, gs.IsFalse)
+		})
+	})
+}
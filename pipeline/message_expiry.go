@@ -0,0 +1,65 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+	"time"
+)
+
+// Name of the message field that can hold an absolute expiry time, in
+// nanoseconds since the epoch. Outputs skip messages past their expiry.
+const EXPIRES_AT_FIELD = "ExpiresAt"
+
+// Decides whether a message has expired before reaching an output, either
+// because its ExpiresAt field is in the past or because it's older than the
+// output's `message_ttl`, and counts the expired messages.
+type messageExpiry struct {
+	ttl     time.Duration
+	expired int64
+	// Replaced in tests.
+	now func() time.Time
+}
+
+func newMessageExpiry(ttl time.Duration) *messageExpiry {
+	return &messageExpiry{ttl: ttl, now: time.Now}
+}
+
+// Returns true if the message has expired.
+func (e *messageExpiry) check(msg *message.Message) (expired bool) {
+	now := e.now().UnixNano()
+	if e.ttl > 0 && msg.Timestamp != nil {
+		expired = now-msg.GetTimestamp() > e.ttl.Nanoseconds()
+	}
+	if !expired {
+		switch expiresAt := msg.FindFirstField(EXPIRES_AT_FIELD); {
+		case expiresAt == nil:
+		case len(expiresAt.ValueInteger) > 0:
+			expired = now > expiresAt.ValueInteger[0]
+		case len(expiresAt.ValueDouble) > 0:
+			expired = float64(now) > expiresAt.ValueDouble[0]
+		}
+	}
+	if expired {
+		atomic.AddInt64(&e.expired, 1)
+	}
+	return
+}
+
+// Returns the number of expired messages seen so far.
+func (e *messageExpiry) ExpiredCount() int64 {
+	return atomic.LoadInt64(&e.expired)
+}
@@ -0,0 +1,65 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func MessageExpirySpec(c gs.Context) {
+	now := time.Unix(1000, 0)
+	msg := &message.Message{}
+	msg.SetTimestamp(now.Add(-5 * time.Minute).UnixNano())
+
+	c.Specify("A message expiry", func() {
+		c.Specify("with a ttl", func() {
+			expiry := newMessageExpiry(10 * time.Minute)
+			expiry.now = func() time.Time { return now }
+
+			c.Specify("passes messages younger than the ttl", func() {
+				c.Expect(expiry.check(msg), gs.IsFalse)
+				c.Expect(expiry.ExpiredCount(), gs.Equals, int64(0))
+			})
+
+			c.Specify("skips and counts messages older than the ttl", func() {
+				expiry.now = func() time.Time { return now.Add(6 * time.Minute) }
+				c.Expect(expiry.check(msg), gs.IsTrue)
+				c.Expect(expiry.check(msg), gs.IsTrue)
+				c.Expect(expiry.ExpiredCount(), gs.Equals, int64(2))
+			})
+		})
+
+		c.Specify("without a ttl", func() {
+			expiry := newMessageExpiry(0)
+			expiry.now = func() time.Time { return now }
+
+			c.Specify("passes messages of any age", func() {
+				msg.SetTimestamp(0)
+				c.Expect(expiry.check(msg), gs.IsFalse)
+			})
+
+			c.Specify("honors the ExpiresAt field", func() {
+				message.NewInt64Field(msg, EXPIRES_AT_FIELD,
+					now.Add(time.Second).UnixNano(), "")
+				c.Expect(expiry.check(msg), gs.IsFalse)
+				expiry.now = func() time.Time { return now.Add(2 * time.Second) }
+				c.Expect(expiry.check(msg), gs.IsTrue)
+				c.Expect(expiry.ExpiredCount(), gs.Equals, int64(1))
+			})
+		})
+	})
+}
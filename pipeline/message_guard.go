@@ -0,0 +1,133 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// What a decoder does with a message exceeding one of its size limits.
+const (
+	GUARD_TRUNCATE = "truncate"
+	GUARD_DROP     = "drop"
+)
+
+// Limits on the size of the messages a decoder produces, so a pathological
+// record can't blow up the filters and outputs downstream (e.g. an
+// ElasticSearch mapping explosion). Messages going over a limit are either
+// truncated to fit or dropped, i.e. handed to the dead-letter queue.
+type messageGuard struct {
+	maxFields      int
+	maxNameLength  int
+	maxValueLength int
+	maxPayloadSize int
+	drop           bool
+	// Number of messages truncated and dropped.
+	truncated int64
+	dropped   int64
+}
+
+// Returns the guard for a decoder's settings, nil if it sets no limit.
+func newMessageGuard(globals *PluginGlobals) (guard *messageGuard, err error) {
+	if globals == nil {
+		return
+	}
+	var drop bool
+	switch globals.GuardAction {
+	case "", GUARD_TRUNCATE:
+	case GUARD_DROP:
+		drop = true
+	default:
+		return nil, fmt.Errorf("invalid guard_action: %s", globals.GuardAction)
+	}
+	if globals.MaxFields == 0 && globals.MaxFieldNameLength == 0 &&
+		globals.MaxFieldValueLength == 0 && globals.MaxPayloadSize == 0 {
+		return
+	}
+	return &messageGuard{
+		maxFields:      int(globals.MaxFields),
+		maxNameLength:  int(globals.MaxFieldNameLength),
+		maxValueLength: int(globals.MaxFieldValueLength),
+		maxPayloadSize: int(globals.MaxPayloadSize),
+		drop:           drop,
+	}, nil
+}
+
+// Cuts s down to at most n bytes without splitting a UTF-8 sequence.
+func truncateString(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// Checks the message against the limits. With the drop action an error
+// describing the first limit exceeded is returned and the message is left
+// alone, otherwise the message is truncated to fit.
+func (g *messageGuard) apply(msg *message.Message) (err error) {
+	var exceeded bool
+	over := func(what string, size, max int) bool {
+		if max == 0 || size <= max {
+			return false
+		}
+		if g.drop && !exceeded {
+			err = fmt.Errorf("message dropped, %s of %d exceeds %d", what, size, max)
+		}
+		exceeded = true
+		return !g.drop
+	}
+
+	if over("payload size", len(msg.GetPayload()), g.maxPayloadSize) {
+		msg.SetPayload(truncateString(msg.GetPayload(), g.maxPayloadSize))
+	}
+	if over("field count", len(msg.Fields), g.maxFields) {
+		msg.Fields = msg.Fields[:g.maxFields]
+	}
+	for _, field := range msg.Fields {
+		if over("field name length", len(field.GetName()), g.maxNameLength) {
+			name := truncateString(field.GetName(), g.maxNameLength)
+			field.Name = &name
+		}
+		for i, value := range field.ValueString {
+			if over("field value length", len(value), g.maxValueLength) {
+				field.ValueString[i] = truncateString(value, g.maxValueLength)
+			}
+		}
+		for i, value := range field.ValueBytes {
+			if over("field value length", len(value), g.maxValueLength) {
+				field.ValueBytes[i] = value[:g.maxValueLength]
+			}
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&g.dropped, 1)
+	} else if exceeded {
+		atomic.AddInt64(&g.truncated, 1)
+	}
+	return
+}
+
+func (g *messageGuard) ReportMsg(msg *message.Message) {
+	message.NewInt64Field(msg, "GuardTruncatedCount",
+		atomic.LoadInt64(&g.truncated), "count")
+	message.NewInt64Field(msg, "GuardDroppedCount",
+		atomic.LoadInt64(&g.dropped), "count")
+}
@@ -0,0 +1,102 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+)
+
+func MessageGuardSpec(c gs.Context) {
+	globals := &PluginGlobals{
+		MaxFields:           2,
+		MaxFieldNameLength:  8,
+		MaxFieldValueLength: 5,
+		MaxPayloadSize:      10,
+	}
+	newMsg := func() *message.Message {
+		msg := new(message.Message)
+		msg.SetPayload("0123456789abcdef")
+		f, _ := message.NewField("verylongname", "héllo world", "")
+		msg.AddField(f)
+		f, _ = message.NewField("bytes", []byte("binary data"), "")
+		msg.AddField(f)
+		f, _ = message.NewField("extra", "dropped", "")
+		msg.AddField(f)
+		return msg
+	}
+
+	c.Specify("A message guard", func() {
+		c.Specify("isn't created without limits", func() {
+			guard, err := newMessageGuard(&PluginGlobals{})
+			c.Expect(err, gs.IsNil)
+			c.Expect(guard, gs.IsNil)
+		})
+
+		c.Specify("rejects an unknown action", func() {
+			globals.GuardAction = "ignore"
+			_, err := newMessageGuard(globals)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("truncates messages by default", func() {
+			guard, err := newMessageGuard(globals)
+			c.Assume(err, gs.IsNil)
+			msg := newMsg()
+			c.Expect(guard.apply(msg), gs.IsNil)
+			c.Expect(msg.GetPayload(), gs.Equals, "0123456789")
+			c.Expect(len(msg.Fields), gs.Equals, 2)
+			c.Expect(msg.Fields[0].GetName(), gs.Equals, "verylong")
+			// Multi-byte characters aren't split.
+			c.Expect(msg.Fields[0].ValueString[0], gs.Equals, "héll")
+			c.Expect(string(msg.Fields[1].ValueBytes[0]), gs.Equals, "binar")
+			c.Expect(guard.truncated, gs.Equals, int64(1))
+
+			small := new(message.Message)
+			small.SetPayload("ok")
+			c.Expect(guard.apply(small), gs.IsNil)
+			c.Expect(guard.truncated, gs.Equals, int64(1))
+		})
+
+		c.Specify("drops messages with the drop action", func() {
+			globals.GuardAction = GUARD_DROP
+			guard, err := newMessageGuard(globals)
+			c.Assume(err, gs.IsNil)
+			msg := newMsg()
+			err = guard.apply(msg)
+			c.Assume(err, gs.Not(gs.IsNil))
+			c.Expect(strings.Contains(err.Error(), "payload size of 16 exceeds 10"),
+				gs.IsTrue)
+			c.Expect(msg.GetPayload(), gs.Equals, "0123456789abcdef")
+			c.Expect(len(msg.Fields), gs.Equals, 3)
+			c.Expect(guard.dropped, gs.Equals, int64(1))
+			c.Expect(guard.truncated, gs.Equals, int64(0))
+		})
+
+		c.Specify("is set up and reported by the decoder runner", func() {
+			NewPipelineConfig(nil) // initializes Globals()
+			globals.GuardAction = GUARD_DROP
+			dr := NewDecoderRunner("decoder", new(ProtobufDecoder), globals).(*dRunner)
+			c.Assume(dr.guard, gs.Not(gs.IsNil))
+			dr.guard.apply(newMsg())
+
+			msg := new(message.Message)
+			c.Expect(PopulateReportMsg(dr, msg), gs.IsNil)
+			count, _ := msg.GetFieldValue("GuardDroppedCount")
+			c.Expect(count, gs.Equals, int64(1))
+		})
+	})
+}
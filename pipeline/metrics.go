@@ -0,0 +1,175 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Content type of the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4"
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+// Samples of one metric, keyed by metric name.
+type metricFamilies map[string][]metricSample
+
+func (m metricFamilies) add(name, labels string, value float64) {
+	m[name] = append(m[name], metricSample{labels, value})
+}
+
+// Converts a report field name to a metric name, e.g. ProcessMessageCount
+// becomes heka_process_message_count.
+func metricName(field string) string {
+	name := make([]rune, 0, len(field)+8)
+	name = append(name, []rune("heka_")...)
+	runes := []rune(field)
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			// Start a new word, keeping acronyms such as "TLS" together.
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(i+1 < len(runes) && unicode.IsLower(runes[i+1]))) &&
+				name[len(name)-1] != '_' {
+				name = append(name, '_')
+			}
+			name = append(name, unicode.ToLower(r))
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			name = append(name, r)
+		default:
+			if name[len(name)-1] != '_' {
+				name = append(name, '_')
+			}
+		}
+	}
+	return strings.TrimRight(string(name), "_")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Collects the numeric fields of every report message, the same data as the
+// heka.all-report message, labelled with the plugin name and the section it
+// belongs to (globals, inputs, decoders, filters or outputs). The counters
+// are read when the metrics are requested, so exporting them costs the
+// message processing nothing.
+func (pc *PipelineConfig) collectMetrics() (families metricFamilies) {
+	families = make(metricFamilies)
+	reports := make(chan *PipelinePack)
+	go pc.reports(reports)
+	for pack := range reports {
+		msg := pack.Message
+		name, _ := msg.GetFieldValue("name")
+		key, _ := msg.GetFieldValue("key")
+		labels := fmt.Sprintf(`plugin="%s",section="%s"`,
+			labelEscaper.Replace(fmt.Sprint(name)), labelEscaper.Replace(fmt.Sprint(key)))
+		for _, field := range msg.Fields {
+			var value float64
+			switch v := field.GetValue().(type) {
+			case int64:
+				value = float64(v)
+			case float64:
+				value = v
+			case bool:
+				if v {
+					value = 1
+				}
+			default:
+				continue
+			}
+			families.add(metricName(field.GetName()), labels, value)
+		}
+		pack.Recycle()
+	}
+
+	// Packs that aren't sitting in the recycle channels are in use.
+	for name, supply := range map[string]chan *PipelinePack{
+		"input":  pc.inputRecycleChan,
+		"inject": pc.injectRecycleChan,
+	} {
+		pool := pc.inputPool
+		if name == "inject" {
+			pool = pc.injectPool
+		}
+		size := pc.poolSize(pool, supply)
+		labels := fmt.Sprintf(`pool="%s"`, name)
+		families.add("heka_pack_pool_size", labels, float64(size))
+		families.add("heka_pack_pool_in_use", labels, float64(size-len(supply)))
+	}
+	return
+}
+
+// Writes the metrics in the Prometheus text format, sorted by name. Metrics
+// ending in "_count" are monotonic and typed as counters, the rest as gauges.
+func (pc *PipelineConfig) writeMetrics(w io.Writer) error {
+	families := pc.collectMetrics()
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := bufio.NewWriter(w)
+	for _, name := range names {
+		typ := "gauge"
+		if strings.HasSuffix(name, "_count") {
+			typ = "counter"
+		}
+		fmt.Fprintf(out, "# TYPE %s %s\n", name, typ)
+		for _, sample := range families[name] {
+			fmt.Fprintf(out, "%s{%s} %v\n", name, sample.labels, sample.value)
+		}
+	}
+	return out.Flush()
+}
+
+func (pc *PipelineConfig) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", metricsContentType)
+	if err := pc.writeMetrics(w); err != nil {
+		log.Println("Metrics exporter can't write response: ", err)
+	}
+}
+
+// Starts serving the metrics on /metrics at the given address.
+func (pc *PipelineConfig) startMetricsServer(addr string) (listener net.Listener,
+	err error) {
+
+	if listener, err = net.Listen("tcp", addr); err != nil {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", pc.serveMetrics)
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(listener); err != nil && !Globals().Stopping {
+			log.Println("Metrics server stopped: ", err)
+		}
+	}()
+	return
+}
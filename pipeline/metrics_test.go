@@ -0,0 +1,95 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+func MetricsSpec(c gs.Context) {
+	c.Specify("Metric names", func() {
+		c.Expect(metricName("ProcessMessageCount"), gs.Equals,
+			"heka_process_message_count")
+		c.Expect(metricName("InChanLength"), gs.Equals, "heka_in_chan_length")
+		c.Expect(metricName("TLSHandshakeErrors"), gs.Equals,
+			"heka_tls_handshake_errors")
+		c.Expect(metricName("StartsWithM-AttemptCount"), gs.Equals,
+			"heka_starts_with_m_attempt_count")
+		c.Expect(metricName("Percentile99"), gs.Equals, "heka_percentile99")
+	})
+
+	c.Specify("The metrics exporter", func() {
+		pc := NewPipelineConfig(nil)
+		pc.reportRecycleChan <- NewPipelinePack(pc.reportRecycleChan)
+
+		filter := new(CounterFilter)
+		fRunner := NewFORunner("counter", filter, nil)
+		var err error
+		fRunner.matcher, err = NewMatchRunner("TRUE", "", fRunner)
+		c.Assume(err, gs.IsNil)
+		fRunner.SetLeakCount(3)
+		pc.FilterRunners = map[string]FilterRunner{"counter": fRunner}
+
+		// Two of the input packs are in use.
+		for i := 0; i < Globals().PoolSize-2; i++ {
+			pc.inputRecycleChan <- NewPipelinePack(pc.inputRecycleChan)
+		}
+		for i := 0; i < Globals().PoolSize; i++ {
+			pc.injectRecycleChan <- NewPipelinePack(pc.injectRecycleChan)
+		}
+
+		c.Specify("writes the report fields in the Prometheus text format", func() {
+			out := new(bytes.Buffer)
+			err := pc.writeMetrics(out)
+			c.Assume(err, gs.IsNil)
+			text := out.String()
+
+			expected := []string{
+				"# TYPE heka_leak_count counter\n",
+				"heka_leak_count{plugin=\"counter\",section=\"filters\"} 3\n",
+				"# TYPE heka_in_chan_length gauge\n",
+				"heka_in_chan_capacity{plugin=\"Router\",section=\"globals\"} ",
+				"heka_pack_pool_in_use{pool=\"input\"} 2\n",
+				"heka_pack_pool_in_use{pool=\"inject\"} 0\n",
+				"heka_pack_pool_size{pool=\"input\"} 100\n",
+			}
+			for _, line := range expected {
+				c.Expect(strings.Contains(text, line), gs.IsTrue)
+			}
+			// String fields such as the plugin state aren't exported.
+			c.Expect(strings.Contains(text, "heka_state"), gs.IsFalse)
+			c.Expect(strings.Contains(text, "heka_test1"), gs.IsFalse)
+		})
+
+		c.Specify("serves the metrics over HTTP", func() {
+			listener, err := pc.startMetricsServer("127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer listener.Close()
+
+			resp, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+			c.Assume(err, gs.IsNil)
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			c.Expect(err, gs.IsNil)
+			c.Expect(resp.StatusCode, gs.Equals, http.StatusOK)
+			c.Expect(resp.Header.Get("Content-Type"), gs.Equals, metricsContentType)
+			c.Expect(strings.Contains(string(body), "heka_leak_count{"), gs.IsTrue)
+		})
+	})
+}
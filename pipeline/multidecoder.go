@@ -19,7 +19,11 @@ import (
 	"errors"
 	"fmt"
 	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
 	"log"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // DecoderRunner wrapper that the MultiDecoder will hand to any subs that ask
@@ -60,10 +64,19 @@ type MultiDecoder struct {
 	Name      string
 	Decoders  map[string]Decoder
 	ordered   []Decoder
+	stats     []*subDecoderStats
 	dRunner   DecoderRunner
 	CascStrat int
 }
 
+// Decode counts and timing of a subdecoder, indexed like the `order`.
+type subDecoderStats struct {
+	attempts  int64
+	successes int64
+	errors    int64
+	duration  int64
+}
+
 type MultiDecoderConfig struct {
 	// subs is an ordered dictionary of other decoders
 	Subs            map[string]interface{}
@@ -115,7 +128,9 @@ func (md *MultiDecoder) Init(config interface{}) (err error) {
 	}
 
 	md.ordered = make([]Decoder, len(md.Config.Order))
+	md.stats = make([]*subDecoderStats, len(md.Config.Order))
 	for i, name := range md.Config.Order {
+		md.stats[i] = new(subDecoderStats)
 		if decoder, ok = md.Decoders[name]; !ok {
 			return fmt.Errorf("Non-existent subdecoder '%s' in `order` config value.",
 				name)
@@ -230,6 +245,15 @@ func (md *MultiDecoder) SetDecoderRunner(dr DecoderRunner) {
 	}
 }
 
+// Passes the sample denominator along to the subdecoders that want it.
+func (md *MultiDecoder) SetSampleDenominator(denominator int) {
+	for _, decoder := range md.Decoders {
+		if wanter, ok := decoder.(WantsSampleDenominator); ok {
+			wanter.SetSampleDenominator(denominator)
+		}
+	}
+}
+
 // Heka will call this at DecoderRunner shutdown time, we might need to pass
 // this along to subdecoders.
 func (md *MultiDecoder) Shutdown() {
@@ -241,21 +265,19 @@ func (md *MultiDecoder) Shutdown() {
 }
 
 // Recurses through a decoder chain, decoding the original pack and returning
-// it and any generated extra packs.
+// it and any generated extra packs, along with the errors of the subdecoders
+// that failed.
 func (md *MultiDecoder) getDecodedPacks(chain []Decoder, inPacks []*PipelinePack) (
-	packs []*PipelinePack, anyMatch bool) {
+	packs []*PipelinePack, anyMatch bool, subErrs []string) {
 
-	decoder := chain[0]
+	idx := len(md.ordered) - len(chain)
 	for _, p := range inPacks {
-		if ps, err := decoder.Decode(p); ps != nil {
+		if ps, err := md.subDecode(idx, p); ps != nil {
 			anyMatch = true
 			packs = append(packs, ps...)
 		} else {
-			if err != nil && md.Config.LogSubErrors {
-				idx := len(md.ordered) - len(chain)
-				err = fmt.Errorf("Subdecoder '%s' decode error: %s",
-					md.Config.Order[idx], err)
-				md.dRunner.LogError(err)
+			if err != nil {
+				subErrs = append(subErrs, md.subError(idx, err))
 			}
 			packs = inPacks
 			break
@@ -263,14 +285,90 @@ func (md *MultiDecoder) getDecodedPacks(chain []Decoder, inPacks []*PipelinePack
 	}
 
 	if len(chain) > 1 {
-		var otherMatch bool
-		packs, otherMatch = md.getDecodedPacks(chain[1:], packs)
+		var (
+			otherMatch bool
+			otherErrs  []string
+		)
+		packs, otherMatch, otherErrs = md.getDecodedPacks(chain[1:], packs)
 		anyMatch = anyMatch || otherMatch
+		subErrs = append(subErrs, otherErrs...)
 	}
 
 	return
 }
 
+// Decodes the pack with the subdecoder at the given index of the order,
+// recording the attempt in its stats.
+func (md *MultiDecoder) subDecode(idx int, pack *PipelinePack) (
+	packs []*PipelinePack, err error) {
+
+	stats := md.stats[idx]
+	start := time.Now()
+	packs, err = md.ordered[idx].Decode(pack)
+	atomic.AddInt64(&stats.attempts, 1)
+	atomic.AddInt64(&stats.duration, time.Since(start).Nanoseconds())
+	if packs != nil {
+		atomic.AddInt64(&stats.successes, 1)
+	} else if err != nil {
+		atomic.AddInt64(&stats.errors, 1)
+	}
+	return
+}
+
+// Satisfies the `ReportingPlugin` interface, reporting how often each
+// subdecoder was tried, how often it decoded the message, and how long it
+// took, so it's possible to see which format of a mixed input stream is
+// failing. The fields are prefixed with the subdecoder name.
+func (md *MultiDecoder) ReportMsg(msg *message.Message) error {
+	for i, name := range md.Config.Order {
+		stats := md.stats[i]
+		// The attempts are counted first and loaded last, so they always
+		// cover the successes and errors.
+		successes := atomic.LoadInt64(&stats.successes)
+		errCount := atomic.LoadInt64(&stats.errors)
+		attempts := atomic.LoadInt64(&stats.attempts)
+		duration := atomic.LoadInt64(&stats.duration)
+		var (
+			successRate float64
+			avgDuration int64
+		)
+		if attempts > 0 {
+			successRate = float64(successes) * 100 / float64(attempts)
+			avgDuration = duration / attempts
+		}
+		message.NewInt64Field(msg, name+"-AttemptCount", attempts, "count")
+		message.NewInt64Field(msg, name+"-SuccessCount", successes, "count")
+		message.NewInt64Field(msg, name+"-FailureCount", attempts-successes,
+			"count")
+		message.NewInt64Field(msg, name+"-ErrorCount", errCount, "count")
+		if f, err := message.NewField(name+"-AvgSuccessRate", successRate,
+			"%"); err == nil {
+			msg.AddField(f)
+		}
+		message.NewInt64Field(msg, name+"-AvgDuration", avgDuration, "ns")
+	}
+	return nil
+}
+
+// Logs a subdecoder's decode error if configured to do so, and returns it
+// prefixed with the subdecoder name for the aggregated error.
+func (md *MultiDecoder) subError(idx int, err error) string {
+	name := md.Config.Order[idx]
+	if md.Config.LogSubErrors {
+		md.dRunner.LogError(fmt.Errorf("Subdecoder '%s' decode error: %s", name, err))
+	}
+	return fmt.Sprintf("'%s': %s", name, err)
+}
+
+// Returns the error for a message none of the subdecoders could decode,
+// listing the errors they returned in order.
+func allSubsFailed(subErrs []string) error {
+	if len(subErrs) == 0 {
+		return errors.New("All subdecoders failed.")
+	}
+	return fmt.Errorf("All subdecoders failed: %s", strings.Join(subErrs, "; "))
+}
+
 // Runs the message payload against each of the decoders.
 func (md *MultiDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
 	var newType string
@@ -281,27 +379,26 @@ func (md *MultiDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err e
 	}
 	pack.Message.SetType(newType)
 
+	var subErrs []string
 	if md.CascStrat == CASC_FIRST_WINS {
-		for i, d := range md.ordered {
-			if packs, err = d.Decode(pack); packs != nil {
+		for i := range md.ordered {
+			if packs, err = md.subDecode(i, pack); packs != nil {
 				return
 			}
-			if err != nil && md.Config.LogSubErrors {
-				err = fmt.Errorf("Subdecoder '%s' decode error: %s", md.Config.Order[i],
-					err)
-				md.dRunner.LogError(err)
+			if err != nil {
+				subErrs = append(subErrs, md.subError(i, err))
 			}
 		}
 		// If we got this far none of the decoders succeeded.
-		err = errors.New("All subdecoders failed.")
+		err = allSubsFailed(subErrs)
 		packs = nil
 		pack.Recycle()
 	} else {
 		// If we get here we know cascade_strategy == "all.
 		var anyMatch bool
-		packs, anyMatch = md.getDecodedPacks(md.ordered, []*PipelinePack{pack})
+		packs, anyMatch, subErrs = md.getDecodedPacks(md.ordered, []*PipelinePack{pack})
 		if !anyMatch {
-			err = errors.New("All subdecoders failed.")
+			err = allSubsFailed(subErrs)
 			packs = nil
 			pack.Recycle()
 		}
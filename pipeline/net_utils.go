@@ -21,6 +21,7 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/subtle"
 	"fmt"
 	"github.com/mozilla-services/heka/client"
@@ -34,6 +35,10 @@ import (
 
 const NEWLINE byte = 10
 
+// Name of the message field holding the signer claimed by a message whose
+// signature didn't verify, see NetworkInputConfig.FailedAuthAction.
+const UNVERIFIED_SIGNER_FIELD = "UnverifiedSigner"
+
 // Create a protocol buffers stream for the given message, put it in the
 // provided byte slice.
 func ProtobufEncodeMessage(pack *PipelinePack, outBytes *[]byte) (err error) {
@@ -58,6 +63,29 @@ type NetworkInputConfig struct {
 	// String indicating if the delimiter is at the start or end of the line,
 	// only used for regexp delimiters
 	DelimiterLocation string `toml:"delimiter_location"`
+	// Name of a configured splitter used to break the stream up into
+	// messages, takes precedence over ParserType.
+	Splitter string
+	// What to do with messages whose signature doesn't verify: "drop"
+	// (default) or "tag", which passes them on with the claimed signer in
+	// the UnverifiedSigner field.
+	FailedAuthAction string `toml:"failed_auth_action"`
+	// Accept TLS connections only, TCP inputs only.
+	UseTls bool `toml:"use_tls"`
+	// TLS settings, used if UseTls is set.
+	Tls TlsConfig
+	// CIDR ranges or IPs whose connections (TCP) or packets (UDP) are
+	// accepted, all if empty.
+	Allow []string
+	// CIDR ranges or IPs that are rejected, takes precedence over Allow.
+	Deny []string
+	// Enable TCP keepalive probes on accepted connections, TCP inputs only.
+	KeepAlive bool `toml:"keep_alive"`
+	// Seconds between keepalive probes, the OS default if zero.
+	KeepAlivePeriod uint `toml:"keep_alive_period"`
+	// Seconds without any data after which a connection is closed, TCP
+	// inputs only. Zero never closes idle connections.
+	IdleTimeout uint `toml:"idle_timeout"`
 }
 
 type NetworkParseFunction func(conn net.Conn,
@@ -89,8 +117,13 @@ func NetworkPayloadParser(conn net.Conn,
 		if remoteAddr := conn.RemoteAddr(); remoteAddr != nil {
 			pack.Message.SetHostname(remoteAddr.String())
 		}
+		if identity := TlsPeerIdentity(conn); identity != "" {
+			NewStringField(pack.Message, TLS_PEER_FIELD, identity)
+		}
 		pack.Message.SetLogger(ir.Name())
 		pack.Message.SetPayload(string(record))
+		TagConnTenant(ir, pack, conn)
+		JournalPack(ir, pack, dr)
 		if dr == nil {
 			ir.Inject(pack)
 		} else {
@@ -126,6 +159,8 @@ func NetworkMessageProtoParser(conn net.Conn,
 			DecodeHeader(record[2:headerLen], header)
 			if authenticateMessage(config.Signers, header, record[headerLen:]) {
 				pack.Signer = header.GetHmacSigner()
+			} else if config.FailedAuthAction == "tag" {
+				pack.UnverifiedSigner = header.GetHmacSigner()
 			} else {
 				pack.Recycle()
 				return
@@ -136,11 +171,33 @@ func NetworkMessageProtoParser(conn net.Conn,
 		}
 		pack.MsgBytes = pack.MsgBytes[:messageLen]
 		copy(pack.MsgBytes, record[headerLen:])
+		pack.PeerIdentity = TlsPeerIdentity(conn)
+		TagConnTenant(ir, pack, conn)
+		JournalPack(ir, pack, dr)
 		dr.InChan() <- pack
 	}
 	return
 }
 
+// Returns a new instance of the input's configured splitter along with the
+// parse function handling its records.
+func NetworkSplitter(h PluginHelper, config *NetworkInputConfig) (
+	parser StreamParser, parseFunction NetworkParseFunction, err error) {
+
+	splitter, ok := h.Splitter(config.Splitter)
+	if !ok {
+		return nil, nil, fmt.Errorf("Splitter not found: %s", config.Splitter)
+	}
+	if UsesHekaFraming(splitter) {
+		if config.Decoder == "" {
+			return nil, nil, fmt.Errorf("The %s splitter must have a decoder",
+				config.Splitter)
+		}
+		return splitter, NetworkMessageProtoParser, nil
+	}
+	return splitter, NetworkPayloadParser, nil
+}
+
 // Heka Message signer object.
 type Signer struct {
 	HmacKey string `toml:"hmac_key"`
@@ -184,6 +241,10 @@ func authenticateMessage(signers map[string]Signer, header *Header, msg []byte)
 			hm = hmac.New(md5.New, []byte(key))
 		case Header_SHA1:
 			hm = hmac.New(sha1.New, []byte(key))
+		case Header_SHA256:
+			hm = hmac.New(sha256.New, []byte(key))
+		default:
+			return false
 		}
 		hm.Write(msg)
 		expectedDigest := hm.Sum(nil)
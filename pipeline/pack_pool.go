@@ -0,0 +1,168 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// How often an autoscaling pool checks whether it has to grow.
+const packPoolCheckInterval = 100 * time.Millisecond
+
+// How long at least half of an autoscaling pool has to be unused before it
+// shrinks.
+const packPoolShrinkDelay = time.Minute
+
+// A pool of PipelinePacks, i.e. the packs created for one of the recycle
+// channels. With autoscaling enabled (maxSize above minSize) the pool grows
+// by half its size whenever it runs dry, up to maxSize, and gives back half
+// of the unused packs once at least half of it has been idle for a while,
+// down to minSize.
+type packPool struct {
+	name    string
+	supply  chan *PipelinePack
+	tracker *DiagnosticTracker
+	minSize int
+	maxSize int
+	// Current number of packs, accessed atomically.
+	size int64
+	// When the pool started being mostly unused, zero if it isn't.
+	idleSince time.Time
+	stopChan  chan struct{}
+}
+
+// Creates the pool with minSize packs, which the tracker monitors. The
+// supply channel has to be able to hold maxSize packs.
+func newPackPool(name string, supply chan *PipelinePack, minSize, maxSize int) (
+	pool *packPool) {
+
+	if maxSize < minSize {
+		maxSize = minSize
+	}
+	pool = &packPool{
+		name:     name,
+		supply:   supply,
+		tracker:  NewDiagnosticTracker(name),
+		minSize:  minSize,
+		maxSize:  maxSize,
+		stopChan: make(chan struct{}),
+	}
+	pool.grow(minSize)
+	return
+}
+
+// Number of packs currently in the pool.
+func (p *packPool) Size() int {
+	return int(atomic.LoadInt64(&p.size))
+}
+
+// Size of the pool feeding the supply channel. It's the channel capacity
+// until the pipeline runs.
+func (pc *PipelineConfig) poolSize(pool *packPool, supply chan *PipelinePack) int {
+	if pool == nil {
+		return cap(supply)
+	}
+	return pool.Size()
+}
+
+func (p *packPool) grow(n int) {
+	for i := 0; i < n; i++ {
+		pack := NewPipelinePack(p.supply)
+		p.tracker.AddPack(pack)
+		atomic.AddInt64(&p.size, 1)
+		p.supply <- pack
+	}
+}
+
+// Releases up to n unused packs, returning how many were released.
+func (p *packPool) shrink(n int) (released int) {
+	for ; released < n; released++ {
+		select {
+		case pack := <-p.supply:
+			p.tracker.RemovePack(pack)
+			atomic.AddInt64(&p.size, -1)
+		default:
+			return
+		}
+	}
+	return
+}
+
+// Grows or shrinks the pool as needed, returning the change in size.
+func (p *packPool) scale(now time.Time) (delta int) {
+	size := p.Size()
+	free := len(p.supply)
+	if free == 0 && size < p.maxSize {
+		delta = size / 2
+		if delta < 1 {
+			delta = 1
+		}
+		if size+delta > p.maxSize {
+			delta = p.maxSize - size
+		}
+		p.grow(delta)
+		p.idleSince = time.Time{}
+		return
+	}
+	if size <= p.minSize || free <= size/2 {
+		p.idleSince = time.Time{}
+		return
+	}
+	if p.idleSince.IsZero() {
+		p.idleSince = now
+		return
+	}
+	if now.Sub(p.idleSince) < packPoolShrinkDelay {
+		return
+	}
+	n := free / 2
+	if size-n < p.minSize {
+		n = size - p.minSize
+	}
+	p.idleSince = now
+	return -p.shrink(n)
+}
+
+// Starts monitoring the packs and, if enabled, autoscaling the pool.
+func (p *packPool) Start(pc *PipelineConfig) {
+	p.tracker.pc = pc
+	go p.tracker.Run()
+	if p.maxSize <= p.minSize {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(packPoolCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if delta := p.scale(now); delta != 0 {
+					Globals().LogMessage("PackPool", fmt.Sprintf(
+						"(%s) pool size changed by %d to %d packs", p.name, delta,
+						p.Size()))
+				}
+			case <-p.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+// Stops autoscaling the pool.
+func (p *packPool) Stop() {
+	close(p.stopChan)
+}
@@ -0,0 +1,128 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"strings"
+	"time"
+)
+
+func PackPoolSpec(c gs.Context) {
+	pc := NewPipelineConfig(nil)
+	now := time.Now()
+
+	c.Specify("An autoscaling pack pool", func() {
+		pool := newPackPool("input", make(chan *PipelinePack, 10), 4, 10)
+		c.Expect(pool.Size(), gs.Equals, 4)
+
+		c.Specify("grows by half when it runs dry", func() {
+			held := make([]*PipelinePack, 0, 10)
+			take := func(n int) {
+				for i := 0; i < n; i++ {
+					held = append(held, <-pool.supply)
+				}
+			}
+			c.Expect(pool.scale(now), gs.Equals, 0)
+			take(4)
+			c.Expect(pool.scale(now), gs.Equals, 2)
+			c.Expect(pool.Size(), gs.Equals, 6)
+			take(2)
+			c.Expect(pool.scale(now), gs.Equals, 3)
+			take(3)
+			// Capped at the max size.
+			c.Expect(pool.scale(now), gs.Equals, 1)
+			take(1)
+			c.Expect(pool.scale(now), gs.Equals, 0)
+			c.Expect(pool.Size(), gs.Equals, 10)
+			c.Expect(len(pool.tracker.packs), gs.Equals, 10)
+
+			c.Specify("and shrinks once mostly unused for a while", func() {
+				for _, pack := range held {
+					pack.Recycle()
+				}
+				c.Expect(pool.scale(now), gs.Equals, 0)
+				c.Expect(pool.scale(now.Add(time.Second)), gs.Equals, 0)
+				later := now.Add(packPoolShrinkDelay)
+				c.Expect(pool.scale(later), gs.Equals, -5)
+				c.Expect(pool.scale(later.Add(packPoolShrinkDelay)), gs.Equals, -1)
+				c.Expect(pool.Size(), gs.Equals, 4)
+				c.Expect(len(pool.supply), gs.Equals, 4)
+				c.Expect(len(pool.tracker.packs), gs.Equals, 4)
+			})
+		})
+	})
+
+	c.Specify("A diagnostic tracker", func() {
+		tracker := NewDiagnosticTracker("inject")
+		supply := make(chan *PipelinePack, 4)
+		for i := 0; i < cap(supply); i++ {
+			pack := NewPipelinePack(supply)
+			tracker.AddPack(pack)
+		}
+		counter := NewFORunner("counter", new(CounterFilter), nil)
+		output := NewFORunner("output", new(CounterFilter), nil)
+		idleMax := time.Minute
+		stale := now.Add(-2 * idleMax)
+		tracker.packs[0].diagnostics.Stamp(counter)
+		tracker.packs[0].diagnostics.LastAccess = stale
+		tracker.packs[1].diagnostics.Stamp(counter)
+		tracker.packs[1].diagnostics.LastAccess = now.Add(-3 * idleMax)
+		tracker.packs[2].diagnostics.Stamp(output)
+		tracker.packs[2].diagnostics.LastAccess = stale
+		// Recently stamped.
+		tracker.packs[3].diagnostics.Stamp(output)
+
+		c.Specify("finds the plugins holding idle packs", func() {
+			idle, holders := tracker.check(now, idleMax)
+			c.Expect(idle, gs.Equals, 3)
+			c.Assume(len(holders), gs.Equals, 2)
+			c.Expect(holders[0].runner.Name(), gs.Equals, "counter")
+			c.Expect(holders[0].count, gs.Equals, 2)
+			c.Expect(holders[0].oldest, gs.Equals, now.Add(-3*idleMax))
+			c.Expect(counter.LeakCount(), gs.Equals, 2)
+			c.Expect(output.LeakCount(), gs.Equals, 1)
+
+			c.Specify("and resets their leak count once they let go", func() {
+				tracker.packs[2].diagnostics.Reset()
+				tracker.check(now, idleMax)
+				c.Expect(output.LeakCount(), gs.Equals, 0)
+				c.Expect(counter.LeakCount(), gs.Equals, 2)
+			})
+
+			c.Specify("and injects a diagnostic message", func() {
+				tracker.pc = pc
+				tracker.sendDiagnostics(now, idle, holders)
+				pack := <-pc.router.InChan()
+				msg := pack.Message
+				c.Expect(msg.GetType(), gs.Equals, "heka.pack-diagnostics")
+				lines := strings.Split(msg.GetPayload(), "\n")
+				c.Assume(len(lines), gs.Equals, 2)
+				c.Expect(lines[0], gs.Equals, "counter: 2 packs, oldest idle 3m0s")
+				value, _ := msg.GetFieldValue("Pool")
+				c.Expect(value, gs.Equals, "inject")
+				value, _ = msg.GetFieldValue("IdlePacks")
+				c.Expect(value, gs.Equals, int64(3))
+				value, _ = msg.GetFieldValue("TopHolder")
+				c.Expect(value, gs.Equals, "counter")
+
+				// Skipped while the previous message is in flight.
+				tracker.sendDiagnostics(now, idle, holders)
+				c.Expect(len(pc.router.InChan()), gs.Equals, 0)
+				pack.Recycle()
+			})
+		})
+	})
+}
@@ -15,8 +15,13 @@
 package pipeline
 
 import (
+	"code.google.com/p/go-uuid/uuid"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	"log"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -73,65 +78,191 @@ func (p *PacketTracking) Runners() (runners []PluginRunner) {
 type DiagnosticTracker struct {
 	// Track all the packs that have been created
 	packs []*PipelinePack
+	lock  sync.Mutex
 
 	// Identify the name of the recycle channel it monitors packs for
 	ChannelName string
+
+	// Pipeline the diagnostic messages are injected into, they're only
+	// logged if nil.
+	pc *PipelineConfig
+	// Single pack used for the diagnostic messages, so they can be sent
+	// even if the monitored pool has run dry.
+	msgSupply chan *PipelinePack
+	// Plugins whose leak count was set by the previous check.
+	leakers map[PluginRunner]bool
 }
 
 // Create and return a new diagnostic tracker
 func NewDiagnosticTracker(channelName string) *DiagnosticTracker {
-	return &DiagnosticTracker{make([]*PipelinePack, 0, 50), channelName}
+	return &DiagnosticTracker{
+		packs:       make([]*PipelinePack, 0, 50),
+		ChannelName: channelName,
+		leakers:     make(map[PluginRunner]bool),
+	}
 }
 
 // Add a pipeline pack for monitoring
 func (d *DiagnosticTracker) AddPack(pack *PipelinePack) {
+	d.lock.Lock()
 	d.packs = append(d.packs, pack)
+	d.lock.Unlock()
+}
+
+// Stops monitoring a pipeline pack, e.g. when the pool shrinks.
+func (d *DiagnosticTracker) RemovePack(pack *PipelinePack) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for i, p := range d.packs {
+		if p == pack {
+			last := len(d.packs) - 1
+			d.packs[i] = d.packs[last]
+			d.packs[last] = nil
+			d.packs = d.packs[:last]
+			return
+		}
+	}
+}
+
+// Packs held by one plugin for longer than the max pack idle time.
+type idlePackHolder struct {
+	runner PluginRunner
+	count  int
+	// Time the longest held pack was last handed on.
+	oldest time.Time
+}
+
+type idlePackHolders []*idlePackHolder
+
+func (h idlePackHolders) Len() int      { return len(h) }
+func (h idlePackHolders) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h idlePackHolders) Less(i, j int) bool {
+	if h[i].count != h[j].count {
+		return h[i].count > h[j].count
+	}
+	return h[i].oldest.Before(h[j].oldest)
+}
+
+// Finds the packs that haven't been touched in idleMax and the plugins that
+// hold them, most packs first. The leak count of each of these plugins is
+// updated, and reset for plugins that no longer hold idle packs.
+func (d *DiagnosticTracker) check(now time.Time, idleMax time.Duration) (
+	idle int, holders idlePackHolders) {
+
+	byRunner := make(map[PluginRunner]*idlePackHolder)
+	earliestAccess := now.Add(-idleMax)
+	d.lock.Lock()
+	for _, pack := range d.packs {
+		if len(pack.diagnostics.lastPlugins) == 0 {
+			continue
+		}
+		if !pack.diagnostics.LastAccess.Before(earliestAccess) {
+			continue
+		}
+		idle++
+		for _, runner := range pack.diagnostics.Runners() {
+			holder, ok := byRunner[runner]
+			if !ok {
+				holder = &idlePackHolder{runner: runner, oldest: now}
+				byRunner[runner] = holder
+				holders = append(holders, holder)
+			}
+			holder.count++
+			if pack.diagnostics.LastAccess.Before(holder.oldest) {
+				holder.oldest = pack.diagnostics.LastAccess
+			}
+		}
+	}
+	d.lock.Unlock()
+	sort.Sort(holders)
+
+	for runner := range d.leakers {
+		if _, ok := byRunner[runner]; !ok {
+			runner.SetLeakCount(0)
+			delete(d.leakers, runner)
+		}
+	}
+	for runner, holder := range byRunner {
+		runner.SetLeakCount(holder.count)
+		d.leakers[runner] = true
+	}
+	return
+}
+
+// Maximum number of plugins named by the diagnostic message.
+const diagnosticTopHolders = 10
+
+// Sends a heka.pack-diagnostics message naming the plugins holding the most
+// idle packs and for how long. Skipped if the previous message is still in
+// flight or the router is backed up.
+func (d *DiagnosticTracker) sendDiagnostics(now time.Time, idle int,
+	holders idlePackHolders) {
+
+	if d.pc == nil {
+		return
+	}
+	if d.msgSupply == nil {
+		d.msgSupply = make(chan *PipelinePack, 1)
+		d.msgSupply <- NewPipelinePack(d.msgSupply)
+	}
+	var pack *PipelinePack
+	select {
+	case pack = <-d.msgSupply:
+	default:
+		return
+	}
+
+	lines := make([]string, 0, diagnosticTopHolders)
+	for i, holder := range holders {
+		if i == diagnosticTopHolders {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%s: %d packs, oldest idle %s",
+			holder.runner.Name(), holder.count, now.Sub(holder.oldest)))
+	}
+	msg := pack.Message
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(now.UnixNano())
+	msg.SetType("heka.pack-diagnostics")
+	msg.SetLogger("hekad")
+	msg.SetSeverity(4)
+	msg.SetPayload(strings.Join(lines, "\n"))
+	message.NewStringField(msg, "Pool", d.ChannelName)
+	message.NewIntField(msg, "IdlePacks", idle, "count")
+	d.lock.Lock()
+	message.NewIntField(msg, "PoolSize", len(d.packs), "count")
+	d.lock.Unlock()
+	if len(holders) > 0 {
+		message.NewStringField(msg, "TopHolder", holders[0].runner.Name())
+	}
+	select {
+	case d.pc.router.InChan() <- pack:
+	default:
+		pack.Recycle()
+	}
 }
 
 // Run the monitoring routine, this should be spun up in a new goroutine
 func (d *DiagnosticTracker) Run() {
-	var (
-		pack           *PipelinePack
-		earliestAccess time.Time
-		pluginCounts   map[PluginRunner]int
-		count          int
-		runner         PluginRunner
-	)
 	g := Globals()
 	idleMax := g.MaxPackIdle
-	probablePacks := make([]*PipelinePack, 0, len(d.packs))
 	ticker := time.NewTicker(time.Duration(30) * time.Second)
 	for {
-		<-ticker.C
-		probablePacks = probablePacks[:0]
-		pluginCounts = make(map[PluginRunner]int)
-
-		// Locate all the packs that have not been touched in idleMax duration
-		// that are not recycled
-		earliestAccess = time.Now().Add(-idleMax)
-		for _, pack = range d.packs {
-			if len(pack.diagnostics.lastPlugins) == 0 {
-				continue
-			}
-			if pack.diagnostics.LastAccess.Before(earliestAccess) {
-				probablePacks = append(probablePacks, pack)
-				for _, runner = range pack.diagnostics.Runners() {
-					pluginCounts[runner] += 1
-				}
-			}
-		}
+		now := <-ticker.C
+		idle, holders := d.check(now, idleMax)
 
 		// Drop a warning about how many packs have been idle
-		if len(probablePacks) > 0 {
-			g.LogMessage("Diagnostics", fmt.Sprintf("%d packs have been idle more than %d seconds.",
-				d.ChannelName, len(probablePacks), idleMax))
+		if idle > 0 {
+			g.LogMessage("Diagnostics", fmt.Sprintf("(%s) %d packs have been idle more than %s.",
+				d.ChannelName, idle, idleMax))
 			g.LogMessage("Diagnostics", fmt.Sprintf("(%s) Plugin names and quantities found on idle packs:",
 				d.ChannelName))
-			for runner, count = range pluginCounts {
-				runner.SetLeakCount(count)
-				g.LogMessage("Diagnostics", fmt.Sprintf("\t%s: %d", runner.Name(), count))
+			for _, holder := range holders {
+				g.LogMessage("Diagnostics", fmt.Sprintf("\t%s: %d", holder.runner.Name(),
+					holder.count))
 			}
 			log.Println("")
+			d.sendDiagnostics(now, idle, holders)
 		}
 	}
 }
@@ -22,7 +22,6 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -36,7 +35,10 @@ const (
 
 // Struct for holding global pipeline config values.
 type GlobalConfigStruct struct {
-	PoolSize              int
+	PoolSize int
+	// Largest size the pack pools may grow to when they run dry, autoscaling
+	// is disabled if it's not above PoolSize.
+	MaxPoolSize           int
 	DecoderPoolSize       int
 	PluginChanSize        int
 	MaxMsgLoops           uint
@@ -46,12 +48,80 @@ type GlobalConfigStruct struct {
 	MaxPackIdle           time.Duration
 	Stopping              bool
 	BaseDir               string
-	sigChan               chan os.Signal
+	// Address for the admin HTTP API, which is disabled if empty.
+	AdminAddr string
+	// Path of a unix domain socket also serving the admin API, and the
+	// permissions it's created with.
+	AdminSocket     string
+	AdminSocketMode os.FileMode
+	// Address serving the plugin metrics in the Prometheus text format,
+	// which is disabled if empty.
+	MetricsAddr string
+	// Number of goroutines the router uses to deliver messages.
+	RouterWorkers int
+	// Message field used to assign messages to router workers. Messages with
+	// the same value are delivered in order.
+	RouterShardField string
+	// Total bytes all of the watched queue and output directories may use
+	// together, zero is unlimited.
+	DiskBudgetTotal uint64
+	// What to do when a disk budget is exceeded: "block", "drop_oldest" or
+	// "alert".
+	DiskFullAction string
+	// How often the disk usage of the watched directories is checked.
+	DiskCheckInterval time.Duration
+	// Maximum total length of the keys and values in a plugin's key/value
+	// store, zero is unlimited.
+	KVStoreMaxSize uint64
+	// How often changed key/value stores are written to disk.
+	KVStoreFlushInterval time.Duration
+	// How often the lookup table files are checked for changes.
+	LookupCheckInterval time.Duration
+	// Output receiving undecodable and fatally rejected messages.
+	DeadLetterOutput string
+	// Protobuf stream file the dead letters are appended to if there's no
+	// DeadLetterOutput.
+	DeadLetterFile string
+	// Delegated cgroup (v2) directory hekad moves itself into, needed for
+	// the cgroups section.
+	Cgroup string
+	// Memory limit in bytes for hekad's cgroup, zero is unlimited.
+	CgroupMemoryMax uint64
+	// Longest a plugin waits for the plugins it depends on to be ready
+	// before starting anyway.
+	DependencyTimeout time.Duration
+	// How long the report history served by the admin API goes back,
+	// disabled if zero, and how often the reports are sampled into it.
+	ReportHistory         time.Duration
+	ReportHistoryInterval time.Duration
+	// Length of the volume accounting intervals, most sources tracked per
+	// interval, the others being lumped together, and whether a message is
+	// injected for each source at the end of an interval.
+	VolumeInterval     time.Duration
+	VolumeMaxSources   int
+	EmitVolumeMessages bool
+	// Identity stamped as the Hostname of the messages hekad generates, the
+	// OS hostname by default, and the message field it's also added in, if
+	// any.
+	Hostname      string
+	IdentityField string
+	// Most messages kept per matcher class for replay to filters.
+	ReplayMaxMessages int
+	// Directory the admin API's snapshots are written to, `snapshots` in
+	// the BaseDir if empty.
+	SnapshotDir string
+	// Encrypts the messages written to the disk queues, disabled if nil.
+	SpoolCipher *SpoolCipher `json:"-"`
+	// Decrypts the "enc:" prefixed plugin config values, which are rejected
+	// if nil.
+	ConfigCipher *SpoolCipher `json:"-"`
+	sigChan      chan os.Signal
 }
 
 // Creates a GlobalConfigStruct object populated w/ default values.
 func DefaultGlobals() (globals *GlobalConfigStruct) {
 	idle, _ := time.ParseDuration("2m")
+	hostname, _ := os.Hostname()
 	return &GlobalConfigStruct{
 		PoolSize:              100,
 		DecoderPoolSize:       2,
@@ -61,6 +131,21 @@ func DefaultGlobals() (globals *GlobalConfigStruct) {
 		MaxMsgProcessDuration: 1000000,
 		MaxMsgTimerInject:     10,
 		MaxPackIdle:           idle,
+		RouterWorkers:         1,
+		RouterShardField:      "Logger",
+		DiskFullAction:        DISK_FULL_BLOCK,
+		DiskCheckInterval:     10 * time.Second,
+		KVStoreMaxSize:        1 << 20,
+		KVStoreFlushInterval:  10 * time.Second,
+		LookupCheckInterval:   5 * time.Second,
+		DependencyTimeout:     30 * time.Second,
+		ReportHistoryInterval: time.Minute,
+		VolumeInterval:        time.Minute,
+		VolumeMaxSources:      1000,
+		EmitVolumeMessages:    true,
+		Hostname:              hostname,
+		ReplayMaxMessages:     10000,
+		AdminSocketMode:       0600,
 		sigChan:               make(chan os.Signal, 1),
 	}
 }
@@ -113,11 +198,24 @@ type PipelinePack struct {
 	// String id of the verified signer of the accompanying Message object, if
 	// any.
 	Signer string
+	// Common name of the certificate presented by the sending end of a TLS
+	// connection, if any. Added to the message as a field when it's decoded.
+	PeerIdentity string
+	// Signer claimed by a message whose signature didn't verify, if the input
+	// passes such messages on. Added to the message as a field when it's
+	// decoded.
+	UnverifiedSigner string
+	// Declared tenant the message belongs to, if any, set by the input that
+	// received it. Added to the message as a field when it's decoded.
+	Tenant string
 	// Number of times the current message chain has generated new messages
 	// and inserted them into the pipeline.
 	MsgLoopCount uint
 	// Used internally to stamp diagnostic information onto a packet
 	diagnostics *PacketTracking
+	// Input journal holding the pack's record until it's delivered, if any.
+	journal    *inputJournal
+	journalSeq uint64
 }
 
 // Returns a new PipelinePack pointer that will recycle itself onto the
@@ -140,11 +238,15 @@ func NewPipelinePack(recycleChan chan *PipelinePack) (pack *PipelinePack) {
 
 // Reset a pack to its zero state.
 func (p *PipelinePack) Zero() {
+	p.commitJournal()
 	p.MsgBytes = p.MsgBytes[:cap(p.MsgBytes)]
 	p.Decoded = false
 	p.RefCount = 1
 	p.MsgLoopCount = 0
 	p.Signer = ""
+	p.PeerIdentity = ""
+	p.UnverifiedSigner = ""
+	p.Tenant = ""
 	p.diagnostics.Reset()
 
 	// TODO: Possibly zero the message instead depending on benchmark
@@ -164,67 +266,144 @@ func (p *PipelinePack) Recycle() {
 	}
 }
 
+// Number of packs a RecycleBatcher holds on to before recycling them.
+const RECYCLE_BATCH_SIZE = 16
+
+// Recycles every pack in the batch, zeroing all of the freed packs before
+// putting them back on their recycle channels in one burst. Returns the
+// emptied slice so it can be reused for the next batch.
+func RecycleBatch(packs []*PipelinePack) []*PipelinePack {
+	freed := packs[:0]
+	for _, p := range packs {
+		if atomic.AddInt32(&p.RefCount, -1) == 0 {
+			p.Zero()
+			freed = append(freed, p)
+		}
+	}
+	for _, p := range freed {
+		p.RecycleChan <- p
+	}
+	for i := range packs {
+		packs[i] = nil
+	}
+	return packs[:0]
+}
+
+// Collects the packs a busy plugin is done with and recycles them with
+// RecycleBatch, so it hands them back in bursts rather than interleaving a
+// recycle channel send with every message it processes. Packs come from a
+// fixed size pool, so the batch is also recycled whenever the plugin has no
+// more input waiting, otherwise the pool could run dry.
+type RecycleBatcher struct {
+	packs []*PipelinePack
+}
+
+// Adds a pack to the batch, given the number of packs still waiting on the
+// plugin's input channel.
+func (b *RecycleBatcher) Add(pack *PipelinePack, waiting int) {
+	b.packs = append(b.packs, pack)
+	if len(b.packs) >= RECYCLE_BATCH_SIZE || waiting == 0 {
+		b.packs = RecycleBatch(b.packs)
+	}
+}
+
+// Recycles any packs left in the batch.
+func (b *RecycleBatcher) Flush() {
+	if len(b.packs) > 0 {
+		b.packs = RecycleBatch(b.packs)
+	}
+}
+
 // Main function driving Heka execution. Loads config, initializes
 // PipelinePack pools, and starts all the runners. Then it listens for signals
 // and drives the shutdown process when that is triggered.
 func Run(config *PipelineConfig) {
 	log.Println("Starting hekad...")
 
-	var outputsWg sync.WaitGroup
-	var err error
-
 	globals := Globals()
 
-	for name, output := range config.OutputRunners {
-		outputsWg.Add(1)
-		if err = output.Start(config, &outputsWg); err != nil {
-			log.Printf("Output '%s' failed to start: %s", name, err)
-			outputsWg.Done()
-			continue
-		}
-		log.Println("Output started: ", name)
+	names := make([]string, 0, len(config.OutputRunners))
+	for name := range config.OutputRunners {
+		names = append(names, name)
 	}
+	config.startInOrder("Output", names, func(name string) (err error) {
+		config.outputsWg.Add(1)
+		if err = config.OutputRunners[name].Start(config, &config.outputsWg); err != nil {
+			config.outputsWg.Done()
+		}
+		return
+	})
 
-	for name, filter := range config.FilterRunners {
+	names = make([]string, 0, len(config.FilterRunners))
+	for name := range config.FilterRunners {
+		names = append(names, name)
+	}
+	config.startInOrder("Filter", names, func(name string) (err error) {
 		config.filtersWg.Add(1)
-		if err = filter.Start(config, &config.filtersWg); err != nil {
-			log.Printf("Filter '%s' failed to start: %s", name, err)
+		if err = config.FilterRunners[name].Start(config, &config.filtersWg); err != nil {
 			config.filtersWg.Done()
-			continue
 		}
-		log.Println("Filter started: ", name)
-	}
-
-	// Setup the diagnostic trackers
-	inputTracker := NewDiagnosticTracker("input")
-	injectTracker := NewDiagnosticTracker("inject")
+		return
+	})
 
 	// Create the report pipeline pack
 	config.reportRecycleChan <- NewPipelinePack(config.reportRecycleChan)
 
-	// Initialize all of the PipelinePacks that we'll need
-	for i := 0; i < Globals().PoolSize; i++ {
-		inputPack := NewPipelinePack(config.inputRecycleChan)
-		inputTracker.AddPack(inputPack)
-		config.inputRecycleChan <- inputPack
-
-		injectPack := NewPipelinePack(config.injectRecycleChan)
-		injectTracker.AddPack(injectPack)
-		config.injectRecycleChan <- injectPack
-	}
-
-	go inputTracker.Run()
-	go injectTracker.Run()
+	// Initialize all of the PipelinePacks that we'll need, the pools start
+	// the diagnostic trackers monitoring them.
+	config.inputPool = newPackPool("input", config.inputRecycleChan,
+		globals.PoolSize, globals.MaxPoolSize)
+	config.injectPool = newPackPool("inject", config.injectRecycleChan,
+		globals.PoolSize, globals.MaxPoolSize)
+	config.inputPool.Start(config)
+	config.injectPool.Start(config)
 	config.router.Start()
 
-	for name, input := range config.InputRunners {
+	names = make([]string, 0, len(config.InputRunners))
+	for name := range config.InputRunners {
+		names = append(names, name)
+	}
+	config.startInOrder("Input", names, func(name string) (err error) {
 		config.inputsWg.Add(1)
-		if err = input.Start(config, &config.inputsWg); err != nil {
-			log.Printf("Input '%s' failed to start: %s", name, err)
+		if err = config.InputRunners[name].Start(config, &config.inputsWg); err != nil {
 			config.inputsWg.Done()
-			continue
 		}
-		log.Printf("Input started: %s\n", name)
+		return
+	})
+
+	go config.diskWatchdog.Run()
+	go config.runKVStoreFlusher(globals.KVStoreFlushInterval)
+	go config.runLookupTableWatcher(globals.LookupCheckInterval)
+	if config.reportHistory != nil {
+		go config.runReportHistory()
+	}
+	go config.runVolumeAccounting(globals.EmitVolumeMessages)
+	go config.injectDeprecationMessages()
+
+	if globals.AdminAddr != "" {
+		if adminListener, err := config.startAdminServer(globals.AdminAddr); err != nil {
+			log.Printf("Admin API failed to start: %s", err)
+		} else {
+			log.Printf("Admin API listening on %s", globals.AdminAddr)
+			defer adminListener.Close()
+		}
+	}
+	if globals.AdminSocket != "" {
+		if adminListener, err := config.startAdminSocket(globals.AdminSocket,
+			globals.AdminSocketMode); err != nil {
+			log.Printf("Admin API socket failed to start: %s", err)
+		} else {
+			log.Printf("Admin API listening on %s", globals.AdminSocket)
+			defer adminListener.Close()
+		}
+	}
+	if globals.MetricsAddr != "" {
+		if metricsListener, err := config.startMetricsServer(globals.MetricsAddr); err != nil {
+			log.Printf("Metrics exporter failed to start: %s", err)
+		} else {
+			log.Printf("Metrics exporter listening on %s", globals.MetricsAddr)
+			defer metricsListener.Close()
+		}
 	}
 
 	// wait for sigint
@@ -236,6 +415,11 @@ func Run(config *PipelineConfig) {
 			switch sig {
 			case syscall.SIGHUP:
 				log.Println("Reload initiated.")
+				go func() {
+					if err := config.Reload(); err != nil {
+						log.Println("Config reload failed: ", err)
+					}
+				}()
 				if err := notify.Post(RELOAD, nil); err != nil {
 					log.Println("Error sending reload event: ", err)
 				}
@@ -249,6 +433,7 @@ func Run(config *PipelineConfig) {
 		}
 	}
 
+	config.diskWatchdog.Stop()
 	config.inputsLock.Lock()
 	for _, input := range config.InputRunners {
 		input.Input().Stop()
@@ -278,10 +463,22 @@ func Run(config *PipelineConfig) {
 	config.filtersLock.Unlock()
 	config.filtersWg.Wait()
 
+	// The lock isn't held while the router removes the matchers, isolated
+	// plugins look their failover output up from the router goroutine.
+	config.outputsLock.Lock()
+	outputs := make([]OutputRunner, 0, len(config.OutputRunners))
 	for _, output := range config.OutputRunners {
+		outputs = append(outputs, output)
+	}
+	config.outputsLock.Unlock()
+	for _, output := range outputs {
 		config.router.RemoveOutputMatcher() <- output.MatchRunner()
 		log.Printf("Stop message sent to output '%s'", output.Name())
 	}
-	outputsWg.Wait()
+	config.outputsWg.Wait()
+	config.inputPool.Stop()
+	config.injectPool.Stop()
+	config.flushKVStores()
+	config.deadLetters.close()
 	log.Println("Shutdown complete.")
 }
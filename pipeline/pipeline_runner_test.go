@@ -0,0 +1,92 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"testing"
+)
+
+func RecycleBatchSpec(c gs.Context) {
+	recycleChan := make(chan *PipelinePack, RECYCLE_BATCH_SIZE+1)
+	newPacks := func(n int) []*PipelinePack {
+		packs := make([]*PipelinePack, n)
+		for i := range packs {
+			packs[i] = NewPipelinePack(recycleChan)
+			packs[i].Message.SetType("used")
+		}
+		return packs
+	}
+
+	c.Specify("RecycleBatch", func() {
+		c.Specify("recycles the packs that aren't referenced anymore", func() {
+			packs := newPacks(3)
+			packs[1].RefCount = 2
+			packs = RecycleBatch(packs)
+			c.Expect(len(packs), gs.Equals, 0)
+			c.Expect(len(recycleChan), gs.Equals, 2)
+			for i := 0; i < 2; i++ {
+				pack := <-recycleChan
+				c.Expect(pack.Message.GetType(), gs.Equals, "")
+				c.Expect(pack.RefCount, gs.Equals, int32(1))
+			}
+		})
+	})
+
+	c.Specify("A RecycleBatcher", func() {
+		var recycler RecycleBatcher
+		packs := newPacks(RECYCLE_BATCH_SIZE + 1)
+
+		c.Specify("holds on to the packs while more are waiting", func() {
+			for _, pack := range packs[:RECYCLE_BATCH_SIZE-1] {
+				recycler.Add(pack, 1)
+			}
+			c.Expect(len(recycleChan), gs.Equals, 0)
+			recycler.Add(packs[RECYCLE_BATCH_SIZE-1], 1)
+			c.Expect(len(recycleChan), gs.Equals, RECYCLE_BATCH_SIZE)
+			recycler.Add(packs[RECYCLE_BATCH_SIZE], 1)
+			c.Expect(len(recycleChan), gs.Equals, RECYCLE_BATCH_SIZE)
+			recycler.Flush()
+			c.Expect(len(recycleChan), gs.Equals, RECYCLE_BATCH_SIZE+1)
+		})
+
+		c.Specify("recycles the batch once the input runs dry", func() {
+			recycler.Add(packs[0], 2)
+			recycler.Add(packs[1], 0)
+			c.Expect(len(recycleChan), gs.Equals, 2)
+		})
+	})
+}
+
+func BenchmarkRecycle(b *testing.B) {
+	recycleChan := make(chan *PipelinePack, 1)
+	recycleChan <- NewPipelinePack(recycleChan)
+	for i := 0; i < b.N; i++ {
+		pack := <-recycleChan
+		pack.Recycle()
+	}
+}
+
+func BenchmarkRecycleBatch(b *testing.B) {
+	recycleChan := make(chan *PipelinePack, RECYCLE_BATCH_SIZE)
+	for i := 0; i < RECYCLE_BATCH_SIZE; i++ {
+		recycleChan <- NewPipelinePack(recycleChan)
+	}
+	var recycler RecycleBatcher
+	for i := 0; i < b.N; i++ {
+		recycler.Add(<-recycleChan, len(recycleChan))
+	}
+	recycler.Flush()
+}
@@ -0,0 +1,279 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Startup states of the inputs, filters and outputs, see PluginState.
+const (
+	// Not started yet, e.g. waiting on its dependencies.
+	PLUGIN_PENDING = "pending"
+	// Started, but its Ready method doesn't report it ready yet.
+	PLUGIN_STARTING = "starting"
+	// Started and ready.
+	PLUGIN_READY = "ready"
+	// Failed to start, or not started because a dependency failed.
+	PLUGIN_FAILED = "failed"
+)
+
+// How often the dependencies of a plugin waiting to start are checked.
+var dependencyPollInterval = 100 * time.Millisecond
+
+// Order in which the plugin categories are started, plugins can only depend
+// on plugins starting before them. Decoders are started by the inputs using
+// them, so are always available.
+var categoryStartOrder = map[string]int{
+	"Decoder": 0,
+	"Output":  1,
+	"Filter":  2,
+	"Input":   3,
+}
+
+// Returns the runner of the named input, filter or output, if there is one.
+func (self *PipelineConfig) pluginRunner(name string) (runner PluginRunner) {
+	var ok bool
+	self.outputsLock.Lock()
+	runner, ok = self.OutputRunners[name]
+	self.outputsLock.Unlock()
+	if ok {
+		return
+	}
+	self.filtersLock.Lock()
+	runner, ok = self.FilterRunners[name]
+	self.filtersLock.Unlock()
+	if ok {
+		return
+	}
+	self.inputsLock.Lock()
+	runner = self.InputRunners[name]
+	self.inputsLock.Unlock()
+	return
+}
+
+// Returns the startup state of the named input, filter or output, one of the
+// PLUGIN_* values, or an empty string if there's no such plugin.
+func (self *PipelineConfig) PluginState(name string) string {
+	runner := self.pluginRunner(name)
+	if runner == nil {
+		return ""
+	}
+	return self.runnerState(runner)
+}
+
+// Returns the startup state of the runner. Doesn't take the runner map locks,
+// so it can be used while they're held.
+func (self *PipelineConfig) runnerState(runner PluginRunner) string {
+	self.pluginStatesLock.Lock()
+	state, ok := self.pluginStates[runner.Name()]
+	self.pluginStatesLock.Unlock()
+	if !ok {
+		return PLUGIN_PENDING
+	}
+	if state == PLUGIN_STARTING {
+		if checker, ok := runner.Plugin().(ReadyChecker); !ok || checker.Ready() {
+			state = PLUGIN_READY
+		}
+	}
+	return state
+}
+
+// Returns the inputs, filters and outputs that aren't ready, by name, along
+// with their state.
+func (self *PipelineConfig) notReady() map[string]string {
+	notReady := make(map[string]string)
+	check := func(runner PluginRunner) {
+		if state := self.runnerState(runner); state != PLUGIN_READY {
+			notReady[runner.Name()] = state
+		}
+	}
+	self.inputsLock.Lock()
+	for _, runner := range self.InputRunners {
+		check(runner)
+	}
+	self.inputsLock.Unlock()
+	self.filtersLock.Lock()
+	for _, runner := range self.FilterRunners {
+		check(runner)
+	}
+	self.filtersLock.Unlock()
+	self.outputsLock.Lock()
+	for _, runner := range self.OutputRunners {
+		check(runner)
+	}
+	self.outputsLock.Unlock()
+	return notReady
+}
+
+func (self *PipelineConfig) setPluginState(name, state string) {
+	self.pluginStatesLock.Lock()
+	self.pluginStates[name] = state
+	self.pluginStatesLock.Unlock()
+}
+
+func (self *PipelineConfig) setDependencies(name string, deps []string) {
+	self.pluginStatesLock.Lock()
+	if len(deps) > 0 {
+		self.pluginDeps[name] = deps
+	} else {
+		delete(self.pluginDeps, name)
+	}
+	self.pluginStatesLock.Unlock()
+}
+
+// Returns the plugin's `depends_on` setting.
+func (self *PipelineConfig) dependencies(name string) []string {
+	self.pluginStatesLock.Lock()
+	defer self.pluginStatesLock.Unlock()
+	return self.pluginDeps[name]
+}
+
+// Drops the dependencies and startup state of a plugin that was removed.
+func (self *PipelineConfig) forgetPlugin(name string) {
+	self.pluginStatesLock.Lock()
+	delete(self.pluginDeps, name)
+	delete(self.pluginStates, name)
+	self.pluginStatesLock.Unlock()
+}
+
+// Checks that every plugin's `depends_on` names plugins that exist and start
+// before it, and that there are no cycles.
+func (self *PipelineConfig) checkDependencies() error {
+	names := make([]string, 0, len(self.pluginDeps))
+	for name := range self.pluginDeps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		category := self.sectionCategories[name]
+		for _, dep := range self.pluginDeps[name] {
+			depCategory, ok := self.sectionCategories[dep]
+			if !ok {
+				return fmt.Errorf("'%s' depends on unknown plugin '%s'", name, dep)
+			}
+			if _, ok = categoryStartOrder[depCategory]; !ok {
+				return fmt.Errorf("'%s' can't depend on %s '%s'", name,
+					strings.ToLower(depCategory), dep)
+			}
+			if categoryStartOrder[depCategory] > categoryStartOrder[category] {
+				return fmt.Errorf("'%s' can't depend on %s '%s', which starts after it",
+					name, strings.ToLower(depCategory), dep)
+			}
+		}
+	}
+	visiting := make(map[string]bool)
+	done := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		if done[name] {
+			return nil
+		}
+		path = append(path, name)
+		if visiting[name] {
+			return fmt.Errorf("dependency cycle: %s", strings.Join(path, " -> "))
+		}
+		visiting[name] = true
+		for _, dep := range self.pluginDeps[name] {
+			if err := visit(dep, path); err != nil {
+				return err
+			}
+		}
+		done[name] = true
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the names in the order they should be started, dependencies
+// first and otherwise alphabetical.
+func (self *PipelineConfig) startupOrder(names []string) (ordered []string) {
+	sort.Strings(names)
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+	added := make(map[string]bool, len(names))
+	var add func(name string)
+	add = func(name string) {
+		if added[name] || !wanted[name] {
+			return
+		}
+		added[name] = true
+		for _, dep := range self.dependencies(name) {
+			add(dep)
+		}
+		ordered = append(ordered, name)
+	}
+	for _, name := range names {
+		add(name)
+	}
+	return
+}
+
+// Waits until the plugin's dependencies are ready, or the
+// `dependency_timeout` is up. Returns an error if one of them failed.
+func (self *PipelineConfig) awaitDependencies(name string) error {
+	deadline := time.Now().Add(Globals().DependencyTimeout)
+	for _, dep := range self.dependencies(name) {
+		for {
+			state := self.PluginState(dep)
+			if state == PLUGIN_READY || state == "" {
+				// Decoders have no runner to wait on, and neither do plugins
+				// a reload removed.
+				break
+			}
+			if state == PLUGIN_FAILED {
+				return fmt.Errorf("dependency '%s' failed to start", dep)
+			}
+			if time.Now().After(deadline) {
+				log.Printf("'%s' starting without '%s', which isn't ready", name, dep)
+				break
+			}
+			time.Sleep(dependencyPollInterval)
+		}
+	}
+	return nil
+}
+
+// Starts the named plugins of a category in dependency order, each once its
+// dependencies are ready.
+func (self *PipelineConfig) startInOrder(category string, names []string,
+	start func(name string) error) {
+
+	for _, name := range self.startupOrder(names) {
+		if err := self.awaitDependencies(name); err != nil {
+			log.Printf("%s '%s' not started: %s", category, name, err)
+			self.setPluginState(name, PLUGIN_FAILED)
+			continue
+		}
+		if err := start(name); err != nil {
+			log.Printf("%s '%s' failed to start: %s", category, name, err)
+			self.setPluginState(name, PLUGIN_FAILED)
+			continue
+		}
+		self.setPluginState(name, PLUGIN_STARTING)
+		log.Printf("%s started: %s", category, name)
+	}
+}
@@ -0,0 +1,154 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+type readyTestOutput struct {
+	ready int32
+}
+
+func (o *readyTestOutput) Init(config interface{}) error {
+	return nil
+}
+
+func (o *readyTestOutput) Ready() bool {
+	return atomic.LoadInt32(&o.ready) == 1
+}
+
+func PluginDependenciesSpec(c gs.Context) {
+	c.Specify("Plugin dependencies", func() {
+		pc := NewPipelineConfig(nil)
+		addSection := func(name, category string, deps ...string) {
+			pc.sectionCategories[name] = category
+			pc.setDependencies(name, deps)
+		}
+
+		c.Specify("are checked when the config is loaded", func() {
+			tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			err = ioutil.WriteFile(filepath.Join(tmpDir, "hekad.toml"), []byte(`
+[out1]
+type = "ReloadTestOutput"
+message_matcher = "Type == 'foo'"
+depends_on = ["out2"]
+`), 0644)
+			c.Assume(err, gs.IsNil)
+			err = pc.LoadFromConfigPath(tmpDir)
+			c.Assume(err, gs.Not(gs.IsNil))
+			c.Expect(err.Error(), gs.Equals, "'out1' depends on unknown plugin 'out2'")
+		})
+
+		c.Specify("must start before the plugin", func() {
+			addSection("input", "Input")
+			addSection("output", "Output", "input")
+			c.Expect(pc.checkDependencies().Error(), gs.Equals,
+				"'output' can't depend on input 'input', which starts after it")
+		})
+
+		c.Specify("can't be encoders", func() {
+			addSection("encoder", "Encoder")
+			addSection("output", "Output", "encoder")
+			c.Expect(pc.checkDependencies().Error(), gs.Equals,
+				"'output' can't depend on encoder 'encoder'")
+		})
+
+		c.Specify("can't be circular", func() {
+			addSection("a", "Output", "b")
+			addSection("b", "Output", "c")
+			addSection("c", "Output", "a")
+			c.Expect(pc.checkDependencies().Error(), gs.Equals,
+				"dependency cycle: a -> b -> c -> a")
+		})
+
+		c.Specify("order the startup", func() {
+			addSection("decoder", "Decoder")
+			addSection("filter", "Filter", "out3")
+			addSection("input", "Input", "decoder", "filter")
+			addSection("out1", "Output", "out3")
+			addSection("out2", "Output")
+			addSection("out3", "Output", "out2")
+			c.Expect(pc.checkDependencies(), gs.IsNil)
+			order := pc.startupOrder([]string{"out1", "out3", "out2"})
+			c.Expect(len(order), gs.Equals, 3)
+			c.Expect(order[0], gs.Equals, "out2")
+			c.Expect(order[1], gs.Equals, "out3")
+			c.Expect(order[2], gs.Equals, "out1")
+		})
+
+		c.Specify("are waited on until they're ready", func() {
+			globals := Globals()
+			origTimeout := globals.DependencyTimeout
+			origInterval := dependencyPollInterval
+			defer func() {
+				globals.DependencyTimeout = origTimeout
+				dependencyPollInterval = origInterval
+			}()
+			dependencyPollInterval = time.Millisecond
+			output := &readyTestOutput{}
+			pc.OutputRunners["out1"] = NewFORunner("out1", output, new(PluginGlobals))
+			pc.OutputRunners["out2"] = NewFORunner("out2", output, new(PluginGlobals))
+			addSection("out1", "Output")
+			addSection("out2", "Output", "out1")
+			c.Expect(pc.PluginState("out1"), gs.Equals, PLUGIN_PENDING)
+			c.Expect(pc.PluginState("missing"), gs.Equals, "")
+
+			c.Specify("and started in order", func() {
+				globals.DependencyTimeout = time.Second
+				var started []string
+				go func() {
+					time.Sleep(10 * time.Millisecond)
+					atomic.StoreInt32(&output.ready, 1)
+				}()
+				pc.startInOrder("Output", []string{"out2", "out1"},
+					func(name string) error {
+						started = append(started, name)
+						if name == "out1" {
+							c.Expect(pc.PluginState("out2"), gs.Equals, PLUGIN_PENDING)
+						}
+						return nil
+					})
+				c.Expect(len(started), gs.Equals, 2)
+				c.Expect(started[0], gs.Equals, "out1")
+				c.Expect(pc.PluginState("out1"), gs.Equals, PLUGIN_READY)
+				c.Expect(pc.PluginState("out2"), gs.Equals, PLUGIN_READY)
+				c.Expect(len(pc.notReady()), gs.Equals, 0)
+			})
+
+			c.Specify("until the timeout", func() {
+				globals.DependencyTimeout = 5 * time.Millisecond
+				pc.setPluginState("out1", PLUGIN_STARTING)
+				c.Expect(pc.PluginState("out1"), gs.Equals, PLUGIN_STARTING)
+				c.Expect(pc.awaitDependencies("out2"), gs.IsNil)
+				c.Expect(pc.notReady()["out1"], gs.Equals, PLUGIN_STARTING)
+			})
+
+			c.Specify("unless they failed", func() {
+				pc.setPluginState("out1", PLUGIN_FAILED)
+				err := pc.awaitDependencies("out2")
+				c.Assume(err, gs.Not(gs.IsNil))
+				c.Expect(err.Error(), gs.Equals, "dependency 'out1' failed to start")
+			})
+		})
+	})
+}
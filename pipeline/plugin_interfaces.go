@@ -16,6 +16,10 @@
 
 package pipeline
 
+import (
+	"io"
+)
+
 // Input plugin interface type.
 type Input interface {
 	// Start listening for / gathering incoming data, populating
@@ -27,6 +31,14 @@ type Input interface {
 	Stop()
 }
 
+// Implemented by inputs, filters and outputs that take a while to become
+// usable after they're started, e.g. until they've connected to a server.
+// Plugins depending on them (see `depends_on`) aren't started until Ready
+// returns true.
+type ReadyChecker interface {
+	Ready() bool
+}
+
 // Heka Decoder plugin interface.
 type Decoder interface {
 	// Extract data loaded into the PipelinePack (usually in pack.MsgBytes)
@@ -39,6 +51,14 @@ type Decoder interface {
 	Decode(pack *PipelinePack) (packs []*PipelinePack, err error)
 }
 
+// Heka Encoder plugin interface.
+type Encoder interface {
+	// Serializes the message in the PipelinePack into the bytes an output
+	// will write or send. Returning (nil, nil) is valid in cases where the
+	// message should be skipped without logging an error.
+	Encode(pack *PipelinePack) (output []byte, err error)
+}
+
 // Heka Filter plugin type.
 type Filter interface {
 	// Starts the filter listening on the FilterRunner's provided input
@@ -54,3 +74,14 @@ type Filter interface {
 type Output interface {
 	Run(or OutputRunner, h PluginHelper) (err error)
 }
+
+// Heka Splitter plugin type. Carves the records out of an input's byte
+// stream, buffering partial records between reads. A splitter holds the
+// state of a single stream, inputs get a new instance for each stream. Every
+// Splitter is also a StreamParser.
+type Splitter interface {
+	Parse(reader io.Reader) (bytesRead int, record []byte, err error)
+	GetRemainingData() []byte
+	SetMinimumBufferSize(size int)
+	SetMaxRecordSize(size int)
+}
@@ -21,7 +21,9 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -118,6 +120,15 @@ type iRunner struct {
 	inChan     chan *PipelinePack
 	tickLength time.Duration
 	ticker     <-chan time.Time
+	// Closed when the runner's goroutine has exited.
+	stopped chan struct{}
+	// Set (atomically) when a config reload removes the runner, so it exits
+	// instead of restarting its plugin or shutting Heka down.
+	removed int32
+	// Write-ahead journal of the input's records, if enabled.
+	journal *inputJournal
+	// Records left pending by the previous run, replayed on start.
+	replay []journalEntry
 }
 
 func (ir *iRunner) SetTickLength(tickLength time.Duration) {
@@ -138,7 +149,8 @@ func NewInputRunner(name string, input Input, pluginGlobals *PluginGlobals) (
 			plugin:        input.(Plugin),
 			pluginGlobals: pluginGlobals,
 		},
-		input: input,
+		input:   input,
+		stopped: make(chan struct{}),
 	}
 }
 
@@ -154,6 +166,13 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 	ir.h = h
 	ir.inChan = h.PipelineConfig().inputRecycleChan
 
+	if ir.pluginGlobals != nil && ir.pluginGlobals.Journal && ir.journal == nil {
+		path := GetHekaConfigDir(filepath.Join("journal", ir.name+".log"))
+		if ir.journal, ir.replay, err = openInputJournal(path); err != nil {
+			return fmt.Errorf("can't open journal: %s", err)
+		}
+	}
+
 	if ir.tickLength != 0 {
 		ir.ticker = time.Tick(ir.tickLength)
 	}
@@ -164,6 +183,7 @@ func (ir *iRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error) {
 
 func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 	defer func() {
+		close(ir.stopped)
 		wg.Done()
 	}()
 
@@ -175,6 +195,11 @@ func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 		return
 	}
 
+	if ir.replay != nil {
+		ir.replayJournal(h, ir.replay)
+		ir.replay = nil
+	}
+
 	for !globals.Stopping {
 		// ir.Input().Run() shouldn't return unless error or shutdown
 		if err := ir.Input().Run(ir, h); err != nil {
@@ -188,6 +213,11 @@ func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 			return
 		}
 
+		// Removed or replaced by a config reload, we're done.
+		if atomic.LoadInt32(&ir.removed) != 0 {
+			return
+		}
+
 		// We stop and let this quit if its not a restarting plugin
 		if recon, ok := ir.plugin.(Restarting); ok {
 			recon.CleanupForRestart()
@@ -226,7 +256,13 @@ func (ir *iRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 }
 
 func (ir *iRunner) Inject(pack *PipelinePack) {
-	ir.h.PipelineConfig().router.InChan() <- pack
+	pc := ir.h.PipelineConfig()
+	if !pc.chargeTenant(pack) {
+		pack.Recycle()
+		return
+	}
+	pc.stampTenant(pack)
+	pc.router.InChan() <- pack
 }
 
 func (ir *iRunner) LogError(err error) {
@@ -266,6 +302,12 @@ type dRunner struct {
 	uuid   string
 	router *messageRouter
 	h      PluginHelper
+	// Number of packs handed to the dead-letter queue.
+	deadLetterCount int64
+	// Size limits for the decoded messages, nil if there are none.
+	guard *messageGuard
+	// Transcodes the invalid UTF-8 strings, nil if there's no charset.
+	charset *charsetNormalizer
 }
 
 // Creates and returns a new (but not yet started) DecoderRunner for the
@@ -273,14 +315,19 @@ type dRunner struct {
 func NewDecoderRunner(name string, decoder Decoder,
 	pluginGlobals *PluginGlobals) DecoderRunner {
 
+	// The settings are validated when the config is loaded.
+	guard, _ := newMessageGuard(pluginGlobals)
+	charset, _ := newCharsetNormalizer(pluginGlobals)
 	return &dRunner{
 		pRunnerBase: pRunnerBase{
 			name:          name,
 			plugin:        decoder.(Plugin),
 			pluginGlobals: pluginGlobals,
 		},
-		uuid:   uuid.NewRandom().String(),
-		inChan: make(chan *PipelinePack, Globals().PluginChanSize),
+		uuid:    uuid.NewRandom().String(),
+		inChan:  make(chan *PipelinePack, Globals().PluginChanSize),
+		guard:   guard,
+		charset: charset,
 	}
 }
 
@@ -293,26 +340,55 @@ func (dr *dRunner) Start(h PluginHelper, wg *sync.WaitGroup) {
 	dr.router = h.PipelineConfig().router
 	go func() {
 		var (
-			pack  *PipelinePack
-			packs []*PipelinePack
-			err   error
+			pack     *PipelinePack
+			packs    []*PipelinePack
+			err      error
+			recycler RecycleBatcher
 		)
+		if wanter, ok := dr.Decoder().(WantsSampleDenominator); ok {
+			wanter.SetSampleDenominator(SampleDenominator(dr))
+		}
 		if wanter, ok := dr.Decoder().(WantsDecoderRunner); ok {
 			wanter.SetDecoderRunner(dr)
 		}
 		for pack = range dr.inChan {
+			pack.diagnostics.Stamp(dr)
+			if !h.PipelineConfig().chargeTenant(pack) {
+				recycler.Add(pack, len(dr.inChan))
+				continue
+			}
+			tenant := pack.Tenant
+			if dr.charset != nil {
+				dr.charset.apply(pack.Message)
+			}
 			if packs, err = dr.Decoder().Decode(pack); packs != nil {
+				recycler.Flush()
 				for _, p := range packs {
+					p.Tenant = tenant
+					h.PipelineConfig().stampTenant(p)
+					if dr.charset != nil {
+						dr.charset.apply(p.Message)
+					}
+					if dr.guard != nil {
+						if err = dr.guard.apply(p.Message); err != nil {
+							dr.LogError(err)
+							h.PipelineConfig().DeadLetter(p, dr.name, err)
+							continue
+						}
+					}
 					h.PipelineConfig().router.InChan() <- p
 				}
+			} else if err != nil {
+				dr.LogError(err)
+				recycler.Flush()
+				atomic.AddInt64(&dr.deadLetterCount, 1)
+				h.PipelineConfig().DeadLetter(pack, dr.name, err)
 			} else {
-				if err != nil {
-					dr.LogError(err)
-				}
-				pack.Recycle()
-				continue
+				// Dropped packs can come in floods.
+				recycler.Add(pack, len(dr.inChan))
 			}
 		}
+		recycler.Flush()
 		if wanter, ok := dr.Decoder().(WantsDecoderRunnerShutdown); ok {
 			wanter.Shutdown()
 		}
@@ -406,6 +482,11 @@ type OutputRunner interface {
 	RetainPack(pack *PipelinePack)
 	// Parsing engine for this Output's message_matcher.
 	MatchRunner() *MatchRunner
+	// Hands provided PipelinePack to the Heka Router, for outputs that
+	// generate messages of their own (e.g. results of the work they did).
+	// Returns false and doesn't perform message injection if the message
+	// would be caught by the sending Output's message_matcher.
+	Inject(pack *PipelinePack) bool
 }
 
 // This one struct provides the implementation of both FilterRunner and
@@ -419,6 +500,14 @@ type foRunner struct {
 	h          PluginHelper
 	retainPack *PipelinePack
 	leakCount  int
+	// Disk backed queue between the matcher and the plugin, only set when
+	// buffering is enabled.
+	buffer *queueBuffer
+	// Closed when the runner's goroutine has exited.
+	stopped chan struct{}
+	// Set (atomically) when a config reload removes the runner, so it exits
+	// instead of restarting its plugin or shutting Heka down.
+	removed int32
 }
 
 // Creates and returns foRunner pointer for use as either a FilterRunner or an
@@ -433,6 +522,7 @@ func NewFORunner(name string, plugin Plugin,
 		},
 	}
 	runner.inChan = make(chan *PipelinePack, Globals().PluginChanSize)
+	runner.stopped = make(chan struct{})
 	return
 }
 
@@ -441,6 +531,29 @@ func (foRunner *foRunner) Start(h PluginHelper, wg *sync.WaitGroup) (err error)
 	if foRunner.tickLength != 0 {
 		foRunner.ticker = time.Tick(foRunner.tickLength)
 	}
+	if foRunner.matcher != nil && foRunner.matcher.leader != nil {
+		leader := foRunner.matcher.leader
+		if foRunner.ticker != nil {
+			foRunner.ticker = leader.gateTicker(foRunner.ticker, foRunner.stopped)
+		}
+		go leader.run(foRunner, foRunner.stopped)
+	}
+
+	if foRunner.pluginGlobals.UseBuffering {
+		if foRunner.buffer, err = newQueueBuffer(foRunner.name,
+			foRunner.pluginGlobals, foRunner); err != nil {
+			return
+		}
+		if foRunner.matcher != nil {
+			foRunner.buffer.expiry = foRunner.matcher.expiry
+		}
+		if pc := h.PipelineConfig(); pc != nil {
+			foRunner.buffer.watchDisk(pc.DiskWatchdog(),
+				foRunner.pluginGlobals.DiskBudget)
+		}
+		go foRunner.buffer.feed()
+		go foRunner.buffer.replay(foRunner.inChan)
+	}
 
 	go foRunner.Starter(h, wg)
 	return
@@ -453,6 +566,7 @@ func (foRunner *foRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 	)
 	globals := Globals()
 	defer func() {
+		close(foRunner.stopped)
 		wg.Done()
 	}()
 
@@ -466,9 +580,23 @@ func (foRunner *foRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 	var pw *PluginWrapper
 	pc := h.PipelineConfig()
 
+	if foRunner.pluginGlobals != nil && foRunner.pluginGlobals.Cgroup != "" {
+		if err = pc.joinCgroup(foRunner.pluginGlobals.Cgroup); err != nil {
+			foRunner.LogError(fmt.Errorf("running outside of its cgroup: %s", err))
+		}
+	}
+
 	for !globals.Stopping {
 		if foRunner.matcher != nil {
-			foRunner.matcher.Start(foRunner.inChan)
+			if foRunner.buffer != nil {
+				foRunner.matcher.Start(foRunner.buffer.inChan)
+			} else {
+				foRunner.matcher.Start(foRunner.inChan)
+			}
+		}
+
+		if wanter, ok := foRunner.plugin.(WantsSampleDenominator); ok {
+			wanter.SetSampleDenominator(SampleDenominator(foRunner))
 		}
 
 		// `Run` method only returns if there's an error or we're shutting
@@ -495,6 +623,11 @@ func (foRunner *foRunner) Starter(h PluginHelper, wg *sync.WaitGroup) {
 			return
 		}
 
+		// Removed or replaced by a config reload, we're done.
+		if atomic.LoadInt32(&foRunner.removed) != 0 {
+			return
+		}
+
 		if pluginType == "filter" {
 			pw = pc.filterWrappers[foRunner.name]
 		} else {
@@ -546,6 +679,11 @@ func (foRunner *foRunner) Inject(pack *PipelinePack) bool {
 		foRunner.LogError(fmt.Errorf("attempted to Inject a message to itself"))
 		return false
 	}
+	// A plugin scoped to a single tenant injects messages on its behalf.
+	if globals := foRunner.pluginGlobals; globals != nil && len(globals.Tenants) == 1 {
+		pack.Tenant = globals.Tenants[0]
+		foRunner.h.PipelineConfig().stampTenant(pack)
+	}
 	// Do the actual injection in a separate goroutine so we free up the
 	// caller; this prevents deadlocks when the caller's InChan is backed up,
 	// backing up the router, which would block us here.
@@ -17,6 +17,7 @@ package pipeline
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"github.com/mozilla-services/heka/message"
 )
 
 // Decoder for converting ProtocolBuffer data into Message objects.
@@ -30,6 +31,13 @@ func (self *ProtobufDecoder) Decode(pack *PipelinePack) (
 	packs []*PipelinePack, err error) {
 
 	if err = proto.Unmarshal(pack.MsgBytes, pack.Message); err == nil {
+		if pack.PeerIdentity != "" {
+			message.NewStringField(pack.Message, TLS_PEER_FIELD, pack.PeerIdentity)
+		}
+		if pack.UnverifiedSigner != "" {
+			message.NewStringField(pack.Message, UNVERIFIED_SIGNER_FIELD,
+				pack.UnverifiedSigner)
+		}
 		packs = []*PipelinePack{pack}
 	}
 	return
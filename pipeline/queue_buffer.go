@@ -0,0 +1,501 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Size at which a queue file is closed and a new one is started. Fully
+// replayed files are removed so the disk space can be reclaimed.
+const QUEUE_FILE_MAX_SIZE = 128 * 1024 * 1024
+
+// Possible `full_action` settings for a buffered filter or output.
+const (
+	BUFFER_FULL_DROP     = "drop"
+	BUFFER_FULL_BLOCK    = "block"
+	BUFFER_FULL_SHUTDOWN = "shutdown"
+)
+
+// Prefixed to the message bytes of encrypted queue records. A protobuf
+// message can't start with a zero byte (field number 0 is invalid), so
+// records queued in plaintext are never mistaken for encrypted ones.
+const ENCRYPTED_RECORD_MARKER = 0
+
+// Disk backed FIFO sitting between a plugin's message matcher and the plugin
+// itself. Matched packs are protobuf encoded and appended to the queue files
+// in the `{base_dir}/queue/{plugin name}` directory, then replayed into the
+// plugin's input channel as fast as the plugin can consume them. The read
+// position is checkpointed so unprocessed messages survive a restart.
+type queueBuffer struct {
+	dir        string
+	maxSize    uint64
+	fullAction string
+	runner     PluginRunner
+	// Channel the MatchRunner delivers matched packs to.
+	inChan chan *PipelinePack
+	// Pack supply for the replayed messages.
+	recycleChan chan *PipelinePack
+	// Size at which the current queue file is sealed.
+	fileMaxSize int64
+	writeId     uint
+	writeFile   *os.File
+	writeSize   int64
+	// Protects readId and readOffset from the disk watchdog dropping files.
+	readLock   sync.Mutex
+	readId     uint
+	readFile   *os.File
+	readOffset int64
+	// Bytes written to the queue that haven't been replayed yet.
+	queueSize int64
+	// Last file id that has been completely written, accessed atomically.
+	sealedId int64
+	// Signals the reader that new data has been written.
+	dataChan chan bool
+	// Closed by the writer once the input channel has been drained.
+	stopChan chan bool
+	dropped  int64
+	// Registration with the disk watchdog, if any.
+	disk *DiskBudget
+	// Encrypts the queued messages if set.
+	cipher *SpoolCipher
+	// Skips messages that expired while queued, if set.
+	expiry *messageExpiry
+}
+
+func queueFileName(id uint) string {
+	return fmt.Sprintf("%d.log", id)
+}
+
+// Returns the sorted list of existing queue file ids in the directory.
+func queueFileIds(dir string) (ids []int, err error) {
+	var names []string
+	if names, err = filepath.Glob(filepath.Join(dir, "*.log")); err != nil {
+		return
+	}
+	for _, name := range names {
+		base := strings.TrimSuffix(filepath.Base(name), ".log")
+		if id, e := strconv.Atoi(base); e == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return
+}
+
+// Creates the queue directory if necessary and restores the read position
+// from the checkpoint file, if any.
+func newQueueBuffer(name string, pluginGlobals *PluginGlobals,
+	runner PluginRunner) (qb *queueBuffer, err error) {
+
+	qb = &queueBuffer{
+		dir:         GetHekaConfigDir(filepath.Join("queue", name)),
+		maxSize:     pluginGlobals.MaxBufferSize,
+		fullAction:  pluginGlobals.FullAction,
+		runner:      runner,
+		fileMaxSize: QUEUE_FILE_MAX_SIZE,
+		cipher:      Globals().SpoolCipher,
+		inChan:      make(chan *PipelinePack, Globals().PluginChanSize),
+		recycleChan: make(chan *PipelinePack, Globals().PluginChanSize),
+		dataChan:    make(chan bool, 1),
+		stopChan:    make(chan bool),
+	}
+	if err = os.MkdirAll(qb.dir, 0700); err != nil {
+		return nil, fmt.Errorf("can't create queue directory: %s", err)
+	}
+
+	var ids []int
+	if ids, err = queueFileIds(qb.dir); err != nil {
+		return nil, err
+	}
+	if len(ids) > 0 {
+		qb.readId = uint(ids[0])
+		qb.writeId = uint(ids[len(ids)-1])
+	}
+	qb.readCheckpoint()
+
+	for _, id := range ids {
+		if uint(id) < qb.readId {
+			// Already replayed before the last shutdown.
+			os.Remove(filepath.Join(qb.dir, queueFileName(uint(id))))
+			continue
+		}
+		if info, e := os.Stat(filepath.Join(qb.dir, queueFileName(uint(id)))); e == nil {
+			qb.queueSize += info.Size()
+		}
+	}
+	qb.queueSize -= qb.readOffset
+	if qb.queueSize < 0 {
+		qb.queueSize = 0
+	}
+
+	if err = qb.openWriteFile(); err != nil {
+		return nil, err
+	}
+	atomic.StoreInt64(&qb.sealedId, int64(qb.writeId)-1)
+	for i := 0; i < Globals().PluginChanSize; i++ {
+		qb.recycleChan <- NewPipelinePack(qb.recycleChan)
+	}
+	return
+}
+
+// Registers the queue directory with the disk watchdog. Queue files are
+// sealed more often when the directory's budget is small, so there are
+// replayable files the watchdog can drop.
+func (qb *queueBuffer) watchDisk(wd *DiskWatchdog, budget uint64) {
+	if budget > 0 && int64(budget/4) < qb.fileMaxSize {
+		qb.fileMaxSize = int64(budget / 4)
+	}
+	qb.disk = wd.Register(qb.runner.Name(), qb.dir, int64(budget), qb.dropOldest)
+}
+
+// Removes the oldest sealed queue files that haven't been replayed yet, never
+// the file being read, until at least `need` bytes have been freed.
+func (qb *queueBuffer) dropOldest(need int64) (freed int64) {
+	qb.readLock.Lock()
+	defer qb.readLock.Unlock()
+	var count int
+	sealedId := atomic.LoadInt64(&qb.sealedId)
+	for id := qb.readId + 1; int64(id) <= sealedId && freed < need; id++ {
+		path := filepath.Join(qb.dir, queueFileName(id))
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err = os.Remove(path); err != nil {
+			qb.runner.LogError(fmt.Errorf("can't remove queue file: %s", err))
+			continue
+		}
+		freed += info.Size()
+		count++
+	}
+	if count > 0 {
+		atomic.AddInt64(&qb.queueSize, -freed)
+		qb.runner.LogError(fmt.Errorf("disk budget exceeded, dropped %d queue "+
+			"files (%d bytes)", count, freed))
+	}
+	return
+}
+
+func (qb *queueBuffer) checkpointPath() string {
+	return filepath.Join(qb.dir, "checkpoint.txt")
+}
+
+// Checkpoint format is "{file id} {offset}".
+func (qb *queueBuffer) readCheckpoint() {
+	contents, err := ioutil.ReadFile(qb.checkpointPath())
+	if err != nil {
+		return
+	}
+	var id uint
+	var offset int64
+	if _, err = fmt.Sscanf(string(contents), "%d %d", &id, &offset); err != nil {
+		qb.runner.LogError(fmt.Errorf("invalid queue checkpoint: %s", err))
+		return
+	}
+	if id >= qb.readId && id <= qb.writeId {
+		qb.readId = id
+		qb.readOffset = offset
+	}
+}
+
+func (qb *queueBuffer) writeCheckpoint() {
+	contents := fmt.Sprintf("%d %d", qb.readId, qb.readOffset)
+	tmpPath := qb.checkpointPath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(contents), 0600); err != nil {
+		qb.runner.LogError(fmt.Errorf("can't write queue checkpoint: %s", err))
+		return
+	}
+	os.Rename(tmpPath, qb.checkpointPath())
+}
+
+func (qb *queueBuffer) openWriteFile() (err error) {
+	path := filepath.Join(qb.dir, queueFileName(qb.writeId))
+	if qb.writeFile, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND,
+		0600); err != nil {
+		return fmt.Errorf("can't open queue file: %s", err)
+	}
+	var info os.FileInfo
+	if info, err = qb.writeFile.Stat(); err != nil {
+		return
+	}
+	qb.writeSize = info.Size()
+	return
+}
+
+// Returns the number of bytes waiting to be replayed.
+func (qb *queueBuffer) QueueSize() int64 {
+	return atomic.LoadInt64(&qb.queueSize)
+}
+
+func (qb *queueBuffer) full(size int) bool {
+	return qb.maxSize > 0 && uint64(qb.QueueSize()+int64(size)) > qb.maxSize
+}
+
+// Encodes the pack's message as a framed record like ProtobufEncodeMessage,
+// but with the message bytes encrypted.
+func (qb *queueBuffer) encodeEncrypted(pack *PipelinePack, outBytes *[]byte) (err error) {
+	var msgBytes, headerBytes []byte
+	if msgBytes, err = proto.Marshal(pack.Message); err != nil {
+		return
+	}
+	if msgBytes, err = qb.cipher.Seal(msgBytes); err != nil {
+		return
+	}
+	msgBytes = append([]byte{ENCRYPTED_RECORD_MARKER}, msgBytes...)
+	header := &message.Header{}
+	header.SetMessageLength(uint32(len(msgBytes)))
+	if headerBytes, err = proto.Marshal(header); err != nil {
+		return
+	}
+	requiredSize := message.HEADER_FRAMING_SIZE + len(headerBytes) + len(msgBytes)
+	if requiredSize > message.MAX_RECORD_SIZE {
+		return fmt.Errorf("message too big, requires %d (MAX_RECORD_SIZE = %d)",
+			requiredSize, message.MAX_RECORD_SIZE)
+	}
+	*outBytes = append((*outBytes)[:0], message.RECORD_SEPARATOR,
+		uint8(len(headerBytes)))
+	*outBytes = append(*outBytes, headerBytes...)
+	*outBytes = append(*outBytes, message.UNIT_SEPARATOR)
+	*outBytes = append(*outBytes, msgBytes...)
+	return
+}
+
+// Returns the plaintext of a queued record's message bytes. Records without
+// the encrypted marker were queued before encryption was enabled and are
+// returned as is.
+func (qb *queueBuffer) decrypt(msgBytes []byte) ([]byte, error) {
+	if len(msgBytes) == 0 || msgBytes[0] != ENCRYPTED_RECORD_MARKER {
+		return msgBytes, nil
+	}
+	if qb.cipher == nil {
+		return nil, errors.New("record is encrypted but no spool key is set")
+	}
+	return qb.cipher.Open(msgBytes[1:])
+}
+
+// Appends an encoded record to the current queue file, starting a new file
+// when the size limit is reached.
+func (qb *queueBuffer) write(record []byte) (err error) {
+	if qb.writeSize+int64(len(record)) > qb.fileMaxSize && qb.writeSize > 0 {
+		qb.writeFile.Close()
+		atomic.StoreInt64(&qb.sealedId, int64(qb.writeId))
+		qb.writeId++
+		if err = qb.openWriteFile(); err != nil {
+			return
+		}
+	}
+	var n int
+	n, err = qb.writeFile.Write(record)
+	qb.writeSize += int64(n)
+	atomic.AddInt64(&qb.queueSize, int64(n))
+	select {
+	case qb.dataChan <- true:
+	default:
+	}
+	return
+}
+
+// Encodes and writes every pack that arrives on the input channel. Returns
+// when the input channel is closed, signalling the replay loop to stop.
+func (qb *queueBuffer) feed() {
+	var (
+		outBytes = make([]byte, 0, 1024)
+		err      error
+		ok       bool
+	)
+	globals := Globals()
+	defer close(qb.stopChan)
+	for pack := range qb.inChan {
+		if qb.cipher != nil {
+			err = qb.encodeEncrypted(pack, &outBytes)
+		} else {
+			err = ProtobufEncodeMessage(pack, &outBytes)
+		}
+		if err != nil {
+			qb.runner.LogError(fmt.Errorf("can't encode message for queue: %s", err))
+			pack.Recycle()
+			continue
+		}
+		pack.Recycle()
+
+		if qb.disk != nil && !qb.disk.Wait() {
+			// Shutting down while over the disk budget.
+			atomic.AddInt64(&qb.dropped, 1)
+			continue
+		}
+		ok = true
+		for qb.full(len(outBytes)) {
+			if qb.fullAction == BUFFER_FULL_BLOCK && !globals.Stopping {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if qb.fullAction == BUFFER_FULL_SHUTDOWN && !globals.Stopping {
+				qb.runner.LogError(fmt.Errorf("queue buffer full, shutting down"))
+				globals.ShutDown()
+			}
+			ok = false
+			break
+		}
+		if !ok {
+			if atomic.AddInt64(&qb.dropped, 1) == 1 {
+				qb.runner.LogError(fmt.Errorf("queue buffer full, dropping messages"))
+			}
+			continue
+		}
+		if err = qb.write(outBytes); err != nil {
+			qb.runner.LogError(fmt.Errorf("can't write to queue: %s", err))
+		}
+	}
+	qb.writeFile.Close()
+	if qb.disk != nil {
+		qb.disk.Close()
+	}
+}
+
+// Reads records from the queue files, hands them to the provided channel as
+// decoded packs, and checkpoints the read position. Closes the output channel
+// once the feed has stopped, any unreplayed data stays on disk.
+func (qb *queueBuffer) replay(outChan chan *PipelinePack) {
+	var (
+		parser    *MessageProtoParser
+		record    []byte
+		n         int
+		err       error
+		pack      *PipelinePack
+		lastCheck time.Time
+	)
+	defer func() {
+		if qb.readFile != nil {
+			qb.readFile.Close()
+		}
+		qb.writeCheckpoint()
+		close(outChan)
+	}()
+
+	openReadFile := func() bool {
+		qb.readLock.Lock()
+		// Skip any files the disk watchdog has dropped.
+		for int64(qb.readId) <= atomic.LoadInt64(&qb.sealedId) {
+			_, err = os.Stat(filepath.Join(qb.dir, queueFileName(qb.readId)))
+			if !os.IsNotExist(err) {
+				break
+			}
+			qb.readId++
+			qb.readOffset = 0
+		}
+		qb.readLock.Unlock()
+		path := filepath.Join(qb.dir, queueFileName(qb.readId))
+		if qb.readFile, err = os.Open(path); err != nil {
+			qb.runner.LogError(fmt.Errorf("can't open queue file: %s", err))
+			return false
+		}
+		if _, err = qb.readFile.Seek(qb.readOffset, 0); err != nil {
+			qb.runner.LogError(fmt.Errorf("can't seek queue file: %s", err))
+			return false
+		}
+		parser = NewMessageProtoParser()
+		return true
+	}
+	if !openReadFile() {
+		return
+	}
+
+	for {
+		n, record, err = parser.Parse(qb.readFile)
+		if err != nil && err != io.EOF {
+			if err == io.ErrShortBuffer {
+				qb.runner.LogError(fmt.Errorf("record exceeded MAX_RECORD_SIZE %d",
+					message.MAX_RECORD_SIZE))
+			} else {
+				qb.runner.LogError(fmt.Errorf("can't read queue file: %s", err))
+			}
+		}
+		if err == nil || err == io.ErrShortBuffer {
+			qb.readOffset += int64(n)
+			atomic.AddInt64(&qb.queueSize, -int64(n))
+		}
+
+		if len(record) > 0 {
+			pack = <-qb.recycleChan
+			headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+			msgBytes := record[headerLen:]
+			if msgBytes, err = qb.decrypt(msgBytes); err != nil {
+				qb.runner.LogError(fmt.Errorf("can't decrypt queued message: %s", err))
+				pack.Recycle()
+			} else if err = proto.Unmarshal(msgBytes, pack.Message); err != nil {
+				qb.runner.LogError(fmt.Errorf("can't decode queued message: %s", err))
+				pack.Recycle()
+			} else if qb.expiry != nil && qb.expiry.check(pack.Message) {
+				pack.Recycle()
+			} else {
+				pack.Decoded = true
+				select {
+				case outChan <- pack:
+				case <-qb.stopChan:
+					// The pack hasn't been delivered, make sure it's replayed
+					// after a restart.
+					qb.readOffset -= int64(n)
+					pack.Recycle()
+					return
+				}
+			}
+			if time.Since(lastCheck) > time.Second {
+				qb.writeCheckpoint()
+				lastCheck = time.Now()
+			}
+			continue
+		}
+
+		if err != io.EOF {
+			continue
+		}
+
+		if int64(qb.readId) <= atomic.LoadInt64(&qb.sealedId) {
+			// This file has been completely written and replayed.
+			qb.readFile.Close()
+			os.Remove(filepath.Join(qb.dir, queueFileName(qb.readId)))
+			qb.readLock.Lock()
+			qb.readId++
+			qb.readOffset = 0
+			qb.readLock.Unlock()
+			qb.writeCheckpoint()
+			if !openReadFile() {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-qb.dataChan:
+		case <-qb.stopChan:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
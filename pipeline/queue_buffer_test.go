@@ -0,0 +1,256 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func QueueBufferSpec(c gs.Context) {
+	NewPipelineConfig(nil)
+	tmpDir, tmpErr := ioutil.TempDir("", "hekad-tests-")
+	c.Expect(tmpErr, gs.IsNil)
+	origBaseDir := Globals().BaseDir
+	Globals().BaseDir = tmpDir
+	defer func() {
+		Globals().BaseDir = origBaseDir
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.IsNil)
+	}()
+
+	pluginGlobals := &PluginGlobals{
+		UseBuffering: true,
+		FullAction:   BUFFER_FULL_DROP,
+	}
+	runner := NewFORunner("BufferedOutput", nil, pluginGlobals)
+	recycleChan := make(chan *PipelinePack, 10)
+
+	sendPacks := func(qb *queueBuffer, count int) {
+		for i := 0; i < count; i++ {
+			pack := NewPipelinePack(recycleChan)
+			pack.Message = ts.GetTestMessage()
+			pack.Message.SetPayload(fmt.Sprintf("message %d", i))
+			qb.inChan <- pack
+		}
+	}
+
+	c.Specify("A queue buffer", func() {
+		qb, err := newQueueBuffer(runner.name, pluginGlobals, runner)
+		c.Assume(err, gs.IsNil)
+		outChan := make(chan *PipelinePack, 10)
+
+		c.Specify("replays the messages in order", func() {
+			go qb.feed()
+			go qb.replay(outChan)
+			sendPacks(qb, 3)
+			for i := 0; i < 3; i++ {
+				pack := <-outChan
+				c.Expect(pack.Decoded, gs.IsTrue)
+				c.Expect(pack.Message.GetPayload(), gs.Equals, fmt.Sprintf("message %d", i))
+				pack.Recycle()
+			}
+			close(qb.inChan)
+			_, ok := <-outChan
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(qb.QueueSize(), gs.Equals, int64(0))
+		})
+
+		c.Specify("keeps unreplayed messages across restarts", func() {
+			go qb.feed()
+			sendPacks(qb, 2)
+			close(qb.inChan)
+			<-qb.stopChan
+			c.Expect(qb.QueueSize() > 0, gs.IsTrue)
+
+			qb, err = newQueueBuffer(runner.name, pluginGlobals, runner)
+			c.Assume(err, gs.IsNil)
+			c.Expect(qb.QueueSize() > 0, gs.IsTrue)
+			go qb.feed()
+			go qb.replay(outChan)
+			pack := <-outChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "message 0")
+			pack = <-outChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "message 1")
+			close(qb.inChan)
+			for _ = range outChan {
+			}
+
+			contents, err := ioutil.ReadFile(filepath.Join(qb.dir, "checkpoint.txt"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(contents) > 0, gs.IsTrue)
+		})
+
+		c.Specify("drops messages when full", func() {
+			qb.maxSize = 10
+			go qb.feed()
+			sendPacks(qb, 2)
+			close(qb.inChan)
+			<-qb.stopChan
+			c.Expect(qb.QueueSize(), gs.Equals, int64(0))
+			c.Expect(qb.dropped, gs.Equals, int64(2))
+		})
+
+		c.Specify("encrypts the queued messages", func() {
+			key := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+			cipher, err := NewSpoolCipher("hex", key)
+			c.Assume(err, gs.IsNil)
+			_, err = NewSpoolCipher("hex", "0001")
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = NewSpoolCipher("nope", key)
+			c.Expect(err, gs.Not(gs.IsNil))
+
+			// Queued in plaintext before encryption is turned on.
+			go qb.feed()
+			sendPacks(qb, 1)
+			close(qb.inChan)
+			<-qb.stopChan
+
+			Globals().SpoolCipher = cipher
+			defer func() {
+				Globals().SpoolCipher = nil
+			}()
+			qb, err = newQueueBuffer(runner.name, pluginGlobals, runner)
+			c.Assume(err, gs.IsNil)
+			go qb.feed()
+			sendPacks(qb, 2)
+			close(qb.inChan)
+			<-qb.stopChan
+			contents, err := ioutil.ReadFile(filepath.Join(qb.dir, queueFileName(qb.writeId)))
+			c.Assume(err, gs.IsNil)
+			c.Expect(strings.Contains(string(contents), "message 0"), gs.IsTrue)
+			c.Expect(strings.Contains(string(contents), "message 1"), gs.IsFalse)
+
+			qb, err = newQueueBuffer(runner.name, pluginGlobals, runner)
+			c.Assume(err, gs.IsNil)
+			go qb.feed()
+			go qb.replay(outChan)
+			for _, payload := range []string{"message 0", "message 0", "message 1"} {
+				pack := <-outChan
+				c.Expect(pack.Message.GetPayload(), gs.Equals, payload)
+				pack.Recycle()
+			}
+			close(qb.inChan)
+			for _ = range outChan {
+			}
+		})
+
+		c.Specify("doesn't replay encrypted messages it can't decrypt", func() {
+			cipher, err := NewSpoolCipher("hex",
+				"000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+			c.Assume(err, gs.IsNil)
+			otherCipher, err := NewSpoolCipher("hex",
+				"1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100")
+			c.Assume(err, gs.IsNil)
+			defer func() {
+				Globals().SpoolCipher = nil
+			}()
+
+			Globals().SpoolCipher = cipher
+			qb, err = newQueueBuffer(runner.name, pluginGlobals, runner)
+			c.Assume(err, gs.IsNil)
+			go qb.feed()
+			sendPacks(qb, 2)
+			close(qb.inChan)
+			<-qb.stopChan
+
+			replayed := func() (payloads []string) {
+				qb, err = newQueueBuffer(runner.name, pluginGlobals, runner)
+				c.Assume(err, gs.IsNil)
+				outChan = make(chan *PipelinePack, 10)
+				go qb.feed()
+				go qb.replay(outChan)
+				close(qb.inChan)
+				for pack := range outChan {
+					payloads = append(payloads, pack.Message.GetPayload())
+					pack.Recycle()
+				}
+				return
+			}
+
+			c.Specify("with the wrong key", func() {
+				Globals().SpoolCipher = otherCipher
+				c.Expect(len(replayed()), gs.Equals, 0)
+			})
+
+			c.Specify("without a key", func() {
+				Globals().SpoolCipher = nil
+				c.Expect(len(replayed()), gs.Equals, 0)
+			})
+
+			c.Specify("and reports them", func() {
+				pack := NewPipelinePack(recycleChan)
+				pack.Message = ts.GetTestMessage()
+				var record []byte
+				qb.cipher = cipher
+				c.Assume(qb.encodeEncrypted(pack, &record), gs.IsNil)
+				msgBytes := record[int(record[1])+message.HEADER_FRAMING_SIZE:]
+				c.Expect(msgBytes[0], gs.Equals, byte(ENCRYPTED_RECORD_MARKER))
+				_, err = qb.decrypt(msgBytes)
+				c.Expect(err, gs.IsNil)
+
+				qb.cipher = otherCipher
+				_, err = qb.decrypt(msgBytes)
+				c.Expect(err, gs.Not(gs.IsNil))
+				qb.cipher = nil
+				_, err = qb.decrypt(msgBytes)
+				c.Expect(err, gs.Not(gs.IsNil))
+
+				plain, err := proto.Marshal(pack.Message)
+				c.Assume(err, gs.IsNil)
+				qb.cipher = cipher
+				msgBytes, err = qb.decrypt(plain)
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(msgBytes), gs.Equals, string(plain))
+			})
+		})
+
+		c.Specify("drops its oldest unreplayed files for the disk watchdog", func() {
+			qb.fileMaxSize = 10
+			go qb.feed()
+			sendPacks(qb, 4)
+			close(qb.inChan)
+			<-qb.stopChan
+			ids, err := queueFileIds(qb.dir)
+			c.Assume(err, gs.IsNil)
+			c.Assume(len(ids), gs.Equals, 4)
+
+			// The file being read and the one being written are kept.
+			freed := qb.dropOldest(1000)
+			c.Expect(freed > 0, gs.IsTrue)
+			ids, _ = queueFileIds(qb.dir)
+			c.Expect(len(ids), gs.Equals, 2)
+
+			qb, err = newQueueBuffer(runner.name, pluginGlobals, runner)
+			c.Assume(err, gs.IsNil)
+			go qb.feed()
+			go qb.replay(outChan)
+			pack := <-outChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "message 0")
+			pack = <-outChan
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "message 3")
+			close(qb.inChan)
+			for _ = range outChan {
+			}
+		})
+	})
+}
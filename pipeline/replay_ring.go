@@ -0,0 +1,244 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A message kept for replay.
+type replayEntry struct {
+	received time.Time
+	msg      *message.Message
+	signer   string
+	tenant   string
+}
+
+// Keeps copies of the recent messages matched by the filters of a matcher
+// class, i.e. sharing a message_matcher, message_signer and tenants, so a
+// filter of the class added or restarted at runtime can be fed the last few
+// minutes of its traffic and warm up its state (see the `replay` setting).
+// Only one filter of the class records into the ring at a time, the others
+// skip recording altogether. The messages are deduplicated by UUID, since a
+// filter taking over the recording may see messages already recorded.
+type replayRing struct {
+	// Id of the matcherReplay recording into the ring, 0 if none.
+	recorder int64
+	lock     sync.Mutex
+	// Circular buffer of the entries, oldest first from start.
+	entries []replayEntry
+	start   int
+	count   int
+	// How long entries are kept, the longest replay of the class's filters.
+	window time.Duration
+	// UUIDs of the entries.
+	uuids map[string]bool
+	// Replaced in tests.
+	now func() time.Time
+}
+
+func newReplayRing(size int, window time.Duration) *replayRing {
+	return &replayRing{
+		entries: make([]replayEntry, size),
+		window:  window,
+		uuids:   make(map[string]bool),
+		now:     time.Now,
+	}
+}
+
+// Returns the key of the matcher class.
+func replayClass(matcher, signer string, tenants []string) string {
+	sorted := append([]string(nil), tenants...)
+	sort.Strings(sorted)
+	return strings.Join(append([]string{matcher, signer}, sorted...), "\x00")
+}
+
+// Keeps entries for at least the window.
+func (r *replayRing) extendWindow(window time.Duration) {
+	r.lock.Lock()
+	if window > r.window {
+		r.window = window
+	}
+	r.lock.Unlock()
+}
+
+// Drops the oldest entry. Must be called with the lock held.
+func (r *replayRing) evict() {
+	delete(r.uuids, string(r.entries[r.start].msg.GetUuid()))
+	r.entries[r.start] = replayEntry{}
+	r.start = (r.start + 1) % len(r.entries)
+	r.count--
+}
+
+// Keeps a copy of the pack's message, unless it's already kept. The message
+// is copied before the lock is taken.
+func (r *replayRing) record(pack *PipelinePack) {
+	if len(r.entries) == 0 {
+		return
+	}
+	msg := message.CopyMessage(pack.Message)
+	uuid := string(msg.GetUuid())
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if uuid != "" && r.uuids[uuid] {
+		return
+	}
+	now := r.now()
+	for r.count > 0 && now.Sub(r.entries[r.start].received) > r.window {
+		r.evict()
+	}
+	if r.count == len(r.entries) {
+		r.evict()
+	}
+	r.entries[(r.start+r.count)%len(r.entries)] = replayEntry{
+		received: now,
+		msg:      msg,
+		signer:   pack.Signer,
+		tenant:   pack.Tenant,
+	}
+	r.count++
+	if uuid != "" {
+		r.uuids[uuid] = true
+	}
+}
+
+// Returns the entries received within the window, oldest first.
+func (r *replayRing) since(window time.Duration) (entries []replayEntry) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	cutoff := r.now().Add(-window)
+	for i := 0; i < r.count; i++ {
+		entry := r.entries[(r.start+i)%len(r.entries)]
+		if !entry.received.Before(cutoff) {
+			entries = append(entries, entry)
+		}
+	}
+	return
+}
+
+// Returns the ring of the matcher class, creating it if needed.
+func (self *PipelineConfig) replayRing(class string, window time.Duration) *replayRing {
+	self.replayRingsLock.Lock()
+	defer self.replayRingsLock.Unlock()
+	if ring, ok := self.replayRings[class]; ok {
+		ring.extendWindow(window)
+		return ring
+	}
+	ring := newReplayRing(Globals().ReplayMaxMessages, window)
+	self.replayRings[class] = ring
+	return ring
+}
+
+// Most packs a replay feeds the filter at once. The replay has its own packs
+// so it doesn't compete with the filters injecting messages for the pools'.
+const REPLAY_POOL_SIZE = 8
+
+// Last id given to a matcherReplay.
+var lastReplayId int64
+
+// A filter's side of its class's replay ring.
+type matcherReplay struct {
+	ring *replayRing
+	// Tells the filters of the class apart as the ring's recorder.
+	id int64
+	// How far back the filter is replayed when it starts.
+	window time.Duration
+	// Number of messages replayed to the filter.
+	replayed int64
+}
+
+func newMatcherReplay(ring *replayRing, window time.Duration) *matcherReplay {
+	return &matcherReplay{
+		ring:   ring,
+		id:     atomic.AddInt64(&lastReplayId, 1),
+		window: window,
+	}
+}
+
+// Records the pack into the ring if the filter is its class's recorder,
+// becoming the recorder if the class has none.
+func (m *matcherReplay) record(pack *PipelinePack) {
+	if atomic.LoadInt64(&m.ring.recorder) != m.id &&
+		!atomic.CompareAndSwapInt64(&m.ring.recorder, 0, m.id) {
+		return
+	}
+	m.ring.record(pack)
+}
+
+// Lets another filter of the class take over the recording, once the filter
+// stops.
+func (m *matcherReplay) stopRecording() {
+	atomic.CompareAndSwapInt64(&m.ring.recorder, m.id, 0)
+}
+
+// Starts feeding the ring's messages from the window to the filter, oldest
+// first, alongside the matcher, which keeps delivering the live messages, so
+// the router isn't held up while the replay waits for the filter. Returns a
+// function that ends the replay and waits for it to have ended, which must be
+// called before matchChan is closed.
+func (m *matcherReplay) start(matchChan chan *PipelinePack) (stop func()) {
+	stopChan := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.replay(matchChan, stopChan)
+	}()
+	return func() {
+		close(stopChan)
+		<-done
+	}
+}
+
+func (m *matcherReplay) replay(matchChan chan *PipelinePack,
+	stopChan chan struct{}) {
+
+	entries := m.ring.since(m.window)
+	size := REPLAY_POOL_SIZE
+	if len(entries) < size {
+		size = len(entries)
+	}
+	supply := make(chan *PipelinePack, size)
+	for i := 0; i < size; i++ {
+		supply <- NewPipelinePack(supply)
+	}
+	var pack *PipelinePack
+	for _, entry := range entries {
+		select {
+		case pack = <-supply:
+		case <-stopChan:
+			return
+		}
+		entry.msg.Copy(pack.Message)
+		pack.Signer = entry.signer
+		pack.Tenant = entry.tenant
+		select {
+		case matchChan <- pack:
+			atomic.AddInt64(&m.replayed, 1)
+		case <-stopChan:
+			pack.Recycle()
+			return
+		}
+	}
+}
+
+// Returns the number of messages replayed to the filter.
+func (m *matcherReplay) ReplayedCount() int64 {
+	return atomic.LoadInt64(&m.replayed)
+}
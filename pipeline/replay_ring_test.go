@@ -0,0 +1,166 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/bbangert/toml"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
+)
+
+func ReplayRingSpec(c gs.Context) {
+	pc := NewPipelineConfig(nil)
+	now := time.Now()
+	recycleChan := make(chan *PipelinePack, 4)
+	newPack := func(payload string) *PipelinePack {
+		pack := NewPipelinePack(recycleChan)
+		pack.Message.SetUuid(uuid.NewRandom())
+		pack.Message.SetType("nginx.access")
+		pack.Message.SetPayload(payload)
+		return pack
+	}
+
+	c.Specify("A replay ring", func() {
+		ring := newReplayRing(2, time.Minute)
+		ring.now = func() time.Time { return now }
+
+		c.Specify("keeps one copy of each message", func() {
+			pack := newPack("one")
+			ring.record(pack)
+			ring.record(pack)
+			pack.Message.SetPayload("changed")
+			entries := ring.since(time.Minute)
+			c.Expect(len(entries), gs.Equals, 1)
+			c.Expect(entries[0].msg.GetPayload(), gs.Equals, "one")
+		})
+
+		c.Specify("drops the oldest messages when full", func() {
+			ring.record(newPack("one"))
+			ring.record(newPack("two"))
+			ring.record(newPack("three"))
+			entries := ring.since(time.Minute)
+			c.Expect(len(entries), gs.Equals, 2)
+			c.Expect(entries[0].msg.GetPayload(), gs.Equals, "two")
+			c.Expect(entries[1].msg.GetPayload(), gs.Equals, "three")
+		})
+
+		c.Specify("drops the messages older than the window", func() {
+			ring.record(newPack("one"))
+			now = now.Add(40 * time.Second)
+			ring.record(newPack("two"))
+			c.Expect(len(ring.since(30*time.Second)), gs.Equals, 1)
+			now = now.Add(40 * time.Second)
+			ring.record(newPack("three"))
+			c.Expect(ring.count, gs.Equals, 2)
+			c.Expect(len(ring.uuids), gs.Equals, 2)
+		})
+	})
+
+	c.Specify("Matcher classes ignore the order of the tenants", func() {
+		c.Expect(replayClass("TRUE", "", []string{"b", "a"}), gs.Equals,
+			replayClass("TRUE", "", []string{"a", "b"}))
+		c.Expect(replayClass("TRUE", "", nil), gs.Not(gs.Equals),
+			replayClass("TRUE", "ops", nil))
+	})
+
+	c.Specify("A MatchRunner with replay", func() {
+		ring := pc.replayRing("Type == 'nginx.access'", time.Minute)
+		ring.record(newPack("old"))
+		runner := NewFORunner("status", nil, new(PluginGlobals))
+		matcher, err := NewMatchRunner("Type == 'nginx.access'", "", runner)
+		c.Assume(err, gs.IsNil)
+		matcher.replay = newMatcherReplay(ring, time.Minute)
+
+		c.Specify("replays the recent messages with packs of its own", func() {
+			matchChan := make(chan *PipelinePack, 2)
+			matcher.Start(matchChan)
+			replayed := <-matchChan
+			c.Expect(replayed.Message.GetPayload(), gs.Equals, "old")
+			c.Expect(replayed.RecycleChan, gs.Not(gs.Equals), pc.injectRecycleChan)
+			c.Expect(matcher.replay.ReplayedCount(), gs.Equals, int64(1))
+
+			live := newPack("live")
+			matcher.inChan <- live
+			c.Expect(<-matchChan, gs.Equals, live)
+			close(matcher.inChan)
+			_, ok := <-matchChan
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(len(ring.since(time.Minute)), gs.Equals, 2)
+			c.Expect(ring.recorder, gs.Equals, int64(0))
+			replayed.Recycle()
+		})
+
+		c.Specify("ends the replay when it's stopped", func() {
+			ring.record(newPack("older"))
+			matchChan := make(chan *PipelinePack)
+			matcher.Start(matchChan)
+			close(matcher.inChan)
+			closed := false
+			for i := 0; i < 100 && !closed; i++ {
+				time.Sleep(10 * time.Millisecond)
+				matcher.matchLock.Lock()
+				closed = matcher.matchClosed
+				matcher.matchLock.Unlock()
+			}
+			c.Expect(closed, gs.IsTrue)
+			_, ok := <-matchChan
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(matcher.replay.ReplayedCount(), gs.Equals, int64(0))
+		})
+
+		c.Specify("records only if it's the class's recorder", func() {
+			other := newMatcherReplay(ring, time.Minute)
+			other.record(newPack("other"))
+			matcher.replay.record(newPack("skipped"))
+			c.Expect(len(ring.since(time.Minute)), gs.Equals, 2)
+			other.stopRecording()
+			matcher.replay.record(newPack("taken over"))
+			c.Expect(len(ring.since(time.Minute)), gs.Equals, 3)
+			c.Expect(ring.recorder, gs.Equals, matcher.replay.id)
+		})
+	})
+
+	c.Specify("The config", func() {
+		decodeSection := func(config string) toml.Primitive {
+			var sections map[string]toml.Primitive
+			_, err := toml.Decode(config, &sections)
+			c.Assume(err, gs.IsNil)
+			return sections["section"]
+		}
+
+		c.Specify("shares the ring of a matcher class", func() {
+			errcnt := pc.loadSection("section", decodeSection(`[section]
+			type = "CounterFilter"
+			message_matcher = "Type == 'nginx.access'"
+			replay = "5m"`))
+			c.Expect(errcnt, gs.Equals, uint(0))
+			replay := pc.FilterRunners["section"].MatchRunner().replay
+			c.Expect(replay.window, gs.Equals, 5*time.Minute)
+			ring := pc.replayRing(replayClass("Type == 'nginx.access'", "", nil),
+				time.Minute)
+			c.Expect(replay.ring, gs.Equals, ring)
+			c.Expect(ring.window, gs.Equals, 5*time.Minute)
+		})
+
+		c.Specify("rejects an invalid replay", func() {
+			errcnt := pc.loadSection("section", decodeSection(`[section]
+			type = "CounterFilter"
+			message_matcher = "TRUE"
+			replay = "soon"`))
+			c.Expect(errcnt, gs.Equals, uint(1))
+		})
+	})
+}
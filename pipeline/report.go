@@ -19,8 +19,10 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/mozilla-services/heka/message"
+	"sort"
 	"strings"
 	"sync/atomic"
+	"time"
 )
 
 // Interface for Heka plugins that will provide reporting data. Plugins can
@@ -40,7 +42,11 @@ type ReportingPlugin interface {
 // capacity, plus any additional data that the plugin might provide through
 // implementation of the `ReportingPlugin` interface defined above.
 func PopulateReportMsg(pr PluginRunner, msg *message.Message) (err error) {
-	if reporter, ok := pr.Plugin().(ReportingPlugin); ok {
+	if pool, ok := pr.(*decoderPool); ok {
+		if err = pool.ReportMsg(msg); err != nil {
+			return
+		}
+	} else if reporter, ok := pr.Plugin().(ReportingPlugin); ok {
 		if err = reporter.ReportMsg(msg); err != nil {
 			return
 		}
@@ -59,9 +65,76 @@ func PopulateReportMsg(pr PluginRunner, msg *message.Message) (err error) {
 		}
 		fRunner.MatchRunner().reportLock.Unlock()
 		message.NewInt64Field(msg, "MatchAvgDuration", tmp, "ns")
-	} else if dRunner, ok := pr.(DecoderRunner); ok {
-		message.NewIntField(msg, "InChanCapacity", cap(dRunner.InChan()), "count")
-		message.NewIntField(msg, "InChanLength", len(dRunner.InChan()), "count")
+		blockedCount, blockedDuration := fRunner.MatchRunner().RouterBlocked()
+		message.NewInt64Field(msg, "RouterBlockedCount", blockedCount, "count")
+		message.NewInt64Field(msg, "RouterBlockedDuration", blockedDuration, "ns")
+		if expiry := fRunner.MatchRunner().expiry; expiry != nil {
+			message.NewInt64Field(msg, "ExpiredCount", expiry.ExpiredCount(), "count")
+		}
+		if shedder := fRunner.MatchRunner().shedder; shedder != nil {
+			message.NewInt64Field(msg, "ShedCount", shedder.ShedCount(), "count")
+			message.NewInt64Field(msg, "QueueFill", int64(shedder.fill()), "%")
+		}
+		if isolator := fRunner.MatchRunner().isolator; isolator != nil {
+			if f, e := message.NewField("Isolated", isolator.Isolated(), ""); e == nil {
+				msg.AddField(f)
+			}
+			message.NewInt64Field(msg, "DivertedCount", isolator.DivertedCount(), "count")
+			message.NewInt64Field(msg, "DivertDroppedCount", isolator.DroppedCount(),
+				"count")
+		}
+		if hot := fRunner.MatchRunner().hot; hot != nil {
+			message.NewInt64Field(msg, "ColdCount", hot.ColdCount(), "count")
+			message.NewInt64Field(msg, "ColdDroppedCount", hot.DroppedCount(), "count")
+		}
+		if leader := fRunner.MatchRunner().leader; leader != nil {
+			if f, e := message.NewField("Leader", leader.IsLeader(), ""); e == nil {
+				msg.AddField(f)
+			}
+			message.NewInt64Field(msg, "StandbyCount", leader.StandbyCount(), "count")
+		}
+		if replay := fRunner.MatchRunner().replay; replay != nil {
+			message.NewInt64Field(msg, "ReplayedCount", replay.ReplayedCount(), "count")
+		}
+		if policy := fRunner.MatchRunner().policy; policy != nil {
+			message.NewInt64Field(msg, "DeliveryDropCount", policy.DroppedCount(), "count")
+		}
+		if fo, ok := pr.(*foRunner); ok && fo.buffer != nil {
+			message.NewInt64Field(msg, "QueueSize", fo.buffer.QueueSize(), "B")
+		}
+	} else if inRunner, ok := pr.(*iRunner); ok && inRunner.journal != nil {
+		message.NewInt64Field(msg, "JournalPending", inRunner.journal.Pending(), "count")
+		message.NewInt64Field(msg, "JournaledCount",
+			atomic.LoadInt64(&inRunner.journal.journaled), "count")
+	} else if decRunner, ok := pr.(DecoderRunner); ok {
+		message.NewIntField(msg, "InChanCapacity", cap(decRunner.InChan()), "count")
+		message.NewIntField(msg, "InChanLength", len(decRunner.InChan()), "count")
+		var (
+			guard   *messageGuard
+			charset *charsetNormalizer
+		)
+		if dr, ok := decRunner.(*dRunner); ok {
+			message.NewInt64Field(msg, "DeadLetterCount",
+				atomic.LoadInt64(&dr.deadLetterCount), "count")
+			guard, charset = dr.guard, dr.charset
+		} else if pool, ok := decRunner.(*decoderPool); ok {
+			// The pool's instances share the guard and normalizer.
+			guard, charset = pool.guard, pool.charset
+		}
+		if guard != nil {
+			guard.ReportMsg(msg)
+		}
+		if charset != nil {
+			charset.ReportMsg(msg)
+		}
+	}
+	// Plugins may report their config values.
+	for _, field := range msg.Fields {
+		if field.GetValueType() == message.Field_STRING {
+			for i, value := range field.ValueString {
+				field.ValueString[i] = RedactSecrets(value)
+			}
+		}
 	}
 	msg.SetType("heka.plugin-report")
 	return
@@ -81,6 +154,8 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	msg = pack.Message
 	message.NewIntField(msg, "InChanCapacity", cap(pc.inputRecycleChan), "count")
 	message.NewIntField(msg, "InChanLength", len(pc.inputRecycleChan), "count")
+	message.NewIntField(msg, "PoolSize", pc.poolSize(pc.inputPool, pc.inputRecycleChan),
+		"count")
 	msg.SetType("heka.input-report")
 	message.NewStringField(msg, "name", "inputRecycleChan")
 	message.NewStringField(msg, "key", "globals")
@@ -90,6 +165,8 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	msg = pack.Message
 	message.NewIntField(msg, "InChanCapacity", cap(pc.injectRecycleChan), "count")
 	message.NewIntField(msg, "InChanLength", len(pc.injectRecycleChan), "count")
+	message.NewIntField(msg, "PoolSize", pc.poolSize(pc.injectPool, pc.injectRecycleChan),
+		"count")
 	msg.SetType("heka.inject-report")
 	message.NewStringField(msg, "name", "injectRecycleChan")
 	message.NewStringField(msg, "key", "globals")
@@ -100,11 +177,22 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 	message.NewIntField(msg, "InChanCapacity", cap(pc.router.InChan()), "count")
 	message.NewIntField(msg, "InChanLength", len(pc.router.InChan()), "count")
 	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&pc.router.processMessageCount), "count")
+	message.NewStringField(msg, "TopBlockers", pc.topRouterBlockers(routerTopBlockers))
 	msg.SetType("heka.router-report")
 	message.NewStringField(msg, "name", "Router")
 	message.NewStringField(msg, "key", "globals")
 	reportChan <- pack
 
+	pack = <-pc.reportRecycleChan
+	msg = pack.Message
+	deadLetterCount, deadLetterDropped := pc.deadLetters.Counts()
+	message.NewInt64Field(msg, "DeadLetterCount", deadLetterCount, "count")
+	message.NewInt64Field(msg, "DroppedCount", deadLetterDropped, "count")
+	msg.SetType("heka.dead-letter-report")
+	message.NewStringField(msg, "name", "DeadLetterQueue")
+	message.NewStringField(msg, "key", "globals")
+	reportChan <- pack
+
 	getReport := func(runner PluginRunner) (pack *PipelinePack) {
 		pack = <-pc.reportRecycleChan
 		if err = PopulateReportMsg(runner, pack.Message); err != nil {
@@ -123,6 +211,7 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 		pack = getReport(runner)
 		message.NewStringField(pack.Message, "name", name)
 		message.NewStringField(pack.Message, "key", "inputs")
+		message.NewStringField(pack.Message, "State", pc.runnerState(runner))
 		reportChan <- pack
 	}
 	pc.inputsLock.Unlock()
@@ -139,19 +228,83 @@ func (pc *PipelineConfig) reports(reportChan chan *PipelinePack) {
 		pack = getReport(runner)
 		message.NewStringField(pack.Message, "name", name)
 		message.NewStringField(pack.Message, "key", "filters")
+		message.NewStringField(pack.Message, "State", pc.runnerState(runner))
 		reportChan <- pack
 	}
 	pc.filtersLock.Unlock()
 
+	pc.outputsLock.Lock()
 	for name, runner := range pc.OutputRunners {
 		pack = getReport(runner)
 		message.NewStringField(pack.Message, "name", name)
 		message.NewStringField(pack.Message, "key", "outputs")
+		message.NewStringField(pack.Message, "State", pc.runnerState(runner))
+		reportChan <- pack
+	}
+	pc.outputsLock.Unlock()
+
+	for _, tenant := range pc.sortedTenants() {
+		pack = <-pc.reportRecycleChan
+		tenant.ReportMsg(pack.Message)
+		pack.Message.SetType("heka.tenant-report")
+		message.NewStringField(pack.Message, "name", tenant.Name)
+		message.NewStringField(pack.Message, "key", "tenants")
 		reportChan <- pack
 	}
 	close(reportChan)
 }
 
+// Number of plugins listed in the router report's TopBlockers field.
+const routerTopBlockers = 5
+
+type routerBlocker struct {
+	name     string
+	duration int64
+}
+
+type routerBlockersByDuration []routerBlocker
+
+func (b routerBlockersByDuration) Len() int           { return len(b) }
+func (b routerBlockersByDuration) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b routerBlockersByDuration) Less(i, j int) bool { return b[i].duration > b[j].duration }
+
+// Returns the filters and outputs the router spent the most time blocked
+// delivering to, longest first, along with the time blocked, e.g.
+// "ElasticSearchOutput (1m2.5s), LogOutput (120ms)". The first of these is
+// usually the bottleneck when the pipeline backs up.
+func (pc *PipelineConfig) topRouterBlockers(n int) string {
+	var blockers routerBlockersByDuration
+	add := func(name string, matcher *MatchRunner) {
+		if matcher == nil {
+			return
+		}
+		if _, duration := matcher.RouterBlocked(); duration > 0 {
+			blockers = append(blockers, routerBlocker{name, duration})
+		}
+	}
+
+	pc.filtersLock.Lock()
+	for name, runner := range pc.FilterRunners {
+		add(name, runner.MatchRunner())
+	}
+	pc.filtersLock.Unlock()
+	pc.outputsLock.Lock()
+	for name, runner := range pc.OutputRunners {
+		add(name, runner.MatchRunner())
+	}
+	pc.outputsLock.Unlock()
+
+	sort.Sort(blockers)
+	if len(blockers) > n {
+		blockers = blockers[:n]
+	}
+	top := make([]string, len(blockers))
+	for i, b := range blockers {
+		top[i] = fmt.Sprintf("%s (%s)", b.name, time.Duration(b.duration))
+	}
+	return strings.Join(top, ", ")
+}
+
 // Use type aliases for readability.
 type pluginReportDataMap map[string]interface{}
 type fullReportDataMap map[string][]pluginReportDataMap
@@ -227,7 +380,8 @@ func (pc *PipelineConfig) FormatTextReport(report_type, payload string) string {
 
 	header := []string{
 		"InChanCapacity", "InChanLength", "MatchChanCapacity", "MatchChanLength",
-		"MatchAvgDuration", "ProcessMessageCount", "InjectMessageCount", "Memory",
+		"MatchAvgDuration", "RouterBlockedCount", "RouterBlockedDuration",
+		"TopBlockers", "ProcessMessageCount", "InjectMessageCount", "Memory",
 		"MaxMemory", "MaxInstructions", "MaxOutput", "ProcessMessageAvgDuration",
 		"TimerEventAvgDuration",
 	}
@@ -0,0 +1,242 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A sample of a report field.
+type historyPoint struct {
+	// Nanoseconds since the epoch.
+	Timestamp int64
+	Value     float64
+}
+
+// Retained values of one numeric report field of one plugin.
+type historySeries struct {
+	Section        string
+	Plugin         string
+	Field          string
+	Representation string
+	// Counters (fields ending in "Count") only ever grow, so their
+	// difference between samples is the throughput.
+	Counter bool
+	// Ring buffer of the samples, oldest at `next` once it's full.
+	points []historyPoint
+	next   int
+	full   bool
+}
+
+func (s *historySeries) add(point historyPoint) {
+	if !s.full && len(s.points) < cap(s.points) {
+		s.points = append(s.points, point)
+		return
+	}
+	s.points[s.next] = point
+	s.next = (s.next + 1) % len(s.points)
+	s.full = true
+}
+
+// Returns the most recent sample.
+func (s *historySeries) newest() historyPoint {
+	return s.points[(s.next+len(s.points)-1)%len(s.points)]
+}
+
+// Returns the samples taken at or after `since` (ns), oldest first. A
+// counter's samples are converted to per second rates if `rate` is true,
+// the first one being dropped since there's nothing to compare it with.
+func (s *historySeries) since(since int64, rate bool) []historyPoint {
+	ordered := make([]historyPoint, 0, len(s.points))
+	ordered = append(ordered, s.points[s.next:]...)
+	ordered = append(ordered, s.points[:s.next]...)
+	points := make([]historyPoint, 0, len(ordered))
+	for i, point := range ordered {
+		if point.Timestamp < since {
+			continue
+		}
+		if rate && s.Counter {
+			if i == 0 {
+				continue
+			}
+			prev := ordered[i-1]
+			elapsed := float64(point.Timestamp-prev.Timestamp) / float64(time.Second)
+			delta := point.Value - prev.Value
+			if elapsed <= 0 || delta < 0 {
+				// Reset by a plugin restart.
+				delta = 0
+			}
+			if elapsed > 0 {
+				point.Value = delta / elapsed
+			}
+		}
+		points = append(points, point)
+	}
+	return points
+}
+
+// In-process time series store holding the last `retention` of the numeric
+// report fields of every plugin, sampled every `interval`, so the admin API
+// can show the throughput and error trends around an incident without an
+// external monitoring system.
+type reportHistory struct {
+	interval  time.Duration
+	retention time.Duration
+	lock      sync.RWMutex
+	// Keyed by section, plugin and field name.
+	series map[string]*historySeries
+}
+
+func newReportHistory(retention, interval time.Duration) *reportHistory {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &reportHistory{
+		interval:  interval,
+		retention: retention,
+		series:    make(map[string]*historySeries),
+	}
+}
+
+// Most samples a series retains.
+func (h *reportHistory) capacity() int {
+	capacity := int(h.retention / h.interval)
+	if capacity < 1 {
+		capacity = 1
+	}
+	return capacity
+}
+
+// Records the numeric fields of the current report messages.
+func (h *reportHistory) sample(pc *PipelineConfig, now time.Time) {
+	timestamp := now.UnixNano()
+	reports := make(chan *PipelinePack)
+	go pc.reports(reports)
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for pack := range reports {
+		msg := pack.Message
+		name, _ := msg.GetFieldValue("name")
+		key, _ := msg.GetFieldValue("key")
+		plugin, section := fmt.Sprint(name), fmt.Sprint(key)
+		for _, field := range msg.Fields {
+			var value float64
+			switch v := field.GetValue().(type) {
+			case int64:
+				value = float64(v)
+			case float64:
+				value = v
+			case bool:
+				if v {
+					value = 1
+				}
+			default:
+				continue
+			}
+			id := section + "/" + plugin + "/" + field.GetName()
+			s, ok := h.series[id]
+			if !ok {
+				s = &historySeries{
+					Section:        section,
+					Plugin:         plugin,
+					Field:          field.GetName(),
+					Representation: field.GetRepresentation(),
+					Counter:        strings.HasSuffix(field.GetName(), "Count"),
+					points:         make([]historyPoint, 0, h.capacity()),
+				}
+				h.series[id] = s
+			}
+			s.add(historyPoint{timestamp, value})
+		}
+		pack.Recycle()
+	}
+
+	// Forget the series of the plugins that have gone away.
+	cutoff := now.Add(-h.retention).UnixNano()
+	for id, s := range h.series {
+		if s.newest().Timestamp < cutoff {
+			delete(h.series, id)
+		}
+	}
+}
+
+type historySeriesById []*historySeries
+
+func (s historySeriesById) Len() int      { return len(s) }
+func (s historySeriesById) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s historySeriesById) Less(i, j int) bool {
+	if s[i].Section != s[j].Section {
+		return s[i].Section < s[j].Section
+	}
+	if s[i].Plugin != s[j].Plugin {
+		return s[i].Plugin < s[j].Plugin
+	}
+	return s[i].Field < s[j].Field
+}
+
+// A series as returned by the admin API.
+type historySeriesData struct {
+	Section        string
+	Plugin         string
+	Field          string
+	Representation string
+	Counter        bool
+	// Oldest first.
+	Points []historyPoint
+}
+
+// Returns the retained samples of the plugin's and field's series taken
+// after `since`, every plugin's or field's if empty, sorted by section,
+// plugin and field name.
+func (h *reportHistory) query(plugin, field string, since time.Time,
+	rate bool) []historySeriesData {
+
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	matching := make(historySeriesById, 0)
+	for _, s := range h.series {
+		if (plugin == "" || s.Plugin == plugin) && (field == "" || s.Field == field) {
+			matching = append(matching, s)
+		}
+	}
+	sort.Sort(matching)
+	data := make([]historySeriesData, len(matching))
+	for i, s := range matching {
+		data[i] = historySeriesData{
+			Section:        s.Section,
+			Plugin:         s.Plugin,
+			Field:          s.Field,
+			Representation: s.Representation,
+			Counter:        s.Counter,
+			Points:         s.since(since.UnixNano(), rate),
+		}
+	}
+	return data
+}
+
+// Samples the reports into the history every interval until Heka stops.
+func (self *PipelineConfig) runReportHistory() {
+	ticker := time.NewTicker(self.reportHistory.interval)
+	defer ticker.Stop()
+	for !Globals().Stopping {
+		now := <-ticker.C
+		self.reportHistory.sample(self, now)
+	}
+}
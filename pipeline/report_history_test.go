@@ -0,0 +1,134 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func ReportHistorySpec(c gs.Context) {
+	start := time.Unix(1400000000, 0)
+
+	c.Specify("A history series", func() {
+		s := &historySeries{Counter: true, points: make([]historyPoint, 0, 3)}
+		for i := int64(0); i < 5; i++ {
+			s.add(historyPoint{start.Add(time.Duration(i) * time.Minute).UnixNano(),
+				float64(i * 600)})
+		}
+
+		c.Specify("keeps the most recent samples in order", func() {
+			points := s.since(0, false)
+			c.Assume(len(points), gs.Equals, 3)
+			c.Expect(points[0].Value, gs.Equals, float64(1200))
+			c.Expect(points[2].Value, gs.Equals, float64(2400))
+			c.Expect(s.newest().Value, gs.Equals, float64(2400))
+		})
+
+		c.Specify("converts counters to rates", func() {
+			points := s.since(0, true)
+			c.Assume(len(points), gs.Equals, 2)
+			c.Expect(points[0].Value, gs.Equals, float64(10))
+			c.Expect(points[1].Timestamp, gs.Equals,
+				start.Add(4*time.Minute).UnixNano())
+		})
+
+		c.Specify("leaves out older samples", func() {
+			points := s.since(start.Add(4*time.Minute).UnixNano(), false)
+			c.Assume(len(points), gs.Equals, 1)
+			c.Expect(points[0].Value, gs.Equals, float64(2400))
+		})
+	})
+
+	c.Specify("The report history", func() {
+		globals := DefaultGlobals()
+		globals.ReportHistory = time.Hour
+		pc := NewPipelineConfig(globals)
+		pc.reportRecycleChan <- NewPipelinePack(pc.reportRecycleChan)
+		c.Assume(pc.reportHistory, gs.Not(gs.IsNil))
+		c.Expect(pc.reportHistory.capacity(), gs.Equals, 60)
+
+		filter := new(CounterFilter)
+		fRunner := NewFORunner("counter", filter, nil)
+		var err error
+		fRunner.matcher, err = NewMatchRunner("TRUE", "", fRunner)
+		c.Assume(err, gs.IsNil)
+		pc.FilterRunners = map[string]FilterRunner{"counter": fRunner}
+
+		fRunner.SetLeakCount(1)
+		pc.reportHistory.sample(pc, start)
+		fRunner.SetLeakCount(4)
+		pc.reportHistory.sample(pc, start.Add(time.Minute))
+
+		c.Specify("samples the numeric report fields", func() {
+			data := pc.reportHistory.query("counter", "LeakCount", time.Time{}, false)
+			c.Assume(len(data), gs.Equals, 1)
+			c.Expect(data[0].Section, gs.Equals, "filters")
+			c.Expect(data[0].Counter, gs.IsTrue)
+			c.Assume(len(data[0].Points), gs.Equals, 2)
+			c.Expect(data[0].Points[1].Value, gs.Equals, float64(4))
+
+			// String fields aren't kept.
+			data = pc.reportHistory.query("counter", "State", time.Time{}, false)
+			c.Expect(len(data), gs.Equals, 0)
+			data = pc.reportHistory.query("Router", "", time.Time{}, false)
+			c.Expect(len(data) > 0, gs.IsTrue)
+		})
+
+		c.Specify("forgets the plugins that have gone away", func() {
+			pc.FilterRunners = map[string]FilterRunner{}
+			pc.reportHistory.sample(pc, start.Add(2*time.Hour))
+			data := pc.reportHistory.query("counter", "", time.Time{}, false)
+			c.Expect(len(data), gs.Equals, 0)
+		})
+
+		c.Specify("is served by the admin API", func() {
+			req, err := http.NewRequest("GET",
+				"http://localhost/history?plugin=counter&field=LeakCount&rate=true", nil)
+			c.Assume(err, gs.IsNil)
+			w := httptest.NewRecorder()
+			(&adminHandler{pc}).ServeHTTP(w, req)
+			c.Expect(w.Code, gs.Equals, http.StatusOK)
+			var body struct {
+				Interval float64 `json:"interval"`
+				Series   []historySeriesData
+			}
+			err = json.Unmarshal(w.Body.Bytes(), &body)
+			c.Assume(err, gs.IsNil)
+			c.Expect(body.Interval, gs.Equals, float64(60))
+			c.Assume(len(body.Series), gs.Equals, 1)
+			c.Assume(len(body.Series[0].Points), gs.Equals, 1)
+			c.Expect(body.Series[0].Points[0].Value, gs.Equals, float64(0.05))
+
+			req, err = http.NewRequest("GET", "http://localhost/history?since=bogus", nil)
+			c.Assume(err, gs.IsNil)
+			w = httptest.NewRecorder()
+			(&adminHandler{pc}).ServeHTTP(w, req)
+			c.Expect(w.Code, gs.Equals, http.StatusBadRequest)
+		})
+	})
+
+	c.Specify("The admin API reports a disabled history", func() {
+		pc := NewPipelineConfig(nil)
+		req, err := http.NewRequest("GET", "http://localhost/history", nil)
+		c.Assume(err, gs.IsNil)
+		w := httptest.NewRecorder()
+		(&adminHandler{pc}).ServeHTTP(w, req)
+		c.Expect(w.Code, gs.Equals, http.StatusNotFound)
+	})
+}
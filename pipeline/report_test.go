@@ -19,6 +19,7 @@ import (
 	"github.com/mozilla-services/heka/message"
 	ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"time"
 )
 
 var (
@@ -112,6 +113,15 @@ func ReportSpec(c gs.Context) {
 				c.Assume(ok, gs.IsTrue)
 				c.Expect(int(i), gs.Equals, 10)
 			})
+
+			c.Specify("adds the time the router blocked on it", func() {
+				count, ok := msg.GetFieldValue("RouterBlockedCount")
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(count, gs.Equals, int64(0))
+				duration, ok := msg.GetFieldValue("RouterBlockedDuration")
+				c.Expect(ok, gs.IsTrue)
+				c.Expect(duration, gs.Equals, int64(0))
+			})
 		})
 
 		c.Specify("w/ an input", func() {
@@ -179,6 +189,32 @@ func ReportSpec(c gs.Context) {
 			routerReport := reports["Router"]
 			c.Expect(routerReport, gs.Not(gs.IsNil))
 			c.Expect(hasChannelData(routerReport.Message), gs.IsTrue)
+
+			deadLetterReport := reports["DeadLetterQueue"]
+			c.Expect(deadLetterReport, gs.Not(gs.IsNil))
+			countVal, ok := deadLetterReport.Message.GetFieldValue("DeadLetterCount")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(countVal.(int64), gs.Equals, int64(0))
+		})
+
+		c.Specify("lists the plugins the router blocked on the longest", func() {
+			newRunner := func(name string, blocked time.Duration) *foRunner {
+				runner := NewFORunner(name, nil, nil)
+				runner.matcher, err = NewMatchRunner("TRUE", "", runner)
+				c.Assume(err, gs.IsNil)
+				runner.matcher.blockedDuration = int64(blocked)
+				return runner
+			}
+			pc.FilterRunners["slow"] = newRunner("slow", 2*time.Second)
+			pc.FilterRunners["idle"] = newRunner("idle", 0)
+			pc.OutputRunners = map[string]OutputRunner{
+				"slowest": newRunner("slowest", time.Minute),
+				"fast":    newRunner("fast", time.Millisecond),
+			}
+			c.Expect(pc.topRouterBlockers(2), gs.Equals,
+				"slowest (1m0s), slow (2s)")
+			c.Expect(pc.topRouterBlockers(5), gs.Equals,
+				"slowest (1m0s), slow (2s), fast (1ms)")
 		})
 	})
 }
@@ -16,7 +16,9 @@
 package pipeline
 
 import (
+	"fmt"
 	"github.com/mozilla-services/heka/message"
+	"hash/fnv"
 	"log"
 	"math/rand"
 	"runtime"
@@ -38,6 +40,9 @@ type MessageRouter interface {
 	// Channel to facilitate adding a matcher to the router which starts the
 	// message flow to the associated filter.
 	AddFilterMatcher() chan *MatchRunner
+	// Channel to facilitate adding a matcher to the router which starts the
+	// message flow to the associated output.
+	AddOutputMatcher() chan *MatchRunner
 	// Channel to facilitate removing a Filter.  If the matcher exists it will
 	// be removed from the router, the matcher channel closed and drained, the
 	// filter channel closed and drained, and the filter exited.
@@ -51,11 +56,18 @@ type MessageRouter interface {
 type messageRouter struct {
 	inChan              chan *PipelinePack
 	addFilterMatcher    chan *MatchRunner
+	addOutputMatcher    chan *MatchRunner
 	removeFilterMatcher chan *MatchRunner
 	removeOutputMatcher chan *MatchRunner
 	fMatchers           []*MatchRunner
 	oMatchers           []*MatchRunner
 	processMessageCount int64
+	// Number of goroutines delivering packs to the matchers.
+	numWorkers int
+	// Message field whose value picks the worker for a pack.
+	shardField string
+	// Messages and bytes routed per source.
+	volume *volumeAccounting
 }
 
 // Creates and returns a (not yet started) Heka message router.
@@ -63,10 +75,18 @@ func NewMessageRouter() (router *messageRouter) {
 	router = new(messageRouter)
 	router.inChan = make(chan *PipelinePack, Globals().PluginChanSize)
 	router.addFilterMatcher = make(chan *MatchRunner, 0)
+	router.addOutputMatcher = make(chan *MatchRunner, 0)
 	router.removeFilterMatcher = make(chan *MatchRunner, 0)
 	router.removeOutputMatcher = make(chan *MatchRunner, 0)
 	router.fMatchers = make([]*MatchRunner, 0, 10)
 	router.oMatchers = make([]*MatchRunner, 0, 10)
+	router.numWorkers = Globals().RouterWorkers
+	if router.numWorkers < 1 {
+		router.numWorkers = 1
+	}
+	router.shardField = Globals().RouterShardField
+	router.volume = newVolumeAccounting(Globals().VolumeInterval,
+		Globals().VolumeMaxSources)
 	return router
 }
 
@@ -78,6 +98,10 @@ func (self *messageRouter) AddFilterMatcher() chan *MatchRunner {
 	return self.addFilterMatcher
 }
 
+func (self *messageRouter) AddOutputMatcher() chan *MatchRunner {
+	return self.addOutputMatcher
+}
+
 func (self *messageRouter) RemoveFilterMatcher() chan *MatchRunner {
 	return self.removeFilterMatcher
 }
@@ -86,11 +110,76 @@ func (self *messageRouter) RemoveOutputMatcher() chan *MatchRunner {
 	return self.removeOutputMatcher
 }
 
+// Returns the index of the worker that delivers the pack. Packs with the same
+// shard field value always go to the same worker, so they reach every
+// matcher in the order they were routed.
+func (self *messageRouter) shard(pack *PipelinePack) int {
+	var key string
+	msg := pack.Message
+	switch self.shardField {
+	case "Logger":
+		key = msg.GetLogger()
+	case "Hostname":
+		key = msg.GetHostname()
+	case "Type":
+		key = msg.GetType()
+	case "Payload":
+		key = msg.GetPayload()
+	case "Pid":
+		return int(uint32(msg.GetPid()) % uint32(self.numWorkers))
+	default:
+		if value, ok := msg.GetFieldValue(self.shardField); ok {
+			switch v := value.(type) {
+			case string:
+				key = v
+			case []byte:
+				key = string(v)
+			default:
+				key = fmt.Sprint(v)
+			}
+		}
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(self.numWorkers))
+}
+
 // Spawns a goroutine within which the router listens for messages on the
 // input channel and performs its routing magic. Spawned goroutine continues
 // until the router is shut down, triggered by closing the router's input
 // channel.
+//
+// With more than one router worker the routing goroutine only hands each
+// pack to one of the workers, which do the delivery to the matchers in
+// parallel. Each worker keeps its own copy of the matcher sets, updated
+// through its control channel, so delivery doesn't need any locking.
 func (self *messageRouter) Start() {
+	workers := make([]*routerWorker, self.numWorkers)
+	var workersWg sync.WaitGroup
+	for i := range workers {
+		workers[i] = newRouterWorker(self.fMatchers, self.oMatchers)
+		if self.numWorkers > 1 {
+			workersWg.Add(1)
+			go workers[i].run(&workersWg)
+		}
+	}
+
+	// Applies a matcher change to every worker, waiting until they've all
+	// applied it.
+	update := func(ctl routerControl) {
+		if self.numWorkers == 1 {
+			workers[0].apply(ctl)
+			return
+		}
+		var done sync.WaitGroup
+		done.Add(len(workers))
+		ctl.done = &done
+		for _, w := range workers {
+			w.control <- ctl
+		}
+		done.Wait()
+	}
+
 	go func() {
 		var matcher *MatchRunner
 		var ok = true
@@ -100,29 +189,20 @@ func (self *messageRouter) Start() {
 			select {
 			case matcher = <-self.addFilterMatcher:
 				if matcher != nil {
-					exists := false
-					available := -1
-					for i, m := range self.fMatchers {
-						if m == nil {
-							available = i
-						}
-						if matcher == m {
-							exists = true
-							break
-						}
-					}
-					if !exists {
-						if available != -1 {
-							self.fMatchers[available] = matcher
-						} else {
-							self.fMatchers = append(self.fMatchers, matcher)
-						}
-					}
+					self.fMatchers = addMatcher(self.fMatchers, matcher)
+					update(routerControl{matcher: matcher, filter: true, add: true})
+				}
+			case matcher = <-self.addOutputMatcher:
+				if matcher != nil {
+					self.oMatchers = addMatcher(self.oMatchers, matcher)
+					update(routerControl{matcher: matcher, add: true})
 				}
 			case matcher = <-self.removeFilterMatcher:
 				if matcher != nil {
 					for i, m := range self.fMatchers {
 						if matcher == m {
+							// No worker may send to the matcher once it's closed.
+							update(routerControl{matcher: matcher, filter: true})
 							close(m.inChan)
 							self.fMatchers[i] = nil
 							break
@@ -133,6 +213,7 @@ func (self *messageRouter) Start() {
 				if matcher != nil {
 					for i, m := range self.oMatchers {
 						if matcher == m {
+							update(routerControl{matcher: matcher})
 							close(m.inChan)
 							self.oMatchers[i] = nil
 							break
@@ -143,38 +224,147 @@ func (self *messageRouter) Start() {
 				if !ok {
 					break
 				}
-				pack.diagnostics.Reset()
 				atomic.AddInt64(&self.processMessageCount, 1)
-				for _, matcher = range self.fMatchers {
-					if matcher != nil {
-						atomic.AddInt32(&pack.RefCount, 1)
-						pack.diagnostics.AddStamp(matcher.pluginRunner)
-						matcher.inChan <- pack
-					}
-				}
-				for _, matcher = range self.oMatchers {
-					if matcher != nil {
-						atomic.AddInt32(&pack.RefCount, 1)
-						pack.diagnostics.AddStamp(matcher.pluginRunner)
-						matcher.inChan <- pack
-					}
+				self.volume.count(pack.Message)
+				pack.commitJournal()
+				if self.numWorkers == 1 {
+					workers[0].route(pack)
+				} else {
+					workers[self.shard(pack)].inChan <- pack
 				}
-				pack.Recycle()
 			}
 		}
+		if self.numWorkers > 1 {
+			for _, w := range workers {
+				close(w.inChan)
+			}
+			workersWg.Wait()
+		}
 		for _, matcher = range self.fMatchers {
 			if matcher != nil {
 				close(matcher.inChan)
 			}
 		}
 		for _, matcher = range self.oMatchers {
-			close(matcher.inChan)
+			if matcher != nil {
+				close(matcher.inChan)
+			}
 		}
 		log.Println("MessageRouter stopped.")
 	}()
 	log.Println("MessageRouter started.")
 }
 
+// Matcher change sent to the router workers.
+type routerControl struct {
+	matcher *MatchRunner
+	// Whether the matcher belongs to a filter (as opposed to an output).
+	filter bool
+	// Whether the matcher is added (as opposed to removed).
+	add bool
+	// Marked done once the change is applied.
+	done *sync.WaitGroup
+}
+
+// Delivers packs to the matchers. The router runs one or more of these.
+type routerWorker struct {
+	inChan    chan *PipelinePack
+	control   chan routerControl
+	fMatchers []*MatchRunner
+	oMatchers []*MatchRunner
+}
+
+func newRouterWorker(fMatchers, oMatchers []*MatchRunner) (w *routerWorker) {
+	w = &routerWorker{
+		inChan:    make(chan *PipelinePack, Globals().PluginChanSize),
+		control:   make(chan routerControl),
+		fMatchers: make([]*MatchRunner, len(fMatchers)),
+		oMatchers: make([]*MatchRunner, len(oMatchers)),
+	}
+	copy(w.fMatchers, fMatchers)
+	copy(w.oMatchers, oMatchers)
+	return
+}
+
+func (w *routerWorker) apply(ctl routerControl) {
+	matchers := &w.oMatchers
+	if ctl.filter {
+		matchers = &w.fMatchers
+	}
+	if ctl.add {
+		*matchers = addMatcher(*matchers, ctl.matcher)
+	} else {
+		for i, m := range *matchers {
+			if m == ctl.matcher {
+				(*matchers)[i] = nil
+				break
+			}
+		}
+	}
+	if ctl.done != nil {
+		ctl.done.Done()
+	}
+}
+
+// Hands the pack to every filter and output matcher.
+func (w *routerWorker) route(pack *PipelinePack) {
+	pack.diagnostics.Reset()
+	for _, matcher := range w.fMatchers {
+		if matcher != nil {
+			atomic.AddInt32(&pack.RefCount, 1)
+			pack.diagnostics.AddStamp(matcher.pluginRunner)
+			matcher.deliver(pack)
+		}
+	}
+	for _, matcher := range w.oMatchers {
+		if matcher != nil {
+			atomic.AddInt32(&pack.RefCount, 1)
+			pack.diagnostics.AddStamp(matcher.pluginRunner)
+			matcher.deliver(pack)
+		}
+	}
+	pack.Recycle()
+}
+
+func (w *routerWorker) run(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case ctl := <-w.control:
+			// The routing goroutine is waiting for us, so everything queued
+			// was routed before the change and is delivered first.
+			for n := len(w.inChan); n > 0; n-- {
+				w.route(<-w.inChan)
+			}
+			w.apply(ctl)
+		case pack, ok := <-w.inChan:
+			if !ok {
+				return
+			}
+			w.route(pack)
+		}
+	}
+}
+
+// Adds the matcher to the set unless it's already there, reusing the slot of
+// a removed matcher if there is one.
+func addMatcher(matchers []*MatchRunner, matcher *MatchRunner) []*MatchRunner {
+	available := -1
+	for i, m := range matchers {
+		if m == nil {
+			available = i
+		}
+		if matcher == m {
+			return matchers
+		}
+	}
+	if available != -1 {
+		matchers[available] = matcher
+		return matchers
+	}
+	return append(matchers, matcher)
+}
+
 // Encapsulates the mechanics of testing messages against a specific plugin's
 // message_matcher value.
 type MatchRunner struct {
@@ -185,6 +375,39 @@ type MatchRunner struct {
 	matchSamples  int64
 	matchDuration int64
 	reportLock    sync.Mutex
+	// Skips expired messages, only set for outputs.
+	expiry *messageExpiry
+	// Drops low severity messages while the output is backed up, only set
+	// for outputs with shedding configured.
+	shedder *severityShedder
+	// Diverts the plugin's messages while it's too slow, only set for
+	// plugins with `isolate_after` configured.
+	isolator *consumerIsolator
+	// Drops messages instead of waiting for the plugin, only set for plugins
+	// with a non blocking `delivery_policy`.
+	policy *deliveryPolicy
+	// Tenants whose messages the plugin receives, all if nil.
+	tenants map[string]bool
+	// Diverts the matched messages too old for the plugin, only set for
+	// plugins with `hot_window` configured.
+	hot *hotWindow
+	// Drops the matched messages while another instance holds the filter's
+	// leader lock, only set for filters with `leader_lock` configured.
+	leader *leaderElector
+	// Records the matched messages for the filter's matcher class and
+	// replays the recent ones when it starts, only set for filters with
+	// `replay` configured.
+	replay *matcherReplay
+	// Number of deliveries for which the router had to wait on the full
+	// input channel, and the total nanoseconds it waited.
+	blockedCount    int64
+	blockedDuration int64
+	// Channel the matched packs are delivered to, set by Start. Other
+	// goroutines hand packs to it through offer, matchLock keeps them from
+	// sending once it's closed.
+	matchLock   sync.Mutex
+	matchChan   chan *PipelinePack
+	matchClosed bool
 }
 
 // Creates and returns a new MatchRunner if possible, or a relevant error if
@@ -203,6 +426,19 @@ func NewMatchRunner(filter, signer string, runner PluginRunner) (matcher *MatchR
 	return
 }
 
+// Restricts the plugin to the messages of the given tenants, or lifts the
+// restriction if there are none. Only called before the matcher starts.
+func (mr *MatchRunner) SetTenants(tenants []string) {
+	if len(tenants) == 0 {
+		mr.tenants = nil
+		return
+	}
+	mr.tenants = make(map[string]bool)
+	for _, tenant := range tenants {
+		mr.tenants[tenant] = true
+	}
+}
+
 // Returns the runner's MatcherSpecification object.
 func (mr *MatchRunner) MatcherSpecification() *message.MatcherSpecification {
 	return mr.spec
@@ -213,6 +449,73 @@ func (mr *MatchRunner) InChanLen() int {
 	return len(mr.inChan)
 }
 
+// Returns the number of times the router blocked delivering a pack to the
+// runner because its input channel was full, and the total time it spent
+// blocked in nanoseconds.
+func (mr *MatchRunner) RouterBlocked() (count, duration int64) {
+	return atomic.LoadInt64(&mr.blockedCount), atomic.LoadInt64(&mr.blockedDuration)
+}
+
+// Puts the pack on the input channel, timing the wait if the channel is full.
+// Only the blocking sends are timed, so the common case stays cheap. With an
+// isolator the wait is bounded, the pack is diverted once it times out.
+func (mr *MatchRunner) deliver(pack *PipelinePack) {
+	isolator := mr.isolator
+	if isolator != nil && isolator.check(mr) {
+		isolator.divert(mr, pack)
+		return
+	}
+	select {
+	case mr.inChan <- pack:
+		return
+	default:
+	}
+	start := time.Now()
+	if isolator == nil {
+		mr.inChan <- pack
+	} else {
+		timer := time.NewTimer(isolator.after)
+		select {
+		case mr.inChan <- pack:
+		case <-timer.C:
+			isolator.isolate(mr)
+			isolator.divert(mr, pack)
+		}
+		timer.Stop()
+	}
+	atomic.AddInt64(&mr.blockedDuration, time.Since(start).Nanoseconds())
+	atomic.AddInt64(&mr.blockedCount, 1)
+}
+
+// Returns true if the pack passes the runner's signer and tenant checks and
+// its message matcher.
+func (mr *MatchRunner) matches(pack *PipelinePack) bool {
+	if len(mr.signer) != 0 && mr.signer != pack.Signer {
+		return false
+	}
+	if mr.tenants != nil && !mr.tenants[pack.Tenant] {
+		return false
+	}
+	return mr.spec.Match(pack.Message)
+}
+
+// Hands an already matched pack straight to the runner's plugin, i.e. to the
+// channel the runner was started with. Never blocks, returns false if the
+// channel is full, or the runner isn't started or has stopped.
+func (mr *MatchRunner) offer(pack *PipelinePack) bool {
+	mr.matchLock.Lock()
+	defer mr.matchLock.Unlock()
+	if mr.matchChan == nil || mr.matchClosed {
+		return false
+	}
+	select {
+	case mr.matchChan <- pack:
+		return true
+	default:
+		return false
+	}
+}
+
 // Returns the runner's average match duration in nanoseconds
 func (mr *MatchRunner) GetAvgDuration() (duration int64) {
 	mr.reportLock.Lock()
@@ -228,6 +531,10 @@ func (mr *MatchRunner) GetAvgDuration() (duration int64) {
 // channel for a specific Filter or Output plugin). Any messages that are not a
 // match will be immediately recycled.
 func (mr *MatchRunner) Start(matchChan chan *PipelinePack) {
+	mr.matchLock.Lock()
+	mr.matchChan = matchChan
+	mr.matchClosed = false
+	mr.matchLock.Unlock()
 	go func() {
 		defer func() {
 			if r := recover(); r != nil {
@@ -242,9 +549,10 @@ func (mr *MatchRunner) Start(matchChan chan *PipelinePack) {
 			}
 		}()
 
+		denominator := SampleDenominator(mr.pluginRunner)
 		var (
 			startTime time.Time
-			random    int = rand.Intn(1000) + DURATION_SAMPLE_DENOMINATOR
+			random    int = rand.Intn(denominator) + denominator
 			// Don't have everyone sample at the same time. We always start with
 			// a sample so there will be a ballpark figure immediately. We could
 			// use a ticker to sample at a regular interval but that seems like
@@ -254,12 +562,21 @@ func (mr *MatchRunner) Start(matchChan chan *PipelinePack) {
 			duration int64
 		)
 
+		var stopReplay func()
+		if mr.replay != nil {
+			stopReplay = mr.replay.start(matchChan)
+		}
+
 		var capacity int64 = int64(cap(mr.inChan))
 		for pack := range mr.inChan {
 			if len(mr.signer) != 0 && mr.signer != pack.Signer {
 				pack.Recycle()
 				continue
 			}
+			if mr.tenants != nil && !mr.tenants[pack.Tenant] {
+				pack.Recycle()
+				continue
+			}
 			// We may want to keep separate samples for match/nomatch conditions.
 			// In most cases the random sampling will capture the most common
 			// condition which is usesful for the overall system health but not
@@ -276,20 +593,46 @@ func (mr *MatchRunner) Start(matchChan chan *PipelinePack) {
 				mr.reportLock.Unlock()
 				if mr.matchSamples > capacity {
 					// the timings can vary greatly, so we need to establish a
-					// decent baseline before we start sampling
-					counter = 0
+					// decent baseline before we start sampling. The count
+					// includes this message so a denominator of 1 samples
+					// every message.
+					counter = 1
 				}
 			} else {
 				match = mr.spec.Match(pack.Message)
 				counter++
 			}
 
-			if match {
-				matchChan <- pack
+			if match && mr.replay != nil {
+				mr.replay.record(pack)
+			}
+			if match && mr.leader != nil && !mr.leader.IsLeader() {
+				atomic.AddInt64(&mr.leader.standbyCount, 1)
+				pack.Recycle()
+				continue
+			}
+			if match && mr.hot != nil && mr.hot.isCold(pack.Message) {
+				mr.hot.divert(pack)
+				continue
+			}
+			if match && (mr.expiry == nil || !mr.expiry.check(pack.Message)) &&
+				(mr.shedder == nil || !mr.shedder.check(pack.Message)) {
+				if mr.policy == nil {
+					matchChan <- pack
+				} else {
+					mr.policy.send(matchChan, pack)
+				}
 			} else {
 				pack.Recycle()
 			}
 		}
+		if mr.replay != nil {
+			stopReplay()
+			mr.replay.stopRecording()
+		}
+		mr.matchLock.Lock()
+		mr.matchClosed = true
 		close(matchChan)
+		mr.matchLock.Unlock()
 	}()
 }
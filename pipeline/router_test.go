@@ -0,0 +1,267 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"sync"
+	"time"
+)
+
+func RouterSpec(c gs.Context) {
+	globals := DefaultGlobals()
+	globals.PoolSize = 100
+	globals.RouterWorkers = 4
+	NewPipelineConfig(globals)
+
+	loggers := []string{"a", "b", "c", "d", "e"}
+
+	newMatcher := func(name string) *MatchRunner {
+		runner := NewFORunner(name, nil, new(PluginGlobals))
+		matcher, err := NewMatchRunner("TRUE", "", runner)
+		c.Assume(err, gs.IsNil)
+		return matcher
+	}
+
+	// Reads packs from the matcher until it's closed, returning the Pid
+	// values received for each logger.
+	collect := func(matcher *MatchRunner, wg *sync.WaitGroup) map[string][]int32 {
+		received := make(map[string][]int32)
+		go func() {
+			for pack := range matcher.inChan {
+				logger := pack.Message.GetLogger()
+				received[logger] = append(received[logger], pack.Message.GetPid())
+				pack.Recycle()
+			}
+			wg.Done()
+		}()
+		return received
+	}
+
+	c.Specify("A sharded router", func() {
+		router := NewMessageRouter()
+		c.Expect(router.numWorkers, gs.Equals, 4)
+		recycleChan := make(chan *PipelinePack, globals.PoolSize)
+		for i := 0; i < globals.PoolSize; i++ {
+			recycleChan <- NewPipelinePack(recycleChan)
+		}
+
+		c.Specify("shards on the configured field", func() {
+			pack := NewPipelinePack(recycleChan)
+			pack.Message.SetLogger("a")
+			shard := router.shard(pack)
+			pack.Message.SetHostname("somewhere")
+			c.Expect(router.shard(pack), gs.Equals, shard)
+			router.shardField = "Hostname"
+			pack.Message.SetLogger("b")
+			shard = router.shard(pack)
+			c.Expect(shard >= 0 && shard < 4, gs.IsTrue)
+			pack.Message.SetLogger("c")
+			c.Expect(router.shard(pack), gs.Equals, shard)
+		})
+
+		c.Specify("delivers every pack in order per shard key", func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			filter := newMatcher("filter")
+			output := newMatcher("output")
+			router.fMatchers = append(router.fMatchers, filter)
+			router.Start()
+			router.AddOutputMatcher() <- output
+			filterReceived := collect(filter, &wg)
+			outputReceived := collect(output, &wg)
+
+			for i := 0; i < 1000; i++ {
+				pack := <-recycleChan
+				pack.Message.SetLogger(loggers[i%len(loggers)])
+				pack.Message.SetPid(int32(i))
+				router.InChan() <- pack
+			}
+			close(router.InChan())
+			wg.Wait()
+
+			for _, received := range []map[string][]int32{filterReceived,
+				outputReceived} {
+
+				total := 0
+				for _, logger := range loggers {
+					pids := received[logger]
+					total += len(pids)
+					for i := 1; i < len(pids); i++ {
+						c.Expect(pids[i] > pids[i-1], gs.IsTrue)
+					}
+				}
+				c.Expect(total, gs.Equals, 1000)
+			}
+			c.Expect(len(recycleChan), gs.Equals, globals.PoolSize)
+		})
+
+		c.Specify("stops delivering to a removed matcher", func() {
+			var wg sync.WaitGroup
+			wg.Add(2)
+			filter := newMatcher("filter")
+			output := newMatcher("output")
+			router.Start()
+			router.AddFilterMatcher() <- filter
+			router.AddOutputMatcher() <- output
+			filterReceived := collect(filter, &wg)
+			outputReceived := collect(output, &wg)
+
+			send := func(from, to int) {
+				for i := from; i < to; i++ {
+					pack := <-recycleChan
+					pack.Message.SetLogger(loggers[i%len(loggers)])
+					pack.Message.SetPid(int32(i))
+					router.InChan() <- pack
+				}
+			}
+			send(0, 100)
+			router.RemoveFilterMatcher() <- filter
+			send(100, 200)
+			close(router.InChan())
+			wg.Wait()
+
+			count := func(received map[string][]int32) (total int) {
+				for _, pids := range received {
+					total += len(pids)
+				}
+				return
+			}
+			c.Expect(count(filterReceived) <= 100, gs.IsTrue)
+			c.Expect(count(outputReceived), gs.Equals, 200)
+			c.Expect(len(recycleChan), gs.Equals, globals.PoolSize)
+		})
+	})
+
+	c.Specify("A MatchRunner", func() {
+		matcher := newMatcher("output")
+		matcher.inChan = make(chan *PipelinePack, 1)
+		recycleChan := make(chan *PipelinePack, 2)
+
+		c.Specify("only times deliveries that block", func() {
+			matcher.deliver(NewPipelinePack(recycleChan))
+			count, duration := matcher.RouterBlocked()
+			c.Expect(count, gs.Equals, int64(0))
+			c.Expect(duration, gs.Equals, int64(0))
+
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				<-matcher.inChan
+			}()
+			matcher.deliver(NewPipelinePack(recycleChan))
+			count, duration = matcher.RouterBlocked()
+			c.Expect(count, gs.Equals, int64(1))
+			c.Expect(duration >= int64(10*time.Millisecond), gs.IsTrue)
+		})
+
+		c.Specify("isolates its consumer once the router times out", func() {
+			matcher.isolator = &consumerIsolator{after: 10 * time.Millisecond}
+			matcher.deliver(NewPipelinePack(recycleChan))
+			matcher.deliver(NewPipelinePack(recycleChan))
+			c.Expect(matcher.isolator.Isolated(), gs.IsTrue)
+			c.Expect(matcher.isolator.DivertedCount(), gs.Equals, int64(1))
+			c.Expect(len(recycleChan), gs.Equals, 1)
+
+			c.Specify("until its channel drains", func() {
+				<-recycleChan
+				matcher.deliver(NewPipelinePack(recycleChan))
+				c.Expect(matcher.isolator.DivertedCount(), gs.Equals, int64(2))
+				c.Expect(len(recycleChan), gs.Equals, 1)
+
+				<-matcher.inChan
+				matcher.deliver(NewPipelinePack(recycleChan))
+				c.Expect(matcher.isolator.Isolated(), gs.IsFalse)
+				c.Expect(matcher.isolator.DivertedCount(), gs.Equals, int64(2))
+				c.Expect(len(matcher.inChan), gs.Equals, 1)
+			})
+		})
+
+		c.Specify("diverts an isolated consumer's packs to its failover", func() {
+			pc := NewPipelineConfig(globals)
+			failover := NewFORunner("failover", nil, new(PluginGlobals))
+			failover.matcher = newMatcher("failover")
+			failover.matcher.Start(failover.inChan)
+			defer close(failover.matcher.inChan)
+			pc.OutputRunners["failover"] = failover
+			matcher.isolator = &consumerIsolator{
+				after:        time.Millisecond,
+				failoverName: "failover",
+				pc:           pc,
+			}
+			matcher.deliver(NewPipelinePack(recycleChan))
+			pack := NewPipelinePack(recycleChan)
+			matcher.deliver(pack)
+			c.Expect(matcher.isolator.Isolated(), gs.IsTrue)
+			c.Expect(len(failover.inChan), gs.Equals, 1)
+			c.Expect(<-failover.inChan, gs.Equals, pack)
+
+			c.Specify("if its matcher accepts them", func() {
+				matcher.spec, _ = message.CreateMatcherSpecification("Type == 'foo'")
+				matcher.deliver(NewPipelinePack(recycleChan))
+				c.Expect(len(failover.inChan), gs.Equals, 0)
+				c.Expect(len(recycleChan), gs.Equals, 1)
+				c.Expect(matcher.isolator.DivertedCount(), gs.Equals, int64(1))
+				c.Expect(matcher.isolator.DroppedCount(), gs.Equals, int64(0))
+			})
+
+			c.Specify("through its queue buffer", func() {
+				failover.buffer = &queueBuffer{inChan: make(chan *PipelinePack, 1)}
+				failover.matcher = newMatcher("failover")
+				failover.matcher.Start(failover.buffer.inChan)
+				defer close(failover.matcher.inChan)
+				pack = NewPipelinePack(recycleChan)
+				matcher.deliver(pack)
+				c.Expect(len(failover.inChan), gs.Equals, 0)
+				c.Expect(<-failover.buffer.inChan, gs.Equals, pack)
+			})
+
+			c.Specify("dropping them when it's full", func() {
+				for len(failover.inChan) < cap(failover.inChan) {
+					failover.inChan <- NewPipelinePack(nil)
+				}
+				matcher.deliver(NewPipelinePack(recycleChan))
+				c.Expect(matcher.isolator.DivertedCount(), gs.Equals, int64(2))
+				c.Expect(matcher.isolator.DroppedCount(), gs.Equals, int64(1))
+				c.Expect(len(recycleChan), gs.Equals, 1)
+			})
+
+			c.Specify("dropping them once it has stopped", func() {
+				stopped := newMatcher("failover")
+				stoppedChan := make(chan *PipelinePack, 1)
+				stopped.Start(stoppedChan)
+				close(stopped.inChan)
+				for _ = range stoppedChan {
+				}
+				failover.matcher = stopped
+				matcher.deliver(NewPipelinePack(recycleChan))
+				c.Expect(matcher.isolator.DroppedCount(), gs.Equals, int64(1))
+				c.Expect(len(recycleChan), gs.Equals, 1)
+			})
+
+			c.Specify("looking it up again once it's replaced", func() {
+				replacement := NewFORunner("failover", nil, new(PluginGlobals))
+				replacement.matcher = newMatcher("failover")
+				replacement.matcher.Start(replacement.inChan)
+				defer close(replacement.matcher.inChan)
+				pc.OutputRunners["failover"] = replacement
+				pack = NewPipelinePack(recycleChan)
+				matcher.deliver(pack)
+				c.Expect(len(failover.inChan), gs.Equals, 0)
+				c.Expect(<-replacement.inChan, gs.Equals, pack)
+			})
+		})
+	})
+}
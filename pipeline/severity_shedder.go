@@ -0,0 +1,63 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"sync/atomic"
+)
+
+// Sheds the less severe messages headed for an output while its queue is
+// filled past a threshold, so the important ones still get through a slow
+// or degraded output. Severities follow syslog, lower is more severe.
+type severityShedder struct {
+	// Queue fill percentage at which shedding starts.
+	percent uint
+	// Most severe (highest) severity still delivered while shedding.
+	maxSeverity int32
+	// Returns the current queue fill percentage.
+	fill func() uint
+	shed int64
+}
+
+// Returns true if the message should be dropped.
+func (s *severityShedder) check(msg *message.Message) bool {
+	if msg.GetSeverity() <= s.maxSeverity || s.fill() < s.percent {
+		return false
+	}
+	atomic.AddInt64(&s.shed, 1)
+	return true
+}
+
+// Returns the number of shed messages so far.
+func (s *severityShedder) ShedCount() int64 {
+	return atomic.LoadInt64(&s.shed)
+}
+
+// Returns how full the runner's queue is, in percent: the disk queue if
+// buffering with a `max_buffer_size`, the in memory channel otherwise.
+func (foRunner *foRunner) queueFill() uint {
+	if qb := foRunner.buffer; qb != nil && qb.maxSize > 0 {
+		fill := uint64(qb.QueueSize()) * 100 / qb.maxSize
+		if fill > 100 {
+			fill = 100
+		}
+		return uint(fill)
+	}
+	if cap(foRunner.inChan) == 0 {
+		return 0
+	}
+	return uint(len(foRunner.inChan) * 100 / cap(foRunner.inChan))
+}
@@ -0,0 +1,71 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func SeverityShedderSpec(c gs.Context) {
+	c.Specify("A severity shedder", func() {
+		runner := NewFORunner("shedOutput", nil, new(PluginGlobals))
+		runner.inChan = make(chan *PipelinePack, 10)
+		shedder := &severityShedder{
+			percent:     80,
+			maxSeverity: 4,
+			fill:        runner.queueFill,
+		}
+		msg := &message.Message{}
+		fillQueue := func(n int) {
+			for i := 0; i < n; i++ {
+				runner.inChan <- NewPipelinePack(nil)
+			}
+		}
+
+		c.Specify("measures the in memory queue", func() {
+			c.Expect(runner.queueFill(), gs.Equals, uint(0))
+			fillQueue(5)
+			c.Expect(runner.queueFill(), gs.Equals, uint(50))
+		})
+
+		c.Specify("delivers everything below the threshold", func() {
+			fillQueue(7)
+			msg.SetSeverity(7)
+			c.Expect(shedder.check(msg), gs.IsFalse)
+			c.Expect(shedder.ShedCount(), gs.Equals, int64(0))
+		})
+
+		c.Specify("above the threshold", func() {
+			fillQueue(8)
+
+			c.Specify("sheds and counts less severe messages", func() {
+				msg.SetSeverity(6)
+				c.Expect(shedder.check(msg), gs.IsTrue)
+				msg.SetSeverity(5)
+				c.Expect(shedder.check(msg), gs.IsTrue)
+				c.Expect(shedder.ShedCount(), gs.Equals, int64(2))
+			})
+
+			c.Specify("delivers severe messages", func() {
+				msg.SetSeverity(4)
+				c.Expect(shedder.check(msg), gs.IsFalse)
+				msg.SetSeverity(0)
+				c.Expect(shedder.check(msg), gs.IsFalse)
+				c.Expect(shedder.ShedCount(), gs.Equals, int64(0))
+			})
+		})
+	})
+}
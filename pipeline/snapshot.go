@@ -0,0 +1,334 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Name of the manifest file of a snapshot, the base_dir files are kept in
+// the snapshot's "files" directory.
+const SNAPSHOT_MANIFEST = "manifest.json"
+
+// Longest each stage of a snapshot waits for the plugins to stop and the
+// messages in flight to be processed. Replaced in tests.
+var snapshotDrainTimeout = 30 * time.Second
+
+// A base_dir file saved in a snapshot.
+type SnapshotFile struct {
+	// Path relative to the base_dir, slash separated.
+	Path   string
+	Size   int64
+	Mode   os.FileMode
+	Sha256 string
+}
+
+// Describes a snapshot of the pipeline's persistent state, i.e. the queue
+// and journal checkpoints, disk queues, sandbox and key/value store data
+// kept in the base_dir.
+type SnapshotManifest struct {
+	Hostname string
+	Created  time.Time
+	BaseDir  string
+	// Whether every message in flight was processed before the plugins
+	// stopped, a plugin that didn't stop in time leaves it false.
+	Drained bool
+	// Plugins stopped for the snapshot.
+	Plugins []string
+	Files   []SnapshotFile
+}
+
+// Returns the directory the snapshots are written to.
+func snapshotRoot() string {
+	if Globals().SnapshotDir != "" {
+		return Globals().SnapshotDir
+	}
+	return GetHekaConfigDir("snapshots")
+}
+
+// Waits for the channels to be closed, returning false if they aren't before
+// the timeout.
+func waitStopped(stopped []<-chan struct{}, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for _, ch := range stopped {
+		if ch == nil {
+			continue
+		}
+		select {
+		case <-ch:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
+
+// Waits for every pack of the pool to be recycled, returning false if they
+// aren't before the timeout.
+func (self *PipelineConfig) waitForPacks(pool *packPool, supply chan *PipelinePack,
+	timeout time.Duration) bool {
+
+	deadline := time.Now().Add(timeout)
+	for len(supply) < self.poolSize(pool, supply) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// Stops the named plugins like StopPlugin and waits for them to exit.
+// Returns false if they didn't in time.
+func (self *PipelineConfig) quiesce(names []string, manifest *SnapshotManifest) bool {
+	sort.Strings(names)
+	stopped := make([]<-chan struct{}, 0, len(names))
+	for _, name := range names {
+		if _, ok := self.sectionCategories[name]; ok {
+			stopped = append(stopped, self.stopSection(name))
+			self.forgetSection(name)
+		} else {
+			// Filters started by a SandboxManager aren't config sections.
+			self.filtersLock.Lock()
+			runner := self.FilterRunners[name]
+			self.filtersLock.Unlock()
+			if !self.RemoveFilterRunner(name) {
+				continue
+			}
+			if fr, ok := runner.(*foRunner); ok {
+				stopped = append(stopped, fr.stopped)
+			}
+		}
+		manifest.Plugins = append(manifest.Plugins, name)
+		log.Printf("Stopped '%s' for the snapshot", name)
+	}
+	return waitStopped(stopped, snapshotDrainTimeout)
+}
+
+// Snapshot quiesces the pipeline and saves its persistent state, so it can
+// be restored on another host (see RestoreSnapshot) and resume where it left
+// off. The inputs are stopped first, then the filters once the messages the
+// inputs produced are processed, and the outputs once the messages the
+// filters injected are. Stopping the plugins saves their checkpoints and
+// sandbox data and flushes the outputs, and the key/value stores are
+// flushed. The base_dir is then copied to a new directory of the
+// `snapshot_dir`, along with a manifest of its files, which is written last.
+// The plugins stay stopped until a config reload or a restart.
+func (self *PipelineConfig) Snapshot() (dir string, manifest *SnapshotManifest,
+	err error) {
+
+	self.reloadLock.Lock()
+	defer self.reloadLock.Unlock()
+
+	if Globals().Stopping {
+		return "", nil, errors.New("Heka is shutting down")
+	}
+	manifest = &SnapshotManifest{
+		Hostname: Globals().Hostname,
+		Created:  time.Now().UTC(),
+		BaseDir:  Globals().BaseDir,
+		Drained:  true,
+		Plugins:  make([]string, 0),
+	}
+	drained := func(ok bool) {
+		manifest.Drained = manifest.Drained && ok
+	}
+
+	names := make([]string, 0)
+	self.inputsLock.Lock()
+	for name := range self.InputRunners {
+		names = append(names, name)
+	}
+	self.inputsLock.Unlock()
+	drained(self.quiesce(names, manifest))
+	drained(self.waitForPacks(self.inputPool, self.inputRecycleChan,
+		snapshotDrainTimeout))
+
+	names = make([]string, 0)
+	self.filtersLock.Lock()
+	for name := range self.FilterRunners {
+		names = append(names, name)
+	}
+	self.filtersLock.Unlock()
+	drained(self.quiesce(names, manifest))
+	drained(self.waitForPacks(self.injectPool, self.injectRecycleChan,
+		snapshotDrainTimeout))
+
+	names = make([]string, 0)
+	self.outputsLock.Lock()
+	for name := range self.OutputRunners {
+		names = append(names, name)
+	}
+	self.outputsLock.Unlock()
+	drained(self.quiesce(names, manifest))
+
+	self.flushKVStores()
+	if !manifest.Drained {
+		log.Println("Not every plugin stopped in time for the snapshot, " +
+			"messages in flight may be missing from it")
+	}
+
+	root := snapshotRoot()
+	dir = filepath.Join(root, manifest.Created.Format("20060102-150405"))
+	for i := 1; snapshotExists(dir); i++ {
+		dir = filepath.Join(root, fmt.Sprintf("%s.%d",
+			manifest.Created.Format("20060102-150405"), i))
+	}
+	if err = writeSnapshot(Globals().BaseDir, dir, root, manifest); err != nil {
+		return "", nil, fmt.Errorf("can't write snapshot: %s", err)
+	}
+	log.Printf("Snapshot of %d files written to %s", len(manifest.Files), dir)
+	return
+}
+
+func snapshotExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Copies the file, returning the hex SHA-256 digest of its contents.
+func copySnapshotFile(src, dest string, mode os.FileMode) (digest string,
+	err error) {
+
+	var in, out *os.File
+	if in, err = os.Open(src); err != nil {
+		return
+	}
+	defer in.Close()
+	if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return
+	}
+	if out, err = os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		mode); err != nil {
+		return
+	}
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(out, hash), in); err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return hex.EncodeToString(hash.Sum(nil)), err
+}
+
+// Copies the regular files of the base_dir, except those in the excluded
+// directory, to the snapshot's "files" directory, then writes the manifest.
+func writeSnapshot(baseDir, dir, exclude string, manifest *SnapshotManifest) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	filesDir := filepath.Join(dir, "files")
+	exclude = filepath.Clean(exclude)
+	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && filepath.Clean(path) == exclude {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		file := SnapshotFile{
+			Path: filepath.ToSlash(rel),
+			Size: info.Size(),
+			Mode: info.Mode().Perm(),
+		}
+		if file.Sha256, err = copySnapshotFile(path, filepath.Join(filesDir, rel),
+			file.Mode); err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, SNAPSHOT_MANIFEST), data, 0600)
+}
+
+// Returns the digest of the file's contents.
+func fileSha256(path string) (digest string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// RestoreSnapshot copies the files of a snapshot written by Snapshot into
+// the base_dir, replacing the files already there, so the pipeline resumes
+// where the snapshot left off when it's loaded. Every file is checked
+// against the manifest before any is copied. Must be called before the
+// pipeline config is loaded.
+func RestoreSnapshot(dir, baseDir string) (manifest *SnapshotManifest, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, SNAPSHOT_MANIFEST))
+	if err != nil {
+		return nil, fmt.Errorf("can't read snapshot manifest: %s", err)
+	}
+	manifest = new(SnapshotManifest)
+	if err = json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest: %s", err)
+	}
+	filesDir := filepath.Join(dir, "files")
+	for _, file := range manifest.Files {
+		rel := filepath.Clean(filepath.FromSlash(file.Path))
+		if filepath.IsAbs(rel) || rel == ".." ||
+			strings.HasPrefix(rel, ".."+string(os.PathSeparator)) {
+			return nil, fmt.Errorf("invalid snapshot file path: %s", file.Path)
+		}
+		var digest string
+		if digest, err = fileSha256(filepath.Join(filesDir, rel)); err != nil {
+			return nil, fmt.Errorf("can't read snapshot file: %s", err)
+		}
+		if digest != file.Sha256 {
+			return nil, fmt.Errorf("snapshot file %s is corrupt", file.Path)
+		}
+	}
+	for _, file := range manifest.Files {
+		rel := filepath.FromSlash(file.Path)
+		if _, err = copySnapshotFile(filepath.Join(filesDir, rel),
+			filepath.Join(baseDir, rel), file.Mode); err != nil {
+			return nil, fmt.Errorf("can't restore %s: %s", file.Path, err)
+		}
+	}
+	return
+}
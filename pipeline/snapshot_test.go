@@ -0,0 +1,140 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+func SnapshotSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	baseDir := filepath.Join(tmpDir, "base")
+
+	writeFile := func(path, contents string) {
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		c.Assume(err, gs.IsNil)
+		err = ioutil.WriteFile(path, []byte(contents), 0640)
+		c.Assume(err, gs.IsNil)
+	}
+	readFile := func(path string) string {
+		contents, err := ioutil.ReadFile(path)
+		c.Assume(err, gs.IsNil)
+		return string(contents)
+	}
+
+	c.Specify("A snapshot", func() {
+		atomic.StoreInt32(&reloadOutputRuns, 0)
+		atomic.StoreInt32(&reloadOutputStops, 0)
+		config := NewPipelineConfig(nil)
+		Globals().BaseDir = baseDir
+		writeFile(filepath.Join(baseDir, "queue", "out1", "checkpoint.txt"), "1 42")
+		writeFile(filepath.Join(baseDir, "sandbox_preservation", "counter.data"),
+			"count = 7")
+		writeFile(filepath.Join(baseDir, "snapshots", "old", SNAPSHOT_MANIFEST), "{}")
+
+		configDir := filepath.Join(tmpDir, "config")
+		writeFile(filepath.Join(configDir, "hekad.toml"), `
+[out1]
+type = "ReloadTestOutput"
+message_matcher = "Type == 'foo'"
+`)
+		err := config.LoadFromConfigPath(configDir)
+		c.Assume(err, gs.IsNil)
+		config.router.Start()
+		defer close(config.router.InChan())
+		for _, output := range config.OutputRunners {
+			config.outputsWg.Add(1)
+			output.Start(config, &config.outputsWg)
+		}
+		c.Assume(waitForCount(&reloadOutputRuns, 1), gs.IsTrue)
+		// Every pack is back in the pools.
+		for i := 0; i < cap(config.inputRecycleChan); i++ {
+			config.inputRecycleChan <- NewPipelinePack(config.inputRecycleChan)
+			config.injectRecycleChan <- NewPipelinePack(config.injectRecycleChan)
+		}
+
+		dir, manifest, err := config.Snapshot()
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("stops the plugins until a reload", func() {
+			c.Expect(manifest.Drained, gs.IsTrue)
+			c.Assume(len(manifest.Plugins), gs.Equals, 1)
+			c.Expect(manifest.Plugins[0], gs.Equals, "out1")
+			c.Expect(waitForCount(&reloadOutputStops, 1), gs.IsTrue)
+			_, ok := config.OutputRunners["out1"]
+			c.Expect(ok, gs.IsFalse)
+
+			c.Expect(config.Reload(), gs.IsNil)
+			c.Expect(waitForCount(&reloadOutputRuns, 2), gs.IsTrue)
+		})
+
+		c.Specify("copies the base_dir except the snapshots", func() {
+			c.Expect(filepath.Dir(dir), gs.Equals, filepath.Join(baseDir, "snapshots"))
+			c.Assume(len(manifest.Files), gs.Equals, 2)
+			c.Expect(manifest.Files[0].Path, gs.Equals, "queue/out1/checkpoint.txt")
+			c.Expect(manifest.Files[0].Size, gs.Equals, int64(4))
+			c.Expect(manifest.Files[1].Path, gs.Equals,
+				"sandbox_preservation/counter.data")
+			c.Expect(manifest.Files[1].Mode, gs.Equals, os.FileMode(0640))
+			c.Expect(readFile(filepath.Join(dir, "files", "queue", "out1",
+				"checkpoint.txt")), gs.Equals, "1 42")
+		})
+
+		c.Specify("is restored into another base_dir", func() {
+			restoreDir := filepath.Join(tmpDir, "restored")
+			writeFile(filepath.Join(restoreDir, "queue", "out1", "checkpoint.txt"),
+				"0 0")
+			restored, err := RestoreSnapshot(dir, restoreDir)
+			c.Assume(err, gs.IsNil)
+			c.Expect(len(restored.Files), gs.Equals, 2)
+			c.Expect(restored.Created.Equal(manifest.Created), gs.IsTrue)
+			c.Expect(readFile(filepath.Join(restoreDir, "queue", "out1",
+				"checkpoint.txt")), gs.Equals, "1 42")
+			c.Expect(readFile(filepath.Join(restoreDir, "sandbox_preservation",
+				"counter.data")), gs.Equals, "count = 7")
+		})
+
+		c.Specify("isn't restored if a file is corrupt", func() {
+			writeFile(filepath.Join(dir, "files", "sandbox_preservation",
+				"counter.data"), "count = 8")
+			restoreDir := filepath.Join(tmpDir, "corrupt")
+			_, err := RestoreSnapshot(dir, restoreDir)
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = os.Stat(restoreDir)
+			c.Expect(os.IsNotExist(err), gs.IsTrue)
+		})
+
+		Globals().Stopping = true
+		for _, output := range config.OutputRunners {
+			config.router.RemoveOutputMatcher() <- output.MatchRunner()
+		}
+		config.outputsWg.Wait()
+		Globals().Stopping = false
+	})
+
+	c.Specify("RestoreSnapshot rejects paths outside the base_dir", func() {
+		dir := filepath.Join(tmpDir, "evil")
+		writeFile(filepath.Join(dir, SNAPSHOT_MANIFEST),
+			`{"Files": [{"Path": "../../etc/passwd"}]}`)
+		_, err := RestoreSnapshot(dir, baseDir)
+		c.Expect(err, gs.Not(gs.IsNil))
+	})
+}
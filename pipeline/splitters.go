@@ -0,0 +1,157 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+)
+
+// Returns true if the parser splits Heka's protobuf stream framing, i.e.
+// its records are framed, encoded messages rather than text payloads.
+func UsesHekaFraming(parser StreamParser) bool {
+	switch parser.(type) {
+	case *MessageProtoParser, *HekaFramingSplitter:
+		return true
+	}
+	return false
+}
+
+// Applies the max_record_size setting shared by all of the splitters.
+func setSplitterMaxRecordSize(parser StreamParser, size uint) error {
+	if size == 0 {
+		return nil
+	}
+	if size > message.MAX_RECORD_SIZE {
+		return fmt.Errorf("max_record_size can't be over %d", message.MAX_RECORD_SIZE)
+	}
+	parser.SetMaxRecordSize(int(size))
+	return nil
+}
+
+// ConfigStruct for NewlineSplitter and HekaFramingSplitter.
+type SplitterConfig struct {
+	// Size of the largest record, larger records are dropped. Defaults to
+	// MAX_RECORD_SIZE.
+	MaxRecordSize uint `toml:"max_record_size"`
+}
+
+// Splits a stream into newline terminated records.
+type NewlineSplitter struct {
+	*TokenParser
+}
+
+func (s *NewlineSplitter) ConfigStruct() interface{} {
+	return new(SplitterConfig)
+}
+
+func (s *NewlineSplitter) Init(config interface{}) error {
+	s.TokenParser = NewTokenParser()
+	return setSplitterMaxRecordSize(s, config.(*SplitterConfig).MaxRecordSize)
+}
+
+// ConfigStruct for TokenSplitter.
+type TokenSplitterConfig struct {
+	// Single byte terminating each record, defaults to a newline.
+	Delimiter     string
+	MaxRecordSize uint `toml:"max_record_size"`
+}
+
+// Splits a stream into records terminated by a single byte delimiter.
+type TokenSplitter struct {
+	*TokenParser
+}
+
+func (s *TokenSplitter) ConfigStruct() interface{} {
+	return &TokenSplitterConfig{Delimiter: "\n"}
+}
+
+func (s *TokenSplitter) Init(config interface{}) error {
+	conf := config.(*TokenSplitterConfig)
+	if len(conf.Delimiter) != 1 {
+		return fmt.Errorf("invalid delimiter: %q", conf.Delimiter)
+	}
+	s.TokenParser = NewTokenParser()
+	s.SetDelimiter(conf.Delimiter[0])
+	return setSplitterMaxRecordSize(s, conf.MaxRecordSize)
+}
+
+// ConfigStruct for RegexSplitter.
+type RegexSplitterConfig struct {
+	// Regular expression matching the record delimiter. A single capture
+	// group is kept as part of the record, the rest of the match is
+	// discarded.
+	Delimiter string
+	// Whether the delimiter is at the "start" or the "end" (default) of a
+	// record.
+	DelimiterLocation string `toml:"delimiter_location"`
+	MaxRecordSize     uint   `toml:"max_record_size"`
+}
+
+// Splits a stream on a regular expression delimiter.
+type RegexSplitter struct {
+	*RegexpParser
+}
+
+func (s *RegexSplitter) ConfigStruct() interface{} {
+	return new(RegexSplitterConfig)
+}
+
+func (s *RegexSplitter) Init(config interface{}) (err error) {
+	conf := config.(*RegexSplitterConfig)
+	if conf.Delimiter == "" {
+		return fmt.Errorf("RegexSplitter requires a delimiter")
+	}
+	s.RegexpParser = NewRegexpParser()
+	if err = s.SetDelimiter(conf.Delimiter); err != nil {
+		return
+	}
+	if err = s.SetDelimiterLocation(conf.DelimiterLocation); err != nil {
+		return
+	}
+	return setSplitterMaxRecordSize(s, conf.MaxRecordSize)
+}
+
+// Splits Heka's protobuf stream framing into records, each one a header and
+// an encoded message, to be handed to a ProtobufDecoder. Data that isn't
+// valid framing is skipped up to the next record separator with a valid
+// header, so the stream resynchronizes after corruption.
+type HekaFramingSplitter struct {
+	*MessageProtoParser
+}
+
+func (s *HekaFramingSplitter) ConfigStruct() interface{} {
+	return new(SplitterConfig)
+}
+
+func (s *HekaFramingSplitter) Init(config interface{}) error {
+	s.MessageProtoParser = NewMessageProtoParser()
+	return setSplitterMaxRecordSize(s, config.(*SplitterConfig).MaxRecordSize)
+}
+
+func init() {
+	RegisterPlugin("NewlineSplitter", func() interface{} {
+		return new(NewlineSplitter)
+	})
+	RegisterPlugin("TokenSplitter", func() interface{} {
+		return new(TokenSplitter)
+	})
+	RegisterPlugin("RegexSplitter", func() interface{} {
+		return new(RegexSplitter)
+	})
+	RegisterPlugin("HekaFramingSplitter", func() interface{} {
+		return new(HekaFramingSplitter)
+	})
+}
@@ -0,0 +1,150 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"bytes"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Parses records out of the data until EOF, including a final partial one.
+func splitAll(s Splitter, data []byte) (records []string, err error) {
+	reader := bytes.NewReader(data)
+	var record []byte
+	for err == nil {
+		_, record, err = s.Parse(reader)
+		if len(record) > 0 {
+			records = append(records, string(record))
+		}
+	}
+	if err == io.EOF {
+		err = nil
+		if record = s.GetRemainingData(); len(record) > 0 {
+			records = append(records, string(record))
+		}
+	}
+	return
+}
+
+func SplitterSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	configPath := filepath.Join(tmpDir, "hekad.toml")
+
+	c.Specify("A NewlineSplitter", func() {
+		s := new(NewlineSplitter)
+		c.Expect(s.Init(s.ConfigStruct()), gs.IsNil)
+
+		c.Specify("splits lines and keeps a partial record", func() {
+			records, err := splitAll(s, []byte("one\ntwo\nthr"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(records), gs.Equals, 3)
+			c.Expect(records[1], gs.Equals, "two\n")
+			c.Expect(records[2], gs.Equals, "thr")
+		})
+
+		c.Specify("drops records over max_record_size", func() {
+			conf := s.ConfigStruct().(*SplitterConfig)
+			conf.MaxRecordSize = 16
+			c.Expect(s.Init(conf), gs.IsNil)
+			_, err := splitAll(s, bytes.Repeat([]byte("x"), 40))
+			c.Expect(err, gs.Equals, io.ErrShortBuffer)
+		})
+	})
+
+	c.Specify("A TokenSplitter", func() {
+		s := new(TokenSplitter)
+		conf := s.ConfigStruct().(*TokenSplitterConfig)
+
+		c.Specify("splits on its delimiter", func() {
+			conf.Delimiter = "|"
+			c.Expect(s.Init(conf), gs.IsNil)
+			records, err := splitAll(s, []byte("a|b|"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(records), gs.Equals, 2)
+			c.Expect(records[0], gs.Equals, "a|")
+		})
+
+		c.Specify("rejects a multi-byte delimiter", func() {
+			conf.Delimiter = "||"
+			c.Expect(s.Init(conf), gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A RegexSplitter", func() {
+		s := new(RegexSplitter)
+		conf := s.ConfigStruct().(*RegexSplitterConfig)
+
+		c.Specify("splits on a start of record delimiter", func() {
+			conf.Delimiter = `\n(\d{4}-\d{2}-\d{2} )`
+			conf.DelimiterLocation = "start"
+			c.Expect(s.Init(conf), gs.IsNil)
+			records, err := splitAll(s,
+				[]byte("2014-01-01 one\n  more\n2014-01-02 two\n"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(records), gs.Equals, 2)
+			c.Expect(records[0], gs.Equals, "2014-01-01 one\n  more")
+			c.Expect(records[1], gs.Equals, "2014-01-02 two\n")
+		})
+
+		c.Specify("requires a delimiter", func() {
+			c.Expect(s.Init(conf), gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A HekaFramingSplitter resynchronizes after corrupt data", func() {
+		record := "\x1e\x02\x08\x05\x1fhello"
+		s := new(HekaFramingSplitter)
+		c.Expect(s.Init(s.ConfigStruct()), gs.IsNil)
+		c.Expect(UsesHekaFraming(s), gs.IsTrue)
+		records, err := splitAll(s, []byte(record+"garbage\x1e\x02\xff"+record))
+		c.Expect(err, gs.IsNil)
+		c.Expect(len(records), gs.Equals, 2)
+		c.Expect(records[0], gs.Equals, record)
+		c.Expect(records[1], gs.Equals, record)
+	})
+
+	c.Specify("The pipeline config", func() {
+		err := ioutil.WriteFile(configPath, []byte(`
+[pipes]
+type = "TokenSplitter"
+delimiter = "|"
+`), 0644)
+		c.Assume(err, gs.IsNil)
+		pc := NewPipelineConfig(nil)
+		c.Assume(pc.LoadFromConfigFile(configPath), gs.IsNil)
+
+		c.Specify("creates a new splitter instance for each caller", func() {
+			a, ok := pc.Splitter("pipes")
+			c.Expect(ok, gs.IsTrue)
+			b, _ := pc.Splitter("pipes")
+			c.Expect(a == b, gs.IsFalse)
+			records, err := splitAll(a, []byte("a|b"))
+			c.Expect(err, gs.IsNil)
+			c.Expect(records[0], gs.Equals, "a|")
+			c.Expect(UsesHekaFraming(a), gs.IsFalse)
+		})
+
+		c.Specify("doesn't know unconfigured splitters", func() {
+			_, ok := pc.Splitter("missing")
+			c.Expect(ok, gs.IsFalse)
+		})
+	})
+}
@@ -0,0 +1,128 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Returns the AES key (16, 24, or 32 bytes) used to encrypt spooled messages.
+// The key id is the `spool_key_id` hekad setting, what it means is up to the
+// provider.
+type SpoolKeyProvider func(keyId string) (key []byte, err error)
+
+var (
+	spoolKeyProviders     = make(map[string]SpoolKeyProvider)
+	spoolKeyProvidersLock sync.Mutex
+)
+
+// Makes a key provider available to the `spool_key_provider` hekad setting,
+// e.g. one fetching the key from a key management service. Must be called
+// before the config is loaded, typically from an `init` function.
+func RegisterSpoolKeyProvider(name string, provider SpoolKeyProvider) {
+	spoolKeyProvidersLock.Lock()
+	spoolKeyProviders[name] = provider
+	spoolKeyProvidersLock.Unlock()
+}
+
+func decodeHexKey(s string) ([]byte, error) {
+	return hex.DecodeString(strings.TrimSpace(s))
+}
+
+func init() {
+	// The key id is the hex encoded key.
+	RegisterSpoolKeyProvider("hex", decodeHexKey)
+	// The key id is the path of a file holding the hex encoded key.
+	RegisterSpoolKeyProvider("file", func(keyId string) ([]byte, error) {
+		contents, err := ioutil.ReadFile(GetHekaConfigDir(keyId))
+		if err != nil {
+			return nil, err
+		}
+		return decodeHexKey(string(contents))
+	})
+	// The key id is the name of an environment variable holding the hex
+	// encoded key.
+	RegisterSpoolKeyProvider("env", func(keyId string) ([]byte, error) {
+		value := os.Getenv(keyId)
+		if value == "" {
+			return nil, fmt.Errorf("environment variable %s is not set", keyId)
+		}
+		return decodeHexKey(value)
+	})
+}
+
+// Encrypts and authenticates spooled messages with AES-GCM. Each record gets
+// a random nonce, which is stored in front of the ciphertext.
+type SpoolCipher struct {
+	aead cipher.AEAD
+}
+
+// Fetches a key from the named provider.
+func FetchSpoolKey(provider, keyId string) (key []byte, err error) {
+	spoolKeyProvidersLock.Lock()
+	getKey, ok := spoolKeyProviders[provider]
+	spoolKeyProvidersLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown spool key provider: %s", provider)
+	}
+	return getKey(keyId)
+}
+
+// Fetches the key from the named provider and creates a cipher using it.
+func NewSpoolCipher(provider, keyId string) (sc *SpoolCipher, err error) {
+	var key []byte
+	if key, err = FetchSpoolKey(provider, keyId); err != nil {
+		return nil, fmt.Errorf("can't get spool key: %s", err)
+	}
+	var block cipher.Block
+	if block, err = aes.NewCipher(key); err != nil {
+		return nil, fmt.Errorf("invalid spool key: %s", err)
+	}
+	sc = new(SpoolCipher)
+	if sc.aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// Returns the encrypted form of plain.
+func (sc *SpoolCipher) Seal(plain []byte) (sealed []byte, err error) {
+	nonceSize := sc.aead.NonceSize()
+	sealed = make([]byte, nonceSize, nonceSize+len(plain)+sc.aead.Overhead())
+	if _, err = io.ReadFull(rand.Reader, sealed); err != nil {
+		return nil, err
+	}
+	return sc.aead.Seal(sealed, sealed, plain, nil), nil
+}
+
+// Decrypts data returned by Seal, failing if it was encrypted with a
+// different key or has been tampered with.
+func (sc *SpoolCipher) Open(sealed []byte) (plain []byte, err error) {
+	nonceSize := sc.aead.NonceSize()
+	if len(sealed) < nonceSize+sc.aead.Overhead() {
+		return nil, errors.New("encrypted record too short")
+	}
+	return sc.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+}
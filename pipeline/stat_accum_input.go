@@ -43,16 +43,38 @@ type StatAccumulator interface {
 	DropStat(stat Stat) (sent bool)
 }
 
+// Implemented by StatAccumulators able to ignore duplicated deliveries.
+type IdempotentStatAccumulator interface {
+	StatAccumulator
+	// Like DropStat, but the stat is ignored if one with the same bucket and
+	// idempotency key was already accumulated in the current interval. An
+	// empty key is never a duplicate.
+	DropStatOnce(stat Stat, idempotencyKey string) (sent bool)
+}
+
+// A stat handed to DropStatOnce.
+type keyedStat struct {
+	stat Stat
+	key  string
+}
+
 type StatAccumInput struct {
-	statChan chan Stat
-	counters map[string]int
-	timers   map[string][]float64
-	gauges   map[string]int
-	pConfig  *PipelineConfig
-	config   *StatAccumInputConfig
-	ir       InputRunner
-	tickChan <-chan time.Time
-	stopChan chan bool
+	statChan      chan Stat
+	keyedStatChan chan keyedStat
+	counters      map[string]int
+	timers        map[string][]float64
+	gauges        map[string]int
+	pConfig       *PipelineConfig
+	config        *StatAccumInputConfig
+	ir            InputRunner
+	tickChan      <-chan time.Time
+	stopChan      chan bool
+	// Percent_threshold followed by any other percent_thresholds.
+	thresholds []int
+	// Idempotency keys seen in the current interval, and the number of
+	// duplicates ignored.
+	seenKeys   *idempotencySet
+	duplicates int
 }
 
 type StatAccumInputConfig struct {
@@ -70,6 +92,10 @@ type StatAccumInputConfig struct {
 	// statistics. Defaults to 90.
 	PercentThreshold int `toml:"percent_threshold"`
 
+	// Additional percentage thresholds, e.g. [50, 99], for which the same
+	// "upper N%" and "mean N%" statistics are also calculated.
+	PercentThresholds []int `toml:"percent_thresholds"`
+
 	// Type value to use for outgoing stat messages, defaults to
 	// `heka.statmetric`.
 	MessageType string `toml:"message_type"`
@@ -84,16 +110,21 @@ type StatAccumInputConfig struct {
 	TimerPrefix      string `toml:"timer_prefix"`
 	GaugePrefix      string `toml:"gauge_prefix"`
 	StatsdPrefix     string `toml:"statsd_prefix"`
+
+	// Most idempotency keys remembered per ticker interval, the oldest ones
+	// are forgotten beyond it. Defaults to 100000.
+	MaxIdempotencyKeys uint `toml:"max_idempotency_keys"`
 }
 
 func (sm *StatAccumInput) ConfigStruct() interface{} {
 	return &StatAccumInputConfig{
-		EmitInPayload:    true,
-		PercentThreshold: 90,
-		MessageType:      "heka.statmetric",
-		TickerInterval:   uint(10),
-		LegacyNamespaces: false,
-		StatsdPrefix:     "statsd",
+		EmitInPayload:      true,
+		PercentThreshold:   90,
+		MessageType:        "heka.statmetric",
+		TickerInterval:     uint(10),
+		LegacyNamespaces:   false,
+		StatsdPrefix:       "statsd",
+		MaxIdempotencyKeys: DEFAULT_MAX_IDEMPOTENCY_KEYS,
 	}
 }
 
@@ -102,14 +133,25 @@ func (sm *StatAccumInput) Init(config interface{}) error {
 	sm.timers = make(map[string][]float64)
 	sm.gauges = make(map[string]int)
 	sm.statChan = make(chan Stat, Globals().PoolSize)
+	sm.keyedStatChan = make(chan keyedStat, Globals().PoolSize)
 	sm.stopChan = make(chan bool, 1)
 
 	sm.config = config.(*StatAccumInputConfig)
+	sm.seenKeys = newIdempotencySet(int(sm.config.MaxIdempotencyKeys))
 	if !sm.config.EmitInPayload && !sm.config.EmitInFields {
 		return errors.New(
 			"One of either `EmitInPayload` or `EmitInFields` must be set to true.",
 		)
 	}
+	sm.thresholds = []int{sm.config.PercentThreshold}
+	for _, threshold := range sm.config.PercentThresholds {
+		if threshold <= 0 || threshold > 100 {
+			return fmt.Errorf("Invalid percent threshold: %d", threshold)
+		}
+		if !containsInt(sm.thresholds, threshold) {
+			sm.thresholds = append(sm.thresholds, threshold)
+		}
+	}
 	if sm.config.LegacyNamespaces {
 		if sm.config.GlobalPrefix == "" {
 			sm.config.GlobalPrefix = "stats"
@@ -127,14 +169,14 @@ func (sm *StatAccumInput) Init(config interface{}) error {
 // Listens on the Stat channel for stats generated internally by Heka.
 func (sm *StatAccumInput) Run(ir InputRunner, h PluginHelper) (err error) {
 	var (
-		stat       Stat
-		floatValue float64
-		intValue   int
+		stat  Stat
+		keyed keyedStat
 	)
 
 	sm.pConfig = h.PipelineConfig()
 	sm.ir = ir
 	sm.tickChan = sm.ir.Ticker()
+	keyedStatChan := sm.keyedStatChan
 	ok := true
 	for ok {
 		select {
@@ -142,30 +184,70 @@ func (sm *StatAccumInput) Run(ir InputRunner, h PluginHelper) (err error) {
 			sm.Flush()
 		case stat, ok = <-sm.statChan:
 			if !ok {
+				sm.drainKeyedStats(keyedStatChan)
 				sm.Flush()
 				break
 			}
-			switch stat.Modifier {
-			case "ms":
-				floatValue, _ = strconv.ParseFloat(stat.Value, 64)
-				sm.timers[stat.Bucket] = append(sm.timers[stat.Bucket], floatValue)
-			case "g":
-				intValue, _ = strconv.Atoi(stat.Value)
-				sm.gauges[stat.Bucket] = intValue
-			default:
-				floatValue, _ = strconv.ParseFloat(stat.Value, 32)
-				sm.counters[stat.Bucket] += int(float32(floatValue) * (1 / stat.Sampling))
+			sm.accumulate(stat)
+		case keyed, ok = <-keyedStatChan:
+			if !ok {
+				// Keep going until the statChan is closed too.
+				keyedStatChan = nil
+				ok = true
+				break
 			}
+			sm.accumulateOnce(keyed)
 		}
 	}
 
 	return
 }
 
+// Accumulates the keyed stats still queued when stopping.
+func (sm *StatAccumInput) drainKeyedStats(keyedStatChan chan keyedStat) {
+	for {
+		select {
+		case keyed, ok := <-keyedStatChan:
+			if !ok {
+				return
+			}
+			sm.accumulateOnce(keyed)
+		default:
+			return
+		}
+	}
+}
+
+// Accumulates the stat unless one with the same bucket and idempotency key
+// was already accumulated in the current interval.
+func (sm *StatAccumInput) accumulateOnce(keyed keyedStat) {
+	if !sm.seenKeys.add(keyed.stat.Bucket + "\x00" + keyed.key) {
+		sm.duplicates++
+		return
+	}
+	sm.accumulate(keyed.stat)
+}
+
+// Adds the stat to the current interval's data.
+func (sm *StatAccumInput) accumulate(stat Stat) {
+	switch stat.Modifier {
+	case "ms":
+		floatValue, _ := strconv.ParseFloat(stat.Value, 64)
+		sm.timers[stat.Bucket] = append(sm.timers[stat.Bucket], floatValue)
+	case "g":
+		intValue, _ := strconv.Atoi(stat.Value)
+		sm.gauges[stat.Bucket] = intValue
+	default:
+		floatValue, _ := strconv.ParseFloat(stat.Value, 32)
+		sm.counters[stat.Bucket] += int(float32(floatValue) * (1 / stat.Sampling))
+	}
+}
+
 func (sm *StatAccumInput) Stop() {
 	// Closing the stopChan first so DropStat won't put any stats on
 	// the statChan after it's closed.
 	close(sm.stopChan)
+	close(sm.keyedStatChan)
 	close(sm.statChan)
 }
 
@@ -182,6 +264,28 @@ func (sm *StatAccumInput) DropStat(stat Stat) (sent bool) {
 	return
 }
 
+func (sm *StatAccumInput) DropStatOnce(stat Stat, idempotencyKey string) (sent bool) {
+	if idempotencyKey == "" {
+		return sm.DropStat(stat)
+	}
+	select {
+	case <-sm.stopChan:
+	default:
+		sm.keyedStatChan <- keyedStat{stat, idempotencyKey}
+		sent = true
+	}
+	return
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 // Extracts all of the accumulated data and generates and injects a message
 // into the Heka pipeline.
 func (sm *StatAccumInput) Flush() {
@@ -248,17 +352,22 @@ func (sm *StatAccumInput) Flush() {
 			max := timings[len(timings)-1]
 			count := len(timings)
 			if count > 1 {
-				tmp := ((100.0 - float64(sm.config.PercentThreshold)) / 100.0) * float64(count)
-				numInThreshold := count - int(math.Floor(tmp+0.5)) // simulate JS Math.round(x)
-				values := timings[0:numInThreshold]
-				max := timings[numInThreshold-1]
-				var sum float64
-				for _, v := range values {
-					sum += v
+				for _, threshold := range sm.thresholds {
+					tmp := ((100.0 - float64(threshold)) / 100.0) * float64(count)
+					numInThreshold := count - int(math.Floor(tmp+0.5)) // simulate JS Math.round(x)
+					if numInThreshold < 1 {
+						numInThreshold = 1
+					}
+					values := timings[0:numInThreshold]
+					max := timings[numInThreshold-1]
+					var sum float64
+					for _, v := range values {
+						sum += v
+					}
+					mean := sum / float64(numInThreshold)
+					timerNs.Emit(fmt.Sprintf("upper_%d", threshold), max)
+					timerNs.Emit(fmt.Sprintf("mean_%d", threshold), mean)
 				}
-				mean := sum / float64(numInThreshold)
-				timerNs.Emit(fmt.Sprintf("upper_%d", sm.config.PercentThreshold), max)
-				timerNs.Emit(fmt.Sprintf("mean_%d", sm.config.PercentThreshold), mean)
 			}
 
 			sm.timers[key] = timings[:0]
@@ -277,22 +386,29 @@ func (sm *StatAccumInput) Flush() {
 			timerNs.Emit("upper", 0)
 			timerNs.Emit("lower", 0)
 			timerNs.Emit("count", 0)
-			timerNs.Emit(fmt.Sprintf("upper_%d", sm.config.PercentThreshold), 0)
-			timerNs.Emit(fmt.Sprintf("mean_%d", sm.config.PercentThreshold), 0)
+			for _, threshold := range sm.thresholds {
+				timerNs.Emit(fmt.Sprintf("upper_%d", threshold), 0)
+				timerNs.Emit(fmt.Sprintf("mean_%d", threshold), 0)
+			}
 		}
 		numStats++
 	}
 
+	statsdNs := globalNs.Namespace(sm.config.StatsdPrefix)
 	if sm.config.LegacyNamespaces {
-		rootNs.Namespace(sm.config.StatsdPrefix).Emit("numStats", numStats)
-	} else {
-		globalNs.Namespace(sm.config.StatsdPrefix).Emit("numStats", numStats)
+		statsdNs = rootNs.Namespace(sm.config.StatsdPrefix)
 	}
+	statsdNs.Emit("numStats", numStats)
+	if sm.seenKeys.len() > 0 {
+		statsdNs.Emit("numDuplicates", sm.duplicates)
+	}
+	sm.seenKeys.reset()
+	sm.duplicates = 0
 
 	pack.Message.SetType(sm.config.MessageType)
 	pack.Message.SetTimestamp(now.UnixNano())
 	pack.Message.SetUuid(uuid.NewRandom())
-	pack.Message.SetHostname(sm.pConfig.hostname)
+	StampIdentity(pack.Message, sm.pConfig.hostname)
 	pack.Message.SetPid(sm.pConfig.pid)
 	pack.Message.SetPayload(buffer.String())
 	sm.ir.Inject(pack)
@@ -360,4 +476,11 @@ func init() {
 	RegisterPlugin("StatAccumInput", func() interface{} {
 		return new(StatAccumInput)
 	})
+	RegisterConfigMigration(ConfigMigration{
+		PluginType: "StatAccumInput",
+		Option:     "flushinterval",
+		Since:      "0.5.0",
+		Advice:     "use ticker_interval",
+		RenameTo:   "ticker_interval",
+	})
 }
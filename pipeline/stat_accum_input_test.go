@@ -163,6 +163,12 @@ func StatAccumInputSpec(c gs.Context) {
 			c.Expect(err.Error(), gs.Equals, expected)
 		})
 
+		c.Specify("rejects invalid percent thresholds", func() {
+			config.PercentThresholds = []int{90, 0}
+			err := statAccumInput.Init(config)
+			c.Expect(err.Error(), gs.Equals, "Invalid percent threshold: 0")
+		})
+
 		c.Specify("that actually emits a message", func() {
 			statName := "sample.stat"
 			statVal := int64(303)
@@ -341,6 +347,31 @@ func StatAccumInputSpec(c gs.Context) {
 				c.Expect(ok, gs.IsTrue)
 				c.Expect(intTmp, gs.Equals, int64(11))
 			})
+
+			c.Specify("calculates additional percent thresholds", func() {
+				config.EmitInFields = true
+				config.PercentThresholds = []int{50, 90, 100}
+				err := statAccumInput.Init(config)
+				c.Assume(err, gs.IsNil)
+				c.Expect(len(statAccumInput.thresholds), gs.Equals, 3)
+				startAndSwapTickChan()
+
+				for _, v := range []int{220, 10, 20, 30, 40, 50, 60, 70, 80, 90, 100} {
+					statAccumInput.statChan <- Stat{"sample.timer", strconv.Itoa(v), "ms", float32(1)}
+				}
+				close(statAccumInput.statChan)
+				wg.Wait()
+
+				getVal := func(token string) interface{} {
+					val, _ := ith.Pack.Message.GetFieldValue("stats.timers.sample.timer." + token)
+					return val
+				}
+				c.Expect(getVal("upper_90"), gs.Equals, 100.0)
+				c.Expect(getVal("upper_50"), gs.Equals, 50.0)
+				c.Expect(getVal("mean_50"), gs.Equals, 30.0)
+				c.Expect(getVal("upper_100"), gs.Equals, 220.0)
+				c.Expect(getVal("mean_100"), gs.Equals, 70.0)
+			})
 		})
 	})
 }
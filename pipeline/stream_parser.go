@@ -41,21 +41,28 @@ type StreamParser interface {
 
 	// Sets the internal buffer to at least 'size' bytes.
 	SetMinimumBufferSize(size int)
+
+	// Sets the size of the largest record that will be buffered, defaults to
+	// MAX_RECORD_SIZE. Parse returns io.ErrShortBuffer and discards the data
+	// when a record doesn't fit.
+	SetMaxRecordSize(size int)
 }
 
 // Internal buffer management for the StreamParser
 type streamParserBuffer struct {
-	buf      []byte
-	readPos  int
-	scanPos  int
-	needData bool
-	err      string
+	buf           []byte
+	readPos       int
+	scanPos       int
+	needData      bool
+	err           string
+	maxRecordSize int
 }
 
 func newStreamParserBuffer() (s *streamParserBuffer) {
 	s = new(streamParserBuffer)
 	s.buf = make([]byte, 1024*8)
 	s.needData = true
+	s.maxRecordSize = message.MAX_RECORD_SIZE
 	return
 }
 
@@ -69,6 +76,9 @@ func (s *streamParserBuffer) GetRemainingData() (record []byte) {
 }
 
 func (s *streamParserBuffer) SetMinimumBufferSize(size int) {
+	if size > s.maxRecordSize {
+		size = s.maxRecordSize
+	}
 	if cap(s.buf) < size {
 		newSlice := make([]byte, size)
 		copy(newSlice, s.buf)
@@ -77,12 +87,22 @@ func (s *streamParserBuffer) SetMinimumBufferSize(size int) {
 	return
 }
 
+func (s *streamParserBuffer) SetMaxRecordSize(size int) {
+	s.maxRecordSize = size
+	if cap(s.buf) > size {
+		newSlice := make([]byte, size)
+		s.readPos = copy(newSlice, s.buf[s.scanPos:s.readPos])
+		s.scanPos = 0
+		s.buf = newSlice
+	}
+}
+
 func (s *streamParserBuffer) read(reader io.Reader) (n int, err error) {
 	if cap(s.buf)-s.readPos <= 1024*4 {
 		if s.scanPos == 0 { // line will not fit in the current buffer
 			newSize := cap(s.buf) * 2
-			if newSize > message.MAX_RECORD_SIZE {
-				if cap(s.buf) == message.MAX_RECORD_SIZE {
+			if newSize > s.maxRecordSize {
+				if cap(s.buf) == s.maxRecordSize {
 					if s.readPos == cap(s.buf) {
 						s.scanPos = 0
 						s.readPos = 0
@@ -91,7 +111,7 @@ func (s *streamParserBuffer) read(reader io.Reader) (n int, err error) {
 						newSize = 0 // don't allocate any more memory, just read into what is left
 					}
 				} else {
-					newSize = message.MAX_RECORD_SIZE
+					newSize = s.maxRecordSize
 				}
 			}
 			if newSize > 0 {
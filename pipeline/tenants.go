@@ -0,0 +1,391 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"fmt"
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const TENANTS_SECTION = "tenants"
+
+// Name of the message field holding the tenant a message belongs to.
+const TENANT_FIELD = "Tenant"
+
+// Config for a single tenant.
+type TenantConfig struct {
+	// Verified message signers whose messages belong to the tenant.
+	Signers []string
+	// CIDR ranges or IPs whose connections belong to the tenant. The most
+	// specific range wins when tenants overlap.
+	Cidrs []string
+	// Tokens identifying the tenant's requests to the HttpListenInput.
+	Tokens []string
+	// Most messages per second the tenant may send, zero is unlimited.
+	MaxMessagesPerSecond uint `toml:"max_messages_per_second"`
+	// Most dynamic filters the sandbox managers scoped to the tenant may run
+	// together, zero is unlimited.
+	MaxSandboxes uint `toml:"max_sandboxes"`
+}
+
+// Token bucket refilled at `rate` tokens a second, holding a second's worth
+// of them at most.
+type tenantQuota struct {
+	lock   sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func (q *tenantQuota) allow(now time.Time) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.last.IsZero() {
+		q.tokens += now.Sub(q.last).Seconds() * q.rate
+	}
+	if q.tokens > q.rate {
+		q.tokens = q.rate
+	}
+	q.last = now
+	if q.tokens < 1 {
+		return false
+	}
+	q.tokens--
+	return true
+}
+
+// A declared tenant, see the tenants config section.
+type Tenant struct {
+	Name         string
+	quota        *tenantQuota
+	maxSandboxes int64
+	// Counters, accessed atomically. They survive config reloads.
+	messageCount   int64
+	quotaDropCount int64
+	sandboxes      int64
+}
+
+type tenantNet struct {
+	ipNet  *net.IPNet
+	tenant *Tenant
+}
+
+type tenantNetsBySize []tenantNet
+
+func (n tenantNetsBySize) Len() int      { return len(n) }
+func (n tenantNetsBySize) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n tenantNetsBySize) Less(i, j int) bool {
+	iOnes, _ := n[i].ipNet.Mask.Size()
+	jOnes, _ := n[j].ipNet.Mask.Size()
+	if iOnes != jOnes {
+		return iOnes > jOnes
+	}
+	return n[i].tenant.Name < n[j].tenant.Name
+}
+
+// The declared tenants and the lookups inputs use to tell which one a
+// message belongs to.
+type tenantRegistry struct {
+	tenants  map[string]*Tenant
+	bySigner map[string]*Tenant
+	byToken  map[string]*Tenant
+	// Most specific first.
+	nets tenantNetsBySize
+}
+
+// Returns the tenant a message belongs to, given its verified signer, the
+// token presented with it and the address it came from, or nil.
+func (r *tenantRegistry) resolve(signer, token string, addr net.Addr) *Tenant {
+	if tenant, ok := r.bySigner[signer]; ok && signer != "" {
+		return tenant
+	}
+	if tenant, ok := r.byToken[token]; ok && token != "" {
+		return tenant
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			ip = a.IP
+		}
+	}
+	if ip != nil {
+		for _, n := range r.nets {
+			if n.ipNet.Contains(ip) {
+				return n.tenant
+			}
+		}
+	}
+	return nil
+}
+
+// Declares the tenants of the tenants config section, replacing the ones
+// declared before.
+func (self *PipelineConfig) declareTenants(section toml.Primitive) (errcnt uint) {
+	var sections map[string]toml.Primitive
+	if err := toml.PrimitiveDecode(section, &sections); err != nil {
+		self.log(fmt.Sprintf("Unable to decode config for %s: %s",
+			TENANTS_SECTION, err))
+		return 1
+	}
+	registry := &tenantRegistry{
+		tenants:  make(map[string]*Tenant),
+		bySigner: make(map[string]*Tenant),
+		byToken:  make(map[string]*Tenant),
+	}
+	old := self.tenantRegistry()
+	for name, primitive := range sections {
+		conf := new(TenantConfig)
+		if err := toml.PrimitiveDecode(primitive, conf); err != nil {
+			self.log(fmt.Sprintf("Unable to decode config for tenant '%s': %s",
+				name, err))
+			errcnt++
+			continue
+		}
+		tenant := &Tenant{Name: name, maxSandboxes: int64(conf.MaxSandboxes)}
+		if old != nil {
+			if prev, ok := old.tenants[name]; ok {
+				tenant.messageCount = atomic.LoadInt64(&prev.messageCount)
+				tenant.quotaDropCount = atomic.LoadInt64(&prev.quotaDropCount)
+				tenant.sandboxes = atomic.LoadInt64(&prev.sandboxes)
+			}
+		}
+		if conf.MaxMessagesPerSecond > 0 {
+			rate := float64(conf.MaxMessagesPerSecond)
+			tenant.quota = &tenantQuota{rate: rate, tokens: rate}
+		}
+		registry.tenants[name] = tenant
+		for _, signer := range conf.Signers {
+			if other, ok := registry.bySigner[signer]; ok {
+				self.log(fmt.Sprintf("Signer '%s' belongs to tenants '%s' and '%s'",
+					signer, other.Name, name))
+				errcnt++
+			}
+			registry.bySigner[signer] = tenant
+		}
+		for _, token := range conf.Tokens {
+			if other, ok := registry.byToken[token]; ok {
+				self.log(fmt.Sprintf("A token belongs to tenants '%s' and '%s'",
+					other.Name, name))
+				errcnt++
+			}
+			registry.byToken[token] = tenant
+		}
+		nets, err := parseCIDRs(conf.Cidrs)
+		if err != nil {
+			self.log(fmt.Sprintf("Invalid cidrs for tenant '%s': %s", name, err))
+			errcnt++
+			continue
+		}
+		for _, ipNet := range nets {
+			registry.nets = append(registry.nets, tenantNet{ipNet, tenant})
+		}
+	}
+	if errcnt != 0 {
+		return
+	}
+	sort.Sort(registry.nets)
+	self.tenantsLock.Lock()
+	self.tenants = registry
+	self.tenantsLock.Unlock()
+	return
+}
+
+// Returns the declared tenants, nil if there's no tenants section.
+func (self *PipelineConfig) tenantRegistry() *tenantRegistry {
+	self.tenantsLock.RLock()
+	defer self.tenantsLock.RUnlock()
+	return self.tenants
+}
+
+// Returns the named tenant.
+func (self *PipelineConfig) Tenant(name string) (tenant *Tenant, ok bool) {
+	if registry := self.tenantRegistry(); registry != nil {
+		tenant, ok = registry.tenants[name]
+	}
+	return
+}
+
+// Checks that the plugins' `tenant` and `tenants` settings name declared
+// tenants.
+func (self *PipelineConfig) checkTenants() error {
+	registry := self.tenantRegistry()
+	check := func(name string, globals *PluginGlobals) error {
+		if globals == nil {
+			return nil
+		}
+		names := globals.Tenants
+		if globals.Tenant != "" {
+			names = append([]string{globals.Tenant}, names...)
+		}
+		for _, tenant := range names {
+			if registry == nil || registry.tenants[tenant] == nil {
+				return fmt.Errorf("'%s' uses undeclared tenant '%s'", name, tenant)
+			}
+		}
+		return nil
+	}
+	for name, runner := range self.InputRunners {
+		if err := check(name, runner.PluginGlobals()); err != nil {
+			return err
+		}
+	}
+	for name, runner := range self.FilterRunners {
+		if err := check(name, runner.PluginGlobals()); err != nil {
+			return err
+		}
+	}
+	for name, runner := range self.OutputRunners {
+		if err := check(name, runner.PluginGlobals()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sets the tenant of a pack an input is about to hand to its decoder or
+// inject: the input's own `tenant` if set, otherwise the one the pack's
+// verified signer, the token the sender presented (may be empty) or the
+// address it came from (may be nil) belongs to.
+func TagTenant(ir InputRunner, pack *PipelinePack, token string, addr net.Addr) {
+	if registry := inputTenantRegistry(ir, pack); registry != nil {
+		if tenant := registry.resolve(pack.Signer, token, addr); tenant != nil {
+			pack.Tenant = tenant.Name
+		}
+	}
+}
+
+// Like TagTenant for packs read from a connection, which is only asked for
+// its address if the tenants need it.
+func TagConnTenant(ir InputRunner, pack *PipelinePack, conn net.Conn) {
+	if registry := inputTenantRegistry(ir, pack); registry != nil {
+		if tenant := registry.resolve(pack.Signer, "", conn.RemoteAddr()); tenant != nil {
+			pack.Tenant = tenant.Name
+		}
+	}
+}
+
+// Tags the pack with the input's own tenant if it has one, otherwise returns
+// the registry its tenant should be resolved from, nil if there's none.
+func inputTenantRegistry(ir InputRunner, pack *PipelinePack) *tenantRegistry {
+	runner, ok := ir.(*iRunner)
+	if !ok || runner.h == nil {
+		return nil
+	}
+	if runner.pluginGlobals != nil && runner.pluginGlobals.Tenant != "" {
+		pack.Tenant = runner.pluginGlobals.Tenant
+		return nil
+	}
+	return runner.h.PipelineConfig().tenantRegistry()
+}
+
+// Counts the pack against its tenant's quota, returning false if the quota
+// is used up and the pack should be dropped.
+func (self *PipelineConfig) chargeTenant(pack *PipelinePack) bool {
+	if pack.Tenant == "" {
+		return true
+	}
+	tenant, ok := self.Tenant(pack.Tenant)
+	if !ok {
+		return true
+	}
+	if tenant.quota != nil && !tenant.quota.allow(time.Now()) {
+		atomic.AddInt64(&tenant.quotaDropCount, 1)
+		return false
+	}
+	atomic.AddInt64(&tenant.messageCount, 1)
+	return true
+}
+
+// Sets the message's Tenant field to the pack's tenant, so it can't be
+// spoofed by the sender, or removes it if the pack has none. Only done once
+// tenants are declared.
+func (self *PipelineConfig) stampTenant(pack *PipelinePack) {
+	if self.tenantRegistry() == nil {
+		return
+	}
+	msg := pack.Message
+	fields := msg.Fields[:0]
+	for _, field := range msg.Fields {
+		if field.GetName() != TENANT_FIELD {
+			fields = append(fields, field)
+		}
+	}
+	msg.Fields = fields
+	if pack.Tenant != "" {
+		message.NewStringField(msg, TENANT_FIELD, pack.Tenant)
+	}
+}
+
+// Takes one of the tenant's sandbox slots for a dynamic filter.
+func (self *PipelineConfig) AcquireTenantSandbox(name string) error {
+	tenant, ok := self.Tenant(name)
+	if !ok {
+		return fmt.Errorf("no such tenant: '%s'", name)
+	}
+	if count := atomic.AddInt64(&tenant.sandboxes, 1); tenant.maxSandboxes > 0 &&
+		count > tenant.maxSandboxes {
+
+		atomic.AddInt64(&tenant.sandboxes, -1)
+		return fmt.Errorf("tenant '%s' already runs %d sandboxes", name,
+			tenant.maxSandboxes)
+	}
+	return nil
+}
+
+// Gives back a sandbox slot taken with AcquireTenantSandbox.
+func (self *PipelineConfig) ReleaseTenantSandbox(name string) {
+	if tenant, ok := self.Tenant(name); ok {
+		atomic.AddInt64(&tenant.sandboxes, -1)
+	}
+}
+
+// Adds the tenant's counters to its report message.
+func (t *Tenant) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ProcessMessageCount",
+		atomic.LoadInt64(&t.messageCount), "count")
+	message.NewInt64Field(msg, "QuotaDropCount",
+		atomic.LoadInt64(&t.quotaDropCount), "count")
+	message.NewInt64Field(msg, "RunningSandboxes",
+		atomic.LoadInt64(&t.sandboxes), "count")
+	return nil
+}
+
+// Returns the declared tenants sorted by name.
+func (self *PipelineConfig) sortedTenants() (tenants []*Tenant) {
+	registry := self.tenantRegistry()
+	if registry == nil {
+		return
+	}
+	names := make([]string, 0, len(registry.tenants))
+	for name := range registry.tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tenants = append(tenants, registry.tenants[name])
+	}
+	return
+}
@@ -0,0 +1,152 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/bbangert/toml"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"time"
+)
+
+func TenantsSpec(c gs.Context) {
+	c.Specify("The tenants section", func() {
+		pc := NewPipelineConfig(nil)
+		declare := func(tomlStr string) uint {
+			var configFile ConfigFile
+			_, err := toml.Decode(tomlStr, &configFile)
+			c.Assume(err, gs.IsNil)
+			return pc.declareTenants(configFile[TENANTS_SECTION])
+		}
+		errcnt := declare(`
+[tenants.payments]
+signers = ["payments"]
+tokens = ["s3cret"]
+cidrs = ["10.1.0.0/16"]
+max_messages_per_second = 2
+max_sandboxes = 1
+
+[tenants.search]
+cidrs = ["10.0.0.0/8"]
+`)
+		c.Assume(errcnt, gs.Equals, uint(0))
+		registry := pc.tenantRegistry()
+		c.Assume(registry, gs.Not(gs.IsNil))
+		addr := func(ip string) net.Addr {
+			return &net.TCPAddr{IP: net.ParseIP(ip), Port: 5565}
+		}
+
+		c.Specify("tells which tenant a message belongs to", func() {
+			c.Expect(registry.resolve("payments", "", nil).Name, gs.Equals, "payments")
+			c.Expect(registry.resolve("", "s3cret", nil).Name, gs.Equals, "payments")
+			// The most specific range wins.
+			c.Expect(registry.resolve("", "", addr("10.1.2.3")).Name, gs.Equals,
+				"payments")
+			c.Expect(registry.resolve("", "", addr("10.2.0.1")).Name, gs.Equals,
+				"search")
+			c.Expect(registry.resolve("other", "bogus", addr("192.168.0.1")),
+				gs.IsNil)
+			var nilAddr *net.TCPAddr
+			c.Expect(registry.resolve("", "", nilAddr), gs.IsNil)
+		})
+
+		c.Specify("rejects conflicting declarations", func() {
+			errcnt := declare(`
+[tenants.a]
+signers = ["shared"]
+
+[tenants.b]
+signers = ["shared"]
+`)
+			c.Expect(errcnt, gs.Equals, uint(1))
+			c.Expect(declare("[tenants.a]\ncidrs = [\"nope\"]\n"), gs.Equals, uint(1))
+			// The tenants declared before are kept.
+			_, ok := pc.Tenant("payments")
+			c.Expect(ok, gs.IsTrue)
+		})
+
+		c.Specify("enforces the message quota", func() {
+			tenant, _ := pc.Tenant("payments")
+			now := time.Now()
+			c.Expect(tenant.quota.allow(now), gs.IsTrue)
+			c.Expect(tenant.quota.allow(now), gs.IsTrue)
+			c.Expect(tenant.quota.allow(now), gs.IsFalse)
+			c.Expect(tenant.quota.allow(now.Add(600*time.Millisecond)), gs.IsTrue)
+
+			pack := NewPipelinePack(nil)
+			pack.Tenant = "payments"
+			c.Expect(pc.chargeTenant(pack), gs.IsFalse)
+			msg := new(message.Message)
+			tenant.ReportMsg(msg)
+			value, _ := msg.GetFieldValue("QuotaDropCount")
+			c.Expect(value, gs.Equals, int64(1))
+		})
+
+		c.Specify("stamps the tenant on messages", func() {
+			pack := NewPipelinePack(nil)
+			message.NewStringField(pack.Message, TENANT_FIELD, "payments")
+			pc.stampTenant(pack)
+			_, ok := pack.Message.GetFieldValue(TENANT_FIELD)
+			c.Expect(ok, gs.IsFalse)
+
+			pack.Tenant = "search"
+			message.NewStringField(pack.Message, TENANT_FIELD, "payments")
+			pc.stampTenant(pack)
+			c.Expect(len(pack.Message.FindAllFields(TENANT_FIELD)), gs.Equals, 1)
+			value, _ := pack.Message.GetFieldValue(TENANT_FIELD)
+			c.Expect(value, gs.Equals, "search")
+		})
+
+		c.Specify("limits the tenant's sandboxes", func() {
+			c.Expect(pc.AcquireTenantSandbox("payments"), gs.IsNil)
+			c.Expect(pc.AcquireTenantSandbox("payments"), gs.Not(gs.IsNil))
+			pc.ReleaseTenantSandbox("payments")
+			c.Expect(pc.AcquireTenantSandbox("payments"), gs.IsNil)
+			c.Expect(pc.AcquireTenantSandbox("search"), gs.IsNil)
+			c.Expect(pc.AcquireTenantSandbox("nobody"), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("checks the plugins' tenants", func() {
+			fRunner := NewFORunner("counter", new(CounterFilter),
+				&PluginGlobals{Tenants: []string{"payments"}})
+			pc.FilterRunners["counter"] = fRunner
+			c.Expect(pc.checkTenants(), gs.IsNil)
+			fRunner.PluginGlobals().Tenants = []string{"payments", "nobody"}
+			c.Expect(pc.checkTenants(), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("scopes filters to their tenants", func() {
+			fRunner := NewFORunner("counter", new(CounterFilter), nil)
+			matcher, err := NewMatchRunner("TRUE", "", fRunner)
+			c.Assume(err, gs.IsNil)
+			matcher.SetTenants([]string{"payments"})
+			matchChan := make(chan *PipelinePack, 2)
+			matcher.Start(matchChan)
+			recycle := make(chan *PipelinePack, 2)
+			for _, tenant := range []string{"search", "payments"} {
+				pack := NewPipelinePack(recycle)
+				pack.Tenant = tenant
+				matcher.inChan <- pack
+			}
+			close(matcher.inChan)
+			pack := <-matchChan
+			c.Expect(pack.Tenant, gs.Equals, "payments")
+			_, ok := <-matchChan
+			c.Expect(ok, gs.IsFalse)
+			c.Expect(len(recycle), gs.Equals, 1)
+		})
+	})
+}
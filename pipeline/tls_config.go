@@ -0,0 +1,155 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// Name of the message field holding the common name of the certificate
+// presented by the other end of a TLS connection.
+const TLS_PEER_FIELD = "TlsPeer"
+
+// TLS settings shared by the network plugins, set in a `tls` subsection of
+// the plugin config.
+type TlsConfig struct {
+	// PEM encoded certificate and private key presented to the other end.
+	// Required for servers, optional for clients.
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// PEM encoded CA certificates used to verify the other end. Servers use
+	// it to verify client certificates, clients to verify the server instead
+	// of the system roots.
+	CAFile string `toml:"ca_file"`
+	// Servers only, reject clients that don't present a certificate signed
+	// by a CA from `ca_file`.
+	RequireClientCert bool `toml:"require_client_cert"`
+	// Lowest accepted protocol version: "TLS10", "TLS11" or "TLS12".
+	MinVersion string `toml:"min_version"`
+	// Names of the accepted cipher suites, e.g.
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256". Defaults to Go's list.
+	Ciphers []string
+	// Clients only, name checked against the server certificate. Defaults to
+	// the host part of the address.
+	ServerName string `toml:"server_name"`
+	// Clients only, skips the verification of the server certificate.
+	InsecureSkipVerify bool `toml:"insecure_skip_verify"`
+}
+
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+}
+
+var tlsCiphers = map[string]uint16{
+	"TLS_RSA_WITH_3DES_EDE_CBC_SHA":           tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA":     tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+}
+
+// Builds a crypto/tls config from the plugin settings. `server` selects
+// between the listening and the dialing side, `address` is the dialed
+// address and only used for the default server name.
+func CreateGoTlsConfig(conf *TlsConfig, server bool, address string) (
+	goConf *tls.Config, err error) {
+
+	goConf = &tls.Config{MinVersion: tls.VersionTLS10}
+	if conf.MinVersion != "" {
+		var ok bool
+		if goConf.MinVersion, ok = tlsVersions[conf.MinVersion]; !ok {
+			return nil, fmt.Errorf("unknown TLS version: %s", conf.MinVersion)
+		}
+	}
+	for _, name := range conf.Ciphers {
+		cipher, ok := tlsCiphers[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite: %s", name)
+		}
+		goConf.CipherSuites = append(goConf.CipherSuites, cipher)
+	}
+
+	if conf.CertFile != "" || conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(GetHekaConfigDir(conf.CertFile),
+			GetHekaConfigDir(conf.KeyFile))
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %s", err)
+		}
+		goConf.Certificates = []tls.Certificate{cert}
+	} else if server {
+		return nil, errors.New("TLS server requires a cert_file and key_file")
+	}
+
+	var pool *x509.CertPool
+	if conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(GetHekaConfigDir(conf.CAFile))
+		if err != nil {
+			return nil, fmt.Errorf("reading TLS CA file: %s", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", conf.CAFile)
+		}
+	}
+
+	if server {
+		goConf.ClientCAs = pool
+		if conf.RequireClientCert {
+			if pool == nil {
+				return nil, errors.New("require_client_cert needs a ca_file")
+			}
+			goConf.ClientAuth = tls.RequireAndVerifyClientCert
+		} else if pool != nil {
+			goConf.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else {
+		goConf.RootCAs = pool
+		goConf.InsecureSkipVerify = conf.InsecureSkipVerify
+		goConf.ServerName = conf.ServerName
+		if goConf.ServerName == "" {
+			if host, _, err := net.SplitHostPort(address); err == nil {
+				goConf.ServerName = host
+			}
+		}
+	}
+	return
+}
+
+// Returns the common name of the verified certificate presented by the
+// other end of a TLS connection, or an empty string for plain connections
+// and peers without a certificate.
+func TlsPeerIdentity(conn net.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
@@ -0,0 +1,161 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func TlsConfigSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+
+	// Writes a PEM certificate and key for `name` to tmpDir, signed by the
+	// parent or self-signed if parent is nil.
+	var serial int64
+	writeCert := func(name string, parent *x509.Certificate,
+		parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		c.Assume(err, gs.IsNil)
+		serial++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+				x509.ExtKeyUsageClientAuth},
+		}
+		if parent == nil {
+			tmpl.IsCA = true
+			tmpl.BasicConstraintsValid = true
+			tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent,
+			&key.PublicKey, parentKey)
+		c.Assume(err, gs.IsNil)
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		c.Assume(err, gs.IsNil)
+		ioutil.WriteFile(filepath.Join(tmpDir, name+".pem"),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+		ioutil.WriteFile(filepath.Join(tmpDir, name+".key"),
+			pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+		cert, err := x509.ParseCertificate(der)
+		c.Assume(err, gs.IsNil)
+		return cert, key
+	}
+	ca, caKey := writeCert("ca", nil, nil)
+	writeCert("server", ca, caKey)
+	writeCert("client", ca, caKey)
+	path := func(name string) string { return filepath.Join(tmpDir, name) }
+
+	serverConf := &TlsConfig{
+		CertFile:          path("server.pem"),
+		KeyFile:           path("server.key"),
+		CAFile:            path("ca.pem"),
+		RequireClientCert: true,
+	}
+	clientConf := &TlsConfig{
+		CertFile: path("client.pem"),
+		KeyFile:  path("client.key"),
+		CAFile:   path("ca.pem"),
+	}
+
+	c.Specify("A TLS config", func() {
+		c.Specify("rejects bad settings", func() {
+			_, err := CreateGoTlsConfig(&TlsConfig{}, true, "")
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = CreateGoTlsConfig(&TlsConfig{MinVersion: "SSL3"}, false, "")
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = CreateGoTlsConfig(&TlsConfig{Ciphers: []string{"NULL"}}, false, "")
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = CreateGoTlsConfig(&TlsConfig{CertFile: path("server.pem"),
+				KeyFile: path("server.key"), RequireClientCert: true}, true, "")
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("sets the client side options", func() {
+			conf := &TlsConfig{MinVersion: "TLS12",
+				Ciphers: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}}
+			goConf, err := CreateGoTlsConfig(conf, false, "example.com:5565")
+			c.Assume(err, gs.IsNil)
+			c.Expect(goConf.MinVersion, gs.Equals, uint16(tls.VersionTLS12))
+			c.Expect(len(goConf.CipherSuites), gs.Equals, 1)
+			c.Expect(goConf.ServerName, gs.Equals, "example.com")
+		})
+
+		c.Specify("connects and verifies the client", func() {
+			goServerConf, err := CreateGoTlsConfig(serverConf, true, "")
+			c.Assume(err, gs.IsNil)
+			listener, err := tls.Listen("tcp", "127.0.0.1:0", goServerConf)
+			c.Assume(err, gs.IsNil)
+			defer listener.Close()
+			addr := listener.Addr().String()
+
+			result := make(chan string, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					result <- err.Error()
+					return
+				}
+				defer conn.Close()
+				if err = conn.(*tls.Conn).Handshake(); err != nil {
+					result <- "handshake failed"
+					return
+				}
+				result <- TlsPeerIdentity(conn)
+			}()
+
+			c.Specify("exposing its identity", func() {
+				goClientConf, err := CreateGoTlsConfig(clientConf, false, addr)
+				c.Assume(err, gs.IsNil)
+				conn, err := tls.Dial("tcp", addr, goClientConf)
+				c.Assume(err, gs.IsNil)
+				defer conn.Close()
+				c.Expect(<-result, gs.Equals, "client")
+				c.Expect(TlsPeerIdentity(conn), gs.Equals, "server")
+			})
+
+			c.Specify("failing the handshake without a certificate", func() {
+				goClientConf, err := CreateGoTlsConfig(&TlsConfig{
+					CAFile: path("ca.pem")}, false, addr)
+				c.Assume(err, gs.IsNil)
+				conn, err := tls.Dial("tcp", addr, goClientConf)
+				if err == nil {
+					defer conn.Close()
+				}
+				c.Expect(<-result, gs.Equals, "handshake failed")
+			})
+		})
+	})
+}
@@ -0,0 +1,203 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Type of the messages carrying the volume of each source.
+const VOLUME_MESSAGE_TYPE = "heka.volume"
+
+// Stands in for the Logger, Hostname and Type of the sources beyond
+// `volume_max_sources`.
+const VOLUME_OTHER_SOURCES = "(other)"
+
+// A source of messages.
+type volumeSource struct {
+	Logger   string
+	Hostname string
+	Type     string
+}
+
+// Messages and bytes a source sent during an interval.
+type volumeEntry struct {
+	volumeSource
+	Messages int64
+	// Approximate encoded size of the messages, see messageSize.
+	Bytes int64
+}
+
+type volumeEntriesByBytes []volumeEntry
+
+func (v volumeEntriesByBytes) Len() int      { return len(v) }
+func (v volumeEntriesByBytes) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v volumeEntriesByBytes) Less(i, j int) bool {
+	if v[i].Bytes != v[j].Bytes {
+		return v[i].Bytes > v[j].Bytes
+	}
+	return v[i].Messages > v[j].Messages
+}
+
+// The volume of every source during an interval, as returned by the admin
+// API.
+type volumeInterval struct {
+	// Nanoseconds since the epoch, End is zero for the current interval.
+	Start   int64
+	End     int64
+	Sources []volumeEntry
+}
+
+// Tracks the messages and bytes going through the router per Logger,
+// Hostname and Type, per interval, so capacity planning and chargeback don't
+// need a filter per team.
+type volumeAccounting struct {
+	interval   time.Duration
+	maxSources int
+	lock       sync.Mutex
+	start      time.Time
+	current    map[volumeSource]*volumeEntry
+	previous   *volumeInterval
+}
+
+func newVolumeAccounting(interval time.Duration, maxSources int) *volumeAccounting {
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	return &volumeAccounting{
+		interval:   interval,
+		maxSources: maxSources,
+		start:      time.Now(),
+		current:    make(map[volumeSource]*volumeEntry),
+	}
+}
+
+// Returns the approximate encoded size of the message, without the cost of
+// encoding it.
+func messageSize(msg *message.Message) (size int) {
+	size = len(msg.Uuid) + len(msg.GetType()) + len(msg.GetLogger()) +
+		len(msg.GetPayload()) + len(msg.GetEnvVersion()) +
+		len(msg.GetHostname()) + 16 // Timestamp, Severity and Pid.
+	for _, field := range msg.Fields {
+		size += len(field.GetName()) + len(field.GetRepresentation())
+		for _, value := range field.ValueString {
+			size += len(value)
+		}
+		for _, value := range field.ValueBytes {
+			size += len(value)
+		}
+		size += 8*(len(field.ValueInteger)+len(field.ValueDouble)) +
+			len(field.ValueBool)
+	}
+	return
+}
+
+// Counts the message against its source.
+func (v *volumeAccounting) count(msg *message.Message) {
+	source := volumeSource{msg.GetLogger(), msg.GetHostname(), msg.GetType()}
+	size := int64(messageSize(msg))
+	v.lock.Lock()
+	entry, ok := v.current[source]
+	if !ok {
+		if v.maxSources > 0 && len(v.current) >= v.maxSources {
+			source = volumeSource{VOLUME_OTHER_SOURCES, VOLUME_OTHER_SOURCES,
+				VOLUME_OTHER_SOURCES}
+			entry, ok = v.current[source]
+		}
+		if !ok {
+			entry = &volumeEntry{volumeSource: source}
+			v.current[source] = entry
+		}
+	}
+	entry.Messages++
+	entry.Bytes += size
+	v.lock.Unlock()
+}
+
+func sortedVolumeEntries(entries map[volumeSource]*volumeEntry) []volumeEntry {
+	sorted := make(volumeEntriesByBytes, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, *entry)
+	}
+	sort.Sort(sorted)
+	return sorted
+}
+
+// Ends the current interval, returning it.
+func (v *volumeAccounting) rollover(now time.Time) *volumeInterval {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	ended := &volumeInterval{
+		Start:   v.start.UnixNano(),
+		End:     now.UnixNano(),
+		Sources: sortedVolumeEntries(v.current),
+	}
+	v.previous = ended
+	v.start = now
+	v.current = make(map[volumeSource]*volumeEntry)
+	return ended
+}
+
+// Returns the interval in progress and the last one that ended, nil if none
+// has yet.
+func (v *volumeAccounting) intervals() (current, previous *volumeInterval) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	current = &volumeInterval{
+		Start:   v.start.UnixNano(),
+		Sources: sortedVolumeEntries(v.current),
+	}
+	return current, v.previous
+}
+
+// Injects a message for each source of the interval.
+func (self *PipelineConfig) injectVolumeMessages(ended *volumeInterval) {
+	seconds := float64(ended.End-ended.Start) / float64(time.Second)
+	for _, entry := range ended.Sources {
+		pack := self.PipelinePack(0)
+		if pack == nil {
+			return
+		}
+		msg := pack.Message
+		msg.SetType(VOLUME_MESSAGE_TYPE)
+		msg.SetTimestamp(ended.End)
+		message.NewStringField(msg, "SourceLogger", entry.Logger)
+		message.NewStringField(msg, "SourceHostname", entry.Hostname)
+		message.NewStringField(msg, "SourceType", entry.Type)
+		message.NewInt64Field(msg, "MessageCount", entry.Messages, "count")
+		message.NewInt64Field(msg, "ByteCount", entry.Bytes, "B")
+		field, _ := message.NewField("Interval", seconds, "s")
+		msg.AddField(field)
+		self.router.InChan() <- pack
+	}
+}
+
+// Ends an accounting interval every interval until Heka stops, injecting
+// the volume messages if enabled.
+func (self *PipelineConfig) runVolumeAccounting(emit bool) {
+	volume := self.router.volume
+	ticker := time.NewTicker(volume.interval)
+	defer ticker.Stop()
+	for !Globals().Stopping {
+		now := <-ticker.C
+		ended := volume.rollover(now)
+		if emit && !Globals().Stopping {
+			self.injectVolumeMessages(ended)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package pipeline
+
+import (
+	"encoding/json"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func VolumeAccountingSpec(c gs.Context) {
+	newMsg := func(logger, typ, payload string) *message.Message {
+		msg := new(message.Message)
+		msg.SetLogger(logger)
+		msg.SetHostname("web1")
+		msg.SetType(typ)
+		msg.SetPayload(payload)
+		return msg
+	}
+	start := time.Unix(1400000000, 0)
+
+	c.Specify("The volume accounting", func() {
+		volume := newVolumeAccounting(time.Minute, 2)
+		volume.start = start
+		volume.count(newMsg("nginx", "access", "GET /"))
+		volume.count(newMsg("nginx", "access", "GET /index.html"))
+		volume.count(newMsg("app", "error", "boom"))
+
+		c.Specify("counts messages and bytes per source", func() {
+			current, previous := volume.intervals()
+			c.Expect(previous, gs.IsNil)
+			c.Assume(len(current.Sources), gs.Equals, 2)
+			nginx := current.Sources[0]
+			c.Expect(nginx.Logger, gs.Equals, "nginx")
+			c.Expect(nginx.Type, gs.Equals, "access")
+			c.Expect(nginx.Messages, gs.Equals, int64(2))
+			c.Expect(nginx.Bytes, gs.Equals,
+				int64(messageSize(newMsg("nginx", "access", "GET /"))+
+					messageSize(newMsg("nginx", "access", "GET /index.html"))))
+			c.Expect(current.Sources[1].Logger, gs.Equals, "app")
+		})
+
+		c.Specify("lumps the sources beyond the limit together", func() {
+			volume.count(newMsg("cron", "job", "ran"))
+			volume.count(newMsg("sshd", "auth", "login"))
+			current, _ := volume.intervals()
+			c.Assume(len(current.Sources), gs.Equals, 3)
+			var other volumeEntry
+			for _, entry := range current.Sources {
+				if entry.Logger == VOLUME_OTHER_SOURCES {
+					other = entry
+				}
+			}
+			c.Expect(other.Type, gs.Equals, VOLUME_OTHER_SOURCES)
+			c.Expect(other.Messages, gs.Equals, int64(2))
+		})
+
+		c.Specify("starts afresh every interval", func() {
+			ended := volume.rollover(start.Add(time.Minute))
+			c.Expect(ended.Start, gs.Equals, start.UnixNano())
+			c.Expect(len(ended.Sources), gs.Equals, 2)
+			current, previous := volume.intervals()
+			c.Expect(previous, gs.Equals, ended)
+			c.Expect(len(current.Sources), gs.Equals, 0)
+		})
+	})
+
+	c.Specify("The volume messages", func() {
+		pc := NewPipelineConfig(nil)
+		pc.injectRecycleChan <- NewPipelinePack(pc.injectRecycleChan)
+		pc.router.volume.start = start
+		pc.router.volume.count(newMsg("nginx", "access", "GET /"))
+		ended := pc.router.volume.rollover(start.Add(time.Minute))
+
+		c.Specify("are injected for each source", func() {
+			pc.injectVolumeMessages(ended)
+			pack := <-pc.router.InChan()
+			msg := pack.Message
+			c.Expect(msg.GetType(), gs.Equals, VOLUME_MESSAGE_TYPE)
+			logger, _ := msg.GetFieldValue("SourceLogger")
+			c.Expect(logger, gs.Equals, "nginx")
+			count, _ := msg.GetFieldValue("MessageCount")
+			c.Expect(count, gs.Equals, int64(1))
+			interval, _ := msg.GetFieldValue("Interval")
+			c.Expect(interval, gs.Equals, float64(60))
+		})
+
+		c.Specify("are served by the admin API", func() {
+			pc.router.volume.count(newMsg("app", "error", "boom"))
+			req, err := http.NewRequest("GET", "http://localhost/volume?logger=app", nil)
+			c.Assume(err, gs.IsNil)
+			w := httptest.NewRecorder()
+			(&adminHandler{pc}).ServeHTTP(w, req)
+			c.Expect(w.Code, gs.Equals, http.StatusOK)
+			var body struct {
+				Interval float64 `json:"interval"`
+				Current  *volumeInterval
+				Previous *volumeInterval
+			}
+			err = json.Unmarshal(w.Body.Bytes(), &body)
+			c.Assume(err, gs.IsNil)
+			c.Expect(body.Interval, gs.Equals, float64(60))
+			c.Assume(len(body.Current.Sources), gs.Equals, 1)
+			c.Expect(body.Current.Sources[0].Type, gs.Equals, "error")
+			c.Expect(len(body.Previous.Sources), gs.Equals, 0)
+		})
+	})
+}
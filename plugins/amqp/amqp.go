@@ -22,8 +22,11 @@ import (
 	"github.com/mozilla-services/heka/client"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
 	"github.com/streadway/amqp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -117,8 +120,8 @@ type AMQPOutputConfig struct {
 	// Whether the exchange is deleted when all queues have finished
 	// Defaults to auto-delete
 	ExchangeAutoDelete bool
-	// Routing key for the message to send, or when used for consumer
-	// the routing key to bind the queue to the exchange with
+	// Routing key for the message to send, `%{name}` is replaced by the
+	// named message attribute or field
 	// Defaults to empty string
 	RoutingKey string
 	// Whether messages published should be marked as persistent or
@@ -128,6 +131,14 @@ type AMQPOutputConfig struct {
 	// published. The AMQP input will automatically detect these
 	// messages and deserialize them. Defaults to true.
 	Serialize bool
+	// Whether to wait for the broker to confirm each published message,
+	// publishing it again when the broker nacks it
+	// Defaults to false
+	UseConfirms bool
+	// How many times a nacked message is published again before it's
+	// handed to the dead letter queue
+	// Defaults to 3
+	MaxRedeliveries int
 }
 
 // Connection tracker that stores the actual AMQP Connection object along
@@ -239,6 +250,88 @@ type AMQPOutput struct {
 	// and is used as a barrier to ensure all users of the connection
 	// are done before we finish
 	connWg *sync.WaitGroup
+	// Parsed routing key, nil if it has no interpolations
+	routingKey []routingKeyPart
+	// Publisher confirmations, if UseConfirms is set
+	acks  chan uint64
+	nacks chan uint64
+	// Counters for the plugin report
+	published    int64
+	nacked       int64
+	deadLettered int64
+}
+
+// A piece of a routing key, either literal text or the name of a message
+// attribute or field to be interpolated, i.e. `%{Hostname}`.
+type routingKeyPart struct {
+	literal string
+	field   string
+}
+
+// Splits a routing key containing `%{name}` interpolations into its parts.
+// Returns nil if the key doesn't contain any interpolations.
+func parseRoutingKey(key string) (parts []routingKeyPart, err error) {
+	rest := key
+	for {
+		start := strings.Index(rest, "%{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, errors.New("unterminated '%{' in routing key")
+		}
+		end += start
+		name := rest[start+2 : end]
+		if name == "" {
+			return nil, errors.New("empty '%{}' in routing key")
+		}
+		if start > 0 {
+			parts = append(parts, routingKeyPart{literal: rest[:start]})
+		}
+		parts = append(parts, routingKeyPart{field: name})
+		rest = rest[end+1:]
+	}
+	if parts != nil && rest != "" {
+		parts = append(parts, routingKeyPart{literal: rest})
+	}
+	return
+}
+
+// Builds the routing key for a message.
+func (ao *AMQPOutput) messageRoutingKey(msg *message.Message) (key string, err error) {
+	if ao.routingKey == nil {
+		return ao.config.RoutingKey, nil
+	}
+	pieces := make([]string, len(ao.routingKey))
+	for i, part := range ao.routingKey {
+		if part.field == "" {
+			pieces[i] = part.literal
+			continue
+		}
+		var ok bool
+		if pieces[i], ok = plugins.GetMessageVariable(msg, part.field); !ok {
+			return "", fmt.Errorf("message has no field '%s' for the routing key",
+				part.field)
+		}
+	}
+	return strings.Join(pieces, ""), nil
+}
+
+// Packs that AMQPOutputs were publishing when their channel closed, by
+// plugin name. The restarted output publishes them first, so they aren't
+// lost when the broker restarts.
+var unconfirmedPacks = struct {
+	sync.Mutex
+	packs map[string]*PipelinePack
+}{packs: make(map[string]*PipelinePack)}
+
+func takeUnconfirmedPack(name string) (pack *PipelinePack) {
+	unconfirmedPacks.Lock()
+	defer unconfirmedPacks.Unlock()
+	pack = unconfirmedPacks.packs[name]
+	delete(unconfirmedPacks.packs, name)
+	return
 }
 
 func (ao *AMQPOutput) ConfigStruct() interface{} {
@@ -248,12 +341,17 @@ func (ao *AMQPOutput) ConfigStruct() interface{} {
 		RoutingKey:         "",
 		Persistent:         false,
 		Serialize:          true,
+		UseConfirms:        false,
+		MaxRedeliveries:    3,
 	}
 }
 
 func (ao *AMQPOutput) Init(config interface{}) (err error) {
 	conf := config.(*AMQPOutputConfig)
 	ao.config = conf
+	if ao.routingKey, err = parseRoutingKey(conf.RoutingKey); err != nil {
+		return
+	}
 	ch, usageWg, connectionWg, err := amqpHub.GetChannel(conf.URL)
 	if err != nil {
 		return
@@ -269,69 +367,129 @@ func (ao *AMQPOutput) Init(config interface{}) (err error) {
 		usageWg.Done()
 		return
 	}
+	if conf.UseConfirms {
+		if err = ch.Confirm(false); err != nil {
+			usageWg.Done()
+			return
+		}
+		ao.acks, ao.nacks = ch.NotifyConfirm(make(chan uint64, 1),
+			make(chan uint64, 1))
+	}
 	ao.ch = ch
 	return
 }
 
+// Builds the AMQP message for the pack.
+func (ao *AMQPOutput) publishing(pack *PipelinePack, encoder client.Encoder,
+	msgBody *[]byte) (amqpMsg amqp.Publishing, err error) {
+
+	conf := ao.config
+	amqpMsg = amqp.Publishing{
+		DeliveryMode: amqp.Transient,
+		Timestamp:    time.Now(),
+	}
+	if conf.Persistent {
+		amqpMsg.DeliveryMode = amqp.Persistent
+	}
+	if conf.Serialize {
+		*msgBody = (*msgBody)[:0]
+		if err = encoder.EncodeMessageStream(pack.Message, msgBody); err != nil {
+			return
+		}
+		amqpMsg.ContentType = "application/hekad"
+		amqpMsg.Body = *msgBody
+	} else {
+		amqpMsg.ContentType = "text/plain"
+		amqpMsg.Body = []byte(pack.Message.GetPayload())
+	}
+	return
+}
+
+// Publishes the pack's message, waiting for the broker's confirmation if
+// UseConfirms is set. Returns an error, without recycling the pack, if the
+// channel failed.
+func (ao *AMQPOutput) deliver(or OutputRunner, h PluginHelper, pack *PipelinePack,
+	encoder client.Encoder, msgBody *[]byte) (err error) {
+
+	conf := ao.config
+	key, e := ao.messageRoutingKey(pack.Message)
+	var amqpMsg amqp.Publishing
+	if e == nil {
+		amqpMsg, e = ao.publishing(pack, encoder, msgBody)
+	}
+	if e != nil {
+		or.LogError(e)
+		pack.Recycle()
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		if err = ao.ch.Publish(conf.Exchange, key, false, false, amqpMsg); err != nil {
+			return
+		}
+		if !conf.UseConfirms {
+			break
+		}
+		var ok, acked bool
+		select {
+		case _, ok = <-ao.acks:
+			acked = true
+		case _, ok = <-ao.nacks:
+		case amqpErr := <-ao.closeChan:
+			return fmt.Errorf("channel closed awaiting confirmation: %v", amqpErr)
+		}
+		if !ok {
+			return errors.New("channel closed awaiting confirmation")
+		}
+		if acked {
+			break
+		}
+		atomic.AddInt64(&ao.nacked, 1)
+		if attempt >= conf.MaxRedeliveries {
+			atomic.AddInt64(&ao.deadLettered, 1)
+			h.PipelineConfig().DeadLetter(pack, or.Name(),
+				fmt.Errorf("broker nacked the message %d times", attempt+1))
+			return
+		}
+	}
+	atomic.AddInt64(&ao.published, 1)
+	pack.Recycle()
+	return
+}
+
 func (ao *AMQPOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	inChan := or.InChan()
 	conf := ao.config
 
 	var (
 		pack    *PipelinePack
-		msg     *message.Message
-		persist uint8
 		ok      bool = true
-		amqpMsg amqp.Publishing
 		encoder client.Encoder
 		msgBody []byte = make([]byte, 0, 500)
 	)
-	if conf.Persistent {
-		persist = uint8(1)
-	} else {
-		persist = uint8(0)
-	}
 	encoder = client.NewProtobufEncoder(nil)
 
+	// Publish what the previous run left unconfirmed first.
+	pack = takeUnconfirmedPack(or.Name())
 	for ok {
-		select {
-		case <-ao.closeChan:
-			ok = false
-		case pack, ok = <-inChan:
+		if pack == nil {
+			select {
+			case <-ao.closeChan:
+				err = errors.New("channel closed")
+				ok = false
+			case pack, ok = <-inChan:
+			}
 			if !ok {
 				break
 			}
-			msg = pack.Message
-			if conf.Serialize {
-				if err = encoder.EncodeMessageStream(msg, &msgBody); err != nil {
-					or.LogError(err)
-					err = nil
-					pack.Recycle()
-					continue
-				}
-				amqpMsg = amqp.Publishing{
-					DeliveryMode: persist,
-					Timestamp:    time.Now(),
-					ContentType:  "application/hekad",
-					Body:         msgBody,
-				}
-			} else {
-				amqpMsg = amqp.Publishing{
-					DeliveryMode: persist,
-					Timestamp:    time.Now(),
-					ContentType:  "text/plain",
-					Body:         []byte(msg.GetPayload()),
-				}
-			}
-			err = ao.ch.Publish(conf.Exchange, conf.RoutingKey,
-				false, false, amqpMsg)
-			if err != nil {
-				ok = false
-			} else {
-				pack.Recycle()
-			}
-			msgBody = msgBody[:0]
 		}
+		if err = ao.deliver(or, h, pack, encoder, &msgBody); err != nil {
+			unconfirmedPacks.Lock()
+			unconfirmedPacks.packs[or.Name()] = pack
+			unconfirmedPacks.Unlock()
+			ok = false
+		}
+		pack = nil
 	}
 	ao.usageWg.Done()
 	amqpHub.Close(conf.URL, ao.connWg)
@@ -345,11 +503,22 @@ func (ao *AMQPOutput) CleanupForRestart() {
 	return
 }
 
+func (ao *AMQPOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "PublishedCount", atomic.LoadInt64(&ao.published),
+		"count")
+	message.NewInt64Field(msg, "NackedCount", atomic.LoadInt64(&ao.nacked), "count")
+	message.NewInt64Field(msg, "DeadLetteredCount",
+		atomic.LoadInt64(&ao.deadLettered), "count")
+	return nil
+}
+
 type AMQPInput struct {
 	config  *AMQPInputConfig
 	ch      AMQPChannel
 	usageWg *sync.WaitGroup
 	connWg  *sync.WaitGroup
+	// Set by Stop, tells a closed delivery stream from a broker failure.
+	stopped int32
 }
 
 func (ai *AMQPInput) ConfigStruct() interface{} {
@@ -368,6 +537,9 @@ func (ai *AMQPInput) ConfigStruct() interface{} {
 func (ai *AMQPInput) Init(config interface{}) (err error) {
 	conf := config.(*AMQPInputConfig)
 	ai.config = conf
+	if conf.PrefetchCount < 1 {
+		return errors.New("PrefetchCount must be at least 1")
+	}
 	ch, usageWg, connWg, err := amqpHub.GetChannel(conf.URL)
 	if err != nil {
 		return
@@ -402,12 +574,45 @@ func (ai *AMQPInput) Init(config interface{}) (err error) {
 	return
 }
 
+// Decodes the delivery into packs, recycling the pack if nothing comes out
+// of it.
+func (ai *AMQPInput) decode(ir InputRunner, decoder Decoder, header *message.Header,
+	msg amqp.Delivery, pack *PipelinePack) (packs []*PipelinePack) {
+
+	var err error
+	if msg.ContentType == "application/hekad" {
+		defer header.Reset()
+		if decoder == nil {
+			err = errors.New("`application/hekad` messages require a decoder.")
+		} else if _, msgOk := findMessage(msg.Body, header, &(pack.MsgBytes)); !msgOk {
+			err = errors.New("Can't find Heka message.")
+		} else {
+			packs, err = decoder.Decode(pack)
+		}
+	} else {
+		pack.Message.SetType("amqp")
+		pack.Message.SetPayload(string(msg.Body))
+		pack.Message.SetTimestamp(msg.Timestamp.UnixNano())
+		if decoder == nil {
+			packs = []*PipelinePack{pack}
+		} else if packs, err = decoder.Decode(pack); err != nil {
+			err = fmt.Errorf("Couldn't parse AMQP message: %s", msg.Body)
+		}
+	}
+	if packs == nil {
+		if err != nil {
+			ir.LogError(err)
+		}
+		pack.Recycle()
+	}
+	return
+}
+
 func (ai *AMQPInput) Run(ir InputRunner, h PluginHelper) (err error) {
 	var (
 		dRunner DecoderRunner
 		decoder Decoder
 		pack    *PipelinePack
-		e       error
 		ok      bool
 	)
 	defer ai.usageWg.Done()
@@ -435,51 +640,25 @@ func (ai *AMQPInput) Run(ir InputRunner, h PluginHelper) (err error) {
 	if err != nil {
 		return
 	}
-readLoop:
 	for {
-		e = nil
 		pack = <-packSupply
 		msg, ok := <-stream
 		if !ok {
-			break readLoop
+			pack.Recycle()
+			break
 		}
-
-		if msg.ContentType == "application/hekad" {
-			if dRunner == nil {
-				pack.Recycle()
-				ir.LogError(errors.New("`application/hekad` messages require a decoder."))
-			}
-			_, msgOk := findMessage(msg.Body, header, &(pack.MsgBytes))
-			if msgOk {
-				dRunner.InChan() <- pack
-			} else {
-				pack.Recycle()
-				ir.LogError(errors.New("Can't find Heka message."))
-			}
-			header.Reset()
-		} else {
-			pack.Message.SetType("amqp")
-			pack.Message.SetPayload(string(msg.Body))
-			pack.Message.SetTimestamp(msg.Timestamp.UnixNano())
-			var packs []*PipelinePack
-			if decoder == nil {
-				packs = []*PipelinePack{pack}
-			} else {
-				packs, e = decoder.Decode(pack)
-			}
-			if packs != nil {
-				for _, p := range packs {
-					ir.Inject(p)
-				}
-			} else {
-				if e != nil {
-					ir.LogError(fmt.Errorf("Couldn't parse AMQP message: %s", msg.Body))
-				}
-				pack.Recycle()
-			}
+		// The delivery is only acknowledged once its messages have reached
+		// the router, the broker redelivers it if the connection fails
+		// before.
+		for _, p := range ai.decode(ir, decoder, header, msg, pack) {
+			ir.Inject(p)
 		}
 		msg.Ack(false)
 	}
+	if atomic.LoadInt32(&ai.stopped) == 0 {
+		// The broker went away, the input is restarted to reconnect.
+		err = errors.New("delivery stream closed by the broker")
+	}
 	return
 }
 
@@ -489,6 +668,7 @@ func (ai *AMQPInput) CleanupForRestart() {
 }
 
 func (ai *AMQPInput) Stop() {
+	atomic.StoreInt32(&ai.stopped, 1)
 	ai.ch.Close()
 	amqpHub.Close(ai.config.URL, ai.connWg)
 	ai.connWg.Wait()
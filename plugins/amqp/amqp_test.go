@@ -203,7 +203,6 @@ func AMQPPluginSpec(c gs.Context) {
 				_ = encoder.EncodeMessageStream(msg, &msgBody)
 
 				ack := plugins_ts.NewMockAcknowledger(ctrl)
-				ack.EXPECT().Ack(gomock.Any(), false)
 
 				streamChan <- amqp.Delivery{
 					ContentType:  "application/hekad",
@@ -214,22 +213,35 @@ func AMQPPluginSpec(c gs.Context) {
 				mch.EXPECT().Consume("", "", false, false, false, false,
 					gomock.Any()).Return(streamChan, nil)
 
-				// Expect the decoded pack
-				mockDRunner.EXPECT().InChan().Return(ith.DecodeChan)
+				// Expect the pack to be decoded and injected before the ack
+				injected := make(chan *PipelinePack, 1)
+				gomock.InOrder(
+					mockDecoder.EXPECT().Decode(ith.Pack).Return(
+						[]*PipelinePack{ith.Pack}, nil),
+					ith.MockInputRunner.EXPECT().Inject(ith.Pack).Do(
+						func(pack *PipelinePack) {
+							injected <- pack
+						}),
+					ack.EXPECT().Ack(gomock.Any(), false),
+				)
 
 				// Increase the usage since Run decrements it on close
 				ug.Add(1)
 
 				ith.PackSupply <- ith.Pack
+				done := make(chan error)
 				go func() {
-					amqpInput.Run(ith.MockInputRunner, ith.MockHelper)
+					done <- amqpInput.Run(ith.MockInputRunner, ith.MockHelper)
 				}()
-				packRef := <-ith.DecodeChan
+				packRef := <-injected
 				c.Expect(ith.Pack, gs.Equals, packRef)
 				// Ignore leading 5 bytes of encoded message as thats the header
 				c.Expect(string(packRef.MsgBytes), gs.Equals, string(msgBody[5:]))
 				ith.PackSupply <- ith.Pack
 				close(streamChan)
+
+				// The broker closing the stream restarts the input.
+				c.Expect(<-done, gs.Not(gs.IsNil))
 			})
 		})
 	})
@@ -259,6 +271,7 @@ func AMQPPluginSpec(c gs.Context) {
 		// Expect the close and the InChan calls
 		aqh.EXPECT().Close("", cg)
 		oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+		oth.MockOutputRunner.EXPECT().Name().Return("amqp").AnyTimes()
 
 		msg := pipeline_ts.GetTestMessage()
 		pack := NewPipelinePack(pConfig.InputRecycleChan())
@@ -298,5 +311,81 @@ func AMQPPluginSpec(c gs.Context) {
 			}()
 			ug.Wait()
 		})
+
+		c.Specify("interpolates the routing key", func() {
+			defaultConfig.RoutingKey = "logs.%{Hostname}.%{Type}"
+			defaultConfig.Persistent = true
+			err := amqpOutput.Init(defaultConfig)
+			c.Assume(err, gs.IsNil)
+
+			mch.EXPECT().Publish("", "logs.my.host.name.TEST", false, false,
+				gomock.Any()).Do(func(exchange, key string, mandatory,
+				immediate bool, msg amqp.Publishing) {
+
+				c.Expect(msg.DeliveryMode, gs.Equals, amqp.Persistent)
+			}).Return(nil)
+			inChan <- pack
+			close(inChan)
+
+			go func() {
+				amqpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+			}()
+			ug.Wait()
+		})
+
+		c.Specify("with publisher confirms", func() {
+			defaultConfig.UseConfirms = true
+			defaultConfig.MaxRedeliveries = 1
+			acks := make(chan uint64, 1)
+			nacks := make(chan uint64, 1)
+			mch.EXPECT().Confirm(false).Return(nil)
+			mch.EXPECT().NotifyConfirm(gomock.Any(), gomock.Any()).Return(acks, nacks)
+			err := amqpOutput.Init(defaultConfig)
+			c.Assume(err, gs.IsNil)
+			oth.MockHelper.EXPECT().PipelineConfig().Return(pConfig).AnyTimes()
+
+			c.Specify("publishes nacked messages again", func() {
+				gomock.InOrder(
+					mch.EXPECT().Publish("", "test", false, false, gomock.Any()).Do(
+						func(string, string, bool, bool, amqp.Publishing) {
+							nacks <- 1
+						}).Return(nil),
+					mch.EXPECT().Publish("", "test", false, false, gomock.Any()).Do(
+						func(string, string, bool, bool, amqp.Publishing) {
+							acks <- 2
+						}).Return(nil),
+				)
+				inChan <- pack
+				close(inChan)
+				err = amqpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				c.Expect(err, gs.IsNil)
+				c.Expect(amqpOutput.nacked, gs.Equals, int64(1))
+				c.Expect(amqpOutput.published, gs.Equals, int64(1))
+			})
+
+			c.Specify("dead letters messages nacked too often", func() {
+				mch.EXPECT().Publish("", "test", false, false, gomock.Any()).Do(
+					func(string, string, bool, bool, amqp.Publishing) {
+						nacks <- 1
+					}).Return(nil).Times(2)
+				inChan <- pack
+				close(inChan)
+				err = amqpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				c.Expect(err, gs.IsNil)
+				c.Expect(amqpOutput.deadLettered, gs.Equals, int64(1))
+				c.Expect(amqpOutput.published, gs.Equals, int64(0))
+			})
+
+			c.Specify("keeps the unconfirmed message for the restarted output", func() {
+				mch.EXPECT().Publish("", "test", false, false, gomock.Any()).Do(
+					func(string, string, bool, bool, amqp.Publishing) {
+						close(acks)
+					}).Return(nil)
+				inChan <- pack
+				err = amqpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				c.Expect(err, gs.Not(gs.IsNil))
+				c.Expect(takeUnconfirmedPack("amqp"), gs.Equals, pack)
+			})
+		})
 	})
 }
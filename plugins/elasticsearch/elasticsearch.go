@@ -53,6 +53,8 @@ type ElasticSearchOutput struct {
 	bulkIndexer BulkIndexer
 	// Specify the document id or field name
 	id string
+	// Backs off between attempts at indexing a batch
+	retryHelper *RetryHelper
 }
 
 // ConfigStruct for ElasticSearchOutput plugin.
@@ -88,6 +90,15 @@ type ElasticSearchOutputConfig struct {
 	ESIndexFromTimestamp bool
 	// Document ID
 	Id string
+	// Number of times a bulk request is retried when the cluster is
+	// throttling (429), unavailable (5xx) or unreachable, before the batch is
+	// dropped. -1 retries forever. Defaults to 5.
+	MaxRetries int `toml:"max_retries"`
+	// Delay before the first retry, doubled on every further retry. Defaults
+	// to "250ms".
+	RetryDelay string `toml:"retry_delay"`
+	// Maximum delay between retries. Defaults to "30s".
+	MaxRetryDelay string `toml:"max_retry_delay"`
 }
 
 func (o *ElasticSearchOutput) ConfigStruct() interface{} {
@@ -102,6 +113,9 @@ func (o *ElasticSearchOutput) ConfigStruct() interface{} {
 		Server:               "http://localhost:9200",
 		ESIndexFromTimestamp: false,
 		Id:                   "",
+		MaxRetries:           5,
+		RetryDelay:           "250ms",
+		MaxRetryDelay:        "30s",
 	}
 }
 
@@ -143,6 +157,18 @@ func (o *ElasticSearchOutput) Init(config interface{}) (err error) {
 		return err
 	}
 
+	// Jitter of up to the initial delay spreads out the retries of several
+	// Heka instances hitting the same cluster.
+	o.retryHelper, err = NewRetryHelper(RetryOptions{
+		MaxDelay:   conf.MaxRetryDelay,
+		Delay:      conf.RetryDelay,
+		MaxJitter:  conf.RetryDelay,
+		MaxRetries: conf.MaxRetries,
+	})
+	if err != nil {
+		return fmt.Errorf("Invalid retry settings: %s", err)
+	}
+
 	return
 }
 
@@ -150,7 +176,7 @@ func (o *ElasticSearchOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go o.receiver(or, &wg)
-	go o.committer(&wg)
+	go o.committer(or, &wg)
 	wg.Wait()
 	return
 }
@@ -162,6 +188,7 @@ func (o *ElasticSearchOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 	var pack *PipelinePack
 	var e error
 	var count int
+	var recycler RecycleBatcher
 	ok := true
 	ticker := time.Tick(time.Duration(o.flushInterval) * time.Millisecond)
 	outBatch := make([]byte, 0, 10000)
@@ -173,14 +200,16 @@ func (o *ElasticSearchOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 		case pack, ok = <-inChan:
 			if !ok {
 				// Closed inChan => we're shutting down, flush data
+				recycler.Flush()
 				if len(outBatch) > 0 {
 					o.batchChan <- outBatch
 				}
 				close(o.batchChan)
 				break
 			}
-			// `handleMessage()` method recycles the pack.
-			if e = o.handleMessage(pack, &outBytes); e != nil {
+			e = o.handleMessage(pack, &outBytes)
+			recycler.Add(pack, len(inChan))
+			if e != nil {
 				or.LogError(e)
 			} else {
 				outBatch = append(outBatch, outBytes...)
@@ -188,6 +217,7 @@ func (o *ElasticSearchOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 					if len(outBatch) > 0 {
 						// This will block until the other side is ready to accept
 						// this batch, so we can't get too far ahead.
+						recycler.Flush()
 						o.batchChan <- outBatch
 						outBatch = <-o.backChan
 						count = 0
@@ -199,6 +229,7 @@ func (o *ElasticSearchOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 			if len(outBatch) > 0 {
 				// This will block until the other side is ready to accept
 				// this batch, freeing us to start on the next one.
+				recycler.Flush()
 				o.batchChan <- outBatch
 				outBatch = <-o.backChan
 				count = 0
@@ -509,7 +540,7 @@ func (c *CleanMessageFormatter) Format(m *message.Message) (doc []byte, err erro
 }
 
 // Performs the actual task of extracting data from the pack and writing it
-// into the output buffer.
+// into the output buffer. The caller recycles the pack.
 func (o *ElasticSearchOutput) handleMessage(pack *PipelinePack, outBytes *[]byte) (err error) {
 
 	// Builds ElasticSearch document coordinates (1st line of bulk indexing)
@@ -525,7 +556,6 @@ func (o *ElasticSearchOutput) handleMessage(pack *PipelinePack, outBytes *[]byte
 	var document []byte
 	document, err = o.messageFormatter.Format(pack.Message)
 	if err != nil {
-		pack.Recycle()
 		err = fmt.Errorf("Error in message conversion to %s format: %s", o.format, err)
 		return
 	}
@@ -537,26 +567,44 @@ func (o *ElasticSearchOutput) handleMessage(pack *PipelinePack, outBytes *[]byte
 	*outBytes = append(*outBytes, NEWLINE)
 
 	document = document[:0]
-	pack.Recycle()
 	return
 }
 
 // Runs in a separate goroutine, waits for buffered data on the committer
 // channel, bulk index it out to the elasticsearch cluster, and puts the now empty buffer on
 // the return channel for reuse.
-func (o *ElasticSearchOutput) committer(wg *sync.WaitGroup) {
+func (o *ElasticSearchOutput) committer(or OutputRunner, wg *sync.WaitGroup) {
 	initBatch := make([]byte, 0, 10000)
 	o.backChan <- initBatch
 	var outBatch []byte
 
 	for outBatch = range o.batchChan {
-		o.bulkIndexer.Index(outBatch)
+		if err := o.indexBatch(outBatch); err != nil {
+			or.LogError(fmt.Errorf("Dropping batch: %s", err))
+		}
 		outBatch = outBatch[:0]
 		o.backChan <- outBatch
 	}
 	wg.Done()
 }
 
+// Indexes a batch, backing off and retrying for as long as the failures are
+// temporary and max_retries isn't exceeded.
+func (o *ElasticSearchOutput) indexBatch(body []byte) (err error) {
+	defer o.retryHelper.Reset()
+	for {
+		if _, err = o.bulkIndexer.Index(body); err == nil {
+			return
+		}
+		if _, ok := err.(*TemporaryIndexError); !ok {
+			return
+		}
+		if o.retryHelper.Wait() != nil {
+			return fmt.Errorf("%s (max retries exceeded)", err)
+		}
+	}
+}
+
 // Replaces a date pattern (ex: %{2012.09.19} in the index name
 func interpolateFlag(e *ElasticSearchCoordinates, m *message.Message, name string) (interpolatedValue string, err error) {
 	iSlice := strings.Split(name, "%{")
@@ -583,8 +631,8 @@ func interpolateFlag(e *ElasticSearchCoordinates, m *message.Message, name strin
 			case "Severity":
 				iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], strconv.Itoa(int(m.GetSeverity())), -1)
 			default:
-				if fname, ok := m.GetFieldValue(elVal); ok {
-					iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], fname.(string), -1)
+				if fval, ok := m.GetFieldValue(elVal); ok {
+					iSlice[i] = strings.Replace(iSlice[i], element[:elEnd+1], fmt.Sprint(fval), -1)
 				} else {
 					if e.ESIndexFromTimestamp && e.Timestamp != nil {
 						t = time.Unix(0, *e.Timestamp).UTC()
@@ -603,6 +651,16 @@ func interpolateFlag(e *ElasticSearchCoordinates, m *message.Message, name strin
 	return
 }
 
+// Error returned by a BulkIndexer when indexing failed in a way that might
+// succeed if retried, e.g. the cluster is throttling requests.
+type TemporaryIndexError struct {
+	msg string
+}
+
+func (e *TemporaryIndexError) Error() string {
+	return e.msg
+}
+
 // A BulkIndexer is used to index documents in ElasticSearch
 type BulkIndexer interface {
 	// Index documents
@@ -649,11 +707,16 @@ func (h *HttpBulkIndexer) Index(body []byte) (success bool, err error) {
 		request.Header.Add("Accept", "application/json")
 		response, err := h.client.Do(request)
 		if err != nil {
-			err = fmt.Errorf("Error executing bulk request: %s", err)
+			err = &TemporaryIndexError{fmt.Sprintf("Error executing bulk request: %s", err)}
 			return false, err
 		}
 		if response != nil {
 			defer response.Body.Close()
+			if response.StatusCode == 429 || response.StatusCode >= 500 {
+				err = &TemporaryIndexError{fmt.Sprintf("Bulk response in error: %s",
+					response.Status)}
+				return false, err
+			}
 			if response.StatusCode > 304 {
 				err = fmt.Errorf("Bulk response in error: %s", response.Status)
 				return false, err
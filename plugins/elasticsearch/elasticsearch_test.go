@@ -20,6 +20,8 @@ import (
 	"encoding/json"
 	. "github.com/mozilla-services/heka/message"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
@@ -135,4 +137,63 @@ func ElasticSearchOutputSpec(c gs.Context) {
 			"Could not interpolate field from config: %{idFail}"), gs.Equals, true)
 		c.Expect(unInterpolatedId, gs.Equals, "idFail")
 	})
+
+	c.Specify("Should interpolate non-string fields into the index name", func() {
+		interpolatedIndex, err := interpolateFlag(&ElasticSearchCoordinates{},
+			getTestMessageWithFunnyFields(), "heka-%{\"number}")
+		c.Expect(err, gs.IsNil)
+		c.Expect(interpolatedIndex, gs.Equals, "heka-64")
+	})
+
+	c.Specify("An ElasticSearchOutput indexing over HTTP", func() {
+		var requests int
+		statuses := []int{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request) {
+			status := http.StatusOK
+			if requests < len(statuses) {
+				status = statuses[requests]
+			}
+			requests++
+			w.WriteHeader(status)
+		}))
+		defer server.Close()
+
+		output := new(ElasticSearchOutput)
+		conf := output.ConfigStruct().(*ElasticSearchOutputConfig)
+		conf.Server = server.URL
+		conf.RetryDelay = "1ms"
+		conf.MaxRetries = 3
+		err := output.Init(conf)
+		c.Assume(err, gs.IsNil)
+		batch := []byte(`{"index":{"_index":"heka","_type":"message"}}` + "\n{}\n")
+
+		c.Specify("retries throttled and failed bulk requests", func() {
+			statuses = []int{429, 503}
+			err := output.indexBatch(batch)
+			c.Expect(err, gs.IsNil)
+			c.Expect(requests, gs.Equals, 3)
+		})
+
+		c.Specify("gives up after max_retries", func() {
+			statuses = []int{500, 500, 500, 500, 500}
+			err := output.indexBatch(batch)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(requests, gs.Equals, 4)
+
+			// The next batch gets a fresh set of retries.
+			requests = 0
+			statuses = []int{502}
+			err = output.indexBatch(batch)
+			c.Expect(err, gs.IsNil)
+			c.Expect(requests, gs.Equals, 2)
+		})
+
+		c.Specify("doesn't retry rejected requests", func() {
+			statuses = []int{400}
+			err := output.indexBatch(batch)
+			c.Expect(err.Error(), gs.Equals, "Bulk response in error: 400 Bad Request")
+			c.Expect(requests, gs.Equals, 1)
+		})
+	})
 }
@@ -27,6 +27,7 @@ func TestAllSpecs(t *testing.T) {
 	r.AddSpec(FileOutputSpec)
 	r.AddSpec(LogfileInputSpec0)
 	r.AddSpec(LogfileInputSpec1)
+	r.AddSpec(LogstreamInputSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -16,14 +16,20 @@
 package file
 
 import (
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	"github.com/mozilla-services/heka/plugins"
 	"github.com/rafrombrc/go-notify"
+	"io"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -36,12 +42,17 @@ var (
 	}
 
 	TSFORMAT = "[2006/Jan/02:15:04:05 -0700] "
+
+	// Matches the suffix `rotatePath` adds to rotated files.
+	rotatedSuffix = regexp.MustCompile(`\.\d{8}-\d{6}(\.\d+)?(\.gz)?$`)
 )
 
 // Output plugin that writes message contents to a file on the file system.
 type FileOutput struct {
 	path          string
 	format        string
+	encoderName   string
+	encoder       Encoder
 	prefix_ts     bool
 	perm          os.FileMode
 	flushInterval uint32
@@ -49,6 +60,21 @@ type FileOutput struct {
 	batchChan     chan []byte
 	backChan      chan []byte
 	folderPerm    os.FileMode
+	// Number of bytes in the currently open file.
+	fileSize         uint64
+	rotationInterval time.Duration
+	maxFileSize      uint64
+	rotationKeep     uint
+	rotationGzip     bool
+	// Set when the path contains message field interpolations.
+	pathTemplate []pathPart
+	maxOpenFiles uint
+	idleTimeout  time.Duration
+	// Registration with the disk watchdog.
+	disk *DiskBudget
+	// Syncs the written files according to the fsync settings.
+	syncer       *fileSyncer
+	writeThrough bool
 }
 
 // ConfigStruct for FileOutput plugin.
@@ -60,6 +86,10 @@ type FileOutputConfig struct {
 	// protobufstream.
 	Format string
 
+	// Name of an encoder plugin used to serialize messages instead of
+	// `format`.
+	Encoder string
+
 	// Add timestamp prefix to each output line?
 	Prefix_ts bool
 
@@ -68,12 +98,48 @@ type FileOutputConfig struct {
 
 	// Interval at which accumulated file data should be written to disk, in
 	// milliseconds (default 1000, i.e. 1 second).
-	FlushInterval uint32
+	FlushInterval uint32 `toml:"flush_interval"`
 
 	// Permissions to apply to directories created for FileOutput's
 	// parent directory if it doesn't exist.  Must be a string
 	// representation of an octal integer. Defaults to "700".
 	FolderPerm string `toml:"folder_perm"`
+
+	// Interval at which the output file is rotated, in seconds. Zero (the
+	// default) disables time based rotation.
+	RotationInterval uint32 `toml:"rotation_interval"`
+
+	// Size in bytes at which the output file is rotated. Zero (the default)
+	// disables size based rotation.
+	MaxFileSize uint64 `toml:"max_file_size"`
+
+	// Number of rotated files to keep around, older files are deleted. Zero
+	// (the default) keeps all of them.
+	RotationKeep uint `toml:"rotation_keep"`
+
+	// Compress rotated files with gzip?
+	RotationGzip bool `toml:"rotation_gzip"`
+
+	// Maximum number of files kept open at once when the path contains
+	// message field interpolations (default 64).
+	MaxOpenFiles uint `toml:"max_open_files"`
+
+	// Time after which an unused file is closed when the path contains
+	// message field interpolations, in seconds (default 300). Zero disables
+	// idle closing.
+	IdleTimeout uint32 `toml:"idle_timeout"`
+
+	// Sync each file to disk after every batch written to it (default true).
+	FsyncOnFlush bool `toml:"fsync_on_flush"`
+
+	// Interval at which the files written to are synced to disk in the
+	// background instead, in milliseconds. Zero (the default) disables
+	// background syncing.
+	FsyncInterval uint32 `toml:"fsync_interval"`
+
+	// Open the files with O_SYNC, so each batch is written to disk by a
+	// single synchronous write rather than a write and an fsync.
+	WriteThrough bool `toml:"write_through"`
 }
 
 func (o *FileOutput) ConfigStruct() interface{} {
@@ -82,6 +148,9 @@ func (o *FileOutput) ConfigStruct() interface{} {
 		Perm:          "644",
 		FlushInterval: 1000,
 		FolderPerm:    "700",
+		MaxOpenFiles:  64,
+		IdleTimeout:   300,
+		FsyncOnFlush:  true,
 	}
 }
 
@@ -94,6 +163,7 @@ func (o *FileOutput) Init(config interface{}) (err error) {
 	}
 	o.path = conf.Path
 	o.format = conf.Format
+	o.encoderName = conf.Encoder
 	o.prefix_ts = conf.Prefix_ts
 	var intPerm int64
 
@@ -110,30 +180,284 @@ func (o *FileOutput) Init(config interface{}) (err error) {
 		return
 	}
 	o.perm = os.FileMode(intPerm)
-	if err = o.openFile(); err != nil {
+
+	if conf.WriteThrough && conf.FsyncInterval > 0 {
+		err = fmt.Errorf("FileOutput '%s' `write_through` and `fsync_interval` can't be used together",
+			o.path)
+		return
+	}
+	o.writeThrough = conf.WriteThrough
+	// Writes through O_SYNC files are already on disk.
+	o.syncer = newFileSyncer(conf.FsyncOnFlush && !o.writeThrough,
+		time.Duration(conf.FsyncInterval)*time.Millisecond)
+
+	if o.pathTemplate, err = parsePathTemplate(o.path); err != nil {
+		err = fmt.Errorf("FileOutput '%s' invalid path: %s", o.path, err)
+		return
+	}
+	if o.pathTemplate != nil {
+		// Files are opened on demand as messages arrive.
+		if conf.MaxOpenFiles == 0 {
+			err = fmt.Errorf("FileOutput '%s' `max_open_files` must be greater than zero",
+				o.path)
+			return
+		}
+		o.maxOpenFiles = conf.MaxOpenFiles
+		o.idleTimeout = time.Duration(conf.IdleTimeout) * time.Second
+	} else if err = o.openFile(); err != nil {
 		err = fmt.Errorf("FileOutput '%s' error opening file: %s", o.path, err)
 		return
 	}
 
 	o.flushInterval = conf.FlushInterval
+	o.rotationInterval = time.Duration(conf.RotationInterval) * time.Second
+	o.maxFileSize = conf.MaxFileSize
+	o.rotationKeep = conf.RotationKeep
+	o.rotationGzip = conf.RotationGzip
 	o.batchChan = make(chan []byte)
 	o.backChan = make(chan []byte, 2) // Never block on the hand-back
 	return
 }
 
 func (o *FileOutput) openFile() (err error) {
-	basePath := filepath.Dir(o.path)
+	o.file, o.fileSize, err = o.openPath(o.path)
+	return
+}
+
+// Opens the file at the given path for appending, creating it and any
+// missing parent directories if necessary. Also returns the current size of
+// the file.
+func (o *FileOutput) openPath(path string) (file *os.File, size uint64, err error) {
+	basePath := filepath.Dir(path)
 	if err = os.MkdirAll(basePath, o.folderPerm); err != nil {
-		return fmt.Errorf("Can't create the basepath for the FileOutput plugin: %s", err.Error())
+		err = fmt.Errorf("Can't create the basepath for the FileOutput plugin: %s", err.Error())
+		return
 	}
 	if err = plugins.CheckWritePermission(basePath); err != nil {
 		return
 	}
-	o.file, err = os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, o.perm)
+	flags := os.O_WRONLY | os.O_APPEND | os.O_CREATE
+	if o.writeThrough {
+		flags |= os.O_SYNC
+	}
+	if file, err = os.OpenFile(path, flags, o.perm); err != nil {
+		return
+	}
+	var info os.FileInfo
+	if info, err = file.Stat(); err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	size = uint64(info.Size())
+	return
+}
+
+// Closes the current output file, rotates it, and opens a fresh output file.
+// If the file can't be moved out of the way or the fresh one can't be opened
+// the output keeps writing to the current file, and the rotation is retried
+// at the next rotation interval or batch.
+func (o *FileOutput) rotate(or OutputRunner) {
+	o.closeFile(or)
+	rotatedPath, err := o.moveRotated(o.path)
+	if err == nil {
+		if err = o.openFile(); err == nil {
+			o.finishRotated(or, o.path, rotatedPath)
+			return
+		}
+		if e := os.Rename(rotatedPath, o.path); e != nil {
+			or.LogError(fmt.Errorf("Can't move %s back: %s", rotatedPath, e))
+		}
+	}
+	or.LogError(fmt.Errorf("Can't rotate %s, still writing to it: %s", o.path, err))
+	if err = o.openFile(); err != nil {
+		or.LogError(fmt.Errorf("Can't reopen %s: %s", o.path, err))
+	}
+}
+
+// Syncs any unsynced writes to the current output file and closes it.
+func (o *FileOutput) closeFile(or OutputRunner) {
+	if err := o.syncer.closing(o.file); err != nil {
+		or.LogError(err)
+	}
+	o.file.Close()
+}
+
+// Moves the (closed) file at path out of the way using a timestamp suffix,
+// compressing it if so configured, and removes any rotated files beyond the
+// `rotation_keep` limit.
+func (o *FileOutput) rotatePath(or OutputRunner, path string) {
+	rotatedPath, err := o.moveRotated(path)
+	if err != nil {
+		or.LogError(fmt.Errorf("Can't rotate %s: %s", path, err))
+		return
+	}
+	o.finishRotated(or, path, rotatedPath)
+}
+
+// Renames the (closed) file at path using a timestamp suffix, returning the
+// new path.
+func (o *FileOutput) moveRotated(path string) (rotatedPath string, err error) {
+	suffix := time.Now().Format("20060102-150405")
+	rotatedPath = fmt.Sprintf("%s.%s", path, suffix)
+	for i := 1; fileExists(rotatedPath) || fileExists(rotatedPath+".gz"); i++ {
+		rotatedPath = fmt.Sprintf("%s.%s.%d", path, suffix, i)
+	}
+	err = os.Rename(path, rotatedPath)
+	return
+}
+
+// Compresses the file rotated away from path if so configured, and removes
+// any rotated files beyond the `rotation_keep` limit.
+func (o *FileOutput) finishRotated(or OutputRunner, path, rotatedPath string) {
+	if o.rotationGzip {
+		if err := gzipFile(rotatedPath, o.perm); err != nil {
+			or.LogError(fmt.Errorf("Can't compress %s: %s", rotatedPath, err))
+		}
+	}
+	o.pruneRotated(or, path)
+}
+
+// Removes the oldest rotated files so at most `rotation_keep` remain.
+func (o *FileOutput) pruneRotated(or OutputRunner, path string) {
+	if o.rotationKeep == 0 {
+		return
+	}
+	matches, err := filepath.Glob(path + ".[0-9]*")
+	if err != nil {
+		or.LogError(fmt.Errorf("Can't list rotated files for %s: %s", path, err))
+		return
+	}
+	if uint(len(matches)) <= o.rotationKeep {
+		return
+	}
+	// Sort oldest first, modification time is more reliable than the name
+	// since the suffix may carry a collision counter.
+	sort.Sort(byModTime(matches))
+	for _, name := range matches[:uint(len(matches))-o.rotationKeep] {
+		if err = os.Remove(name); err != nil {
+			or.LogError(fmt.Errorf("Can't remove rotated file %s: %s", name, err))
+		}
+	}
+}
+
+// Registers the directory the output writes to with the disk watchdog, which
+// may drop the oldest rotated files to keep the directory within budget.
+func (o *FileOutput) watchDisk(or OutputRunner, wd *DiskWatchdog) {
+	var budget uint64
+	if pluginGlobals := or.PluginGlobals(); pluginGlobals != nil {
+		budget = pluginGlobals.DiskBudget
+	}
+	root := o.path
+	if o.pathTemplate != nil {
+		// Everything up to the first interpolation is fixed.
+		root = o.pathTemplate[0].literal
+	}
+	dir := filepath.Dir(root)
+	o.disk = wd.Register(or.Name(), dir, int64(budget), func(need int64) int64 {
+		return o.dropRotated(or, dir, need)
+	})
+}
+
+// Removes rotated output files below dir, oldest first, until at least `need`
+// bytes have been freed. Returns the number of bytes freed.
+func (o *FileOutput) dropRotated(or OutputRunner, dir string, need int64) (freed int64) {
+	var rotated []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || !rotatedSuffix.MatchString(path) {
+			return nil
+		}
+		if o.pathTemplate == nil && !strings.HasPrefix(path, o.path+".") {
+			// Some other file that happens to share the directory.
+			return nil
+		}
+		rotated = append(rotated, path)
+		return nil
+	})
+	sort.Sort(byModTime(rotated))
+	for _, name := range rotated {
+		if freed >= need {
+			break
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		if err = os.Remove(name); err != nil {
+			or.LogError(fmt.Errorf("Can't remove rotated file %s: %s", name, err))
+			continue
+		}
+		or.LogError(fmt.Errorf("Disk budget exceeded, removed rotated file %s", name))
+		freed += info.Size()
+	}
 	return
 }
 
+type byModTime []string
+
+func (b byModTime) Len() int      { return len(b) }
+func (b byModTime) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byModTime) Less(i, j int) bool {
+	var ti, tj time.Time
+	if info, err := os.Stat(b[i]); err == nil {
+		ti = info.ModTime()
+	}
+	if info, err := os.Stat(b[j]); err == nil {
+		tj = info.ModTime()
+	}
+	if ti.Equal(tj) {
+		return b[i] < b[j]
+	}
+	return ti.Before(tj)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Replaces the file at path with a gzip compressed copy named path + ".gz".
+func gzipFile(path string, perm os.FileMode) (err error) {
+	var in, out *os.File
+	if in, err = os.Open(path); err != nil {
+		return
+	}
+	defer in.Close()
+	if out, err = os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC,
+		perm); err != nil {
+		return
+	}
+	gz := gzip.NewWriter(out)
+	if _, err = io.Copy(gz, in); err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return
+	}
+	return os.Remove(path)
+}
+
 func (o *FileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if o.encoderName != "" {
+		var ok bool
+		if o.encoder, ok = h.Encoder(o.encoderName); !ok {
+			return fmt.Errorf("FileOutput '%s' unknown encoder: %s", o.path,
+				o.encoderName)
+		}
+	}
+	if pc := h.PipelineConfig(); pc != nil {
+		o.watchDisk(or, pc.DiskWatchdog())
+		defer o.disk.Close()
+	}
+	o.syncer.start(or)
+	defer o.syncer.stop()
+	if o.pathTemplate != nil {
+		o.fanOut(or)
+		return
+	}
 	var wg sync.WaitGroup
 	wg.Add(2)
 	go o.receiver(or, &wg)
@@ -148,8 +472,10 @@ func (o *FileOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 func (o *FileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 	var pack *PipelinePack
 	var e error
+	var recycler RecycleBatcher
 	ok := true
-	ticker := time.Tick(time.Duration(o.flushInterval) * time.Millisecond)
+	ticker := time.NewTicker(time.Duration(o.flushInterval) * time.Millisecond)
+	defer ticker.Stop()
 	outBatch := make([]byte, 0, 10000)
 	outBytes := make([]byte, 0, 1000)
 	inChan := or.InChan()
@@ -159,6 +485,7 @@ func (o *FileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 		case pack, ok = <-inChan:
 			if !ok {
 				// Closed inChan => we're shutting down, flush data
+				recycler.Flush()
 				if len(outBatch) > 0 {
 					o.batchChan <- outBatch
 				}
@@ -171,11 +498,12 @@ func (o *FileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 				outBatch = append(outBatch, outBytes...)
 			}
 			outBytes = outBytes[:0]
-			pack.Recycle()
-		case <-ticker:
+			recycler.Add(pack, len(inChan))
+		case <-ticker.C:
 			if len(outBatch) > 0 {
 				// This will block until the other side is ready to accept
 				// this batch, freeing us to start on the next one.
+				recycler.Flush()
 				o.batchChan <- outBatch
 				outBatch = <-o.backChan
 			}
@@ -187,6 +515,14 @@ func (o *FileOutput) receiver(or OutputRunner, wg *sync.WaitGroup) {
 // Performs the actual task of extracting data from the pack and writing it
 // into the output buffer in the proper format.
 func (o *FileOutput) handleMessage(pack *PipelinePack, outBytes *[]byte) (err error) {
+	if o.encoder != nil {
+		var output []byte
+		if output, err = o.encoder.Encode(pack); err != nil {
+			return fmt.Errorf("Can't encode message: %s", err)
+		}
+		*outBytes = append(*outBytes, output...)
+		return
+	}
 	if o.prefix_ts && o.format != "protobufstream" {
 		ts := time.Now().Format(TSFORMAT)
 		*outBytes = append(*outBytes, ts...)
@@ -212,6 +548,12 @@ func (o *FileOutput) handleMessage(pack *PipelinePack, outBytes *[]byte) (err er
 	return
 }
 
+// Reports the fsync count and timings.
+func (o *FileOutput) ReportMsg(msg *message.Message) error {
+	o.syncer.ReportMsg(msg)
+	return nil
+}
+
 // Runs in a separate goroutine, waits for buffered data on the committer
 // channel, writes it out to the filesystem, and puts the now empty buffer on
 // the return channel for reuse.
@@ -225,6 +567,13 @@ func (o *FileOutput) committer(or OutputRunner, wg *sync.WaitGroup) {
 	hupChan := make(chan interface{})
 	notify.Start(RELOAD, hupChan)
 
+	var rotateTicker <-chan time.Time
+	if o.rotationInterval > 0 {
+		ticker := time.NewTicker(o.rotationInterval)
+		defer ticker.Stop()
+		rotateTicker = ticker.C
+	}
+
 	for ok {
 		select {
 		case outBatch, ok = <-o.batchChan:
@@ -232,18 +581,37 @@ func (o *FileOutput) committer(or OutputRunner, wg *sync.WaitGroup) {
 				// Channel is closed => we're shutting down, exit cleanly.
 				break
 			}
+			if o.disk != nil {
+				o.disk.Wait()
+			}
+			if o.file == nil {
+				// A failed rotation couldn't reopen the file, try again.
+				if err = o.openFile(); err != nil {
+					or.LogError(fmt.Errorf("Can't reopen %s: %s", o.path, err))
+				}
+			}
 			n, err := o.file.Write(outBatch)
 			if err != nil {
 				or.LogError(fmt.Errorf("Can't write to %s: %s", o.path, err))
 			} else if n != len(outBatch) {
 				or.LogError(fmt.Errorf("Truncated output for %s", o.path))
-			} else {
-				o.file.Sync()
+			} else if err = o.syncer.written(o.file, o.path); err != nil {
+				or.LogError(err)
 			}
+			o.fileSize += uint64(n)
 			outBatch = outBatch[:0]
 			o.backChan <- outBatch
+			if o.maxFileSize > 0 && o.fileSize >= o.maxFileSize {
+				o.rotate(or)
+			}
+		case <-rotateTicker:
+			if o.fileSize == 0 {
+				// Nothing to rotate.
+				break
+			}
+			o.rotate(or)
 		case <-hupChan:
-			o.file.Close()
+			o.closeFile(or)
 			if err = o.openFile(); err != nil {
 				// TODO: Need a way to handle this gracefully, see
 				// https://github.com/mozilla-services/heka/issues/38
@@ -253,7 +621,7 @@ func (o *FileOutput) committer(or OutputRunner, wg *sync.WaitGroup) {
 		}
 	}
 
-	o.file.Close()
+	o.closeFile(or)
 	wg.Done()
 }
 
@@ -261,4 +629,21 @@ func init() {
 	RegisterPlugin("FileOutput", func() interface{} {
 		return new(FileOutput)
 	})
+	RegisterConfigMigration(ConfigMigration{
+		PluginType: "FileOutput",
+		Option:     "flushinterval",
+		Since:      "0.5.0",
+		Advice:     "use flush_interval",
+		RenameTo:   "flush_interval",
+	})
+	RegisterConfigMigration(ConfigMigration{
+		PluginType: "FileOutput",
+		Option:     "format",
+		Since:      "0.5.0",
+		Advice: "set `encoder` to a HekaJsonEncoder (or SandboxEncoder) " +
+			"instead of using format = \"json\"",
+		// Only the JSON format has an encoder to move to. Its output differs
+		// slightly, so the option is reported but left alone.
+		Values: []string{"json"},
+	})
 }
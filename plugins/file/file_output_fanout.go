@@ -0,0 +1,277 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"github.com/rafrombrc/go-notify"
+	"os"
+	"strings"
+	"time"
+)
+
+// A piece of a FileOutput path, either literal text or the name of a message
+// attribute or field to be interpolated, i.e. `%{Hostname}`.
+type pathPart struct {
+	literal string
+	field   string
+}
+
+// Splits a path containing `%{name}` interpolations into its parts. Returns
+// nil if the path doesn't contain any interpolations.
+func parsePathTemplate(path string) (parts []pathPart, err error) {
+	rest := path
+	for {
+		start := strings.Index(rest, "%{")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(rest[start:], "}")
+		if end < 0 {
+			return nil, errors.New("unterminated '%{' in path")
+		}
+		end += start
+		name := rest[start+2 : end]
+		if name == "" {
+			return nil, errors.New("empty '%{}' in path")
+		}
+		if start > 0 {
+			parts = append(parts, pathPart{literal: rest[:start]})
+		}
+		parts = append(parts, pathPart{field: name})
+		rest = rest[end+1:]
+	}
+	if parts != nil && rest != "" {
+		parts = append(parts, pathPart{literal: rest})
+	}
+	return
+}
+
+// Builds the output path for a message from the parsed path template.
+// Interpolated values have path separators replaced so a message can't
+// direct output outside of the configured directory structure.
+func interpolatePath(parts []pathPart, m *message.Message) (path string, err error) {
+	var value string
+	pieces := make([]string, len(parts))
+	for i, part := range parts {
+		if part.field == "" {
+			pieces[i] = part.literal
+			continue
+		}
+		var ok bool
+		if value, ok = plugins.GetMessageVariable(m, part.field); !ok {
+			return "", fmt.Errorf("message has no field '%s'", part.field)
+		}
+		value = strings.Replace(value, string(os.PathSeparator), "_", -1)
+		if value == "" || value == "." || value == ".." {
+			value = "_"
+		}
+		pieces[i] = value
+	}
+	return strings.Join(pieces, ""), nil
+}
+
+// An open output file in the fan out handle cache.
+type fileHandle struct {
+	path     string
+	file     *os.File
+	size     uint64
+	lastUsed time.Time
+	elem     *list.Element
+}
+
+// LRU cache of open output file handles, used when the FileOutput path
+// contains interpolations. The least recently used file is closed when the
+// `max_open_files` limit would be exceeded.
+type fileCache struct {
+	o       *FileOutput
+	handles map[string]*fileHandle
+	// Front is the most recently used handle.
+	lru *list.List
+}
+
+func newFileCache(o *FileOutput) *fileCache {
+	return &fileCache{
+		o:       o,
+		handles: make(map[string]*fileHandle),
+		lru:     list.New(),
+	}
+}
+
+// Returns the open handle for the path, opening the file (and evicting the
+// least recently used handle if necessary) when it isn't already open.
+func (fc *fileCache) get(path string) (h *fileHandle, err error) {
+	if h = fc.handles[path]; h != nil {
+		fc.lru.MoveToFront(h.elem)
+		h.lastUsed = time.Now()
+		return
+	}
+	for uint(len(fc.handles)) >= fc.o.maxOpenFiles {
+		fc.close(fc.lru.Back().Value.(*fileHandle))
+	}
+	h = &fileHandle{path: path, lastUsed: time.Now()}
+	if h.file, h.size, err = fc.o.openPath(path); err != nil {
+		return nil, err
+	}
+	h.elem = fc.lru.PushFront(h)
+	fc.handles[path] = h
+	return
+}
+
+func (fc *fileCache) close(h *fileHandle) {
+	// Like the Close error, a failed sync is ignored as the file goes away.
+	fc.o.syncer.closing(h.file)
+	h.file.Close()
+	fc.lru.Remove(h.elem)
+	delete(fc.handles, h.path)
+}
+
+// Closes every handle that hasn't been used since the cutoff.
+func (fc *fileCache) closeIdle(cutoff time.Time) {
+	for e := fc.lru.Back(); e != nil; {
+		h := e.Value.(*fileHandle)
+		if h.lastUsed.After(cutoff) {
+			break
+		}
+		e = e.Prev()
+		fc.close(h)
+	}
+}
+
+func (fc *fileCache) closeAll() {
+	for _, h := range fc.handles {
+		fc.close(h)
+	}
+}
+
+// Writes the data to the file at path, rotating the file afterwards if it
+// has reached `max_file_size`.
+func (fc *fileCache) write(or OutputRunner, path string, data []byte) {
+	h, err := fc.get(path)
+	if err != nil {
+		or.LogError(fmt.Errorf("Can't open %s: %s", path, err))
+		return
+	}
+	n, err := h.file.Write(data)
+	if err != nil {
+		or.LogError(fmt.Errorf("Can't write to %s: %s", path, err))
+	} else if n != len(data) {
+		or.LogError(fmt.Errorf("Truncated output for %s", path))
+	} else if err = fc.o.syncer.written(h.file, path); err != nil {
+		or.LogError(err)
+	}
+	h.size += uint64(n)
+	if fc.o.maxFileSize > 0 && h.size >= fc.o.maxFileSize {
+		fc.close(h)
+		fc.o.rotatePath(or, path)
+	}
+}
+
+// Rotates every open file that has data in it.
+func (fc *fileCache) rotateAll(or OutputRunner) {
+	for path, h := range fc.handles {
+		if h.size == 0 {
+			continue
+		}
+		fc.close(h)
+		fc.o.rotatePath(or, path)
+	}
+}
+
+// Used instead of the receiver / committer pair when the path contains
+// interpolations. Buffers the serialized messages per destination path and
+// writes each buffer to its file every flush interval.
+func (o *FileOutput) fanOut(or OutputRunner) {
+	var (
+		pack     *PipelinePack
+		path     string
+		e        error
+		idleTick <-chan time.Time
+		rotTick  <-chan time.Time
+	)
+	var recycler RecycleBatcher
+	ok := true
+	cache := newFileCache(o)
+	batches := make(map[string][]byte)
+	outBytes := make([]byte, 0, 1000)
+	inChan := or.InChan()
+	flushTicker := time.NewTicker(time.Duration(o.flushInterval) * time.Millisecond)
+	defer flushTicker.Stop()
+	flushTick := flushTicker.C
+	if o.idleTimeout > 0 {
+		idleTicker := time.NewTicker(o.idleTimeout / 2)
+		defer idleTicker.Stop()
+		idleTick = idleTicker.C
+	}
+	if o.rotationInterval > 0 {
+		rotTicker := time.NewTicker(o.rotationInterval)
+		defer rotTicker.Stop()
+		rotTick = rotTicker.C
+	}
+	hupChan := make(chan interface{})
+	notify.Start(RELOAD, hupChan)
+
+	flush := func() {
+		if o.disk != nil {
+			o.disk.Wait()
+		}
+		for path, batch := range batches {
+			if len(batch) == 0 {
+				// Nothing written to this path since the last flush.
+				delete(batches, path)
+				continue
+			}
+			cache.write(or, path, batch)
+			batches[path] = batch[:0]
+		}
+	}
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			if path, e = interpolatePath(o.pathTemplate, pack.Message); e != nil {
+				or.LogError(fmt.Errorf("Can't interpolate path: %s", e))
+			} else if e = o.handleMessage(pack, &outBytes); e != nil {
+				or.LogError(e)
+			} else {
+				batches[path] = append(batches[path], outBytes...)
+			}
+			outBytes = outBytes[:0]
+			recycler.Add(pack, len(inChan))
+		case <-flushTick:
+			flush()
+		case <-idleTick:
+			cache.closeIdle(time.Now().Add(-o.idleTimeout))
+		case <-rotTick:
+			flush()
+			cache.rotateAll(or)
+		case <-hupChan:
+			// Files will be reopened as needed.
+			cache.closeAll()
+		}
+	}
+
+	recycler.Flush()
+	flush()
+	cache.closeAll()
+}
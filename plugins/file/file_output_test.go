@@ -19,8 +19,10 @@ import (
 	"bytes"
 	"code.google.com/p/gomock/gomock"
 	"code.google.com/p/goprotobuf/proto"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
@@ -188,6 +190,49 @@ func FileOutputSpec(c gs.Context) {
 				c.Expect(string(contents), gs.Equals, outStr)
 			})
 
+			c.Specify("and rotates it when it reaches max_file_size", func() {
+				config.MaxFileSize = uint64(len(outBytes))
+				config.RotationKeep = 1
+				config.RotationGzip = true
+				err := fileOutput.Init(config)
+				defer os.Remove(tmpFilePath)
+				c.Assume(err, gs.IsNil)
+
+				wg.Add(1)
+				go fileOutput.committer(oth.MockOutputRunner, &wg)
+
+				go func() {
+					for i := 0; i < 3; i++ {
+						fileOutput.batchChan <- outBytes
+						_ = <-fileOutput.backChan
+					}
+					close(fileOutput.batchChan)
+				}()
+				wg.Wait()
+
+				rotated, err := filepath.Glob(tmpFilePath + ".*")
+				c.Assume(err, gs.IsNil)
+				for _, name := range rotated {
+					defer os.Remove(name)
+				}
+				c.Expect(len(rotated), gs.Equals, 1)
+				c.Expect(filepath.Ext(rotated[0]), gs.Equals, ".gz")
+
+				gzFile, err := os.Open(rotated[0])
+				c.Assume(err, gs.IsNil)
+				defer gzFile.Close()
+				gz, err := gzip.NewReader(gzFile)
+				c.Assume(err, gs.IsNil)
+				contents, err := ioutil.ReadAll(gz)
+				c.Assume(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, outStr)
+
+				// Every batch filled a file, the current one is fresh.
+				contents, err = ioutil.ReadFile(tmpFilePath)
+				c.Assume(err, gs.IsNil)
+				c.Expect(len(contents), gs.Equals, 0)
+			})
+
 			c.Specify("with different Perm settings", func() {
 				config.Perm = "600"
 				err := fileOutput.Init(config)
@@ -224,5 +269,199 @@ func FileOutputSpec(c gs.Context) {
 				}
 			})
 		})
+
+		c.Specify("syncs the files it writes", func() {
+			outStr := "Write me out to the log file"
+			fsyncCount := func() int64 {
+				msg := new(message.Message)
+				fileOutput.ReportMsg(msg)
+				count, _ := msg.GetFieldValue("FsyncCount")
+				return count.(int64)
+			}
+			commit := func() {
+				wg.Add(1)
+				go fileOutput.committer(oth.MockOutputRunner, &wg)
+				for i := 0; i < 2; i++ {
+					fileOutput.batchChan <- []byte(outStr)
+					<-fileOutput.backChan
+				}
+				close(fileOutput.batchChan)
+				wg.Wait()
+				contents, err := ioutil.ReadFile(tmpFilePath)
+				c.Assume(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, outStr+outStr)
+			}
+
+			c.Specify("after each batch by default", func() {
+				err := fileOutput.Init(config)
+				defer os.Remove(tmpFilePath)
+				c.Assume(err, gs.IsNil)
+				commit()
+				c.Expect(fsyncCount(), gs.Equals, int64(2))
+			})
+
+			c.Specify("not at all with fsync_on_flush off or write_through", func() {
+				config.FsyncOnFlush = false
+				err := fileOutput.Init(config)
+				defer os.Remove(tmpFilePath)
+				c.Assume(err, gs.IsNil)
+				commit()
+				c.Expect(fsyncCount(), gs.Equals, int64(0))
+
+				config.FsyncOnFlush = true
+				config.WriteThrough = true
+				fileOutput = new(FileOutput)
+				err = fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				os.Truncate(tmpFilePath, 0)
+				commit()
+				c.Expect(fsyncCount(), gs.Equals, int64(0))
+			})
+
+			c.Specify("in the background with fsync_interval", func() {
+				config.FsyncInterval = 3600000
+				err := fileOutput.Init(config)
+				defer os.Remove(tmpFilePath)
+				c.Assume(err, gs.IsNil)
+				err = fileOutput.syncer.written(fileOutput.file, tmpFilePath)
+				c.Expect(err, gs.IsNil)
+				c.Expect(fsyncCount(), gs.Equals, int64(0))
+				fileOutput.syncer.syncDirty(oth.MockOutputRunner)
+				c.Expect(fsyncCount(), gs.Equals, int64(1))
+
+				// Unsynced writes are synced when the file is closed.
+				commit()
+				c.Expect(fsyncCount(), gs.Equals, int64(2))
+			})
+
+			c.Specify("but not both in the background and with write_through", func() {
+				config.FsyncInterval = 1000
+				config.WriteThrough = true
+				err := fileOutput.Init(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+
+		c.Specify("drops the oldest rotated files for the disk watchdog", func() {
+			tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			config.Path = filepath.Join(tmpDir, "out.log")
+			err = fileOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			defer fileOutput.file.Close()
+
+			rotated := func(name string, age time.Duration) string {
+				path := filepath.Join(tmpDir, name)
+				err := ioutil.WriteFile(path, make([]byte, 100), 0644)
+				c.Assume(err, gs.IsNil)
+				modTime := time.Now().Add(-age)
+				os.Chtimes(path, modTime, modTime)
+				return path
+			}
+			oldest := rotated("out.log.20140101-000000.gz", 3*time.Hour)
+			older := rotated("out.log.20140101-010000", 2*time.Hour)
+			newest := rotated("out.log.20140101-020000", time.Hour)
+			other := rotated("other.log.20140101-000000", 4*time.Hour)
+
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).Times(2)
+			freed := fileOutput.dropRotated(oth.MockOutputRunner, tmpDir, 150)
+			c.Expect(freed, gs.Equals, int64(200))
+			for _, path := range []string{oldest, older} {
+				_, err = os.Stat(path)
+				c.Expect(os.IsNotExist(err), gs.IsTrue)
+			}
+			for _, path := range []string{newest, other, config.Path} {
+				_, err = os.Stat(path)
+				c.Expect(err, gs.IsNil)
+			}
+		})
+
+		c.Specify("fans messages out by interpolated path", func() {
+			tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			config.Path = filepath.Join(tmpDir, "%{Hostname}", "%{Logger}-%{foo}.log")
+
+			c.Specify("rejects a malformed template", func() {
+				config.Path = filepath.Join(tmpDir, "%{Hostname.log")
+				err := fileOutput.Init(config)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("interpolates message attributes and fields", func() {
+				err := fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				path, err := interpolatePath(fileOutput.pathTemplate, msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(path, gs.Equals, filepath.Join(tmpDir, "my.host.name",
+					"GoSpec-bar.log"))
+
+				msg.SetLogger("../../etc")
+				path, err = interpolatePath(fileOutput.pathTemplate, msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(filepath.Dir(filepath.Dir(path)), gs.Equals, tmpDir)
+
+				config.Path = filepath.Join(tmpDir, "%{missing}.log")
+				err = fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				_, err = interpolatePath(fileOutput.pathTemplate, msg)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("writes each message to its own file", func() {
+				err := fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+
+				pack2 := NewPipelinePack(pConfig.InputRecycleChan())
+				pack2.Message = pipeline_ts.GetTestMessage()
+				pack2.Message.SetHostname("other.host")
+				pack2.Message.SetPayload("other payload")
+
+				fanInChan := make(chan *PipelinePack, 2)
+				fanInChan <- pack
+				fanInChan <- pack2
+				close(fanInChan)
+				oth.MockOutputRunner.EXPECT().InChan().Return(fanInChan)
+				fileOutput.fanOut(oth.MockOutputRunner)
+
+				contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "my.host.name",
+					"GoSpec-bar.log"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, msg.GetPayload())
+				contents, err = ioutil.ReadFile(filepath.Join(tmpDir, "other.host",
+					"GoSpec-bar.log"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, "other payload")
+			})
+
+			c.Specify("limits and expires open file handles", func() {
+				config.MaxOpenFiles = 2
+				err := fileOutput.Init(config)
+				c.Assume(err, gs.IsNil)
+				cache := newFileCache(fileOutput)
+				defer cache.closeAll()
+
+				for _, name := range []string{"a", "b", "c"} {
+					cache.write(oth.MockOutputRunner, filepath.Join(tmpDir, name), []byte(name))
+				}
+				c.Expect(len(cache.handles), gs.Equals, 2)
+				_, ok := cache.handles[filepath.Join(tmpDir, "a")]
+				c.Expect(ok, gs.IsFalse)
+
+				// Reusing "b" makes "c" the least recently used handle.
+				cache.write(oth.MockOutputRunner, filepath.Join(tmpDir, "b"), []byte("b"))
+				cache.write(oth.MockOutputRunner, filepath.Join(tmpDir, "a"), []byte("a"))
+				_, ok = cache.handles[filepath.Join(tmpDir, "c")]
+				c.Expect(ok, gs.IsFalse)
+				contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "b"))
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(contents), gs.Equals, "bb")
+
+				cache.closeIdle(time.Now())
+				c.Expect(len(cache.handles), gs.Equals, 0)
+				c.Expect(cache.lru.Len(), gs.Equals, 0)
+			})
+		})
 	})
 }
@@ -0,0 +1,153 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Applies a FileOutput's fsync policy to the files it writes. A file is
+// either synced after each batch written to it (`fsync_on_flush`), or marked
+// dirty and synced in the background every `fsync_interval`, so the busy
+// disk's fsync latency is kept off the write path. Files are synced before
+// they are closed either way, which acts as a write barrier for rotation.
+type fileSyncer struct {
+	onFlush  bool
+	interval time.Duration
+	// Held while files are synced, so a file isn't closed mid sync.
+	syncLock sync.Mutex
+	lock     sync.Mutex
+	dirty    map[*os.File]string
+	// Number of fsyncs, and their total and longest durations.
+	count    int64
+	total    int64
+	longest  int64
+	stopChan chan bool
+}
+
+func newFileSyncer(onFlush bool, interval time.Duration) *fileSyncer {
+	return &fileSyncer{
+		onFlush:  onFlush,
+		interval: interval,
+		dirty:    make(map[*os.File]string),
+	}
+}
+
+// Syncs the file, recording how long it took.
+func (s *fileSyncer) sync(file *os.File, path string) (err error) {
+	start := time.Now()
+	err = file.Sync()
+	elapsed := int64(time.Since(start))
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.total, elapsed)
+	for {
+		longest := atomic.LoadInt64(&s.longest)
+		if elapsed <= longest ||
+			atomic.CompareAndSwapInt64(&s.longest, longest, elapsed) {
+			break
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("Can't sync %s: %s", path, err)
+	}
+	return
+}
+
+// Called after a batch has been written to the file.
+func (s *fileSyncer) written(file *os.File, path string) error {
+	if s.interval > 0 {
+		s.lock.Lock()
+		s.dirty[file] = path
+		s.lock.Unlock()
+	} else if s.onFlush {
+		return s.sync(file, path)
+	}
+	return nil
+}
+
+// Syncs the file if it has unsynced writes, must be called before the file
+// is closed.
+func (s *fileSyncer) closing(file *os.File) error {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+	s.lock.Lock()
+	path, ok := s.dirty[file]
+	delete(s.dirty, file)
+	s.lock.Unlock()
+	if ok {
+		return s.sync(file, path)
+	}
+	return nil
+}
+
+// Syncs every dirty file.
+func (s *fileSyncer) syncDirty(or OutputRunner) {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+	s.lock.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[*os.File]string)
+	s.lock.Unlock()
+	for file, path := range dirty {
+		if err := s.sync(file, path); err != nil {
+			or.LogError(err)
+		}
+	}
+}
+
+// Starts syncing the dirty files every interval, if one is set.
+func (s *fileSyncer) start(or OutputRunner) {
+	if s.interval <= 0 {
+		return
+	}
+	s.stopChan = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.syncDirty(or)
+			case <-s.stopChan:
+				return
+			}
+		}
+	}()
+}
+
+func (s *fileSyncer) stop() {
+	if s.stopChan != nil {
+		close(s.stopChan)
+		s.stopChan = nil
+	}
+}
+
+func (s *fileSyncer) ReportMsg(msg *message.Message) {
+	count := atomic.LoadInt64(&s.count)
+	var avg int64
+	if count > 0 {
+		avg = atomic.LoadInt64(&s.total) / count
+	}
+	message.NewInt64Field(msg, "FsyncCount", count, "count")
+	message.NewInt64Field(msg, "FsyncAvgDuration", avg, "ns")
+	message.NewInt64Field(msg, "FsyncMaxDuration", atomic.LoadInt64(&s.longest),
+		"ns")
+}
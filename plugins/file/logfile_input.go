@@ -72,6 +72,9 @@ type LogfileInputConfig struct {
 	// String indicating if the delimiter is at the start or end of the line,
 	// only used for regexp delimiters
 	DelimiterLocation string `toml:"delimiter_location"`
+	// Name of a configured splitter used to break the log file up into
+	// messages, takes precedence over ParserType.
+	Splitter string
 }
 
 // Heka Input plugin that reads files from the filesystem, converts each line
@@ -117,6 +120,11 @@ func (lw *LogfileInput) Run(ir InputRunner, h PluginHelper) (err error) {
 		ok      bool
 	)
 	lw.Monitor.ir = ir
+	if lw.Monitor.splitterName != "" {
+		if err = lw.Monitor.setupSplitter(h); err != nil {
+			return
+		}
+	}
 	go lw.Monitor.Watcher()
 
 	for _, msg := range lw.Monitor.pendingMessages {
@@ -181,6 +189,8 @@ type FileMonitor struct {
 
 	parser        StreamParser
 	parseFunction func(fm *FileMonitor, isRotated bool) (bytesRead int64, err error)
+	splitterName  string
+	hasDecoder    bool
 	hostname      string
 }
 
@@ -376,7 +386,7 @@ func payloadParser(fm *FileMonitor, isRotated bool) (bytesRead int64, err error)
 			pack.Message.SetSeverity(int32(0))
 			pack.Message.SetEnvVersion("0.8")
 			pack.Message.SetPid(0)
-			pack.Message.SetHostname(fm.hostname)
+			StampIdentity(pack.Message, fm.hostname)
 			pack.Message.SetLogger(fm.logger_ident)
 			pack.Message.SetPayload(payload)
 			fm.outChan <- pack
@@ -503,15 +513,16 @@ func (fm *FileMonitor) Init(conf *LogfileInputConfig) (err error) {
 	statInterval := conf.StatInterval
 	logger := conf.Logger
 	if conf.Hostname == "" {
-		conf.Hostname, err = os.Hostname()
-		if err != nil {
-			return
-		}
+		conf.Hostname = Globals().Hostname
 	}
 	fm.hostname = conf.Hostname
 
 	fm.resumeFromStart = conf.ResumeFromStart
-	if conf.ParserType == "" || conf.ParserType == "token" {
+	fm.hasDecoder = conf.Decoder != ""
+	if conf.Splitter != "" {
+		// Splitters can't be looked up until the input is running.
+		fm.splitterName = conf.Splitter
+	} else if conf.ParserType == "" || conf.ParserType == "token" {
 		tp := NewTokenParser()
 		fm.parser = tp
 		fm.parseFunction = payloadParser
@@ -582,6 +593,24 @@ func (fm *FileMonitor) Init(conf *LogfileInputConfig) (err error) {
 	return
 }
 
+// Creates the configured splitter and picks the matching parse function.
+func (fm *FileMonitor) setupSplitter(h PluginHelper) (err error) {
+	splitter, ok := h.Splitter(fm.splitterName)
+	if !ok {
+		return fmt.Errorf("Splitter not found: %s", fm.splitterName)
+	}
+	fm.parser = splitter
+	if UsesHekaFraming(splitter) {
+		if !fm.hasDecoder {
+			return fmt.Errorf("The %s splitter must have a decoder", fm.splitterName)
+		}
+		fm.parseFunction = messageProtoParser
+	} else {
+		fm.parseFunction = payloadParser
+	}
+	return
+}
+
 func (fm *FileMonitor) recoverSeekPosition() (err error) {
 	// No seekJournalPath means we're not tracking file location.
 	if fm.seekJournalPath == "" {
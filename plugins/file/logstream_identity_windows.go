@@ -0,0 +1,25 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"os"
+)
+
+// Windows doesn't expose a file's identity through os.FileInfo, so logstream
+// journals fall back to matching on the file name.
+func fileIdentity(fi os.FileInfo) (device, inode uint64) {
+	return 0, 0
+}
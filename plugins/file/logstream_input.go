@@ -0,0 +1,615 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Number of bytes preceding the saved offset that are hashed into the
+// journal, used to verify a file's contents on resume.
+const logstreamHashLength = 1024
+
+// ConfigStruct for LogstreamInput plugin.
+type LogstreamInputConfig struct {
+	// Directory containing the files that make up the logstream.
+	LogDirectory string `toml:"log_directory"`
+	// Glob, relative to `log_directory`, matching every file that belongs
+	// to the logstream.
+	FileMatch string `toml:"file_match"`
+	// Regular expression applied to each matched file name. The first
+	// capture group is used as the file's sort key, compared numerically
+	// when possible. Defaults to `\.(\d+)$`, i.e. a numeric rotation suffix.
+	SortPattern string `toml:"sort_pattern"`
+	// Either "descending" (the default, the file with the highest key is the
+	// oldest and is read first) or "ascending". Files that don't match
+	// `sort_pattern` have the lowest key.
+	SortOrder string `toml:"sort_order"`
+	// Folder in which the read position journals are stored, relative to the
+	// Heka base directory. Defaults to "logstreams".
+	JournalDirectory string `toml:"journal_directory"`
+	// Interval btn reads from the current file, in milliseconds, default 500.
+	StatInterval int `toml:"stat_interval"`
+	// Interval btn checks for new or rotated files, in milliseconds, default
+	// 5000.
+	RescanInterval int `toml:"rescan_interval"`
+	// When no usable journal exists, start at the beginning of the oldest
+	// file (the default) instead of the end of the newest one.
+	ResumeFromStart bool `toml:"resume_from_start"`
+	// Name of configured decoder instance.
+	Decoder string
+	// Hostname to use for the generated messages.
+	Hostname string
+	// Value to use for the `logger` attribute of the generated messages.
+	// Defaults to the plugin name.
+	Logger string
+	// Type of parser used to break the log files up into messages.
+	ParserType string `toml:"parser_type"`
+	// Delimiter used to split the log stream into log messages.
+	Delimiter string
+	// String indicating if the delimiter is at the start or end of the line,
+	// only used for regexp delimiters.
+	DelimiterLocation string `toml:"delimiter_location"`
+	// Name of a configured splitter used to break the log files up into
+	// messages, takes precedence over ParserType.
+	Splitter string
+}
+
+// Position of a logstream as written to its journal. The device and inode
+// let us find the file again after it has been rotated to a new name.
+type logstreamPosition struct {
+	FileName string `json:"file_name"`
+	Device   uint64 `json:"device"`
+	Inode    uint64 `json:"inode"`
+	Seek     int64  `json:"seek"`
+	HashLen  int64  `json:"hash_len"`
+	Hash     string `json:"hash"`
+}
+
+// Heka Input plugin that tails a logstream, i.e. a set of files matched by a
+// glob, such as a log file and its rotated predecessors. Files are read
+// oldest first and the read position is journaled, so a restarted Heka picks
+// up exactly where it left off.
+type LogstreamInput struct {
+	conf        *LogstreamInputConfig
+	name        string
+	glob        string
+	sortPattern *regexp.Regexp
+	descending  bool
+	journalPath string
+	stopChan    chan bool
+	h           PluginHelper
+
+	fd       *os.File
+	position logstreamPosition
+	dirty    bool
+	parser   StreamParser
+	deliver  func(record []byte)
+}
+
+func (li *LogstreamInput) ConfigStruct() interface{} {
+	return &LogstreamInputConfig{
+		SortPattern:      `\.(\d+)$`,
+		SortOrder:        "descending",
+		JournalDirectory: "logstreams",
+		StatInterval:     500,
+		RescanInterval:   5000,
+		ResumeFromStart:  true,
+		ParserType:       "token",
+	}
+}
+
+func (li *LogstreamInput) SetName(name string) {
+	li.name = name
+}
+
+func (li *LogstreamInput) Init(config interface{}) (err error) {
+	conf := config.(*LogstreamInputConfig)
+	li.conf = conf
+	if conf.LogDirectory == "" {
+		return fmt.Errorf("LogstreamInput requires a `log_directory`")
+	}
+	if conf.FileMatch == "" {
+		return fmt.Errorf("LogstreamInput requires a `file_match`")
+	}
+	li.glob = filepath.Join(conf.LogDirectory, conf.FileMatch)
+	if _, err = filepath.Match(li.glob, ""); err != nil {
+		return fmt.Errorf("invalid file_match: %s", err)
+	}
+	if li.sortPattern, err = regexp.Compile(conf.SortPattern); err != nil {
+		return fmt.Errorf("invalid sort_pattern: %s", err)
+	}
+	switch conf.SortOrder {
+	case "", "descending":
+		li.descending = true
+	case "ascending":
+		li.descending = false
+	default:
+		return fmt.Errorf("invalid sort_order: %s", conf.SortOrder)
+	}
+	if conf.Splitter == "" {
+		switch conf.ParserType {
+		case "", "token", "regexp":
+		case "message.proto":
+			if conf.Decoder == "" {
+				return fmt.Errorf("The message.proto parser must have a decoder")
+			}
+		default:
+			return fmt.Errorf("unknown parser type: %s", conf.ParserType)
+		}
+		if _, err = li.newParser(); err != nil {
+			return
+		}
+	}
+	if conf.Hostname == "" {
+		conf.Hostname = Globals().Hostname
+	}
+	if li.name == "" {
+		li.name = "LogstreamInput"
+	}
+	if conf.Logger == "" {
+		conf.Logger = li.name
+	}
+
+	r := strings.NewReplacer(string(os.PathSeparator), "_", ".", "_")
+	li.journalPath = filepath.Join(GetHekaConfigDir(conf.JournalDirectory),
+		r.Replace(li.name)+".json")
+	li.stopChan = make(chan bool)
+	return
+}
+
+// Creates a fresh StreamParser of the configured type.
+func (li *LogstreamInput) newParser() (parser StreamParser, err error) {
+	if li.conf.Splitter != "" {
+		var ok bool
+		if li.h == nil {
+			return nil, fmt.Errorf("Splitter not available before Run")
+		}
+		if parser, ok = li.h.Splitter(li.conf.Splitter); !ok {
+			return nil, fmt.Errorf("Splitter not found: %s", li.conf.Splitter)
+		}
+		if UsesHekaFraming(parser) && li.conf.Decoder == "" {
+			return nil, fmt.Errorf("The %s splitter must have a decoder",
+				li.conf.Splitter)
+		}
+		return
+	}
+	switch li.conf.ParserType {
+	case "", "token":
+		tp := NewTokenParser()
+		switch len(li.conf.Delimiter) {
+		case 0: // use default
+		case 1:
+			tp.SetDelimiter(li.conf.Delimiter[0])
+		default:
+			return nil, fmt.Errorf("invalid delimiter: %s", li.conf.Delimiter)
+		}
+		parser = tp
+	case "regexp":
+		rp := NewRegexpParser()
+		if len(li.conf.Delimiter) > 0 {
+			if err = rp.SetDelimiter(li.conf.Delimiter); err != nil {
+				return
+			}
+		}
+		if err = rp.SetDelimiterLocation(li.conf.DelimiterLocation); err != nil {
+			return
+		}
+		parser = rp
+	case "message.proto":
+		parser = NewMessageProtoParser()
+	}
+	return
+}
+
+// Returns the files currently making up the logstream, oldest first.
+func (li *LogstreamInput) logstreamFiles() (files []string, err error) {
+	var matches []string
+	if matches, err = filepath.Glob(li.glob); err != nil {
+		return
+	}
+	for _, fn := range matches {
+		if fi, err := os.Stat(fn); err == nil && fi.Mode().IsRegular() {
+			files = append(files, fn)
+		}
+	}
+	sort.Sort(&logstreamSorter{files, li.sortPattern, li.descending})
+	return
+}
+
+// Orders logstream files by the key extracted with the sort pattern.
+type logstreamSorter struct {
+	files      []string
+	pattern    *regexp.Regexp
+	descending bool
+}
+
+func (s *logstreamSorter) Len() int      { return len(s.files) }
+func (s *logstreamSorter) Swap(i, j int) { s.files[i], s.files[j] = s.files[j], s.files[i] }
+
+func (s *logstreamSorter) Less(i, j int) bool {
+	cmp := s.compareKeys(filepath.Base(s.files[i]), filepath.Base(s.files[j]))
+	if cmp == 0 {
+		return s.files[i] < s.files[j]
+	}
+	if s.descending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func (s *logstreamSorter) compareKeys(a, b string) int {
+	ma := s.pattern.FindStringSubmatch(a)
+	mb := s.pattern.FindStringSubmatch(b)
+	switch {
+	case len(ma) < 2 && len(mb) < 2:
+		return 0
+	case len(ma) < 2:
+		return -1
+	case len(mb) < 2:
+		return 1
+	}
+	na, errA := strconv.ParseInt(ma[1], 10, 64)
+	nb, errB := strconv.ParseInt(mb[1], 10, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case na < nb:
+			return -1
+		case na > nb:
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case ma[1] < mb[1]:
+		return -1
+	case ma[1] > mb[1]:
+		return 1
+	}
+	return 0
+}
+
+// Loads the journal and opens the file it points at, verifying that the
+// bytes preceding the saved offset haven't changed. Without a usable journal
+// reading starts at either end of the logstream, per `resume_from_start`.
+func (li *LogstreamInput) restorePosition(files []string) (msg string, err error) {
+	var pos logstreamPosition
+	contents, err := ioutil.ReadFile(li.journalPath)
+	if err == nil {
+		if err = json.Unmarshal(contents, &pos); err != nil {
+			return "", fmt.Errorf("can't parse journal %s: %s", li.journalPath, err)
+		}
+		for _, fn := range files {
+			if !li.isJournaledFile(fn, &pos) {
+				continue
+			}
+			if err = li.openFile(fn, 0); err != nil {
+				return
+			}
+			if li.verifyPosition(&pos) {
+				if _, err = li.fd.Seek(pos.Seek, 0); err != nil {
+					return
+				}
+				li.position.Seek = pos.Seek
+				return fmt.Sprintf("Resuming %s at byte pos: %d", fn, pos.Seek), nil
+			}
+			return fmt.Sprintf("Journal mismatch, restarting %s from the start", fn), nil
+		}
+		msg = fmt.Sprintf("Journaled file %s no longer found. ", pos.FileName)
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	err = nil
+
+	if len(files) == 0 {
+		return msg, nil
+	}
+	if li.conf.ResumeFromStart {
+		err = li.openFile(files[0], 0)
+		msg += fmt.Sprintf("Starting at the beginning of %s", files[0])
+	} else {
+		last := files[len(files)-1]
+		if err = li.openFile(last, 0); err != nil {
+			return
+		}
+		if li.position.Seek, err = li.fd.Seek(0, 2); err != nil {
+			return
+		}
+		msg += fmt.Sprintf("Starting at the end of %s [%d]", last, li.position.Seek)
+	}
+	return
+}
+
+// Checks whether fn is the file described by a journal position. The device
+// and inode are authoritative where the platform provides them, otherwise we
+// fall back to the file name.
+func (li *LogstreamInput) isJournaledFile(fn string, pos *logstreamPosition) bool {
+	fi, err := os.Stat(fn)
+	if err != nil {
+		return false
+	}
+	device, inode := fileIdentity(fi)
+	if pos.Inode != 0 || inode != 0 {
+		return device == pos.Device && inode == pos.Inode
+	}
+	return fn == pos.FileName
+}
+
+func (li *LogstreamInput) verifyPosition(pos *logstreamPosition) bool {
+	fi, err := li.fd.Stat()
+	if err != nil || fi.Size() < pos.Seek {
+		return false
+	}
+	hash, hashLen := li.hashBeforeOffset(pos.Seek)
+	return hashLen == pos.HashLen && hash == pos.Hash
+}
+
+// Returns the hex encoded SHA1 of the bytes preceding the given offset in the
+// current file.
+func (li *LogstreamInput) hashBeforeOffset(offset int64) (hash string, hashLen int64) {
+	hashLen = logstreamHashLength
+	if offset < hashLen {
+		hashLen = offset
+	}
+	buf := make([]byte, hashLen)
+	if _, err := li.fd.ReadAt(buf, offset-hashLen); err != nil {
+		return "", 0
+	}
+	return fmt.Sprintf("%x", sha1.Sum(buf)), hashLen
+}
+
+func (li *LogstreamInput) openFile(fn string, seek int64) (err error) {
+	var fd *os.File
+	if fd, err = os.Open(fn); err != nil {
+		return
+	}
+	if _, err = fd.Seek(seek, 0); err != nil {
+		fd.Close()
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = fd.Stat(); err != nil {
+		fd.Close()
+		return
+	}
+	li.closeFile()
+	li.fd = fd
+	li.position = logstreamPosition{FileName: fn, Seek: seek}
+	li.position.Device, li.position.Inode = fileIdentity(fi)
+	li.dirty = true
+	li.parser, err = li.newParser()
+	return
+}
+
+func (li *LogstreamInput) closeFile() {
+	if li.fd != nil {
+		li.fd.Close()
+		li.fd = nil
+	}
+}
+
+// Delivers every complete record between the current position and the end
+// of the current file. Returns an error only for read failures; a truncated
+// file is detected here and read again from the start.
+func (li *LogstreamInput) readRecords() (msg string, err error) {
+	if li.fd == nil {
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = li.fd.Stat(); err != nil {
+		return
+	}
+	if fi.Size() < li.position.Seek {
+		msg = fmt.Sprintf("%s was truncated, restarting from the start",
+			li.position.FileName)
+		if err = li.openFile(li.position.FileName, 0); err != nil {
+			return
+		}
+	}
+
+	var (
+		n      int
+		record []byte
+	)
+	for err == nil {
+		n, record, err = li.parser.Parse(li.fd)
+		if err == io.ErrShortBuffer {
+			err = fmt.Errorf("record exceeded MAX_RECORD_SIZE %d", message.MAX_RECORD_SIZE)
+		}
+		if len(record) > 0 {
+			li.deliver(record)
+		}
+		if n > 0 {
+			li.position.Seek += int64(n)
+			li.dirty = true
+		}
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return
+}
+
+// Moves on to the next file of the logstream once the current one has been
+// rotated away, i.e. a newer file exists or the current one is gone.
+func (li *LogstreamInput) checkRotation() (msg string, err error) {
+	files, err := li.logstreamFiles()
+	if err != nil || len(files) == 0 {
+		return
+	}
+	if li.fd == nil {
+		err = li.openFile(files[0], 0)
+		return fmt.Sprintf("Starting at the beginning of %s", files[0]), err
+	}
+
+	current, next := li.position.FileName, files[len(files)-1]
+	for i, fn := range files {
+		if li.isJournaledFile(fn, &li.position) {
+			if i == len(files)-1 {
+				// Still reading the newest file.
+				return
+			}
+			current, next = fn, files[i+1]
+			break
+		}
+	}
+	// Flush a final unterminated record before leaving the file behind.
+	if record := li.parser.GetRemainingData(); len(record) > 0 {
+		li.deliver(record)
+	}
+	msg = fmt.Sprintf("%s has been rotated, continuing with %s", current, next)
+	err = li.openFile(next, 0)
+	return
+}
+
+// Writes the current read position to the journal. The file is written
+// to a temporary file first so a crash can't leave a truncated journal.
+func (li *LogstreamInput) savePosition() (err error) {
+	if !li.dirty || li.fd == nil {
+		return
+	}
+	li.position.Hash, li.position.HashLen = li.hashBeforeOffset(li.position.Seek)
+	var contents []byte
+	if contents, err = json.Marshal(li.position); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(li.journalPath), 0700); err != nil {
+		return
+	}
+	tmpPath := li.journalPath + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, contents, 0600); err != nil {
+		return
+	}
+	if err = os.Rename(tmpPath, li.journalPath); err == nil {
+		li.dirty = false
+	}
+	return
+}
+
+func (li *LogstreamInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	var (
+		dRunner DecoderRunner
+		ok      bool
+		msg     string
+		files   []string
+	)
+	li.h = h
+	if li.conf.Splitter != "" {
+		// Fail up front rather than on every file.
+		if _, err = li.newParser(); err != nil {
+			return
+		}
+	}
+	if li.conf.Decoder != "" {
+		if dRunner, ok = h.DecoderRunner(li.conf.Decoder); !ok {
+			return fmt.Errorf("Decoder not found: %s", li.conf.Decoder)
+		}
+	}
+	li.deliver = func(record []byte) {
+		pack := <-ir.InChan()
+		if UsesHekaFraming(li.parser) {
+			headerLen := int(record[1]) + 3 // recsep+len+header+unitsep
+			messageLen := len(record) - headerLen
+			if messageLen > cap(pack.MsgBytes) {
+				pack.MsgBytes = make([]byte, messageLen)
+			}
+			pack.MsgBytes = pack.MsgBytes[:messageLen]
+			copy(pack.MsgBytes, record[headerLen:])
+		} else {
+			pack.Message.SetUuid(uuid.NewRandom())
+			pack.Message.SetTimestamp(time.Now().UnixNano())
+			pack.Message.SetType("logfile")
+			pack.Message.SetSeverity(int32(0))
+			pack.Message.SetEnvVersion("0.8")
+			pack.Message.SetPid(0)
+			StampIdentity(pack.Message, li.conf.Hostname)
+			pack.Message.SetLogger(li.conf.Logger)
+			pack.Message.SetPayload(string(record))
+		}
+		if dRunner == nil {
+			ir.Inject(pack)
+		} else {
+			dRunner.InChan() <- pack
+		}
+	}
+
+	if files, err = li.logstreamFiles(); err != nil {
+		return
+	}
+	if msg, err = li.restorePosition(files); err != nil {
+		return
+	}
+	if msg != "" {
+		ir.LogMessage(msg)
+	}
+	defer li.closeFile()
+
+	statTicker := time.Tick(time.Duration(li.conf.StatInterval) * time.Millisecond)
+	rescanTicker := time.Tick(time.Duration(li.conf.RescanInterval) * time.Millisecond)
+	for {
+		select {
+		case <-li.stopChan:
+			if err = li.savePosition(); err != nil {
+				ir.LogError(fmt.Errorf("can't write journal: %s", err))
+			}
+			return nil
+		case <-statTicker:
+			msg, err = li.readRecords()
+		case <-rescanTicker:
+			// Drain the current file before deciding it's been rotated.
+			if msg, err = li.readRecords(); err == nil {
+				if msg != "" {
+					ir.LogMessage(msg)
+				}
+				msg, err = li.checkRotation()
+			}
+		}
+		if msg != "" {
+			ir.LogMessage(msg)
+		}
+		if err != nil {
+			ir.LogError(err)
+			err = nil
+		}
+		if err = li.savePosition(); err != nil {
+			ir.LogError(fmt.Errorf("can't write journal: %s", err))
+			err = nil
+		}
+	}
+}
+
+func (li *LogstreamInput) Stop() {
+	close(li.stopChan)
+}
+
+func init() {
+	RegisterPlugin("LogstreamInput", func() interface{} {
+		return new(LogstreamInput)
+	})
+}
@@ -0,0 +1,259 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package file
+
+import (
+	"code.google.com/p/gomock/gomock"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func LogstreamInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+	tmpDir, tmpErr := ioutil.TempDir("", "hekad-tests-")
+	c.Expect(tmpErr, gs.IsNil)
+	origBaseDir := Globals().BaseDir
+	Globals().BaseDir = tmpDir
+	defer func() {
+		Globals().BaseDir = origBaseDir
+		tmpErr = os.RemoveAll(tmpDir)
+		c.Expect(tmpErr, gs.IsNil)
+	}()
+
+	logDir := filepath.Join(tmpDir, "logs")
+	err := os.MkdirAll(logDir, 0700)
+	c.Expect(err, gs.IsNil)
+
+	writeLog := func(name, contents string) {
+		err := ioutil.WriteFile(filepath.Join(logDir, name), []byte(contents), 0600)
+		c.Expect(err, gs.IsNil)
+	}
+	appendLog := func(name, contents string) {
+		fd, err := os.OpenFile(filepath.Join(logDir, name), os.O_APPEND|os.O_WRONLY, 0600)
+		c.Expect(err, gs.IsNil)
+		_, err = fd.WriteString(contents)
+		c.Expect(err, gs.IsNil)
+		fd.Close()
+	}
+
+	var records []string
+	newInput := func() *LogstreamInput {
+		input := new(LogstreamInput)
+		input.SetName("access")
+		config := input.ConfigStruct().(*LogstreamInputConfig)
+		config.LogDirectory = logDir
+		config.FileMatch = "access.log*"
+		err := input.Init(config)
+		c.Expect(err, gs.IsNil)
+		input.deliver = func(record []byte) {
+			records = append(records, string(record))
+		}
+		return input
+	}
+	// Starts an input, reads everything and journals the position.
+	readAll := func(input *LogstreamInput) {
+		files, err := input.logstreamFiles()
+		c.Expect(err, gs.IsNil)
+		_, err = input.restorePosition(files)
+		c.Expect(err, gs.IsNil)
+		for i := 0; i < len(files); i++ {
+			_, err = input.readRecords()
+			c.Expect(err, gs.IsNil)
+			_, err = input.checkRotation()
+			c.Expect(err, gs.IsNil)
+		}
+		_, err = input.readRecords()
+		c.Expect(err, gs.IsNil)
+		err = input.savePosition()
+		c.Expect(err, gs.IsNil)
+		input.closeFile()
+	}
+
+	c.Specify("A LogstreamInput", func() {
+		records = nil
+
+		c.Specify("orders rotated files oldest first", func() {
+			for _, name := range []string{"access.log", "access.log.1",
+				"access.log.10", "access.log.2"} {
+				writeLog(name, "")
+			}
+			input := newInput()
+			files, err := input.logstreamFiles()
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(files), gs.Equals, 4)
+			c.Expect(filepath.Base(files[0]), gs.Equals, "access.log.10")
+			c.Expect(filepath.Base(files[1]), gs.Equals, "access.log.2")
+			c.Expect(filepath.Base(files[2]), gs.Equals, "access.log.1")
+			c.Expect(filepath.Base(files[3]), gs.Equals, "access.log")
+
+			input.descending = false
+			files, err = input.logstreamFiles()
+			c.Expect(err, gs.IsNil)
+			c.Expect(filepath.Base(files[0]), gs.Equals, "access.log")
+			c.Expect(filepath.Base(files[3]), gs.Equals, "access.log.10")
+		})
+
+		c.Specify("rejects an invalid sort order", func() {
+			input := new(LogstreamInput)
+			config := input.ConfigStruct().(*LogstreamInputConfig)
+			config.LogDirectory = logDir
+			config.FileMatch = "access.log*"
+			config.SortOrder = "sideways"
+			err := input.Init(config)
+			c.Expect(err.Error(), gs.Equals, "invalid sort_order: sideways")
+		})
+
+		c.Specify("reads the whole logstream in order", func() {
+			writeLog("access.log.2", "one\ntwo\n")
+			writeLog("access.log.1", "three\n")
+			writeLog("access.log", "four\n")
+			readAll(newInput())
+			c.Expect(len(records), gs.Equals, 4)
+			c.Expect(records[0], gs.Equals, "one\n")
+			c.Expect(records[3], gs.Equals, "four\n")
+		})
+
+		c.Specify("resumes from the journal after a restart", func() {
+			writeLog("access.log", "one\ntwo\n")
+			readAll(newInput())
+			c.Expect(len(records), gs.Equals, 2)
+
+			appendLog("access.log", "three\n")
+			records = nil
+			readAll(newInput())
+			c.Expect(len(records), gs.Equals, 1)
+			c.Expect(records[0], gs.Equals, "three\n")
+		})
+
+		c.Specify("finds a journaled file after it's been rotated", func() {
+			writeLog("access.log", "one\n")
+			readAll(newInput())
+
+			appendLog("access.log", "two\n")
+			err := os.Rename(filepath.Join(logDir, "access.log"),
+				filepath.Join(logDir, "access.log.1"))
+			c.Expect(err, gs.IsNil)
+			writeLog("access.log", "three\n")
+
+			records = nil
+			readAll(newInput())
+			c.Expect(len(records), gs.Equals, 2)
+			c.Expect(records[0], gs.Equals, "two\n")
+			c.Expect(records[1], gs.Equals, "three\n")
+		})
+
+		c.Specify("follows a file being rotated while it's read", func() {
+			writeLog("access.log", "one\n")
+			input := newInput()
+			files, err := input.logstreamFiles()
+			c.Expect(err, gs.IsNil)
+			_, err = input.restorePosition(files)
+			c.Expect(err, gs.IsNil)
+			_, err = input.readRecords()
+			c.Expect(err, gs.IsNil)
+
+			appendLog("access.log", "unterminated")
+			err = os.Rename(filepath.Join(logDir, "access.log"),
+				filepath.Join(logDir, "access.log.1"))
+			c.Expect(err, gs.IsNil)
+			writeLog("access.log", "two\n")
+
+			_, err = input.readRecords()
+			c.Expect(err, gs.IsNil)
+			msg, err := input.checkRotation()
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg, gs.Equals, filepath.Join(logDir, "access.log.1")+
+				" has been rotated, continuing with "+filepath.Join(logDir, "access.log"))
+			_, err = input.readRecords()
+			c.Expect(err, gs.IsNil)
+			input.closeFile()
+
+			c.Expect(len(records), gs.Equals, 3)
+			c.Expect(records[1], gs.Equals, "unterminated")
+			c.Expect(records[2], gs.Equals, "two\n")
+		})
+
+		c.Specify("starts over when a file is truncated", func() {
+			writeLog("access.log", "one\ntwo\n")
+			input := newInput()
+			files, err := input.logstreamFiles()
+			c.Expect(err, gs.IsNil)
+			_, err = input.restorePosition(files)
+			c.Expect(err, gs.IsNil)
+			_, err = input.readRecords()
+			c.Expect(err, gs.IsNil)
+
+			err = os.Truncate(filepath.Join(logDir, "access.log"), 0)
+			c.Expect(err, gs.IsNil)
+			appendLog("access.log", "new\n")
+			msg, err := input.readRecords()
+			c.Expect(err, gs.IsNil)
+			c.Expect(msg, gs.Equals, filepath.Join(logDir, "access.log")+
+				" was truncated, restarting from the start")
+			input.closeFile()
+
+			c.Expect(len(records), gs.Equals, 3)
+			c.Expect(records[2], gs.Equals, "new\n")
+		})
+
+		c.Specify("injects the records it reads", func() {
+			writeLog("access.log", "one\n")
+			input := new(LogstreamInput)
+			input.SetName("access")
+			config := input.ConfigStruct().(*LogstreamInputConfig)
+			config.LogDirectory = logDir
+			config.FileMatch = "access.log*"
+			config.StatInterval = 5
+			err := input.Init(config)
+			c.Expect(err, gs.IsNil)
+
+			supply := make(chan *PipelinePack, 1)
+			supply <- NewPipelinePack(pConfig.InputRecycleChan())
+			injected := make(chan *PipelinePack, 1)
+			ir := pipelinemock.NewMockInputRunner(ctrl)
+			ir.EXPECT().LogMessage(gomock.Any()).AnyTimes()
+			ir.EXPECT().InChan().Return(supply)
+			ir.EXPECT().Inject(gomock.Any()).Do(func(pack *PipelinePack) {
+				injected <- pack
+			})
+			h := pipelinemock.NewMockPluginHelper(ctrl)
+
+			done := make(chan error)
+			go func() {
+				done <- input.Run(ir, h)
+			}()
+			var pack *PipelinePack
+			select {
+			case pack = <-injected:
+			case <-time.After(time.Second):
+			}
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+			c.Expect(pack, gs.Not(gs.IsNil))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "one\n")
+			c.Expect(pack.Message.GetLogger(), gs.Equals, "access")
+		})
+	})
+}
@@ -18,46 +18,120 @@ package graphite
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	. "github.com/mozilla-services/heka/pipeline"
+	"math"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// Output plugin that sends statmetric messages via TCP
+// Largest payload written to a single UDP datagram, lines are never split
+// across datagrams.
+const carbonMaxDatagramSize = 1400
+
+// A single metric data point parsed from a statmetric message.
+type carbonPoint struct {
+	name string
+	// Kept as received for the plaintext protocol.
+	value     string
+	timestamp int64
+}
+
+// Output plugin that sends statmetric messages to a Carbon daemon over TCP or
+// UDP. Data points are batched, the connection is kept open between batches
+// and reopened, backing off, when writing fails.
 type CarbonOutput struct {
-	address string
+	conf        *CarbonOutputConfig
+	conn        net.Conn
+	retryHelper *RetryHelper
+	// Data points waiting to be written.
+	points []carbonPoint
 }
 
 // ConfigStruct for CarbonOutput plugin.
 type CarbonOutputConfig struct {
-	// String representation of the TCP address to which this output should be
-	// sending data.
+	// String representation of the TCP or UDP address to which this output
+	// should be sending data.
 	Address string
+	// "tcp" or "udp". Defaults to "tcp".
+	Protocol string
+	// Whether to use Carbon's pickle protocol rather than the plaintext one,
+	// TCP only. Defaults to false.
+	Pickle bool
+	// Interval in milliseconds at which the batched data points are written.
+	// Defaults to 1000.
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Number of batched data points that triggers a write. Defaults to 100.
+	FlushCount int `toml:"flush_count"`
+	// Number of times a failed write is retried before the batch is
+	// dropped. -1 retries forever. Defaults to 5.
+	MaxRetries int `toml:"max_retries"`
+	// Delay before the first retry, doubled on every further retry. Defaults
+	// to "250ms".
+	RetryDelay string `toml:"retry_delay"`
+	// Maximum delay between retries. Defaults to "30s".
+	MaxRetryDelay string `toml:"max_retry_delay"`
 }
 
 func (t *CarbonOutput) ConfigStruct() interface{} {
-	return &CarbonOutputConfig{Address: "localhost:2003"}
+	return &CarbonOutputConfig{
+		Address:       "localhost:2003",
+		Protocol:      "tcp",
+		FlushInterval: 1000,
+		FlushCount:    100,
+		MaxRetries:    5,
+		RetryDelay:    "250ms",
+		MaxRetryDelay: "30s",
+	}
 }
 
 func (t *CarbonOutput) Init(config interface{}) (err error) {
-	conf := config.(*CarbonOutputConfig)
-	t.address = conf.Address
+	t.conf = config.(*CarbonOutputConfig)
 
-	_, err = net.ResolveTCPAddr("tcp", t.address)
+	switch t.conf.Protocol {
+	case "tcp":
+		_, err = net.ResolveTCPAddr("tcp", t.conf.Address)
+	case "udp":
+		if t.conf.Pickle {
+			return errors.New("the pickle protocol requires tcp")
+		}
+		_, err = net.ResolveUDPAddr("udp", t.conf.Address)
+	default:
+		return fmt.Errorf("unknown protocol: %s", t.conf.Protocol)
+	}
+	if err != nil {
+		return
+	}
+	if t.conf.FlushInterval == 0 || t.conf.FlushCount <= 0 {
+		return errors.New("flush_interval and flush_count must be greater than zero")
+	}
 
+	if t.retryHelper, err = NewRetryHelper(RetryOptions{
+		MaxDelay:   t.conf.MaxRetryDelay,
+		Delay:      t.conf.RetryDelay,
+		MaxJitter:  t.conf.RetryDelay,
+		MaxRetries: t.conf.MaxRetries,
+	}); err != nil {
+		return fmt.Errorf("Invalid retry settings: %s", err)
+	}
+	t.points = make([]carbonPoint, 0, t.conf.FlushCount)
 	return
 }
 
+// Adds the data points of a statmetric message payload to the batch.
 func (t *CarbonOutput) ProcessPack(pack *PipelinePack, or OutputRunner) {
-	var e error
+	var (
+		timestamp uint64
+		e         error
+	)
 
 	lines := strings.Split(strings.Trim(pack.Message.GetPayload(), " \n"), "\n")
 	pack.Recycle() // Once we've copied the payload we're done w/ the pack.
 
-	clean_statmetrics := make([]string, len(lines))
-	index := 0
 	for _, line := range lines {
 		// `fields` should be "<name> <value> <timestamp>"
 		fields := strings.Fields(line)
@@ -66,7 +140,7 @@ func (t *CarbonOutput) ProcessPack(pack *PipelinePack, or OutputRunner) {
 			continue
 		}
 
-		if _, e = strconv.ParseUint(fields[2], 0, 32); e != nil {
+		if timestamp, e = strconv.ParseUint(fields[2], 0, 32); e != nil {
 			or.LogError(fmt.Errorf("parsing time: %s", e))
 			continue
 		}
@@ -74,42 +148,151 @@ func (t *CarbonOutput) ProcessPack(pack *PipelinePack, or OutputRunner) {
 			or.LogError(fmt.Errorf("parsing value '%s': %s", fields[1], e))
 			continue
 		}
-		clean_statmetrics[index] = line
-		index += 1
+		t.points = append(t.points, carbonPoint{fields[0], fields[1], int64(timestamp)})
 	}
-	clean_statmetrics = clean_statmetrics[:index]
+}
 
-	conn, err := net.Dial("tcp", t.address)
-	if err != nil {
-		or.LogError(fmt.Errorf("Dial failed: %s",
-			err.Error()))
+// Writes the batched data points, retrying until it succeeds or max_retries
+// is exceeded, in which case the batch is dropped.
+func (t *CarbonOutput) flush(or OutputRunner) {
+	if len(t.points) == 0 {
 		return
 	}
-	defer conn.Close()
+	var data []byte
+	if t.conf.Pickle {
+		data = pickleCarbonPoints(t.points)
+	} else {
+		data = plaintextCarbonPoints(t.points)
+	}
 
-	// Stuff each parseable statmetric into a bytebuffer
-	var buffer bytes.Buffer
-	for i := 0; i < len(clean_statmetrics); i++ {
-		buffer.WriteString(clean_statmetrics[i] + "\n")
+	defer t.retryHelper.Reset()
+	for {
+		err := t.write(data)
+		if err == nil {
+			break
+		}
+		or.LogError(err)
+		if t.retryHelper.Wait() != nil {
+			or.LogError(fmt.Errorf("Dropping %d data points: max retries exceeded",
+				len(t.points)))
+			break
+		}
 	}
+	t.points = t.points[:0]
+}
 
-	_, err = conn.Write(buffer.Bytes())
+// Writes the data, (re)connecting first if needed. The connection is closed
+// if the write fails.
+func (t *CarbonOutput) write(data []byte) (err error) {
+	if t.conn == nil {
+		if t.conn, err = net.Dial(t.conf.Protocol, t.conf.Address); err != nil {
+			t.conn = nil
+			return fmt.Errorf("Dial failed: %s", err)
+		}
+	}
+	if t.conf.Protocol == "udp" {
+		err = writeDatagrams(t.conn, data)
+	} else {
+		_, err = t.conn.Write(data)
+	}
 	if err != nil {
-		or.LogError(fmt.Errorf("Write to server failed: %s",
-			err.Error()))
+		t.conn.Close()
+		t.conn = nil
+		return fmt.Errorf("Write to server failed: %s", err)
 	}
+	return
 }
 
-func (t *CarbonOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+// Writes newline separated lines in as few datagrams as possible.
+func writeDatagrams(conn net.Conn, data []byte) (err error) {
+	for len(data) > 0 {
+		size := len(data)
+		if size > carbonMaxDatagramSize {
+			size = bytes.LastIndex(data[:carbonMaxDatagramSize], []byte("\n")) + 1
+			if size == 0 {
+				// A single line over the limit goes out on its own.
+				size = bytes.IndexByte(data, '\n') + 1
+				if size == 0 {
+					size = len(data)
+				}
+			}
+		}
+		if _, err = conn.Write(data[:size]); err != nil {
+			return
+		}
+		data = data[size:]
+	}
+	return
+}
+
+// Encodes the data points using the plaintext protocol, one
+// "<name> <value> <timestamp>" line each.
+func plaintextCarbonPoints(points []carbonPoint) []byte {
+	var buffer bytes.Buffer
+	for _, p := range points {
+		fmt.Fprintf(&buffer, "%s %s %d\n", p.name, p.value, p.timestamp)
+	}
+	return buffer.Bytes()
+}
 
+// Encodes the data points using the pickle protocol, i.e. a 4 byte big
+// endian length header followed by a (protocol 2) pickled list of
+// `(name, (timestamp, value))` tuples.
+func pickleCarbonPoints(points []carbonPoint) []byte {
+	var (
+		pickle bytes.Buffer
+		num    [8]byte
+	)
+	pickle.WriteString("\x80\x02") // PROTO 2
+	pickle.WriteString("](")       // EMPTY_LIST, MARK
+	for _, p := range points {
+		pickle.WriteByte('X') // BINUNICODE
+		binary.LittleEndian.PutUint32(num[:4], uint32(len(p.name)))
+		pickle.Write(num[:4])
+		pickle.WriteString(p.name)
+		pickle.WriteByte('J') // BININT
+		binary.LittleEndian.PutUint32(num[:4], uint32(p.timestamp))
+		pickle.Write(num[:4])
+		value, _ := strconv.ParseFloat(p.value, 64)
+		pickle.WriteByte('G') // BINFLOAT
+		binary.BigEndian.PutUint64(num[:], math.Float64bits(value))
+		pickle.Write(num[:])
+		pickle.WriteString("\x86\x86") // TUPLE2, TUPLE2
+	}
+	pickle.WriteString("e.") // APPENDS, STOP
+
+	data := make([]byte, 4, pickle.Len()+4)
+	binary.BigEndian.PutUint32(data, uint32(pickle.Len()))
+	return append(data, pickle.Bytes()...)
+}
+
+func (t *CarbonOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	var (
 		pack *PipelinePack
+		ok   = true
 	)
+	ticker := time.NewTicker(time.Duration(t.conf.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
 
-	for pack = range or.InChan() {
-		t.ProcessPack(pack, or)
+	for ok {
+		select {
+		case pack, ok = <-or.InChan():
+			if !ok {
+				break
+			}
+			t.ProcessPack(pack, or)
+			if len(t.points) >= t.conf.FlushCount {
+				t.flush(or)
+			}
+		case <-ticker.C:
+			t.flush(or)
+		}
+	}
+	t.flush(or)
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
 	}
-
 	return
 }
 
@@ -118,6 +118,158 @@ func CarbonOutputSpec(c gs.Context) {
 			computed_result := strings.Join(lines, "\n") + "\n"
 			c.Expect(result, gs.Equals, computed_result)
 		})
+
+		// Reads from the connection until `size` bytes have been received.
+		readAll := func(conn net.Conn, size int) string {
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b := make([]byte, 0, size)
+			buf := make([]byte, 1000)
+			for len(b) < size {
+				n, err := conn.Read(buf)
+				b = append(b, buf[:n]...)
+				if err != nil {
+					break
+				}
+			}
+			return string(b)
+		}
+
+		newPack := func(payload string) *PipelinePack {
+			pack := NewPipelinePack(pConfig.InputRecycleChan())
+			pack.Message.SetPayload(payload)
+			return pack
+		}
+
+		var logged []string
+		oth.MockOutputRunner.EXPECT().LogError(gomock.Any()).AnyTimes().Do(
+			func(err error) {
+				logged = append(logged, err.Error())
+			})
+
+		c.Specify("batches the data points of several messages", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			config.Address = ln.Addr().String()
+			config.FlushCount = 6
+			err = carbonOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			carbonOutput.ProcessPack(newPack(strings.Join(lines[:3], "\n")), oth.MockOutputRunner)
+			carbonOutput.ProcessPack(newPack("bogus\n"+strings.Join(lines[3:], "\n")),
+				oth.MockOutputRunner)
+			c.Expect(len(carbonOutput.points), gs.Equals, count)
+			c.Expect(logged[0], gs.Equals, "malformed statmetric line: 'bogus'")
+			go carbonOutput.flush(oth.MockOutputRunner)
+
+			conn, err := ln.Accept()
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			expected := strings.Join(lines, "\n") + "\n"
+			c.Expect(readAll(conn, len(expected)), gs.Equals, expected)
+		})
+
+		c.Specify("retries until the server is available", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			config.Address = ln.Addr().String()
+			ln.Close()
+			config.RetryDelay = "10ms"
+			config.MaxRetryDelay = "20ms"
+			config.MaxRetries = -1
+			err = carbonOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			carbonOutput.ProcessPack(newPack(strings.Join(lines, "\n")), oth.MockOutputRunner)
+
+			done := make(chan bool)
+			go func() {
+				carbonOutput.flush(oth.MockOutputRunner)
+				done <- true
+			}()
+			time.Sleep(50 * time.Millisecond)
+			ln, err = net.Listen("tcp", config.Address)
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			conn, err := ln.Accept()
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			expected := strings.Join(lines, "\n") + "\n"
+			c.Expect(readAll(conn, len(expected)), gs.Equals, expected)
+			<-done
+			c.Expect(len(logged) > 0, gs.IsTrue)
+			c.Expect(logged[0], pipeline_ts.StringContains, "Dial failed")
+			c.Expect(len(carbonOutput.points), gs.Equals, 0)
+		})
+
+		c.Specify("drops the batch once max_retries is exceeded", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			config.Address = ln.Addr().String()
+			ln.Close()
+			config.RetryDelay = "1ms"
+			config.MaxRetries = 1
+			err = carbonOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			carbonOutput.ProcessPack(newPack(strings.Join(lines, "\n")), oth.MockOutputRunner)
+
+			carbonOutput.flush(oth.MockOutputRunner)
+			c.Expect(len(logged), gs.Equals, 3)
+			c.Expect(logged[2], gs.Equals, "Dropping 5 data points: max retries exceeded")
+			c.Expect(len(carbonOutput.points), gs.Equals, 0)
+		})
+
+		c.Specify("sends UDP datagrams", func() {
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer pc.Close()
+			config.Address = pc.LocalAddr().String()
+			config.Protocol = "udp"
+			err = carbonOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			carbonOutput.ProcessPack(newPack(strings.Join(lines, "\n")), oth.MockOutputRunner)
+			carbonOutput.flush(oth.MockOutputRunner)
+
+			pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b := make([]byte, 2000)
+			n, _, err := pc.ReadFrom(b)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(b[:n]), gs.Equals, strings.Join(lines, "\n")+"\n")
+		})
+
+		c.Specify("rejects the pickle protocol over UDP", func() {
+			config.Protocol = "udp"
+			config.Pickle = true
+			err := carbonOutput.Init(config)
+			c.Expect(err.Error(), gs.Equals, "the pickle protocol requires tcp")
+		})
+	})
+
+	c.Specify("Carbon data points", func() {
+		points := []carbonPoint{{"a.b", "2.5", 1400000000}}
+
+		c.Specify("are pickled with a length header", func() {
+			c.Expect(string(pickleCarbonPoints(points)), gs.Equals,
+				"\x00\x00\x00\x1e\x80\x02](X\x03\x00\x00\x00a.bJ\x00NrS"+
+					"G@\x04\x00\x00\x00\x00\x00\x00\x86\x86e.")
+		})
+
+		c.Specify("are split into datagrams on line boundaries", func() {
+			line := strings.Repeat("x", 599) + "\n"
+			client, server := net.Pipe()
+			received := make(chan int, 3)
+			go func() {
+				b := make([]byte, 2000)
+				for i := 0; i < 3; i++ {
+					n, _ := server.Read(b)
+					received <- n
+				}
+			}()
+			err := writeDatagrams(client, []byte(strings.Repeat(line, 5)))
+			c.Expect(err, gs.IsNil)
+			c.Expect(<-received, gs.Equals, 1200)
+			c.Expect(<-received, gs.Equals, 1200)
+			c.Expect(<-received, gs.Equals, 600)
+		})
 	})
 
 }
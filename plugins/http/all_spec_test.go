@@ -23,7 +23,11 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(HttpCheckOutputSpec)
 	r.AddSpec(HttpInputSpec)
+	r.AddSpec(HttpListenInputSpec)
+	r.AddSpec(JsonPollInputSpec)
+	r.AddSpec(TailOutputSpec)
 
 	gospec.MainGoTest(r, t)
 }
@@ -0,0 +1,267 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTP request described by the fields of a check request message.
+type httpCheck struct {
+	name   string
+	url    string
+	method string
+	body   string
+	// Expected response status, any 2xx status if zero.
+	expectedStatus int
+	msgLoopCount   uint
+}
+
+// Outcome of performing an httpCheck.
+type httpCheckResult struct {
+	statusCode   int
+	status       string
+	responseTime float64
+	snippet      string
+	err          error
+}
+
+// Output plugin that performs the HTTP request described by each "check
+// request" message it receives and injects a message with the outcome, so
+// synthetic monitoring can be driven from the config (e.g. a filter emitting
+// check requests on its ticker) and alerted on by other filters.
+type HttpCheckOutput struct {
+	name   string
+	conf   *HttpCheckOutputConfig
+	client *http.Client
+}
+
+// HttpCheckOutput config struct
+type HttpCheckOutputConfig struct {
+	// Request timeout, in seconds. Default is 10.
+	Timeout uint
+	// Number of checks that can be in flight at once. Default is 4.
+	Concurrency uint
+	// Number of bytes of the response body included in the result message's
+	// payload. Default is 256.
+	MaxBodySnippet uint `toml:"max_body_snippet"`
+	// Type of the result messages. Default is "heka.httpcheck.result".
+	ResultType string `toml:"result_type"`
+	// Extra HTTP headers to send with each request.
+	Headers map[string]string
+	// Severity level of successful checks. Default is 6 (information)
+	SuccessSeverity int32 `toml:"success_severity"`
+	// Severity level of failed checks. Default is 1 (alert)
+	ErrorSeverity int32 `toml:"error_severity"`
+}
+
+func (ho *HttpCheckOutput) SetName(name string) {
+	ho.name = name
+}
+
+func (ho *HttpCheckOutput) ConfigStruct() interface{} {
+	return &HttpCheckOutputConfig{
+		Timeout:         uint(10),
+		Concurrency:     uint(4),
+		MaxBodySnippet:  uint(256),
+		ResultType:      "heka.httpcheck.result",
+		SuccessSeverity: int32(6),
+		ErrorSeverity:   int32(1),
+	}
+}
+
+func (ho *HttpCheckOutput) Init(config interface{}) error {
+	ho.conf = config.(*HttpCheckOutputConfig)
+	if ho.conf.Concurrency == 0 {
+		return errors.New("concurrency must be greater than zero")
+	}
+	if ho.conf.ResultType == "" {
+		return errors.New("result_type can't be empty")
+	}
+	ho.client = &http.Client{Timeout: time.Duration(ho.conf.Timeout) * time.Second}
+	return nil
+}
+
+// Extracts the check from a request message. The `Url` field is required,
+// `Method` (default GET), `Body`, `ExpectedStatus` and `CheckName` are
+// optional.
+func newHttpCheck(msg *message.Message) (check *httpCheck, err error) {
+	check = &httpCheck{method: "GET"}
+	var ok bool
+	if check.url, ok = stringField(msg, "Url"); !ok || check.url == "" {
+		return nil, errors.New("check request has no Url field")
+	}
+	if method, ok := stringField(msg, "Method"); ok && method != "" {
+		check.method = strings.ToUpper(method)
+	}
+	check.body, _ = stringField(msg, "Body")
+	check.name, _ = stringField(msg, "CheckName")
+	status, _ := msg.GetFieldValue("ExpectedStatus")
+	switch status := status.(type) {
+	case nil:
+	case int64:
+		check.expectedStatus = int(status)
+	case float64:
+		check.expectedStatus = int(status)
+	default:
+		return nil, fmt.Errorf("invalid ExpectedStatus: %v", status)
+	}
+	return
+}
+
+func stringField(msg *message.Message, name string) (value string, ok bool) {
+	var v interface{}
+	if v, ok = msg.GetFieldValue(name); ok {
+		value, ok = v.(string)
+	}
+	return
+}
+
+func (ho *HttpCheckOutput) perform(check *httpCheck) (result *httpCheckResult) {
+	result = new(httpCheckResult)
+	var body io.Reader
+	if check.body != "" {
+		body = strings.NewReader(check.body)
+	}
+	req, err := http.NewRequest(check.method, check.url, body)
+	if err != nil {
+		result.err = err
+		return
+	}
+	req.Header.Set("User-Agent", "Heka")
+	for name, value := range ho.conf.Headers {
+		req.Header.Set(name, value)
+	}
+
+	start := time.Now()
+	resp, err := ho.client.Do(req)
+	if err != nil {
+		result.responseTime = time.Since(start).Seconds()
+		result.err = err
+		return
+	}
+	snippet, err := ioutil.ReadAll(io.LimitReader(resp.Body,
+		int64(ho.conf.MaxBodySnippet)))
+	if err == nil {
+		// Drain the rest so the connection can be reused.
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	resp.Body.Close()
+	result.responseTime = time.Since(start).Seconds()
+	result.statusCode = resp.StatusCode
+	result.status = resp.Status
+	result.snippet = string(snippet)
+	if err != nil {
+		result.err = fmt.Errorf("can't read response: %s", err)
+		return
+	}
+	if check.expectedStatus != 0 {
+		if resp.StatusCode != check.expectedStatus {
+			result.err = fmt.Errorf("expected status %d, got %s",
+				check.expectedStatus, resp.Status)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		result.err = fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return
+}
+
+func (ho *HttpCheckOutput) populatePack(pack *PipelinePack, check *httpCheck,
+	result *httpCheckResult, or OutputRunner) {
+
+	addField := func(name string, value interface{}, representation string) {
+		if field, err := message.NewField(name, value, representation); err == nil {
+			pack.Message.AddField(field)
+		} else {
+			or.LogError(fmt.Errorf("can't add field: %s", err))
+		}
+	}
+
+	pack.Message.SetType(ho.conf.ResultType)
+	pack.Message.SetLogger(ho.name)
+	pack.Message.SetPayload(result.snippet)
+	if check.name != "" {
+		addField("CheckName", check.name, "")
+	}
+	addField("Url", check.url, "")
+	addField("Method", check.method, "")
+	if result.statusCode != 0 {
+		addField("StatusCode", result.statusCode, "")
+		addField("Status", result.status, "")
+	}
+	addField("ResponseTime", result.responseTime, "s")
+	addField("Success", result.err == nil, "")
+	if result.err != nil {
+		pack.Message.SetSeverity(ho.conf.ErrorSeverity)
+		addField("Error", result.err.Error(), "")
+	} else {
+		pack.Message.SetSeverity(ho.conf.SuccessSeverity)
+	}
+}
+
+func (ho *HttpCheckOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		check *httpCheck
+		wg    sync.WaitGroup
+	)
+	slots := make(chan struct{}, ho.conf.Concurrency)
+
+	for pack := range or.InChan() {
+		check, err = newHttpCheck(pack.Message)
+		if check != nil {
+			check.msgLoopCount = pack.MsgLoopCount
+		}
+		pack.Recycle()
+		if err != nil {
+			or.LogError(err)
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func(check *httpCheck) {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			result := ho.perform(check)
+			resultPack := h.PipelinePack(check.msgLoopCount)
+			if resultPack == nil {
+				or.LogError(fmt.Errorf("exceeded MaxMsgLoops = %d",
+					Globals().MaxMsgLoops))
+				return
+			}
+			ho.populatePack(resultPack, check, result, or)
+			or.Inject(resultPack)
+		}(check)
+	}
+	wg.Wait()
+	return nil
+}
+
+func init() {
+	RegisterPlugin("HttpCheckOutput", func() interface{} {
+		return new(HttpCheckOutput)
+	})
+}
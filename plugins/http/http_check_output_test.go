@@ -0,0 +1,153 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+)
+
+func HttpCheckOutputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			fmt.Fprint(w, "all systems go, nothing to see here")
+		case "/echo":
+			body, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, "%s %s %s", r.Method, r.Header.Get("X-Check"), body)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	newRequest := func(fields map[string]interface{}) *PipelinePack {
+		pack := NewPipelinePack(pConfig.InputRecycleChan())
+		pack.Message.SetType("check.request")
+		for name, value := range fields {
+			field, err := message.NewField(name, value, "")
+			c.Assume(err, gs.IsNil)
+			pack.Message.AddField(field)
+		}
+		return pack
+	}
+
+	c.Specify("An HttpCheckOutput", func() {
+		output := new(HttpCheckOutput)
+		output.SetName("checker")
+		config := output.ConfigStruct().(*HttpCheckOutputConfig)
+		config.Concurrency = 1
+		config.MaxBodySnippet = 12
+		config.Headers = map[string]string{"X-Check": "yes"}
+		err := output.Init(config)
+		c.Assume(err, gs.IsNil)
+
+		inChan := make(chan *PipelinePack, 4)
+		injected := make(chan *PipelinePack, 4)
+		mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+		mockRunner := pipelinemock.NewMockOutputRunner(ctrl)
+		mockRunner.EXPECT().InChan().Return(inChan)
+		mockRunner.EXPECT().LogError(gomock.Any()).AnyTimes()
+		mockRunner.EXPECT().Inject(gomock.Any()).AnyTimes().Do(func(pack *PipelinePack) {
+			injected <- pack
+		})
+
+		run := func(requests ...*PipelinePack) (results []*message.Message) {
+			for _, pack := range requests {
+				mockHelper.EXPECT().PipelinePack(uint(0)).MaxTimes(1).Return(
+					NewPipelinePack(pConfig.InjectRecycleChan()))
+				inChan <- pack
+			}
+			close(inChan)
+			err := output.Run(mockRunner, mockHelper)
+			c.Expect(err, gs.IsNil)
+			close(injected)
+			for pack := range injected {
+				results = append(results, pack.Message)
+			}
+			return
+		}
+
+		c.Specify("injects the result of a successful check", func() {
+			results := run(newRequest(map[string]interface{}{
+				"Url":       server.URL + "/health",
+				"CheckName": "health",
+			}))
+			c.Expect(len(results), gs.Equals, 1)
+			msg := results[0]
+			c.Expect(msg.GetType(), gs.Equals, "heka.httpcheck.result")
+			c.Expect(msg.GetLogger(), gs.Equals, "checker")
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(6))
+			c.Expect(msg.GetPayload(), gs.Equals, "all systems ")
+			value, _ := msg.GetFieldValue("CheckName")
+			c.Expect(value, gs.Equals, "health")
+			value, _ = msg.GetFieldValue("StatusCode")
+			c.Expect(value, gs.Equals, int64(200))
+			value, _ = msg.GetFieldValue("Success")
+			c.Expect(value, gs.Equals, true)
+			_, ok := msg.GetFieldValue("ResponseTime")
+			c.Expect(ok, gs.IsTrue)
+		})
+
+		c.Specify("sends the method, body and headers", func() {
+			results := run(newRequest(map[string]interface{}{
+				"Url":    server.URL + "/echo",
+				"Method": "post",
+				"Body":   "hi",
+			}))
+			c.Expect(len(results), gs.Equals, 1)
+			c.Expect(results[0].GetPayload(), gs.Equals, "POST yes hi")
+		})
+
+		c.Specify("reports failed checks", func() {
+			results := run(newRequest(map[string]interface{}{
+				"Url": server.URL + "/down",
+			}), newRequest(map[string]interface{}{
+				"Url":            server.URL + "/health",
+				"ExpectedStatus": 204,
+			}))
+			c.Expect(len(results), gs.Equals, 2)
+			for _, msg := range results {
+				c.Expect(msg.GetSeverity(), gs.Equals, int32(1))
+				value, _ := msg.GetFieldValue("Success")
+				c.Expect(value, gs.Equals, false)
+			}
+			value, _ := results[0].GetFieldValue("StatusCode")
+			c.Expect(value, gs.Equals, int64(503))
+			value, _ = results[1].GetFieldValue("Error")
+			c.Expect(value, gs.Equals, "expected status 204, got 200 OK")
+		})
+
+		c.Specify("skips requests without a url", func() {
+			results := run(newRequest(map[string]interface{}{"Method": "GET"}))
+			c.Expect(len(results), gs.Equals, 0)
+		})
+	})
+}
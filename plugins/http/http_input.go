@@ -61,6 +61,11 @@ type HttpInputConfig struct {
 	SuccessSeverity int32 `toml:"success_severity"`
 	// Severity level of errors and unsuccessful GETs. Default is 1 (alert)
 	ErrorSeverity int32 `toml:"error_severity"`
+	// Extra request headers, e.g. for API tokens.
+	Headers map[string]string
+	// Credentials for HTTP basic auth, not used if the username is empty.
+	Username string
+	Password string
 }
 
 func (hi *HttpInput) SetName(name string) {
@@ -93,6 +98,9 @@ func (hi *HttpInput) Init(config interface{}) error {
 	hi.stopChan = make(chan bool)
 	hi.Monitor = new(HttpInputMonitor)
 	hi.Monitor.Init(hi.urls, hi.respChan, hi.errChan, hi.stopChan)
+	hi.Monitor.headers = hi.conf.Headers
+	hi.Monitor.username = hi.conf.Username
+	hi.Monitor.password = hi.conf.Password
 
 	return nil
 }
@@ -127,7 +135,7 @@ func (hi *HttpInput) Run(ir InputRunner, h PluginHelper) (err error) {
 			pack.Message.SetUuid(uuid.NewRandom())
 			pack.Message.SetTimestamp(time.Now().UnixNano())
 			pack.Message.SetType("heka.httpinput.data")
-			pack.Message.SetHostname(hostname)
+			StampIdentity(pack.Message, hostname)
 			pack.Message.SetPayload(string(data.ResponseData))
 			if data.StatusCode != 200 {
 				pack.Message.SetSeverity(hi.conf.ErrorSeverity)
@@ -196,6 +204,10 @@ type HttpInputMonitor struct {
 	errChan  chan *MonitorResponse
 	stopChan chan bool
 
+	headers  map[string]string
+	username string
+	password string
+
 	ir       InputRunner
 	tickChan <-chan time.Time
 }
@@ -222,8 +234,17 @@ func (hm *HttpInputMonitor) Monitor(ir InputRunner) {
 				// Request URL(s)
 				httpClient := &http.Client{}
 				req, err := http.NewRequest("GET", url, nil)
-				req.Header.Add("User-Agent", "Heka")
-				resp, err := httpClient.Do(req)
+				var resp *http.Response
+				if err == nil {
+					req.Header.Add("User-Agent", "Heka")
+					for name, value := range hm.headers {
+						req.Header.Set(name, value)
+					}
+					if hm.username != "" {
+						req.SetBasicAuth(hm.username, hm.password)
+					}
+					resp, err = httpClient.Do(req)
+				}
 
 				responseTime := time.Since(responseTimeStart)
 				if err != nil {
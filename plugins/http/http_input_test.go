@@ -17,11 +17,14 @@ package http
 
 import (
 	"code.google.com/p/gomock/gomock"
+	"encoding/base64"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	"github.com/mozilla-services/heka/pipelinemock"
 	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
 	"runtime"
 	"time"
 )
@@ -129,4 +132,40 @@ func HttpInputSpec(c gs.Context) {
 		runtime.Gosched() // Yield so the stop can happen before we return.
 
 	})
+
+	c.Specify("A HttpInput with headers and credentials", func() {
+		var received *http.Request
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, req *http.Request) {
+				received = req
+			}))
+		defer server.Close()
+
+		httpInput := HttpInput{}
+		config := httpInput.ConfigStruct().(*HttpInputConfig)
+		config.Url = server.URL
+		config.Headers = map[string]string{"X-Api-Token": "abc"}
+		config.Username = "heka"
+		config.Password = "secret"
+		err := httpInput.Init(config)
+		c.Assume(err, gs.IsNil)
+
+		ir := pipelinemock.NewMockInputRunner(ctrl)
+		tickChan := make(chan time.Time)
+		ir.EXPECT().LogMessage(gomock.Any()).Times(2)
+		ir.EXPECT().Ticker().Return(tickChan)
+		done := make(chan bool)
+		go func() {
+			httpInput.Monitor.Monitor(ir)
+			close(done)
+		}()
+		tickChan <- time.Now()
+		<-httpInput.respChan
+		httpInput.Stop()
+		<-done
+
+		c.Expect(received.Header.Get("X-Api-Token"), gs.Equals, "abc")
+		c.Expect(received.Header.Get("Authorization"), gs.Equals,
+			"Basic "+base64.StdEncoding.EncodeToString([]byte("heka:secret")))
+	})
 }
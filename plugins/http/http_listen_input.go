@@ -16,6 +16,9 @@ package http
 
 import (
 	"code.google.com/p/go-uuid/uuid"
+	"code.google.com/p/goprotobuf/proto"
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
@@ -24,9 +27,13 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
 	"time"
 )
 
+// Request header carrying the token that identifies the sender's tenant.
+const TENANT_TOKEN_HEADER = "X-Heka-Tenant-Token"
+
 type HttpListenInput struct {
 	conf        *HttpListenInputConfig
 	listener    net.Listener
@@ -35,6 +42,7 @@ type HttpListenInput struct {
 	dRunner     DecoderRunner
 	pConfig     *PipelineConfig
 	decoderName string
+	filter      *AddressFilter
 }
 
 // HTTP Listen Input config struct
@@ -45,25 +53,110 @@ type HttpListenInputConfig struct {
 	// Name of configured decoder instance used to decode the messages.
 	// Defaults to request body as payload.
 	Decoder string
+	// Credentials requests must supply with HTTP basic auth. Authentication
+	// is disabled if the username is empty.
+	Username string
+	Password string
+	// Largest request body accepted, in bytes. Defaults to MAX_MESSAGE_SIZE,
+	// 0 disables the limit.
+	MaxBodySize int64 `toml:"max_body_size"`
+	// CIDR ranges or IPs whose connections are accepted, all if empty.
+	Allow []string
+	// CIDR ranges or IPs that are rejected, takes precedence over Allow.
+	Deny []string
 }
 
 func (hli *HttpListenInput) ConfigStruct() interface{} {
 	return &HttpListenInputConfig{
-		Address: "127.0.0.1:8325",
+		Address:     "127.0.0.1:8325",
+		MaxBodySize: message.MAX_MESSAGE_SIZE,
+	}
+}
+
+// Returns whether the request carries the configured basic auth credentials.
+func (hli *HttpListenInput) authorized(req *http.Request) bool {
+	if hli.conf.Username == "" {
+		return true
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len("Basic "):])
+	if err != nil {
+		return false
+	}
+	expected := hli.conf.Username + ":" + hli.conf.Password
+	return subtle.ConstantTimeCompare(decoded, []byte(expected)) == 1
+}
+
+// Sets the tenant of the request's message from its tenant token header or
+// the address it came from.
+func (hli *HttpListenInput) tagTenant(pack *PipelinePack, req *http.Request) {
+	var addr net.Addr
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", req.RemoteAddr); err == nil {
+		addr = tcpAddr
 	}
+	TagTenant(hli.ir, pack, req.Header.Get(TENANT_TOKEN_HEADER), addr)
 }
 
 func (hli *HttpListenInput) RequestHandler(w http.ResponseWriter, req *http.Request) {
+	if !hli.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="heka"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 
+	if hli.conf.MaxBodySize > 0 {
+		req.Body = http.MaxBytesReader(w, req.Body, hli.conf.MaxBodySize)
+	}
 	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
 	if err != nil {
-		fmt.Errorf("[HttpListenInput] Read HTTP request body fail: %s\n", err.Error())
+		if hli.conf.MaxBodySize > 0 && int64(len(body)) >= hli.conf.MaxBodySize {
+			http.Error(w, fmt.Sprintf("request body exceeds %d bytes",
+				hli.conf.MaxBodySize), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "can't read request body", http.StatusBadRequest)
+		}
+		return
 	}
-	req.Body.Close()
 
-	unEscapedBody, _ := url.QueryUnescape(string(body))
+	contentType := req.Header.Get("Content-Type")
+	if i := strings.Index(contentType, ";"); i >= 0 {
+		contentType = contentType[:i]
+	}
+	contentType = strings.TrimSpace(strings.ToLower(contentType))
 
 	pack := <-hli.ir.InChan()
+
+	// Protobuf bodies are complete Heka messages, they bypass the decoder.
+	if contentType == "application/x-protobuf" {
+		if err = proto.Unmarshal(body, pack.Message); err != nil {
+			pack.Recycle()
+			http.Error(w, fmt.Sprintf("invalid message: %s", err),
+				http.StatusBadRequest)
+			return
+		}
+		if pack.Message.GetUuid() == nil {
+			pack.Message.SetUuid(uuid.NewRandom())
+		}
+		if pack.Message.Timestamp == nil {
+			pack.Message.SetTimestamp(time.Now().UnixNano())
+		}
+		hli.tagTenant(pack, req)
+		JournalPack(hli.ir, pack, nil)
+		hli.ir.Inject(pack)
+		return
+	}
+
+	payload := string(body)
+	if contentType == "application/x-www-form-urlencoded" {
+		if unescaped, err := url.QueryUnescape(payload); err == nil {
+			payload = unescaped
+		}
+	}
+
 	pack.Message.SetUuid(uuid.NewRandom())
 	pack.Message.SetTimestamp(time.Now().UnixNano())
 	pack.Message.SetType("heka.httpdata.request")
@@ -71,7 +164,7 @@ func (hli *HttpListenInput) RequestHandler(w http.ResponseWriter, req *http.Requ
 	pack.Message.SetHostname(req.RemoteAddr)
 	pack.Message.SetPid(int32(os.Getpid()))
 	pack.Message.SetSeverity(int32(6))
-	pack.Message.SetPayload(unEscapedBody)
+	pack.Message.SetPayload(payload)
 	if field, err := message.NewField("Protocol", req.Proto, ""); err == nil {
 		pack.Message.AddField(field)
 	} else {
@@ -88,6 +181,8 @@ func (hli *HttpListenInput) RequestHandler(w http.ResponseWriter, req *http.Requ
 		hli.ir.LogError(fmt.Errorf("can't add field: %s", err))
 	}
 
+	hli.tagTenant(pack, req)
+	JournalPack(hli.ir, pack, hli.dRunner)
 	if hli.dRunner == nil {
 		hli.ir.Inject(pack)
 	} else {
@@ -101,7 +196,8 @@ func (hli *HttpListenInput) Init(config interface{}) (err error) {
 	hli.conf = config.(*HttpListenInputConfig)
 	hli.decoderName = hli.conf.Decoder
 
-	return nil
+	hli.filter, err = NewAddressFilter(hli.conf.Allow, hli.conf.Deny)
+	return
 }
 
 func (hli *HttpListenInput) Run(ir InputRunner, h PluginHelper) (err error) {
@@ -125,6 +221,9 @@ func (hli *HttpListenInput) Run(ir InputRunner, h PluginHelper) (err error) {
 		hli.ir.LogMessage(fmt.Sprintf("[HttpListenInput (%s)] Listening.",
 			hli.conf.Address))
 	}
+	if hli.filter != nil {
+		hli.listener = hli.filter.Listener(hli.listener)
+	}
 
 	hliEndpointMux.HandleFunc("/", hli.RequestHandler)
 	err = http.Serve(hli.listener, hliEndpointMux)
@@ -142,6 +241,15 @@ func (hli *HttpListenInput) Stop() {
 	close(hli.stopChan)
 }
 
+// Reports the connections rejected by the allow and deny lists.
+func (hli *HttpListenInput) ReportMsg(msg *message.Message) error {
+	if hli.filter != nil {
+		message.NewInt64Field(msg, "RejectedConnections", hli.filter.Rejected(),
+			"count")
+	}
+	return nil
+}
+
 func init() {
 	RegisterPlugin("HttpListenInput", func() interface{} {
 		return new(HttpListenInput)
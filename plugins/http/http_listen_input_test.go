@@ -0,0 +1,143 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"code.google.com/p/gomock/gomock"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+func HttpListenInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("A HttpListenInput", func() {
+		input := new(HttpListenInput)
+		config := input.ConfigStruct().(*HttpListenInputConfig)
+		ir := pipelinemock.NewMockInputRunner(ctrl)
+		input.ir = ir
+
+		pack := NewPipelinePack(pConfig.InputRecycleChan())
+		packSupply := make(chan *PipelinePack, 1)
+		packSupply <- pack
+		var injected *PipelinePack
+
+		expectInject := func() {
+			ir.EXPECT().InChan().Return(packSupply)
+			ir.EXPECT().Name().Return("HttpListenInput").AnyTimes()
+			ir.EXPECT().Inject(gomock.Any()).Do(func(p *PipelinePack) {
+				injected = p
+			})
+		}
+
+		post := func(body, contentType string) *httptest.ResponseRecorder {
+			req, err := http.NewRequest("POST", "http://localhost/",
+				strings.NewReader(body))
+			c.Assume(err, gs.IsNil)
+			req.Header.Set("Content-Type", contentType)
+			if config.Username != "" {
+				req.SetBasicAuth("heka", "secret")
+			}
+			w := httptest.NewRecorder()
+			input.RequestHandler(w, req)
+			return w
+		}
+
+		c.Specify("uses raw and JSON bodies as the payload", func() {
+			c.Assume(input.Init(config), gs.IsNil)
+			expectInject()
+			body := `{"event": "push%20tag"}`
+			w := post(body, "application/json; charset=utf-8")
+			c.Expect(w.Code, gs.Equals, http.StatusOK)
+			c.Assume(injected, gs.Not(gs.IsNil))
+			c.Expect(injected.Message.GetPayload(), gs.Equals, body)
+			c.Expect(injected.Message.GetType(), gs.Equals, "heka.httpdata.request")
+		})
+
+		c.Specify("unescapes form encoded bodies", func() {
+			c.Assume(input.Init(config), gs.IsNil)
+			expectInject()
+			post("a%20b", "application/x-www-form-urlencoded")
+			c.Assume(injected, gs.Not(gs.IsNil))
+			c.Expect(injected.Message.GetPayload(), gs.Equals, "a b")
+		})
+
+		c.Specify("injects protobuf encoded messages", func() {
+			c.Assume(input.Init(config), gs.IsNil)
+			msg := new(message.Message)
+			msg.SetUuid(uuid.NewRandom())
+			msg.SetTimestamp(1234)
+			msg.SetType("webhook")
+			msg.SetPayload("hello")
+			encoded, err := proto.Marshal(msg)
+			c.Assume(err, gs.IsNil)
+
+			expectInject()
+			w := post(string(encoded), "application/x-protobuf")
+			c.Expect(w.Code, gs.Equals, http.StatusOK)
+			c.Assume(injected, gs.Not(gs.IsNil))
+			c.Expect(injected.Message.GetType(), gs.Equals, "webhook")
+			c.Expect(injected.Message.GetPayload(), gs.Equals, "hello")
+			c.Expect(injected.Message.GetTimestamp(), gs.Equals, int64(1234))
+		})
+
+		c.Specify("rejects invalid protobuf messages", func() {
+			c.Assume(input.Init(config), gs.IsNil)
+			ir.EXPECT().InChan().Return(packSupply)
+			w := post("\xff\xff\xff", "application/x-protobuf")
+			c.Expect(w.Code, gs.Equals, http.StatusBadRequest)
+		})
+
+		c.Specify("rejects bodies over max_body_size", func() {
+			config.MaxBodySize = 4
+			c.Assume(input.Init(config), gs.IsNil)
+			w := post("too long", "text/plain")
+			c.Expect(w.Code, gs.Equals, http.StatusRequestEntityTooLarge)
+		})
+
+		c.Specify("with basic auth", func() {
+			config.Username = "heka"
+			config.Password = "secret"
+			c.Assume(input.Init(config), gs.IsNil)
+
+			c.Specify("accepts the configured credentials", func() {
+				expectInject()
+				w := post("payload", "text/plain")
+				c.Expect(w.Code, gs.Equals, http.StatusOK)
+				c.Expect(injected.Message.GetPayload(), gs.Equals, "payload")
+			})
+
+			c.Specify("rejects other credentials", func() {
+				config.Password = "other"
+				w := post("payload", "text/plain")
+				c.Expect(w.Code, gs.Equals, http.StatusUnauthorized)
+				c.Expect(w.Header().Get("WWW-Authenticate"), gs.Equals,
+					`Basic realm="heka"`)
+			})
+		})
+	})
+}
@@ -0,0 +1,240 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins/payload"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Result of polling a single URL.
+type jsonPollResult struct {
+	url          string
+	statusCode   int
+	responseTime float64
+	// Extracted values keyed by field name.
+	values map[string]interface{}
+	err    error
+}
+
+// Input plugin that periodically GETs a set of JSON returning HTTP endpoints
+// (e.g. Jolokia or application health checks) and turns selected values from
+// the responses into message fields.
+type JsonPollInput struct {
+	name     string
+	conf     *JsonPollInputConfig
+	client   *http.Client
+	stopChan chan bool
+}
+
+// JsonPollInput config struct
+type JsonPollInputConfig struct {
+	// Urls to GET.
+	Urls []string
+	// Maps message field names to JSONPath expressions, i.e.
+	// `HeapUsed = "$.value.HeapMemoryUsage.used"`.
+	JsonMap map[string]string `toml:"json_map"`
+	// Extra HTTP headers to send with each request.
+	Headers map[string]string
+	// Interval at which the urls are polled. Default is 10 seconds.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Request timeout, in seconds. Default is 5.
+	Timeout uint
+	// Severity level of successful polls. Default is 6 (information)
+	SuccessSeverity int32 `toml:"success_severity"`
+	// Severity level of failed polls. Default is 1 (alert)
+	ErrorSeverity int32 `toml:"error_severity"`
+}
+
+func (ji *JsonPollInput) SetName(name string) {
+	ji.name = name
+}
+
+func (ji *JsonPollInput) ConfigStruct() interface{} {
+	return &JsonPollInputConfig{
+		TickerInterval:  uint(10),
+		Timeout:         uint(5),
+		SuccessSeverity: int32(6),
+		ErrorSeverity:   int32(1),
+	}
+}
+
+func (ji *JsonPollInput) Init(config interface{}) error {
+	ji.conf = config.(*JsonPollInputConfig)
+	if len(ji.conf.Urls) == 0 {
+		return errors.New("urls must contain at least one URL")
+	}
+	if len(ji.conf.JsonMap) == 0 {
+		return errors.New("json_map must contain at least one field")
+	}
+	if ji.conf.TickerInterval == 0 {
+		return errors.New("ticker_interval must be greater than zero")
+	}
+	ji.client = &http.Client{Timeout: time.Duration(ji.conf.Timeout) * time.Second}
+	ji.stopChan = make(chan bool)
+	return nil
+}
+
+// Converts a JSON value into something that can be stored in a message
+// field. Objects and arrays are stored as their JSON text.
+func jsonFieldValue(v interface{}) (value interface{}, err error) {
+	switch v := v.(type) {
+	case json.Number:
+		return v.Float64()
+	case string, bool:
+		return v, nil
+	case nil:
+		return "", nil
+	default:
+		var b []byte
+		if b, err = json.Marshal(v); err != nil {
+			return
+		}
+		return string(b), nil
+	}
+}
+
+func (ji *JsonPollInput) poll(url string) (result *jsonPollResult) {
+	result = &jsonPollResult{url: url}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		result.err = err
+		return
+	}
+	for name, value := range ji.conf.Headers {
+		req.Header.Set(name, value)
+	}
+
+	start := time.Now()
+	resp, err := ji.client.Do(req)
+	if err != nil {
+		result.err = err
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	result.responseTime = time.Since(start).Seconds()
+	result.statusCode = resp.StatusCode
+	if err != nil {
+		result.err = fmt.Errorf("can't read response: %s", err)
+		return
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		result.err = fmt.Errorf("unexpected response status: %s", resp.Status)
+		return
+	}
+
+	jp := new(payload.JsonPath)
+	if err = jp.SetJsonText(string(body)); err != nil {
+		result.err = fmt.Errorf("invalid JSON response: %s", err)
+		return
+	}
+	result.values = make(map[string]interface{})
+	for name, path := range ji.conf.JsonMap {
+		// Missing values are left out of the message.
+		if v, err := jp.FindValue(path); err == nil {
+			if result.values[name], err = jsonFieldValue(v); err != nil {
+				delete(result.values, name)
+			}
+		}
+	}
+	return
+}
+
+func (ji *JsonPollInput) pollAll() []*jsonPollResult {
+	results := make([]*jsonPollResult, len(ji.conf.Urls))
+	var wg sync.WaitGroup
+	for i, url := range ji.conf.Urls {
+		wg.Add(1)
+		go func(i int, url string) {
+			results[i] = ji.poll(url)
+			wg.Done()
+		}(i, url)
+	}
+	wg.Wait()
+	return results
+}
+
+func (ji *JsonPollInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	var pack *PipelinePack
+
+	hostname := h.PipelineConfig().Hostname()
+	packSupply := ir.InChan()
+	ticker := ir.Ticker()
+
+	for {
+		select {
+		case <-ticker:
+			for _, result := range ji.pollAll() {
+				pack = <-packSupply
+				ji.populatePack(pack, result, hostname, ir)
+				ir.Inject(pack)
+			}
+		case <-ji.stopChan:
+			return
+		}
+	}
+}
+
+func (ji *JsonPollInput) populatePack(pack *PipelinePack, result *jsonPollResult,
+	hostname string, ir InputRunner) {
+
+	addField := func(name string, value interface{}, representation string) {
+		if field, err := message.NewField(name, value, representation); err == nil {
+			pack.Message.AddField(field)
+		} else {
+			ir.LogError(fmt.Errorf("can't add field: %s", err))
+		}
+	}
+
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	StampIdentity(pack.Message, hostname)
+	pack.Message.SetLogger(result.url)
+	if result.err != nil {
+		pack.Message.SetType("heka.jsonpoll.error")
+		pack.Message.SetSeverity(ji.conf.ErrorSeverity)
+		pack.Message.SetPayload(result.err.Error())
+	} else {
+		pack.Message.SetType("heka.jsonpoll.data")
+		pack.Message.SetSeverity(ji.conf.SuccessSeverity)
+		for name, value := range result.values {
+			addField(name, value, "")
+		}
+	}
+	if result.statusCode != 0 {
+		addField("StatusCode", result.statusCode, "")
+		addField("ResponseTime", result.responseTime, "s")
+	}
+}
+
+func (ji *JsonPollInput) Stop() {
+	close(ji.stopChan)
+}
+
+func init() {
+	RegisterPlugin("JsonPollInput", func() interface{} {
+		return new(JsonPollInput)
+	})
+}
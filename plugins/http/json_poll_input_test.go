@@ -0,0 +1,128 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+func JsonPollInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	jolokia := `{"status": 200, "value": {"HeapMemoryUsage": {"used": 1024,
+		"max": 4096}, "Verbose": false, "Name": "java"}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter,
+		r *http.Request) {
+		switch r.URL.Path {
+		case "/jolokia":
+			if r.Header.Get("X-Auth") != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			fmt.Fprint(w, jolokia)
+		default:
+			fmt.Fprint(w, "not json")
+		}
+	}))
+	defer server.Close()
+
+	c.Specify("A JsonPollInput", func() {
+		input := new(JsonPollInput)
+		input.SetName("jsonpoll")
+		config := input.ConfigStruct().(*JsonPollInputConfig)
+		config.JsonMap = map[string]string{
+			"HeapUsed": "$.value.HeapMemoryUsage.used",
+			"Verbose":  "$.value.Verbose",
+			"Name":     "$.value.Name",
+			"Missing":  "$.value.nope",
+		}
+		config.Headers = map[string]string{"X-Auth": "secret"}
+
+		c.Specify("requires urls and a json_map", func() {
+			err := input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+			config.Urls = []string{server.URL}
+			config.JsonMap = nil
+			err = input.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("emits a message per url on each tick", func() {
+			config.Urls = []string{server.URL + "/jolokia", server.URL + "/bad"}
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+			mockRunner := pipelinemock.NewMockInputRunner(ctrl)
+			packSupply := make(chan *PipelinePack, 2)
+			for i := 0; i < 2; i++ {
+				packSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+			}
+			tickChan := make(chan time.Time)
+			injected := make(chan *PipelinePack, 2)
+
+			mockHelper.EXPECT().PipelineConfig().Return(pConfig)
+			mockRunner.EXPECT().InChan().Return(packSupply)
+			mockRunner.EXPECT().Ticker().Return(tickChan)
+			mockRunner.EXPECT().Inject(gomock.Any()).Times(2).Do(func(pack *PipelinePack) {
+				injected <- pack
+			})
+
+			done := make(chan error)
+			go func() {
+				done <- input.Run(mockRunner, mockHelper)
+			}()
+			tickChan <- time.Now()
+
+			pack := <-injected
+			msg := pack.Message
+			c.Expect(msg.GetType(), gs.Equals, "heka.jsonpoll.data")
+			c.Expect(msg.GetLogger(), gs.Equals, server.URL+"/jolokia")
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(6))
+			value, ok := msg.GetFieldValue("HeapUsed")
+			c.Expect(ok, gs.IsTrue)
+			c.Expect(value, gs.Equals, float64(1024))
+			value, _ = msg.GetFieldValue("Verbose")
+			c.Expect(value, gs.Equals, false)
+			value, _ = msg.GetFieldValue("Name")
+			c.Expect(value, gs.Equals, "java")
+			_, ok = msg.GetFieldValue("Missing")
+			c.Expect(ok, gs.IsFalse)
+			value, _ = msg.GetFieldValue("StatusCode")
+			c.Expect(value, gs.Equals, int64(200))
+
+			pack = <-injected
+			msg = pack.Message
+			c.Expect(msg.GetType(), gs.Equals, "heka.jsonpoll.error")
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(1))
+			c.Expect(msg.GetPayload(), pipeline_ts.StringContains, "invalid JSON")
+
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+		})
+	})
+}
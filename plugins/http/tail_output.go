@@ -0,0 +1,377 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Appended to the client's key to compute the Sec-WebSocket-Accept header,
+// see RFC 6455.
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket frame opcodes used by the TailOutput.
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+)
+
+// TailOutput config struct
+type TailOutputConfig struct {
+	// Address the HTTP server listens on. Defaults to "127.0.0.1:4353".
+	Address string
+	// Maximum number of connected clients, further ones get a 503 response.
+	// Defaults to 10.
+	MaxClients uint `toml:"max_clients"`
+	// Number of messages queued for each client before it's considered slow.
+	// Defaults to 100.
+	ClientBuffer uint `toml:"client_buffer"`
+	// What happens to slow clients: "drop" skips the messages they can't
+	// keep up with, "disconnect" closes their connection. Defaults to
+	// "drop".
+	SlowClientAction string `toml:"slow_client_action"`
+}
+
+// A connected client and the messages queued for it.
+type tailClient struct {
+	matcher *message.MatcherSpecification
+	msgs    chan []byte
+	// Closed when the client is disconnected by the output.
+	done chan struct{}
+}
+
+// Output plugin that streams the JSON encoded messages it receives to the
+// browsers or CLI clients connected to its HTTP server, as Server-Sent Events
+// on /events or WebSocket text frames on /ws. Each client can narrow the
+// stream down with its own message matcher, passed as the `match` query
+// parameter.
+type TailOutput struct {
+	conf       *TailOutputConfig
+	listener   net.Listener
+	disconnect bool
+	clients    map[*tailClient]bool
+	lock       sync.Mutex
+	// Counters for the reports.
+	rejected     int64
+	disconnected int64
+	dropped      int64
+}
+
+func (t *TailOutput) ConfigStruct() interface{} {
+	return &TailOutputConfig{
+		Address:          "127.0.0.1:4353",
+		MaxClients:       10,
+		ClientBuffer:     100,
+		SlowClientAction: "drop",
+	}
+}
+
+func (t *TailOutput) Init(config interface{}) (err error) {
+	t.conf = config.(*TailOutputConfig)
+	switch t.conf.SlowClientAction {
+	case "drop":
+	case "disconnect":
+		t.disconnect = true
+	default:
+		return fmt.Errorf("unknown slow_client_action: %s", t.conf.SlowClientAction)
+	}
+	t.clients = make(map[*tailClient]bool)
+
+	if t.listener, err = net.Listen("tcp", t.conf.Address); err != nil {
+		return fmt.Errorf("can't listen on %s: %s", t.conf.Address, err)
+	}
+	go http.Serve(t.listener, t.handler())
+	return
+}
+
+func (t *TailOutput) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", t.serveEvents)
+	mux.HandleFunc("/ws", t.serveWebSocket)
+	return mux
+}
+
+// Registers a client for the request, failing with the HTTP status to
+// respond with.
+func (t *TailOutput) addClient(req *http.Request) (client *tailClient,
+	status int, err error) {
+
+	match := req.URL.Query().Get("match")
+	if match == "" {
+		match = "TRUE"
+	}
+	client = &tailClient{
+		msgs: make(chan []byte, t.conf.ClientBuffer),
+		done: make(chan struct{}),
+	}
+	if client.matcher, err = message.CreateMatcherSpecification(match); err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid match: %s", err)
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if uint(len(t.clients)) >= t.conf.MaxClients {
+		atomic.AddInt64(&t.rejected, 1)
+		return nil, http.StatusServiceUnavailable, errors.New("too many clients")
+	}
+	t.clients[client] = true
+	return
+}
+
+// Unregisters the client, closing its done channel if the output is the one
+// disconnecting it. Does nothing if it was already removed.
+func (t *TailOutput) removeClient(client *tailClient, byOutput bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.clients[client] {
+		return
+	}
+	delete(t.clients, client)
+	if byOutput {
+		close(client.done)
+	}
+}
+
+func (t *TailOutput) serveEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	client, status, err := t.addClient(req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer t.removeClient(client, false)
+
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case msg := <-client.msgs:
+			if _, err = fmt.Fprintf(w, "data: %s\n\n", msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-client.done:
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (t *TailOutput) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") || key == "" {
+		http.Error(w, "websocket upgrade expected", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return
+	}
+	client, status, err := t.addClient(req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer t.removeClient(client, false)
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + webSocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err = rw.Flush(); err != nil {
+		return
+	}
+
+	// The client's frames are discarded, we only need to know when it goes
+	// away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if opcode, err := readWsFrame(rw.Reader); err != nil || opcode == wsOpClose {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-client.msgs:
+			if err = writeWsFrame(conn, wsOpText, msg); err != nil {
+				return
+			}
+		case <-client.done:
+			writeWsFrame(conn, wsOpClose, nil)
+			return
+		case <-closed:
+			writeWsFrame(conn, wsOpClose, nil)
+			return
+		}
+	}
+}
+
+// Writes an unmasked, unfragmented frame, as sent by servers.
+func writeWsFrame(w io.Writer, opcode byte, payload []byte) (err error) {
+	header := []byte{0x80 | opcode, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = append(header, byte(n>>8), byte(n))
+	default:
+		header[1] = 127
+		ext := make([]byte, 8)
+		binary.BigEndian.PutUint64(ext, uint64(n))
+		header = append(header, ext...)
+	}
+	if _, err = w.Write(header); err == nil {
+		_, err = w.Write(payload)
+	}
+	return
+}
+
+// Reads a client frame, skipping its payload, and returns its opcode.
+func readWsFrame(r *bufio.Reader) (opcode byte, err error) {
+	header := make([]byte, 2)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	opcode = header[0] & 0x0f
+	length := int64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err = io.ReadFull(r, ext); err != nil {
+			return
+		}
+		length = int64(binary.BigEndian.Uint64(ext))
+	}
+	// Skip the masking key too.
+	if header[1]&0x80 != 0 {
+		length += 4
+	}
+	_, err = io.CopyN(ioutil.Discard, r, length)
+	return
+}
+
+// Queues the message for every client whose matcher it satisfies, applying
+// the slow client action to those whose queue is full. The message is only
+// encoded if a client wants it.
+func (t *TailOutput) dispatch(msg *message.Message) (err error) {
+	var contents []byte
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for client := range t.clients {
+		if !client.matcher.Match(msg) {
+			continue
+		}
+		if contents == nil {
+			if contents, err = json.Marshal(msg); err != nil {
+				return
+			}
+		}
+		select {
+		case client.msgs <- contents:
+		default:
+			atomic.AddInt64(&t.dropped, 1)
+			if t.disconnect {
+				delete(t.clients, client)
+				close(client.done)
+				atomic.AddInt64(&t.disconnected, 1)
+			}
+		}
+	}
+	return
+}
+
+func (t *TailOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	for pack := range or.InChan() {
+		if e := t.dispatch(pack.Message); e != nil {
+			or.LogError(fmt.Errorf("can't encode message: %s", e))
+		}
+		pack.Recycle()
+	}
+
+	t.listener.Close()
+	t.lock.Lock()
+	for client := range t.clients {
+		delete(t.clients, client)
+		close(client.done)
+	}
+	t.lock.Unlock()
+	return
+}
+
+// Reports the connected clients, those that were turned away or disconnected
+// and the messages slow clients missed.
+func (t *TailOutput) ReportMsg(msg *message.Message) error {
+	t.lock.Lock()
+	clients := len(t.clients)
+	t.lock.Unlock()
+	message.NewInt64Field(msg, "ConnectedClients", int64(clients), "count")
+	message.NewInt64Field(msg, "RejectedClients", atomic.LoadInt64(&t.rejected),
+		"count")
+	message.NewInt64Field(msg, "DisconnectedClients",
+		atomic.LoadInt64(&t.disconnected), "count")
+	message.NewInt64Field(msg, "DroppedMessages", atomic.LoadInt64(&t.dropped),
+		"count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("TailOutput", func() interface{} {
+		return new(TailOutput)
+	})
+}
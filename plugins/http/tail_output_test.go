@@ -0,0 +1,210 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package http
+
+import (
+	"bufio"
+	"code.google.com/p/gomock/gomock"
+	"encoding/json"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+func TailOutputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	newPack := func(msgType string) *PipelinePack {
+		pack := NewPipelinePack(pConfig.InputRecycleChan())
+		pack.Message.SetType(msgType)
+		pack.Message.SetPayload("payload of " + msgType)
+		return pack
+	}
+
+	c.Specify("A TailOutput", func() {
+		output := new(TailOutput)
+		config := output.ConfigStruct().(*TailOutputConfig)
+		config.Address = "127.0.0.1:0"
+		config.MaxClients = 2
+
+		inChan := make(chan *PipelinePack, 4)
+		mockRunner := pipelinemock.NewMockOutputRunner(ctrl)
+		mockRunner.EXPECT().InChan().Return(inChan).AnyTimes()
+		mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+
+		clientCount := func() int {
+			output.lock.Lock()
+			defer output.lock.Unlock()
+			return len(output.clients)
+		}
+		waitForClients := func(n int) {
+			for i := 0; i < 100 && clientCount() != n; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			c.Assume(clientCount(), gs.Equals, n)
+		}
+
+		c.Specify("rejects an unknown slow_client_action", func() {
+			config.SlowClientAction = "ignore"
+			err := output.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("once running", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			baseUrl := fmt.Sprintf("http://%s", output.listener.Addr())
+			done := make(chan bool)
+			go func() {
+				output.Run(mockRunner, mockHelper)
+				done <- true
+			}()
+			defer func() {
+				close(inChan)
+				<-done
+			}()
+
+			c.Specify("streams the matching messages as events", func() {
+				resp, err := http.Get(baseUrl + "/events?match=" +
+					url.QueryEscape("Type == 'wanted'"))
+				c.Assume(err, gs.IsNil)
+				defer resp.Body.Close()
+				c.Expect(resp.Header.Get("Content-Type"), gs.Equals, "text/event-stream")
+				waitForClients(1)
+
+				inChan <- newPack("unwanted")
+				inChan <- newPack("wanted")
+				reader := bufio.NewReader(resp.Body)
+				line, err := reader.ReadString('\n')
+				c.Assume(err, gs.IsNil)
+				c.Expect(strings.HasPrefix(line, "data: "), gs.IsTrue)
+				msg := new(message.Message)
+				err = json.Unmarshal([]byte(line[len("data: "):]), msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg.GetType(), gs.Equals, "wanted")
+				c.Expect(msg.GetPayload(), gs.Equals, "payload of wanted")
+			})
+
+			c.Specify("streams messages over a websocket", func() {
+				conn, err := net.Dial("tcp", output.listener.Addr().String())
+				c.Assume(err, gs.IsNil)
+				defer conn.Close()
+				fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\n"+
+					"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+					"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n"+
+					"Sec-WebSocket-Version: 13\r\n\r\n")
+				reader := bufio.NewReader(conn)
+				resp, err := http.ReadResponse(reader, nil)
+				c.Assume(err, gs.IsNil)
+				c.Expect(resp.StatusCode, gs.Equals, http.StatusSwitchingProtocols)
+				c.Expect(resp.Header.Get("Sec-WebSocket-Accept"), gs.Equals,
+					"s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+				waitForClients(1)
+
+				inChan <- newPack("anything")
+				header := make([]byte, 2)
+				_, err = io.ReadFull(reader, header)
+				c.Assume(err, gs.IsNil)
+				c.Expect(header[0], gs.Equals, byte(0x80|wsOpText))
+				payload := make([]byte, int(header[1]))
+				_, err = io.ReadFull(reader, payload)
+				c.Assume(err, gs.IsNil)
+				msg := new(message.Message)
+				err = json.Unmarshal(payload, msg)
+				c.Expect(err, gs.IsNil)
+				c.Expect(msg.GetType(), gs.Equals, "anything")
+
+				// A masked close frame from the client ends the connection.
+				conn.Write([]byte{0x80 | wsOpClose, 0x80, 1, 2, 3, 4})
+				waitForClients(0)
+			})
+
+			c.Specify("refuses invalid matchers", func() {
+				resp, err := http.Get(baseUrl + "/events?match=bogus")
+				c.Assume(err, gs.IsNil)
+				resp.Body.Close()
+				c.Expect(resp.StatusCode, gs.Equals, http.StatusBadRequest)
+			})
+
+			c.Specify("turns away clients over max_clients", func() {
+				for i := 0; i < 2; i++ {
+					resp, err := http.Get(baseUrl + "/events")
+					c.Assume(err, gs.IsNil)
+					defer resp.Body.Close()
+				}
+				waitForClients(2)
+				resp, err := http.Get(baseUrl + "/events")
+				c.Assume(err, gs.IsNil)
+				resp.Body.Close()
+				c.Expect(resp.StatusCode, gs.Equals, http.StatusServiceUnavailable)
+				c.Expect(output.rejected, gs.Equals, int64(1))
+			})
+		})
+
+		c.Specify("handles slow clients", func() {
+			output.conf = config
+			output.clients = make(map[*tailClient]bool)
+			matcher, err := message.CreateMatcherSpecification("TRUE")
+			c.Assume(err, gs.IsNil)
+			client := &tailClient{
+				matcher: matcher,
+				msgs:    make(chan []byte, 1),
+				done:    make(chan struct{}),
+			}
+			output.clients[client] = true
+			msg := newPack("test").Message
+
+			c.Specify("by dropping their messages", func() {
+				for i := 0; i < 3; i++ {
+					c.Expect(output.dispatch(msg), gs.IsNil)
+				}
+				c.Expect(len(client.msgs), gs.Equals, 1)
+				c.Expect(output.dropped, gs.Equals, int64(2))
+				c.Expect(clientCount(), gs.Equals, 1)
+			})
+
+			c.Specify("by disconnecting them", func() {
+				output.disconnect = true
+				for i := 0; i < 3; i++ {
+					c.Expect(output.dispatch(msg), gs.IsNil)
+				}
+				c.Expect(clientCount(), gs.Equals, 0)
+				c.Expect(output.disconnected, gs.Equals, int64(1))
+				_, open := <-client.done
+				c.Expect(open, gs.IsFalse)
+
+				report := new(message.Message)
+				c.Expect(output.ReportMsg(report), gs.IsNil)
+				value, _ := report.GetFieldValue("DisconnectedClients")
+				c.Expect(value, gs.Equals, int64(1))
+				value, _ = report.GetFieldValue("DroppedMessages")
+				c.Expect(value, gs.Equals, int64(1))
+			})
+		})
+	})
+}
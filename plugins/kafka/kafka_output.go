@@ -0,0 +1,277 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package kafka
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"errors"
+	"fmt"
+	"github.com/Shopify/sarama"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"time"
+)
+
+var (
+	partitioners = map[string]sarama.PartitionerConstructor{
+		"Random":     sarama.NewRandomPartitioner,
+		"RoundRobin": sarama.NewRoundRobinPartitioner,
+		"Hash":       sarama.NewHashPartitioner,
+	}
+
+	requiredAcks = map[string]sarama.RequiredAcks{
+		"NoResponse":   sarama.NoResponse,
+		"WaitForLocal": sarama.WaitForLocal,
+		"WaitForAll":   sarama.WaitForAll,
+	}
+
+	compressionCodecs = map[string]sarama.CompressionCodec{
+		"None":   sarama.CompressionNone,
+		"GZIP":   sarama.CompressionGZIP,
+		"Snappy": sarama.CompressionSnappy,
+	}
+
+	encodings = map[string]bool{
+		"protobuf": true,
+		"payload":  true,
+	}
+)
+
+// Output plugin that publishes messages to a Kafka cluster.
+type KafkaOutput struct {
+	name          string
+	config        *KafkaOutputConfig
+	topicVariable string
+	hashVariable  string
+	client        sarama.Client
+	producer      sarama.AsyncProducer
+}
+
+// ConfigStruct for KafkaOutput plugin.
+type KafkaOutputConfig struct {
+	// Client id sent to the brokers, defaults to the plugin name.
+	Id string
+	// Addresses ("host:port") of the brokers used to bootstrap the cluster
+	// metadata.
+	Addrs []string
+	// Number of times to retry fetching the cluster metadata (default 3).
+	MetadataRetries int `toml:"metadata_retries"`
+	// Time to wait for a leader election to complete, in milliseconds
+	// (default 250).
+	WaitForElection uint32 `toml:"wait_for_election"`
+	// Broker connection timeout, in milliseconds (default 60000).
+	DialTimeout uint32 `toml:"dial_timeout"`
+
+	// Topic to publish to, used unless `topic_variable` is set.
+	Topic string
+	// Message attribute or field whose value is used as the topic.
+	TopicVariable string `toml:"topic_variable"`
+
+	// Partitioner to use, "Random" (default), "RoundRobin", or "Hash".
+	Partitioner string
+	// Message attribute or field whose value is hashed to pick the partition
+	// when the "Hash" partitioner is used.
+	HashVariable string `toml:"hash_variable"`
+
+	// Acknowledgement required from the brokers, "NoResponse",
+	// "WaitForLocal" (default), or "WaitForAll".
+	RequiredAcks string `toml:"required_acks"`
+	// Time the brokers wait to satisfy `required_acks`, in milliseconds
+	// (default 10000).
+	Timeout uint32
+	// "None" (default), "GZIP", or "Snappy".
+	CompressionCodec string `toml:"compression_codec"`
+	// Number of buffered bytes that triggers a flush to the brokers
+	// (default 16384).
+	MaxBufferedBytes uint32 `toml:"max_buffered_bytes"`
+	// Maximum time messages are buffered before being flushed, in
+	// milliseconds (default 1).
+	MaxBufferTime uint32 `toml:"max_buffer_time"`
+
+	// "protobuf" (default) to send the whole message, or "payload" to send
+	// only the message payload.
+	Encoding string
+}
+
+func (k *KafkaOutput) SetName(name string) {
+	k.name = name
+}
+
+func (k *KafkaOutput) ConfigStruct() interface{} {
+	return &KafkaOutputConfig{
+		MetadataRetries:  3,
+		WaitForElection:  250,
+		DialTimeout:      60000,
+		Partitioner:      "Random",
+		RequiredAcks:     "WaitForLocal",
+		Timeout:          10000,
+		CompressionCodec: "None",
+		MaxBufferedBytes: 16384,
+		MaxBufferTime:    1,
+		Encoding:         "protobuf",
+	}
+}
+
+func (k *KafkaOutput) Init(config interface{}) (err error) {
+	k.config = config.(*KafkaOutputConfig)
+	if len(k.config.Addrs) == 0 {
+		return errors.New("addrs must have at least one entry")
+	}
+	if k.config.Id == "" {
+		k.config.Id = k.name
+	}
+	if k.config.Topic == "" && k.config.TopicVariable == "" {
+		return errors.New("topic or topic_variable must be set")
+	}
+	k.topicVariable = k.config.TopicVariable
+
+	partitioner, ok := partitioners[k.config.Partitioner]
+	if !ok {
+		return fmt.Errorf("invalid partitioner: %s", k.config.Partitioner)
+	}
+	if k.config.Partitioner == "Hash" {
+		if k.config.HashVariable == "" {
+			return errors.New("hash_variable must be set for the Hash partitioner")
+		}
+		k.hashVariable = k.config.HashVariable
+	} else if k.config.HashVariable != "" {
+		return errors.New("hash_variable is only used by the Hash partitioner")
+	}
+
+	acks, ok := requiredAcks[k.config.RequiredAcks]
+	if !ok {
+		return fmt.Errorf("invalid required_acks: %s", k.config.RequiredAcks)
+	}
+	codec, ok := compressionCodecs[k.config.CompressionCodec]
+	if !ok {
+		return fmt.Errorf("invalid compression_codec: %s", k.config.CompressionCodec)
+	}
+	if !encodings[k.config.Encoding] {
+		return fmt.Errorf("invalid encoding: %s", k.config.Encoding)
+	}
+
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.ClientID = k.config.Id
+	saramaConfig.Metadata.Retry.Max = k.config.MetadataRetries
+	saramaConfig.Metadata.Retry.Backoff = time.Duration(k.config.WaitForElection) * time.Millisecond
+	saramaConfig.Net.DialTimeout = time.Duration(k.config.DialTimeout) * time.Millisecond
+
+	saramaConfig.Producer.Partitioner = partitioner
+	saramaConfig.Producer.RequiredAcks = acks
+	saramaConfig.Producer.Timeout = time.Duration(k.config.Timeout) * time.Millisecond
+	saramaConfig.Producer.Compression = codec
+	saramaConfig.Producer.Flush.Bytes = int(k.config.MaxBufferedBytes)
+	saramaConfig.Producer.Flush.Frequency = time.Duration(k.config.MaxBufferTime) * time.Millisecond
+
+	if k.client, err = sarama.NewClient(k.config.Addrs, saramaConfig); err != nil {
+		return fmt.Errorf("can't connect to the Kafka cluster: %s", err)
+	}
+	if k.producer, err = sarama.NewAsyncProducerFromClient(k.client); err != nil {
+		k.client.Close()
+		return fmt.Errorf("can't create the Kafka producer: %s", err)
+	}
+	return
+}
+
+// Works out the topic, key, and value of the Kafka message for a pack.
+func (k *KafkaOutput) prepare(pack *PipelinePack) (topic string, key,
+	value sarama.Encoder, err error) {
+
+	msg := pack.Message
+	topic = k.config.Topic
+	if k.topicVariable != "" {
+		var ok bool
+		if topic, ok = plugins.GetMessageVariable(msg, k.topicVariable); !ok || topic == "" {
+			err = fmt.Errorf("message has no topic_variable '%s'", k.topicVariable)
+			return
+		}
+	}
+
+	if k.hashVariable != "" {
+		hashKey, ok := plugins.GetMessageVariable(msg, k.hashVariable)
+		if !ok {
+			err = fmt.Errorf("message has no hash_variable '%s'", k.hashVariable)
+			return
+		}
+		key = sarama.StringEncoder(hashKey)
+	}
+
+	switch k.config.Encoding {
+	case "payload":
+		value = sarama.StringEncoder(msg.GetPayload())
+	default:
+		var b []byte
+		if b, err = proto.Marshal(msg); err != nil {
+			err = fmt.Errorf("can't encode message: %s", err)
+			return
+		}
+		value = sarama.ByteEncoder(b)
+	}
+	return
+}
+
+func (k *KafkaOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		ok         = true
+		pack       *PipelinePack
+		topic      string
+		key, value sarama.Encoder
+		e          error
+		pe         *sarama.ProducerError
+	)
+	inChan := or.InChan()
+	errChan := k.producer.Errors()
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			topic, key, value, e = k.prepare(pack)
+			pack.Recycle()
+			if e != nil {
+				or.LogError(e)
+				break
+			}
+			msg := &sarama.ProducerMessage{Topic: topic, Key: key, Value: value}
+			// The producer stops reading its input while a delivery error
+			// is waiting to be read, so keep draining them.
+			for queued := false; !queued; {
+				select {
+				case k.producer.Input() <- msg:
+					queued = true
+				case pe = <-errChan:
+					or.LogError(fmt.Errorf("Kafka delivery failed: %s", pe.Err))
+				}
+			}
+		case pe = <-errChan:
+			or.LogError(fmt.Errorf("Kafka delivery failed: %s", pe.Err))
+		}
+	}
+
+	// Close flushes the buffered messages, returning the failed deliveries.
+	if e = k.producer.Close(); e != nil {
+		or.LogError(e)
+	}
+	k.client.Close()
+	return
+}
+
+func init() {
+	RegisterPlugin("KafkaOutput", func() interface{} {
+		return new(KafkaOutput)
+	})
+}
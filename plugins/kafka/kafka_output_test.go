@@ -0,0 +1,100 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package kafka
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func KafkaOutputSpec(c gs.Context) {
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("A KafkaOutput", func() {
+		output := new(KafkaOutput)
+		output.SetName("kafka")
+		config := output.ConfigStruct().(*KafkaOutputConfig)
+		config.Addrs = []string{"localhost:9092"}
+		config.Topic = "heka"
+
+		c.Specify("validates its config", func() {
+			config.Addrs = nil
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.Addrs = []string{"localhost:9092"}
+
+			config.Topic = ""
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.Topic = "heka"
+
+			config.Partitioner = "Bogus"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.Partitioner = "Hash"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.Partitioner = "Random"
+			config.HashVariable = "Hostname"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.HashVariable = ""
+
+			config.RequiredAcks = "Sometimes"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.RequiredAcks = "WaitForAll"
+
+			config.CompressionCodec = "zip"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.CompressionCodec = "None"
+
+			config.Encoding = "json"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("prepares Kafka messages", func() {
+			pack := NewPipelinePack(pConfig.InputRecycleChan())
+			pack.Message = pipeline_ts.GetTestMessage()
+			output.config = config
+
+			c.Specify("with a static topic and protobuf encoding", func() {
+				topic, key, value, err := output.prepare(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(topic, gs.Equals, "heka")
+				c.Expect(key, gs.IsNil)
+				b, err := value.Encode()
+				c.Assume(err, gs.IsNil)
+				msg := new(message.Message)
+				c.Expect(proto.Unmarshal(b, msg), gs.IsNil)
+				c.Expect(msg.GetPayload(), gs.Equals, pack.Message.GetPayload())
+			})
+
+			c.Specify("with the topic and key taken from the message", func() {
+				output.topicVariable = "foo"
+				output.hashVariable = "Hostname"
+				config.Encoding = "payload"
+				topic, key, value, err := output.prepare(pack)
+				c.Expect(err, gs.IsNil)
+				c.Expect(topic, gs.Equals, "bar")
+				b, _ := key.Encode()
+				c.Expect(string(b), gs.Equals, "my.host.name")
+				b, _ = value.Encode()
+				c.Expect(string(b), gs.Equals, pack.Message.GetPayload())
+
+				output.topicVariable = "missing"
+				_, _, _, err = output.prepare(pack)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+		})
+	})
+}
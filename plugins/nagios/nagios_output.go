@@ -15,10 +15,15 @@
 package nagios
 
 import (
+	"errors"
+	"fmt"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -32,80 +37,220 @@ type NagiosOutputConfig struct {
 	Password string
 	// Http ResponseHeaderTimeout in seconds
 	ResponseHeaderTimeout uint
+	// How check results are submitted: "http" to the cmd.cgi or "nsca".
+	SendVia string `toml:"send_via"`
+	// Address of the NSCA daemon.
+	NscaAddress string `toml:"nsca_address"`
+	// NSCA encryption method: "none" or "xor".
+	NscaEncryption string `toml:"nsca_encryption"`
+	// NSCA password, used by the xor encryption.
+	NscaPassword string `toml:"nsca_password"`
+	// Connect and request timeout in seconds.
+	Timeout uint
+	// Message variables (attributes or field names) holding the host and
+	// service of the check.
+	HostVariable    string `toml:"host_variable"`
+	ServiceVariable string `toml:"service_variable"`
+	// Message variable holding the state (OK, WARNING, CRITICAL, UNKNOWN or
+	// 0-3). If empty the payload is expected to be "<state>:<output>".
+	StateVariable string `toml:"state_variable"`
+	// Message variable holding the plugin output. Defaults to the payload
+	// (after the state if state_variable is empty).
+	OutputVariable string `toml:"output_variable"`
+	// Number of times a failed submission is retried before the check
+	// result is dropped, -1 retries forever.
+	MaxRetries int `toml:"max_retries"`
+	// Delay before the first retry, doubled on every further retry.
+	RetryDelay string `toml:"retry_delay"`
+	// Maximum delay between retries.
+	MaxRetryDelay string `toml:"max_retry_delay"`
 }
 
 func (n *NagiosOutput) ConfigStruct() interface{} {
 	return &NagiosOutputConfig{
-		Url: "http://localhost/cgi-bin/cmd.cgi",
+		Url:                   "http://localhost/cgi-bin/cmd.cgi",
 		ResponseHeaderTimeout: 2,
+		SendVia:               "http",
+		NscaAddress:           "localhost:5667",
+		NscaEncryption:        "xor",
+		Timeout:               5,
+		HostVariable:          "Hostname",
+		ServiceVariable:       "Logger",
+		MaxRetries:            3,
+		RetryDelay:            "250ms",
+		MaxRetryDelay:         "30s",
 	}
 }
 
 type NagiosOutput struct {
-	conf      *NagiosOutputConfig
-	client    *http.Client
-	transport *http.Transport
+	conf        *NagiosOutputConfig
+	client      *http.Client
+	transport   *http.Transport
+	nsca        *nscaClient
+	retryHelper *RetryHelper
+	// Replaced in tests.
+	submit func(check *checkResult) error
+}
+
+// A passive service check result.
+type checkResult struct {
+	host    string
+	service string
+	state   int
+	output  string
+}
+
+var nagiosStates = map[string]int{
+	"OK":       0,
+	"WARNING":  1,
+	"CRITICAL": 2,
+	"UNKNOWN":  3,
 }
 
 func (n *NagiosOutput) Init(config interface{}) (err error) {
 	n.conf = config.(*NagiosOutputConfig)
-	n.transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		ResponseHeaderTimeout: time.Duration(n.conf.ResponseHeaderTimeout) * time.Second}
-	n.client = &http.Client{Transport: n.transport}
+	timeout := time.Duration(n.conf.Timeout) * time.Second
+	switch n.conf.SendVia {
+	case "http":
+		dialer := &net.Dialer{Timeout: timeout}
+		n.transport = &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			Dial:                  dialer.Dial,
+			ResponseHeaderTimeout: time.Duration(n.conf.ResponseHeaderTimeout) * time.Second}
+		n.client = &http.Client{Transport: n.transport}
+		n.submit = n.submitHttp
+	case "nsca":
+		encryption, ok := nscaEncryptions[n.conf.NscaEncryption]
+		if !ok {
+			return fmt.Errorf("unsupported nsca_encryption: %s", n.conf.NscaEncryption)
+		}
+		n.nsca = &nscaClient{
+			address:    n.conf.NscaAddress,
+			password:   []byte(n.conf.NscaPassword),
+			encryption: encryption,
+			timeout:    timeout,
+		}
+		n.submit = n.submitNsca
+	default:
+		return fmt.Errorf("invalid send_via: %s", n.conf.SendVia)
+	}
+	if n.conf.HostVariable == "" || n.conf.ServiceVariable == "" {
+		return errors.New("host_variable and service_variable must be set")
+	}
+	n.retryHelper, err = NewRetryHelper(RetryOptions{
+		MaxDelay:   n.conf.MaxRetryDelay,
+		Delay:      n.conf.RetryDelay,
+		MaxJitter:  n.conf.RetryDelay,
+		MaxRetries: n.conf.MaxRetries,
+	})
+	if err != nil {
+		return fmt.Errorf("Invalid retry settings: %s", err)
+	}
 	return
 }
 
-func (n *NagiosOutput) Run(or OutputRunner, h PluginHelper) (err error) {
-	inChan := or.InChan()
+// Maps the message to a check result using the configured variables.
+func (n *NagiosOutput) checkResult(msg *message.Message) (check *checkResult,
+	err error) {
 
-	var (
-		pack    *PipelinePack
-		msg     *message.Message
-		payload string
-	)
+	check = &checkResult{state: nagiosStates["UNKNOWN"]}
+	var ok bool
+	if check.host, ok = plugins.GetMessageVariable(msg, n.conf.HostVariable); !ok {
+		return nil, fmt.Errorf("message has no host_variable '%s'", n.conf.HostVariable)
+	}
+	if check.service, ok = plugins.GetMessageVariable(msg, n.conf.ServiceVariable); !ok {
+		return nil, fmt.Errorf("message has no service_variable '%s'",
+			n.conf.ServiceVariable)
+	}
 
-	for pack = range inChan {
-		msg = pack.Message
-		payload = msg.GetPayload()
+	if n.conf.StateVariable == "" {
+		payload := msg.GetPayload()
 		pos := strings.IndexAny(payload, ":")
-		state := "3" // UNKNOWN
 		if pos != -1 {
-			switch payload[:pos] {
-			case "OK":
-				state = "0"
-			case "WARNING":
-				state = "1"
-			case "CRITICAL":
-				state = "2"
+			if state, ok := nagiosStates[payload[:pos]]; ok {
+				check.state = state
 			}
 		}
+		check.output = payload[pos+1:]
+	} else {
+		value, _ := plugins.GetMessageVariable(msg, n.conf.StateVariable)
+		if state, ok := nagiosStates[strings.ToUpper(value)]; ok {
+			check.state = state
+		} else if state, err := strconv.Atoi(value); err == nil && state >= 0 && state <= 3 {
+			check.state = state
+		}
+		check.output = msg.GetPayload()
+	}
+	if n.conf.OutputVariable != "" {
+		check.output, _ = plugins.GetMessageVariable(msg, n.conf.OutputVariable)
+	}
+	return
+}
+
+// Posts the check result to the Nagios cmd.cgi.
+func (n *NagiosOutput) submitHttp(check *checkResult) (err error) {
+	data := url.Values{
+		"cmd_typ":          {"30"}, // PROCESS_SERVICE_CHECK_RESULT
+		"cmd_mod":          {"2"},  // CMDMODE_COMMIT
+		"host":             {check.host},
+		"service":          {check.service},
+		"plugin_state":     {strconv.Itoa(check.state)},
+		"plugin_output":    {check.output},
+		"performance_data": {""}}
+	req, err := http.NewRequest("POST", n.conf.Url,
+		strings.NewReader(data.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(n.conf.Username, n.conf.Password)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("cmd.cgi responded with %s", resp.Status)
+	}
+	return
+}
+
+func (n *NagiosOutput) submitNsca(check *checkResult) error {
+	return n.nsca.send(check.host, check.service, check.state, check.output)
+}
+
+// Submits the check result, backing off and retrying failures up to
+// max_retries times.
+func (n *NagiosOutput) submitWithRetries(check *checkResult) (err error) {
+	defer n.retryHelper.Reset()
+	for {
+		if err = n.submit(check); err == nil {
+			return
+		}
+		if n.retryHelper.Wait() != nil {
+			return fmt.Errorf("%s (max retries exceeded)", err)
+		}
+	}
+}
 
-		data := url.Values{
-			"cmd_typ":          {"30"}, // PROCESS_SERVICE_CHECK_RESULT
-			"cmd_mod":          {"2"},  // CMDMODE_COMMIT
-			"host":             {msg.GetHostname()},
-			"service":          {msg.GetLogger()},
-			"plugin_state":     {state},
-			"plugin_output":    {payload[pos+1:]},
-			"performance_data": {""}}
-		req, err := http.NewRequest("POST", n.conf.Url,
-			strings.NewReader(data.Encode()))
-		if err == nil {
-			req.SetBasicAuth(n.conf.Username, n.conf.Password)
-			if resp, err := n.client.Do(req); err == nil {
-				resp.Body.Close()
-			} else {
-				or.LogError(err)
-			}
-		} else {
-			or.LogError(err)
+func (n *NagiosOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		pack  *PipelinePack
+		check *checkResult
+		e     error
+	)
+
+	for pack = range or.InChan() {
+		if check, e = n.checkResult(pack.Message); e == nil {
+			e = n.submitWithRetries(check)
+		}
+		if e != nil {
+			or.LogError(e)
 		}
 		pack.Recycle()
 	}
 	return
 }
-
 func init() {
 	RegisterPlugin("NagiosOutput", func() interface{} {
 		return new(NagiosOutput)
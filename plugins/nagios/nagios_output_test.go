@@ -0,0 +1,168 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package nagios
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/mozilla-services/heka/message"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllSpecs(t *testing.T) {
+	r := gs.NewRunner()
+	r.Parallel = false
+
+	r.AddSpec(NagiosOutputSpec)
+
+	gs.MainGoTest(r, t)
+}
+
+func NagiosOutputSpec(c gs.Context) {
+	c.Specify("A NagiosOutput", func() {
+		output := new(NagiosOutput)
+		config := output.ConfigStruct().(*NagiosOutputConfig)
+		config.RetryDelay = "1ms"
+		config.MaxRetryDelay = "1ms"
+		msg := pipeline_ts.GetTestMessage()
+
+		c.Specify("parses the state from the payload by default", func() {
+			c.Assume(output.Init(config), gs.IsNil)
+			msg.SetPayload("WARNING:disk 91% full")
+			check, err := output.checkResult(msg)
+			c.Assume(err, gs.IsNil)
+			c.Expect(*check, gs.Equals, checkResult{"my.host.name", "GoSpec", 1,
+				"disk 91% full"})
+
+			msg.SetPayload("no state")
+			check, err = output.checkResult(msg)
+			c.Assume(err, gs.IsNil)
+			c.Expect(check.state, gs.Equals, 3)
+			c.Expect(check.output, gs.Equals, "no state")
+		})
+
+		c.Specify("maps configured message variables", func() {
+			config.HostVariable = "foo"
+			config.ServiceVariable = "Type"
+			config.StateVariable = "level"
+			config.OutputVariable = "summary"
+			c.Assume(output.Init(config), gs.IsNil)
+			field, _ := message.NewField("level", "critical", "")
+			msg.AddField(field)
+			field, _ = message.NewField("summary", "all down", "")
+			msg.AddField(field)
+			check, err := output.checkResult(msg)
+			c.Assume(err, gs.IsNil)
+			c.Expect(*check, gs.Equals, checkResult{"bar", "TEST", 2, "all down"})
+
+			config.HostVariable = "missing"
+			_, err = output.checkResult(msg)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects unknown settings", func() {
+			config.SendVia = "smoke signal"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.SendVia = "nsca"
+			config.NscaEncryption = "3des"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("retries failed cmd.cgi requests", func() {
+			var requests []*http.Request
+			failures := 1
+			server := httptest.NewServer(http.HandlerFunc(
+				func(w http.ResponseWriter, req *http.Request) {
+					req.ParseForm()
+					requests = append(requests, req)
+					if len(requests) <= failures {
+						w.WriteHeader(http.StatusInternalServerError)
+					}
+				}))
+			defer server.Close()
+			config.Url = server.URL
+			c.Assume(output.Init(config), gs.IsNil)
+
+			err := output.submitWithRetries(&checkResult{"web1", "nginx", 2, "down"})
+			c.Expect(err, gs.IsNil)
+			c.Assume(len(requests), gs.Equals, 2)
+			c.Expect(requests[1].PostForm.Get("host"), gs.Equals, "web1")
+			c.Expect(requests[1].PostForm.Get("service"), gs.Equals, "nginx")
+			c.Expect(requests[1].PostForm.Get("plugin_state"), gs.Equals, "2")
+			c.Expect(requests[1].PostForm.Get("plugin_output"), gs.Equals, "down")
+
+			config.MaxRetries = 1
+			c.Assume(output.Init(config), gs.IsNil)
+			failures = 4
+			err = output.submitWithRetries(&checkResult{"web1", "nginx", 2, "down"})
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(len(requests), gs.Equals, 4)
+		})
+
+		c.Specify("sends xor encrypted NSCA packets", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer listener.Close()
+			iv := bytes.Repeat([]byte{0x5a, 0xa5}, nscaIVSize/2)
+			received := make(chan []byte, 1)
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				init := make([]byte, nscaInitSize)
+				copy(init, iv)
+				binary.BigEndian.PutUint32(init[nscaIVSize:], 1400000000)
+				conn.Write(init)
+				packet := make([]byte, nscaDataSize)
+				io.ReadFull(conn, packet)
+				received <- packet
+			}()
+
+			config.SendVia = "nsca"
+			config.NscaAddress = listener.Addr().String()
+			config.NscaPassword = "secret"
+			c.Assume(output.Init(config), gs.IsNil)
+			err = output.submit(&checkResult{"web1", "nginx", 1, "slow"})
+			c.Assume(err, gs.IsNil)
+
+			packet := <-received
+			password := []byte("secret")
+			for i := range packet {
+				packet[i] ^= iv[i%len(iv)] ^ password[i%len(password)]
+			}
+			c.Expect(binary.BigEndian.Uint16(packet), gs.Equals, uint16(3))
+			c.Expect(binary.BigEndian.Uint32(packet[8:]), gs.Equals, uint32(1400000000))
+			c.Expect(binary.BigEndian.Uint16(packet[12:]), gs.Equals, uint16(1))
+			c.Expect(string(bytes.TrimRight(packet[nscaHostOffset:nscaServiceOffset], "\x00")),
+				gs.Equals, "web1")
+			c.Expect(string(bytes.TrimRight(packet[nscaServiceOffset:nscaOutputOffset], "\x00")),
+				gs.Equals, "nginx")
+			c.Expect(string(bytes.TrimRight(packet[nscaOutputOffset:], "\x00")),
+				gs.Equals, "slow")
+			crc := binary.BigEndian.Uint32(packet[4:])
+			copy(packet[4:8], []byte{0, 0, 0, 0})
+			c.Expect(crc32.ChecksumIEEE(packet), gs.Equals, crc)
+		})
+	})
+}
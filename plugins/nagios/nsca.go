@@ -0,0 +1,107 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package nagios
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"time"
+)
+
+// Sizes of the NSCA 2.x protocol (version 3) packets.
+const (
+	nscaIVSize        = 128
+	nscaInitSize      = nscaIVSize + 4
+	nscaVersion       = 3
+	nscaHostSize      = 64
+	nscaServiceSize   = 128
+	nscaOutputSize    = 512
+	nscaDataSize      = 2 + 2 + 4 + 4 + 2 + nscaHostSize + nscaServiceSize + nscaOutputSize + 2
+	nscaHostOffset    = 14
+	nscaServiceOffset = nscaHostOffset + nscaHostSize
+	nscaOutputOffset  = nscaServiceOffset + nscaServiceSize
+)
+
+// NSCA encryption methods, as numbered in nsca.cfg / send_nsca.cfg.
+var nscaEncryptions = map[string]int{
+	"none": 0,
+	"xor":  1,
+}
+
+// Submits passive check results to an NSCA daemon, one connection per
+// result.
+type nscaClient struct {
+	address    string
+	password   []byte
+	encryption int
+	timeout    time.Duration
+}
+
+// Sends a passive service check result. The host, service and output are
+// truncated to the sizes of the NSCA packet.
+func (c *nscaClient) send(host, service string, state int, output string) (
+	err error) {
+
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+
+	// The server starts by sending the IV for the encryption and its time.
+	init := make([]byte, nscaInitSize)
+	if _, err = io.ReadFull(conn, init); err != nil {
+		return fmt.Errorf("reading NSCA init packet: %s", err)
+	}
+	iv := init[:nscaIVSize]
+	timestamp := binary.BigEndian.Uint32(init[nscaIVSize:])
+
+	packet := nscaPacket(host, service, state, output, timestamp)
+	c.encrypt(packet, iv)
+	_, err = conn.Write(packet)
+	return
+}
+
+// Builds the data packet, the CRC32 is calculated with its own field zeroed.
+func nscaPacket(host, service string, state int, output string,
+	timestamp uint32) (packet []byte) {
+
+	packet = make([]byte, nscaDataSize)
+	binary.BigEndian.PutUint16(packet[0:], nscaVersion)
+	binary.BigEndian.PutUint32(packet[8:], timestamp)
+	binary.BigEndian.PutUint16(packet[12:], uint16(state))
+	// Leave room for the terminating NUL of each string.
+	copy(packet[nscaHostOffset:nscaServiceOffset-1], host)
+	copy(packet[nscaServiceOffset:nscaOutputOffset-1], service)
+	copy(packet[nscaOutputOffset:nscaOutputOffset+nscaOutputSize-1], output)
+	binary.BigEndian.PutUint32(packet[4:], crc32.ChecksumIEEE(packet))
+	return
+}
+
+func (c *nscaClient) encrypt(packet, iv []byte) {
+	if c.encryption != nscaEncryptions["xor"] {
+		return
+	}
+	for i := range packet {
+		packet[i] ^= iv[i%len(iv)]
+		if len(c.password) > 0 {
+			packet[i] ^= c.password[i%len(c.password)]
+		}
+	}
+}
@@ -23,9 +23,11 @@ func TestAllSpecs(t *testing.T) {
 	r := gospec.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(CsvDecoderSpec)
 	r.AddSpec(JsonPathSpec)
 	r.AddSpec(MultiDecoderSpec)
 	r.AddSpec(PayloadDecodersSpec)
+	r.AddSpec(PayloadProtobufDecoderSpec)
 
 	gospec.MainGoTest(r, t)
 }
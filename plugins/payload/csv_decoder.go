@@ -0,0 +1,185 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var csvColumnTypes = map[string]bool{
+	"string": true,
+	"int":    true,
+	"float":  true,
+	"bool":   true,
+}
+
+type CsvDecoderConfig struct {
+	// Field delimiter, a single character (default ",").
+	Delimiter string
+	// Column names, used as the message field names.
+	Columns []string
+	// Whether the first row of each stream is a header row. The header
+	// provides the column names unless `columns` is set, in which case it is
+	// skipped.
+	Header bool
+	// Maps column names to "string" (default), "int", "float", or "bool".
+	ColumnTypes map[string]string `toml:"column_types"`
+	// In strict mode rows with the wrong number of values, badly quoted
+	// values, and values that don't match their column type are rejected.
+	Strict bool
+}
+
+// Decoder that parses a delimited (CSV, TSV, etc.) payload into message
+// fields, one per column.
+type CsvDecoder struct {
+	delimiter   rune
+	columns     []string
+	header      bool
+	columnTypes map[string]string
+	strict      bool
+	// Header derived column names keyed by message Logger, i.e. per stream.
+	streamColumns map[string][]string
+	dRunner       DecoderRunner
+}
+
+func (cd *CsvDecoder) ConfigStruct() interface{} {
+	return &CsvDecoderConfig{
+		Delimiter: ",",
+		Strict:    true,
+	}
+}
+
+func (cd *CsvDecoder) Init(config interface{}) (err error) {
+	conf := config.(*CsvDecoderConfig)
+	if conf.Delimiter == `\t` {
+		conf.Delimiter = "\t"
+	}
+	if utf8.RuneCountInString(conf.Delimiter) != 1 {
+		return fmt.Errorf("CsvDecoder delimiter must be a single character: '%s'",
+			conf.Delimiter)
+	}
+	cd.delimiter, _ = utf8.DecodeRuneInString(conf.Delimiter)
+	if len(conf.Columns) == 0 && !conf.Header {
+		return errors.New("CsvDecoder requires `columns` unless `header` is set")
+	}
+	for column, typ := range conf.ColumnTypes {
+		if !csvColumnTypes[typ] {
+			return fmt.Errorf("CsvDecoder unsupported type '%s' for column '%s'",
+				typ, column)
+		}
+	}
+	cd.columns = conf.Columns
+	cd.header = conf.Header
+	cd.columnTypes = conf.ColumnTypes
+	cd.strict = conf.Strict
+	cd.streamColumns = make(map[string][]string)
+	return
+}
+
+// Heka will call this to give us access to the runner.
+func (cd *CsvDecoder) SetDecoderRunner(dr DecoderRunner) {
+	cd.dRunner = dr
+}
+
+func (cd *CsvDecoder) parseRow(s string) (row []string, err error) {
+	reader := csv.NewReader(strings.NewReader(s))
+	reader.Comma = cd.delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = !cd.strict
+	return reader.Read()
+}
+
+// Converts a value to its column's configured type.
+func (cd *CsvDecoder) typedValue(column, value string) (typed interface{}, err error) {
+	switch cd.columnTypes[column] {
+	case "int":
+		typed, err = strconv.ParseInt(value, 10, 64)
+	case "float":
+		typed, err = strconv.ParseFloat(value, 64)
+	case "bool":
+		typed, err = strconv.ParseBool(value)
+	default:
+		typed = value
+	}
+	if err != nil {
+		err = fmt.Errorf("column '%s' value '%s' isn't a valid %s", column, value,
+			cd.columnTypes[column])
+	}
+	return
+}
+
+func (cd *CsvDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack, err error) {
+	var row []string
+	if row, err = cd.parseRow(pack.Message.GetPayload()); err != nil {
+		return nil, fmt.Errorf("CsvDecoder can't parse row: %s", err)
+	}
+
+	columns := cd.columns
+	if cd.header {
+		stream := pack.Message.GetLogger()
+		if _, ok := cd.streamColumns[stream]; !ok {
+			// First row of the stream is the header, it doesn't produce a
+			// message.
+			cd.streamColumns[stream] = row
+			return
+		}
+		if len(columns) == 0 {
+			columns = cd.streamColumns[stream]
+		}
+	}
+
+	if len(row) != len(columns) {
+		if cd.strict {
+			return nil, fmt.Errorf("CsvDecoder expected %d values, got %d",
+				len(columns), len(row))
+		}
+		// Lenient mode drops extra values and leaves out missing columns.
+		if len(row) > len(columns) {
+			row = row[:len(columns)]
+		}
+	}
+
+	var (
+		value interface{}
+		field *message.Field
+	)
+	for i, raw := range row {
+		if value, err = cd.typedValue(columns[i], raw); err != nil {
+			if cd.strict {
+				return nil, fmt.Errorf("CsvDecoder %s", err)
+			}
+			value, err = raw, nil
+		}
+		if field, err = message.NewField(columns[i], value, ""); err != nil {
+			return nil, fmt.Errorf("CsvDecoder can't add field: %s", err)
+		}
+		pack.Message.AddField(field)
+	}
+	packs = []*PipelinePack{pack}
+	return
+}
+
+func init() {
+	RegisterPlugin("CsvDecoder", func() interface{} {
+		return new(CsvDecoder)
+	})
+}
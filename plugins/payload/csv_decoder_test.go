@@ -0,0 +1,116 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+)
+
+func CsvDecoderSpec(c gs.Context) {
+	c.Specify("A CsvDecoder", func() {
+		decoder := new(CsvDecoder)
+		conf := decoder.ConfigStruct().(*CsvDecoderConfig)
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+
+		decode := func(payload string) ([]*PipelinePack, error) {
+			pack.Zero()
+			pack.Message.SetLogger("stream1")
+			pack.Message.SetPayload(payload)
+			return decoder.Decode(pack)
+		}
+
+		c.Specify("requires columns or a header", func() {
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Header = true
+			conf.Delimiter = "::"
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("decodes typed fields from configured columns", func() {
+			conf.Columns = []string{"host", "status", "latency", "cached"}
+			conf.ColumnTypes = map[string]string{
+				"status":  "int",
+				"latency": "float",
+				"cached":  "bool",
+			}
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+
+			packs, err := decode(`"web, 1",200,0.25,true` + "\n")
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(packs), gs.Equals, 1)
+			value, _ := pack.Message.GetFieldValue("host")
+			c.Expect(value, gs.Equals, "web, 1")
+			value, _ = pack.Message.GetFieldValue("status")
+			c.Expect(value, gs.Equals, int64(200))
+			value, _ = pack.Message.GetFieldValue("latency")
+			c.Expect(value, gs.Equals, 0.25)
+			value, _ = pack.Message.GetFieldValue("cached")
+			c.Expect(value, gs.Equals, true)
+
+			c.Specify("and rejects bad rows in strict mode", func() {
+				_, err = decode("web,200,0.25")
+				c.Expect(err, gs.Not(gs.IsNil))
+				_, err = decode("web,OK,0.25,true")
+				c.Expect(err, gs.Not(gs.IsNil))
+				_, err = decode(`web,"2"00,0.25,true`)
+				c.Expect(err, gs.Not(gs.IsNil))
+			})
+
+			c.Specify("and accepts ragged rows in lenient mode", func() {
+				conf.Strict = false
+				err = decoder.Init(conf)
+				c.Assume(err, gs.IsNil)
+				packs, err = decode("web,OK")
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(packs), gs.Equals, 1)
+				value, _ = pack.Message.GetFieldValue("status")
+				c.Expect(value, gs.Equals, "OK")
+				_, ok := pack.Message.GetFieldValue("latency")
+				c.Expect(ok, gs.IsFalse)
+
+				packs, err = decode("web,200,0.5,false,extra")
+				c.Expect(err, gs.IsNil)
+				c.Expect(len(pack.Message.Fields), gs.Equals, 4)
+			})
+		})
+
+		c.Specify("takes the columns from each stream's header row", func() {
+			conf.Header = true
+			conf.Delimiter = `\t`
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+
+			packs, err := decode("name\tcount")
+			c.Expect(err, gs.IsNil)
+			c.Expect(packs, gs.IsNil)
+			packs, err = decode("foo\t3")
+			c.Expect(err, gs.IsNil)
+			value, _ := pack.Message.GetFieldValue("count")
+			c.Expect(value, gs.Equals, "3")
+
+			pack.Zero()
+			pack.Message.SetLogger("stream2")
+			pack.Message.SetPayload("other\tcolumns")
+			packs, err = decoder.Decode(pack)
+			c.Expect(packs, gs.IsNil)
+			packs, err = decode("bar\t4")
+			value, _ = pack.Message.GetFieldValue("name")
+			c.Expect(value, gs.Equals, "bar")
+		})
+	})
+}
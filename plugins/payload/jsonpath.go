@@ -52,56 +52,71 @@ func (j *JsonPath) SetJsonText(json_text string) (err error) {
 }
 
 func (j *JsonPath) Find(jp string) (result string, err error) {
-	var ok bool
+	var v interface{}
+	if v, err = j.FindValue(jp); err != nil {
+		return
+	}
+
+	r_kind := reflect.ValueOf(v).Kind()
+	if r_kind == reflect.Bool {
+		result = fmt.Sprintf("%t", v)
+	} else if r_kind == reflect.Map || r_kind == reflect.Slice {
+		json_str, _ := json.Marshal(v)
+		result = fmt.Sprintf("%s", json_str)
+	} else {
+		result = fmt.Sprintf("%s", v)
+	}
+
+	return result, nil
+}
 
+// Like Find, but returns the raw decoded value at the path, i.e. a
+// json.Number, string, bool, nil, []interface{} or map[string]interface{}.
+func (j *JsonPath) FindValue(jp string) (v interface{}, err error) {
 	if j.json_data == nil {
-		return "", fmt.Errorf("JSON data is nil")
+		return nil, fmt.Errorf("JSON data is nil")
 	}
 
 	if jp == "" || strings.HasPrefix("$.", jp) {
-		return result, errors.New("invalid path")
+		return nil, errors.New("invalid path")
 	}
 
 	// Strip off the leading $.
 	jp = jp[2:]
 
 	// Need to grab a pointer to the top of the data structure
-	v := j.json_data
+	v = j.json_data
 
 	for _, token := range strings.Split(jp, ".") {
 		sl := json_re.FindAllStringSubmatch(token, -1)
 		if len(sl) == 0 {
-			return result, errors.New("invalid path")
+			return nil, errors.New("invalid path")
 		}
 		ss := sl[0]
 		if ss[1] != "" {
-			v, ok = v.(map[string]interface{})[ss[1]]
+			v_map, ok := v.(map[string]interface{})
 			if !ok {
-				return result, errors.New("invalid path")
+				return nil, errors.New("invalid path")
+			}
+			if v, ok = v_map[ss[1]]; !ok {
+				return nil, errors.New("invalid path")
 			}
 		}
 		if ss[2] != "" {
 			i, err := strconv.Atoi(ss[2][1 : len(ss[2])-1])
 			if err != nil {
-				return result, errors.New("invalid path")
+				return nil, errors.New("invalid path")
+			}
+			v_arr, ok := v.([]interface{})
+			if !ok {
+				return nil, errors.New("invalid path")
 			}
-			v_arr := v.([]interface{})
 			if i < 0 || i >= len(v_arr) {
-				return result, errors.New(fmt.Sprintf("array out of bounds jsonpath:[%s]", jp))
+				return nil, errors.New(fmt.Sprintf("array out of bounds jsonpath:[%s]", jp))
 			}
 			v = v_arr[i]
 		}
 	}
 
-	r_kind := reflect.ValueOf(v).Kind()
-	if r_kind == reflect.Bool {
-		result = fmt.Sprintf("%t", v)
-	} else if r_kind == reflect.Map || r_kind == reflect.Slice {
-		json_str, _ := json.Marshal(v)
-		result = fmt.Sprintf("%s", json_str)
-	} else {
-		result = fmt.Sprintf("%s", v)
-	}
-
-	return result, nil
+	return v, nil
 }
@@ -15,6 +15,7 @@
 package payload
 
 import (
+	"encoding/json"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 )
 
@@ -93,6 +94,20 @@ func JsonPathSpec(c gs.Context) {
 		c.Expect(err, gs.IsNil)
 		c.Expect(result_data, gs.Equals, expected_data)
 
+		result, err = json_path.FindValue("$.foo.bar[1].moo")
+		c.Expect(err, gs.IsNil)
+		c.Expect(result, gs.Equals, json.Number("256"))
+
+		result, err = json_path.FindValue("$.foo.boo.bag")
+		c.Expect(err, gs.IsNil)
+		c.Expect(result, gs.Equals, true)
+
+		// Indexing into a scalar is an error, not a panic.
+		result, err = json_path.FindValue("$.foo.boo.bag.nope")
+		c.Expect(err, gs.Not(gs.IsNil))
+
+		result, err = json_path.FindValue("$.foo.bar[0].baz[0]")
+		c.Expect(err, gs.Not(gs.IsNil))
 	})
 
 	c.Specify("JsonPath doesn't crash on nil data", func() {
@@ -58,7 +58,7 @@ func MultiDecoderSpec(c gospec.Context) {
 
 		conf.Order = []string{"StartsWithM"}
 
-		errMsg := "All subdecoders failed."
+		errMsg := "All subdecoders failed: 'StartsWithM': No match"
 
 		dRunner := pipelinemock.NewMockDecoderRunner(ctrl)
 		// An error will be spit out b/c there's no real *dRunner in there;
@@ -188,7 +188,8 @@ func MultiDecoderSpec(c gospec.Context) {
 					pack.Message.SetPayload(regexData)
 					packs, err := decoder.Decode(pack)
 					c.Expect(len(packs), gs.Equals, 0)
-					c.Expect(err.Error(), gs.Equals, errMsg)
+					c.Expect(err.Error(), gs.Equals, errMsg+
+						"; 'StartsWithS': No match; 'StartsWithM2': No match")
 					_, ok = pack.Message.GetFieldValue("StartsWithM")
 					c.Expect(ok, gs.IsFalse)
 					_, ok = pack.Message.GetFieldValue("StartsWithS")
@@ -196,6 +197,30 @@ func MultiDecoderSpec(c gospec.Context) {
 					_, ok = pack.Message.GetFieldValue("StartsWithM2")
 					c.Expect(ok, gs.IsFalse)
 				})
+
+				c.Specify("reporting the attempts of each subdecoder", func() {
+					pack.Message.SetPayload("second match")
+					_, err = decoder.Decode(pack)
+					c.Assume(err, gs.IsNil)
+					msg := pack.Message
+					msg.Fields = nil
+					c.Expect(decoder.ReportMsg(msg), gs.IsNil)
+					expected := map[string]int64{
+						"StartsWithM-AttemptCount":  1,
+						"StartsWithM-FailureCount":  1,
+						"StartsWithM-ErrorCount":    1,
+						"StartsWithS-AttemptCount":  1,
+						"StartsWithS-SuccessCount":  1,
+						"StartsWithS-FailureCount":  0,
+						"StartsWithM2-AttemptCount": 0,
+					}
+					for name, count := range expected {
+						value, _ := msg.GetFieldValue(name)
+						c.Expect(value, gs.Equals, count)
+					}
+					rate, _ := msg.GetFieldValue("StartsWithS-AvgSuccessRate")
+					c.Expect(rate, gs.Equals, float64(100))
+				})
 			})
 
 			c.Specify("and using `all` cascading", func() {
@@ -235,7 +260,8 @@ func MultiDecoderSpec(c gospec.Context) {
 					pack.Message.SetPayload(regexData)
 					packs, err := decoder.Decode(pack)
 					c.Expect(len(packs), gs.Equals, 0)
-					c.Expect(err.Error(), gs.Equals, errMsg)
+					c.Expect(err.Error(), gs.Equals, errMsg+
+						"; 'StartsWithS': No match; 'StartsWithM2': No match")
 					_, ok = pack.Message.GetFieldValue("StartsWithM")
 					c.Expect(ok, gs.IsFalse)
 					_, ok = pack.Message.GetFieldValue("StartsWithS")
@@ -0,0 +1,498 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"code.google.com/p/goprotobuf/protoc-gen-go/descriptor"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protobuf data")
+
+type PayloadProtobufDecoderConfig struct {
+	// Compiled FileDescriptorSet describing the payload, as produced by
+	// `protoc --include_imports -o <file>`.
+	DescriptorSet string `toml:"descriptor_set"`
+	// Fully qualified name of the payload's message type, e.g.
+	// "myapp.LoginEvent".
+	MessageType string `toml:"message_type"`
+	// Maps protobuf field paths (nested message fields separated by dots,
+	// e.g. "user.id") to Heka message field names. The names Type, Logger,
+	// Hostname, Payload, Severity, and Pid set the matching message header
+	// instead. If empty, every top level non-message field is added using
+	// its own name.
+	Fields map[string]string
+}
+
+// A protobuf message type reduced to the fields that are decoded.
+type protoMessage struct {
+	fields map[int32]*protoField
+}
+
+type protoField struct {
+	path   string
+	typ    descriptor.FieldDescriptorProto_Type
+	target string
+	// Whether the field, or a message containing it, is repeated. Otherwise
+	// the last value seen wins.
+	repeated bool
+	// Value names for enum fields.
+	enum map[int32]string
+	// Selected fields of message typed fields.
+	nested *protoMessage
+}
+
+// Decoder that parses protobuf payloads of an arbitrary message type, as
+// described by a compiled descriptor set, into message fields.
+type PayloadProtobufDecoder struct {
+	messageType *protoMessage
+	// Target names in the order they're added to the message.
+	targets []string
+	dRunner DecoderRunner
+}
+
+func (pd *PayloadProtobufDecoder) ConfigStruct() interface{} {
+	return new(PayloadProtobufDecoderConfig)
+}
+
+// Indexes the message and enum types in a descriptor set by fully qualified
+// name (with a leading dot, as used in type_name references).
+type protoSchema struct {
+	messages map[string]*descriptor.DescriptorProto
+	enums    map[string]map[int32]string
+}
+
+func (s *protoSchema) addEnums(prefix string, enums []*descriptor.EnumDescriptorProto) {
+	for _, enum := range enums {
+		values := make(map[int32]string)
+		for _, value := range enum.GetValue() {
+			values[value.GetNumber()] = value.GetName()
+		}
+		s.enums[prefix+"."+enum.GetName()] = values
+	}
+}
+
+func (s *protoSchema) addMessages(prefix string, messages []*descriptor.DescriptorProto) {
+	for _, msg := range messages {
+		name := prefix + "." + msg.GetName()
+		s.messages[name] = msg
+		s.addMessages(name, msg.GetNestedType())
+		s.addEnums(name, msg.GetEnumType())
+	}
+}
+
+func loadProtoSchema(filename string) (schema *protoSchema, err error) {
+	var data []byte
+	if data, err = ioutil.ReadFile(filename); err != nil {
+		return
+	}
+	set := new(descriptor.FileDescriptorSet)
+	if err = proto.Unmarshal(data, set); err != nil {
+		return
+	}
+	schema = &protoSchema{
+		messages: make(map[string]*descriptor.DescriptorProto),
+		enums:    make(map[string]map[int32]string),
+	}
+	for _, file := range set.GetFile() {
+		prefix := ""
+		if file.GetPackage() != "" {
+			prefix = "." + file.GetPackage()
+		}
+		schema.addMessages(prefix, file.GetMessageType())
+		schema.addEnums(prefix, file.GetEnumType())
+	}
+	return
+}
+
+// Header targets and whether they take a string (as opposed to an integer)
+// value.
+var protoHeaderTargets = map[string]bool{
+	"Type":     true,
+	"Logger":   true,
+	"Hostname": true,
+	"Payload":  true,
+	"Severity": false,
+	"Pid":      false,
+}
+
+func isProtoIntType(typ descriptor.FieldDescriptorProto_Type) bool {
+	switch typ {
+	case descriptor.FieldDescriptorProto_TYPE_INT32,
+		descriptor.FieldDescriptorProto_TYPE_INT64,
+		descriptor.FieldDescriptorProto_TYPE_UINT32,
+		descriptor.FieldDescriptorProto_TYPE_UINT64,
+		descriptor.FieldDescriptorProto_TYPE_SINT32,
+		descriptor.FieldDescriptorProto_TYPE_SINT64,
+		descriptor.FieldDescriptorProto_TYPE_FIXED32,
+		descriptor.FieldDescriptorProto_TYPE_FIXED64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		return true
+	}
+	return false
+}
+
+// Adds the field at the dotted path to the selected fields of the message.
+func (s *protoSchema) selectField(msg *protoMessage, desc *descriptor.DescriptorProto,
+	path []string, target string, repeated bool) error {
+
+	var fd *descriptor.FieldDescriptorProto
+	for _, f := range desc.GetField() {
+		if f.GetName() == path[0] {
+			fd = f
+			break
+		}
+	}
+	if fd == nil {
+		return fmt.Errorf("message '%s' has no field '%s'", desc.GetName(), path[0])
+	}
+
+	field, ok := msg.fields[fd.GetNumber()]
+	if !ok {
+		field = &protoField{path: path[0], typ: fd.GetType()}
+		msg.fields[fd.GetNumber()] = field
+	}
+	field.repeated = repeated ||
+		fd.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REPEATED
+	switch fd.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		if len(path) == 1 {
+			return fmt.Errorf("field '%s' is a message, select one of its fields",
+				path[0])
+		}
+		nestedDesc, ok := s.messages[fd.GetTypeName()]
+		if !ok {
+			return fmt.Errorf("unknown message type '%s'", fd.GetTypeName())
+		}
+		if field.nested == nil {
+			field.nested = &protoMessage{fields: make(map[int32]*protoField)}
+		}
+		return s.selectField(field.nested, nestedDesc, path[1:], target,
+			field.repeated)
+	case descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return fmt.Errorf("field '%s' is a group, groups aren't supported", path[0])
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		if field.enum, ok = s.enums[fd.GetTypeName()]; !ok {
+			return fmt.Errorf("unknown enum type '%s'", fd.GetTypeName())
+		}
+	}
+	if len(path) > 1 {
+		return fmt.Errorf("field '%s' is not a message", path[0])
+	}
+	if isString, ok := protoHeaderTargets[target]; ok {
+		typ := fd.GetType()
+		if isString && typ != descriptor.FieldDescriptorProto_TYPE_STRING &&
+			typ != descriptor.FieldDescriptorProto_TYPE_ENUM {
+			return fmt.Errorf("field '%s' must be a string to set %s", path[0], target)
+		}
+		if !isString && !isProtoIntType(typ) {
+			return fmt.Errorf("field '%s' must be an integer to set %s", path[0],
+				target)
+		}
+	}
+	field.target = target
+	return nil
+}
+
+func (pd *PayloadProtobufDecoder) Init(config interface{}) (err error) {
+	conf := config.(*PayloadProtobufDecoderConfig)
+	if conf.DescriptorSet == "" || conf.MessageType == "" {
+		return errors.New(
+			"PayloadProtobufDecoder requires `descriptor_set` and `message_type`")
+	}
+	var schema *protoSchema
+	if schema, err = loadProtoSchema(GetHekaConfigDir(conf.DescriptorSet)); err != nil {
+		return fmt.Errorf("PayloadProtobufDecoder can't load descriptor set: %s", err)
+	}
+	typeName := conf.MessageType
+	if !strings.HasPrefix(typeName, ".") {
+		typeName = "." + typeName
+	}
+	desc, ok := schema.messages[typeName]
+	if !ok {
+		return fmt.Errorf("PayloadProtobufDecoder unknown message type: '%s'",
+			conf.MessageType)
+	}
+
+	fields := conf.Fields
+	if len(fields) == 0 {
+		fields = make(map[string]string)
+		for _, fd := range desc.GetField() {
+			switch fd.GetType() {
+			case descriptor.FieldDescriptorProto_TYPE_MESSAGE,
+				descriptor.FieldDescriptorProto_TYPE_GROUP:
+			default:
+				fields[fd.GetName()] = fd.GetName()
+			}
+		}
+	}
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	pd.messageType = &protoMessage{fields: make(map[int32]*protoField)}
+	pd.targets = pd.targets[:0]
+	for _, path := range paths {
+		if err = schema.selectField(pd.messageType, desc, strings.Split(path, "."),
+			fields[path], false); err != nil {
+			return fmt.Errorf("PayloadProtobufDecoder field '%s': %s", path, err)
+		}
+		if !pd.hasTarget(fields[path]) {
+			pd.targets = append(pd.targets, fields[path])
+		}
+	}
+	return
+}
+
+func (pd *PayloadProtobufDecoder) hasTarget(target string) bool {
+	for _, t := range pd.targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Heka will call this to give us access to the runner.
+func (pd *PayloadProtobufDecoder) SetDecoderRunner(dr DecoderRunner) {
+	pd.dRunner = dr
+}
+
+// Reads a varint from the start of data, returning the value and the number
+// of bytes used.
+func readVarint(data []byte) (v uint64, n int, err error) {
+	if v, n = binary.Uvarint(data); n <= 0 {
+		err = errTruncated
+	}
+	return
+}
+
+// Converts a varint or fixed width wire value to its Heka field value.
+func protoScalarValue(field *protoField, v uint64) interface{} {
+	switch field.typ {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE:
+		return math.Float64frombits(v)
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT:
+		return float64(math.Float32frombits(uint32(v)))
+	case descriptor.FieldDescriptorProto_TYPE_BOOL:
+		return v != 0
+	case descriptor.FieldDescriptorProto_TYPE_INT32:
+		return int64(int32(v))
+	case descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		return int64(int32(uint32(v)))
+	case descriptor.FieldDescriptorProto_TYPE_UINT32,
+		descriptor.FieldDescriptorProto_TYPE_FIXED32:
+		return int64(uint32(v))
+	case descriptor.FieldDescriptorProto_TYPE_SINT32:
+		return int64(int32(uint32(v>>1) ^ -uint32(v&1)))
+	case descriptor.FieldDescriptorProto_TYPE_SINT64:
+		return int64(v>>1) ^ -int64(v&1)
+	case descriptor.FieldDescriptorProto_TYPE_ENUM:
+		if name, ok := field.enum[int32(v)]; ok {
+			return name
+		}
+		return int64(int32(v))
+	}
+	// int64, uint64, fixed64, sfixed64
+	return int64(v)
+}
+
+// Reads a single varint or fixed width value of the field's type from the
+// start of data.
+func readProtoScalar(field *protoField, data []byte) (v uint64, n int, err error) {
+	switch field.typ {
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE,
+		descriptor.FieldDescriptorProto_TYPE_FIXED64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		if len(data) < 8 {
+			return 0, 0, errTruncated
+		}
+		return binary.LittleEndian.Uint64(data), 8, nil
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT,
+		descriptor.FieldDescriptorProto_TYPE_FIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		if len(data) < 4 {
+			return 0, 0, errTruncated
+		}
+		return uint64(binary.LittleEndian.Uint32(data)), 4, nil
+	}
+	return readVarint(data)
+}
+
+// Records a decoded value for the field's target.
+func (field *protoField) collect(values map[string][]interface{}, value interface{}) {
+	if field.repeated {
+		values[field.target] = append(values[field.target], value)
+	} else {
+		values[field.target] = []interface{}{value}
+	}
+}
+
+// Walks the wire encoded message, collecting the values of the selected
+// fields by target name.
+func decodeProtoMessage(msg *protoMessage, data []byte,
+	values map[string][]interface{}) error {
+
+	for len(data) > 0 {
+		key, n, err := readVarint(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+		wireType := key & 7
+		field := msg.fields[int32(key>>3)]
+
+		var raw []byte // The field's encoded value.
+		switch wireType {
+		case wireVarint:
+			if _, n, err = readVarint(data); err != nil {
+				return err
+			}
+		case wireFixed64:
+			n = 8
+		case wireFixed32:
+			n = 4
+		case wireBytes:
+			var length uint64
+			if length, n, err = readVarint(data); err != nil {
+				return err
+			}
+			if uint64(len(data)-n) < length {
+				return errTruncated
+			}
+			data = data[n:]
+			n = int(length)
+		default:
+			return fmt.Errorf("unsupported wire type %d", wireType)
+		}
+		if len(data) < n {
+			return errTruncated
+		}
+		raw, data = data[:n], data[n:]
+		if field == nil {
+			continue
+		}
+
+		switch {
+		case field.nested != nil:
+			if wireType != wireBytes {
+				return fmt.Errorf("field '%s' has wrong wire type", field.path)
+			}
+			if err = decodeProtoMessage(field.nested, raw, values); err != nil {
+				return err
+			}
+		case field.typ == descriptor.FieldDescriptorProto_TYPE_STRING:
+			field.collect(values, string(raw))
+		case field.typ == descriptor.FieldDescriptorProto_TYPE_BYTES:
+			field.collect(values, raw)
+		case wireType == wireBytes:
+			// Packed repeated scalars.
+			for len(raw) > 0 {
+				v, n, err := readProtoScalar(field, raw)
+				if err != nil {
+					return err
+				}
+				raw = raw[n:]
+				field.collect(values, protoScalarValue(field, v))
+			}
+		default:
+			v, _, err := readProtoScalar(field, raw)
+			if err != nil {
+				return err
+			}
+			field.collect(values, protoScalarValue(field, v))
+		}
+	}
+	return nil
+}
+
+// Sets a message header from the last decoded value.
+func setProtoHeader(msg *message.Message, target string, value interface{}) {
+	s, _ := value.(string)
+	i, _ := value.(int64)
+	switch target {
+	case "Type":
+		msg.SetType(s)
+	case "Logger":
+		msg.SetLogger(s)
+	case "Hostname":
+		msg.SetHostname(s)
+	case "Payload":
+		msg.SetPayload(s)
+	case "Severity":
+		msg.SetSeverity(int32(i))
+	case "Pid":
+		msg.SetPid(int32(i))
+	}
+}
+
+func (pd *PayloadProtobufDecoder) Decode(pack *PipelinePack) (packs []*PipelinePack,
+	err error) {
+
+	values := make(map[string][]interface{})
+	if err = decodeProtoMessage(pd.messageType, []byte(pack.Message.GetPayload()),
+		values); err != nil {
+		return nil, fmt.Errorf("PayloadProtobufDecoder can't decode payload: %s", err)
+	}
+
+	var field *message.Field
+	for _, target := range pd.targets {
+		vals, ok := values[target]
+		if !ok {
+			continue
+		}
+		if _, ok := protoHeaderTargets[target]; ok {
+			setProtoHeader(pack.Message, target, vals[len(vals)-1])
+			continue
+		}
+		if field, err = message.NewField(target, vals[0], ""); err != nil {
+			return nil, fmt.Errorf("PayloadProtobufDecoder can't add field: %s", err)
+		}
+		for _, value := range vals[1:] {
+			if err = field.AddValue(value); err != nil {
+				return nil, fmt.Errorf("PayloadProtobufDecoder can't add field: %s",
+					err)
+			}
+		}
+		pack.Message.AddField(field)
+	}
+	packs = []*PipelinePack{pack}
+	return
+}
+
+func init() {
+	RegisterPlugin("PayloadProtobufDecoder", func() interface{} {
+		return new(PayloadProtobufDecoder)
+	})
+}
@@ -0,0 +1,208 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package payload
+
+import (
+	"code.google.com/p/goprotobuf/proto"
+	"code.google.com/p/goprotobuf/protoc-gen-go/descriptor"
+	. "github.com/mozilla-services/heka/pipeline"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+func protoFieldDesc(name string, number int32,
+	typ descriptor.FieldDescriptorProto_Type, typeName string,
+	repeated bool) *descriptor.FieldDescriptorProto {
+
+	fd := &descriptor.FieldDescriptorProto{
+		Name:   proto.String(name),
+		Number: proto.Int32(number),
+		Type:   typ.Enum(),
+		Label:  descriptor.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+	}
+	if repeated {
+		fd.Label = descriptor.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	}
+	if typeName != "" {
+		fd.TypeName = proto.String(typeName)
+	}
+	return fd
+}
+
+// Descriptor set for:
+//
+//	package test;
+//	message Event {
+//	  enum Level { INFO = 0; ERROR = 3; }
+//	  message User { optional int64 id = 1; optional string name = 2; }
+//	  optional string type = 1;
+//	  optional Level level = 2;
+//	  optional User user = 3;
+//	  repeated sint32 codes = 4 [packed=true];
+//	  optional double latency = 5;
+//	  optional bytes raw = 6;
+//	}
+func protoTestDescriptorSet() *descriptor.FileDescriptorSet {
+	event := &descriptor.DescriptorProto{
+		Name: proto.String("Event"),
+		Field: []*descriptor.FieldDescriptorProto{
+			protoFieldDesc("type", 1, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+			protoFieldDesc("level", 2, descriptor.FieldDescriptorProto_TYPE_ENUM,
+				".test.Event.Level", false),
+			protoFieldDesc("user", 3, descriptor.FieldDescriptorProto_TYPE_MESSAGE,
+				".test.Event.User", false),
+			protoFieldDesc("codes", 4, descriptor.FieldDescriptorProto_TYPE_SINT32, "", true),
+			protoFieldDesc("latency", 5, descriptor.FieldDescriptorProto_TYPE_DOUBLE, "", false),
+			protoFieldDesc("raw", 6, descriptor.FieldDescriptorProto_TYPE_BYTES, "", false),
+		},
+		NestedType: []*descriptor.DescriptorProto{{
+			Name: proto.String("User"),
+			Field: []*descriptor.FieldDescriptorProto{
+				protoFieldDesc("id", 1, descriptor.FieldDescriptorProto_TYPE_INT64, "", false),
+				protoFieldDesc("name", 2, descriptor.FieldDescriptorProto_TYPE_STRING, "", false),
+			},
+		}},
+		EnumType: []*descriptor.EnumDescriptorProto{{
+			Name: proto.String("Level"),
+			Value: []*descriptor.EnumValueDescriptorProto{
+				{Name: proto.String("INFO"), Number: proto.Int32(0)},
+				{Name: proto.String("ERROR"), Number: proto.Int32(3)},
+			},
+		}},
+	}
+	return &descriptor.FileDescriptorSet{
+		File: []*descriptor.FileDescriptorProto{{
+			Name:        proto.String("test.proto"),
+			Package:     proto.String("test"),
+			MessageType: []*descriptor.DescriptorProto{event},
+		}},
+	}
+}
+
+// Wire encoded test.Event.
+func protoTestEvent() []byte {
+	user := proto.NewBuffer(nil)
+	user.EncodeVarint(1<<3 | 0)
+	user.EncodeVarint(42)
+	user.EncodeVarint(2<<3 | 2)
+	user.EncodeStringBytes("alice")
+
+	codes := proto.NewBuffer(nil)
+	codes.EncodeZigzag32(uint64(7))
+	codes.EncodeZigzag32(uint64(-2 & 0xffffffff))
+
+	event := proto.NewBuffer(nil)
+	event.EncodeVarint(1<<3 | 2)
+	event.EncodeStringBytes("login")
+	event.EncodeVarint(2<<3 | 0)
+	event.EncodeVarint(3)
+	event.EncodeVarint(3<<3 | 2)
+	event.EncodeRawBytes(user.Bytes())
+	event.EncodeVarint(4<<3 | 2)
+	event.EncodeRawBytes(codes.Bytes())
+	event.EncodeVarint(5<<3 | 1)
+	event.EncodeFixed64(math.Float64bits(0.25))
+	// Unknown field, skipped.
+	event.EncodeVarint(9<<3 | 0)
+	event.EncodeVarint(1)
+	return event.Bytes()
+}
+
+func PayloadProtobufDecoderSpec(c gs.Context) {
+	tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+	c.Assume(err, gs.IsNil)
+	defer os.RemoveAll(tmpDir)
+	descFile := filepath.Join(tmpDir, "test.desc")
+	data, err := proto.Marshal(protoTestDescriptorSet())
+	c.Assume(err, gs.IsNil)
+	err = ioutil.WriteFile(descFile, data, 0644)
+	c.Assume(err, gs.IsNil)
+
+	c.Specify("A PayloadProtobufDecoder", func() {
+		decoder := new(PayloadProtobufDecoder)
+		conf := decoder.ConfigStruct().(*PayloadProtobufDecoderConfig)
+		conf.DescriptorSet = descFile
+		conf.MessageType = "test.Event"
+		supply := make(chan *PipelinePack, 1)
+		pack := NewPipelinePack(supply)
+		pack.Message.SetPayload(string(protoTestEvent()))
+
+		c.Specify("rejects unknown types and fields", func() {
+			conf.MessageType = "test.Nope"
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.MessageType = "test.Event"
+			conf.Fields = map[string]string{"user.nope": "nope"}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Fields = map[string]string{"user": "user"}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+			conf.Fields = map[string]string{"latency": "Hostname"}
+			c.Expect(decoder.Init(conf), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("decodes the top level fields by default", func() {
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			packs, err := decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(packs), gs.Equals, 1)
+
+			value, _ := pack.Message.GetFieldValue("type")
+			c.Expect(value, gs.Equals, "login")
+			value, _ = pack.Message.GetFieldValue("level")
+			c.Expect(value, gs.Equals, "ERROR")
+			value, _ = pack.Message.GetFieldValue("latency")
+			c.Expect(value, gs.Equals, 0.25)
+			fields := pack.Message.FindAllFields("codes")
+			c.Assume(len(fields), gs.Equals, 1)
+			c.Expect(len(fields[0].ValueInteger), gs.Equals, 2)
+			c.Expect(fields[0].ValueInteger[0], gs.Equals, int64(7))
+			c.Expect(fields[0].ValueInteger[1], gs.Equals, int64(-2))
+			c.Expect(len(pack.Message.FindAllFields("user")), gs.Equals, 0)
+			c.Expect(len(pack.Message.FindAllFields("raw")), gs.Equals, 0)
+		})
+
+		c.Specify("maps selected and nested fields", func() {
+			conf.Fields = map[string]string{
+				"type":      "Type",
+				"user.id":   "UserId",
+				"user.name": "UserName",
+			}
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			_, err = decoder.Decode(pack)
+			c.Expect(err, gs.IsNil)
+
+			c.Expect(pack.Message.GetType(), gs.Equals, "login")
+			value, _ := pack.Message.GetFieldValue("UserId")
+			c.Expect(value, gs.Equals, int64(42))
+			value, _ = pack.Message.GetFieldValue("UserName")
+			c.Expect(value, gs.Equals, "alice")
+			c.Expect(len(pack.Message.FindAllFields("type")), gs.Equals, 0)
+			c.Expect(len(pack.Message.FindAllFields("level")), gs.Equals, 0)
+		})
+
+		c.Specify("fails on truncated data", func() {
+			err := decoder.Init(conf)
+			c.Assume(err, gs.IsNil)
+			event := protoTestEvent()
+			pack.Message.SetPayload(string(event[:len(event)-6]))
+			_, err = decoder.Decode(pack)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+}
@@ -0,0 +1,291 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package probe
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Result of probing a single target.
+type ProbeResult struct {
+	Target    string
+	Protocol  string
+	Available bool
+	// Round trip (icmp) or connect (tcp) time in seconds.
+	Latency float64
+	Err     error
+}
+
+type probeTarget struct {
+	spec     string
+	protocol string
+	address  string
+}
+
+// Periodically checks the reachability of a set of hosts, either by sending
+// an ICMP echo request or by opening a TCP connection, and emits one message
+// per target describing the outcome.
+type ProbeInput struct {
+	name     string
+	conf     *ProbeInputConfig
+	targets  []*probeTarget
+	timeout  time.Duration
+	stopChan chan bool
+	seq      uint16
+}
+
+// ProbeInput config struct
+type ProbeInputConfig struct {
+	// Targets to probe, in the form "tcp://host:port" or "icmp://host".
+	Targets []string
+	// Interval at which the targets are probed. Default is 10 seconds.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Time to wait for a response, in milliseconds. Default is 2000.
+	Timeout uint
+	// Severity level of successful probes. Default is 6 (information)
+	SuccessSeverity int32 `toml:"success_severity"`
+	// Severity level of failed probes. Default is 1 (alert)
+	ErrorSeverity int32 `toml:"error_severity"`
+}
+
+func (pi *ProbeInput) SetName(name string) {
+	pi.name = name
+}
+
+func (pi *ProbeInput) ConfigStruct() interface{} {
+	return &ProbeInputConfig{
+		TickerInterval:  uint(10),
+		Timeout:         uint(2000),
+		SuccessSeverity: int32(6),
+		ErrorSeverity:   int32(1),
+	}
+}
+
+func parseProbeTarget(spec string) (target *probeTarget, err error) {
+	parts := strings.SplitN(spec, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid target '%s', expected 'protocol://address'",
+			spec)
+	}
+	target = &probeTarget{spec: spec, protocol: parts[0], address: parts[1]}
+	switch target.protocol {
+	case "tcp":
+		if _, _, err = net.SplitHostPort(target.address); err != nil {
+			return nil, fmt.Errorf("invalid tcp target '%s': %s", spec, err)
+		}
+	case "icmp":
+	default:
+		return nil, fmt.Errorf("unsupported protocol for target '%s'", spec)
+	}
+	return
+}
+
+func (pi *ProbeInput) Init(config interface{}) (err error) {
+	pi.conf = config.(*ProbeInputConfig)
+	if len(pi.conf.Targets) == 0 {
+		return errors.New("targets must contain at least one target")
+	}
+	if pi.conf.TickerInterval == 0 {
+		return errors.New("ticker_interval must be greater than zero")
+	}
+	if pi.conf.Timeout == 0 {
+		return errors.New("timeout must be greater than zero")
+	}
+	pi.targets = make([]*probeTarget, 0, len(pi.conf.Targets))
+	for _, spec := range pi.conf.Targets {
+		var target *probeTarget
+		if target, err = parseProbeTarget(spec); err != nil {
+			return
+		}
+		pi.targets = append(pi.targets, target)
+	}
+	pi.timeout = time.Duration(pi.conf.Timeout) * time.Millisecond
+	pi.stopChan = make(chan bool)
+	return
+}
+
+// Probes all of the targets concurrently, so a single unreachable host
+// doesn't hold up the results for the others.
+func (pi *ProbeInput) probeAll() []*ProbeResult {
+	results := make([]*ProbeResult, len(pi.targets))
+	var wg sync.WaitGroup
+	for i, target := range pi.targets {
+		pi.seq++
+		wg.Add(1)
+		go func(i int, target *probeTarget, seq uint16) {
+			results[i] = pi.probe(target, seq)
+			wg.Done()
+		}(i, target, pi.seq)
+	}
+	wg.Wait()
+	return results
+}
+
+func (pi *ProbeInput) probe(target *probeTarget, seq uint16) *ProbeResult {
+	result := &ProbeResult{Target: target.spec, Protocol: target.protocol}
+	start := time.Now()
+	switch target.protocol {
+	case "tcp":
+		var conn net.Conn
+		if conn, result.Err = net.DialTimeout("tcp", target.address,
+			pi.timeout); result.Err == nil {
+			conn.Close()
+		}
+	case "icmp":
+		result.Err = icmpEcho(target.address, pi.timeout, seq)
+	}
+	result.Latency = time.Since(start).Seconds()
+	result.Available = result.Err == nil
+	return result
+}
+
+func (pi *ProbeInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	var pack *PipelinePack
+
+	hostname := h.PipelineConfig().Hostname()
+	packSupply := ir.InChan()
+	ticker := ir.Ticker()
+
+	for {
+		select {
+		case <-ticker:
+			for _, result := range pi.probeAll() {
+				pack = <-packSupply
+				pi.populatePack(pack, result, hostname, ir)
+				ir.Inject(pack)
+			}
+		case <-pi.stopChan:
+			return
+		}
+	}
+}
+
+func (pi *ProbeInput) populatePack(pack *PipelinePack, result *ProbeResult,
+	hostname string, ir InputRunner) {
+
+	pack.Message.SetUuid(uuid.NewRandom())
+	pack.Message.SetTimestamp(time.Now().UnixNano())
+	pack.Message.SetType("heka.probe")
+	StampIdentity(pack.Message, hostname)
+	pack.Message.SetLogger(pi.name)
+	if result.Available {
+		pack.Message.SetSeverity(pi.conf.SuccessSeverity)
+	} else {
+		pack.Message.SetSeverity(pi.conf.ErrorSeverity)
+		pack.Message.SetPayload(result.Err.Error())
+	}
+	fields := []struct {
+		name  string
+		value interface{}
+		repr  string
+	}{
+		{"Target", result.Target, ""},
+		{"Protocol", result.Protocol, ""},
+		{"Available", result.Available, ""},
+		{"Latency", result.Latency, "s"},
+	}
+	for _, f := range fields {
+		if field, err := message.NewField(f.name, f.value, f.repr); err == nil {
+			pack.Message.AddField(field)
+		} else {
+			ir.LogError(fmt.Errorf("can't add field: %s", err))
+		}
+	}
+}
+
+func (pi *ProbeInput) Stop() {
+	close(pi.stopChan)
+}
+
+// Computes the internet checksum (RFC 1071) of an ICMP message.
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// Sends a single ICMP echo request to the host and waits for the matching
+// reply. Requires permission to open raw sockets, i.e. root or CAP_NET_RAW.
+func icmpEcho(host string, timeout time.Duration, seq uint16) (err error) {
+	var conn net.Conn
+	if conn, err = net.DialTimeout("ip4:icmp", host, timeout); err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	id := uint16(os.Getpid() & 0xffff)
+	msg := []byte{8, 0, 0, 0, byte(id >> 8), byte(id), byte(seq >> 8), byte(seq),
+		'h', 'e', 'k', 'a'}
+	csum := icmpChecksum(msg)
+	msg[2], msg[3] = byte(csum>>8), byte(csum)
+	if _, err = conn.Write(msg); err != nil {
+		return
+	}
+
+	reply := make([]byte, 1500)
+	var n int
+	for {
+		if n, err = conn.Read(reply); err != nil {
+			return
+		}
+		// Raw sockets see all ICMP traffic, skip anything that isn't the
+		// echo reply to our own request.
+		if isEchoReply(reply[:n], id, seq) {
+			return nil
+		}
+	}
+}
+
+// Returns true if the packet read from an `ip4:icmp` connection is the echo
+// reply with the given id and sequence number. Reads on Linux return the
+// packet with its IPv4 header, which is skipped.
+func isEchoReply(packet []byte, id, seq uint16) bool {
+	if len(packet) > 0 && packet[0]>>4 == 4 {
+		headerLen := int(packet[0]&0x0f) * 4
+		if headerLen < 20 || len(packet) < headerLen {
+			return false
+		}
+		packet = packet[headerLen:]
+	}
+	if len(packet) < 8 || packet[0] != 0 {
+		return false
+	}
+	return uint16(packet[4])<<8|uint16(packet[5]) == id &&
+		uint16(packet[6])<<8|uint16(packet[7]) == seq
+}
+
+func init() {
+	RegisterPlugin("ProbeInput", func() interface{} {
+		return new(ProbeInput)
+	})
+}
@@ -0,0 +1,150 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package probe
+
+import (
+	"code.google.com/p/gomock/gomock"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"time"
+)
+
+func ProbeInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("A ProbeInput", func() {
+		input := new(ProbeInput)
+		input.SetName("probe")
+		config := input.ConfigStruct().(*ProbeInputConfig)
+		config.Timeout = 500
+
+		c.Specify("rejects invalid targets", func() {
+			config.Targets = []string{"udp://localhost:53"}
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+			config.Targets = []string{"tcp://localhost"}
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+			config.Targets = []string{}
+			c.Expect(input.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("reports tcp availability and latency", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			openAddr := listener.Addr().String()
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					conn.Close()
+				}
+			}()
+			closed, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			closedAddr := closed.Addr().String()
+			closed.Close()
+			defer listener.Close()
+
+			config.Targets = []string{"tcp://" + openAddr, "tcp://" + closedAddr}
+			err = input.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+			mockRunner := pipelinemock.NewMockInputRunner(ctrl)
+			packSupply := make(chan *PipelinePack, 2)
+			for i := 0; i < 2; i++ {
+				packSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+			}
+			tickChan := make(chan time.Time)
+			injected := make(chan *PipelinePack, 2)
+
+			mockHelper.EXPECT().PipelineConfig().Return(pConfig)
+			mockRunner.EXPECT().InChan().Return(packSupply)
+			mockRunner.EXPECT().Ticker().Return(tickChan)
+			mockRunner.EXPECT().Inject(gomock.Any()).Times(2).Do(func(pack *PipelinePack) {
+				injected <- pack
+			})
+
+			done := make(chan error)
+			go func() {
+				done <- input.Run(mockRunner, mockHelper)
+			}()
+			tickChan <- time.Now()
+
+			results := make(map[string]*PipelinePack)
+			for i := 0; i < 2; i++ {
+				pack := <-injected
+				target, _ := pack.Message.GetFieldValue("Target")
+				results[target.(string)] = pack
+			}
+
+			pack := results["tcp://"+openAddr]
+			c.Expect(pack.Message.GetType(), gs.Equals, "heka.probe")
+			c.Expect(pack.Message.GetLogger(), gs.Equals, "probe")
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(6))
+			available, _ := pack.Message.GetFieldValue("Available")
+			c.Expect(available, gs.Equals, true)
+			latency, _ := pack.Message.GetFieldValue("Latency")
+			c.Expect(latency.(float64) >= 0, gs.IsTrue)
+			protocol, _ := pack.Message.GetFieldValue("Protocol")
+			c.Expect(protocol, gs.Equals, "tcp")
+
+			pack = results["tcp://"+closedAddr]
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(1))
+			available, _ = pack.Message.GetFieldValue("Available")
+			c.Expect(available, gs.Equals, false)
+			c.Expect(pack.Message.GetPayload(), gs.Not(gs.Equals), "")
+
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+		})
+	})
+
+	c.Specify("computes ICMP checksums", func() {
+		msg := []byte{8, 0, 0, 0, 0, 1, 0, 1}
+		csum := icmpChecksum(msg)
+		msg[2], msg[3] = byte(csum>>8), byte(csum)
+		c.Expect(icmpChecksum(msg), gs.Equals, uint16(0))
+	})
+
+	c.Specify("recognizes echo replies", func() {
+		// Echo reply for id 0x1234 and sequence 7 from 127.0.0.1, as read
+		// from a raw socket on Linux, IPv4 header first.
+		packet := []byte{
+			0x45, 0x00, 0x00, 0x20, 0xbe, 0xef, 0x00, 0x00,
+			0x40, 0x01, 0xbd, 0xeb, 0x7f, 0x00, 0x00, 0x01,
+			0x7f, 0x00, 0x00, 0x01,
+			0x00, 0x00, 0x19, 0xfe, 0x12, 0x34, 0x00, 0x07,
+			'h', 'e', 'k', 'a',
+		}
+		c.Expect(icmpChecksum(packet[20:]), gs.Equals, uint16(0))
+		c.Expect(isEchoReply(packet, 0x1234, 7), gs.IsTrue)
+		c.Expect(isEchoReply(packet[20:], 0x1234, 7), gs.IsTrue)
+		c.Expect(isEchoReply(packet, 0x1234, 8), gs.IsFalse)
+		c.Expect(isEchoReply(packet[:24], 0x1234, 7), gs.IsFalse)
+
+		// Our own echo request, also seen by the raw socket.
+		packet[20] = 8
+		c.Expect(isEchoReply(packet, 0x1234, 7), gs.IsFalse)
+	})
+}
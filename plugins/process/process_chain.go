@@ -20,6 +20,7 @@ import (
 	"io"
 	"os/exec"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -135,6 +136,8 @@ func (mc *ManagedCmd) Start(redirectToChannels bool) (err error) {
 		}()
 	}
 
+	mc.Cmd.Env = mc.Env
+	mc.Cmd.Dir = mc.Dir
 	return mc.Cmd.Start()
 }
 
@@ -198,6 +201,8 @@ func (mc *ManagedCmd) kill() (err error) {
 // Usually so that a chain can be restarted.
 func (mc *ManagedCmd) clone() (clone *ManagedCmd) {
 	clone = NewManagedCmd(mc.Path, mc.Args, mc.timeout_duration)
+	clone.Env = mc.Env
+	clone.Dir = mc.Dir
 	return clone
 }
 
@@ -328,11 +333,42 @@ func (cc *CommandChain) Wait() (err error) {
 func (cc *CommandChain) clone() (clone *CommandChain) {
 	clone = NewCommandChain(cc.timeout_duration)
 	for _, cmd := range cc.Cmds {
-		clone.AddStep(cmd.Path, cmd.Args...)
+		step := clone.AddStep(cmd.Path, cmd.Args...)
+		step.Env = cmd.Env
+		step.Dir = cmd.Dir
 	}
 	return clone
 }
 
+// ExitStatus returns the exit status of the last command in the chain once
+// the chain has been waited on, or -1 if the command didn't exit normally
+// (e.g. it was killed after timing out).
+func (cc *CommandChain) ExitStatus() int {
+	if len(cc.Cmds) == 0 {
+		return -1
+	}
+	state := cc.Cmds[len(cc.Cmds)-1].ProcessState
+	if state == nil {
+		return -1
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok {
+		return status.ExitStatus()
+	}
+	if state.Success() {
+		return 0
+	}
+	return -1
+}
+
+// String returns the chain in shell pipeline syntax.
+func (cc *CommandChain) String() string {
+	steps := make([]string, len(cc.Cmds))
+	for i, cmd := range cc.Cmds {
+		steps[i] = strings.Join(append([]string{cmd.Path}, cmd.Args...), " ")
+	}
+	return strings.Join(steps, " | ")
+}
+
 type StringChannelReader struct {
 	input  chan string
 	buffer string
@@ -220,7 +220,7 @@ func ProcessChainSpec(c gs.Context) {
 			var err error
 
 			chain := NewCommandChain(0)
-			chain.AddStep(PIPE_CMD1, PIPE_CMD1_ARGS...)
+			chain.AddStep(PIPE_CMD1, PIPE_CMD1_ARGS...).Dir = "."
 			chain.AddStep(PIPE_CMD2, PIPE_CMD2_ARGS...)
 
 			stdout_chan, err := chain.StdoutChan()
@@ -242,8 +242,11 @@ func ProcessChainSpec(c gs.Context) {
 			c.Expect(<-stderr_result, gs.Equals, "")
 			c.Expect(<-stdout_result, gs.Equals, PIPE_CMD_OUTPUT)
 
+			c.Expect(chain.ExitStatus(), gs.Equals, 0)
+
 			// Reset the chain for a second run
 			chain = chain.clone()
+			c.Expect(chain.Cmds[0].Dir, gs.Equals, ".")
 
 			stdout_chan, err = chain.StdoutChan()
 			c.Expect(err, gs.IsNil)
@@ -22,9 +22,11 @@ import (
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,7 +37,7 @@ type cmd_config struct {
 	Args []string
 
 	// Enviroment variables
-	Env []string
+	Env []string `toml:"environment"`
 
 	// Dir specifies the working directory of Command.  Defaults to
 	// the directory where the program resides.
@@ -78,6 +80,21 @@ type ProcessInputConfig struct {
 
 	ParseStdout bool `toml:"stdout"`
 	ParseStderr bool `toml:"stderr"`
+
+	// Stream the output through the parser as the commands run, one message
+	// per record. When false each run's complete output is sent as a single
+	// message per stream, with the exit status, duration and command as
+	// fields. Defaults to true.
+	Stream bool
+}
+
+// Complete output of one stream of a command chain run, sent when the output
+// isn't streamed.
+type processRun struct {
+	stream     string
+	output     string
+	exitStatus int
+	duration   time.Duration
 }
 
 // Heka Input plugin that runs external programs and processes their
@@ -94,6 +111,7 @@ type ProcessInput struct {
 
 	stdoutChan chan string
 	stderrChan chan string
+	runChan    chan *processRun
 
 	stopChan chan bool
 	parser   StreamParser
@@ -102,7 +120,9 @@ type ProcessInput struct {
 	heka_pid     int32
 	tickInterval uint
 
-	trim bool
+	trim    bool
+	stream  bool
+	command string
 }
 
 // ConfigStruct implements the HasConfigStruct interface and sets
@@ -115,6 +135,7 @@ func (pi *ProcessInput) ConfigStruct() interface{} {
 		ParseStdout:    true,
 		ParseStderr:    false,
 		Trim:           true,
+		Stream:         true,
 	}
 }
 
@@ -124,9 +145,11 @@ func (pi *ProcessInput) Init(config interface{}) (err error) {
 
 	pi.stdoutChan = make(chan string)
 	pi.stderrChan = make(chan string)
+	pi.runChan = make(chan *processRun)
 	pi.stopChan = make(chan bool)
 
 	pi.trim = conf.Trim
+	pi.stream = conf.Stream
 
 	if conf.Name == "" {
 		return fmt.Errorf("Name field is required for ProcessInput plugin")
@@ -161,6 +184,7 @@ func (pi *ProcessInput) Init(config interface{}) (err error) {
 		}
 	}
 
+	pi.command = pi.cc.String()
 	pi.decoderName = conf.Decoder
 
 	switch conf.ParserType {
@@ -189,11 +213,7 @@ func (pi *ProcessInput) Init(config interface{}) (err error) {
 		return fmt.Errorf("unknown parser type: %s", conf.ParserType)
 	}
 
-	hostname, err := os.Hostname()
-	if err != nil {
-		return err
-	}
-	pi.hostname = hostname
+	pi.hostname = Globals().Hostname
 
 	pi.heka_pid = int32(os.Getpid())
 
@@ -223,6 +243,14 @@ func (pi *ProcessInput) Run(ir InputRunner, h PluginHelper) error {
 	// Start the output parser and start running commands.
 	go pi.RunCmd()
 
+	deliver := func(pack *PipelinePack) {
+		if router_shortcircuit {
+			pConfig.Router().InChan() <- pack
+		} else {
+			dRunner.InChan() <- pack
+		}
+	}
+
 	packSupply := ir.InChan()
 	// Wait for and route populated PipelinePacks.
 	for {
@@ -230,22 +258,18 @@ func (pi *ProcessInput) Run(ir InputRunner, h PluginHelper) error {
 		case data := <-pi.stdoutChan:
 			pack = <-packSupply
 			pi.writeToPack(data, pack, "stdout")
-
-			if router_shortcircuit {
-				pConfig.Router().InChan() <- pack
-			} else {
-				dRunner.InChan() <- pack
-			}
+			deliver(pack)
 
 		case data := <-pi.stderrChan:
 			pack = <-packSupply
 			pi.writeToPack(data, pack, "stderr")
+			deliver(pack)
 
-			if router_shortcircuit {
-				pConfig.Router().InChan() <- pack
-			} else {
-				dRunner.InChan() <- pack
-			}
+		case run := <-pi.runChan:
+			pack = <-packSupply
+			pi.writeToPack(run.output, pack, run.stream)
+			pi.addRunFields(run, pack)
+			deliver(pack)
 
 		case <-pi.stopChan:
 			return nil
@@ -262,7 +286,7 @@ func (pi *ProcessInput) writeToPack(data string, pack *PipelinePack, stream_name
 	pack.Message.SetSeverity(int32(0))
 	pack.Message.SetEnvVersion("0.8")
 	pack.Message.SetPid(pi.heka_pid)
-	pack.Message.SetHostname(pi.hostname)
+	StampIdentity(pack.Message, pi.hostname)
 	pack.Message.SetLogger(pi.ir.Name())
 	pack.Message.SetPayload(data)
 	if fPInputName, err := message.NewField("ProcessInputName",
@@ -274,6 +298,18 @@ func (pi *ProcessInput) writeToPack(data string, pack *PipelinePack, stream_name
 	}
 }
 
+// Adds the outcome of a (non-streamed) command chain run to the message.
+func (pi *ProcessInput) addRunFields(run *processRun, pack *PipelinePack) {
+	message.NewInt64Field(pack.Message, "ExitStatus", int64(run.exitStatus), "")
+	if field, err := message.NewField("Duration", run.duration.Seconds(),
+		"s"); err == nil {
+		pack.Message.AddField(field)
+	} else {
+		pi.ir.LogError(err)
+	}
+	message.NewStringField(pack.Message, "Command", pi.command)
+}
+
 func (pi *ProcessInput) Stop() {
 	// This will shutdown the ProcessInput::RunCmd goroutine
 	close(pi.stopChan)
@@ -328,13 +364,32 @@ func (pi *ProcessInput) runOnce() {
 	stdout_reader := &StringChannelReader{input: stdout_chan}
 	stderr_reader := &StringChannelReader{input: stderr_chan}
 
+	var (
+		stdout, stderr []byte
+		readWg         sync.WaitGroup
+	)
+	readAll := func(r io.Reader, output *[]byte) {
+		*output, _ = ioutil.ReadAll(r)
+		readWg.Done()
+	}
 	if pi.parseStdout {
-		go pi.ParseOutput(stdout_reader, pi.stdoutChan)
+		if pi.stream {
+			go pi.ParseOutput(stdout_reader, pi.stdoutChan)
+		} else {
+			readWg.Add(1)
+			go readAll(stdout_reader, &stdout)
+		}
 	}
 	if pi.parseStderr {
-		go pi.ParseOutput(stderr_reader, pi.stderrChan)
+		if pi.stream {
+			go pi.ParseOutput(stderr_reader, pi.stderrChan)
+		} else {
+			readWg.Add(1)
+			go readAll(stderr_reader, &stderr)
+		}
 	}
 
+	start := time.Now()
 	err = pi.cc.Start()
 	if err != nil {
 		pi.ir.LogError(fmt.Errorf("%s CommandChain::Start() error: [%s]", pi.ProcessName, err.Error()))
@@ -344,6 +399,34 @@ func (pi *ProcessInput) runOnce() {
 	if err != nil {
 		pi.ir.LogError(fmt.Errorf("%s CommandChain::Wait() error: [%s]", pi.ProcessName, err.Error()))
 	}
+	if pi.stream {
+		return
+	}
+
+	readWg.Wait()
+	duration := time.Since(start)
+	exitStatus := pi.cc.ExitStatus()
+	send := func(stream string, output []byte) {
+		if pi.trim {
+			output = bytes.TrimRight(output, "\n")
+		}
+		run := &processRun{
+			stream:     stream,
+			output:     string(output),
+			exitStatus: exitStatus,
+			duration:   duration,
+		}
+		select {
+		case pi.runChan <- run:
+		case <-pi.stopChan:
+		}
+	}
+	if pi.parseStdout {
+		send("stdout", stdout)
+	}
+	if pi.parseStderr {
+		send("stderr", stderr)
+	}
 }
 
 func (pi *ProcessInput) ParseOutput(r io.Reader, outputChannel chan string) {
@@ -23,6 +23,7 @@ import (
 	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
 	"runtime"
+	"strings"
 	"time"
 )
 
@@ -106,6 +107,36 @@ func ProcessInputSpec(c gs.Context) {
 			pInput.Stop()
 		})
 
+		c.Specify("sends the complete output of each run", func() {
+			config.Name = "WholeOutput"
+			config.Decoder = "RegexpDecoder"
+			config.Stream = false
+			config.Command["0"] = cmd_config{Bin: PROCESSINPUT_TEST1_CMD, Args: PROCESSINPUT_TEST1_CMD_ARGS}
+			err := pInput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			go func() {
+				pInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			tickChan <- time.Now()
+
+			ith.PackSupply <- ith.Pack
+			packRef := <-ith.DecodeChan
+			c.Expect(*packRef.Message.Payload, gs.Equals,
+				strings.Join(PROCESSINPUT_TEST1_OUTPUT, ""))
+			fPInputName := packRef.Message.FindFirstField("ProcessInputName")
+			c.Expect(fPInputName.ValueString[0], gs.Equals, "WholeOutput.stdout")
+			exitStatus, _ := packRef.Message.GetFieldValue("ExitStatus")
+			c.Expect(exitStatus, gs.Equals, int64(0))
+			duration, _ := packRef.Message.GetFieldValue("Duration")
+			c.Expect(duration.(float64) > 0, gs.IsTrue)
+			command, _ := packRef.Message.GetFieldValue("Command")
+			c.Expect(command, gs.Equals, strings.Join(append([]string{
+				PROCESSINPUT_TEST1_CMD}, PROCESSINPUT_TEST1_CMD_ARGS...), " "))
+
+			pInput.Stop()
+		})
+
 		c.Specify("handles bad arguments", func() {
 
 			config.Name = "BadArgs"
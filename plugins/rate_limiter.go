@@ -0,0 +1,153 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"sync"
+	"time"
+)
+
+// Token bucket limiting the rate at which an output sends bytes. The bucket
+// holds up to `burst` bytes worth of tokens and refills at `rate` bytes per
+// second. Sending more than is available puts the bucket in debt, and the
+// sender waits until the debt is paid off, so sends larger than the burst
+// size are still allowed.
+type ByteRateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+	// Totals since the last report.
+	reportBytes int64
+	reportWait  time.Duration
+	reportStart time.Time
+	// Replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// Creates a limiter allowing `rate` bytes per second on average, in bursts of
+// up to `burst` bytes. A burst of zero or less means one second's worth.
+func NewByteRateLimiter(rate, burst int64) (l *ByteRateLimiter) {
+	if burst <= 0 {
+		burst = rate
+	}
+	l = &ByteRateLimiter{
+		rate:  float64(rate),
+		burst: float64(burst),
+		now:   time.Now,
+		sleep: time.Sleep,
+	}
+	l.last = l.now()
+	l.reportStart = l.last
+	l.tokens = l.burst
+	return
+}
+
+// Takes `n` bytes worth of tokens from the bucket, blocking until the bucket
+// is out of debt.
+func (l *ByteRateLimiter) Wait(n int) {
+	l.lock.Lock()
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	l.reportBytes += int64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+		l.reportWait += wait
+	}
+	l.lock.Unlock()
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// Adds the limiter's settings and current utilization to a report message:
+// the configured limit, the average rate since the previous report, how much
+// of the limit that rate uses, and how long the output was held back.
+func (l *ByteRateLimiter) ReportMsg(msg *message.Message) {
+	l.lock.Lock()
+	now := l.now()
+	var rate float64
+	if elapsed := now.Sub(l.reportStart).Seconds(); elapsed > 0 {
+		rate = float64(l.reportBytes) / elapsed
+	}
+	wait := l.reportWait
+	l.reportBytes = 0
+	l.reportWait = 0
+	l.reportStart = now
+	l.lock.Unlock()
+
+	message.NewInt64Field(msg, "RateLimit", int64(l.rate), "B/s")
+	message.NewInt64Field(msg, "SendRate", int64(rate), "B/s")
+	message.NewIntField(msg, "RateLimitUtilization", int(rate*100/l.rate), "%")
+	message.NewInt64Field(msg, "RateLimitWait", wait.Nanoseconds(), "ns")
+}
+
+// Returns a Writer that waits on the limiter before each write to `w`.
+func (l *ByteRateLimiter) Writer(w io.Writer) io.Writer {
+	return &rateLimitedWriter{w, l}
+}
+
+// Returns a Reader that waits on the limiter after each read from `r`, for
+// limiting request bodies that are sent as they're read.
+func (l *ByteRateLimiter) Reader(r io.Reader) io.Reader {
+	return &rateLimitedReader{r, l}
+}
+
+// ReaderAt version of `Reader`.
+func (l *ByteRateLimiter) ReaderAt(r io.ReaderAt) io.ReaderAt {
+	return &rateLimitedReaderAt{r, l}
+}
+
+type rateLimitedWriter struct {
+	w io.Writer
+	l *ByteRateLimiter
+}
+
+func (rw *rateLimitedWriter) Write(p []byte) (int, error) {
+	rw.l.Wait(len(p))
+	return rw.w.Write(p)
+}
+
+type rateLimitedReader struct {
+	r io.Reader
+	l *ByteRateLimiter
+}
+
+func (rr *rateLimitedReader) Read(p []byte) (n int, err error) {
+	n, err = rr.r.Read(p)
+	rr.l.Wait(n)
+	return
+}
+
+type rateLimitedReaderAt struct {
+	r io.ReaderAt
+	l *ByteRateLimiter
+}
+
+func (rr *rateLimitedReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	n, err = rr.r.ReadAt(p, off)
+	rr.l.Wait(n)
+	return
+}
@@ -0,0 +1,92 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"bytes"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"time"
+)
+
+func ByteRateLimiterSpec(c gs.Context) {
+	c.Specify("A ByteRateLimiter", func() {
+		// Fake clock, sleeping just moves it forward.
+		now := time.Unix(1000, 0)
+		var slept time.Duration
+		limiter := NewByteRateLimiter(1000, 500)
+		limiter.now = func() time.Time { return now }
+		limiter.sleep = func(d time.Duration) {
+			slept += d
+			now = now.Add(d)
+		}
+		limiter.last = now
+		limiter.reportStart = now
+
+		c.Specify("allows a burst without waiting", func() {
+			limiter.Wait(300)
+			limiter.Wait(200)
+			c.Expect(slept, gs.Equals, time.Duration(0))
+
+			c.Specify("then waits for the tokens to refill", func() {
+				limiter.Wait(250)
+				c.Expect(slept, gs.Equals, 250*time.Millisecond)
+				now = now.Add(100 * time.Millisecond)
+				limiter.Wait(100)
+				c.Expect(slept, gs.Equals, 250*time.Millisecond)
+			})
+		})
+
+		c.Specify("lets sends larger than the burst through", func() {
+			limiter.Wait(2500)
+			c.Expect(slept, gs.Equals, 2*time.Second)
+		})
+
+		c.Specify("doesn't save up more than the burst", func() {
+			now = now.Add(time.Hour)
+			limiter.Wait(1000)
+			c.Expect(slept, gs.Equals, 500*time.Millisecond)
+		})
+
+		c.Specify("limits writes and reads", func() {
+			buf := new(bytes.Buffer)
+			w := limiter.Writer(buf)
+			w.Write(make([]byte, 1500))
+			c.Expect(slept, gs.Equals, time.Second)
+			c.Expect(buf.Len(), gs.Equals, 1500)
+
+			data, err := ioutil.ReadAll(limiter.Reader(buf))
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(data), gs.Equals, 1500)
+			c.Expect(slept, gs.Equals, 2500*time.Millisecond)
+		})
+
+		c.Specify("reports its utilization", func() {
+			limiter.Wait(1500)
+			now = now.Add(time.Second)
+			msg := new(message.Message)
+			limiter.ReportMsg(msg)
+			value, _ := msg.GetFieldValue("RateLimit")
+			c.Expect(value, gs.Equals, int64(1000))
+			value, _ = msg.GetFieldValue("SendRate")
+			c.Expect(value, gs.Equals, int64(750))
+			value, _ = msg.GetFieldValue("RateLimitUtilization")
+			c.Expect(value, gs.Equals, int64(75))
+			value, _ = msg.GetFieldValue("RateLimitWait")
+			c.Expect(value, gs.Equals, time.Second.Nanoseconds())
+		})
+	})
+}
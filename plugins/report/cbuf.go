@@ -0,0 +1,112 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package report
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Describes a circular buffer column, as found in the cbuf header.
+type CbufColumnInfo struct {
+	Name        string `json:"name"`
+	Unit        string `json:"unit"`
+	Aggregation string `json:"aggregation"`
+}
+
+// Header line of the sandbox circular buffer output.
+type CbufHeader struct {
+	// Time of the first row, in seconds since the epoch.
+	Time          int64            `json:"time"`
+	Rows          int              `json:"rows"`
+	Columns       int              `json:"columns"`
+	SecondsPerRow int64            `json:"seconds_per_row"`
+	ColumnInfo    []CbufColumnInfo `json:"column_info"`
+}
+
+// Circular buffer parsed from a sandbox `cbuf` payload, i.e. a JSON header
+// (optionally preceded by an annotations line) followed by one line of tab
+// separated values per row, oldest first. Missing values are NaN.
+type CircularBuffer struct {
+	Header CbufHeader
+	Rows   [][]float64
+}
+
+func ParseCircularBuffer(payload string) (cb *CircularBuffer, err error) {
+	lines := strings.Split(strings.TrimRight(payload, "\n"), "\n")
+	var first struct {
+		Annotations json.RawMessage `json:"annotations"`
+	}
+	if err = json.Unmarshal([]byte(lines[0]), &first); err != nil {
+		return nil, fmt.Errorf("invalid cbuf header: %s", err)
+	}
+	if first.Annotations != nil {
+		lines = lines[1:]
+		if len(lines) == 0 {
+			return nil, errors.New("missing cbuf header")
+		}
+	}
+
+	cb = new(CircularBuffer)
+	if err = json.Unmarshal([]byte(lines[0]), &cb.Header); err != nil {
+		return nil, fmt.Errorf("invalid cbuf header: %s", err)
+	}
+	if cb.Header.Columns != len(cb.Header.ColumnInfo) {
+		return nil, fmt.Errorf("cbuf header has %d columns but describes %d",
+			cb.Header.Columns, len(cb.Header.ColumnInfo))
+	}
+	if cb.Header.SecondsPerRow <= 0 {
+		return nil, errors.New("cbuf header has no seconds_per_row")
+	}
+
+	cb.Rows = make([][]float64, 0, len(lines)-1)
+	for i, line := range lines[1:] {
+		values := strings.Split(line, "\t")
+		if len(values) != cb.Header.Columns {
+			return nil, fmt.Errorf("cbuf row %d has %d columns", i+1, len(values))
+		}
+		row := make([]float64, len(values))
+		for j, v := range values {
+			if row[j], err = strconv.ParseFloat(v, 64); err != nil {
+				row[j] = math.NaN()
+				err = nil
+			}
+		}
+		cb.Rows = append(cb.Rows, row)
+	}
+	return
+}
+
+// Returns the time of the given row, in seconds since the epoch.
+func (cb *CircularBuffer) RowTime(row int) int64 {
+	return cb.Header.Time + int64(row)*cb.Header.SecondsPerRow
+}
+
+// Returns the index of the first row of the trailing window of the given
+// number of seconds, all of the rows if window is zero.
+func (cb *CircularBuffer) windowStart(window int64) (start int) {
+	if window <= 0 || len(cb.Rows) == 0 {
+		return 0
+	}
+	end := cb.RowTime(len(cb.Rows))
+	for start < len(cb.Rows) && cb.RowTime(start) < end-window {
+		start++
+	}
+	return
+}
@@ -0,0 +1,359 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package report
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"html/template"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter that keeps the latest circular buffer output of the sandbox filters
+// it matches and periodically renders them into an HTML report, with a chart
+// and summary statistics for every column. The report is injected as a
+// message with an `html` payload type, ready to be mailed by an SmtpOutput.
+type CbufReportFilter struct {
+	name     string
+	conf     *CbufReportFilterConfig
+	template *template.Template
+	// Latest circular buffer from each source, keyed by logger and
+	// payload_name.
+	cbufs map[string]*CircularBuffer
+	// Returns the report's generation time, replaced by the tests.
+	now func() time.Time
+}
+
+// CbufReportFilter config struct
+type CbufReportFilterConfig struct {
+	// Defaults to the circular buffer output of all sandbox filters.
+	MessageMatcher string `toml:"message_matcher"`
+	// Interval in seconds at which the report is generated. Defaults to once
+	// a day.
+	TickerInterval uint `toml:"ticker_interval"`
+	// Title of the report, defaults to the plugin name.
+	Title string
+	// Number of seconds of data summarized, counting back from the last row
+	// of each circular buffer. Defaults to the ticker interval (-1), 0 covers
+	// every row.
+	Window int64
+	// Optional html/template file replacing the built in report layout.
+	TemplateFile string `toml:"template_file"`
+	// Type of the report messages. Defaults to "heka.cbuf-report".
+	ReportType string `toml:"report_type"`
+	// Width and height in pixels of the column charts. Default 480x80.
+	ChartWidth  uint `toml:"chart_width"`
+	ChartHeight uint `toml:"chart_height"`
+}
+
+// Template data for a report.
+type CbufReport struct {
+	Title     string
+	Generated time.Time
+	Sections  []*CbufReportSection
+}
+
+// Template data for a single circular buffer.
+type CbufReportSection struct {
+	// Logger of the filter that produced the buffer.
+	Logger string
+	// The buffer's payload_name.
+	Name          string
+	Start         time.Time
+	End           time.Time
+	SecondsPerRow int64
+	Columns       []*CbufColumnSummary
+}
+
+// Template data for a single circular buffer column, covering the rows in
+// the report window. The statistics ignore missing (NaN) values.
+type CbufColumnSummary struct {
+	CbufColumnInfo
+	// Number of rows with a value.
+	Count int
+	Min   float64
+	Max   float64
+	Avg   float64
+	Sum   float64
+	Last  float64
+	// SVG polyline points charting the values.
+	ChartPoints string
+	ChartWidth  uint
+	ChartHeight uint
+}
+
+func (f *CbufReportFilter) SetName(name string) {
+	f.name = name
+}
+
+func (f *CbufReportFilter) ConfigStruct() interface{} {
+	return &CbufReportFilterConfig{
+		MessageMatcher: "Type == 'heka.sandbox-output' && Fields[payload_type] == 'cbuf'",
+		TickerInterval: uint(86400),
+		Window:         -1,
+		ReportType:     "heka.cbuf-report",
+		ChartWidth:     uint(480),
+		ChartHeight:    uint(80),
+	}
+}
+
+var reportFuncs = template.FuncMap{
+	"num": formatNumber,
+}
+
+func (f *CbufReportFilter) Init(config interface{}) (err error) {
+	f.conf = config.(*CbufReportFilterConfig)
+	if f.conf.Title == "" {
+		f.conf.Title = f.name
+	}
+	if f.conf.Window < 0 {
+		f.conf.Window = int64(f.conf.TickerInterval)
+	}
+	if f.conf.ReportType == "" {
+		return errors.New("report_type can't be empty")
+	}
+	if f.conf.ChartWidth == 0 || f.conf.ChartHeight == 0 {
+		return errors.New("chart_width and chart_height must be greater than zero")
+	}
+	tmpl := template.New("report").Funcs(reportFuncs)
+	if f.conf.TemplateFile != "" {
+		f.template, err = tmpl.ParseFiles(f.conf.TemplateFile)
+		if err == nil {
+			// ParseFiles names the template after the file.
+			f.template = f.template.Lookup(templateName(f.conf.TemplateFile))
+		}
+	} else {
+		f.template, err = tmpl.Parse(defaultReportTemplate)
+	}
+	if err != nil {
+		return fmt.Errorf("can't parse the report template: %s", err)
+	}
+	f.cbufs = make(map[string]*CircularBuffer)
+	f.now = time.Now
+	return
+}
+
+func templateName(path string) string {
+	return path[strings.LastIndexAny(path, `/\`)+1:]
+}
+
+func (f *CbufReportFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
+	inChan := fr.InChan()
+	ticker := fr.Ticker()
+	if ticker == nil {
+		return errors.New("ticker_interval must be greater than zero")
+	}
+
+	var (
+		ok   = true
+		pack *PipelinePack
+	)
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			if err = f.add(pack.Message); err != nil {
+				fr.LogError(err)
+			}
+			pack.Recycle()
+		case <-ticker:
+			if err = f.inject(fr, h); err != nil {
+				fr.LogError(err)
+			}
+		}
+	}
+	return nil
+}
+
+// Stores a message's circular buffer, replacing the previous one from the
+// same source.
+func (f *CbufReportFilter) add(msg *message.Message) (err error) {
+	var name string
+	if v, ok := msg.GetFieldValue("payload_name"); ok {
+		name = fmt.Sprint(v)
+	}
+	var cb *CircularBuffer
+	if cb, err = ParseCircularBuffer(msg.GetPayload()); err != nil {
+		return fmt.Errorf("%s %s: %s", msg.GetLogger(), name, err)
+	}
+	f.cbufs[msg.GetLogger()+"\x00"+name] = cb
+	return
+}
+
+// Renders and injects the report, if there's any data to report on.
+func (f *CbufReportFilter) inject(fr FilterRunner, h PluginHelper) (err error) {
+	if len(f.cbufs) == 0 {
+		return
+	}
+	var html []byte
+	if html, err = f.render(); err != nil {
+		return fmt.Errorf("can't render the report: %s", err)
+	}
+	pack := h.PipelinePack(0)
+	if pack == nil {
+		return fmt.Errorf("exceeded MaxMsgLoops = %d", Globals().MaxMsgLoops)
+	}
+	pack.Message.SetType(f.conf.ReportType)
+	pack.Message.SetLogger(f.name)
+	pack.Message.SetPayload(string(html))
+	message.NewStringField(pack.Message, "payload_type", "html")
+	message.NewStringField(pack.Message, "payload_name", f.conf.Title)
+	fr.Inject(pack)
+	return
+}
+
+func (f *CbufReportFilter) render() (html []byte, err error) {
+	report := &CbufReport{
+		Title:     f.conf.Title,
+		Generated: f.now().UTC(),
+	}
+	keys := make([]string, 0, len(f.cbufs))
+	for key := range f.cbufs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts := strings.SplitN(key, "\x00", 2)
+		section := f.summarize(f.cbufs[key])
+		section.Logger, section.Name = parts[0], parts[1]
+		report.Sections = append(report.Sections, section)
+	}
+
+	var buf bytes.Buffer
+	if err = f.template.Execute(&buf, report); err != nil {
+		return
+	}
+	return buf.Bytes(), nil
+}
+
+// Computes the statistics and chart of every column over the report window.
+func (f *CbufReportFilter) summarize(cb *CircularBuffer) (section *CbufReportSection) {
+	start := cb.windowStart(f.conf.Window)
+	rows := cb.Rows[start:]
+	section = &CbufReportSection{
+		Start:         time.Unix(cb.RowTime(start), 0).UTC(),
+		End:           time.Unix(cb.RowTime(len(cb.Rows)), 0).UTC(),
+		SecondsPerRow: cb.Header.SecondsPerRow,
+		Columns:       make([]*CbufColumnSummary, len(cb.Header.ColumnInfo)),
+	}
+	for col, info := range cb.Header.ColumnInfo {
+		summary := &CbufColumnSummary{
+			CbufColumnInfo: info,
+			Min:            math.NaN(),
+			Max:            math.NaN(),
+			Avg:            math.NaN(),
+			Last:           math.NaN(),
+			ChartWidth:     f.conf.ChartWidth,
+			ChartHeight:    f.conf.ChartHeight,
+		}
+		for _, row := range rows {
+			v := row[col]
+			if math.IsNaN(v) {
+				continue
+			}
+			if summary.Count == 0 || v < summary.Min {
+				summary.Min = v
+			}
+			if summary.Count == 0 || v > summary.Max {
+				summary.Max = v
+			}
+			summary.Sum += v
+			summary.Last = v
+			summary.Count++
+		}
+		if summary.Count > 0 {
+			summary.Avg = summary.Sum / float64(summary.Count)
+		}
+		summary.ChartPoints = chartPoints(rows, col, summary.Min, summary.Max,
+			f.conf.ChartWidth, f.conf.ChartHeight)
+		section.Columns[col] = summary
+	}
+	return
+}
+
+// Scales a column's values into SVG polyline points, missing values are
+// skipped.
+func chartPoints(rows [][]float64, col int, min, max float64, width,
+	height uint) string {
+
+	if len(rows) == 0 || math.IsNaN(min) {
+		return ""
+	}
+	xScale := float64(width)
+	if len(rows) > 1 {
+		xScale /= float64(len(rows) - 1)
+	}
+	yRange := max - min
+	if yRange == 0 {
+		yRange = 1
+	}
+	points := make([]string, 0, len(rows))
+	for i, row := range rows {
+		if math.IsNaN(row[col]) {
+			continue
+		}
+		x := float64(i) * xScale
+		y := float64(height) - (row[col]-min)/yRange*float64(height)
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x, y))
+	}
+	return strings.Join(points, " ")
+}
+
+// Formats a value for display, missing values are shown as a dash.
+func formatNumber(v float64) string {
+	if math.IsNaN(v) {
+		return "-"
+	}
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
+
+const defaultReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+</head>
+<body style="font-family: sans-serif; color: #333;">
+<h1>{{.Title}}</h1>
+<p>Generated {{.Generated.Format "2006-01-02 15:04:05 MST"}}</p>
+{{range .Sections}}
+<h2>{{.Logger}}{{if .Name}} &ndash; {{.Name}}{{end}}</h2>
+<p>{{.Start.Format "2006-01-02 15:04"}} to {{.End.Format "2006-01-02 15:04 MST"}}, {{.SecondsPerRow}} seconds per row</p>
+<table cellpadding="4" cellspacing="0" border="1" style="border-collapse: collapse;">
+<tr><th>Column</th><th>Unit</th><th>Min</th><th>Max</th><th>Avg</th><th>Sum</th><th>Last</th><th>Chart</th></tr>
+{{range .Columns}}<tr>
+<td>{{.Name}}</td><td>{{.Unit}}</td><td>{{num .Min}}</td><td>{{num .Max}}</td><td>{{num .Avg}}</td><td>{{num .Sum}}</td><td>{{num .Last}}</td>
+<td><svg xmlns="http://www.w3.org/2000/svg" width="{{.ChartWidth}}" height="{{.ChartHeight}}"><polyline fill="none" stroke="#36c" stroke-width="1.5" points="{{.ChartPoints}}"/></svg></td>
+</tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`
+
+func init() {
+	RegisterPlugin("CbufReportFilter", func() interface{} {
+		return new(CbufReportFilter)
+	})
+}
@@ -0,0 +1,171 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package report
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const testCbuf = `{"time":1400000000,"rows":4,"columns":2,"seconds_per_row":60,"column_info":[{"name":"Requests","unit":"count","aggregation":"sum"},{"name":"Latency","unit":"ms","aggregation":"max"}]}
+1	nan
+2	10
+3	30
+6	20
+`
+
+func CbufReportFilterSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	newCbufPack := func(logger, name, payload string) *PipelinePack {
+		pack := NewPipelinePack(pConfig.InputRecycleChan())
+		pack.Message.SetType("heka.sandbox-output")
+		pack.Message.SetLogger(logger)
+		pack.Message.SetPayload(payload)
+		message.NewStringField(pack.Message, "payload_type", "cbuf")
+		message.NewStringField(pack.Message, "payload_name", name)
+		return pack
+	}
+
+	c.Specify("A circular buffer", func() {
+		c.Specify("is parsed with its annotations", func() {
+			cb, err := ParseCircularBuffer(`{"annotations":[]}` + "\n" + testCbuf)
+			c.Expect(err, gs.IsNil)
+			c.Expect(cb.Header.SecondsPerRow, gs.Equals, int64(60))
+			c.Expect(cb.Header.ColumnInfo[1].Name, gs.Equals, "Latency")
+			c.Expect(len(cb.Rows), gs.Equals, 4)
+			c.Expect(math.IsNaN(cb.Rows[0][1]), gs.IsTrue)
+			c.Expect(cb.Rows[3][0], gs.Equals, float64(6))
+			c.Expect(cb.RowTime(2), gs.Equals, int64(1400000120))
+		})
+
+		c.Specify("with inconsistent rows is rejected", func() {
+			_, err := ParseCircularBuffer(testCbuf + "1\n")
+			c.Expect(err.Error(), gs.Equals, "cbuf row 5 has 1 columns")
+		})
+	})
+
+	c.Specify("A CbufReportFilter", func() {
+		filter := new(CbufReportFilter)
+		filter.SetName("daily")
+		config := filter.ConfigStruct().(*CbufReportFilterConfig)
+
+		c.Specify("summarizes the report window", func() {
+			config.Window = 120
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = filter.add(newCbufPack("web", "stats", testCbuf).Message)
+			c.Assume(err, gs.IsNil)
+
+			section := filter.summarize(filter.cbufs["web\x00stats"])
+			c.Expect(section.Start, gs.Equals, time.Unix(1400000120, 0).UTC())
+			c.Expect(section.End, gs.Equals, time.Unix(1400000240, 0).UTC())
+			requests := section.Columns[0]
+			c.Expect(requests.Count, gs.Equals, 2)
+			c.Expect(requests.Sum, gs.Equals, float64(9))
+			c.Expect(requests.Min, gs.Equals, float64(3))
+			c.Expect(requests.Max, gs.Equals, float64(6))
+			c.Expect(requests.Last, gs.Equals, float64(6))
+			c.Expect(requests.ChartPoints, gs.Equals, "0.0,80.0 480.0,0.0")
+		})
+
+		c.Specify("ignores missing values", func() {
+			config.Window = 0
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			cb, err := ParseCircularBuffer(testCbuf)
+			c.Assume(err, gs.IsNil)
+
+			latency := filter.summarize(cb).Columns[1]
+			c.Expect(latency.Count, gs.Equals, 3)
+			c.Expect(latency.Avg, gs.Equals, float64(20))
+			c.Expect(latency.ChartPoints, gs.Equals, "160.0,80.0 320.0,0.0 480.0,40.0")
+		})
+
+		c.Specify("renders a custom template", func() {
+			tmpDir, err := ioutil.TempDir("", "cbuf-report-")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			config.TemplateFile = filepath.Join(tmpDir, "report.html")
+			err = ioutil.WriteFile(config.TemplateFile, []byte(
+				`{{.Title}}{{range .Sections}} {{.Logger}}/{{.Name}}{{range .Columns}} {{.Name}}={{num .Last}}{{end}}{{end}}`),
+				0644)
+			c.Assume(err, gs.IsNil)
+			config.Title = "<Daily>"
+			err = filter.Init(config)
+			c.Assume(err, gs.IsNil)
+			filter.add(newCbufPack("web", "stats", testCbuf).Message)
+			filter.add(newCbufPack("api", "", testCbuf).Message)
+
+			html, err := filter.render()
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(html), gs.Equals,
+				"&lt;Daily&gt; api/ Requests=6 Latency=20 web/stats Requests=6 Latency=20")
+		})
+
+		c.Specify("injects the report on each tick", func() {
+			err := filter.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			inChan := make(chan *PipelinePack)
+			ticker := make(chan time.Time)
+			injected := make(chan *PipelinePack, 1)
+			mockRunner := pipelinemock.NewMockFilterRunner(ctrl)
+			mockHelper := pipelinemock.NewMockPluginHelper(ctrl)
+			mockRunner.EXPECT().InChan().Return(inChan)
+			mockRunner.EXPECT().Ticker().Return(ticker)
+			mockRunner.EXPECT().LogError(gomock.Any())
+			mockHelper.EXPECT().PipelinePack(uint(0)).Return(
+				NewPipelinePack(pConfig.InjectRecycleChan()))
+			mockRunner.EXPECT().Inject(gomock.Any()).Do(func(pack *PipelinePack) {
+				injected <- pack
+			})
+
+			done := make(chan error)
+			go func() {
+				done <- filter.Run(mockRunner, mockHelper)
+			}()
+			inChan <- newCbufPack("web", "stats", testCbuf)
+			inChan <- newCbufPack("web", "broken", "not a cbuf")
+			ticker <- time.Now()
+			pack := <-injected
+			close(inChan)
+			c.Expect(<-done, gs.IsNil)
+
+			msg := pack.Message
+			c.Expect(msg.GetType(), gs.Equals, "heka.cbuf-report")
+			c.Expect(msg.GetLogger(), gs.Equals, "daily")
+			payloadType, _ := msg.GetFieldValue("payload_type")
+			c.Expect(payloadType, gs.Equals, "html")
+			payloadName, _ := msg.GetFieldValue("payload_name")
+			c.Expect(payloadName, gs.Equals, "daily")
+			c.Expect(msg.GetPayload(), pipeline_ts.StringContains, "<td>Requests</td><td>count</td>")
+			c.Expect(msg.GetPayload(), pipeline_ts.StringContains, "<h2>web &ndash; stats</h2>")
+		})
+	})
+}
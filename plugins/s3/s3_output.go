@@ -0,0 +1,486 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/crowdmob/goamz/aws"
+	goamz_s3 "github.com/crowdmob/goamz/s3"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// S3 doesn't accept multipart upload parts smaller than this, other than the
+// last one.
+const MIN_PART_SIZE = 5 * 1024 * 1024
+
+// Destination for the finished batches, wraps an S3 bucket.
+type objectStore interface {
+	Put(key string, r io.Reader, length int64, contType string) error
+	PutMultipart(key string, r io.ReaderAt, length, partSize int64,
+		contType string) error
+}
+
+type bucketStore struct {
+	bucket *goamz_s3.Bucket
+}
+
+func (b *bucketStore) Put(key string, r io.Reader, length int64,
+	contType string) error {
+
+	return b.bucket.PutReader(key, r, length, contType, goamz_s3.Private,
+		goamz_s3.Options{})
+}
+
+func (b *bucketStore) PutMultipart(key string, r io.ReaderAt, length,
+	partSize int64, contType string) (err error) {
+
+	var multi *goamz_s3.Multi
+	if multi, err = b.bucket.InitMulti(key, contType, goamz_s3.Private,
+		goamz_s3.Options{}); err != nil {
+		return
+	}
+	parts := make([]goamz_s3.Part, 0, length/partSize+1)
+	for offset, n := int64(0), 1; offset < length; offset, n = offset+partSize, n+1 {
+		size := partSize
+		if offset+size > length {
+			size = length - offset
+		}
+		var part goamz_s3.Part
+		if part, err = multi.PutPart(n, io.NewSectionReader(r, offset, size)); err != nil {
+			multi.Abort()
+			return
+		}
+		parts = append(parts, part)
+	}
+	if err = multi.Complete(parts); err != nil {
+		multi.Abort()
+	}
+	return
+}
+
+// A piece of the object key template.
+type keyPart struct {
+	// Literal text, formatted as a Go time layout.
+	literal string
+	// Message attribute or field to interpolate.
+	field string
+	// Placeholder for the upload sequence number.
+	seq bool
+}
+
+// Splits a key template into its parts, `%{name}` for message variables,
+// `{seq}` for the sequence number, everything else is a time layout.
+func parseKeyTemplate(template string) (parts []keyPart, err error) {
+	rest := template
+	hasSeq := false
+	for rest != "" {
+		fieldStart := strings.Index(rest, "%{")
+		seqStart := strings.Index(rest, "{seq}")
+		switch {
+		case seqStart >= 0 && (fieldStart < 0 || seqStart < fieldStart):
+			if seqStart > 0 {
+				parts = append(parts, keyPart{literal: rest[:seqStart]})
+			}
+			parts = append(parts, keyPart{seq: true})
+			hasSeq = true
+			rest = rest[seqStart+len("{seq}"):]
+		case fieldStart >= 0:
+			end := strings.Index(rest[fieldStart:], "}")
+			if end < 0 {
+				return nil, errors.New("unterminated '%{' in key template")
+			}
+			end += fieldStart
+			if end == fieldStart+2 {
+				return nil, errors.New("empty '%{}' in key template")
+			}
+			if fieldStart > 0 {
+				parts = append(parts, keyPart{literal: rest[:fieldStart]})
+			}
+			parts = append(parts, keyPart{field: rest[fieldStart+2 : end]})
+			rest = rest[end+1:]
+		default:
+			parts = append(parts, keyPart{literal: rest})
+			rest = ""
+		}
+	}
+	if !hasSeq {
+		return nil, errors.New("key template must contain '{seq}'")
+	}
+	return
+}
+
+// Messages sharing the same key prefix, waiting to be uploaded.
+type s3Batch struct {
+	// Object key with the `{seq}` placeholder still in place.
+	key     string
+	buffer  *bytes.Buffer
+	file    *os.File
+	writer  io.Writer
+	gz      *gzip.Writer
+	size    int64
+	count   int
+	started time.Time
+	// Time of the last failed upload attempt.
+	failed time.Time
+}
+
+func (b *s3Batch) Write(p []byte) (n int, err error) {
+	n, err = b.writer.Write(p)
+	b.size += int64(n)
+	return
+}
+
+// Flushes any compressed data and returns the batch contents.
+func (b *s3Batch) finish() (r io.ReaderAt, length int64, err error) {
+	if b.gz != nil {
+		if err = b.gz.Close(); err != nil {
+			return
+		}
+		b.gz = nil
+	}
+	if b.file != nil {
+		var info os.FileInfo
+		if info, err = b.file.Stat(); err != nil {
+			return
+		}
+		return b.file, info.Size(), nil
+	}
+	return bytes.NewReader(b.buffer.Bytes()), int64(b.buffer.Len()), nil
+}
+
+// Releases the batch's buffer file, if any.
+func (b *s3Batch) discard() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+// Output plugin that batches messages and archives them as objects in an
+// Amazon S3 bucket.
+type S3Output struct {
+	conf          *S3OutputConfig
+	keyTemplate   []keyPart
+	store         objectStore
+	flushInterval time.Duration
+	retryInterval time.Duration
+	partSize      int64
+	contentType   string
+	startTime     time.Time
+	seq           uint64
+	batches       map[string]*s3Batch
+	failed        []*s3Batch
+	limiter       *plugins.ByteRateLimiter
+}
+
+// ConfigStruct for S3Output plugin.
+type S3OutputConfig struct {
+	// Name of the bucket to upload to.
+	Bucket string
+	// AWS region the bucket lives in (default "us-east-1").
+	Region string
+	// AWS credentials, taken from the AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY environment variables if not set.
+	AccessKey string `toml:"access_key"`
+	SecretKey string `toml:"secret_key"`
+	// Template for the object keys. `%{name}` is replaced with the named
+	// message attribute or field, `{seq}` with a unique sequence string, and
+	// the remaining text is treated as a Go time layout.
+	KeyTemplate string `toml:"key_template"`
+	// "protobufstream" (default) or "payload".
+	Encoding string
+	// Compress the uploaded objects with gzip? Defaults to true.
+	Gzip bool
+	// Maximum time messages are batched before being uploaded, in seconds
+	// (default 300).
+	FlushInterval uint32 `toml:"flush_interval"`
+	// Size of the serialized (uncompressed) messages at which a batch is
+	// uploaded, in bytes (default 64MiB).
+	FlushSize int64 `toml:"flush_size"`
+	// Directory for batch buffer files, batches are held in memory if not
+	// set.
+	BufferPath string `toml:"buffer_path"`
+	// Objects larger than this are uploaded in parts, in bytes (default
+	// 16MiB).
+	MultipartThreshold int64 `toml:"multipart_threshold"`
+	// Size of the multipart upload parts, in bytes (default 5MiB).
+	PartSize int64 `toml:"part_size"`
+	// Time between attempts to upload batches that have failed to upload,
+	// in seconds (default 30).
+	RetryInterval uint32 `toml:"retry_interval"`
+	// Maximum average upload rate in bytes per second, unlimited if zero.
+	MaxBytesPerSec int64 `toml:"max_bytes_per_sec"`
+	// Number of bytes that can be uploaded at once before the rate limit
+	// kicks in, defaults to one second's worth.
+	BurstBytes int64 `toml:"burst_bytes"`
+}
+
+func (so *S3Output) ConfigStruct() interface{} {
+	return &S3OutputConfig{
+		Region:             "us-east-1",
+		KeyTemplate:        "heka/%{Type}/2006/01/02/15/hekad-%{Hostname}-{seq}.pb.gz",
+		Encoding:           "protobufstream",
+		Gzip:               true,
+		FlushInterval:      300,
+		FlushSize:          64 * 1024 * 1024,
+		MultipartThreshold: 16 * 1024 * 1024,
+		PartSize:           MIN_PART_SIZE,
+		RetryInterval:      30,
+	}
+}
+
+func (so *S3Output) Init(config interface{}) (err error) {
+	so.conf = config.(*S3OutputConfig)
+	if so.conf.Bucket == "" {
+		return errors.New("bucket must be set")
+	}
+	region, ok := aws.Regions[so.conf.Region]
+	if !ok {
+		return fmt.Errorf("unknown region: %s", so.conf.Region)
+	}
+	if so.keyTemplate, err = parseKeyTemplate(so.conf.KeyTemplate); err != nil {
+		return
+	}
+	switch so.conf.Encoding {
+	case "protobufstream":
+		so.contentType = "application/octet-stream"
+	case "payload":
+		so.contentType = "text/plain"
+	default:
+		return fmt.Errorf("invalid encoding: %s", so.conf.Encoding)
+	}
+	if so.conf.Gzip {
+		so.contentType = "application/x-gzip"
+	}
+	if so.conf.FlushInterval == 0 || so.conf.FlushSize <= 0 {
+		return errors.New("flush_interval and flush_size must be greater than zero")
+	}
+	if so.conf.PartSize < MIN_PART_SIZE {
+		return fmt.Errorf("part_size must be at least %d", MIN_PART_SIZE)
+	}
+	if so.conf.BufferPath != "" {
+		if err = os.MkdirAll(so.conf.BufferPath, 0700); err != nil {
+			return fmt.Errorf("can't create buffer_path: %s", err)
+		}
+	}
+
+	var auth aws.Auth
+	if so.conf.AccessKey != "" || so.conf.SecretKey != "" {
+		auth = aws.Auth{AccessKey: so.conf.AccessKey, SecretKey: so.conf.SecretKey}
+	} else if auth, err = aws.EnvAuth(); err != nil {
+		return fmt.Errorf("no AWS credentials: %s", err)
+	}
+	so.store = &bucketStore{goamz_s3.New(auth, region).Bucket(so.conf.Bucket)}
+
+	so.flushInterval = time.Duration(so.conf.FlushInterval) * time.Second
+	so.retryInterval = time.Duration(so.conf.RetryInterval) * time.Second
+	so.partSize = so.conf.PartSize
+	so.startTime = time.Now()
+	so.batches = make(map[string]*s3Batch)
+	if so.conf.MaxBytesPerSec > 0 {
+		so.limiter = plugins.NewByteRateLimiter(so.conf.MaxBytesPerSec,
+			so.conf.BurstBytes)
+	}
+	return
+}
+
+// Builds the object key for a message, leaving the `{seq}` placeholder in
+// place. Literal text is formatted using the current UTC time.
+func (so *S3Output) messageKey(msg *message.Message, now time.Time) (key string,
+	err error) {
+
+	pieces := make([]string, len(so.keyTemplate))
+	for i, part := range so.keyTemplate {
+		switch {
+		case part.seq:
+			pieces[i] = "{seq}"
+		case part.field != "":
+			value, ok := plugins.GetMessageVariable(msg, part.field)
+			if !ok {
+				return "", fmt.Errorf("message has no field '%s'", part.field)
+			}
+			pieces[i] = value
+		default:
+			pieces[i] = now.Format(part.literal)
+		}
+	}
+	return strings.Join(pieces, ""), nil
+}
+
+func (so *S3Output) newBatch(key string) (batch *s3Batch, err error) {
+	batch = &s3Batch{key: key, started: time.Now()}
+	if so.conf.BufferPath != "" {
+		if batch.file, err = ioutil.TempFile(so.conf.BufferPath, "s3batch-"); err != nil {
+			return nil, fmt.Errorf("can't create buffer file: %s", err)
+		}
+		batch.writer = batch.file
+	} else {
+		batch.buffer = new(bytes.Buffer)
+		batch.writer = batch.buffer
+	}
+	if so.conf.Gzip {
+		batch.gz = gzip.NewWriter(batch.writer)
+		batch.writer = batch.gz
+	}
+	return
+}
+
+// Uploads a batch, returns false if the upload failed and should be retried.
+func (so *S3Output) upload(or OutputRunner, batch *s3Batch) bool {
+	r, length, err := batch.finish()
+	if err != nil {
+		or.LogError(fmt.Errorf("can't finish batch for %s, dropping %d messages: %s",
+			batch.key, batch.count, err))
+		batch.discard()
+		return true
+	}
+	if so.limiter != nil {
+		r = so.limiter.ReaderAt(r)
+	}
+	so.seq++
+	seq := fmt.Sprintf("%d-%d", so.startTime.Unix(), so.seq)
+	key := strings.Replace(batch.key, "{seq}", seq, -1)
+	if length > so.conf.MultipartThreshold {
+		err = so.store.PutMultipart(key, r, length, so.partSize, so.contentType)
+	} else {
+		err = so.store.Put(key, io.NewSectionReader(r, 0, length), length,
+			so.contentType)
+	}
+	if err != nil {
+		or.LogError(fmt.Errorf("can't upload %s: %s", key, err))
+		batch.failed = time.Now()
+		return false
+	}
+	batch.discard()
+	return true
+}
+
+// Uploads the batch, keeping it for a later retry if that fails.
+func (so *S3Output) flush(or OutputRunner, batch *s3Batch) {
+	delete(so.batches, batch.key)
+	if !so.upload(or, batch) {
+		so.failed = append(so.failed, batch)
+	}
+}
+
+// Uploads any batches that are old enough, and retries failed uploads.
+func (so *S3Output) tick(or OutputRunner, now time.Time) {
+	for _, batch := range so.batches {
+		if now.Sub(batch.started) >= so.flushInterval {
+			so.flush(or, batch)
+		}
+	}
+	stillFailed := so.failed[:0]
+	for _, batch := range so.failed {
+		if now.Sub(batch.failed) < so.retryInterval || !so.upload(or, batch) {
+			stillFailed = append(stillFailed, batch)
+		}
+	}
+	so.failed = stillFailed
+}
+
+func (so *S3Output) handleMessage(pack *PipelinePack, outBytes *[]byte) (
+	batch *s3Batch, err error) {
+
+	var key string
+	if key, err = so.messageKey(pack.Message, time.Now().UTC()); err != nil {
+		return
+	}
+	if so.conf.Encoding == "payload" {
+		*outBytes = append(*outBytes, pack.Message.GetPayload()...)
+		*outBytes = append(*outBytes, NEWLINE)
+	} else if err = ProtobufEncodeMessage(pack, outBytes); err != nil {
+		return nil, fmt.Errorf("can't encode message: %s", err)
+	}
+	if batch = so.batches[key]; batch == nil {
+		if batch, err = so.newBatch(key); err != nil {
+			return
+		}
+		so.batches[key] = batch
+	}
+	if _, err = batch.Write(*outBytes); err != nil {
+		return nil, fmt.Errorf("can't buffer message: %s", err)
+	}
+	batch.count++
+	return
+}
+
+// Reports the upload rate limit utilization, if a rate limit is set.
+func (so *S3Output) ReportMsg(msg *message.Message) error {
+	if so.limiter != nil {
+		so.limiter.ReportMsg(msg)
+	}
+	return nil
+}
+
+func (so *S3Output) Run(or OutputRunner, h PluginHelper) (err error) {
+	var (
+		pack  *PipelinePack
+		batch *s3Batch
+		e     error
+	)
+	ok := true
+	outBytes := make([]byte, 0, 1000)
+	inChan := or.InChan()
+	ticker := time.Tick(time.Second)
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			if batch, e = so.handleMessage(pack, &outBytes); e != nil {
+				or.LogError(e)
+			} else if batch.size >= so.conf.FlushSize {
+				so.flush(or, batch)
+			}
+			outBytes = outBytes[:0]
+			pack.Recycle()
+		case now := <-ticker:
+			so.tick(or, now)
+		}
+	}
+
+	// Final attempt to get everything uploaded.
+	for _, batch = range so.batches {
+		so.flush(or, batch)
+	}
+	for _, batch = range so.failed {
+		if !so.upload(or, batch) {
+			or.LogError(fmt.Errorf("giving up on %s, dropping %d messages",
+				batch.key, batch.count))
+			batch.discard()
+		}
+	}
+	so.failed = nil
+	return
+}
+
+func init() {
+	RegisterPlugin("S3Output", func() interface{} {
+		return new(S3Output)
+	})
+}
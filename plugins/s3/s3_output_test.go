@@ -0,0 +1,189 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package s3
+
+import (
+	"bytes"
+	"code.google.com/p/gomock/gomock"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+type upload struct {
+	key       string
+	data      []byte
+	multipart bool
+}
+
+// In memory objectStore that records the uploads.
+type testStore struct {
+	uploads []upload
+	fail    bool
+}
+
+func (s *testStore) Put(key string, r io.Reader, length int64, contType string) error {
+	if s.fail {
+		return errors.New("upload failed")
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != length {
+		return fmt.Errorf("expected %d bytes, got %d", length, len(data))
+	}
+	s.uploads = append(s.uploads, upload{key: key, data: data})
+	return nil
+}
+
+func (s *testStore) PutMultipart(key string, r io.ReaderAt, length, partSize int64,
+	contType string) error {
+
+	if s.fail {
+		return errors.New("upload failed")
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, 0); err != nil && err != io.EOF {
+		return err
+	}
+	s.uploads = append(s.uploads, upload{key: key, data: data, multipart: true})
+	return nil
+}
+
+func S3OutputSpec(c gs.Context) {
+	t := new(pipeline_ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	oth := plugins_ts.NewOutputTestHelper(ctrl)
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("An S3Output", func() {
+		output := new(S3Output)
+		config := output.ConfigStruct().(*S3OutputConfig)
+		config.Bucket = "heka-archive"
+		config.AccessKey = "access"
+		config.SecretKey = "secret"
+		config.KeyTemplate = "logs/%{Type}/2006/hekad-%{Hostname}-{seq}.log"
+		config.Encoding = "payload"
+		config.Gzip = false
+		store := new(testStore)
+
+		inChan := make(chan *PipelinePack, 3)
+		sendMessages := func(types ...string) {
+			for i, typ := range types {
+				pack := NewPipelinePack(pConfig.InputRecycleChan())
+				pack.Message = pipeline_ts.GetTestMessage()
+				pack.Message.SetType(typ)
+				pack.Message.SetPayload(fmt.Sprintf("message %d", i))
+				inChan <- pack
+			}
+			close(inChan)
+		}
+
+		c.Specify("validates the key template", func() {
+			config.KeyTemplate = "logs/%{Type}.log"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+			config.KeyTemplate = "logs/%{Type.log"
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+
+		c.Specify("uploads one object per key", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.store = store
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			sendMessages("a", "b", "a")
+			err = output.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(err, gs.IsNil)
+
+			c.Expect(len(store.uploads), gs.Equals, 2)
+			year := time.Now().UTC().Format("2006")
+			contents := make(map[string]string)
+			for _, u := range store.uploads {
+				c.Expect(strings.Contains(u.key, "{seq}"), gs.IsFalse)
+				typ := strings.Split(u.key, "/")[1]
+				prefix := fmt.Sprintf("logs/%s/%s/hekad-my.host.name-", typ, year)
+				c.Expect(strings.HasPrefix(u.key, prefix), gs.IsTrue)
+				contents[typ] = string(u.data)
+			}
+			c.Expect(contents["a"], gs.Equals, "message 0\nmessage 2\n")
+			c.Expect(contents["b"], gs.Equals, "message 1\n")
+		})
+
+		c.Specify("compresses and buffers batches on disk", func() {
+			tmpDir, err := ioutil.TempDir("", "hekad-tests-")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			config.BufferPath = tmpDir
+			config.Gzip = true
+			err = output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.store = store
+			output.conf.MultipartThreshold = 10
+			oth.MockOutputRunner.EXPECT().InChan().Return(inChan)
+			sendMessages("a", "a")
+			err = output.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(err, gs.IsNil)
+
+			c.Expect(len(store.uploads), gs.Equals, 1)
+			c.Expect(store.uploads[0].multipart, gs.IsTrue)
+			gz, err := gzip.NewReader(bytes.NewReader(store.uploads[0].data))
+			c.Assume(err, gs.IsNil)
+			data, err := ioutil.ReadAll(gz)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(data), gs.Equals, "message 0\nmessage 1\n")
+
+			// The buffer file is removed once uploaded.
+			left, err := ioutil.ReadDir(tmpDir)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(left), gs.Equals, 0)
+		})
+
+		c.Specify("retries failed uploads", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.store = store
+			store.fail = true
+			oth.MockOutputRunner.EXPECT().LogError(gomock.Any())
+
+			pack := NewPipelinePack(pConfig.InputRecycleChan())
+			pack.Message = pipeline_ts.GetTestMessage()
+			outBytes := make([]byte, 0, 100)
+			batch, err := output.handleMessage(pack, &outBytes)
+			c.Assume(err, gs.IsNil)
+			output.flush(oth.MockOutputRunner, batch)
+			c.Expect(len(output.failed), gs.Equals, 1)
+
+			// Not retried until the retry interval has passed.
+			store.fail = false
+			output.tick(oth.MockOutputRunner, time.Now())
+			c.Expect(len(store.uploads), gs.Equals, 0)
+			output.tick(oth.MockOutputRunner, time.Now().Add(time.Minute))
+			c.Expect(len(store.uploads), gs.Equals, 1)
+			c.Expect(len(output.failed), gs.Equals, 0)
+		})
+	})
+}
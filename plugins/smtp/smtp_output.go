@@ -16,18 +16,31 @@ package smtp
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"mime/multipart"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type SmtpOutput struct {
 	conf         *SmtpOutputConfig
 	auth         smtp.Auth
 	sendFunction func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+	batch        *attachmentBatch
+	emails       *emailBatch
+	limiter      *emailLimiter
+	tlsConfig    *tls.Config
 }
 
 type SmtpOutputConfig struct {
@@ -45,14 +58,50 @@ type SmtpOutputConfig struct {
 	User string
 	// SMTP password
 	Password string
+	// Collects the messages into a gzip compressed JSON attachment instead of
+	// sending one email per message
+	SendAttachment bool `toml:"send_attachment"`
+	// File name given to the attachment
+	AttachmentName string `toml:"attachment_name"`
+	// Maximum number of messages in a single attachment, once reached the
+	// email is sent without waiting for the attachment_interval
+	AttachmentMaxMessages int `toml:"attachment_max_messages"`
+	// Interval in seconds at which any collected attachment messages are sent.
+	AttachmentInterval uint `toml:"attachment_interval"`
+	// Collects the messages into a single email for up to this many seconds
+	// instead of sending one email per message, 0 disables the interval.
+	BatchInterval uint `toml:"batch_interval"`
+	// Maximum number of messages in a single email, once reached the email
+	// is sent without waiting for the batch_interval. 0 means no limit if a
+	// batch_interval is set and 1 otherwise.
+	BatchCount int `toml:"batch_count"`
+	// Maximum number of emails sent per rate_limit_window, 0 is unlimited.
+	// Emails over the limit are dropped and summarized in a single email
+	// once the window is over.
+	RateLimit int `toml:"rate_limit"`
+	// Length of the rate limit window in seconds.
+	RateLimitWindow uint `toml:"rate_limit_window"`
+	// Subject of the emails, interpolating %Hostname%, %Type%, %Logger%,
+	// %Severity% and %<field name>% from the (first) message. Defaults to the
+	// output name.
+	Subject string
+	// "starttls" to require STARTTLS, "tls" for an implicit TLS connection.
+	// By default STARTTLS is used only if the server offers it.
+	TlsMode string `toml:"tls_mode"`
+	// TLS settings, used if TlsMode is set.
+	Tls TlsConfig
 }
 
 func (s *SmtpOutput) ConfigStruct() interface{} {
 	return &SmtpOutputConfig{
-		PayloadOnly: true,
-		SendFrom:    "heka@localhost.localdomain",
-		Host:        "127.0.0.1:25",
-		Auth:        "none",
+		PayloadOnly:           true,
+		SendFrom:              "heka@localhost.localdomain",
+		Host:                  "127.0.0.1:25",
+		Auth:                  "none",
+		AttachmentName:        "heka_messages.json.gz",
+		AttachmentMaxMessages: 1000,
+		AttachmentInterval:    60,
+		RateLimitWindow:       60,
 	}
 }
 
@@ -68,7 +117,17 @@ func (s *SmtpOutput) Init(config interface{}) (err error) {
 		return fmt.Errorf("Host must contain a port specifier")
 	}
 
-	s.sendFunction = smtp.SendMail
+	switch s.conf.TlsMode {
+	case "":
+		s.sendFunction = smtp.SendMail
+	case "starttls", "tls":
+		if s.tlsConfig, err = CreateGoTlsConfig(&s.conf.Tls, false, s.conf.Host); err != nil {
+			return fmt.Errorf("TLS config: %s", err)
+		}
+		s.sendFunction = s.sendMailTls
+	default:
+		return fmt.Errorf("invalid tls_mode: %s", s.conf.TlsMode)
+	}
 
 	if s.conf.Auth == "Plain" {
 		s.auth = smtp.PlainAuth("", s.conf.User, s.conf.Password, host)
@@ -79,37 +138,474 @@ func (s *SmtpOutput) Init(config interface{}) (err error) {
 	} else {
 		return fmt.Errorf("Invalid auth type: %s", s.conf.Auth)
 	}
+
+	if s.conf.SendAttachment {
+		if s.conf.AttachmentMaxMessages < 1 {
+			return fmt.Errorf("attachment_max_messages must be greater than zero")
+		}
+		if s.conf.AttachmentName == "" {
+			return fmt.Errorf("attachment_name must be specified")
+		}
+		if s.conf.AttachmentInterval == 0 {
+			return fmt.Errorf("attachment_interval must be greater than zero")
+		}
+		s.batch = newAttachmentBatch()
+	} else {
+		if s.conf.BatchCount < 0 {
+			return fmt.Errorf("batch_count can't be negative")
+		}
+		s.emails = &emailBatch{payloadOnly: s.conf.PayloadOnly}
+	}
+	if s.conf.RateLimit < 0 {
+		return fmt.Errorf("rate_limit can't be negative")
+	}
+	if s.conf.RateLimit > 0 {
+		if s.conf.RateLimitWindow == 0 {
+			return fmt.Errorf("rate_limit_window must be greater than zero")
+		}
+		s.limiter = newEmailLimiter(s.conf.RateLimit,
+			time.Duration(s.conf.RateLimitWindow)*time.Second)
+	}
 	return
 }
 
 func (s *SmtpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
-	inChan := or.InChan()
+	if s.conf.SendAttachment {
+		return s.runAttachment(or)
+	}
 
 	var (
-		pack     *PipelinePack
-		msg      *message.Message
-		contents []byte
+		pack      *PipelinePack
+		ok        = true
+		batchTick <-chan time.Time
 	)
-	subject := or.Name()
+	inChan := or.InChan()
+	if s.conf.BatchInterval > 0 {
+		ticker := time.NewTicker(time.Duration(s.conf.BatchInterval) * time.Second)
+		defer ticker.Stop()
+		batchTick = ticker.C
+	}
+	windowTick, stopWindow := s.windowTicker()
+	defer stopWindow()
+	maxMessages := s.conf.BatchCount
+	if maxMessages == 0 && s.conf.BatchInterval == 0 {
+		maxMessages = 1
+	}
 
-	for pack = range inChan {
-		msg = pack.Message
-		if s.conf.PayloadOnly {
-			message := bytes.NewBufferString(fmt.Sprintf("Subject: %s\r\n\r\n%s", subject, msg.GetPayload()))
-			err = s.sendFunction(s.conf.Host, s.auth, s.conf.SendFrom, s.conf.SendTo, message.Bytes())
-		} else {
-			if contents, err = json.Marshal(msg); err == nil {
-				message := bytes.NewBufferString(fmt.Sprintf("Subject: %s\r\n\r\n%s", subject, contents))
-				err = s.sendFunction(s.conf.Host, s.auth, s.conf.SendFrom, s.conf.SendTo, message.Bytes())
-			} else {
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			if s.emails.count == 0 {
+				s.emails.subject = s.formatSubject(pack.Message, or.Name())
+			}
+			if err = s.emails.add(pack.Message); err != nil {
 				or.LogError(err)
 			}
+			pack.Recycle()
+			if maxMessages > 0 && s.emails.count >= maxMessages {
+				s.sendEmails(or)
+			}
+		case <-batchTick:
+			s.sendEmails(or)
+		case <-windowTick:
+			s.sendOverflowSummary(or)
 		}
-		if err != nil {
+	}
+	s.sendEmails(or)
+	s.sendOverflowSummary(or)
+	return nil
+}
+
+// Sends the collected message bodies as a single email and resets the batch.
+func (s *SmtpOutput) sendEmails(or OutputRunner) {
+	if s.emails.count == 0 {
+		return
+	}
+	defer s.emails.reset()
+	if err := s.deliver(or, s.emails.email(), s.emails.count); err != nil {
+		if s.emails.count == 1 {
 			or.LogError(err)
+		} else {
+			or.LogError(fmt.Errorf("can't send email with %d messages: %s",
+				s.emails.count, err))
+		}
+	}
+}
+
+// Interpolates the message's headers and fields into the subject template.
+func (s *SmtpOutput) formatSubject(msg *message.Message, name string) string {
+	if s.conf.Subject == "" {
+		return name
+	}
+	values := map[string]string{
+		"Logger":   msg.GetLogger(),
+		"Hostname": msg.GetHostname(),
+		"Type":     msg.GetType(),
+		"Severity": strconv.Itoa(int(msg.GetSeverity())),
+	}
+	for _, field := range msg.Fields {
+		if value := field.GetValue(); value != nil {
+			values[field.GetName()] = fmt.Sprint(value)
+		}
+	}
+	// Header values can't span lines.
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(
+		InterpolateString(s.conf.Subject, values))
+}
+
+// Returns a channel ticking once per rate limit window, so the overflow
+// summary isn't held back until the next email is sent, and a function
+// stopping it. The channel is nil without a rate limit.
+func (s *SmtpOutput) windowTicker() (tick <-chan time.Time, stop func()) {
+	if s.limiter == nil {
+		return nil, func() {}
+	}
+	ticker := time.NewTicker(s.limiter.window)
+	return ticker.C, ticker.Stop
+}
+
+// Sends the email unless the rate limit is exhausted, in which case it's
+// only counted for the overflow summary.
+func (s *SmtpOutput) deliver(or OutputRunner, contents []byte, messages int) error {
+	s.sendOverflowSummary(or)
+	if s.limiter != nil && !s.limiter.allow(messages) {
+		return nil
+	}
+	return s.sendFunction(s.conf.Host, s.auth, s.conf.SendFrom, s.conf.SendTo,
+		contents)
+}
+
+// Sends a summary of the emails dropped by the rate limit once their window
+// is over. The summary counts against the new window.
+func (s *SmtpOutput) sendOverflowSummary(or OutputRunner) {
+	if s.limiter == nil {
+		return
+	}
+	emails, messages, start := s.limiter.roll()
+	if emails == 0 {
+		return
+	}
+	s.limiter.sent++
+	contents := fmt.Sprintf("Subject: %s: %d emails suppressed\r\n\r\n"+
+		"The limit of %d emails per %s was exceeded, %d emails with %d "+
+		"messages were not sent between %s and %s.\r\n", or.Name(), emails,
+		s.limiter.max, s.limiter.window, emails, messages,
+		start.UTC().Format(time.RFC3339),
+		start.Add(s.limiter.window).UTC().Format(time.RFC3339))
+	if err := s.sendFunction(s.conf.Host, s.auth, s.conf.SendFrom, s.conf.SendTo,
+		[]byte(contents)); err != nil {
+		or.LogError(fmt.Errorf("can't send overflow summary: %s", err))
+	}
+}
+
+// Sends the email over an implicit TLS connection or after a mandatory
+// STARTTLS, unlike smtp.SendMail which only upgrades the connection if the
+// server offers it.
+func (s *SmtpOutput) sendMailTls(addr string, a smtp.Auth, from string, to []string,
+	msg []byte) (err error) {
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	if s.conf.TlsMode == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, s.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer client.Close()
+
+	if s.conf.TlsMode == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("server doesn't support STARTTLS")
+		}
+		if err = client.StartTLS(s.tlsConfig); err != nil {
+			return
+		}
+	}
+	if a != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			if err = client.Auth(a); err != nil {
+				return
+			}
+		}
+	}
+	if err = client.Mail(from); err != nil {
+		return
+	}
+	for _, addr := range to {
+		if err = client.Rcpt(addr); err != nil {
+			return
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(msg); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	return client.Quit()
+}
+
+// Returns the MIME headers for a payload only email, HTML payloads (e.g. a
+// CbufReportFilter report) are sent as HTML.
+func contentHeaders(msg *message.Message) string {
+	if payloadType, _ := msg.GetFieldValue("payload_type"); payloadType == "html" {
+		return "MIME-Version: 1.0\r\nContent-Type: text/html; charset=utf-8\r\n"
+	}
+	return ""
+}
+
+// Collects the messages into the attachment batch and sends it whenever the
+// attachment_interval passes, the batch is full, or the input channel is
+// closed.
+func (s *SmtpOutput) runAttachment(or OutputRunner) (err error) {
+	var (
+		pack *PipelinePack
+		ok   = true
+	)
+	inChan := or.InChan()
+	ticker := time.NewTicker(time.Duration(s.conf.AttachmentInterval) * time.Second)
+	defer ticker.Stop()
+	windowTick, stopWindow := s.windowTicker()
+	defer stopWindow()
+
+	for ok {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			if s.batch.count == 0 {
+				s.batch.subject = s.formatSubject(pack.Message, or.Name())
+			}
+			if err = s.batch.add(pack.Message); err != nil {
+				or.LogError(err)
+			}
+			pack.Recycle()
+			if s.batch.count >= s.conf.AttachmentMaxMessages {
+				s.sendBatch(or)
+			}
+		case <-ticker.C:
+			s.sendBatch(or)
+		case <-windowTick:
+			s.sendOverflowSummary(or)
+		}
+	}
+	s.sendBatch(or)
+	s.sendOverflowSummary(or)
+	return nil
+}
+
+// Sends the current batch as an email with a summary body and the compressed
+// messages as an attachment, then resets the batch.
+func (s *SmtpOutput) sendBatch(or OutputRunner) {
+	if s.batch.count == 0 {
+		return
+	}
+	defer s.batch.reset()
+	contents, err := s.batch.email(s.conf.AttachmentName)
+	if err == nil {
+		err = s.deliver(or, contents, s.batch.count)
+	}
+	if err != nil {
+		or.LogError(fmt.Errorf("can't send attachment with %d messages: %s",
+			s.batch.count, err))
+	}
+}
+
+// Accumulates JSON encoded messages into a gzip compressed JSON array.
+type attachmentBatch struct {
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	count   int
+	first   int64
+	last    int64
+	subject string
+}
+
+func newAttachmentBatch() (b *attachmentBatch) {
+	b = new(attachmentBatch)
+	b.gz = gzip.NewWriter(&b.buf)
+	return
+}
+
+func (b *attachmentBatch) add(msg *message.Message) (err error) {
+	var contents []byte
+	if contents, err = json.Marshal(msg); err != nil {
+		return
+	}
+	if b.count == 0 {
+		b.gz.Write([]byte("["))
+	} else {
+		b.gz.Write([]byte(","))
+	}
+	if _, err = b.gz.Write(contents); err != nil {
+		return
+	}
+	ts := msg.GetTimestamp()
+	if b.count == 0 || ts < b.first {
+		b.first = ts
+	}
+	if ts > b.last {
+		b.last = ts
+	}
+	b.count++
+	return
+}
+
+func (b *attachmentBatch) reset() {
+	b.buf.Reset()
+	b.gz.Reset(&b.buf)
+	b.count = 0
+	b.first = 0
+	b.last = 0
+}
+
+// Closes the JSON array and the gzip stream and returns the complete MIME
+// encoded email.
+func (b *attachmentBatch) email(name string) (contents []byte, err error) {
+	b.gz.Write([]byte("]"))
+	if err = b.gz.Close(); err != nil {
+		return
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	fmt.Fprintf(&body, "Subject: %s\r\nMIME-Version: 1.0\r\n", b.subject)
+	fmt.Fprintf(&body, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n",
+		writer.Boundary())
+
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(part, "%d messages from %s to %s are attached as %s\r\n",
+		b.count, time.Unix(0, b.first).UTC().Format(time.RFC3339),
+		time.Unix(0, b.last).UTC().Format(time.RFC3339), name)
+
+	header = make(textproto.MIMEHeader)
+	header.Set("Content-Type", fmt.Sprintf("application/gzip; name=\"%s\"", name))
+	header.Set("Content-Transfer-Encoding", "base64")
+	header.Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", name))
+	if part, err = writer.CreatePart(header); err != nil {
+		return
+	}
+	encoded := base64.StdEncoding.EncodeToString(b.buf.Bytes())
+	for len(encoded) > 76 {
+		fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(part, "%s\r\n", encoded)
+
+	if err = writer.Close(); err != nil {
+		return
+	}
+	return body.Bytes(), nil
+}
+
+// Accumulates payloads (or JSON encoded messages) into the body of a single
+// email, separated by blank lines.
+type emailBatch struct {
+	body        bytes.Buffer
+	count       int
+	subject     string
+	headers     string
+	payloadOnly bool
+}
+
+func (b *emailBatch) add(msg *message.Message) (err error) {
+	var contents []byte
+	if b.payloadOnly {
+		contents = []byte(msg.GetPayload())
+	} else if contents, err = json.Marshal(msg); err != nil {
+		return
+	}
+	if b.count == 0 {
+		if b.payloadOnly {
+			b.headers = contentHeaders(msg)
 		}
-		pack.Recycle()
+	} else {
+		b.body.WriteString("\r\n\r\n")
+	}
+	b.body.Write(contents)
+	b.count++
+	return
+}
+
+func (b *emailBatch) reset() {
+	b.body.Reset()
+	b.count = 0
+	b.subject = ""
+	b.headers = ""
+}
+
+// Returns the complete email, the MIME headers are those of the first
+// message.
+func (b *emailBatch) email() []byte {
+	return []byte(fmt.Sprintf("Subject: %s\r\n%s\r\n%s", b.subject, b.headers,
+		b.body.Bytes()))
+}
+
+// Caps the number of emails sent per window, counting the emails and
+// messages held back since the window started.
+type emailLimiter struct {
+	max             int
+	window          time.Duration
+	start           time.Time
+	sent            int
+	droppedEmails   int
+	droppedMessages int
+	// Replaced in tests.
+	now func() time.Time
+}
+
+func newEmailLimiter(max int, window time.Duration) (l *emailLimiter) {
+	l = &emailLimiter{max: max, window: window, now: time.Now}
+	l.start = l.now()
+	return
+}
+
+// Returns whether another email fits in the current window, counting it as
+// dropped if not.
+func (l *emailLimiter) allow(messages int) bool {
+	if l.sent < l.max {
+		l.sent++
+		return true
+	}
+	l.droppedEmails++
+	l.droppedMessages += messages
+	return false
+}
+
+// Starts a new window if the current one is over, returning what was
+// dropped during it and when it started.
+func (l *emailLimiter) roll() (emails, messages int, start time.Time) {
+	now := l.now()
+	if now.Sub(l.start) < l.window {
+		return
 	}
+	emails, messages, start = l.droppedEmails, l.droppedMessages, l.start
+	l.start = now
+	l.sent = 0
+	l.droppedEmails = 0
+	l.droppedMessages = 0
 	return
 }
 
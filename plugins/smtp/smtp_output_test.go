@@ -15,17 +15,28 @@
 package smtp
 
 import (
+	"bufio"
 	"bytes"
 	"code.google.com/p/gomock/gomock"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
 	"net/smtp"
+	"strings"
 	"sync"
 	"testing"
-	//  "time"
+	"time"
 )
 
 var sendCount int
@@ -101,6 +112,33 @@ func SmtpOutputSpec(c gs.Context) {
 			wg.Wait()
 		})
 
+		c.Specify("send html payloads as html", func() {
+			err := smtpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			var sent []byte
+			smtpOutput.sendFunction = func(addr string, a smtp.Auth, from string,
+				to []string, msg []byte) error {
+				sent = msg
+				return nil
+			}
+
+			pack.Message.SetPayload("<p>Daily report</p>")
+			field, _ := message.NewField("payload_type", "html", "")
+			pack.Message.AddField(field)
+			inChan <- pack
+			close(inChan)
+			smtpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+
+			email, err := mail.ReadMessage(bytes.NewReader(sent))
+			c.Assume(err, gs.IsNil)
+			c.Expect(email.Header.Get("Subject"), gs.Equals, "SmtpOutput")
+			c.Expect(email.Header.Get("Content-Type"), gs.Equals,
+				"text/html; charset=utf-8")
+			body, err := ioutil.ReadAll(email.Body)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(body), gs.Equals, "<p>Daily report</p>")
+		})
+
 		c.Specify("send email json message", func() {
 			config.PayloadOnly = false
 
@@ -119,6 +157,174 @@ func SmtpOutputSpec(c gs.Context) {
 			close(inChan)
 			wg.Wait()
 		})
+
+		c.Specify("send email with compressed attachment", func() {
+			config.SendAttachment = true
+			config.AttachmentMaxMessages = 2
+
+			err := smtpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			var sent [][]byte
+			smtpOutput.sendFunction = func(addr string, a smtp.Auth, from string,
+				to []string, msg []byte) error {
+				sent = append(sent, msg)
+				return nil
+			}
+
+			pack2 := NewPipelinePack(pConfig.InputRecycleChan())
+			pack2.Message = pipeline_ts.GetTestMessage()
+			pack3 := NewPipelinePack(pConfig.InputRecycleChan())
+			pack3.Message = pipeline_ts.GetTestMessage()
+			inChan = make(chan *PipelinePack, 3)
+			inChanCall.Return(inChan)
+			inChan <- pack
+			inChan <- pack2
+			inChan <- pack3
+			close(inChan)
+			err = smtpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(err, gs.IsNil)
+			// Two messages fill the first batch, the third is flushed on
+			// shutdown.
+			c.Expect(len(sent), gs.Equals, 2)
+
+			email, err := mail.ReadMessage(bytes.NewReader(sent[0]))
+			c.Assume(err, gs.IsNil)
+			c.Expect(email.Header.Get("Subject"), gs.Equals, "SmtpOutput")
+			mediaType, params, err := mime.ParseMediaType(email.Header.Get("Content-Type"))
+			c.Assume(err, gs.IsNil)
+			c.Expect(mediaType, gs.Equals, "multipart/mixed")
+
+			reader := multipart.NewReader(email.Body, params["boundary"])
+			part, err := reader.NextPart()
+			c.Assume(err, gs.IsNil)
+			summary, _ := ioutil.ReadAll(part)
+			c.Expect(strings.HasPrefix(string(summary), "2 messages from"), gs.IsTrue)
+
+			part, err = reader.NextPart()
+			c.Assume(err, gs.IsNil)
+			c.Expect(part.FileName(), gs.Equals, "heka_messages.json.gz")
+			encoded, _ := ioutil.ReadAll(part)
+			compressed, err := base64.StdEncoding.DecodeString(
+				strings.Replace(string(encoded), "\r\n", "", -1))
+			c.Assume(err, gs.IsNil)
+			gz, err := gzip.NewReader(bytes.NewReader(compressed))
+			c.Assume(err, gs.IsNil)
+			var msgs []*message.Message
+			err = json.NewDecoder(gz).Decode(&msgs)
+			c.Expect(err, gs.IsNil)
+			c.Expect(len(msgs), gs.Equals, 2)
+			c.Expect(msgs[1].GetPayload(), gs.Equals, "Test Payload")
+		})
+
+		c.Specify("batches payloads into a single email", func() {
+			config.BatchCount = 2
+			config.Subject = "%Severity% %Type% on %Hostname%: %foo%"
+			err := smtpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			var sent [][]byte
+			smtpOutput.sendFunction = func(addr string, a smtp.Auth, from string,
+				to []string, msg []byte) error {
+				sent = append(sent, msg)
+				return nil
+			}
+
+			inChan = make(chan *PipelinePack, 3)
+			inChanCall.Return(inChan)
+			for _, payload := range []string{"one", "two", "three"} {
+				p := NewPipelinePack(pConfig.InputRecycleChan())
+				p.Message = pipeline_ts.GetTestMessage()
+				p.Message.SetPayload(payload)
+				inChan <- p
+			}
+			close(inChan)
+			err = smtpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+			c.Expect(err, gs.IsNil)
+			c.Assume(len(sent), gs.Equals, 2)
+			c.Expect(string(sent[0]), gs.Equals,
+				"Subject: 6 TEST on my.host.name: bar\r\n\r\none\r\n\r\ntwo")
+			c.Expect(string(sent[1]), gs.Equals,
+				"Subject: 6 TEST on my.host.name: bar\r\n\r\nthree")
+		})
+
+		c.Specify("limits the emails sent per window", func() {
+			config.RateLimit = 1
+			config.RateLimitWindow = 60
+			err := smtpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			var sent []string
+			smtpOutput.sendFunction = func(addr string, a smtp.Auth, from string,
+				to []string, msg []byte) error {
+				sent = append(sent, string(msg))
+				return nil
+			}
+			now := time.Unix(1400000000, 0)
+			smtpOutput.limiter.now = func() time.Time { return now }
+			smtpOutput.limiter.start = now
+
+			email := []byte("Subject: SmtpOutput\r\n\r\nTest Payload")
+			for i := 0; i < 3; i++ {
+				err = smtpOutput.deliver(oth.MockOutputRunner, email, 1)
+				c.Expect(err, gs.IsNil)
+			}
+			c.Expect(len(sent), gs.Equals, 1)
+			smtpOutput.sendOverflowSummary(oth.MockOutputRunner)
+			c.Expect(len(sent), gs.Equals, 1)
+
+			now = now.Add(time.Minute)
+			smtpOutput.sendOverflowSummary(oth.MockOutputRunner)
+			c.Assume(len(sent), gs.Equals, 2)
+			c.Expect(sent[0], gs.Equals, "Subject: SmtpOutput\r\n\r\nTest Payload")
+			c.Expect(strings.HasPrefix(sent[1],
+				"Subject: SmtpOutput: 2 emails suppressed\r\n"), gs.IsTrue)
+			c.Expect(strings.Contains(sent[1], "2 emails with 2 messages"), gs.IsTrue)
+		})
+
+		c.Specify("requires STARTTLS if configured", func() {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			c.Assume(err, gs.IsNil)
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				conn.Write([]byte("220 localhost ESMTP\r\n"))
+				reader.ReadString('\n') // EHLO
+				conn.Write([]byte("250 localhost\r\n"))
+				ioutil.ReadAll(reader)
+			}()
+
+			config.Host = listener.Addr().String()
+			config.TlsMode = "starttls"
+			err = smtpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			err = smtpOutput.sendFunction(config.Host, nil, config.SendFrom,
+				config.SendTo, []byte("Subject: test\r\n\r\n"))
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(err.Error(), gs.Equals, "server doesn't support STARTTLS")
+		})
+
+		c.Specify("rejects an unknown tls_mode", func() {
+			config.TlsMode = "ssl"
+			err := smtpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an empty attachment size", func() {
+			config.SendAttachment = true
+			config.AttachmentMaxMessages = 0
+			err := smtpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+
+		c.Specify("rejects an empty attachment interval", func() {
+			config.SendAttachment = true
+			config.AttachmentInterval = 0
+			err := smtpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
 	})
 
 	// Use this test with a real server
@@ -35,8 +35,9 @@ type metric struct {
 // StatsdInput exactly as if a statsd message has come from a networked statsd
 // client.
 type StatFilter struct {
-	metrics       map[string]metric
-	statAccumName string
+	metrics             map[string]metric
+	statAccumName       string
+	idempotencyKeyField string
 }
 
 // StatFilter config struct.
@@ -47,6 +48,10 @@ type StatFilterConfig struct {
 	// Configured name of StatAccumInput plugin to which this filter should be
 	// delivering its stats. Defaults to "StatsAccumInput".
 	StatAccumName string `toml:"stat_accum_name"`
+	// Name of a message field identifying the delivery, the stats generated
+	// from messages with the same value are only counted once per
+	// StatAccumInput interval. Optional.
+	IdempotencyKeyField string `toml:"idempotency_key_field"`
 }
 
 func (s *StatFilter) ConfigStruct() interface{} {
@@ -59,6 +64,7 @@ func (s *StatFilter) Init(config interface{}) (err error) {
 	conf := config.(*StatFilterConfig)
 	s.metrics = conf.Metric
 	s.statAccumName = conf.StatAccumName
+	s.idempotencyKeyField = conf.IdempotencyKeyField
 	return
 }
 
@@ -74,11 +80,18 @@ func (s *StatFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 	if statAccum, err = h.StatAccumulator(s.statAccumName); err != nil {
 		return
 	}
+	idempotentAccum, _ := statAccum.(IdempotentStatAccumulator)
+	if s.idempotencyKeyField != "" && idempotentAccum == nil {
+		return fmt.Errorf("StatAccumulator '%s' can't ignore duplicates",
+			s.statAccumName)
+	}
 
 	var (
 		pack   *PipelinePack
 		values = make(map[string]string)
 		stat   Stat
+		key    string
+		sent   bool
 	)
 
 	inChan := fr.InChan()
@@ -95,6 +108,8 @@ func (s *StatFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 			}
 		}
 
+		key = IdempotencyKey(pack.Message, s.idempotencyKeyField)
+
 		// We matched, generate appropriate metrics
 		for _, met := range s.metrics {
 			stat.Bucket = InterpolateString(met.Name, values)
@@ -108,7 +123,12 @@ func (s *StatFilter) Run(fr FilterRunner, h PluginHelper) (err error) {
 			}
 			stat.Value = InterpolateString(met.Value, values)
 			stat.Sampling = 1.0
-			if !statAccum.DropStat(stat) {
+			if key != "" {
+				sent = idempotentAccum.DropStatOnce(stat, key)
+			} else {
+				sent = statAccum.DropStat(stat)
+			}
+			if !sent {
 				fr.LogError(fmt.Errorf("Undelivered stat: %s", stat))
 			}
 		}
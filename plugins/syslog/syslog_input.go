@@ -0,0 +1,253 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"bufio"
+	"code.google.com/p/go-uuid/uuid"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConfigStruct for SyslogInput.
+type SyslogInputConfig struct {
+	// Socket type: "udp", "tcp", "unixgram" or "unix".
+	Net string
+	// Address to listen on, a path for the unix socket types.
+	Address string
+	// Optional decoder the parsed messages are handed to.
+	Decoder string
+	// Maximum number of simultaneous stream connections, zero is unlimited.
+	MaxConnections int `toml:"max_connections"`
+	// Maximum size of a single record in bytes, longer records are
+	// truncated (newline framing) or rejected (octet counting).
+	MaxRecordSize int `toml:"max_record_size"`
+}
+
+// Input plugin that receives syslog records over datagram or stream sockets
+// and parses them straight into Heka messages. Stream connections each get
+// their own goroutine.
+type SyslogInput struct {
+	config      *SyslogInputConfig
+	listener    net.Listener
+	packetConn  net.PacketConn
+	ir          InputRunner
+	dr          DecoderRunner
+	wg          sync.WaitGroup
+	connsLock   sync.Mutex
+	conns       map[net.Conn]bool
+	stopped     int32
+	parseErrors int64
+	rejected    int64
+}
+
+func (s *SyslogInput) ConfigStruct() interface{} {
+	return &SyslogInputConfig{
+		Net:           "udp",
+		Address:       "127.0.0.1:514",
+		MaxRecordSize: 64 * 1024,
+	}
+}
+
+func (s *SyslogInput) Init(config interface{}) (err error) {
+	s.config = config.(*SyslogInputConfig)
+	s.conns = make(map[net.Conn]bool)
+	if s.config.MaxRecordSize <= 0 {
+		return fmt.Errorf("max_record_size must be positive")
+	}
+	switch s.config.Net {
+	case "udp", "unixgram":
+		if s.config.Net == "unixgram" {
+			os.Remove(s.config.Address)
+		}
+		if s.packetConn, err = net.ListenPacket(s.config.Net, s.config.Address); err != nil {
+			return fmt.Errorf("listening on %s %s: %s", s.config.Net,
+				s.config.Address, err)
+		}
+	case "tcp", "unix":
+		if s.config.Net == "unix" {
+			os.Remove(s.config.Address)
+		}
+		if s.listener, err = net.Listen(s.config.Net, s.config.Address); err != nil {
+			return fmt.Errorf("listening on %s %s: %s", s.config.Net,
+				s.config.Address, err)
+		}
+	default:
+		return fmt.Errorf("unknown net: %s", s.config.Net)
+	}
+	return
+}
+
+func (s *SyslogInput) Run(ir InputRunner, h PluginHelper) (err error) {
+	s.ir = ir
+	if s.config.Decoder != "" {
+		var ok bool
+		if s.dr, ok = h.DecoderRunner(s.config.Decoder); !ok {
+			return fmt.Errorf("Error getting decoder: %s", s.config.Decoder)
+		}
+	}
+	if s.packetConn != nil {
+		s.readPackets()
+		return
+	}
+
+	for {
+		conn, e := s.listener.Accept()
+		if e != nil {
+			if atomic.LoadInt32(&s.stopped) != 0 {
+				break
+			}
+			if neterr, ok := e.(net.Error); ok && neterr.Temporary() {
+				ir.LogError(fmt.Errorf("accept failed: %s", e))
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			err = e
+			break
+		}
+		s.connsLock.Lock()
+		if s.config.MaxConnections > 0 && len(s.conns) >= s.config.MaxConnections {
+			s.connsLock.Unlock()
+			atomic.AddInt64(&s.rejected, 1)
+			conn.Close()
+			continue
+		}
+		s.conns[conn] = true
+		s.connsLock.Unlock()
+		s.wg.Add(1)
+		go s.handleConnection(conn)
+	}
+	s.wg.Wait()
+	return
+}
+
+// Reads one record per datagram.
+func (s *SyslogInput) readPackets() {
+	buf := make([]byte, s.config.MaxRecordSize)
+	for {
+		n, addr, err := s.packetConn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadInt32(&s.stopped) != 0 {
+				return
+			}
+			if !strings.Contains(err.Error(), "use of closed") {
+				s.ir.LogError(fmt.Errorf("read error: %s", err))
+			}
+			continue
+		}
+		if n > 0 {
+			s.deliver(buf[:n], addr)
+		}
+	}
+}
+
+// Reads framed records from a stream connection until it's closed.
+func (s *SyslogInput) handleConnection(conn net.Conn) {
+	defer func() {
+		s.connsLock.Lock()
+		delete(s.conns, conn)
+		s.connsLock.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	reader := bufio.NewReaderSize(conn, s.config.MaxRecordSize)
+	for {
+		record, err := readFrame(reader, s.config.MaxRecordSize)
+		if atomic.LoadInt32(&s.stopped) != 0 {
+			// Don't wait for a pack, the pipeline may be shutting down.
+			return
+		}
+		if len(record) > 0 {
+			s.deliver(record, conn.RemoteAddr())
+		}
+		if err != nil {
+			if err == ErrFrameTooLarge {
+				s.ir.LogError(fmt.Errorf("closing connection from %s: %s",
+					conn.RemoteAddr(), err))
+			}
+			return
+		}
+	}
+}
+
+// Turns a record into a message and passes it on. Records that can't be
+// parsed are delivered with the raw record as the payload.
+func (s *SyslogInput) deliver(record []byte, addr net.Addr) {
+	pack := <-s.ir.InChan()
+	msg := pack.Message
+	if err := ParseSyslog(record, msg, time.Now()); err != nil {
+		atomic.AddInt64(&s.parseErrors, 1)
+		msg.SetTimestamp(time.Now().UnixNano())
+		msg.SetPayload(string(record))
+	}
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetType("syslog")
+	msg.SetLogger(s.ir.Name())
+	msg.SetEnvVersion("0.8")
+	if msg.GetHostname() == "" && addr != nil && addr.String() != "" {
+		host := addr.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		msg.SetHostname(host)
+	}
+	JournalPack(s.ir, pack, s.dr)
+	if s.dr == nil {
+		s.ir.Inject(pack)
+	} else {
+		s.dr.InChan() <- pack
+	}
+}
+
+func (s *SyslogInput) Stop() {
+	atomic.StoreInt32(&s.stopped, 1)
+	if s.packetConn != nil {
+		s.packetConn.Close()
+		if s.config.Net == "unixgram" {
+			os.Remove(s.config.Address)
+		}
+		return
+	}
+	s.listener.Close()
+	s.connsLock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsLock.Unlock()
+}
+
+// Reports the parse failures and rejected connections.
+func (s *SyslogInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ParseErrors", atomic.LoadInt64(&s.parseErrors), "count")
+	message.NewInt64Field(msg, "RejectedConnections", atomic.LoadInt64(&s.rejected),
+		"count")
+	s.connsLock.Lock()
+	message.NewIntField(msg, "Connections", len(s.conns), "count")
+	s.connsLock.Unlock()
+	return nil
+}
+
+func init() {
+	RegisterPlugin("SyslogInput", func() interface{} {
+		return new(SyslogInput)
+	})
+}
@@ -0,0 +1,113 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"code.google.com/p/gomock/gomock"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"time"
+)
+
+func SyslogInputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+	ir := pipelinemock.NewMockInputRunner(ctrl)
+	helper := pipelinemock.NewMockPluginHelper(ctrl)
+	packSupply := make(chan *PipelinePack, 2)
+	injected := make(chan *PipelinePack, 2)
+
+	ir.EXPECT().InChan().Return(packSupply).AnyTimes()
+	ir.EXPECT().Name().Return("syslog").AnyTimes()
+	ir.EXPECT().Inject(gomock.Any()).Do(func(pack *PipelinePack) {
+		injected <- pack
+	}).AnyTimes()
+
+	receive := func() *PipelinePack {
+		select {
+		case pack := <-injected:
+			return pack
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	c.Specify("A SyslogInput", func() {
+		input := new(SyslogInput)
+		config := input.ConfigStruct().(*SyslogInputConfig)
+		config.Address = "127.0.0.1:0"
+		for i := 0; i < 2; i++ {
+			packSupply <- NewPipelinePack(pConfig.InputRecycleChan())
+		}
+
+		c.Specify("reads framed records over TCP", func() {
+			config.Net = "tcp"
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			done := make(chan error)
+			go func() {
+				done <- input.Run(ir, helper)
+			}()
+
+			conn, err := net.Dial("tcp", input.listener.Addr().String())
+			c.Assume(err, gs.IsNil)
+			conn.Write([]byte("<34>Oct 11 22:14:15 mymachine su: failed\n"))
+			conn.Write([]byte("23 <165>1 - host app - - -"))
+
+			pack := receive()
+			c.Assume(pack, gs.Not(gs.IsNil))
+			c.Expect(pack.Message.GetType(), gs.Equals, "syslog")
+			c.Expect(pack.Message.GetLogger(), gs.Equals, "syslog")
+			c.Expect(pack.Message.GetHostname(), gs.Equals, "mymachine")
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "failed")
+			pack = receive()
+			c.Assume(pack, gs.Not(gs.IsNil))
+			c.Expect(pack.Message.GetSeverity(), gs.Equals, int32(5))
+			c.Expect(pack.Message.GetHostname(), gs.Equals, "host")
+
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+		})
+
+		c.Specify("reads datagrams over UDP", func() {
+			config.Net = "udp"
+			err := input.Init(config)
+			c.Assume(err, gs.IsNil)
+			done := make(chan error)
+			go func() {
+				done <- input.Run(ir, helper)
+			}()
+
+			conn, err := net.Dial("udp", input.packetConn.LocalAddr().String())
+			c.Assume(err, gs.IsNil)
+			conn.Write([]byte("not syslog at all"))
+
+			pack := receive()
+			c.Assume(pack, gs.Not(gs.IsNil))
+			c.Expect(pack.Message.GetPayload(), gs.Equals, "not syslog at all")
+			c.Expect(pack.Message.GetHostname(), gs.Equals, "127.0.0.1")
+			c.Expect(input.parseErrors, gs.Equals, int64(1))
+
+			input.Stop()
+			c.Expect(<-done, gs.IsNil)
+		})
+	})
+}
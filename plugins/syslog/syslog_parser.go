@@ -0,0 +1,275 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"io"
+	"strconv"
+	"time"
+)
+
+const NILVALUE = "-"
+
+var (
+	ErrNoPriority    = errors.New("missing or invalid priority")
+	ErrFrameTooLarge = errors.New("octet counted frame too large")
+	utf8BOM          = []byte{0xef, 0xbb, 0xbf}
+)
+
+// Populates msg from a single syslog record in either RFC 5424 or the older
+// BSD (RFC 3164) format. The severity and header fields go into the message
+// headers, the rest into fields; the free form text becomes the payload. On
+// error the message is left untouched.
+func ParseSyslog(record []byte, msg *message.Message, now time.Time) (err error) {
+	record = bytes.TrimRight(record, "\r\n\x00")
+	pri, rest, err := parsePriority(record)
+	if err != nil {
+		return
+	}
+	if len(rest) > 1 && rest[0] >= '1' && rest[0] <= '9' && rest[1] == ' ' {
+		err = parseRFC5424(rest, msg, now)
+	} else {
+		parseRFC3164(rest, msg, now)
+	}
+	if err == nil {
+		msg.SetSeverity(int32(pri & 7))
+		message.NewIntField(msg, "syslogfacility", pri>>3, "")
+	}
+	return
+}
+
+// Splits the "<PRI>" prefix off a record.
+func parsePriority(record []byte) (pri int, rest []byte, err error) {
+	end := bytes.IndexByte(record, '>')
+	if len(record) < 3 || record[0] != '<' || end < 2 || end > 4 {
+		return 0, nil, ErrNoPriority
+	}
+	if pri, err = strconv.Atoi(string(record[1:end])); err != nil || pri > 191 {
+		return 0, nil, ErrNoPriority
+	}
+	return pri, record[end+1:], nil
+}
+
+// Returns the next space separated token and what follows it.
+func nextToken(b []byte) (token string, rest []byte) {
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		return string(b[:i]), b[i+1:]
+	}
+	return string(b), nil
+}
+
+func parseRFC5424(b []byte, msg *message.Message, now time.Time) (err error) {
+	var version, ts, host, app, procId, msgId string
+	version, b = nextToken(b)
+	ts, b = nextToken(b)
+	host, b = nextToken(b)
+	app, b = nextToken(b)
+	procId, b = nextToken(b)
+	msgId, b = nextToken(b)
+
+	timestamp := now
+	if ts != NILVALUE {
+		if timestamp, err = time.Parse(time.RFC3339Nano, ts); err != nil {
+			return fmt.Errorf("invalid timestamp: %s", ts)
+		}
+	}
+	var sd map[string]string
+	if len(b) > 0 && b[0] == '[' {
+		if sd, b, err = parseStructuredData(b); err != nil {
+			return
+		}
+	} else if len(b) > 0 && b[0] == '-' {
+		b = b[1:]
+	}
+	if len(b) > 0 && b[0] == ' ' {
+		b = b[1:]
+	}
+
+	msg.SetTimestamp(timestamp.UnixNano())
+	if host != NILVALUE {
+		msg.SetHostname(host)
+	}
+	if app != NILVALUE {
+		message.NewStringField(msg, "programname", app)
+	}
+	if procId != NILVALUE {
+		if pid, err := strconv.Atoi(procId); err == nil {
+			msg.SetPid(int32(pid))
+		} else {
+			message.NewStringField(msg, "procid", procId)
+		}
+	}
+	if msgId != NILVALUE {
+		message.NewStringField(msg, "msgid", msgId)
+	}
+	if v, err := strconv.Atoi(version); err == nil {
+		message.NewIntField(msg, "syslogversion", v, "")
+	}
+	for name, value := range sd {
+		message.NewStringField(msg, name, value)
+	}
+	msg.SetPayload(string(bytes.TrimPrefix(b, utf8BOM)))
+	return nil
+}
+
+// Parses one or more "[id name="value" ...]" elements, returning the params
+// as "sd.{id}.{name}" keys.
+func parseStructuredData(b []byte) (sd map[string]string, rest []byte, err error) {
+	sd = make(map[string]string)
+	malformed := errors.New("malformed structured data")
+	for len(b) > 0 && b[0] == '[' {
+		b = b[1:]
+		end := bytes.IndexAny(b, " ]")
+		if end <= 0 {
+			return nil, nil, malformed
+		}
+		id := string(b[:end])
+		b = b[end:]
+		for len(b) > 0 && b[0] == ' ' {
+			b = b[1:]
+			eq := bytes.IndexByte(b, '=')
+			if eq <= 0 || len(b) < eq+2 || b[eq+1] != '"' {
+				return nil, nil, malformed
+			}
+			name := string(b[:eq])
+			b = b[eq+2:]
+			var value []byte
+			closed := false
+			for i := 0; i < len(b); i++ {
+				if b[i] == '\\' && i+1 < len(b) {
+					i++
+					if b[i] != '"' && b[i] != '\\' && b[i] != ']' {
+						value = append(value, '\\')
+					}
+					value = append(value, b[i])
+				} else if b[i] == '"' {
+					b = b[i+1:]
+					closed = true
+					break
+				} else {
+					value = append(value, b[i])
+				}
+			}
+			if !closed {
+				return nil, nil, malformed
+			}
+			sd[fmt.Sprintf("sd.%s.%s", id, name)] = string(value)
+		}
+		if len(b) == 0 || b[0] != ']' {
+			return nil, nil, malformed
+		}
+		b = b[1:]
+	}
+	return sd, b, nil
+}
+
+// BSD syslog is loosely specified, so anything after the priority that
+// doesn't look like a header ends up in the payload.
+func parseRFC3164(b []byte, msg *message.Message, now time.Time) {
+	timestamp := now
+	headerOk := false
+	if len(b) >= 16 && b[15] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, string(b[:15]),
+			now.Location()); err == nil {
+			// There's no year, use the one closest to now.
+			timestamp = t.AddDate(now.Year(), 0, 0)
+			if timestamp.After(now.AddDate(0, 0, 1)) {
+				timestamp = timestamp.AddDate(-1, 0, 0)
+			}
+			b = b[16:]
+			headerOk = true
+		}
+	} else if ts, rest := nextToken(b); len(ts) > 0 {
+		// Some senders use RFC 3339 timestamps in otherwise BSD records.
+		if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+			timestamp = t
+			b = rest
+			headerOk = true
+		}
+	}
+	if headerOk {
+		var host string
+		if host, b = nextToken(b); host != "" {
+			msg.SetHostname(host)
+		}
+	}
+	msg.SetTimestamp(timestamp.UnixNano())
+
+	// The tag, e.g. "sshd[1234]: ", is optional.
+	if colon := bytes.Index(b, []byte(": ")); colon > 0 &&
+		bytes.IndexByte(b[:colon], ' ') < 0 {
+
+		tag := b[:colon]
+		if open := bytes.IndexByte(tag, '['); open > 0 && tag[len(tag)-1] == ']' {
+			procId := string(tag[open+1 : len(tag)-1])
+			if pid, err := strconv.Atoi(procId); err == nil {
+				msg.SetPid(int32(pid))
+			} else {
+				message.NewStringField(msg, "procid", procId)
+			}
+			tag = tag[:open]
+		}
+		message.NewStringField(msg, "programname", string(tag))
+		b = b[colon+2:]
+	}
+	msg.SetPayload(string(b))
+}
+
+// Reads one record from a stream socket. Records are either octet counted
+// ("{length} {record}", RFC 6587) or terminated by a newline; the framing is
+// detected for every record.
+func readFrame(r *bufio.Reader, maxSize int) (record []byte, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] >= '1' && first[0] <= '9' {
+		var lenStr string
+		if lenStr, err = r.ReadString(' '); err != nil {
+			return
+		}
+		size, err := strconv.Atoi(lenStr[:len(lenStr)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame length: %s", lenStr)
+		}
+		if size > maxSize {
+			return nil, ErrFrameTooLarge
+		}
+		record = make([]byte, size)
+		_, err = io.ReadFull(r, record)
+		return record, err
+	}
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// Deliver what fits and drop the rest of the line.
+		record = append([]byte(nil), line...)
+		for err == bufio.ErrBufferFull {
+			_, err = r.ReadSlice('\n')
+		}
+		return record, err
+	}
+	if len(line) > 0 {
+		record = append([]byte(nil), line...)
+		if err == io.EOF {
+			err = nil
+		}
+	}
+	return
+}
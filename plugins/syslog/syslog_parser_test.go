@@ -0,0 +1,128 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package syslog
+
+import (
+	"bufio"
+	"github.com/mozilla-services/heka/message"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io"
+	"strings"
+	"time"
+)
+
+func SyslogParserSpec(c gs.Context) {
+	now := time.Date(2014, time.January, 2, 10, 0, 0, 0, time.UTC)
+
+	fieldValue := func(msg *message.Message, name string) interface{} {
+		f := msg.FindFirstField(name)
+		if f == nil {
+			return nil
+		}
+		return f.GetValue()
+	}
+
+	c.Specify("A syslog parser", func() {
+		msg := new(message.Message)
+
+		c.Specify("parses RFC 5424 records", func() {
+			record := `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="App\"lication"][origin ip="192.0.2.1"] An application event`
+			err := ParseSyslog([]byte(record+"\n"), msg, now)
+			c.Assume(err, gs.IsNil)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(5))
+			c.Expect(fieldValue(msg, "syslogfacility"), gs.Equals, int64(20))
+			c.Expect(msg.GetHostname(), gs.Equals, "mymachine.example.com")
+			ts := time.Date(2003, time.October, 11, 22, 14, 15, 3000000, time.UTC)
+			c.Expect(msg.GetTimestamp(), gs.Equals, ts.UnixNano())
+			c.Expect(fieldValue(msg, "programname"), gs.Equals, "evntslog")
+			c.Expect(fieldValue(msg, "msgid"), gs.Equals, "ID47")
+			c.Expect(fieldValue(msg, "sd.exampleSDID@32473.iut"), gs.Equals, "3")
+			c.Expect(fieldValue(msg, "sd.exampleSDID@32473.eventSource"), gs.Equals,
+				`App"lication`)
+			c.Expect(fieldValue(msg, "sd.origin.ip"), gs.Equals, "192.0.2.1")
+			c.Expect(msg.GetPayload(), gs.Equals, "An application event")
+		})
+
+		c.Specify("parses RFC 5424 records with nil values", func() {
+			err := ParseSyslog([]byte("<13>1 - - - 42 - -"), msg, now)
+			c.Assume(err, gs.IsNil)
+			c.Expect(msg.GetTimestamp(), gs.Equals, now.UnixNano())
+			c.Expect(msg.GetPid(), gs.Equals, int32(42))
+			c.Expect(msg.GetPayload(), gs.Equals, "")
+			c.Expect(fieldValue(msg, "programname"), gs.IsNil)
+		})
+
+		c.Specify("parses RFC 3164 records", func() {
+			record := "<34>Oct 11 22:14:15 mymachine su[230]: 'su root' failed on /dev/pts/8"
+			err := ParseSyslog([]byte(record), msg, now)
+			c.Assume(err, gs.IsNil)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(2))
+			c.Expect(fieldValue(msg, "syslogfacility"), gs.Equals, int64(4))
+			c.Expect(msg.GetHostname(), gs.Equals, "mymachine")
+			c.Expect(msg.GetPid(), gs.Equals, int32(230))
+			c.Expect(fieldValue(msg, "programname"), gs.Equals, "su")
+			c.Expect(msg.GetPayload(), gs.Equals, "'su root' failed on /dev/pts/8")
+			// October is closer in the past than in the future.
+			ts := time.Date(2013, time.October, 11, 22, 14, 15, 0, time.UTC)
+			c.Expect(msg.GetTimestamp(), gs.Equals, ts.UnixNano())
+		})
+
+		c.Specify("keeps RFC 3164 records without a header", func() {
+			err := ParseSyslog([]byte("<13>just some text"), msg, now)
+			c.Assume(err, gs.IsNil)
+			c.Expect(msg.GetSeverity(), gs.Equals, int32(5))
+			c.Expect(msg.GetPayload(), gs.Equals, "just some text")
+			c.Expect(msg.GetTimestamp(), gs.Equals, now.UnixNano())
+		})
+
+		c.Specify("rejects malformed records", func() {
+			c.Expect(ParseSyslog([]byte("no priority"), msg, now), gs.Equals,
+				ErrNoPriority)
+			c.Expect(ParseSyslog([]byte("<999>1 - - - - - -"), msg, now), gs.Equals,
+				ErrNoPriority)
+			err := ParseSyslog([]byte(`<13>1 - - - - - [broken x="1"`), msg, now)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("A syslog stream", func() {
+		c.Specify("is split on octet counts and newlines", func() {
+			stream := "10 <13>1 - hi<13>newline\n17 <13>1 - two\nlines<13>last"
+			r := bufio.NewReader(strings.NewReader(stream))
+			var records []string
+			for {
+				record, err := readFrame(r, 100)
+				if len(record) > 0 {
+					records = append(records, string(record))
+				}
+				if err != nil {
+					c.Expect(err, gs.Equals, io.EOF)
+					break
+				}
+			}
+			c.Assume(len(records), gs.Equals, 4)
+			c.Expect(records[0], gs.Equals, "<13>1 - hi")
+			c.Expect(records[1], gs.Equals, "<13>newline\n")
+			c.Expect(records[2], gs.Equals, "<13>1 - two\nlines")
+			c.Expect(records[3], gs.Equals, "<13>last")
+		})
+
+		c.Specify("rejects oversized octet counted records", func() {
+			r := bufio.NewReader(strings.NewReader("500 <13>..."))
+			_, err := readFrame(r, 100)
+			c.Expect(err, gs.Equals, ErrFrameTooLarge)
+		})
+	})
+}
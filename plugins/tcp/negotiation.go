@@ -0,0 +1,345 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"code.google.com/p/goprotobuf/proto"
+	"compress/flate"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Capability negotiation between a TcpOutput and a TcpInput: when enabled,
+// the output sends a hello message listing what it supports at the start of
+// every connection, and the input answers with a hello listing what both ends
+// agree on. Hellos aren't framed as Heka records but sent as a line made of
+// HELLO_PREAMBLE and the base64 encoded message, which has no record
+// separator, so inputs predating negotiation skip it like any other bytes
+// between records. They never answer, in which case the output speaks the
+// original protocol.
+const (
+	// Version of the Heka protocol spoken after negotiating, 1 being the
+	// original one.
+	HEKA_PROTOCOL_VERSION = 2
+	// Type of the messages the two ends exchange.
+	HELLO_MESSAGE_TYPE = "heka.hello"
+	// Start of a hello line. A stream of records starts with a record
+	// separator instead.
+	HELLO_PREAMBLE = "HEKA-HELLO "
+	// Longest hello line accepted.
+	HELLO_MAX_SIZE = 4096
+	// Longest time a TcpInput waits for the rest of a hello line.
+	HELLO_READ_TIMEOUT = 10 * time.Second
+
+	COMPRESSION_NONE    = "none"
+	COMPRESSION_DEFLATE = "deflate"
+)
+
+var (
+	supportedCompressions  = []string{COMPRESSION_DEFLATE}
+	supportedSigningHashes = []string{"md5", "sha1", "sha256"}
+)
+
+// What one end of a connection supports or, in an answer, what both ends
+// agreed on.
+type capabilities struct {
+	Version int64
+	// In order of preference.
+	Compression []string
+	Signing     []string
+}
+
+func localCapabilities(compression string) *capabilities {
+	caps := &capabilities{
+		Version: HEKA_PROTOCOL_VERSION,
+		Signing: supportedSigningHashes,
+	}
+	if compression != "" && compression != COMPRESSION_NONE {
+		caps.Compression = []string{compression}
+	}
+	return caps
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns what the peer and this end both support: the lowest version, the
+// first of the peer's compressions known here and the peer's signing hashes
+// known here. Fails if there's no signing hash both know.
+func agree(peer *capabilities) (*capabilities, error) {
+	agreed := &capabilities{
+		Version:     HEKA_PROTOCOL_VERSION,
+		Compression: []string{COMPRESSION_NONE},
+	}
+	if peer.Version < agreed.Version {
+		agreed.Version = peer.Version
+	}
+	for _, compression := range peer.Compression {
+		if contains(supportedCompressions, compression) {
+			agreed.Compression[0] = compression
+			break
+		}
+	}
+	for _, hash := range peer.Signing {
+		if contains(supportedSigningHashes, hash) {
+			agreed.Signing = append(agreed.Signing, hash)
+		}
+	}
+	if len(agreed.Signing) == 0 {
+		return nil, fmt.Errorf("no signing hash in common, peer supports %s",
+			strings.Join(peer.Signing, ", "))
+	}
+	return agreed, nil
+}
+
+// Returns the agreed compression of an answer.
+func (c *capabilities) compression() string {
+	if len(c.Compression) == 0 {
+		return COMPRESSION_NONE
+	}
+	return c.Compression[0]
+}
+
+func newHelloMessage(caps *capabilities) *message.Message {
+	msg := new(message.Message)
+	msg.SetUuid(uuid.NewRandom())
+	msg.SetTimestamp(time.Now().UnixNano())
+	msg.SetType(HELLO_MESSAGE_TYPE)
+	msg.SetHostname(Globals().Hostname)
+	msg.SetPid(int32(os.Getpid()))
+	message.NewInt64Field(msg, "ProtocolVersion", caps.Version, "")
+	addStringsField(msg, "Compression", caps.Compression)
+	addStringsField(msg, "Signing", caps.Signing)
+	return msg
+}
+
+func addStringsField(msg *message.Message, name string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	field := message.NewFieldInit(name, message.Field_STRING, "")
+	for _, value := range values {
+		field.AddValue(value)
+	}
+	msg.AddField(field)
+}
+
+// Returns the capabilities carried by the message, nil if it isn't a hello.
+func parseHello(msg *message.Message) *capabilities {
+	if msg.GetType() != HELLO_MESSAGE_TYPE {
+		return nil
+	}
+	caps := &capabilities{Version: 1}
+	if version, ok := msg.GetFieldValue("ProtocolVersion"); ok {
+		if v, ok := version.(int64); ok {
+			caps.Version = v
+		}
+	}
+	for _, field := range msg.FindAllFields("Compression") {
+		caps.Compression = append(caps.Compression, field.GetValueString()...)
+	}
+	for _, field := range msg.FindAllFields("Signing") {
+		caps.Signing = append(caps.Signing, field.GetValueString()...)
+	}
+	return caps
+}
+
+func writeHello(conn net.Conn, caps *capabilities) (err error) {
+	var msgBytes []byte
+	if msgBytes, err = proto.Marshal(newHelloMessage(caps)); err != nil {
+		return
+	}
+	_, err = io.WriteString(conn, HELLO_PREAMBLE+
+		base64.StdEncoding.EncodeToString(msgBytes)+"\n")
+	return
+}
+
+// Reads a hello line, returning the capabilities it carries.
+func readHello(reader *bufio.Reader) (caps *capabilities, err error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		return
+	}
+	if !bytes.HasPrefix(line, []byte(HELLO_PREAMBLE)) {
+		return nil, errors.New("not a hello")
+	}
+	encoded := strings.TrimSpace(string(line[len(HELLO_PREAMBLE):]))
+	msgBytes, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return
+	}
+	msg := new(message.Message)
+	if err = proto.Unmarshal(msgBytes, msg); err != nil {
+		return
+	}
+	if caps = parseHello(msg); caps == nil {
+		return nil, errors.New("not a hello")
+	}
+	return
+}
+
+// Sends the local capabilities and waits up to timeout for the peer's
+// answer, returning nil if it didn't come.
+func negotiate(conn net.Conn, local *capabilities, timeout time.Duration) (
+	agreed *capabilities, err error) {
+
+	if err = writeHello(conn, local); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	if agreed, err = readHello(bufio.NewReaderSize(conn, HELLO_MAX_SIZE)); err != nil {
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("invalid answer: %s", err)
+	}
+	return
+}
+
+// Wraps the message.proto parser of a TcpInput connection, answering a hello
+// sent at its start and inflating the records that follow if compression
+// was agreed on.
+type negotiatingParser struct {
+	*MessageProtoParser
+	conn net.Conn
+	ir   InputRunner
+	// Reads the connection, so its first byte can be looked at.
+	reader  *bufio.Reader
+	started bool
+	inflate bool
+	// Incremented when a connection negotiates.
+	negotiated *int64
+}
+
+func newNegotiatingParser(conn net.Conn, ir InputRunner,
+	negotiated *int64) *negotiatingParser {
+
+	return &negotiatingParser{
+		MessageProtoParser: NewMessageProtoParser(),
+		conn:               conn,
+		ir:                 ir,
+		negotiated:         negotiated,
+	}
+}
+
+func (n *negotiatingParser) Parse(reader io.Reader) (bytesRead int,
+	record []byte, err error) {
+
+	if n.reader == nil {
+		n.reader = bufio.NewReaderSize(reader, HELLO_MAX_SIZE)
+	}
+	if !n.started {
+		var first []byte
+		if first, err = n.reader.Peek(1); err != nil {
+			return
+		}
+		n.started = true
+		if first[0] == HELLO_PREAMBLE[0] {
+			// The rest of the line may take more than the read deadline
+			// the input uses to check for shutdowns.
+			n.conn.SetReadDeadline(time.Now().Add(HELLO_READ_TIMEOUT))
+			var peer *capabilities
+			if peer, err = readHello(n.reader); err != nil {
+				return 0, nil, fmt.Errorf("invalid hello from %s: %s",
+					n.conn.RemoteAddr(), err)
+			}
+			return 0, nil, n.answer(peer)
+		}
+	}
+
+	bytesRead, record, err = n.MessageProtoParser.Parse(n.reader)
+	if len(record) == 0 {
+		return
+	}
+	if n.inflate {
+		var e error
+		if record, e = inflateRecord(record); e != nil {
+			n.ir.LogError(fmt.Errorf("dropping record from %s: %s",
+				n.conn.RemoteAddr(), e))
+			record = nil
+		}
+	}
+	return
+}
+
+func (n *negotiatingParser) answer(peer *capabilities) (err error) {
+	agreed, err := agree(peer)
+	if err != nil {
+		return fmt.Errorf("negotiating with %s: %s", n.conn.RemoteAddr(), err)
+	}
+	if err = writeHello(n.conn, agreed); err != nil {
+		return fmt.Errorf("answering hello from %s: %s", n.conn.RemoteAddr(), err)
+	}
+	n.inflate = agreed.compression() == COMPRESSION_DEFLATE
+	atomic.AddInt64(n.negotiated, 1)
+	return
+}
+
+// Returns a copy of the record with its message inflated, and the header's
+// MessageLength set to the inflated length. The signature, if any, is of the
+// inflated message already.
+func inflateRecord(record []byte) ([]byte, error) {
+	headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+	header := new(message.Header)
+	if err := proto.Unmarshal(record[message.HEADER_DELIMITER_SIZE:headerLen-1],
+		header); err != nil {
+		return nil, fmt.Errorf("invalid header: %s", err)
+	}
+	r := flate.NewReader(bytes.NewReader(record[headerLen:]))
+	defer r.Close()
+	msgBytes, err := ioutil.ReadAll(io.LimitReader(r, message.MAX_MESSAGE_SIZE+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(msgBytes) > message.MAX_MESSAGE_SIZE {
+		return nil, fmt.Errorf("inflated message exceeds MAX_MESSAGE_SIZE %d",
+			message.MAX_MESSAGE_SIZE)
+	}
+	header.SetMessageLength(uint32(len(msgBytes)))
+	headerBytes, err := proto.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+	if len(headerBytes) > message.MAX_HEADER_SIZE {
+		return nil, fmt.Errorf("header exceeds MAX_HEADER_SIZE %d",
+			message.MAX_HEADER_SIZE)
+	}
+	inflated := make([]byte, 0,
+		message.HEADER_FRAMING_SIZE+len(headerBytes)+len(msgBytes))
+	inflated = append(inflated, message.RECORD_SEPARATOR, uint8(len(headerBytes)))
+	inflated = append(inflated, headerBytes...)
+	inflated = append(inflated, message.UNIT_SEPARATOR)
+	return append(inflated, msgBytes...), nil
+}
@@ -0,0 +1,246 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package tcp
+
+import (
+	"bytes"
+	"code.google.com/p/goprotobuf/proto"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"sync/atomic"
+)
+
+// Decodes the message of a Heka framed record.
+func decodeRecord(record []byte) (msg *message.Message, err error) {
+	headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+	msg = new(message.Message)
+	err = proto.Unmarshal(record[headerLen:], msg)
+	return
+}
+
+func NegotiationSpec(c gs.Context) {
+	NewPipelineConfig(nil)
+
+	c.Specify("A negotiating TcpOutput", func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assume(err, gs.IsNil)
+		defer ln.Close()
+
+		tcpOutput := new(TcpOutput)
+		config := tcpOutput.ConfigStruct().(*TcpOutputConfig)
+		config.Address = ln.Addr().String()
+		config.Negotiate = true
+		config.Compression = COMPRESSION_DEFLATE
+
+		c.Specify("sends compressed messages to a TcpInput", func() {
+			var negotiated int64
+			records := make(chan []byte, 2)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				parser := newNegotiatingParser(conn, nil, &negotiated)
+				for {
+					_, record, err := parser.Parse(conn)
+					if len(record) > 0 {
+						records <- append([]byte(nil), record...)
+					}
+					if err != nil {
+						close(records)
+						return
+					}
+				}
+			}()
+
+			err := tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(tcpOutput.protocolVersion, gs.Equals, int64(HEKA_PROTOCOL_VERSION))
+			c.Expect(tcpOutput.compress, gs.IsTrue)
+
+			msg := pipeline_ts.GetTestMessage()
+			var outBytes []byte
+			err = tcpOutput.encoder.EncodeCompressedMessageStream(msg, &outBytes)
+			c.Assume(err, gs.IsNil)
+			_, err = tcpOutput.connection.Write(outBytes)
+			c.Assume(err, gs.IsNil)
+
+			received, err := decodeRecord(<-records)
+			c.Expect(err, gs.IsNil)
+			c.Expect(received.GetPayload(), gs.Equals, msg.GetPayload())
+			c.Expect(proto.Equal(received, msg), gs.IsTrue)
+			c.Expect(negotiated, gs.Equals, int64(1))
+
+			reportMsg := new(message.Message)
+			tcpOutput.ReportMsg(reportMsg)
+			compression, _ := reportMsg.GetFieldValue("Compression")
+			c.Expect(compression, gs.Equals, COMPRESSION_DEFLATE)
+			tcpOutput.connection.Close()
+		})
+
+		c.Specify("negotiates again when it reconnects", func() {
+			var negotiated int64
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						parser := newNegotiatingParser(conn, nil, &negotiated)
+						for {
+							if _, _, err := parser.Parse(conn); err != nil {
+								return
+							}
+						}
+					}()
+				}
+			}()
+
+			err := tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			tcpOutput.connection.Close()
+			tcpOutput.setAgreed(1, false)
+			c.Assume(tcpOutput.connect(), gs.IsNil)
+			c.Expect(atomic.LoadInt64(&negotiated), gs.Equals, int64(2))
+			c.Expect(tcpOutput.protocolVersion, gs.Equals, int64(HEKA_PROTOCOL_VERSION))
+			c.Expect(tcpOutput.compress, gs.IsTrue)
+			tcpOutput.connection.Close()
+		})
+
+		c.Specify("speaks the original protocol to a peer that skips the hello", func() {
+			config.NegotiateTimeout = 50
+			records := make(chan []byte, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				parser := NewMessageProtoParser()
+				for {
+					_, record, err := parser.Parse(conn)
+					if len(record) > 0 {
+						records <- append([]byte(nil), record...)
+						return
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+
+			err := tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+			c.Expect(tcpOutput.protocolVersion, gs.Equals, int64(1))
+			c.Expect(tcpOutput.compress, gs.IsFalse)
+
+			msg := pipeline_ts.GetTestMessage()
+			var outBytes []byte
+			err = tcpOutput.encoder.EncodeMessageStream(msg, &outBytes)
+			c.Assume(err, gs.IsNil)
+			_, err = tcpOutput.connection.Write(outBytes)
+			c.Assume(err, gs.IsNil)
+			received, err := decodeRecord(<-records)
+			c.Expect(err, gs.IsNil)
+			c.Expect(received.GetType(), gs.Equals, msg.GetType())
+			c.Expect(received.GetUuidString(), gs.Equals, msg.GetUuidString())
+			tcpOutput.connection.Close()
+		})
+
+		c.Specify("requires negotiation to compress", func() {
+			config.Negotiate = false
+			err := tcpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("Agreeing on capabilities", func() {
+		peer := &capabilities{
+			Version:     3,
+			Compression: []string{"lzma", COMPRESSION_DEFLATE},
+			Signing:     []string{"sha512", "sha256", "md5"},
+		}
+
+		c.Specify("keeps what both ends support", func() {
+			agreed, err := agree(peer)
+			c.Assume(err, gs.IsNil)
+			c.Expect(agreed.Version, gs.Equals, int64(HEKA_PROTOCOL_VERSION))
+			c.Expect(agreed.compression(), gs.Equals, COMPRESSION_DEFLATE)
+			c.Assume(len(agreed.Signing), gs.Equals, 2)
+			c.Expect(agreed.Signing[0], gs.Equals, "sha256")
+			c.Expect(agreed.Signing[1], gs.Equals, "md5")
+		})
+
+		c.Specify("fails without a signing hash in common", func() {
+			peer.Signing = []string{"sha512"}
+			_, err := agree(peer)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
+	})
+
+	c.Specify("An inflated record goes through the header framing", func() {
+		msg := pipeline_ts.GetTestMessage()
+		var outBytes []byte
+		err := client.NewProtobufEncoder(nil).EncodeCompressedMessageStream(msg,
+			&outBytes)
+		c.Assume(err, gs.IsNil)
+		inflated, err := inflateRecord(outBytes)
+		c.Assume(err, gs.IsNil)
+
+		parser := NewMessageProtoParser()
+		var record []byte
+		reader := bytes.NewReader(inflated)
+		for len(record) == 0 && err == nil {
+			_, record, err = parser.Parse(reader)
+		}
+		c.Assume(len(record), gs.Equals, len(inflated))
+		headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+		header := new(message.Header)
+		c.Expect(DecodeHeader(record[2:headerLen], header), gs.IsTrue)
+		c.Expect(int(header.GetMessageLength()), gs.Equals, len(record)-headerLen)
+		received, err := decodeRecord(record)
+		c.Expect(err, gs.IsNil)
+		c.Expect(proto.Equal(received, msg), gs.IsTrue)
+	})
+
+	c.Specify("A TcpInput connection passes other first records through", func() {
+		peer, server := net.Pipe()
+		defer peer.Close()
+		defer server.Close()
+		msg := pipeline_ts.GetTestMessage()
+		go func() {
+			var outBytes []byte
+			client.NewProtobufEncoder(nil).EncodeMessageStream(msg, &outBytes)
+			peer.Write(outBytes)
+		}()
+		var negotiated int64
+		parser := newNegotiatingParser(server, nil, &negotiated)
+		var record []byte
+		for len(record) == 0 {
+			_, record, _ = parser.Parse(server)
+		}
+		received, err := decodeRecord(record)
+		c.Expect(err, gs.IsNil)
+		c.Expect(received.GetUuidString(), gs.Equals, msg.GetUuidString())
+		c.Expect(negotiated, gs.Equals, int64(0))
+	})
+}
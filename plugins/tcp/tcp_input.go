@@ -15,10 +15,13 @@
 package tcp
 
 import (
+	"crypto/tls"
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -32,8 +35,35 @@ type TcpInput struct {
 	ir       InputRunner
 	h        PluginHelper
 	config   *NetworkInputConfig
+	filter   *AddressFilter
+	// Connection counters, accessed atomically.
+	active     int64
+	idleClosed int64
+	negotiated int64
 }
 
+// Listener enabling TCP keepalive on the connections it accepts, so the
+// OS detects peers that went away without closing the connection.
+type keepAliveListener struct {
+	*net.TCPListener
+	period time.Duration
+}
+
+func (l keepAliveListener) Accept() (conn net.Conn, err error) {
+	tcpConn, err := l.AcceptTCP()
+	if err != nil {
+		return
+	}
+	tcpConn.SetKeepAlive(true)
+	if l.period > 0 {
+		tcpConn.SetKeepAlivePeriod(l.period)
+	}
+	return tcpConn, nil
+}
+
+// How often a connection's read loop checks whether the input is stopping.
+const tcpStopCheckInterval = 5 * time.Second
+
 func (t *TcpInput) ConfigStruct() interface{} {
 	return new(NetworkInputConfig)
 }
@@ -41,11 +71,25 @@ func (t *TcpInput) ConfigStruct() interface{} {
 // Listen on the provided TCP connection, extracting messages from the incoming
 // data until the connection is closed or Stop is called on the input.
 func (t *TcpInput) handleConnection(conn net.Conn) {
+	atomic.AddInt64(&t.active, 1)
 	defer func() {
+		atomic.AddInt64(&t.active, -1)
 		conn.Close()
 		t.wg.Done()
 	}()
 
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// Handshake up front so a failing client is reported once and
+		// doesn't hold the connection open.
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			t.ir.LogError(fmt.Errorf("TLS handshake with %s failed: %s",
+				conn.RemoteAddr(), err))
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+	}
+
 	var (
 		dr DecoderRunner
 		ok bool
@@ -60,10 +104,16 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 	var (
 		parser        StreamParser
 		parseFunction NetworkParseFunction
+		err           error
 	)
-	if t.config.ParserType == "message.proto" {
-		mp := NewMessageProtoParser()
-		parser = mp
+	if t.config.Splitter != "" {
+		if parser, parseFunction, err = NetworkSplitter(t.h, t.config); err != nil {
+			t.ir.LogError(err)
+			return
+		}
+	} else if t.config.ParserType == "message.proto" {
+		// Answers TcpOutputs that negotiate, see negotiation.go.
+		parser = newNegotiatingParser(conn, t.ir, &t.negotiated)
 		parseFunction = NetworkMessageProtoParser
 	} else if t.config.ParserType == "regexp" {
 		rp := NewRegexpParser()
@@ -80,10 +130,18 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 		}
 	}
 
-	var err error
+	// A connection that stays silent for longer than the idle timeout is
+	// assumed to be half-open, e.g. its sender crashed, and closed.
+	idleTimeout := time.Duration(t.config.IdleTimeout) * time.Second
+	checkInterval := tcpStopCheckInterval
+	if idleTimeout > 0 && idleTimeout < checkInterval {
+		checkInterval = idleTimeout
+	}
+	lastActive := time.Now()
+
 	stopped := false
 	for !stopped {
-		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(checkInterval))
 		select {
 		case <-t.stopChan:
 			stopped = true
@@ -92,9 +150,17 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 				if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 					// keep the connection open, we are just checking to see if
 					// we are shutting down: Issue #354
+					if idleTimeout > 0 && time.Since(lastActive) >= idleTimeout {
+						atomic.AddInt64(&t.idleClosed, 1)
+						t.ir.LogMessage(fmt.Sprintf("closing connection from %s, "+
+							"idle for %s", conn.RemoteAddr(), idleTimeout))
+						stopped = true
+					}
 				} else {
 					stopped = true
 				}
+			} else {
+				lastActive = time.Now()
 			}
 		}
 	}
@@ -103,10 +169,37 @@ func (t *TcpInput) handleConnection(conn net.Conn) {
 func (t *TcpInput) Init(config interface{}) error {
 	var err error
 	t.config = config.(*NetworkInputConfig)
+	if t.filter, err = NewAddressFilter(t.config.Allow, t.config.Deny); err != nil {
+		return err
+	}
 	t.listener, err = net.Listen("tcp", t.config.Address)
 	if err != nil {
 		return fmt.Errorf("ListenTCP failed: %s\n", err.Error())
 	}
+	if t.config.KeepAlive {
+		t.listener = keepAliveListener{t.listener.(*net.TCPListener),
+			time.Duration(t.config.KeepAlivePeriod) * time.Second}
+	}
+	if t.filter != nil {
+		t.listener = t.filter.Listener(t.listener)
+	}
+	if t.config.UseTls {
+		goTlsConfig, err := CreateGoTlsConfig(&t.config.Tls, true, "")
+		if err != nil {
+			t.listener.Close()
+			return fmt.Errorf("TLS config: %s", err)
+		}
+		t.listener = tls.NewListener(t.listener, goTlsConfig)
+	}
+	switch t.config.FailedAuthAction {
+	case "", "drop", "tag":
+	default:
+		return fmt.Errorf("invalid failed_auth_action: %s", t.config.FailedAuthAction)
+	}
+	if t.config.Splitter != "" {
+		// Splitters can't be looked up until Run is called.
+		return nil
+	}
 	if t.config.ParserType == "message.proto" {
 		if t.config.Decoder == "" {
 			return fmt.Errorf("The message.proto parser must have a decoder")
@@ -133,6 +226,14 @@ func (t *TcpInput) Run(ir InputRunner, h PluginHelper) error {
 	t.ir = ir
 	t.h = h
 	t.stopChan = make(chan bool)
+	if t.config.Splitter != "" {
+		// Check the splitter once up front rather than failing every
+		// connection.
+		if _, _, err := NetworkSplitter(h, t.config); err != nil {
+			t.listener.Close()
+			return err
+		}
+	}
 
 	var conn net.Conn
 	var e error
@@ -157,6 +258,22 @@ func (t *TcpInput) Stop() {
 	close(t.stopChan)
 }
 
+// Reports the open connections, those closed for being idle, those that
+// negotiated capabilities and those rejected by the allow and deny lists.
+func (t *TcpInput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "ActiveConnections", atomic.LoadInt64(&t.active),
+		"count")
+	message.NewInt64Field(msg, "IdleClosedConnections",
+		atomic.LoadInt64(&t.idleClosed), "count")
+	message.NewInt64Field(msg, "NegotiatedConnections",
+		atomic.LoadInt64(&t.negotiated), "count")
+	if t.filter != nil {
+		message.NewInt64Field(msg, "RejectedConnections", t.filter.Rejected(),
+			"count")
+	}
+	return nil
+}
+
 func init() {
 	RegisterPlugin("TcpInput", func() interface{} {
 		return new(TcpInput)
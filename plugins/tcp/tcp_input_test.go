@@ -21,6 +21,7 @@ import (
 	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
+	"crypto/sha256"
 	"errors"
 	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
@@ -28,6 +29,8 @@ import (
 	"github.com/mozilla-services/heka/pipelinemock"
 	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
+	"net"
 	"time"
 )
 
@@ -206,6 +209,69 @@ func TcpInputSpec(c gs.Context) {
 			}
 		})
 
+		c.Specify("reads a SHA256 signed message from its connection", func() {
+			header.SetHmacHashFunction(message.Header_SHA256)
+			header.SetHmacSigner(signer)
+			header.SetHmacKeyVersion(uint32(1))
+			hm := hmac.New(sha256.New, []byte(key))
+			hm.Write(mbytes)
+			header.SetHmac(hm.Sum(nil))
+			hbytes, _ := proto.Marshal(header)
+			buflen := 3 + len(hbytes) + len(mbytes)
+			readCall.Return(buflen, nil)
+			readCall.Do(getPayloadBytes(hbytes, mbytes))
+
+			go func() {
+				tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			ith.PackSupply <- ith.Pack
+			timeout := make(chan bool, 1)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				timeout <- true
+			}()
+			select {
+			case packRef := <-ith.DecodeChan:
+				c.Expect(ith.Pack, gs.Equals, packRef)
+				c.Expect(string(ith.Pack.MsgBytes), gs.Equals, string(mbytes))
+				c.Expect(ith.Pack.Signer, gs.Equals, "test")
+			case t := <-timeout:
+				c.Expect(t, gs.IsNil)
+			}
+		})
+
+		c.Specify("tags a message with an incorrect hmac if configured to", func() {
+			tcpInput.config.FailedAuthAction = "tag"
+			header.SetHmacHashFunction(message.Header_SHA256)
+			header.SetHmacSigner(signer)
+			header.SetHmacKeyVersion(uint32(1))
+			hm := hmac.New(sha256.New, []byte("wrongkey"))
+			hm.Write(mbytes)
+			header.SetHmac(hm.Sum(nil))
+			hbytes, _ := proto.Marshal(header)
+			buflen := 3 + len(hbytes) + len(mbytes)
+			readCall.Return(buflen, nil)
+			readCall.Do(getPayloadBytes(hbytes, mbytes))
+
+			go func() {
+				tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			}()
+			ith.PackSupply <- ith.Pack
+			timeout := make(chan bool, 1)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				timeout <- true
+			}()
+			select {
+			case packRef := <-ith.DecodeChan:
+				c.Expect(ith.Pack, gs.Equals, packRef)
+				c.Expect(ith.Pack.Signer, gs.Equals, "")
+				c.Expect(ith.Pack.UnverifiedSigner, gs.Equals, "test")
+			case t := <-timeout:
+				c.Expect(t, gs.IsNil)
+			}
+		})
+
 		c.Specify("reads a signed message with an expired key from its connection", func() {
 			header.SetHmacHashFunction(message.Header_MD5)
 			header.SetHmacSigner(signer)
@@ -376,4 +442,41 @@ func TcpInputSpec(c gs.Context) {
 			c.Expect(ith.Pack.Message.GetHostname(), gs.Equals, "123")
 		})
 	})
+
+	c.Specify("A TcpInput with an idle timeout", func() {
+		tcpInput := TcpInput{}
+		err := tcpInput.Init(&NetworkInputConfig{Address: "127.0.0.1:0",
+			ParserType:  "token",
+			KeepAlive:   true,
+			IdleTimeout: 1})
+		c.Assume(err, gs.IsNil)
+		ith.MockInputRunner.EXPECT().LogMessage(gomock.Any())
+		done := make(chan bool)
+		go func() {
+			tcpInput.Run(ith.MockInputRunner, ith.MockHelper)
+			done <- true
+		}()
+		defer func() {
+			tcpInput.Stop()
+			<-done
+		}()
+
+		c.Specify("closes connections that stay silent", func() {
+			conn, err := net.Dial("tcp", tcpInput.listener.Addr().String())
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			start := time.Now()
+			_, err = ioutil.ReadAll(conn)
+			c.Expect(err, gs.IsNil) // closed by the input, not timed out
+			c.Expect(time.Since(start) >= 900*time.Millisecond, gs.IsTrue)
+
+			msg := new(message.Message)
+			c.Expect(tcpInput.ReportMsg(msg), gs.IsNil)
+			closed, _ := msg.GetFieldValue("IdleClosedConnections")
+			c.Expect(closed, gs.Equals, int64(1))
+			active, _ := msg.GetFieldValue("ActiveConnections")
+			c.Expect(active, gs.Equals, int64(0))
+		})
+	})
 }
@@ -16,9 +16,15 @@
 package tcp
 
 import (
+	"crypto/tls"
 	"fmt"
+	"github.com/mozilla-services/heka/client"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
+	"github.com/mozilla-services/heka/plugins"
 	"net"
+	"sync"
+	"time"
 )
 
 // Output plugin that sends messages via TCP using the Heka protocol.
@@ -26,6 +32,16 @@ type TcpOutput struct {
 	address       string
 	connection    net.Conn
 	exitonfailure bool
+	limiter       *plugins.ByteRateLimiter
+	encoder       *client.ProtobufEncoder
+	tlsConfig     *tls.Config
+	conf          *TcpOutputConfig
+	signer        *message.MessageSigningConfig
+	// Negotiated with the peer, see negotiation.go. Protected by agreedLock
+	// since they change when reconnecting.
+	agreedLock      sync.Mutex
+	protocolVersion int64
+	compress        bool
 }
 
 // ConfigStruct for TcpOutput plugin.
@@ -34,40 +50,176 @@ type TcpOutputConfig struct {
 	// sending data.
 	Address       string
 	ExitOnFailure bool
+	// Maximum average number of bytes sent per second, unlimited if zero.
+	MaxBytesPerSec int64 `toml:"max_bytes_per_sec"`
+	// Number of bytes that can be sent at once before the rate limit kicks
+	// in, defaults to one second's worth.
+	BurstBytes int64 `toml:"burst_bytes"`
+	// Signs every message with the given key if the name is set. The hash
+	// defaults to "sha256".
+	Signer message.MessageSigningConfig `toml:"signer"`
+	// Connect using TLS.
+	UseTls bool `toml:"use_tls"`
+	// TLS settings, used if UseTls is set.
+	Tls TlsConfig
+	// Negotiates the protocol version and compression with the TcpInput
+	// when connecting.
+	Negotiate bool
+	// How long to wait for the peer's answer before assuming it predates
+	// negotiation, in milliseconds. Defaults to 2000.
+	NegotiateTimeout uint `toml:"negotiate_timeout"`
+	// Compression to use if the peer supports it, "none" or "deflate".
+	// Requires Negotiate.
+	Compression string
 }
 
 func (t *TcpOutput) ConfigStruct() interface{} {
 	//return &TcpOutputConfig{Address: "localhost:9125"}
-	return &TcpOutputConfig{Address: "localhost:9125", ExitOnFailure: false}
+	return &TcpOutputConfig{
+		Address:          "localhost:9125",
+		ExitOnFailure:    false,
+		NegotiateTimeout: 2000,
+		Compression:      COMPRESSION_NONE,
+	}
 }
 
 func (t *TcpOutput) Init(config interface{}) (err error) {
 	conf := config.(*TcpOutputConfig)
+	t.conf = conf
 	t.address = conf.Address
 	t.exitonfailure = conf.ExitOnFailure
-	t.connection, err = net.Dial("tcp", t.address)
+	var signer *message.MessageSigningConfig
+	if conf.Signer.Name != "" {
+		switch conf.Signer.Hash {
+		case "":
+			conf.Signer.Hash = "sha256"
+		case "md5", "sha1", "sha256":
+		default:
+			return fmt.Errorf("unknown signer hmac_hash: %s", conf.Signer.Hash)
+		}
+		if conf.Signer.Key == "" {
+			return fmt.Errorf("signer '%s' has no hmac_key", conf.Signer.Name)
+		}
+		signer = &conf.Signer
+	}
+	t.signer = signer
+	t.encoder = client.NewProtobufEncoder(signer)
+	if conf.MaxBytesPerSec > 0 {
+		t.limiter = plugins.NewByteRateLimiter(conf.MaxBytesPerSec, conf.BurstBytes)
+	}
+	switch conf.Compression {
+	case "", COMPRESSION_NONE:
+	case COMPRESSION_DEFLATE:
+		if !conf.Negotiate {
+			return fmt.Errorf("compression '%s' requires negotiate = true",
+				conf.Compression)
+		}
+	default:
+		return fmt.Errorf("unknown compression: %s", conf.Compression)
+	}
+	if conf.UseTls {
+		if t.tlsConfig, err = CreateGoTlsConfig(&conf.Tls, false, t.address); err != nil {
+			return fmt.Errorf("TLS config: %s", err)
+		}
+	}
+	return t.connect()
+}
+
+// Connects to the peer, negotiating with it if enabled. Every connection
+// negotiates, the peer may have been replaced by one supporting something
+// else since the previous one.
+func (t *TcpOutput) connect() (err error) {
+	t.setAgreed(1, false)
+	if err = t.dial(); err != nil || !t.conf.Negotiate {
+		return
+	}
+	if err = t.negotiate(); err != nil {
+		t.connection.Close()
+		t.connection = nil
+	}
 	return
 }
 
+func (t *TcpOutput) dial() (err error) {
+	if t.tlsConfig == nil {
+		if t.connection, err = net.Dial("tcp", t.address); err != nil {
+			t.connection = nil
+		}
+		return
+	}
+	tlsConn, err := tls.Dial("tcp", t.address, t.tlsConfig)
+	if err != nil {
+		t.connection = nil
+		return fmt.Errorf("TLS connection to %s failed: %s", t.address, err)
+	}
+	t.connection = tlsConn
+	return
+}
+
+// Agrees on the protocol version and compression with the peer, speaking the
+// original protocol if it doesn't answer.
+func (t *TcpOutput) negotiate() error {
+	timeout := time.Duration(t.conf.NegotiateTimeout) * time.Millisecond
+	agreed, err := negotiate(t.connection, localCapabilities(t.conf.Compression),
+		timeout)
+	if err != nil {
+		return fmt.Errorf("negotiating with %s: %s", t.address, err)
+	}
+	if agreed == nil {
+		// The peer predates negotiation and skipped the hello.
+		return nil
+	}
+	if t.signer != nil && !contains(agreed.Signing, t.signer.Hash) {
+		return fmt.Errorf("%s doesn't support hmac_hash %s", t.address, t.signer.Hash)
+	}
+	t.setAgreed(agreed.Version, agreed.compression() == COMPRESSION_DEFLATE)
+	return nil
+}
+
+func (t *TcpOutput) setAgreed(version int64, compress bool) {
+	t.agreedLock.Lock()
+	t.protocolVersion = version
+	t.compress = compress
+	t.agreedLock.Unlock()
+}
+
 func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 	var e error
 	var n int
 	outBytes := make([]byte, 0, 2000)
 
 	for pack := range or.InChan() {
+		if t.connection == nil {
+			if e = t.connect(); e != nil {
+				or.LogError(fmt.Errorf("reconnecting to %s: %s", t.address, e))
+				pack.Recycle()
+				continue
+			}
+		}
 		outBytes = outBytes[:0]
 
-		if e = ProtobufEncodeMessage(pack, &outBytes); e != nil {
+		if t.compress {
+			e = t.encoder.EncodeCompressedMessageStream(pack.Message, &outBytes)
+		} else {
+			e = t.encoder.EncodeMessageStream(pack.Message, &outBytes)
+		}
+		if e != nil {
 			or.LogError(e)
 			pack.Recycle()
 			continue
 		}
 
+		if t.limiter != nil {
+			t.limiter.Wait(len(outBytes))
+		}
 		if n, e = t.connection.Write(outBytes); e != nil {
 			or.LogError(fmt.Errorf("writing to %s: %s", t.address, e))
 			if t.exitonfailure {
 				return
 			}
+			// Reconnect when the next message is sent.
+			t.connection.Close()
+			t.connection = nil
 
 		} else if n != len(outBytes) {
 			or.LogError(fmt.Errorf("truncated output to: %s", t.address))
@@ -76,11 +228,31 @@ func (t *TcpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
 		pack.Recycle()
 	}
 
-	t.connection.Close()
+	if t.connection != nil {
+		t.connection.Close()
+	}
 
 	return
 }
 
+// Reports the negotiated protocol version and compression, and the rate
+// limit utilization if a rate limit is set.
+func (t *TcpOutput) ReportMsg(msg *message.Message) error {
+	t.agreedLock.Lock()
+	version, compress := t.protocolVersion, t.compress
+	t.agreedLock.Unlock()
+	message.NewInt64Field(msg, "ProtocolVersion", version, "")
+	compression := COMPRESSION_NONE
+	if compress {
+		compression = COMPRESSION_DEFLATE
+	}
+	message.NewStringField(msg, "Compression", compression)
+	if t.limiter != nil {
+		t.limiter.ReportMsg(msg)
+	}
+	return nil
+}
+
 func init() {
 	RegisterPlugin("TcpOutput", func() interface{} {
 		return new(TcpOutput)
@@ -19,6 +19,9 @@ import (
 	"bytes"
 	"code.google.com/p/gomock/gomock"
 	"code.google.com/p/goprotobuf/proto"
+	"crypto/hmac"
+	"crypto/sha256"
+	"github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
 	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
 	plugins_ts "github.com/mozilla-services/heka/plugins/testsupport"
@@ -100,5 +103,58 @@ func TcpOutputSpec(c gs.Context) {
 			result = <-ch
 			c.Expect(result, gs.Equals, string(matchBytes))
 		})
+
+		c.Specify("signs the messages it writes", func() {
+			inChanCall := oth.MockOutputRunner.EXPECT().InChan().AnyTimes()
+			inChanCall.Return(inChan)
+
+			ln, err := net.Listen("tcp", "localhost:0")
+			c.Assume(err, gs.IsNil)
+			defer ln.Close()
+			ch := make(chan []byte, 1)
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					ch <- nil
+					return
+				}
+				b := make([]byte, 1000)
+				n, _ := conn.Read(b)
+				ch <- b[:n]
+			}()
+
+			config.Address = ln.Addr().String()
+			config.Signer = message.MessageSigningConfig{Name: "ops", Key: "secret",
+				Version: 2}
+			err = tcpOutput.Init(config)
+			c.Assume(err, gs.IsNil)
+
+			wg.Add(1)
+			go func() {
+				tcpOutput.Run(oth.MockOutputRunner, oth.MockHelper)
+				wg.Done()
+			}()
+			inChan <- pack
+			close(inChan)
+			wg.Wait()
+
+			record := <-ch
+			c.Assume(len(record) > 2, gs.IsTrue)
+			headerLen := int(record[1]) + message.HEADER_FRAMING_SIZE
+			header := new(message.Header)
+			c.Expect(DecodeHeader(record[2:headerLen], header), gs.IsTrue)
+			c.Expect(header.GetHmacSigner(), gs.Equals, "ops")
+			c.Expect(header.GetHmacKeyVersion(), gs.Equals, uint32(2))
+			c.Expect(header.GetHmacHashFunction(), gs.Equals, message.Header_SHA256)
+			hm := hmac.New(sha256.New, []byte("secret"))
+			hm.Write(record[headerLen:])
+			c.Expect(bytes.Equal(header.GetHmac(), hm.Sum(nil)), gs.IsTrue)
+		})
+
+		c.Specify("rejects a signer without a key", func() {
+			config.Signer = message.MessageSigningConfig{Name: "ops"}
+			err := tcpOutput.Init(config)
+			c.Expect(err, gs.Not(gs.IsNil))
+		})
 	})
 }
@@ -0,0 +1,158 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package udp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+	"time"
+)
+
+// GELF chunk header: the two magic bytes, an 8 byte message id, the
+// sequence number and the sequence count.
+const gelfChunkHeaderSize = 12
+
+// Most chunks a GELF message may be split into.
+const gelfMaxChunks = 128
+
+// How long the chunks of a message are kept waiting for the rest of them,
+// the same as Graylog.
+const gelfChunkTimeout = 5 * time.Second
+
+// Largest decompressed GELF message accepted.
+const gelfMaxMessageSize = 8 << 20
+
+// Most messages waiting for more chunks, so a flood of bogus chunks can't
+// exhaust the memory.
+const gelfMaxPending = 1024
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+// A GELF message whose chunks are being received.
+type gelfMessage struct {
+	chunks   [][]byte
+	received int
+	started  time.Time
+}
+
+// Reassembles the GELF messages received over UDP, which clients split into
+// chunks when they don't fit in a datagram.
+type gelfAssembler struct {
+	pending    map[string]*gelfMessage
+	lastExpiry time.Time
+	// Number of partial messages that expired before all their chunks
+	// arrived, and of invalid datagrams, accessed atomically.
+	incomplete int64
+	invalid    int64
+}
+
+func newGelfAssembler() *gelfAssembler {
+	return &gelfAssembler{pending: make(map[string]*gelfMessage)}
+}
+
+// Drops the partial messages that have waited longer than the timeout.
+func (a *gelfAssembler) expire(now time.Time) {
+	for id, msg := range a.pending {
+		if now.Sub(msg.started) > gelfChunkTimeout {
+			delete(a.pending, id)
+			atomic.AddInt64(&a.incomplete, 1)
+		}
+	}
+	a.lastExpiry = now
+}
+
+// Takes a received datagram, returning the (still compressed) message once
+// it's complete, nil while chunks are missing. The datagram is copied if
+// it's kept.
+func (a *gelfAssembler) add(datagram []byte, now time.Time) (data []byte,
+	err error) {
+
+	if now.Sub(a.lastExpiry) >= time.Second {
+		a.expire(now)
+	}
+	if !bytes.HasPrefix(datagram, gelfChunkMagic) {
+		return datagram, nil
+	}
+	if len(datagram) < gelfChunkHeaderSize {
+		atomic.AddInt64(&a.invalid, 1)
+		return nil, errors.New("truncated GELF chunk header")
+	}
+	id := string(datagram[2:10])
+	seq, count := int(datagram[10]), int(datagram[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		atomic.AddInt64(&a.invalid, 1)
+		return nil, fmt.Errorf("invalid GELF chunk %d of %d", seq, count)
+	}
+
+	msg, ok := a.pending[id]
+	if !ok {
+		if len(a.pending) >= gelfMaxPending {
+			a.expire(now)
+			if len(a.pending) >= gelfMaxPending {
+				atomic.AddInt64(&a.incomplete, 1)
+				return nil, errors.New("too many incomplete GELF messages")
+			}
+		}
+		msg = &gelfMessage{chunks: make([][]byte, count), started: now}
+		a.pending[id] = msg
+	} else if len(msg.chunks) != count {
+		delete(a.pending, id)
+		atomic.AddInt64(&a.invalid, 1)
+		return nil, errors.New("GELF chunks disagree on the sequence count")
+	}
+	if msg.chunks[seq] == nil {
+		msg.chunks[seq] = append([]byte{}, datagram[gelfChunkHeaderSize:]...)
+		msg.received++
+	}
+	if msg.received < count {
+		return
+	}
+	delete(a.pending, id)
+	return bytes.Join(msg.chunks, nil), nil
+}
+
+// Decompresses a GELF message if it's gzip or zlib compressed, as detected
+// by its first bytes.
+func decompressGelf(data []byte) (payload []byte, err error) {
+	var reader io.Reader
+	switch {
+	case len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b:
+		if reader, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return
+		}
+	case len(data) >= 2 && data[0] == 0x78 && (uint(data[0])<<8|uint(data[1]))%31 == 0:
+		// A zlib header, whose check bits make it a multiple of 31.
+		if reader, err = zlib.NewReader(bytes.NewReader(data)); err != nil {
+			return
+		}
+	default:
+		return data, nil
+	}
+	limited := io.LimitReader(reader, gelfMaxMessageSize+1)
+	if payload, err = ioutil.ReadAll(limited); err != nil {
+		return nil, err
+	}
+	if len(payload) > gelfMaxMessageSize {
+		return nil, fmt.Errorf("decompressed GELF message larger than %d bytes",
+			gelfMaxMessageSize)
+	}
+	return
+}
@@ -0,0 +1,159 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package udp
+
+import (
+	"bytes"
+	"code.google.com/p/gomock/gomock"
+	"compress/gzip"
+	"compress/zlib"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"strings"
+	"time"
+)
+
+// Splits a GELF message into chunks of at most size bytes of data.
+func gelfChunks(id string, data []byte, size int) (chunks [][]byte) {
+	count := (len(data) + size - 1) / size
+	for seq := 0; seq < count; seq++ {
+		end := (seq + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := append([]byte{0x1e, 0x0f}, id...)
+		chunk = append(chunk, byte(seq), byte(count))
+		chunks = append(chunks, append(chunk, data[seq*size:end]...))
+	}
+	return
+}
+
+func GelfSpec(c gs.Context) {
+	doc := `{"version":"1.1","host":"web1","short_message":"` +
+		strings.Repeat("x", 100) + `"}`
+	now := time.Now()
+
+	c.Specify("A GELF assembler", func() {
+		assembler := newGelfAssembler()
+
+		c.Specify("passes unchunked messages through", func() {
+			data, err := assembler.add([]byte(doc), now)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(data), gs.Equals, doc)
+		})
+
+		c.Specify("reassembles chunks received out of order", func() {
+			chunks := gelfChunks("msgid-01", []byte(doc), 40)
+			c.Assume(len(chunks), gs.Equals, 4)
+			for _, i := range []int{2, 0, 3, 2} {
+				data, err := assembler.add(chunks[i], now)
+				c.Expect(err, gs.IsNil)
+				c.Expect(data, gs.IsNil)
+			}
+			data, err := assembler.add(chunks[1], now)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(data), gs.Equals, doc)
+			c.Expect(len(assembler.pending), gs.Equals, 0)
+		})
+
+		c.Specify("drops incomplete messages after the timeout", func() {
+			chunks := gelfChunks("msgid-02", []byte(doc), 40)
+			assembler.add(chunks[0], now)
+			assembler.add([]byte(doc), now.Add(gelfChunkTimeout+time.Second))
+			c.Expect(len(assembler.pending), gs.Equals, 0)
+			c.Expect(assembler.incomplete, gs.Equals, int64(1))
+		})
+
+		c.Specify("rejects invalid chunks", func() {
+			_, err := assembler.add([]byte{0x1e, 0x0f, 1, 2}, now)
+			c.Expect(err, gs.Not(gs.IsNil))
+			_, err = assembler.add(append([]byte{0x1e, 0x0f}, "msgid-03\x05\x02"...), now)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(assembler.invalid, gs.Equals, int64(2))
+		})
+	})
+
+	c.Specify("GELF messages are decompressed", func() {
+		var gzipped, zlibbed bytes.Buffer
+		gw := gzip.NewWriter(&gzipped)
+		gw.Write([]byte(doc))
+		gw.Close()
+		zw := zlib.NewWriter(&zlibbed)
+		zw.Write([]byte(doc))
+		zw.Close()
+		for _, data := range [][]byte{gzipped.Bytes(), zlibbed.Bytes(), []byte(doc)} {
+			payload, err := decompressGelf(data)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(payload), gs.Equals, doc)
+		}
+	})
+
+	c.Specify("A UdpInput with the gelf parser", func() {
+		t := &pipeline_ts.SimpleT{}
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+
+		pc := NewPipelineConfig(nil)
+		udpInput := UdpInput{}
+		err := udpInput.Init(&NetworkInputConfig{Address: "127.0.0.1:55566",
+			ParserType: "gelf", Decoder: "gelf_json"})
+		c.Assume(err, gs.IsNil)
+
+		ir := pipelinemock.NewMockInputRunner(ctrl)
+		helper := pipelinemock.NewMockPluginHelper(ctrl)
+		dr := pipelinemock.NewMockDecoderRunner(ctrl)
+		supply := make(chan *PipelinePack, 1)
+		decodeChan := make(chan *PipelinePack)
+		helper.EXPECT().DecoderRunner("gelf_json").Return(dr, true)
+		ir.EXPECT().InChan().Return(supply)
+		ir.EXPECT().Name().Return("gelf_input")
+		dr.EXPECT().InChan().Return(decodeChan)
+
+		c.Specify("hands the reassembled document to the decoder", func() {
+			go udpInput.Run(ir, helper)
+			conn, err := net.Dial("udp", "127.0.0.1:55566")
+			c.Assume(err, gs.IsNil)
+			defer conn.Close()
+
+			var compressed bytes.Buffer
+			gw := gzip.NewWriter(&compressed)
+			gw.Write([]byte(doc))
+			gw.Close()
+			for _, chunk := range gelfChunks("msgid-04", compressed.Bytes(), 20) {
+				_, err = conn.Write(chunk)
+				c.Assume(err, gs.IsNil)
+			}
+			supply <- NewPipelinePack(pc.InputRecycleChan())
+			pack := <-decodeChan
+			udpInput.Stop()
+			c.Expect(pack.Message.GetPayload(), gs.Equals, doc)
+			c.Expect(pack.Message.GetType(), gs.Equals, "gelf")
+			c.Expect(pack.Message.GetLogger(), gs.Equals, "gelf_input")
+		})
+	})
+
+	c.Specify("The gelf parser can't be used with a splitter", func() {
+		udpInput := UdpInput{}
+		err := udpInput.Init(&NetworkInputConfig{Address: "127.0.0.1:55567",
+			ParserType: "gelf", Splitter: "TokenSplitter"})
+		c.Expect(err, gs.Not(gs.IsNil))
+		if udpInput.listener != nil {
+			udpInput.listener.Close()
+		}
+	})
+}
@@ -15,6 +15,8 @@
 package udp
 
 import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
 	"fmt"
 	. "github.com/mozilla-services/heka/message"
 	. "github.com/mozilla-services/heka/pipeline"
@@ -23,6 +25,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 // Input plugin implementation that listens for Heka protocol messages on a
@@ -34,6 +38,9 @@ type UdpInput struct {
 	config        *NetworkInputConfig
 	parser        StreamParser
 	parseFunction NetworkParseFunction
+	filter        *AddressFilter
+	// Set with the "gelf" parser type.
+	gelf *gelfAssembler
 }
 
 func (u *UdpInput) ConfigStruct() interface{} {
@@ -42,6 +49,9 @@ func (u *UdpInput) ConfigStruct() interface{} {
 
 func (u *UdpInput) Init(config interface{}) (err error) {
 	u.config = config.(*NetworkInputConfig)
+	if u.filter, err = NewAddressFilter(u.config.Allow, u.config.Deny); err != nil {
+		return err
+	}
 	if len(u.config.Address) > 3 && u.config.Address[:3] == "fd:" {
 		// File descriptor
 		fdStr := u.config.Address[3:]
@@ -67,6 +77,22 @@ func (u *UdpInput) Init(config interface{}) (err error) {
 			return fmt.Errorf("ListenUDP failed: %s\n", err.Error())
 		}
 	}
+	if u.filter != nil {
+		if u.listener, err = u.filter.PacketConn(u.listener); err != nil {
+			return err
+		}
+	}
+	if u.config.ParserType == "gelf" {
+		if u.config.Splitter != "" {
+			return errors.New("The gelf parser can't be used with a splitter")
+		}
+		u.gelf = newGelfAssembler()
+		return
+	}
+	if u.config.Splitter != "" {
+		// Splitters can't be looked up until Run is called.
+		return
+	}
 	if u.config.ParserType == "message.proto" {
 		mp := NewMessageProtoParser()
 		u.parser = mp
@@ -112,12 +138,24 @@ func (u *UdpInput) Run(ir InputRunner, h PluginHelper) error {
 			return fmt.Errorf("Error getting decoder: %s", u.config.Decoder)
 		}
 	}
+	if u.config.Splitter != "" {
+		var err error
+		if u.parser, u.parseFunction, err = NetworkSplitter(h, u.config); err != nil {
+			return err
+		}
+		u.parser.SetMinimumBufferSize(1024 * 64)
+	}
+
+	if u.gelf != nil {
+		u.readGelf(ir, dr)
+		return nil
+	}
 
 	var err error
 	for !u.stopped {
 		if err = u.parseFunction(u.listener, u.parser, ir, u.config, dr); err != nil {
 			if !strings.Contains(err.Error(), "use of closed") {
-				ir.LogError(fmt.Errorf("Read error: ", err))
+				ir.LogError(fmt.Errorf("Read error: %s", err))
 			}
 		}
 		u.parser.GetRemainingData() // reset the receiving buffer
@@ -125,11 +163,67 @@ func (u *UdpInput) Run(ir InputRunner, h PluginHelper) error {
 	return nil
 }
 
+// Reads GELF datagrams, reassembling the chunked messages and decompressing
+// them, and hands the resulting JSON documents to the decoder as payloads.
+func (u *UdpInput) readGelf(ir InputRunner, dr DecoderRunner) {
+	buf := make([]byte, 65536)
+	for !u.stopped {
+		n, err := u.listener.Read(buf)
+		if err != nil {
+			if !strings.Contains(err.Error(), "use of closed") {
+				ir.LogError(fmt.Errorf("Read error: %s", err))
+			}
+			continue
+		}
+		var data []byte
+		if data, err = u.gelf.add(buf[:n], time.Now()); err != nil {
+			ir.LogError(err)
+			continue
+		} else if data == nil {
+			continue
+		}
+		if data, err = decompressGelf(data); err != nil {
+			atomic.AddInt64(&u.gelf.invalid, 1)
+			ir.LogError(fmt.Errorf("can't decompress GELF message: %s", err))
+			continue
+		}
+
+		pack := <-ir.InChan()
+		pack.Message.SetUuid(uuid.NewRandom())
+		pack.Message.SetTimestamp(time.Now().UnixNano())
+		pack.Message.SetType("gelf")
+		pack.Message.SetLogger(ir.Name())
+		pack.Message.SetPayload(string(data))
+		TagTenant(ir, pack, "", nil)
+		JournalPack(ir, pack, dr)
+		if dr == nil {
+			ir.Inject(pack)
+		} else {
+			dr.InChan() <- pack
+		}
+	}
+}
+
 func (u *UdpInput) Stop() {
 	u.stopped = true
 	u.listener.Close()
 }
 
+// Reports the packets dropped by the allow and deny lists and, for GELF, the
+// messages that couldn't be reassembled or decompressed.
+func (u *UdpInput) ReportMsg(msg *Message) error {
+	if u.filter != nil {
+		NewInt64Field(msg, "RejectedPackets", u.filter.Rejected(), "count")
+	}
+	if u.gelf != nil {
+		NewInt64Field(msg, "GelfIncompleteCount",
+			atomic.LoadInt64(&u.gelf.incomplete), "count")
+		NewInt64Field(msg, "GelfInvalidCount", atomic.LoadInt64(&u.gelf.invalid),
+			"count")
+	}
+	return nil
+}
+
 func init() {
 	RegisterPlugin("UdpInput", func() interface{} {
 		return new(UdpInput)
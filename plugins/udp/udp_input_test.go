@@ -32,7 +32,9 @@ func TestAllSpecs(t *testing.T) {
 	r := gs.NewRunner()
 	r.Parallel = false
 
+	r.AddSpec(GelfSpec)
 	r.AddSpec(UdpInputSpec)
+	r.AddSpec(UdpOutputSpec)
 
 	gs.MainGoTest(r, t)
 }
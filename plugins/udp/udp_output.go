@@ -0,0 +1,197 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package udp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Largest payload of a UDP datagram over IPv4.
+const maxDatagramSize = 65507
+
+// Output plugin that sends each message as a UDP datagram to one or more
+// destinations, e.g. statsd daemons or UDP syslog collectors.
+type UdpOutput struct {
+	conf        *UdpOutputConfig
+	conns       []net.Conn
+	encoder     Encoder
+	rand        *rand.Rand
+	sent        int64
+	sampledOut  int64
+	oversized   int64
+	sendFailed  int64
+	encodeError int64
+}
+
+// ConfigStruct for UdpOutput plugin.
+type UdpOutputConfig struct {
+	// Addresses every datagram is sent to.
+	Addresses []string
+	// Name of an encoder plugin used to serialize the messages, the message
+	// payload is sent if empty.
+	Encoder string
+	// Largest datagram sent, defaults to the UDP limit of 65507 bytes.
+	MaxMessageSize int `toml:"max_message_size"`
+	// Splits encoded messages larger than MaxMessageSize into several
+	// datagrams, at line breaks where possible, instead of dropping them.
+	SplitOversized bool `toml:"split_oversized"`
+	// Fraction of the messages that are sent, between 0 (exclusive) and 1.
+	SampleRate float64 `toml:"sample_rate"`
+}
+
+func (u *UdpOutput) ConfigStruct() interface{} {
+	return &UdpOutputConfig{
+		Addresses:      []string{"127.0.0.1:8125"},
+		MaxMessageSize: maxDatagramSize,
+		SampleRate:     1,
+	}
+}
+
+func (u *UdpOutput) Init(config interface{}) (err error) {
+	u.conf = config.(*UdpOutputConfig)
+	if len(u.conf.Addresses) == 0 {
+		return errors.New("UdpOutput needs at least one address")
+	}
+	if u.conf.MaxMessageSize < 1 || u.conf.MaxMessageSize > maxDatagramSize {
+		return fmt.Errorf("max_message_size must be between 1 and %d",
+			maxDatagramSize)
+	}
+	if u.conf.SampleRate <= 0 || u.conf.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be above 0 and at most 1: %g",
+			u.conf.SampleRate)
+	}
+	u.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	u.conns = make([]net.Conn, 0, len(u.conf.Addresses))
+	for _, address := range u.conf.Addresses {
+		var conn net.Conn
+		if conn, err = net.Dial("udp", address); err != nil {
+			u.close()
+			return fmt.Errorf("can't resolve %s: %s", address, err)
+		}
+		u.conns = append(u.conns, conn)
+	}
+	return
+}
+
+func (u *UdpOutput) close() {
+	for _, conn := range u.conns {
+		conn.Close()
+	}
+	u.conns = nil
+}
+
+// Splits the data into chunks of at most size bytes, breaking each chunk
+// after its last newline if it has one.
+func splitDatagrams(data []byte, size int) (chunks [][]byte) {
+	for len(data) > size {
+		cut := bytes.LastIndex(data[:size], []byte{'\n'}) + 1
+		if cut == 0 {
+			cut = size
+		}
+		chunks = append(chunks, data[:cut])
+		data = data[cut:]
+	}
+	if len(data) > 0 {
+		chunks = append(chunks, data)
+	}
+	return
+}
+
+func (u *UdpOutput) send(or OutputRunner, pack *PipelinePack) {
+	if u.conf.SampleRate < 1 && u.rand.Float64() >= u.conf.SampleRate {
+		atomic.AddInt64(&u.sampledOut, 1)
+		return
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if u.encoder != nil {
+		if data, err = u.encoder.Encode(pack); err != nil {
+			atomic.AddInt64(&u.encodeError, 1)
+			or.LogError(fmt.Errorf("can't encode message: %s", err))
+			return
+		}
+	} else {
+		data = []byte(pack.Message.GetPayload())
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	datagrams := [][]byte{data}
+	if len(data) > u.conf.MaxMessageSize {
+		if !u.conf.SplitOversized {
+			atomic.AddInt64(&u.oversized, 1)
+			or.LogError(fmt.Errorf("dropped message of %d bytes, larger than "+
+				"max_message_size", len(data)))
+			return
+		}
+		datagrams = splitDatagrams(data, u.conf.MaxMessageSize)
+	}
+	for i, conn := range u.conns {
+		for _, datagram := range datagrams {
+			if _, err = conn.Write(datagram); err != nil {
+				atomic.AddInt64(&u.sendFailed, 1)
+				or.LogError(fmt.Errorf("sending to %s: %s", u.conf.Addresses[i], err))
+				break
+			}
+		}
+	}
+	atomic.AddInt64(&u.sent, 1)
+}
+
+func (u *UdpOutput) Run(or OutputRunner, h PluginHelper) (err error) {
+	if u.conf.Encoder != "" {
+		var ok bool
+		if u.encoder, ok = h.Encoder(u.conf.Encoder); !ok {
+			return fmt.Errorf("unknown encoder: %s", u.conf.Encoder)
+		}
+	}
+	for pack := range or.InChan() {
+		u.send(or, pack)
+		pack.Recycle()
+	}
+	u.close()
+	return
+}
+
+func (u *UdpOutput) ReportMsg(msg *message.Message) error {
+	message.NewInt64Field(msg, "SentCount", atomic.LoadInt64(&u.sent), "count")
+	message.NewInt64Field(msg, "SampledOutCount", atomic.LoadInt64(&u.sampledOut),
+		"count")
+	message.NewInt64Field(msg, "OversizedCount", atomic.LoadInt64(&u.oversized),
+		"count")
+	message.NewInt64Field(msg, "SendFailedCount", atomic.LoadInt64(&u.sendFailed),
+		"count")
+	message.NewInt64Field(msg, "EncodeErrorCount", atomic.LoadInt64(&u.encodeError),
+		"count")
+	return nil
+}
+
+func init() {
+	RegisterPlugin("UdpOutput", func() interface{} {
+		return new(UdpOutput)
+	})
+}
@@ -0,0 +1,118 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package udp
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"github.com/mozilla-services/heka/message"
+	. "github.com/mozilla-services/heka/pipeline"
+	pipeline_ts "github.com/mozilla-services/heka/pipeline/testsupport"
+	"github.com/mozilla-services/heka/pipelinemock"
+	gs "github.com/rafrombrc/gospec/src/gospec"
+	"net"
+	"strings"
+	"time"
+)
+
+func UdpOutputSpec(c gs.Context) {
+	t := &pipeline_ts.SimpleT{}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := NewPipelineConfig(nil)
+
+	c.Specify("A UdpOutput", func() {
+		output := new(UdpOutput)
+		config := output.ConfigStruct().(*UdpOutputConfig)
+
+		listeners := make([]*net.UDPConn, 2)
+		config.Addresses = make([]string, len(listeners))
+		for i := range listeners {
+			addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:0")
+			listener, err := net.ListenUDP("udp", addr)
+			c.Assume(err, gs.IsNil)
+			defer listener.Close()
+			listeners[i] = listener
+			config.Addresses[i] = listener.LocalAddr().String()
+		}
+		receive := func(listener *net.UDPConn) string {
+			buf := make([]byte, maxDatagramSize)
+			listener.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := listener.Read(buf)
+			c.Assume(err, gs.IsNil)
+			return string(buf[:n])
+		}
+
+		oth := pipelinemock.NewMockOutputRunner(ctrl)
+		newPack := func(payload string) *PipelinePack {
+			pack := NewPipelinePack(pConfig.InputRecycleChan())
+			pack.Message.SetPayload(payload)
+			return pack
+		}
+
+		c.Specify("sends the payload to every address", func() {
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.send(oth, newPack("gauge:42|g"))
+			for _, listener := range listeners {
+				c.Expect(receive(listener), gs.Equals, "gauge:42|g")
+			}
+		})
+
+		c.Specify("drops oversized messages", func() {
+			config.MaxMessageSize = 10
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			oth.EXPECT().LogError(gomock.Any())
+			output.send(oth, newPack(strings.Repeat("x", 11)))
+			c.Expect(output.oversized, gs.Equals, int64(1))
+			c.Expect(output.sent, gs.Equals, int64(0))
+		})
+
+		c.Specify("splits oversized messages at line breaks", func() {
+			config.MaxMessageSize = 12
+			config.SplitOversized = true
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			output.send(oth, newPack("a:1|c\nb:2|c\nlongername:3|c"))
+			c.Expect(receive(listeners[0]), gs.Equals, "a:1|c\nb:2|c\n")
+			c.Expect(receive(listeners[0]), gs.Equals, "longername:3")
+			c.Expect(receive(listeners[0]), gs.Equals, "|c")
+		})
+
+		c.Specify("samples messages", func() {
+			config.SampleRate = 0.5
+			config.Addresses = config.Addresses[:1]
+			err := output.Init(config)
+			c.Assume(err, gs.IsNil)
+			for i := 0; i < 100; i++ {
+				output.send(oth, newPack("x"))
+			}
+			c.Expect(output.sent+output.sampledOut, gs.Equals, int64(100))
+			c.Expect(output.sent > 0, gs.IsTrue)
+			c.Expect(output.sampledOut > 0, gs.IsTrue)
+
+			msg := new(message.Message)
+			c.Expect(output.ReportMsg(msg), gs.IsNil)
+			count, _ := msg.GetFieldValue("SampledOutCount")
+			c.Expect(count, gs.Equals, output.sampledOut)
+		})
+
+		c.Specify("rejects an invalid sample rate", func() {
+			config.SampleRate = 1.5
+			c.Expect(output.Init(config), gs.Not(gs.IsNil))
+		})
+	})
+}
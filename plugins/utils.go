@@ -17,8 +17,10 @@ package plugins
 
 import (
 	"fmt"
+	"github.com/mozilla-services/heka/message"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
@@ -43,3 +45,37 @@ func CheckWritePermission(fp string) (err error) {
 	}
 	return
 }
+
+// Returns the value of the named message attribute (e.g. "Hostname") or, if
+// there is no such attribute, the named message field as a string.
+func GetMessageVariable(msg *message.Message, name string) (value string, ok bool) {
+	switch name {
+	case "Type":
+		return msg.GetType(), true
+	case "Logger":
+		return msg.GetLogger(), true
+	case "Hostname":
+		return msg.GetHostname(), true
+	case "EnvVersion":
+		return msg.GetEnvVersion(), true
+	case "Payload":
+		return msg.GetPayload(), true
+	case "Pid":
+		return strconv.Itoa(int(msg.GetPid())), true
+	case "Severity":
+		return strconv.Itoa(int(msg.GetSeverity())), true
+	}
+	var fieldValue interface{}
+	if fieldValue, ok = msg.GetFieldValue(name); !ok {
+		return
+	}
+	switch v := fieldValue.(type) {
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		value = fmt.Sprint(v)
+	}
+	return
+}
@@ -364,6 +364,140 @@ int inject_message(lua_State* lua)
     return 0;
 }
 
+////////////////////////////////////////////////////////////////////////////////
+int kv_get(lua_State* lua)
+{
+    void* luserdata = lua_touserdata(lua, lua_upvalueindex(1));
+    if (NULL == luserdata) {
+        luaL_error(lua, "kv_get() invalid lightuserdata");
+    }
+    lua_sandbox* lsb = (lua_sandbox*)luserdata;
+
+    if (lua_gettop(lua) != 1) {
+        luaL_error(lua, "kv_get() must have a single argument");
+    }
+    size_t len;
+    const char* key = luaL_checklstring(lua, 1, &len);
+
+    struct go_lua_kv_get_return gr;
+    gr = go_lua_kv_get(lsb_get_parent(lsb), (char*)key, (int)len);
+    if (gr.r0 == NULL) {
+        lua_pushnil(lua);
+    } else {
+        lua_pushlstring(lua, gr.r0, gr.r1);
+        free(gr.r0);
+    }
+    return 1;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int kv_set(lua_State* lua)
+{
+    void* luserdata = lua_touserdata(lua, lua_upvalueindex(1));
+    if (NULL == luserdata) {
+        luaL_error(lua, "kv_set() invalid lightuserdata");
+    }
+    lua_sandbox* lsb = (lua_sandbox*)luserdata;
+
+    if (lua_gettop(lua) != 2) {
+        luaL_error(lua, "kv_set() must have two arguments");
+    }
+    size_t key_len, value_len;
+    const char* key = luaL_checklstring(lua, 1, &key_len);
+    // Numbers are converted to their string representation.
+    const char* value = luaL_checklstring(lua, 2, &value_len);
+
+    int result = go_lua_kv_set(lsb_get_parent(lsb), (char*)key, (int)key_len,
+                               (char*)value, (int)value_len);
+    if (result == 1) {
+        luaL_error(lua, "kv_set() no key/value store available");
+    }
+    lua_pushboolean(lua, result == 0);
+    return 1;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int kv_delete(lua_State* lua)
+{
+    void* luserdata = lua_touserdata(lua, lua_upvalueindex(1));
+    if (NULL == luserdata) {
+        luaL_error(lua, "kv_delete() invalid lightuserdata");
+    }
+    lua_sandbox* lsb = (lua_sandbox*)luserdata;
+
+    if (lua_gettop(lua) != 1) {
+        luaL_error(lua, "kv_delete() must have a single argument");
+    }
+    size_t len;
+    const char* key = luaL_checklstring(lua, 1, &len);
+
+    go_lua_kv_delete(lsb_get_parent(lsb), (char*)key, (int)len);
+    return 0;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int lookup(lua_State* lua)
+{
+    void* luserdata = lua_touserdata(lua, lua_upvalueindex(1));
+    if (NULL == luserdata) {
+        luaL_error(lua, "lookup() invalid lightuserdata");
+    }
+    lua_sandbox* lsb = (lua_sandbox*)luserdata;
+
+    if (lua_gettop(lua) != 2) {
+        luaL_error(lua, "lookup() must have two arguments");
+    }
+    size_t table_len, key_len;
+    const char* table = luaL_checklstring(lua, 1, &table_len);
+    const char* key = luaL_checklstring(lua, 2, &key_len);
+
+    struct go_lua_lookup_return gr;
+    gr = go_lua_lookup(lsb_get_parent(lsb), (char*)table, (int)table_len,
+                       (char*)key, (int)key_len);
+    if (gr.r0 == NULL) {
+        lua_pushnil(lua);
+    } else {
+        lua_pushlstring(lua, gr.r0, gr.r1);
+        free(gr.r0);
+    }
+    return 1;
+}
+
+////////////////////////////////////////////////////////////////////////////////
+int write_output(lua_State* lua)
+{
+    static const char* default_target = "";
+    void* luserdata = lua_touserdata(lua, lua_upvalueindex(1));
+    if (NULL == luserdata) {
+        luaL_error(lua, "write_output() invalid lightuserdata");
+    }
+    lua_sandbox* lsb = (lua_sandbox*)luserdata;
+
+    const char* target = default_target;
+    switch (lua_gettop(lua)) {
+    case 0:
+        break;
+    case 1:
+        target = luaL_checkstring(lua, 1);
+        break;
+    default:
+        luaL_error(lua, "write_output() takes a maximum of 1 argument");
+        break;
+    }
+    size_t len;
+    const char* output = lsb_get_output(lsb, &len);
+
+    int result = 0;
+    if (len != 0) {
+        result = go_lua_write_output(lsb_get_parent(lsb),
+                                     (char*)output,
+                                     (int)len,
+                                     (char*)target);
+    }
+    lua_pushboolean(lua, result == 0);
+    return 1;
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_type)
 {
@@ -372,12 +506,25 @@ int sandbox_init(lua_sandbox* lsb, const char* data_file, const char* plugin_typ
     lsb_add_function(lsb, &read_config, "read_config");
     lsb_add_function(lsb, &read_message, "read_message");
     lsb_add_function(lsb, &read_next_field, "read_next_field");
-    lsb_add_function(lsb, &inject_message, "inject_message");
+
+    if (strcmp(plugin_type, "output") == 0) {
+        // outputs deliver their data themselves rather than injecting it
+        lsb_add_function(lsb, &write_output, "write_output");
+    } else {
+        lsb_add_function(lsb, &inject_message, "inject_message");
+    }
 
     if (strcmp(plugin_type, "decoder") == 0) {
         lsb_add_function(lsb, &write_message, "write_message");
     }
 
+    if (strcmp(plugin_type, "filter") == 0) {
+        lsb_add_function(lsb, &kv_get, "kv_get");
+        lsb_add_function(lsb, &kv_set, "kv_set");
+        lsb_add_function(lsb, &kv_delete, "kv_delete");
+        lsb_add_function(lsb, &lookup, "lookup");
+    }
+
     int result = lsb_init(lsb, data_file);
     if (result) return result;
 
@@ -69,6 +69,43 @@ int read_message(lua_State* lua);
  */
 int read_next_field(lua_State* lua);
 
+/**
+* Returns the string stored under a key in the plugin's key/value store, or
+* nil.
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns one value on the stack.
+*/
+int kv_get(lua_State* lua);
+
+/**
+* Stores a string or number under a key in the plugin's key/value store.
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns one value on the stack, false if the store is full.
+*/
+int kv_set(lua_State* lua);
+
+/**
+* Removes a key from the plugin's key/value store.
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns zero values on the stack.
+*/
+int kv_delete(lua_State* lua);
+
+/**
+* Returns the value a lookup table maps a key to, or nil.
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns one value on the stack.
+*/
+int lookup(lua_State* lua);
+
 /**
 * Inject a message into Heka using the output buffer's contents as the message
 * payload.
@@ -79,6 +116,16 @@ int read_next_field(lua_State* lua);
 */
 int inject_message(lua_State* lua);
 
+/**
+* Writes the output buffer's contents to a target provided by the host (a
+* file or network destination). Only available to output plugins.
+*
+* @param lua Pointer to the Lua state.
+*
+* @return int Returns one value on the stack, true if the write succeeded.
+*/
+int write_output(lua_State* lua);
+
 /**
  * Initializes the sandbox and sets up the above callbacks.
  *
@@ -935,6 +935,64 @@ func TestReadConfig(t *testing.T) {
 	sb.Destroy("")
 }
 
+func TestKVStore(t *testing.T) {
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/kv_store.lua"
+	sbc.MemoryLimit = 32767
+	sbc.InstructionLimit = 1000
+	path := filepath.Join(os.TempDir(), "kv_store_test.json")
+	defer os.Remove(path)
+	store, err := pipeline.OpenKVStore(path, 64)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	sb, err := lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	err = sb.Init("", "filter")
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	sb.KeyValueStore(store)
+	pack := getTestPack()
+	for i := 0; i < 2; i++ {
+		if r := sb.ProcessMessage(pack); r != 0 {
+			t.Errorf("ProcessMessage should return 0, received %d %s", r, sb.LastError())
+		}
+	}
+	if v, _ := store.Get("count"); v != "2" {
+		t.Errorf("count expected: 2, received: %s", v)
+	}
+	sb.Destroy("")
+}
+
+func TestLookup(t *testing.T) {
+	var sbc SandboxConfig
+	sbc.ScriptFilename = "./testsupport/lookup.lua"
+	sbc.MemoryLimit = 32767
+	sbc.InstructionLimit = 1000
+	sb, err := lua.CreateLuaSandbox(&sbc)
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	err = sb.Init("", "filter")
+	if err != nil {
+		t.Errorf("%s", err)
+	}
+	sb.Lookup(func(table, key string) (string, bool) {
+		if table == "teams" && key == "web" {
+			return "ops", true
+		}
+		return "", false
+	})
+	pack := getTestPack()
+	if r := sb.ProcessMessage(pack); r != 0 {
+		t.Errorf("ProcessMessage should return 0, received %d %s", r, sb.LastError())
+	}
+	sb.Destroy("")
+}
+
 func TestCJson(t *testing.T) {
 	var sbc SandboxConfig
 	sbc.ScriptFilename = "./testsupport/cjson.lua"
@@ -0,0 +1,16 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+function process_message()
+    local hostname = read_message("Hostname")
+    if hostname == "skip.me" then
+        return 0 -- nothing injected, the message is skipped
+    end
+    if hostname == "" then
+        return -1
+    end
+    output(hostname, "|", read_message("Payload"), "\n")
+    inject_message()
+    return 0
+end
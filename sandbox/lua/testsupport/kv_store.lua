@@ -0,0 +1,21 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+function process_message ()
+    if kv_get("missing") ~= nil then error("missing") end
+
+    local count = tonumber(kv_get("count")) or 0
+    if not kv_set("count", count + 1) then error("set count") end
+
+    if not kv_set("host", "widget") then error("set host") end
+    if kv_get("host") ~= "widget" then error("get host") end
+    kv_delete("host")
+    if kv_get("host") ~= nil then error("delete host") end
+
+    if kv_set("big", string.rep("x", 100)) then error("size cap") end
+    return 0
+end
+
+function timer_event()
+end
@@ -0,0 +1,13 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+function process_message ()
+    if lookup("teams", "web") ~= "ops" then error("lookup web") end
+    if lookup("teams", "db") ~= nil then error("missing key") end
+    if lookup("nosuchtable", "web") ~= nil then error("missing table") end
+    return 0
+end
+
+function timer_event()
+end
@@ -0,0 +1,20 @@
+-- This Source Code Form is subject to the terms of the Mozilla Public
+-- License, v. 2.0. If a copy of the MPL was not distributed with this
+-- file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+local target = read_config("target")
+local count = 0
+
+function process_message()
+    count = count + 1
+    output(read_message("Payload"), "\n")
+    if not write_output(target) then
+        return -1
+    end
+    return 0
+end
+
+function timer_event(ns)
+    output("count:", count, "\n")
+    write_output(target)
+end
@@ -42,6 +42,8 @@ type SandboxDecoder struct {
 	pack                   *pipeline.PipelinePack
 	packs                  []*pipeline.PipelinePack
 	dRunner                pipeline.DecoderRunner
+	// One in how many messages ProcessMessage is timed.
+	sampleDenominator int
 }
 
 func (pd *SandboxDecoder) ConfigStruct() interface{} {
@@ -60,6 +62,7 @@ func (s *SandboxDecoder) Init(config interface{}) (err error) {
 	s.sbc = config.(*SandboxConfig)
 	s.sbc.ScriptFilename = pipeline.GetHekaConfigDir(s.sbc.ScriptFilename)
 	s.sample = true
+	s.sampleDenominator = pipeline.DURATION_SAMPLE_DENOMINATOR
 
 	switch s.sbc.ScriptType {
 	case "lua":
@@ -116,6 +119,10 @@ func copyMessageHeaders(dst *message.Message, src *message.Message) {
 	}
 }
 
+func (s *SandboxDecoder) SetSampleDenominator(denominator int) {
+	s.sampleDenominator = denominator
+}
+
 func (s *SandboxDecoder) SetDecoderRunner(dr pipeline.DecoderRunner) {
 	s.dRunner = dr
 	var original *message.Message
@@ -202,7 +209,7 @@ func (s *SandboxDecoder) Decode(pack *pipeline.PipelinePack) (packs []*pipeline.
 		s.processMessageSamples++
 		s.reportLock.Unlock()
 	}
-	s.sample = 0 == rand.Intn(pipeline.DURATION_SAMPLE_DENOMINATOR)
+	s.sample = 0 == rand.Intn(s.sampleDenominator)
 	if retval > 0 {
 		s.err = errors.New("FATAL: " + s.sb.LastError())
 		s.dRunner.LogError(s.err)
@@ -258,10 +265,16 @@ func init() {
 	pipeline.RegisterPlugin("SandboxDecoder", func() interface{} {
 		return new(SandboxDecoder)
 	})
+	pipeline.RegisterPlugin("SandboxEncoder", func() interface{} {
+		return new(SandboxEncoder)
+	})
 	pipeline.RegisterPlugin("SandboxFilter", func() interface{} {
 		return new(SandboxFilter)
 	})
 	pipeline.RegisterPlugin("SandboxManagerFilter", func() interface{} {
 		return new(SandboxManagerFilter)
 	})
+	pipeline.RegisterPlugin("SandboxOutput", func() interface{} {
+		return new(SandboxOutput)
+	})
 }
@@ -0,0 +1,94 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/pipeline"
+	. "github.com/mozilla-services/heka/sandbox"
+	"github.com/mozilla-services/heka/sandbox/lua"
+)
+
+// Encoder for converting Heka messages into arbitrary output formats. The
+// script's process_message function builds the encoded data with output()
+// and hands it back to Heka with inject_message().
+type SandboxEncoder struct {
+	sb     Sandbox
+	sbc    *SandboxConfig
+	err    error
+	output []byte
+}
+
+func (s *SandboxEncoder) ConfigStruct() interface{} {
+	return &SandboxConfig{
+		ModuleDirectory:  pipeline.GetHekaConfigDir("lua_modules"),
+		MemoryLimit:      8 * 1024 * 1024,
+		InstructionLimit: 1e6,
+		OutputLimit:      63 * 1024,
+	}
+}
+
+func (s *SandboxEncoder) Init(config interface{}) (err error) {
+	if s.sb != nil {
+		return // no-op already initialized
+	}
+	s.sbc = config.(*SandboxConfig)
+	s.sbc.ScriptFilename = pipeline.GetHekaConfigDir(s.sbc.ScriptFilename)
+
+	switch s.sbc.ScriptType {
+	case "lua":
+		s.sb, err = lua.CreateLuaSandbox(s.sbc)
+		if err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("unsupported script type: %s", s.sbc.ScriptType)
+	}
+	if err = s.sb.Init("", "encoder"); err != nil {
+		return
+	}
+
+	// Every injection made while encoding a message is appended to the
+	// encoded output.
+	s.sb.InjectMessage(func(payload, payload_type, payload_name string) int {
+		s.output = append(s.output, payload...)
+		return 0
+	})
+	return
+}
+
+func (s *SandboxEncoder) Encode(pack *pipeline.PipelinePack) (output []byte, err error) {
+	if s.sb == nil {
+		err = s.err
+		return
+	}
+	s.output = nil
+	retval := s.sb.ProcessMessage(pack)
+	if retval > 0 {
+		s.err = errors.New("FATAL: " + s.sb.LastError())
+		s.sb.Destroy("")
+		s.sb = nil
+		err = s.err
+		return
+	}
+	if retval < 0 {
+		err = errors.New("Failed encoding message")
+		return
+	}
+	output = s.output
+	s.output = nil
+	return
+}
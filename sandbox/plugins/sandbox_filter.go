@@ -17,11 +17,11 @@ package plugins
 
 import (
 	"code.google.com/p/goprotobuf/proto"
+	"errors"
 	"fmt"
 	"github.com/mozilla-services/heka/message"
 	"github.com/mozilla-services/heka/pipeline"
 	. "github.com/mozilla-services/heka/sandbox"
-	"github.com/mozilla-services/heka/sandbox/lua"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -58,6 +58,10 @@ type SandboxFilter struct {
 	timerEventDuration     int64
 	reportLock             sync.Mutex
 	name                   string
+	// Closed when Run has exited and the sandbox's data is preserved.
+	stopped chan struct{}
+	// One in how many messages ProcessMessage is timed.
+	sampleDenominator int
 }
 
 func (this *SandboxFilter) ConfigStruct() interface{} {
@@ -79,22 +83,18 @@ func (s *SandboxFilter) IsStoppable() {
 }
 
 // Determines the script type and creates interpreter
+func (this *SandboxFilter) SetSampleDenominator(denominator int) {
+	this.sampleDenominator = denominator
+}
+
 func (this *SandboxFilter) Init(config interface{}) (err error) {
 	if this.sb != nil {
 		return nil // no-op already initialized
 	}
 	this.sbc = config.(*SandboxConfig)
 	this.sbc.ScriptFilename = pipeline.GetHekaConfigDir(this.sbc.ScriptFilename)
-
-	switch this.sbc.ScriptType {
-	case "lua":
-		this.sb, err = lua.CreateLuaSandbox(this.sbc)
-		if err != nil {
-			return
-		}
-	default:
-		return fmt.Errorf("unsupported script type: %s", this.sbc.ScriptType)
-	}
+	this.stopped = make(chan struct{})
+	this.sampleDenominator = pipeline.DURATION_SAMPLE_DENOMINATOR
 
 	data_dir := pipeline.GetHekaConfigDir("sandbox_preservation")
 	if !fileExists(data_dir) {
@@ -105,12 +105,7 @@ func (this *SandboxFilter) Init(config interface{}) (err error) {
 	}
 
 	this.preservationFile = filepath.Join(data_dir, this.name+".data")
-	if this.sbc.PreserveData && fileExists(this.preservationFile) {
-		err = this.sb.Init(this.preservationFile, "filter")
-	} else {
-		err = this.sb.Init("", "filter")
-	}
-
+	this.sb, err = initSandbox(this.sbc, this.preservationFile, "filter")
 	return
 }
 
@@ -176,6 +171,19 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 		capacity       = cap(inChan) - 1
 	)
 
+	store, err := h.KVStore(fr.Name())
+	if err != nil {
+		return err
+	}
+	this.sb.KeyValueStore(store)
+	this.sb.Lookup(func(table, key string) (value string, ok bool) {
+		var t *pipeline.LookupTable
+		if t, ok = h.LookupTable(table); ok {
+			value, ok = t.Lookup(key)
+		}
+		return
+	})
+
 	this.sb.InjectMessage(func(payload, payload_type, payload_name string) int {
 		if injectionCount == 0 {
 			fr.LogError(fmt.Errorf("exceeded InjectMessage count"))
@@ -270,9 +278,16 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 				if retval < 0 {
 					atomic.AddInt64(&this.processMessageFailures, 1)
 				}
-				sample = 0 == rand.Intn(pipeline.DURATION_SAMPLE_DENOMINATOR)
+				sample = 0 == rand.Intn(this.sampleDenominator)
 			} else {
 				terminated = true
+				// The pack is shared with the other consumers, dead-letter a
+				// copy of the message that killed the sandbox.
+				if dl := h.PipelinePack(pack.MsgLoopCount); dl != nil {
+					dl.Message = message.CopyMessage(pack.Message)
+					h.PipelineConfig().DeadLetter(dl, fr.Name(),
+						errors.New(this.sb.LastError()))
+				}
 			}
 			pack.Recycle()
 
@@ -321,11 +336,10 @@ func (this *SandboxFilter) Run(fr pipeline.FilterRunner, h pipeline.PluginHelper
 		}
 	}
 
-	if this.sbc.PreserveData {
-		this.sb.Destroy(this.preservationFile)
-	} else {
-		this.sb.Destroy("")
+	if e := destroySandbox(this.sb, this.sbc, this.preservationFile); e != nil {
+		fr.LogError(e)
 	}
 	this.sb = nil
+	close(this.stopped)
 	return
 }
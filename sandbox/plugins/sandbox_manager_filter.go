@@ -30,6 +30,9 @@ import (
 	"time"
 )
 
+// How long a reload waits for the running version of a filter to stop.
+var sandboxStopTimeout = 10 * time.Second
+
 // Heka Filter plugin that listens for (signed) control messages and
 // dynamically creates, manages, and destroys sandboxed filter scripts as
 // instructed.
@@ -39,6 +42,13 @@ type SandboxManagerFilter struct {
 	workingDirectory    string
 	moduleDirectory     string
 	processMessageCount int64
+	// The manager's cgroup, which the filters it starts run in unless they
+	// set their own.
+	cgroup string
+	// Tenants the manager is scoped to, its filters can't see any other
+	// tenant's messages. A manager scoped to a single tenant counts its
+	// filters against the tenant's `max_sandboxes`.
+	tenants []string
 }
 
 // Config struct for `SandboxManagerFilter`.
@@ -108,6 +118,20 @@ func (this *SandboxManagerFilter) createRunner(dir, name string, configSection t
 		return nil, fmt.Errorf("Plugin must be a SandboxFilter, received %s",
 			pluginGlobals.Typ)
 	}
+	if pluginGlobals.Cgroup == "" {
+		pluginGlobals.Cgroup = this.cgroup
+	}
+	if len(this.tenants) > 0 {
+		if len(pluginGlobals.Tenants) == 0 {
+			pluginGlobals.Tenants = this.tenants
+		}
+		for _, tenant := range pluginGlobals.Tenants {
+			if !this.hasTenant(tenant) {
+				return nil, fmt.Errorf("'%s' isn't allowed tenant '%s'", wrapper.Name,
+					tenant)
+			}
+		}
+	}
 
 	// Create plugin, test config object generation.
 	wrapper.PluginCreator, _ = pipeline.AvailablePlugins[pluginGlobals.Typ]
@@ -143,12 +167,37 @@ func (this *SandboxManagerFilter) createRunner(dir, name string, configSection t
 			return nil, fmt.Errorf("Can't create message matcher for '%s': %s",
 				wrapper.Name, err)
 		}
+		matcher.SetTenants(pluginGlobals.Tenants)
 		runner.SetMatchRunner(matcher)
 	}
 
 	return runner, nil
 }
 
+func (this *SandboxManagerFilter) hasTenant(name string) bool {
+	for _, tenant := range this.tenants {
+		if tenant == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Takes one of the tenant's sandbox slots if the manager is scoped to a
+// single tenant.
+func (this *SandboxManagerFilter) acquireSandbox(h pipeline.PluginHelper) error {
+	if len(this.tenants) != 1 {
+		return nil
+	}
+	return h.PipelineConfig().AcquireTenantSandbox(this.tenants[0])
+}
+
+func (this *SandboxManagerFilter) releaseSandbox(h pipeline.PluginHelper) {
+	if len(this.tenants) == 1 {
+		h.PipelineConfig().ReleaseTenantSandbox(this.tenants[0])
+	}
+}
+
 // Replaces all non word characters with an underscore and returns the
 // normalized string
 func getNormalizedName(name string) (normalized string) {
@@ -187,9 +236,17 @@ func (this *SandboxManagerFilter) loadSandbox(fr pipeline.FilterRunner,
 		} else {
 			for name, conf := range configFile {
 				name = getSandboxName(fr.Name(), name)
-				if _, ok := h.Filter(name); ok {
-					// todo support reload
-					return fmt.Errorf("loadSandbox failed: %s is already running", name)
+				if running, ok := h.Filter(name); ok {
+					// The running version is stopped first so the data it
+					// preserves is restored by the new one.
+					fr.LogMessage(fmt.Sprintf("Reloading: %s", name))
+					if err = this.stopSandbox(h, running); err != nil {
+						return fmt.Errorf("loadSandbox failed: %s", err)
+					}
+				}
+				if this.currentFilters >= this.maxFilters {
+					return fmt.Errorf("%s attempted to load more than %d filters",
+						fr.Name(), this.maxFilters)
 				}
 				fr.LogMessage(fmt.Sprintf("Loading: %s", name))
 				confFile := filepath.Join(dir, fmt.Sprintf("%s.toml", name))
@@ -213,9 +270,15 @@ func (this *SandboxManagerFilter) loadSandbox(fr pipeline.FilterRunner,
 					removeAll(dir, fmt.Sprintf("%s.*", name))
 					return
 				}
+				if err = this.acquireSandbox(h); err != nil {
+					removeAll(dir, fmt.Sprintf("%s.*", name))
+					return
+				}
 				err = h.PipelineConfig().AddFilterRunner(runner)
 				if err == nil {
 					this.currentFilters++
+				} else {
+					this.releaseSandbox(h)
 				}
 				break // only interested in the first item
 			}
@@ -224,6 +287,29 @@ func (this *SandboxManagerFilter) loadSandbox(fr pipeline.FilterRunner,
 	return
 }
 
+// Stops a running SandboxFilter and waits for it to exit, which is when it
+// preserves its data.
+func (this *SandboxManagerFilter) stopSandbox(h pipeline.PluginHelper,
+	runner pipeline.FilterRunner) error {
+
+	sbf, _ := runner.Filter().(*SandboxFilter)
+	if !h.PipelineConfig().RemoveFilterRunner(runner.Name()) {
+		return fmt.Errorf("%s can't be stopped", runner.Name())
+	}
+	this.currentFilters--
+	this.releaseSandbox(h)
+	if sbf == nil {
+		return nil
+	}
+	select {
+	case <-sbf.stopped:
+	case <-time.After(sandboxStopTimeout):
+		return fmt.Errorf("%s didn't stop within %s", runner.Name(),
+			sandboxStopTimeout)
+	}
+	return nil
+}
+
 // On Heka restarts this function reloads all previously running SandboxFilters
 // using the script, configuration, and preservation files in the working
 // directory.
@@ -246,9 +332,14 @@ func (this *SandboxManagerFilter) restoreSandboxes(fr pipeline.FilterRunner, h p
 						removeAll(dir, fmt.Sprintf("%s.*", name))
 						break
 					}
+					if err = this.acquireSandbox(h); err != nil {
+						fr.LogError(err)
+						break
+					}
 					err = h.PipelineConfig().AddFilterRunner(runner)
 					if err != nil {
 						fr.LogError(err)
+						this.releaseSandbox(h)
 					} else {
 						this.currentFilters++
 					}
@@ -266,6 +357,10 @@ func (this *SandboxManagerFilter) Run(fr pipeline.FilterRunner, h pipeline.Plugi
 	var pack *pipeline.PipelinePack
 	var delta int64
 
+	if globals := fr.PluginGlobals(); globals != nil {
+		this.cgroup = globals.Cgroup
+		this.tenants = globals.Tenants
+	}
 	this.restoreSandboxes(fr, h, this.workingDirectory)
 	for ok {
 		select {
@@ -283,14 +378,9 @@ func (this *SandboxManagerFilter) Run(fr pipeline.FilterRunner, h pipeline.Plugi
 			action, _ := pack.Message.GetFieldValue("action")
 			switch action {
 			case "load":
-				if this.currentFilters < this.maxFilters {
-					err := this.loadSandbox(fr, h, this.workingDirectory, pack.Message)
-					if err != nil {
-						fr.LogError(err)
-					}
-				} else {
-					fr.LogError(fmt.Errorf("%s attempted to load more than %d filters",
-						fr.Name(), this.maxFilters))
+				err := this.loadSandbox(fr, h, this.workingDirectory, pack.Message)
+				if err != nil {
+					fr.LogError(err)
 				}
 			case "unload":
 				fv, _ := pack.Message.GetFieldValue("name")
@@ -298,6 +388,7 @@ func (this *SandboxManagerFilter) Run(fr pipeline.FilterRunner, h pipeline.Plugi
 					name = getSandboxName(fr.Name(), name)
 					if h.PipelineConfig().RemoveFilterRunner(name) {
 						this.currentFilters--
+						this.releaseSandbox(h)
 						removeAll(this.workingDirectory, fmt.Sprintf("%s.*", name))
 					}
 				}
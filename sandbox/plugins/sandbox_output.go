@@ -0,0 +1,209 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mozilla-services/heka/message"
+	"github.com/mozilla-services/heka/pipeline"
+	. "github.com/mozilla-services/heka/sandbox"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Time allowed for establishing a network connection to a write_output
+// target.
+const outputDialTimeout = 5 * time.Second
+
+// Heka Output plugin that acts as a wrapper for sandboxed output scripts. The
+// script builds its data with output() and delivers it with
+// write_output(target), where target is a "file://", "tcp://", or "udp://"
+// URL. Targets are opened on first use and kept open until a write fails.
+type SandboxOutput struct {
+	sb                     Sandbox
+	sbc                    *SandboxConfig
+	preservationFile       string
+	processMessageCount    int64
+	processMessageFailures int64
+	reportLock             sync.Mutex
+	name                   string
+	targets                map[string]io.WriteCloser
+}
+
+func (s *SandboxOutput) ConfigStruct() interface{} {
+	return &SandboxConfig{
+		ModuleDirectory:  pipeline.GetHekaConfigDir("lua_modules"),
+		MemoryLimit:      8 * 1024 * 1024,
+		InstructionLimit: 1e6,
+		OutputLimit:      63 * 1024,
+	}
+}
+
+func (s *SandboxOutput) SetName(name string) {
+	re := regexp.MustCompile("\\W")
+	s.name = re.ReplaceAllString(name, "_")
+}
+
+// Determines the script type and creates interpreter
+func (s *SandboxOutput) Init(config interface{}) (err error) {
+	if s.sb != nil {
+		return // no-op already initialized
+	}
+	s.sbc = config.(*SandboxConfig)
+	s.sbc.ScriptFilename = pipeline.GetHekaConfigDir(s.sbc.ScriptFilename)
+	s.targets = make(map[string]io.WriteCloser)
+
+	data_dir := pipeline.GetHekaConfigDir("sandbox_preservation")
+	if !fileExists(data_dir) {
+		err = os.MkdirAll(data_dir, 0700)
+		if err != nil {
+			return
+		}
+	}
+
+	s.preservationFile = filepath.Join(data_dir, s.name+".data")
+	s.sb, err = initSandbox(s.sbc, s.preservationFile, "output")
+	return
+}
+
+// Opens the write_output target described by the URL.
+func openOutputTarget(target string) (w io.WriteCloser, err error) {
+	var u *url.URL
+	if u, err = url.Parse(target); err != nil {
+		return
+	}
+	switch u.Scheme {
+	case "file":
+		if u.Path == "" {
+			return nil, errors.New("missing file path")
+		}
+		return os.OpenFile(u.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	case "tcp", "udp":
+		if u.Host == "" {
+			return nil, errors.New("missing network address")
+		}
+		return net.DialTimeout(u.Scheme, u.Host, outputDialTimeout)
+	}
+	return nil, fmt.Errorf("unsupported scheme: '%s'", u.Scheme)
+}
+
+// Writes the script output to the target, opening the target if necessary.
+// A target that fails is closed so the next write will reopen it.
+func (s *SandboxOutput) writeOutput(or pipeline.OutputRunner, output,
+	target string) int {
+
+	var err error
+	w, ok := s.targets[target]
+	if !ok {
+		if w, err = openOutputTarget(target); err != nil {
+			or.LogError(fmt.Errorf("can't open write_output target '%s': %s",
+				target, err))
+			return 1
+		}
+		s.targets[target] = w
+	}
+	if _, err = io.WriteString(w, output); err != nil {
+		or.LogError(fmt.Errorf("write_output to '%s' failed: %s", target, err))
+		w.Close()
+		delete(s.targets, target)
+		return 1
+	}
+	return 0
+}
+
+// Satisfies the `pipeline.ReportingPlugin` interface to provide sandbox state
+// information to the Heka report and dashboard.
+func (s *SandboxOutput) ReportMsg(msg *message.Message) error {
+	s.reportLock.Lock()
+	defer s.reportLock.Unlock()
+	if s.sb == nil {
+		return fmt.Errorf("Output is not running")
+	}
+
+	message.NewIntField(msg, "Memory", int(s.sb.Usage(TYPE_MEMORY,
+		STAT_CURRENT)), "B")
+	message.NewIntField(msg, "MaxMemory", int(s.sb.Usage(TYPE_MEMORY,
+		STAT_MAXIMUM)), "B")
+	message.NewIntField(msg, "MaxInstructions", int(s.sb.Usage(
+		TYPE_INSTRUCTIONS, STAT_MAXIMUM)), "count")
+	message.NewIntField(msg, "MaxOutput", int(s.sb.Usage(TYPE_OUTPUT,
+		STAT_MAXIMUM)), "B")
+	message.NewInt64Field(msg, "ProcessMessageCount", atomic.LoadInt64(&s.processMessageCount), "count")
+	message.NewInt64Field(msg, "ProcessMessageFailures", atomic.LoadInt64(&s.processMessageFailures), "count")
+	return nil
+}
+
+func (s *SandboxOutput) Run(or pipeline.OutputRunner, h pipeline.PluginHelper) (err error) {
+	var (
+		ok         = true
+		terminated = false
+		pack       *pipeline.PipelinePack
+		retval     int
+	)
+	inChan := or.InChan()
+	ticker := or.Ticker()
+
+	s.sb.WriteOutput(func(output, target string) int {
+		return s.writeOutput(or, output, target)
+	})
+
+	for ok && !terminated {
+		select {
+		case pack, ok = <-inChan:
+			if !ok {
+				break
+			}
+			atomic.AddInt64(&s.processMessageCount, 1)
+			retval = s.sb.ProcessMessage(pack)
+			if retval > 0 {
+				terminated = true
+			} else if retval < 0 {
+				atomic.AddInt64(&s.processMessageFailures, 1)
+			}
+			pack.Recycle()
+
+		case t := <-ticker:
+			if retval = s.sb.TimerEvent(t.UnixNano()); retval != 0 {
+				terminated = true
+			}
+		}
+	}
+
+	if terminated {
+		err = fmt.Errorf("FATAL: %s", s.sb.LastError())
+	}
+	for target, w := range s.targets {
+		w.Close()
+		delete(s.targets, target)
+	}
+
+	s.reportLock.Lock()
+	if terminated {
+		s.sb.Destroy("")
+	} else if e := destroySandbox(s.sb, s.sbc, s.preservationFile); e != nil {
+		or.LogError(e)
+	}
+	s.sb = nil
+	s.reportLock.Unlock()
+	return
+}
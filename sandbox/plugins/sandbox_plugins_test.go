@@ -24,6 +24,7 @@ import (
 	pm "github.com/mozilla-services/heka/pipelinemock"
 	"github.com/mozilla-services/heka/sandbox"
 	gs "github.com/rafrombrc/gospec/src/gospec"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -36,6 +37,8 @@ func TestAllSpecs(t *testing.T) {
 
 	r.AddSpec(FilterSpec)
 	r.AddSpec(DecoderSpec)
+	r.AddSpec(EncoderSpec)
+	r.AddSpec(OutputSpec)
 
 	gs.MainGoTest(r, t)
 }
@@ -95,7 +98,8 @@ func FilterSpec(c gs.Context) {
 			var timer <-chan time.Time
 			fth.MockFilterRunner.EXPECT().Ticker().Return(timer)
 			fth.MockFilterRunner.EXPECT().InChan().Return(inChan)
-			fth.MockFilterRunner.EXPECT().Name().Return("processinject").Times(3)
+			fth.MockFilterRunner.EXPECT().Name().Return("processinject").Times(4)
+			fth.MockHelper.EXPECT().KVStore("processinject").Return(nil, nil)
 			fth.MockFilterRunner.EXPECT().Inject(pack).Return(true).Times(2)
 			fth.MockHelper.EXPECT().PipelineConfig().Return(pConfig)
 			fth.MockHelper.EXPECT().PipelinePack(uint(0)).Return(pack).Times(2)
@@ -114,7 +118,8 @@ func FilterSpec(c gs.Context) {
 			timer = time.Tick(time.Duration(1) * time.Millisecond)
 			fth.MockFilterRunner.EXPECT().Ticker().Return(timer)
 			fth.MockFilterRunner.EXPECT().InChan().Return(inChan)
-			fth.MockFilterRunner.EXPECT().Name().Return("timerinject").Times(12)
+			fth.MockFilterRunner.EXPECT().Name().Return("timerinject").Times(13)
+			fth.MockHelper.EXPECT().KVStore("timerinject").Return(nil, nil)
 			fth.MockFilterRunner.EXPECT().Inject(pack).Return(true).Times(11)
 			fth.MockHelper.EXPECT().PipelineConfig().Return(pConfig)
 			fth.MockHelper.EXPECT().PipelinePack(uint(0)).Return(pack).Times(11)
@@ -129,6 +134,42 @@ func FilterSpec(c gs.Context) {
 			}()
 			sbFilter.Run(fth.MockFilterRunner, fth.MockHelper)
 		})
+
+		c.Specify("Starts fresh when the preserved data is unusable", func() {
+			tmpDir, err := ioutil.TempDir("", "sbfilter-tests")
+			c.Assume(err, gs.IsNil)
+			defer os.RemoveAll(tmpDir)
+			dataFile := filepath.Join(tmpDir, "counter.data")
+			writeData := func(data string, version int) {
+				err := ioutil.WriteFile(dataFile, []byte(data), 0600)
+				c.Assume(err, gs.IsNil)
+				err = ioutil.WriteFile(preservationVersionFile(dataFile),
+					[]byte(fmt.Sprint(version)), 0600)
+				c.Assume(err, gs.IsNil)
+			}
+			config.ScriptFilename = "../lua/testsupport/simple_count.lua"
+			config.PreserveData = true
+
+			c.Specify("because of its preservation_version", func() {
+				writeData("count = 1\n", 1)
+				c.Expect(usablePreservedData(dataFile, 1), gs.IsTrue)
+				c.Expect(usablePreservedData(dataFile, 2), gs.IsFalse)
+				c.Expect(fileExists(dataFile), gs.IsFalse)
+				c.Expect(fileExists(preservationVersionFile(dataFile)), gs.IsFalse)
+			})
+
+			c.Specify("because it can't be restored", func() {
+				writeData("count = \n", 0)
+				sb, err := initSandbox(config, dataFile, "filter")
+				c.Expect(err, gs.IsNil)
+				c.Expect(fileExists(dataFile), gs.IsFalse)
+				c.Expect(destroySandbox(sb, config, dataFile), gs.IsNil)
+				c.Expect(fileExists(dataFile), gs.IsTrue)
+				data, err := ioutil.ReadFile(preservationVersionFile(dataFile))
+				c.Expect(err, gs.IsNil)
+				c.Expect(string(data), gs.Equals, "0")
+			})
+		})
 	})
 
 	c.Specify("A SandboxManagerFilter", func() {
@@ -290,3 +331,112 @@ func DecoderSpec(c gs.Context) {
 		})
 	})
 }
+
+func EncoderSpec(c gs.Context) {
+	// NewPipelineConfig sets up Globals which is needed for the
+	// pipeline.GetHekaConfigDir() to not die during plugin Init()
+	_ = pipeline.NewPipelineConfig(nil)
+
+	c.Specify("A SandboxEncoder", func() {
+		encoder := new(SandboxEncoder)
+		conf := encoder.ConfigStruct().(*sandbox.SandboxConfig)
+		conf.ScriptFilename = "../lua/testsupport/encoder.lua"
+		conf.ScriptType = "lua"
+		supply := make(chan *pipeline.PipelinePack, 1)
+		pack := pipeline.NewPipelinePack(supply)
+		pack.Message = getTestMessage()
+		err := encoder.Init(conf)
+		c.Assume(err, gs.IsNil)
+
+		c.Specify("encodes a message", func() {
+			output, err := encoder.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(output), gs.Equals, "my.host.name|Test Payload\n")
+		})
+
+		c.Specify("skips a message when nothing is injected", func() {
+			pack.Message.SetHostname("skip.me")
+			output, err := encoder.Encode(pack)
+			c.Expect(err, gs.IsNil)
+			c.Expect(output, gs.IsNil)
+		})
+
+		c.Specify("returns an error when encoding fails", func() {
+			pack.Message.SetHostname("")
+			output, err := encoder.Encode(pack)
+			c.Expect(err, gs.Not(gs.IsNil))
+			c.Expect(output, gs.IsNil)
+		})
+	})
+}
+
+func OutputSpec(c gs.Context) {
+	t := new(ts.SimpleT)
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pConfig := pipeline.NewPipelineConfig(nil)
+	oRunner := pm.NewMockOutputRunner(ctrl)
+	helper := pm.NewMockPluginHelper(ctrl)
+	inChan := make(chan *pipeline.PipelinePack, 1)
+
+	c.Specify("A SandboxOutput", func() {
+		tmpDir, err := ioutil.TempDir("", "sandbox-output")
+		c.Assume(err, gs.IsNil)
+		defer os.RemoveAll(tmpDir)
+		path := filepath.Join(tmpDir, "out.txt")
+
+		output := new(SandboxOutput)
+		output.SetName("SandboxOutput")
+		conf := output.ConfigStruct().(*sandbox.SandboxConfig)
+		conf.ScriptFilename = "../lua/testsupport/output.lua"
+		conf.ScriptType = "lua"
+		conf.Config = map[string]interface{}{"target": "file://" + path}
+
+		pack := pipeline.NewPipelinePack(pConfig.InputRecycleChan())
+		pack.Message = getTestMessage()
+
+		c.Specify("writes messages and timer output to a file", func() {
+			timer := make(chan time.Time, 1)
+			oRunner.EXPECT().InChan().Return(inChan)
+			oRunner.EXPECT().Ticker().Return((<-chan time.Time)(timer))
+			err = output.Init(conf)
+			c.Assume(err, gs.IsNil)
+
+			done := make(chan error)
+			go func() {
+				done <- output.Run(oRunner, helper)
+			}()
+			inChan <- pack
+			// Wait for the pack to be recycled before firing the timer.
+			<-pConfig.InputRecycleChan()
+			timer <- time.Now()
+			for len(timer) > 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			close(inChan)
+			c.Expect(<-done, gs.IsNil)
+
+			contents, err := ioutil.ReadFile(path)
+			c.Expect(err, gs.IsNil)
+			c.Expect(string(contents), gs.Equals, "Test Payload\ncount:1\n")
+		})
+
+		c.Specify("logs an error for an unsupported target", func() {
+			var timer <-chan time.Time
+			conf.Config["target"] = "ftp://example.com/out"
+			oRunner.EXPECT().InChan().Return(inChan)
+			oRunner.EXPECT().Ticker().Return(timer)
+			oRunner.EXPECT().LogError(fmt.Errorf(
+				"can't open write_output target 'ftp://example.com/out': unsupported scheme: 'ftp'"))
+			err = output.Init(conf)
+			c.Assume(err, gs.IsNil)
+
+			inChan <- pack
+			close(inChan)
+			err = output.Run(oRunner, helper)
+			c.Expect(err, gs.IsNil)
+			c.Expect(output.processMessageFailures, gs.Equals, int64(1))
+		})
+	})
+}
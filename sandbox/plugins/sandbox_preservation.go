@@ -0,0 +1,105 @@
+/***** BEGIN LICENSE BLOCK *****
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this file,
+# You can obtain one at http://mozilla.org/MPL/2.0/.
+#
+# The Initial Developer of the Original Code is the Mozilla Foundation.
+# Portions created by the Initial Developer are Copyright (C) 2014
+# the Initial Developer. All Rights Reserved.
+#
+# Contributor(s):
+#   Mike Trinkala (trink@mozilla.com)
+#   Rob Miller (rmiller@mozilla.com)
+#
+# ***** END LICENSE BLOCK *****/
+
+package plugins
+
+import (
+	"fmt"
+	. "github.com/mozilla-services/heka/sandbox"
+	"github.com/mozilla-services/heka/sandbox/lua"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Returns the file recording the preservation_version the data file was
+// written with.
+func preservationVersionFile(dataFile string) string {
+	return strings.TrimSuffix(dataFile, ".data") + ".version"
+}
+
+// Removes a preservation data file along with its version.
+func removePreservedData(dataFile string) {
+	os.Remove(dataFile)
+	os.Remove(preservationVersionFile(dataFile))
+}
+
+// Returns whether the data file exists and was written by a script with the
+// given preservation_version. Data preserved with a different version is
+// removed so the sandbox starts fresh. Files without a version predate the
+// setting and match version 0.
+func usablePreservedData(dataFile string, version int) bool {
+	if !fileExists(dataFile) {
+		return false
+	}
+	preserved := 0
+	if data, err := ioutil.ReadFile(preservationVersionFile(dataFile)); err == nil {
+		if preserved, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			preserved = -1
+		}
+	}
+	if preserved != version {
+		log.Printf("Discarding %s: preserved with preservation_version %d, "+
+			"the script has %d", dataFile, preserved, version)
+		removePreservedData(dataFile)
+		return false
+	}
+	return true
+}
+
+// Creates and initializes the sandbox, restoring the preserved global data if
+// it's usable. Data that can't be restored (e.g. the script changed without
+// bumping its preservation_version) is discarded and the sandbox starts
+// fresh, rather than failing the plugin.
+func initSandbox(sbc *SandboxConfig, dataFile, pluginType string) (
+	sb Sandbox, err error) {
+
+	if sbc.ScriptType != "lua" {
+		return nil, fmt.Errorf("unsupported script type: %s", sbc.ScriptType)
+	}
+	if sb, err = lua.CreateLuaSandbox(sbc); err != nil {
+		return
+	}
+	if !sbc.PreserveData || !usablePreservedData(dataFile, sbc.PreservationVersion) {
+		err = sb.Init("", pluginType)
+		return
+	}
+	if err = sb.Init(dataFile, pluginType); err == nil {
+		return
+	}
+	log.Printf("Discarding %s, it can't be restored: %s", dataFile, err)
+	sb.Destroy("")
+	removePreservedData(dataFile)
+	if sb, err = lua.CreateLuaSandbox(sbc); err != nil {
+		return
+	}
+	err = sb.Init("", pluginType)
+	return
+}
+
+// Destroys the sandbox, preserving its global data and the script's
+// preservation_version if preserve_data is set.
+func destroySandbox(sb Sandbox, sbc *SandboxConfig, dataFile string) error {
+	if !sbc.PreserveData {
+		return sb.Destroy("")
+	}
+	if err := sb.Destroy(dataFile); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(preservationVersionFile(dataFile),
+		[]byte(strconv.Itoa(sbc.PreservationVersion)), 0600)
+}
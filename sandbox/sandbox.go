@@ -44,8 +44,13 @@ type Sandbox interface {
 	ProcessMessage(pack *pipeline.PipelinePack) int
 	TimerEvent(ns int64) int
 
-	// Go callback
+	// Go callbacks
 	InjectMessage(f func(payload, payload_type, payload_name string) int)
+	WriteOutput(f func(output, target string) int)
+	// Backs the kv_get, kv_set and kv_delete functions of filters.
+	KeyValueStore(store *pipeline.KVStore)
+	// Backs the lookup function of filters.
+	Lookup(f func(table, key string) (value string, ok bool))
 }
 
 type SandboxConfig struct {
@@ -58,4 +63,7 @@ type SandboxConfig struct {
 	OutputLimit      uint   `toml:"output_limit"`
 	Profile          bool
 	Config           map[string]interface{}
+	// Bumped when a script change makes previously preserved data
+	// incompatible, the data is then discarded instead of restored.
+	PreservationVersion int `toml:"preservation_version"`
 }